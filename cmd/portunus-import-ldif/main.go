@@ -0,0 +1,140 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldif"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/errext"
+)
+
+const usage = `Usage: portunus-import-ldif [-format database|seed] [<file>]
+
+Reads an LDIF export of an existing LDAP directory (from <file> or from stdin)
+and prints the users and groups therein in the format of Portunus' database
+file (the default) or in the format of a seed file. If the result contains
+validation errors, it is still printed, but the exit code will be non-zero.
+
+Password hashes can only be carried over into the database format, and only if
+they are in the {CRYPT}, {SSHA} or {PBKDF2} schemes (or bcrypt hashes without
+scheme prefix). Anything that could not be converted, as well as any validation
+errors in the result, is reported on stderr.
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	format := flag.String("format", "database", `output format ("database" or "seed")`)
+	flag.Parse()
+	if flag.NArg() > 1 || (*format != "database" && *format != "seed") {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := run(*format, flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "portunus-import-ldif: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// defaultNamePattern is the same default as in portunus-orchestrator.
+const defaultNamePattern = `^[a-z_][a-z0-9_-]*\$?$`
+
+func run(format, path string) error {
+	for _, key := range []string{"PORTUNUS_GROUP_NAME_REGEX", "PORTUNUS_USER_NAME_REGEX"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, defaultNamePattern)
+		}
+	}
+	vcfg, err := core.ReadValidationConfigFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	input := io.Reader(os.Stdin)
+	if path != "" && path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+	entries, err := ldif.Parse(input)
+	if err != nil {
+		return err
+	}
+
+	db, warnings := ldif.Import(entries)
+	for _, msg := range warnings {
+		fmt.Fprintln(os.Stderr, "WARNING: "+msg)
+	}
+	var errs errext.ErrorSet
+	if format == "seed" {
+		errs = writeSeed(db, vcfg)
+	} else {
+		errs = db.Validate(vcfg)
+		var buf []byte
+		buf, err = store.MarshalDatabase(db)
+		errs.Add(err)
+		_, err = os.Stdout.Write(buf)
+		errs.Add(err)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "imported %d users and %d groups with %d warnings and %d errors\n",
+		len(db.Users), len(db.Groups), len(warnings), len(errs))
+	if !errs.IsEmpty() {
+		return errors.New("the result needs to be fixed manually before it can be used")
+	}
+	return nil
+}
+
+// writeSeed prints the given database in the seed format.
+func writeSeed(db core.Database, vcfg *core.ValidationConfig) (errs errext.ErrorSet) {
+	//Seeds contain plain-text passwords, so the hashes cannot be retained.
+	for idx := range db.Users {
+		db.Users[idx].PasswordHash = ""
+	}
+
+	//The seed format uses the same field names as the database format, so one
+	//can be converted into the other through a JSON roundtrip.
+	buf, err := json.Marshal(struct {
+		Users  []core.User  `json:"users"`
+		Groups []core.Group `json:"groups"`
+	}{db.Users, db.Groups})
+	if err != nil {
+		errs.Add(err)
+		return errs
+	}
+	var seed core.DatabaseSeed
+	err = json.Unmarshal(buf, &seed)
+	if err != nil {
+		errs.Add(err)
+		return errs
+	}
+	errs.Append(seed.Validate(vcfg))
+
+	buf, err = json.MarshalIndent(seed, "", "  ")
+	if err != nil {
+		errs.Add(err)
+		return errs
+	}
+	buf = append(buf, '\n')
+	_, err = os.Stdout.Write(buf)
+	errs.Add(err)
+	return errs
+}
@@ -0,0 +1,323 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	//How often we check whether the certificate needs to be renewed.
+	acmeRenewalCheckInterval = 12 * time.Hour
+	//Let's Encrypt recommends renewing when a third of the lifetime is left,
+	//which is 30 days for their 90-day certificates.
+	acmeRenewalThreshold = 30 * 24 * time.Hour
+	//How long a single attempt at obtaining a certificate may take.
+	acmeOrderTimeout = 5 * time.Minute
+)
+
+// acmeManager obtains and renews the certificate for
+// PORTUNUS_SLAPD_TLS_DOMAIN_NAME when PORTUNUS_SLAPD_TLS_ACME is set. The
+// account key and the latest certificate are kept in a cache directory below
+// PORTUNUS_SERVER_STATE_DIR, since the slapd state dir is wiped on startup and
+// we do not want to run into the rate limits of the ACME server.
+type acmeManager struct {
+	DomainName   string
+	DirectoryURL string
+	EMail        string //optional
+	HTTPListen   string
+	CachePath    string
+}
+
+func newACMEManager(environment map[string]string) (*acmeManager, error) {
+	m := &acmeManager{
+		DomainName:   environment["PORTUNUS_SLAPD_TLS_DOMAIN_NAME"],
+		DirectoryURL: environment["PORTUNUS_SLAPD_TLS_ACME_DIRECTORY_URL"],
+		EMail:        environment["PORTUNUS_SLAPD_TLS_ACME_EMAIL"],
+		HTTPListen:   environment["PORTUNUS_SLAPD_TLS_ACME_HTTP_LISTEN"],
+		CachePath:    filepath.Join(environment["PORTUNUS_SERVER_STATE_DIR"], "acme"),
+	}
+	//only we as root need to be able to read this (portunus-server does not need the keys)
+	err := os.MkdirAll(m.CachePath, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return m, os.Chmod(m.CachePath, 0700)
+}
+
+// ObtainInitialCertificate returns a certificate that slapd can be started
+// with. A cached certificate is reused if it is not due for renewal yet.
+func (m *acmeManager) ObtainInitialCertificate() (tlsFileSet, error) {
+	cached, expiry, err := m.readCache()
+	if err != nil {
+		logg.Info("no usable ACME certificate in cache: %s", err.Error())
+	} else if time.Until(expiry) > acmeRenewalThreshold {
+		return cached, nil
+	}
+
+	files, err := m.obtainCertificate()
+	if err != nil {
+		//an older certificate is still better than not starting at all; the
+		//renewal will be retried by RenewPeriodically()
+		if cached.Certificate != nil && time.Now().Before(expiry) {
+			logg.Error("could not renew certificate via ACME (using the cached certificate for now): %s", err.Error())
+			return cached, nil
+		}
+		return tlsFileSet{}, fmt.Errorf("could not obtain certificate via ACME: %w", err)
+	}
+	return files, nil
+}
+
+// RenewPeriodically renews the certificate whenever it is due for renewal,
+// and restarts slapd afterwards to load the new certificate. Does not return.
+// Call with `go`.
+func (m *acmeManager) RenewPeriodically(slapdStatePath string, ids map[string]int, restartLDAPServer chan<- struct{}) {
+	for range time.Tick(acmeRenewalCheckInterval) {
+		_, expiry, err := m.readCache()
+		if err == nil && time.Until(expiry) > acmeRenewalThreshold {
+			continue
+		}
+
+		logg.Info("renewing certificate for %s via ACME", m.DomainName)
+		files, err := m.obtainCertificate()
+		if err != nil {
+			logg.Error("could not renew certificate via ACME (will retry in %s): %s",
+				acmeRenewalCheckInterval, err.Error())
+			continue
+		}
+		err = files.CopyInto(slapdStatePath, ids)
+		if err != nil {
+			logg.Error("cannot copy renewed TLS files: %s", err.Error())
+			continue
+		}
+		logg.Info("certificate has been renewed, restarting LDAP server")
+		restartLDAPServer <- struct{}{}
+	}
+}
+
+// Returns the cached certificate and the expiry date of its leaf certificate.
+func (m *acmeManager) readCache() (tlsFileSet, time.Time, error) {
+	var (
+		files tlsFileSet
+		err   error
+	)
+	files.Certificate, err = os.ReadFile(filepath.Join(m.CachePath, "cert.pem"))
+	if err != nil {
+		return tlsFileSet{}, time.Time{}, err
+	}
+	files.PrivateKey, err = os.ReadFile(filepath.Join(m.CachePath, "key.pem"))
+	if err != nil {
+		return tlsFileSet{}, time.Time{}, err
+	}
+	files.CACertificate, err = os.ReadFile(filepath.Join(m.CachePath, "ca.pem"))
+	if err != nil {
+		return tlsFileSet{}, time.Time{}, err
+	}
+
+	block, _ := pem.Decode(files.Certificate)
+	if block == nil {
+		return tlsFileSet{}, time.Time{}, errors.New("cert.pem does not contain a PEM block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return tlsFileSet{}, time.Time{}, err
+	}
+	err = cert.VerifyHostname(m.DomainName)
+	if err != nil {
+		//e.g. because PORTUNUS_SLAPD_TLS_DOMAIN_NAME was changed
+		return tlsFileSet{}, time.Time{}, err
+	}
+	return files, cert.NotAfter, nil
+}
+
+func (m *acmeManager) writeCache(files tlsFileSet) error {
+	for fileName, buf := range map[string][]byte{
+		"cert.pem": files.Certificate,
+		"key.pem":  files.PrivateKey,
+		"ca.pem":   files.CACertificate,
+	} {
+		err := os.WriteFile(filepath.Join(m.CachePath, fileName), buf, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the ACME account key from the cache, or generates a new one.
+func (m *acmeManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.CachePath, "account-key.pem")
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("%s does not contain a PEM block", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	buf = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return key, os.WriteFile(path, buf, 0600)
+}
+
+// Runs through the entire ACME flow, and stores the resulting certificate in
+// the cache if successful.
+func (m *acmeManager) obtainCertificate() (tlsFileSet, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), acmeOrderTimeout)
+	defer cancel()
+
+	accountKey, err := m.accountKey()
+	if err != nil {
+		return tlsFileSet{}, fmt.Errorf("cannot load ACME account key: %w", err)
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: m.DirectoryURL}
+
+	//the operator agrees to the terms of service by setting PORTUNUS_SLAPD_TLS_ACME=true
+	account := &acme.Account{}
+	if m.EMail != "" {
+		account.Contact = []string{"mailto:" + m.EMail}
+	}
+	_, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return tlsFileSet{}, fmt.Errorf("cannot register ACME account: %w", err)
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(m.DomainName))
+	if err != nil {
+		return tlsFileSet{}, fmt.Errorf("cannot create ACME order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		err := m.fulfillAuthorization(ctx, client, authzURL)
+		if err != nil {
+			return tlsFileSet{}, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return tlsFileSet{}, fmt.Errorf("ACME order did not become ready: %w", err)
+	}
+
+	//a fresh key is used for each certificate
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tlsFileSet{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{m.DomainName}}, certKey)
+	if err != nil {
+		return tlsFileSet{}, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return tlsFileSet{}, fmt.Errorf("cannot finalize ACME order: %w", err)
+	}
+	if len(chain) < 2 {
+		return tlsFileSet{}, fmt.Errorf("expected ACME server to return a certificate chain, but got %d certificate(s)", len(chain))
+	}
+
+	certKeyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return tlsFileSet{}, err
+	}
+	files := tlsFileSet{
+		Certificate:   encodeCertificatesAsPEM(chain),
+		PrivateKey:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: certKeyDER}),
+		CACertificate: encodeCertificatesAsPEM(chain[1:]),
+	}
+	return files, m.writeCache(files)
+}
+
+// Solves the http-01 challenge for the given authorization. For the duration
+// of this, an HTTP server is run on PORTUNUS_SLAPD_TLS_ACME_HTTP_LISTEN.
+func (m *acmeManager) fulfillAuthorization(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("cannot get ACME authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil //the domain was validated recently enough
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("ACME server does not offer a http-01 challenge for %s", authz.Identifier.Value)
+	}
+	response, err := client.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+client.HTTP01ChallengePath(challenge.Token), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(response))
+	})
+	server := &http.Server{
+		Addr:              m.HTTPListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serverErrChan := make(chan error, 1)
+	go func() { serverErrChan <- server.ListenAndServe() }()
+	defer server.Close()
+
+	//give the listener a moment to fail before we tell the ACME server to look at it
+	select {
+	case err := <-serverErrChan:
+		return fmt.Errorf("cannot serve ACME challenge on %s: %w", m.HTTPListen, err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = client.Accept(ctx, challenge)
+	if err != nil {
+		return fmt.Errorf("cannot accept ACME challenge: %w", err)
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		return fmt.Errorf("ACME validation of %s failed: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+func encodeCertificatesAsPEM(ders [][]byte) []byte {
+	var result []byte
+	for _, der := range ders {
+		result = append(result, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return result
+}
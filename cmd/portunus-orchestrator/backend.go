@@ -0,0 +1,125 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// ldapBackend knows how to configure and run one particular LDAP server
+// implementation (as selected by PORTUNUS_LDAP_BACKEND). All implementations
+// keep their files in PORTUNUS_SLAPD_STATE_DIR, which is created anew on each
+// start of portunus-orchestrator.
+//
+// With PORTUNUS_LDAP_BACKEND=embedded, there is no ldapBackend since
+// portunus-server serves LDAP by itself.
+type ldapBackend interface {
+	// Setup prepares the state directory before the LDAP server is started for
+	// the first time. Setup must put the password for Portunus' own technical
+	// user into environment["PORTUNUS_LDAP_PASSWORD"].
+	Setup(environment map[string]string, hasher crypt.PasswordHasher) error
+	// Command returns the command that runs the LDAP server in the foreground.
+	// It is called before each start, so it can also refresh files that the
+	// LDAP server only reads on startup.
+	Command(environment map[string]string) (*exec.Cmd, error)
+	// AfterStart is called each time the LDAP server starts accepting
+	// connections.
+	AfterStart(environment map[string]string) error
+	// LogHint is shown when the LDAP server fails, to point the admin to where
+	// the LDAP server's own logs can be found.
+	LogHint() string
+}
+
+// Returns the ldapBackend for the configured PORTUNUS_LDAP_BACKEND, or nil
+// for the embedded LDAP server.
+func newLDAPBackend(environment map[string]string, ids map[string]int, layout ldap.Layout) ldapBackend {
+	switch environment["PORTUNUS_LDAP_BACKEND"] {
+	case "embedded":
+		return nil
+	case "389ds":
+		return &dirsrvBackend{ids, layout}
+	default:
+		return slapdBackend{ids, layout}
+	}
+}
+
+func generateServiceUserPassword() string {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Does not return. Call with `go`. A send on `restart` makes the LDAP server
+// shut down and start again with the same configuration, e.g. to load a
+// renewed TLS certificate. Once the LDAP server accepts connections again,
+// `afterRestart` is called.
+func runLDAPServer(environment map[string]string, backend ldapBackend, restart <-chan struct{}, afterRestart func()) {
+	logg.Info("starting LDAP server")
+	isFirstStart := true
+	for {
+		cmd, err := backend.Command(environment)
+		if err != nil {
+			exitBecauseOfLDAPServer(backend, err)
+		}
+		cmd.Stdin = nil
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Start()
+		if err != nil {
+			exitBecauseOfLDAPServer(backend, err)
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		go func(isFirstStart bool) {
+			err := waitForLDAPServer(environment, 30*time.Second)
+			if err == nil {
+				err = backend.AfterStart(environment)
+			}
+			if err != nil {
+				exitBecauseOfLDAPServer(backend, err)
+			}
+			//on the first start, portunus-server connects by itself
+			if !isFirstStart {
+				afterRestart()
+			}
+		}(isFirstStart)
+		isFirstStart = false
+
+		select {
+		case err := <-exited:
+			if err != nil {
+				exitBecauseOfLDAPServer(backend, err)
+			}
+			return
+		case <-restart:
+			err := cmd.Process.Signal(syscall.SIGTERM)
+			if err != nil {
+				exitBecauseOfLDAPServer(backend, err)
+			}
+			<-exited //we asked the LDAP server to shut down, so its exit status is not interesting
+		}
+	}
+}
+
+func exitBecauseOfLDAPServer(backend ldapBackend, err error) {
+	logg.Error("error encountered while running LDAP server: " + err.Error())
+	logg.Info(backend.LogHint())
+	os.Exit(1)
+}
@@ -8,13 +8,22 @@ package main
 
 import (
 	"fmt"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/envconfig"
 	"github.com/majewsky/portunus/internal/grammars"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/policy"
+	"github.com/majewsky/portunus/internal/siem"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
+	"golang.org/x/crypto/acme"
 )
 
 type valueCheck struct {
@@ -26,37 +35,105 @@ var (
 	userOrGroupPattern = `^[a-z_][a-z0-9_-]*\$?$`
 	envDefaults        = map[string]string{
 		//empty value = not optional
-		"PORTUNUS_DEBUG":              "false",
-		"PORTUNUS_GROUP_NAME_REGEX":   userOrGroupPattern,
-		"PORTUNUS_LDAP_SUFFIX":        "",
-		"PORTUNUS_SERVER_BINARY":      "portunus-server",
-		"PORTUNUS_SERVER_GROUP":       "portunus",
-		"PORTUNUS_SERVER_HTTP_LISTEN": "127.0.0.1:8080",
-		"PORTUNUS_SERVER_HTTP_SECURE": "true",
-		"PORTUNUS_SERVER_STATE_DIR":   "/var/lib/portunus",
-		"PORTUNUS_SERVER_USER":        "portunus",
-		"PORTUNUS_SLAPD_BINARY":       "slapd",
-		"PORTUNUS_SLAPD_GROUP":        "ldap",
-		"PORTUNUS_SLAPD_SCHEMA_DIR":   "/etc/openldap/schema",
-		"PORTUNUS_SLAPD_STATE_DIR":    "/var/run/portunus-slapd",
-		"PORTUNUS_SLAPD_USER":         "ldap",
-		"PORTUNUS_USER_NAME_REGEX":    userOrGroupPattern,
+		"PORTUNUS_DEBUG":                           "false",
+		"PORTUNUS_GROUP_NAME_REGEX":                userOrGroupPattern,
+		"PORTUNUS_HISTORY_DEPTH":                   "10",
+		"PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES":    "false",
+		"PORTUNUS_LDAP_BACKEND":                    "slapd",
+		"PORTUNUS_LDAP_CHANGELOG_SIZE":             "0",
+		"PORTUNUS_LDAP_DISABLED":                   "false",
+		"PORTUNUS_LDAP_DISABLED_USER_HANDLING":     "remove",
+		"PORTUNUS_LDAP_DRIFT_HANDLING":             "ignore",
+		"PORTUNUS_LDAP_RENDER_LABELS":              "false",
+		"PORTUNUS_LDAP_SUFFIX":                     "",
+		"PORTUNUS_PASSWORD_HASH_COST":              "0",
+		"PORTUNUS_POLICY_WEBHOOK_FAIL_OPEN":        "false",
+		"PORTUNUS_POLICY_WEBHOOK_TIMEOUT":          "2s",
+		"PORTUNUS_POSIX_GROUP_LIMIT":               "16",
+		"PORTUNUS_SERVER_BINARY":                   "portunus-server",
+		"PORTUNUS_SERVER_GROUP":                    "portunus",
+		"PORTUNUS_SERVER_HTTP_H2C":                 "false",
+		"PORTUNUS_SERVER_HTTP_IDLE_TIMEOUT":        "2m",
+		"PORTUNUS_SERVER_HTTP_LISTEN":              "127.0.0.1:8080",
+		"PORTUNUS_SERVER_HTTP_MAX_BODY_SIZE":       "1MiB",
+		"PORTUNUS_SERVER_HTTP_READ_HEADER_TIMEOUT": "10s",
+		"PORTUNUS_SERVER_HTTP_READ_TIMEOUT":        "30s",
+		"PORTUNUS_SERVER_HTTP_REQUIRE_HTTPS":       "false",
+		"PORTUNUS_SERVER_HTTP_SECURE":              "true",
+		"PORTUNUS_SERVER_HTTP_WRITE_TIMEOUT":       "30s",
+		"PORTUNUS_SERVER_REMEMBER_LOGIN_NAME":      "true",
+		"PORTUNUS_SERVER_SELF_SERVICE_PRIVACY":     "false",
+		"PORTUNUS_SERVER_STATE_DIR":                "/var/lib/portunus",
+		"PORTUNUS_SERVER_USER":                     "portunus",
+		"PORTUNUS_SIEM_EXPORT_FORMAT":              "json",
+		"PORTUNUS_SLAPD_BINARY":                    "slapd",
+		"PORTUNUS_SLAPD_GROUP":                     "ldap",
+		"PORTUNUS_SLAPD_SCHEMA_DIR":                "/etc/openldap/schema",
+		"PORTUNUS_SLAPD_STATE_DIR":                 "/var/run/portunus-slapd",
+		"PORTUNUS_SLAPD_SYNCPROV":                  "false",
+		"PORTUNUS_SLAPD_TLS_ACME":                  "false",
+		"PORTUNUS_SLAPD_USER":                      "ldap",
+		"PORTUNUS_USER_NAME_REGEX":                 userOrGroupPattern,
+		"PORTUNUS_USER_RETENTION_DAYS":             "30",
 	}
 
 	strictBoolCheck    = valueCheck{isStrictBool, `either "true" or "false"`}
 	ldapSuffixCheck    = valueCheck{grammars.IsLDAPSuffix, `an RDN with only dc= components`}
 	listenAddressCheck = valueCheck{grammars.IsListenAddress, `a listen address like "1.2.3.4:80" or "[::1]:8080"`}
 	posixAcctNameCheck = valueCheck{grammars.IsPOSIXAccountName, "a POSIX account name (see `man 8 useradd` for format description)"}
+	nonnegIntegerCheck = valueCheck{grammars.IsNonnegativeInteger, "a non-negative integer"}
+	durationCheck      = valueCheck{isPositiveDuration, `a positive duration like "30s" or "5m"`}
+	sizeCheck          = valueCheck{isPositiveSize, `a positive size like "512KiB" or "10MiB"`}
+	driftHandlingCheck = valueCheck{isDriftHandling, `one of "ignore", "repair" or "import"`}
+	disabledUserCheck  = valueCheck{isDisabledUserHandling, `either "remove" or "mark"`}
+	ldapBackendCheck   = valueCheck{isLDAPBackend, `one of "slapd", "389ds" or "embedded"`}
+	siemFormatCheck    = valueCheck{isSIEMFormat, `one of "json" or "cef"`}
+	absolutePathCheck  = valueCheck{filepath.IsAbs, "an absolute path"}
+	fileModeCheck      = valueCheck{isFileMode, `an octal file mode like "0660"`}
+	checkpointCheck    = valueCheck{isSyncprovCheckpoint, `two non-negative integers like "100 10"`}
+	policyTimeoutCheck = valueCheck{isPolicyWebhookTimeout, fmt.Sprintf(`a positive duration of at most %q`, policy.MaxTimeout)}
+	extraAttrsCheck    = valueCheck{isExtraUserAttributeList, "a space-separated list of LDAP attribute names that are not managed by Portunus itself"}
 
 	envFormats = map[string]valueCheck{
-		"PORTUNUS_DEBUG":              strictBoolCheck,
-		"PORTUNUS_LDAP_SUFFIX":        ldapSuffixCheck,
-		"PORTUNUS_SERVER_GROUP":       posixAcctNameCheck,
-		"PORTUNUS_SERVER_HTTP_LISTEN": listenAddressCheck,
-		"PORTUNUS_SERVER_HTTP_SECURE": strictBoolCheck,
-		"PORTUNUS_SERVER_USER":        posixAcctNameCheck,
-		"PORTUNUS_SLAPD_GROUP":        posixAcctNameCheck,
-		"PORTUNUS_SLAPD_USER":         posixAcctNameCheck,
+		"PORTUNUS_DEBUG":                           strictBoolCheck,
+		"PORTUNUS_HISTORY_DEPTH":                   nonnegIntegerCheck,
+		"PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES":    strictBoolCheck,
+		"PORTUNUS_LDAP_BACKEND":                    ldapBackendCheck,
+		"PORTUNUS_LDAP_CHANGELOG_SIZE":             nonnegIntegerCheck,
+		"PORTUNUS_LDAP_DISABLED":                   strictBoolCheck,
+		"PORTUNUS_LDAP_DISABLED_USER_HANDLING":     disabledUserCheck,
+		"PORTUNUS_LDAP_DRIFT_HANDLING":             driftHandlingCheck,
+		"PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES":      extraAttrsCheck,
+		"PORTUNUS_LDAP_RENDER_LABELS":              strictBoolCheck,
+		"PORTUNUS_LDAP_SUFFIX":                     ldapSuffixCheck,
+		"PORTUNUS_PASSWORD_HASH_COST":              nonnegIntegerCheck,
+		"PORTUNUS_POLICY_WEBHOOK_FAIL_OPEN":        strictBoolCheck,
+		"PORTUNUS_POLICY_WEBHOOK_TIMEOUT":          policyTimeoutCheck,
+		"PORTUNUS_POSIX_GROUP_LIMIT":               nonnegIntegerCheck,
+		"PORTUNUS_SERVER_GROUP":                    posixAcctNameCheck,
+		"PORTUNUS_SERVER_HTTP_H2C":                 strictBoolCheck,
+		"PORTUNUS_SERVER_HTTP_IDLE_TIMEOUT":        durationCheck,
+		"PORTUNUS_SERVER_HTTP_LISTEN":              listenAddressCheck,
+		"PORTUNUS_SERVER_HTTP_MAX_BODY_SIZE":       sizeCheck,
+		"PORTUNUS_SERVER_HTTP_READ_HEADER_TIMEOUT": durationCheck,
+		"PORTUNUS_SERVER_HTTP_READ_TIMEOUT":        durationCheck,
+		"PORTUNUS_SERVER_HTTP_REQUIRE_HTTPS":       strictBoolCheck,
+		"PORTUNUS_SERVER_HTTP_SECURE":              strictBoolCheck,
+		"PORTUNUS_SERVER_HTTP_WRITE_TIMEOUT":       durationCheck,
+		"PORTUNUS_SERVER_REMEMBER_LOGIN_NAME":      strictBoolCheck,
+		"PORTUNUS_SERVER_SELF_SERVICE_PRIVACY":     strictBoolCheck,
+		"PORTUNUS_SERVER_USER":                     posixAcctNameCheck,
+		"PORTUNUS_SIEM_EXPORT_FORMAT":              siemFormatCheck,
+		"PORTUNUS_SLAPD_GROUP":                     posixAcctNameCheck,
+		"PORTUNUS_SLAPD_LDAPI_SOCKET":              absolutePathCheck,
+		"PORTUNUS_SLAPD_LDAPI_SOCKET_MODE":         fileModeCheck,
+		"PORTUNUS_SLAPD_SYNCPROV":                  strictBoolCheck,
+		"PORTUNUS_SLAPD_SYNCPROV_CHECKPOINT":       checkpointCheck,
+		"PORTUNUS_SLAPD_SYNCPROV_SESSIONLOG":       nonnegIntegerCheck,
+		"PORTUNUS_SLAPD_TLS_ACME":                  strictBoolCheck,
+		"PORTUNUS_SLAPD_TLS_ACME_HTTP_LISTEN":      listenAddressCheck,
+		"PORTUNUS_SLAPD_USER":                      posixAcctNameCheck,
+		"PORTUNUS_USER_RETENTION_DAYS":             nonnegIntegerCheck,
 	}
 )
 
@@ -64,6 +141,60 @@ func isStrictBool(input string) bool {
 	return input == "true" || input == "false"
 }
 
+func isDriftHandling(input string) bool {
+	_, err := ldap.ParseDriftHandling(input)
+	return err == nil
+}
+
+func isDisabledUserHandling(input string) bool {
+	_, err := ldap.ParseDisabledUserHandling(input)
+	return err == nil
+}
+
+func isLDAPBackend(input string) bool {
+	return input == "slapd" || input == "389ds" || input == "embedded"
+}
+
+func isExtraUserAttributeList(input string) bool {
+	_, err := core.ParseExtraUserAttributes(input)
+	return err == nil
+}
+
+func isSIEMFormat(input string) bool {
+	_, err := siem.ParseFormat(input)
+	return err == nil
+}
+
+func isFileMode(input string) bool {
+	if len(input) != 4 || input[0] != '0' {
+		return false
+	}
+	_, err := strconv.ParseUint(input, 8, 32)
+	return err == nil
+}
+
+// The argument of `syncprov-checkpoint` is a number of operations and a
+// number of minutes.
+func isSyncprovCheckpoint(input string) bool {
+	fields := strings.Fields(input)
+	return len(fields) == 2 && grammars.IsNonnegativeInteger(fields[0]) && grammars.IsNonnegativeInteger(fields[1])
+}
+
+func isPositiveDuration(input string) bool {
+	d, err := envconfig.ParseDuration(input)
+	return err == nil && d > 0
+}
+
+func isPolicyWebhookTimeout(input string) bool {
+	d, err := envconfig.ParseDuration(input)
+	return err == nil && d > 0 && d <= policy.MaxTimeout
+}
+
+func isPositiveSize(input string) bool {
+	size, err := envconfig.ParseSize(input)
+	return err == nil && size > 0
+}
+
 func readConfig() (environment map[string]string, ids map[string]int) {
 	//last-minute initializations in envDefaults
 	if os.Getenv("PORTUNUS_SLAPD_TLS_CERTIFICATE") != "" {
@@ -72,6 +203,34 @@ func readConfig() (environment map[string]string, ids map[string]int) {
 		envDefaults["PORTUNUS_SLAPD_TLS_PRIVATE_KEY"] = ""
 		envDefaults["PORTUNUS_SLAPD_TLS_CA_CERTIFICATE"] = ""
 	}
+	if os.Getenv("PORTUNUS_SLAPD_LDAPI_SOCKET") != "" {
+		envDefaults["PORTUNUS_SLAPD_LDAPI_SOCKET"] = ""
+		envDefaults["PORTUNUS_SLAPD_LDAPI_SOCKET_MODE"] = "0666"
+	}
+	if os.Getenv("PORTUNUS_LDAP_BACKEND") == "389ds" {
+		envDefaults["PORTUNUS_SLAPD_BINARY"] = "ns-slapd"
+		envDefaults["PORTUNUS_SLAPD_DSCREATE_BINARY"] = "dscreate"
+		envDefaults["PORTUNUS_SLAPD_GROUP"] = "dirsrv"
+		envDefaults["PORTUNUS_SLAPD_USER"] = "dirsrv"
+	}
+	if os.Getenv("PORTUNUS_SLAPD_TLS_ACME") == "true" {
+		if os.Getenv("PORTUNUS_SLAPD_TLS_CERTIFICATE") != "" {
+			logg.Fatal("PORTUNUS_SLAPD_TLS_ACME and PORTUNUS_SLAPD_TLS_CERTIFICATE cannot be used at the same time")
+		}
+		envDefaults["PORTUNUS_SLAPD_TLS_DOMAIN_NAME"] = ""
+		envDefaults["PORTUNUS_SLAPD_TLS_ACME_DIRECTORY_URL"] = acme.LetsEncryptURL
+		envDefaults["PORTUNUS_SLAPD_TLS_ACME_HTTP_LISTEN"] = "[::]:80"
+	}
+	if os.Getenv("PORTUNUS_SLAPD_SYNCPROV") == "true" {
+		envDefaults["PORTUNUS_SLAPD_SYNCPROV_CHECKPOINT"] = "100 10"
+		envDefaults["PORTUNUS_SLAPD_SYNCPROV_SESSIONLOG"] = "100"
+	}
+	if os.Getenv("PORTUNUS_LDAP_DISABLED") == "true" {
+		//without an LDAP directory, there is no need for a suffix, and there are
+		//no files to prepare for slapd
+		delete(envDefaults, "PORTUNUS_LDAP_SUFFIX")
+		delete(envDefaults, "PORTUNUS_SLAPD_STATE_DIR")
+	}
 
 	//read and validate all relevant environment variables
 	environment = make(map[string]string)
@@ -91,13 +250,73 @@ func readConfig() (environment map[string]string, ids map[string]int) {
 		environment[key] = value
 		os.Unsetenv(key) //avoid unintentional leakage of env vars to child processes
 	}
+	//optional, so they cannot be in envDefaults
+	for _, key := range []string{"PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES", "PORTUNUS_SLAPD_SYNCPROV_MODULE", "PORTUNUS_SLAPD_TLS_ACME_EMAIL"} {
+		value := os.Getenv(key)
+		if check := envFormats[key]; value != "" && check.Checker != nil && !check.Checker(value) {
+			logg.Fatal("malformed environment variable: %s must be %s", value, check.FormatDesc)
+		}
+		environment[key] = value
+		os.Unsetenv(key)
+	}
+
+	//not all LDAP backends support all features
+	var isUnsupported map[string]bool
+	unsupportedWith := "PORTUNUS_LDAP_BACKEND=" + environment["PORTUNUS_LDAP_BACKEND"]
+	switch {
+	case environment["PORTUNUS_LDAP_DISABLED"] == "true":
+		unsupportedWith = "PORTUNUS_LDAP_DISABLED=true"
+		isUnsupported = map[string]bool{
+			"PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES": environment["PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES"] == "true",
+			"PORTUNUS_LDAP_BACKEND":                 environment["PORTUNUS_LDAP_BACKEND"] != "slapd",
+			"PORTUNUS_LDAP_CHANGELOG_SIZE":          environment["PORTUNUS_LDAP_CHANGELOG_SIZE"] != "0",
+			"PORTUNUS_LDAP_DISABLED_USER_HANDLING":  environment["PORTUNUS_LDAP_DISABLED_USER_HANDLING"] != "remove",
+			"PORTUNUS_LDAP_DRIFT_HANDLING":          environment["PORTUNUS_LDAP_DRIFT_HANDLING"] != "ignore",
+			"PORTUNUS_LDAP_RENDER_LABELS":           environment["PORTUNUS_LDAP_RENDER_LABELS"] == "true",
+			"PORTUNUS_SLAPD_LDAPI_SOCKET":           environment["PORTUNUS_SLAPD_LDAPI_SOCKET"] != "",
+			"PORTUNUS_SLAPD_SYNCPROV":               environment["PORTUNUS_SLAPD_SYNCPROV"] == "true",
+			"PORTUNUS_SLAPD_TLS_ACME":               environment["PORTUNUS_SLAPD_TLS_ACME"] == "true",
+			"PORTUNUS_SLAPD_TLS_CERTIFICATE":        environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "",
+		}
+	case environment["PORTUNUS_LDAP_BACKEND"] == "embedded":
+		//the embedded LDAP server is read-only, and it only listens on TCP
+		isUnsupported = map[string]bool{
+			"PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES": environment["PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES"] == "true",
+			"PORTUNUS_LDAP_CHANGELOG_SIZE":          environment["PORTUNUS_LDAP_CHANGELOG_SIZE"] != "0",
+			"PORTUNUS_LDAP_DRIFT_HANDLING":          environment["PORTUNUS_LDAP_DRIFT_HANDLING"] != "ignore",
+			"PORTUNUS_SLAPD_LDAPI_SOCKET":           environment["PORTUNUS_SLAPD_LDAPI_SOCKET"] != "",
+			"PORTUNUS_SLAPD_SYNCPROV":               environment["PORTUNUS_SLAPD_SYNCPROV"] == "true",
+		}
+	case environment["PORTUNUS_LDAP_BACKEND"] == "389ds":
+		//389-ds would hash changed passwords with its own default scheme, and it
+		//can only listen on one Unix socket, which we need for ourselves; syncrepl
+		//is specific to OpenLDAP (389-ds has its own replication protocol)
+		isUnsupported = map[string]bool{
+			"PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES": environment["PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES"] == "true",
+			"PORTUNUS_SLAPD_LDAPI_SOCKET":           environment["PORTUNUS_SLAPD_LDAPI_SOCKET"] != "",
+			"PORTUNUS_SLAPD_SYNCPROV":               environment["PORTUNUS_SLAPD_SYNCPROV"] == "true",
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(isUnsupported)) {
+		if isUnsupported[key] {
+			logg.Fatal("%s cannot be used with %s", key, unsupportedWith)
+		}
+	}
 
 	//resolve user/group names into IDs
 	ids = map[string]int{
 		"PORTUNUS_SERVER_UID": must.Return(lookupID("/etc/passwd", environment["PORTUNUS_SERVER_USER"])),
 		"PORTUNUS_SERVER_GID": must.Return(lookupID("/etc/group", environment["PORTUNUS_SERVER_GROUP"])),
-		"PORTUNUS_SLAPD_UID":  must.Return(lookupID("/etc/passwd", environment["PORTUNUS_SLAPD_USER"])),
-		"PORTUNUS_SLAPD_GID":  must.Return(lookupID("/etc/group", environment["PORTUNUS_SLAPD_GROUP"])),
+	}
+	if environment["PORTUNUS_LDAP_BACKEND"] == "embedded" || environment["PORTUNUS_LDAP_DISABLED"] == "true" {
+		//there is no slapd (and maybe not even a user account for it), so the
+		//files that we would prepare for slapd (i.e. the TLS files) are owned
+		//by portunus-server instead
+		ids["PORTUNUS_SLAPD_UID"] = ids["PORTUNUS_SERVER_UID"]
+		ids["PORTUNUS_SLAPD_GID"] = ids["PORTUNUS_SERVER_GID"]
+	} else {
+		ids["PORTUNUS_SLAPD_UID"] = must.Return(lookupID("/etc/passwd", environment["PORTUNUS_SLAPD_USER"]))
+		ids["PORTUNUS_SLAPD_GID"] = must.Return(lookupID("/etc/group", environment["PORTUNUS_SLAPD_GROUP"]))
 	}
 
 	return
@@ -0,0 +1,368 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// dirsrvBackend is the ldapBackend for PORTUNUS_LDAP_BACKEND=389ds, which
+// runs the 389 Directory Server instead of OpenLDAP.
+//
+// Notes on how this differs from slapdBackend:
+//   - The instance is created with dscreate(8), since the initial dse.ldif
+//     needs to contain the configuration for a few dozen plugins that we do not
+//     care about. We then patch the settings that dscreate does not cover into
+//     dse.ldif before the first start.
+//   - 389-ds does not have a central ACL. Access control is done through ACIs
+//     that are stored in the `aci` attribute of the objects that they apply to.
+//     Since the objects in the directory (including the suffix objects) are
+//     created by portunus-server, we put our ACIs on the suffix objects once
+//     ns-slapd is running (see AfterStart). The ACIs mirror the ACL for slapd,
+//     except for the rules involving the portunus-writers-$NAME and
+//     portunus-readers-group-$NAME groups: 389-ds cannot derive a group name
+//     from the DN of the target object, so write access to subtrees and read
+//     access to individual groups are not available.
+//   - For AfterStart, we talk to ns-slapd through a Unix socket in the state
+//     directory. As root, we are authenticated as Portunus' technical user by
+//     means of LDAPI autobind, so no password needs to be given.
+//   - 389-ds only reads TLS certificates from an NSS database, so the TLS files
+//     are imported into a fresh NSS database before each start. This requires
+//     certutil(1), pk12util(1) and openssl(1).
+//   - Unlike slapd, 389-ds knows the schema from draft-good-ldap-changelog out
+//     of the box (it originates in Netscape Directory Server after all), so
+//     our custom schema leaves it out to avoid conflicting definitions.
+//   - When TLS is configured, `nsslapd-minssf` and `nsslapd-require-secure-binds`
+//     have the same effect as `security ssf=256` for slapd. LDAPI connections
+//     get an SSF of 71 (`nsslapd-localssf`), so they are still allowed.
+type dirsrvBackend struct {
+	ids    map[string]int
+	layout ldap.Layout
+}
+
+// All paths within PORTUNUS_SLAPD_STATE_DIR that are known to 389-ds.
+var dirsrvDirectories = map[string]string{
+	"backup_dir": "bak",
+	"cert_dir":   "nss",
+	"config_dir": "config",
+	"db_dir":     "db",
+	"ldif_dir":   "ldif",
+	"lock_dir":   "lock",
+	"log_dir":    "log",
+	"run_dir":    "run",
+	"schema_dir": "config/schema",
+	"tmp_dir":    "tmp",
+}
+
+func dirsrvPath(environment map[string]string, key string, fileName ...string) string {
+	parts := append([]string{environment["PORTUNUS_SLAPD_STATE_DIR"], dirsrvDirectories[key]}, fileName...)
+	return filepath.Join(parts...)
+}
+
+// Setup implements the ldapBackend interface.
+func (b *dirsrvBackend) Setup(environment map[string]string, hasher crypt.PasswordHasher) error {
+	password := generateServiceUserPassword()
+	logg.Debug("password for cn=portunus,%s is %s",
+		environment["PORTUNUS_LDAP_SUFFIX"], password)
+	environment["PORTUNUS_LDAP_PASSWORD"] = password
+
+	//create the instance
+	infPath := filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], "instance.inf")
+	err := os.WriteFile(infPath, b.renderInstanceConfig(environment, hasher.HashPassword(password)), 0400)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(environment["PORTUNUS_SLAPD_DSCREATE_BINARY"], "from-file", infPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("could not create 389-ds instance: %w (output was: %q)", err, string(output))
+	}
+
+	//add the settings that dscreate does not know about
+	dsePath := dirsrvPath(environment, "config_dir", "dse.ldif")
+	buf, err := os.ReadFile(dsePath)
+	if err != nil {
+		return err
+	}
+	dse := patchLDIF(string(buf), "cn=config", []ldifAttribute{
+		{"nsslapd-ldapilisten", "on"},
+		{"nsslapd-ldapifilepath", dirsrvPath(environment, "run_dir", "ldapi.sock")},
+		{"nsslapd-ldapiautobind", "on"},
+		{"nsslapd-ldapimaprootdn", "cn=portunus," + environment["PORTUNUS_LDAP_SUFFIX"]},
+		{"nsslapd-ldapimaptoentries", "off"},
+	})
+	if hasTLS(environment) {
+		dse = patchLDIF(dse, "cn=config", []ldifAttribute{
+			{"nsslapd-security", "on"},
+			{"nsslapd-minssf", "71"},
+			{"nsslapd-require-secure-binds", "on"},
+		})
+		dse = patchLDIF(dse, "cn=encryption,cn=config", []ldifAttribute{
+			{"sslVersionMin", "TLS1.2"},
+		})
+		dse = patchLDIF(dse, "cn=RSA,cn=encryption,cn=config", []ldifAttribute{
+			{"objectClass", "top"},
+			{"objectClass", "nsEncryptionModule"},
+			{"cn", "RSA"},
+			{"nsSSLPersonalitySSL", "Server-Cert"},
+			{"nsSSLToken", "internal (software)"},
+			{"nsSSLActivation", "on"},
+		})
+	}
+	err = os.WriteFile(dsePath, []byte(dse), 0600)
+	if err != nil {
+		return err
+	}
+
+	schemaPath := dirsrvPath(environment, "schema_dir", "99portunus.ldif")
+	err = os.WriteFile(schemaPath, []byte(renderDirsrvSchema(customSchema)), 0444)
+	if err != nil {
+		return err
+	}
+	return os.Chown(schemaPath, b.ids["PORTUNUS_SLAPD_UID"], b.ids["PORTUNUS_SLAPD_GID"])
+}
+
+// Renders the input file for dscreate(8).
+func (b *dirsrvBackend) renderInstanceConfig(environment map[string]string, rootPasswordHash string) []byte {
+	//the machine name only matters for the self-signed certificate, which we do not use
+	machineName := environment["PORTUNUS_SLAPD_TLS_DOMAIN_NAME"]
+	if machineName == "" {
+		machineName = "localhost"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[general]\nconfig_version = 2\nfull_machine_name = %s\nstrict_host_checking = False\nstart = False\n", machineName)
+	fmt.Fprintf(&buf, "\n[slapd]\ninstance_name = portunus\nuser = %s\ngroup = %s\n",
+		environment["PORTUNUS_SLAPD_USER"], environment["PORTUNUS_SLAPD_GROUP"])
+	fmt.Fprintf(&buf, "port = 389\nsecure_port = 636\nself_sign_cert = False\n")
+	fmt.Fprintf(&buf, "root_dn = cn=portunus,%s\nroot_password = %s\n", environment["PORTUNUS_LDAP_SUFFIX"], rootPasswordHash)
+	for _, key := range slices.Sorted(maps.Keys(dirsrvDirectories)) {
+		fmt.Fprintf(&buf, "%s = %s\n", key, dirsrvPath(environment, key))
+	}
+
+	//unlike slapd, 389-ds needs a separate database for each suffix
+	for idx, suffix := range allLDAPSuffixes(environment) {
+		backendName := "userroot"
+		if idx > 0 {
+			backendName = fmt.Sprintf("domain%d", idx)
+		}
+		fmt.Fprintf(&buf, "\n[backend-%s]\nsuffix = %s\ncreate_suffix_entry = False\nsample_entries = no\n", backendName, suffix)
+	}
+	return buf.Bytes()
+}
+
+// Command implements the ldapBackend interface.
+func (b *dirsrvBackend) Command(environment map[string]string) (*exec.Cmd, error) {
+	if hasTLS(environment) {
+		err := b.importTLSFiles(environment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//giving `-d` keeps ns-slapd from daemonizing (its debug levels are mostly
+	//interesting for developers of 389-ds itself, so we do not enable any)
+	return exec.Command(environment["PORTUNUS_SLAPD_BINARY"],
+		"-D", dirsrvPath(environment, "config_dir"),
+		"-i", dirsrvPath(environment, "run_dir", "ns-slapd.pid"),
+		"-d", "0",
+	), nil
+}
+
+// Imports the TLS files written by tlsFileSet.CopyInto() into a fresh NSS
+// database in cert_dir.
+func (b *dirsrvBackend) importTLSFiles(environment map[string]string) error {
+	statePath := environment["PORTUNUS_SLAPD_STATE_DIR"]
+	nssPath := dirsrvPath(environment, "cert_dir")
+	err := os.RemoveAll(nssPath)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(nssPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	nssDB := "sql:" + nssPath
+	p12Path := filepath.Join(nssPath, "server.p12")
+	commands := [][]string{
+		{"certutil", "-N", "-d", nssDB, "--empty-password"},
+		{"openssl", "pkcs12", "-export", "-name", "Server-Cert", "-passout", "pass:",
+			"-in", filepath.Join(statePath, "cert.pem"), "-inkey", filepath.Join(statePath, "key.pem"), "-out", p12Path},
+		{"pk12util", "-d", nssDB, "-W", "", "-i", p12Path},
+	}
+	if fi, err := os.Stat(filepath.Join(statePath, "ca.pem")); err == nil && fi.Size() > 0 {
+		commands = append(commands,
+			[]string{"certutil", "-A", "-d", nssDB, "-n", "CA", "-t", "CT,,", "-i", filepath.Join(statePath, "ca.pem")})
+	}
+	for _, args := range commands {
+		output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("could not import TLS files into NSS database: %s failed: %w (output was: %q)", args[0], err, string(output))
+		}
+	}
+	err = os.Remove(p12Path)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(nssPath, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chown(path, b.ids["PORTUNUS_SLAPD_UID"], b.ids["PORTUNUS_SLAPD_GID"])
+	})
+}
+
+// AfterStart implements the ldapBackend interface.
+func (b *dirsrvBackend) AfterStart(environment map[string]string) error {
+	socketPath := dirsrvPath(environment, "run_dir", "ldapi.sock")
+	conn, err := ldap.DialSocket(socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.ExternalBind()
+	if err != nil {
+		return err
+	}
+
+	//portunus-server might create the suffix objects before or after us (it
+	//accepts when they already exist), so we need to handle both cases
+	primarySuffix := environment["PORTUNUS_LDAP_SUFFIX"]
+	for _, suffix := range allLDAPSuffixes(environment) {
+		acis := renderDirsrvACIs(suffix, primarySuffix, b.layout)
+		dcName := strings.TrimPrefix(strings.Split(suffix, ",")[0], "dc=")
+		addReq := goldap.NewAddRequest(suffix, nil)
+		addReq.Attribute("dc", []string{dcName})
+		addReq.Attribute("o", []string{dcName})
+		addReq.Attribute("objectClass", []string{"dcObject", "organization", "top"})
+		addReq.Attribute("aci", acis)
+		err := conn.Add(addReq)
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultEntryAlreadyExists) {
+			modReq := goldap.NewModifyRequest(suffix, nil)
+			modReq.Replace("aci", acis)
+			err = conn.Modify(modReq)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot put ACIs on %s: %w", suffix, err)
+		}
+	}
+	return nil
+}
+
+// LogHint implements the ldapBackend interface.
+func (b *dirsrvBackend) LogHint() string {
+	return "Check the error log of 389-ds in PORTUNUS_SLAPD_STATE_DIR/log for more information."
+}
+
+// Renders the ACIs for the suffix object of the given suffix. These
+// correspond to the rules in configTemplateGeneral and renderScopedReadACLs()
+// for slapd. Portunus' own technical user is the root DN and thus not subject
+// to any ACIs.
+func renderDirsrvACIs(suffix, primarySuffix string, layout ldap.Layout) []string {
+	aci := func(target, name, subject string) string {
+		return fmt.Sprintf(`%s(targetattr="*")(version 3.0; acl "%s"; allow (read,search,compare) %s;)`, target, name, subject)
+	}
+	groupSubject := func(groupName string) string {
+		return fmt.Sprintf(`groupdn="ldap:///cn=%s,%s"`, groupName, primarySuffix)
+	}
+	ouTarget := func(ouName string) string {
+		return fmt.Sprintf(`(target="ldap:///ou=%s,%s")`, ouName, suffix)
+	}
+
+	//service accounts only exist below the primary suffix
+	viewersTarget := ""
+	if suffix == primarySuffix {
+		viewersTarget = fmt.Sprintf(`(target!="ldap:///ou=%s,%s")`, layout.ServiceAccountsOU, primarySuffix)
+	}
+	return []string{
+		aci(viewersTarget, "portunus-viewers", groupSubject("portunus-viewers")),
+		aci("", "portunus-self", `userdn="ldap:///self"`),
+		aci(ouTarget(layout.UsersOU), "portunus-readers-users", groupSubject("portunus-readers-users")),
+		aci(ouTarget(layout.GroupsOU), "portunus-readers-groups", groupSubject("portunus-readers-groups")),
+		aci(ouTarget(layout.PosixGroupsOU), "portunus-readers-posix-groups", groupSubject("portunus-readers-groups")),
+	}
+}
+
+// Converts our custom schema from slapd.conf syntax into the LDIF format that
+// 389-ds uses for schema files.
+func renderDirsrvSchema(schema string) string {
+	var result strings.Builder
+	result.WriteString("dn: cn=schema\nobjectClass: top\nobjectClass: ldapSubentry\nobjectClass: subschema\ncn: schema\n")
+	for _, definition := range strings.Split(strings.TrimSpace(schema), "\n\n") {
+		keyword, body, _ := strings.Cut(strings.Join(strings.Fields(definition), " "), " ")
+		//skip the changelog schema, which 389-ds already knows (see above)
+		if strings.HasPrefix(body, "( 2.16.840.1.113730.") {
+			continue
+		}
+		switch keyword {
+		case "attributetype":
+			fmt.Fprintf(&result, "attributeTypes: %s\n", body)
+		case "objectclass":
+			fmt.Fprintf(&result, "objectClasses: %s\n", body)
+		}
+	}
+	return result.String()
+}
+
+// An attribute value in an LDIF document.
+type ldifAttribute struct {
+	Name  string
+	Value string
+}
+
+// Replaces the given attributes in the entry with the given DN within an LDIF
+// document (like dse.ldif). If there is no such entry yet, it is appended.
+func patchLDIF(document, dn string, attrs []ldifAttribute) string {
+	isReplaced := make(map[string]bool, len(attrs))
+	var rendered strings.Builder
+	for _, attr := range attrs {
+		isReplaced[strings.ToLower(attr.Name)] = true
+		fmt.Fprintf(&rendered, "\n%s: %s", attr.Name, attr.Value)
+	}
+
+	//unfold continuation lines, so that each line contains one attribute value
+	document = strings.ReplaceAll(document, "\n ", "")
+	var entries []string
+	for _, entry := range strings.Split(document, "\n\n") {
+		if entry = strings.Trim(entry, "\n"); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	for idx, entry := range entries {
+		lines := strings.Split(entry, "\n")
+		if !slices.ContainsFunc(lines, func(line string) bool { return strings.EqualFold(line, "dn: "+dn) }) {
+			continue
+		}
+		var kept []string
+		for _, line := range lines {
+			name, _, _ := strings.Cut(line, ":")
+			if !isReplaced[strings.ToLower(name)] {
+				kept = append(kept, line)
+			}
+		}
+		entries[idx] = strings.Join(kept, "\n") + rendered.String()
+		return strings.Join(entries, "\n\n") + "\n"
+	}
+	entries = append(entries, "dn: "+dn+rendered.String())
+	return strings.Join(entries, "\n\n") + "\n"
+}
@@ -7,9 +7,9 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,17 +17,48 @@ import (
 	"strings"
 
 	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/grammars"
+	"github.com/majewsky/portunus/internal/ldap"
 	"github.com/sapcc/go-bits/logg"
 )
 
 // Notes on these configuration templates:
-//   - Only Portunus' own technical user has any sort of write access.
+//   - Only Portunus' own technical user has write access to the objects managed by Portunus.
 //   - The cn=portunus-viewers virtual group corresponds to Portunus' `LDAP.CanRead` permission.
+//   - The cn=portunus-writers-$NAME virtual groups correspond to Portunus' `LDAP.WriteSubtree` permission.
+//     Members can write everything below ou=$NAME,ou=subtrees (including that object itself).
+//     Any logged-in user may add or delete children of ou=subtrees, but since slapd also checks
+//     the permissions on the child object itself, only members of the respective group can do so.
+//     (The name of ou=subtrees can be changed with PORTUNUS_LDAP_SUBTREES_OU.)
+//   - The subtree permissions only apply below the primary suffix. Additional suffixes are
+//     covered by the rules for the portunus-viewers group and for the own object.
 //   - Users can read their own object, so that applications not using a service
 //     user can discover group memberships of a logged-in user.
+//   - Service accounts below ou=service-accounts are only visible to themselves (and to Portunus).
+//   - The cn=portunus-readers-users and cn=portunus-readers-groups virtual groups correspond to
+//     the read scopes of service accounts, and to Portunus' `LDAP.CanReadUsers` and `LDAP.CanReadGroups`
+//     permissions. They grant read access to the respective OUs in all domains.
+//     (The names of these OUs can be changed with the respective PORTUNUS_LDAP_*_OU variables.)
+//   - The cn=portunus-readers-group-$NAME virtual groups correspond to Portunus' `LDAP.ReadGroupNames`
+//     permission. Members can read cn=$NAME in ou=groups and ou=posix-groups. Any logged-in user may
+//     search these OUs, but only entries that they can read are returned.
+//   - If PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES is set, users can change (but not read) their own
+//     userPassword, e.g. through the Password Modify extended operation. slapd hashes the new password
+//     with sha512crypt, and portunus-server copies it into its database. Other users continue to be
+//     evaluated by the subsequent rules, by virtue of the final `by * break`.
 //   - TLSProtocolMin 3.3 means "TLS 1.2 or higher". (TODO select cipher suites according to recommendations)
-//
-// TODO when TLS is configured, also listen on ldap:///, but require StartTLS through `security minssf=256`.
+//   - When TLS is configured, slapd listens on both ldaps:/// and ldap:///. The `security ssf=` directive
+//     makes sure that connections on ldap:/// cannot do anything (not even bind) before StartTLS. This is
+//     the global minimum SSF that `minssf` would set for SASL binds, but it also applies to simple binds.
+//     The minimum is ldap.MinimumSSF, which every cipher suite that portunus-server may negotiate achieves,
+//     so this does not restrict TLS connections on either port.
+//   - When PORTUNUS_SLAPD_LDAPI_SOCKET is set, slapd also listens on that Unix socket. Connections on
+//     the socket never leave the host, so `localSSF 256` exempts them from the SSF requirement above.
+//   - When PORTUNUS_SLAPD_SYNCPROV is set, the syncprov overlay turns slapd into a syncrepl provider.
+//     Consumers bind as a member of cn=portunus-viewers, since they need to read everything, and the
+//     `limits` directive keeps their initial refresh from being cut short by the default size limit.
+//     The syncprov module is only loaded explicitly if PORTUNUS_SLAPD_SYNCPROV_MODULE is given, since
+//     some distributions build slapd with syncprov compiled in.
 //
 // For what the format directives refer to, compare the fmt.Sprintf() call down below.
 const configTemplateGeneral = `
@@ -41,28 +72,58 @@ include %[2]s/portunus.schema
 access to dn.base="" by * read
 access to dn.base="cn=Subschema" by * read
 
+access to dn.base="ou=%[5]s,%[3]s" attrs=children
+	by dn.base="cn=portunus,%[3]s" write
+	by users write
+
+access to dn.regex="^(.+,)?ou=([^,]+),ou=%[5]s,%[3]s$"
+	by dn.base="cn=portunus,%[3]s" write
+	by group.expand="cn=portunus-writers-$2,%[3]s" write
+	by group.exact="cn=portunus-viewers,%[3]s" read
+	by self read
+	by anonymous auth
+%[7]s
 access to *
 	by dn.base="cn=portunus,%[3]s" write
 	by group.exact="cn=portunus-viewers,%[3]s" read
 	by self read
 	by anonymous auth
 `
+const configTemplatePasswordChanges = `
+password-hash {CRYPT}
+password-crypt-salt-format "$6$%%.16s"
+`
 const configTemplateTLS = `
 TLSCACertificateFile  "%[2]s/ca.pem"
 TLSCertificateFile    "%[2]s/cert.pem"
 TLSCertificateKeyFile "%[2]s/key.pem"
 TLSProtocolMin 3.3
+security ssf=%[12]d
+`
+const configTemplateLDAPI = `
+localSSF 256
+`
+const configTemplateSyncprovModule = `
+moduleload "%[10]s"
 `
 const configTemplateDatabase = `
 database   mdb
-maxsize    1073741824
-suffix     "%[3]s"
+maxsize    %[11]d
+suffix     "%[3]s"%[6]s
 rootdn     "cn=portunus,%[3]s"
 rootpw     "%[4]s"
 directory  "%[2]s/data"
 
 index objectClass eq
 `
+const configTemplateSyncprov = `
+index entryCSN,entryUUID eq
+limits group.exact="cn=portunus-viewers,%[3]s" size=unlimited time=unlimited
+
+overlay syncprov
+syncprov-checkpoint %[8]s
+syncprov-sessionlog %[9]s
+`
 
 // We do not use the OLC machinery for the memberOf attribute because
 // portunus-server itself can do it much more easily. But that means we have to
@@ -72,6 +133,10 @@ index objectClass eq
 // standard attribute name `memberOf`, but `isMemberOf` instead. (Some OpenLDAPs
 // define the `memberOf` attribute even if you don't enable the memberof
 // overlay.)
+//
+// The schema for the entries below cn=changelog is taken from
+// draft-good-ldap-changelog, since that is what consumers of the changelog
+// expect. OpenLDAP does not ship this schema because it has no changelog.
 var customSchema = `
 	attributetype ( 9999.1.1 NAME 'isMemberOf'
 		DESC 'back-reference to groups this user is a member of'
@@ -81,28 +146,91 @@ var customSchema = `
 		DESC 'SSH public key used by this user'
 		SUP name )
 
+	attributetype ( 2.16.840.1.113730.3.1.5 NAME 'changeNumber'
+		DESC 'a number which uniquely identifies a change made to a directory entry'
+		EQUALITY integerMatch
+		ORDERING integerOrderingMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.27
+		SINGLE-VALUE )
+
+	attributetype ( 2.16.840.1.113730.3.1.6 NAME 'targetDN'
+		DESC 'the DN of the entry which was modified'
+		EQUALITY distinguishedNameMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.12
+		SINGLE-VALUE )
+
+	attributetype ( 2.16.840.1.113730.3.1.7 NAME 'changeType'
+		DESC 'the type of change made to an entry'
+		EQUALITY caseIgnoreMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.15
+		SINGLE-VALUE )
+
+	attributetype ( 2.16.840.1.113730.3.1.77 NAME 'changeTime'
+		DESC 'the time when the change was processed'
+		EQUALITY generalizedTimeMatch
+		ORDERING generalizedTimeOrderingMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.24
+		SINGLE-VALUE )
+
+	attributetype ( 9999.1.3 NAME 'portunusLabel'
+		DESC 'label of the form key=value that was assigned in Portunus'
+		EQUALITY caseExactMatch
+		SUBSTR caseExactSubstringsMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.15 )
+
+	attributetype ( 9999.1.4 NAME 'portunusDisabled'
+		DESC 'set to TRUE on users that were disabled in Portunus'
+		EQUALITY booleanMatch
+		SYNTAX 1.3.6.1.4.1.1466.115.121.1.7
+		SINGLE-VALUE )
+
 	objectclass ( 9999.2.1 NAME 'portunusPerson'
 		DESC 'addon to objectClass person that adds Portunus-specific attributes'
 		SUP top AUXILIARY
-		MAY ( isMemberOf $ sshPublicKey ) )
+		MAY ( isMemberOf $ sshPublicKey $ portunusLabel $ portunusDisabled ) )
+
+	objectclass ( 9999.2.2 NAME 'portunusGroup'
+		DESC 'addon to objectClass groupOfNames that adds Portunus-specific attributes'
+		SUP top AUXILIARY
+		MAY ( mail $ portunusLabel ) )
+
+	objectclass ( 2.16.840.1.113730.3.2.1 NAME 'changeLogEntry'
+		DESC 'an entry in the changelog below cn=changelog (see draft-good-ldap-changelog)'
+		SUP top STRUCTURAL
+		MUST ( changeNumber $ targetDN $ changeType )
+		MAY ( changeTime ) )
 
 `
 
 //^ The trailing empty line is important, otherwise slapd cannot correctly
 //parse this file. ikr?
 
-func renderSlapdConfig(environment map[string]string, hasher crypt.PasswordHasher) []byte {
+func renderSlapdConfig(environment map[string]string, layout ldap.Layout, hasher crypt.PasswordHasher) []byte {
 	password := generateServiceUserPassword()
 	logg.Debug("password for cn=portunus,%s is %s",
 		environment["PORTUNUS_LDAP_SUFFIX"], password)
 	environment["PORTUNUS_LDAP_PASSWORD"] = password
 	environment["PORTUNUS_LDAP_PASSWORD_HASH"] = hasher.HashPassword(password)
 
+	acceptPasswordChanges := environment["PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES"] == "true"
 	configTemplates := []string{strings.TrimSpace(configTemplateGeneral)}
-	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
+	if acceptPasswordChanges {
+		configTemplates = append(configTemplates, strings.TrimSpace(configTemplatePasswordChanges))
+	}
+	if hasTLS(environment) {
 		configTemplates = append(configTemplates, strings.TrimSpace(configTemplateTLS))
 	}
+	if environment["PORTUNUS_SLAPD_LDAPI_SOCKET"] != "" {
+		configTemplates = append(configTemplates, strings.TrimSpace(configTemplateLDAPI))
+	}
+	hasSyncprov := environment["PORTUNUS_SLAPD_SYNCPROV"] == "true"
+	if hasSyncprov && environment["PORTUNUS_SLAPD_SYNCPROV_MODULE"] != "" {
+		configTemplates = append(configTemplates, strings.TrimSpace(configTemplateSyncprovModule))
+	}
 	configTemplates = append(configTemplates, strings.TrimSpace(configTemplateDatabase))
+	if hasSyncprov {
+		configTemplates = append(configTemplates, strings.TrimSpace(configTemplateSyncprov))
+	}
 
 	return []byte(fmt.Sprintf(
 		strings.Join(configTemplates, "\n\n")+"\n",
@@ -110,20 +238,113 @@ func renderSlapdConfig(environment map[string]string, hasher crypt.PasswordHashe
 		environment["PORTUNUS_SLAPD_STATE_DIR"],
 		environment["PORTUNUS_LDAP_SUFFIX"],
 		environment["PORTUNUS_LDAP_PASSWORD_HASH"],
+		layout.SubtreesOU,
+		renderExtraSuffixes(environment),
+		renderScopedReadACLs(environment, layout, acceptPasswordChanges),
+		environment["PORTUNUS_SLAPD_SYNCPROV_CHECKPOINT"],
+		environment["PORTUNUS_SLAPD_SYNCPROV_SESSIONLOG"],
+		environment["PORTUNUS_SLAPD_SYNCPROV_MODULE"],
+		ldap.MDBMaxSize,
+		ldap.MinimumSSF,
 	))
 }
 
-func generateServiceUserPassword() string {
-	buf := make([]byte, 32)
-	_, err := rand.Read(buf[:])
+// The ACLs for partial read access need several rules per domain, so they are
+// generated instead of being part of the static config template. The rule for
+// password changes is also generated here since it needs to precede the rule
+// for the respective users OU.
+func renderScopedReadACLs(environment map[string]string, layout ldap.Layout, acceptPasswordChanges bool) string {
+	primarySuffix := environment["PORTUNUS_LDAP_SUFFIX"]
+	var result strings.Builder
+	fmt.Fprintf(&result, "\naccess to dn.subtree=\"ou=%[1]s,%[2]s\"\n\tby dn.base=\"cn=portunus,%[2]s\" write\n\tby self read\n\tby anonymous auth\n",
+		layout.ServiceAccountsOU, primarySuffix)
+
+	writeRule := func(what string, extraWho ...string) {
+		fmt.Fprintf(&result, "\naccess to %s\n", what)
+		fmt.Fprintf(&result, "\tby dn.base=\"cn=portunus,%s\" write\n", primarySuffix)
+		fmt.Fprintf(&result, "\tby group.exact=\"cn=portunus-viewers,%s\" read\n", primarySuffix)
+		for _, who := range extraWho {
+			fmt.Fprintf(&result, "\tby %s\n", who)
+		}
+		result.WriteString("\tby self read\n\tby anonymous auth\n")
+	}
+
+	for _, suffix := range allLDAPSuffixes(environment) {
+		if acceptPasswordChanges {
+			fmt.Fprintf(&result, "\naccess to dn.subtree=\"ou=%s,%s\" attrs=userPassword\n", layout.UsersOU, suffix)
+			fmt.Fprintf(&result, "\tby dn.base=\"cn=portunus,%s\" write\n", primarySuffix)
+			result.WriteString("\tby self =wx\n\tby anonymous auth\n\tby * break\n")
+		}
+		writeRule(fmt.Sprintf("dn.subtree=\"ou=%s,%s\"", layout.UsersOU, suffix),
+			fmt.Sprintf("group.exact=\"cn=portunus-readers-users,%s\" read", primarySuffix),
+		)
+		for _, ou := range []string{layout.GroupsOU, layout.PosixGroupsOU} {
+			readersWho := fmt.Sprintf("group.exact=\"cn=portunus-readers-groups,%s\" read", primarySuffix)
+			//users with read access to individual groups need to be able to search
+			//the OU containing them
+			writeRule(fmt.Sprintf("dn.base=\"ou=%s,%s\"", ou, suffix),
+				readersWho, "users search")
+			writeRule(fmt.Sprintf("dn.regex=\"^cn=([^,]+),ou=%s,%s$\"", ou, suffix),
+				readersWho, fmt.Sprintf("group.expand=\"cn=portunus-readers-group-$1,%s\" read", primarySuffix))
+		}
+	}
+	return result.String()
+}
+
+// Users and groups in additional domains (see PORTUNUS_LDAP_EXTRA_SUFFIXES in
+// package core) are stored in the same database as the primary suffix.
+func renderExtraSuffixes(environment map[string]string) string {
+	var result strings.Builder
+	for _, suffix := range allLDAPSuffixes(environment)[1:] {
+		fmt.Fprintf(&result, "\nsuffix     %q", suffix)
+	}
+	return result.String()
+}
+
+// Returns the primary suffix, followed by the suffixes of all additional
+// domains.
+func allLDAPSuffixes(environment map[string]string) []string {
+	result := []string{environment["PORTUNUS_LDAP_SUFFIX"]}
+	for _, suffix := range strings.Fields(os.Getenv("PORTUNUS_LDAP_EXTRA_SUFFIXES")) {
+		if !grammars.IsLDAPSuffix(suffix) {
+			logg.Fatal("malformed environment variable: PORTUNUS_LDAP_EXTRA_SUFFIXES must be a space-separated list of suffixes, each being %s", ldapSuffixCheck.FormatDesc)
+		}
+		result = append(result, suffix)
+	}
+	return result
+}
+
+// slapdBackend is the ldapBackend for PORTUNUS_LDAP_BACKEND=slapd.
+type slapdBackend struct {
+	ids    map[string]int
+	layout ldap.Layout
+}
+
+// Setup implements the ldapBackend interface.
+func (b slapdBackend) Setup(environment map[string]string, hasher crypt.PasswordHasher) error {
+	slapdStatePath := environment["PORTUNUS_SLAPD_STATE_DIR"]
+	slapdDataPath := filepath.Join(slapdStatePath, "data")
+	err := os.Mkdir(slapdDataPath, 0770)
+	if err != nil {
+		return err
+	}
+	err = os.Chown(slapdDataPath, b.ids["PORTUNUS_SLAPD_UID"], b.ids["PORTUNUS_SLAPD_GID"])
+	if err != nil {
+		return err
+	}
+
+	customSchemaPath := filepath.Join(slapdStatePath, "portunus.schema")
+	err = os.WriteFile(customSchemaPath, []byte(customSchema), 0444)
 	if err != nil {
-		logg.Fatal(err.Error())
+		return err
 	}
-	return hex.EncodeToString(buf[:])
+
+	slapdConfigPath := filepath.Join(slapdStatePath, "slapd.conf")
+	return os.WriteFile(slapdConfigPath, renderSlapdConfig(environment, b.layout, hasher), 0444)
 }
 
-// Does not return. Call with `go`.
-func runLDAPServer(environment map[string]string) {
+// Command implements the ldapBackend interface.
+func (b slapdBackend) Command(environment map[string]string) (*exec.Cmd, error) {
 	debugLogFlags := uint64(0)
 	if logg.ShowDebug {
 		//with PORTUNUS_DEBUG=true, turn on all debug logging except for package
@@ -132,29 +353,66 @@ func runLDAPServer(environment map[string]string) {
 		debugLogFlags = 0xFFFF &^ 0x12
 	}
 
-	bindURL := "ldap:///"
-	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
-		bindURL = "ldaps:///"
+	bindURLs := "ldap:///"
+	if hasTLS(environment) {
+		//ldap:/// is still useful for clients that only support StartTLS (see
+		//`security` directive in configTemplateTLS)
+		bindURLs = "ldaps:/// ldap:///"
+	}
+	if socketPath := environment["PORTUNUS_SLAPD_LDAPI_SOCKET"]; socketPath != "" {
+		//the path is given in the host part of the URL, so slashes need to be
+		//escaped as well; x-mod is a slapd-specific URL extension
+		bindURLs += fmt.Sprintf(" ldapi://%s/????x-mod=%s",
+			strings.ReplaceAll(url.PathEscape(socketPath), "/", "%2F"),
+			environment["PORTUNUS_SLAPD_LDAPI_SOCKET_MODE"],
+		)
 	}
 
-	logg.Info("starting LDAP server")
-	//run slapd
-	cmd := exec.Command(environment["PORTUNUS_SLAPD_BINARY"],
+	return exec.Command(environment["PORTUNUS_SLAPD_BINARY"],
 		"-u", environment["PORTUNUS_SLAPD_USER"],
 		"-g", environment["PORTUNUS_SLAPD_GROUP"],
-		"-h", bindURL,
+		"-h", bindURLs,
 		"-f", filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], "slapd.conf"),
 		//even for debugLogFlags == 0, giving `-d` is still important because its
 		//presence keeps slapd from daemonizing)
 		"-d", strconv.FormatUint(debugLogFlags, 10),
-	)
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		logg.Error("error encountered while running slapd: " + err.Error())
-		logg.Info("Since slapd logs to syslog only, check there for more information.")
-		os.Exit(1)
+	), nil
+}
+
+// AfterStart implements the ldapBackend interface.
+func (b slapdBackend) AfterStart(environment map[string]string) error {
+	//everything is in slapd.conf already
+	return nil
+}
+
+// LogHint implements the ldapBackend interface.
+func (b slapdBackend) LogHint() string {
+	return "Since slapd logs to syslog only, check there for more information."
+}
+
+// With PORTUNUS_LDAP_BACKEND=embedded, portunus-server serves LDAP by itself.
+// Since it does not run as root, we open the privileged ports for it and pass
+// them on as file descriptors 3 (ldap:///) and, if TLS is configured, 4
+// (ldaps:///). Like slapd, we listen on all interfaces.
+func listenForEmbeddedLDAPServer(environment map[string]string) ([]*os.File, error) {
+	addresses := []string{":389"}
+	if hasTLS(environment) {
+		addresses = append(addresses, ":636")
+	}
+
+	var files []*os.File
+	for _, address := range addresses {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		file, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			return nil, err
+		}
+		//the file is a duplicate of the socket, so the socket stays open
+		listener.Close()
+		files = append(files, file)
 	}
+	return files, nil
 }
@@ -10,9 +10,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"syscall"
 
 	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/envconfig"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/sdnotify"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 )
@@ -20,38 +23,32 @@ import (
 func main() {
 	environment, ids := readConfig()
 	logg.ShowDebug = environment["PORTUNUS_DEBUG"] == "true"
-	hasher := must.Return(crypt.NewPasswordHasher())
+	//NOTE: This needs to happen before any child processes are started, since
+	//only we as the main process are allowed to talk to systemd.
+	notifier, useSystemd := sdnotify.FromEnvironment()
+	hasherOpts := crypt.HasherOptions{
+		Cost: uint(must.Return(envconfig.ParseUint(environment["PORTUNUS_PASSWORD_HASH_COST"], 32))),
+	}
+	hasher := must.Return(crypt.NewPasswordHasher(hasherOpts))
+	layout := must.Return(ldap.LayoutFromEnvironment())
 
-	//delete leftovers from previous runs
+	//with PORTUNUS_LDAP_DISABLED, there is neither an LDAP server nor an
+	//embedded LDAP server, so we only need to run portunus-server
+	ldapDisabled := environment["PORTUNUS_LDAP_DISABLED"] == "true"
 	slapdStatePath := environment["PORTUNUS_SLAPD_STATE_DIR"]
-	must.Succeed(os.RemoveAll(slapdStatePath))
-
-	//setup the slapd directory with the correct permissions
-	must.Succeed(os.Mkdir(slapdStatePath, 0700))
-	must.Succeed(os.Chown(slapdStatePath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"]))
-
-	slapdDataPath := filepath.Join(slapdStatePath, "data")
-	must.Succeed(os.Mkdir(slapdDataPath, 0770))
-	must.Succeed(os.Chown(slapdDataPath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"]))
-
-	customSchemaPath := filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], "portunus.schema")
-	must.Succeed(os.WriteFile(customSchemaPath, []byte(customSchema), 0444))
+	var backend ldapBackend
+	if !ldapDisabled {
+		//delete leftovers from previous runs
+		must.Succeed(os.RemoveAll(slapdStatePath))
 
-	slapdConfigPath := filepath.Join(slapdStatePath, "slapd.conf")
-	must.Succeed(os.WriteFile(slapdConfigPath, renderSlapdConfig(environment, hasher), 0444))
-
-	//copy TLS cert and private key into a location where slapd can definitely read it
-	if environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" {
-		copyTLSFile := func(destName, srcPath string) {
-			destPath := filepath.Join(environment["PORTUNUS_SLAPD_STATE_DIR"], destName)
-			buf := must.Return(os.ReadFile(srcPath))
-			must.Succeed(os.WriteFile(destPath, buf, 0400))
-			must.Succeed(os.Chown(destPath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"]))
+		//setup the slapd directory with the correct permissions (with the embedded
+		//LDAP server, this directory only holds the TLS files)
+		backend = newLDAPBackend(environment, ids, layout)
+		must.Succeed(os.Mkdir(slapdStatePath, 0700))
+		must.Succeed(os.Chown(slapdStatePath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"]))
+		if backend != nil {
+			must.Succeed(backend.Setup(environment, hasher))
 		}
-
-		copyTLSFile("cert.pem", environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"])
-		copyTLSFile("key.pem", environment["PORTUNUS_SLAPD_TLS_PRIVATE_KEY"])
-		copyTLSFile("ca.pem", environment["PORTUNUS_SLAPD_TLS_CA_CERTIFICATE"])
 	}
 
 	//setup our state directory with the correct permissions
@@ -59,7 +56,21 @@ func main() {
 	must.Succeed(os.MkdirAll(statePath, 0770))
 	must.Succeed(os.Chown(statePath, ids["PORTUNUS_SERVER_UID"], ids["PORTUNUS_SERVER_GID"]))
 
-	go runLDAPServer(environment)
+	//copy TLS cert and private key into a location where slapd can definitely read it
+	//(the ACME manager keeps its cache in our state directory, so this needs to come after)
+	var (
+		tlsFiles    tlsFileSet
+		acmeManager *acmeManager
+	)
+	switch {
+	case environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "":
+		tlsFiles = must.Return(readTLSFiles(environment))
+		must.Succeed(tlsFiles.CopyInto(slapdStatePath, ids))
+	case environment["PORTUNUS_SLAPD_TLS_ACME"] == "true":
+		acmeManager = must.Return(newACMEManager(environment))
+		tlsFiles = must.Return(acmeManager.ObtainInitialCertificate())
+		must.Succeed(tlsFiles.CopyInto(slapdStatePath, ids))
+	}
 
 	//run portunus-server (thus blocking this goroutine)
 	cmd := exec.Command(environment["PORTUNUS_SERVER_BINARY"])
@@ -71,15 +82,75 @@ func main() {
 		fmt.Sprintf("PORTUNUS_SERVER_GID=%d", ids["PORTUNUS_SERVER_GID"]),
 		"PORTUNUS_DEBUG="+environment["PORTUNUS_DEBUG"],
 		"PORTUNUS_GROUP_NAME_REGEX="+environment["PORTUNUS_GROUP_NAME_REGEX"],
+		"PORTUNUS_HISTORY_DEPTH="+environment["PORTUNUS_HISTORY_DEPTH"],
+		"PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES="+environment["PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES"],
+		"PORTUNUS_LDAP_BACKEND="+environment["PORTUNUS_LDAP_BACKEND"],
+		"PORTUNUS_LDAP_DRIFT_HANDLING="+environment["PORTUNUS_LDAP_DRIFT_HANDLING"],
+		"PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES="+environment["PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES"],
+		"PORTUNUS_LDAP_CHANGELOG_SIZE="+environment["PORTUNUS_LDAP_CHANGELOG_SIZE"],
+		"PORTUNUS_LDAP_DISABLED="+environment["PORTUNUS_LDAP_DISABLED"],
+		"PORTUNUS_LDAP_DISABLED_USER_HANDLING="+environment["PORTUNUS_LDAP_DISABLED_USER_HANDLING"],
+		"PORTUNUS_LDAP_RENDER_LABELS="+environment["PORTUNUS_LDAP_RENDER_LABELS"],
 		"PORTUNUS_LDAP_SUFFIX="+environment["PORTUNUS_LDAP_SUFFIX"],
 		"PORTUNUS_LDAP_PASSWORD="+environment["PORTUNUS_LDAP_PASSWORD"],
+		"PORTUNUS_PASSWORD_HASH_COST="+environment["PORTUNUS_PASSWORD_HASH_COST"],
+		"PORTUNUS_POLICY_WEBHOOK_FAIL_OPEN="+environment["PORTUNUS_POLICY_WEBHOOK_FAIL_OPEN"],
+		"PORTUNUS_POLICY_WEBHOOK_TIMEOUT="+environment["PORTUNUS_POLICY_WEBHOOK_TIMEOUT"],
+		"PORTUNUS_POSIX_GROUP_LIMIT="+environment["PORTUNUS_POSIX_GROUP_LIMIT"],
+		"PORTUNUS_SERVER_HTTP_H2C="+environment["PORTUNUS_SERVER_HTTP_H2C"],
+		"PORTUNUS_SERVER_HTTP_IDLE_TIMEOUT="+environment["PORTUNUS_SERVER_HTTP_IDLE_TIMEOUT"],
 		"PORTUNUS_SERVER_HTTP_LISTEN="+environment["PORTUNUS_SERVER_HTTP_LISTEN"],
+		"PORTUNUS_SERVER_HTTP_MAX_BODY_SIZE="+environment["PORTUNUS_SERVER_HTTP_MAX_BODY_SIZE"],
+		"PORTUNUS_SERVER_HTTP_READ_HEADER_TIMEOUT="+environment["PORTUNUS_SERVER_HTTP_READ_HEADER_TIMEOUT"],
+		"PORTUNUS_SERVER_HTTP_READ_TIMEOUT="+environment["PORTUNUS_SERVER_HTTP_READ_TIMEOUT"],
+		"PORTUNUS_SERVER_HTTP_REQUIRE_HTTPS="+environment["PORTUNUS_SERVER_HTTP_REQUIRE_HTTPS"],
 		"PORTUNUS_SERVER_HTTP_SECURE="+environment["PORTUNUS_SERVER_HTTP_SECURE"],
+		"PORTUNUS_SERVER_HTTP_WRITE_TIMEOUT="+environment["PORTUNUS_SERVER_HTTP_WRITE_TIMEOUT"],
+		"PORTUNUS_SERVER_REMEMBER_LOGIN_NAME="+environment["PORTUNUS_SERVER_REMEMBER_LOGIN_NAME"],
+		"PORTUNUS_SERVER_SELF_SERVICE_PRIVACY="+environment["PORTUNUS_SERVER_SELF_SERVICE_PRIVACY"],
 		"PORTUNUS_SERVER_STATE_DIR="+environment["PORTUNUS_SERVER_STATE_DIR"],
+		"PORTUNUS_SIEM_EXPORT_FORMAT="+environment["PORTUNUS_SIEM_EXPORT_FORMAT"],
+		"PORTUNUS_SLAPD_LDAPI_SOCKET="+environment["PORTUNUS_SLAPD_LDAPI_SOCKET"],
+		"PORTUNUS_SLAPD_STATE_DIR="+environment["PORTUNUS_SLAPD_STATE_DIR"],
 		"PORTUNUS_SLAPD_TLS_DOMAIN_NAME="+environment["PORTUNUS_SLAPD_TLS_DOMAIN_NAME"],
 		"PORTUNUS_USER_NAME_REGEX="+environment["PORTUNUS_USER_NAME_REGEX"],
+		"PORTUNUS_USER_RETENTION_DAYS="+environment["PORTUNUS_USER_RETENTION_DAYS"],
 	)
-	err := cmd.Run()
+
+	restartLDAPServer := make(chan struct{})
+	switch {
+	case ldapDisabled:
+		//there are no TLS files to watch, so nothing is ever sent on restartLDAPServer
+	case backend == nil:
+		cmd.ExtraFiles = must.Return(listenForEmbeddedLDAPServer(environment))
+		//portunus-server picks up changed TLS files by itself
+		go func() {
+			for range restartLDAPServer {
+			}
+		}()
+	default:
+		//after the LDAP server was restarted, portunus-server needs to reconnect to it
+		go runLDAPServer(environment, backend, restartLDAPServer, func() {
+			err := cmd.Process.Signal(syscall.SIGHUP)
+			if err != nil {
+				logg.Error("could not ask portunus-server to reconnect to LDAP: %s", err.Error())
+			}
+		})
+	}
+	if useSystemd {
+		go notifySystemd(notifier, environment)
+	}
+
+	err := cmd.Start()
+	if err == nil {
+		switch {
+		case environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "":
+			go watchTLSFiles(environment, ids, tlsFiles, restartLDAPServer)
+		case acmeManager != nil:
+			go acmeManager.RenewPeriodically(slapdStatePath, ids, restartLDAPServer)
+		}
+		err = cmd.Wait()
+	}
 	if err != nil {
 		logg.Fatal("error encountered while running portunus-server: " + err.Error())
 	}
@@ -0,0 +1,93 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/majewsky/portunus/internal/sdnotify"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// notifySystemd reports to systemd once slapd and portunus-server accept
+// connections, and then keeps pinging the watchdog (if enabled) for as long
+// as both remain reachable. With PORTUNUS_LDAP_DISABLED, only portunus-server
+// is checked.
+func notifySystemd(n sdnotify.Notifier, environment map[string]string) {
+	addresses := []string{probeAddressFor(environment["PORTUNUS_SERVER_HTTP_LISTEN"])}
+	readyStatus := "Serving HTTP"
+	if environment["PORTUNUS_LDAP_DISABLED"] != "true" {
+		addresses = append(addresses, ldapProbeAddress(environment))
+		readyStatus = "Serving LDAP and HTTP"
+	}
+
+	sendNotification(n, "STATUS=Waiting for slapd and portunus-server to start up...")
+	for checkHealth(addresses...) != nil {
+		time.Sleep(250 * time.Millisecond)
+	}
+	sendNotification(n, "READY=1\nSTATUS="+readyStatus)
+
+	interval := n.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	for range time.Tick(interval / 2) {
+		err := checkHealth(addresses...)
+		if err == nil {
+			sendNotification(n, "WATCHDOG=1")
+		} else {
+			//by withholding the watchdog ping, we ask systemd to restart us
+			logg.Error("health check failed: %s", err.Error())
+		}
+	}
+}
+
+// ldapProbeAddress returns the address where slapd can be reached once it
+// accepts connections.
+func ldapProbeAddress(environment map[string]string) string {
+	if hasTLS(environment) {
+		return "127.0.0.1:636"
+	}
+	return "127.0.0.1:389"
+}
+
+func sendNotification(n sdnotify.Notifier, state string) {
+	err := n.Notify(state)
+	if err != nil {
+		logg.Error("cannot send notification to systemd: %s", err.Error())
+	}
+}
+
+func checkHealth(addresses ...string) error {
+	for _, address := range addresses {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// probeAddressFor converts a listen address into an address that we can
+// connect to. When listening on all interfaces, we connect to loopback.
+func probeAddressFor(listenAddress string) string {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return listenAddress
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil || !ip.IsUnspecified():
+		return listenAddress
+	case ip.To4() != nil:
+		return net.JoinHostPort("127.0.0.1", port)
+	default:
+		return net.JoinHostPort("::1", port)
+	}
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// How often the TLS files are checked for changes. Certificates are usually
+// renewed well ahead of their expiry, so this does not need to be quick.
+const tlsFilePollInterval = time.Minute
+
+// Whether slapd serves LDAPS, regardless of where the certificate comes from.
+func hasTLS(environment map[string]string) bool {
+	return environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"] != "" || environment["PORTUNUS_SLAPD_TLS_ACME"] == "true"
+}
+
+// The contents of the TLS files named by PORTUNUS_SLAPD_TLS_*.
+type tlsFileSet struct {
+	Certificate   []byte
+	PrivateKey    []byte
+	CACertificate []byte
+}
+
+func readTLSFiles(environment map[string]string) (tlsFileSet, error) {
+	var (
+		result tlsFileSet
+		err    error
+	)
+	result.Certificate, err = os.ReadFile(environment["PORTUNUS_SLAPD_TLS_CERTIFICATE"])
+	if err != nil {
+		return tlsFileSet{}, err
+	}
+	result.PrivateKey, err = os.ReadFile(environment["PORTUNUS_SLAPD_TLS_PRIVATE_KEY"])
+	if err != nil {
+		return tlsFileSet{}, err
+	}
+	result.CACertificate, err = os.ReadFile(environment["PORTUNUS_SLAPD_TLS_CA_CERTIFICATE"])
+	if err != nil {
+		return tlsFileSet{}, err
+	}
+	return result, nil
+}
+
+func (s tlsFileSet) Equal(other tlsFileSet) bool {
+	return bytes.Equal(s.Certificate, other.Certificate) &&
+		bytes.Equal(s.PrivateKey, other.PrivateKey) &&
+		bytes.Equal(s.CACertificate, other.CACertificate)
+}
+
+// CopyInto writes the files into a location where slapd can definitely read
+// them (the file names are referenced in configTemplateTLS).
+func (s tlsFileSet) CopyInto(slapdStatePath string, ids map[string]int) error {
+	for destName, buf := range map[string][]byte{
+		"cert.pem": s.Certificate,
+		"key.pem":  s.PrivateKey,
+		"ca.pem":   s.CACertificate,
+	} {
+		destPath := filepath.Join(slapdStatePath, destName)
+		err := os.WriteFile(destPath, buf, 0400)
+		if err != nil {
+			return err
+		}
+		err = os.Chown(destPath, ids["PORTUNUS_SLAPD_UID"], ids["PORTUNUS_SLAPD_GID"])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watches the TLS files for changes (e.g. when certbot renews the
+// certificate), and restarts slapd whenever they change, since slapd only
+// reads them on startup. Does not return. Call with `go`.
+func watchTLSFiles(environment map[string]string, ids map[string]int, current tlsFileSet, restartLDAPServer chan<- struct{}) {
+	var rejected tlsFileSet //to avoid complaining about the same broken files every time
+	for range time.Tick(tlsFilePollInterval) {
+		files, err := readTLSFiles(environment)
+		if err != nil {
+			logg.Error("cannot check TLS files for changes: %s", err.Error())
+			continue
+		}
+		if files.Equal(current) || files.Equal(rejected) {
+			continue
+		}
+
+		//while certbot et al. are replacing the files, we could observe the new
+		//certificate with the old key or vice versa
+		_, err = tls.X509KeyPair(files.Certificate, files.PrivateKey)
+		if err != nil {
+			logg.Error("not reloading changed TLS files yet: %s", err.Error())
+			rejected = files
+			continue
+		}
+
+		err = files.CopyInto(environment["PORTUNUS_SLAPD_STATE_DIR"], ids)
+		if err != nil {
+			//slapd is still running with the old files, so we can try again later
+			logg.Error("cannot copy changed TLS files: %s", err.Error())
+			continue
+		}
+		logg.Info("TLS files have changed, restarting LDAP server")
+		current = files
+		restartLDAPServer <- struct{}{}
+	}
+}
+
+// Waits until slapd accepts connections after a restart.
+func waitForLDAPServer(environment map[string]string, timeout time.Duration) error {
+	address := ldapProbeAddress(environment)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkHealth(address)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("LDAP server did not come back within %s: %w", timeout, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
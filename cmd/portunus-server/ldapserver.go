@@ -0,0 +1,131 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/osext"
+)
+
+// With PORTUNUS_LDAP_BACKEND=embedded, we serve LDAP ourselves instead of
+// writing into slapd. Since we do not run as root, portunus-orchestrator opens
+// the LDAP ports for us, and passes them as file descriptors 3 (ldap:///) and,
+// if TLS is configured, 4 (ldaps:///).
+func newEmbeddedLDAPServer(nexus core.Nexus) (*ldap.Server, []net.Listener, error) {
+	opts := ldap.ServerOptions{
+		DNSuffix:     osext.MustGetenv("PORTUNUS_LDAP_SUFFIX"),
+		RenderLabels: os.Getenv("PORTUNUS_LDAP_RENDER_LABELS") == "true",
+	}
+	var err error
+	opts.Layout, err = ldap.LayoutFromEnvironment()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.DisabledUserHandling, err = ldap.ParseDisabledUserHandling(os.Getenv("PORTUNUS_LDAP_DISABLED_USER_HANDLING"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileNames := []string{"ldap"}
+	if os.Getenv("PORTUNUS_SLAPD_TLS_DOMAIN_NAME") != "" {
+		//the orchestrator puts the TLS files in the same place as for slapd
+		statePath := osext.MustGetenv("PORTUNUS_SLAPD_STATE_DIR")
+		loader := &certificateLoader{
+			CertificatePath: filepath.Join(statePath, "cert.pem"),
+			PrivateKeyPath:  filepath.Join(statePath, "key.pem"),
+		}
+		_, err := loader.GetCertificate(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.TLSConfig = &tls.Config{
+			GetCertificate: loader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		fileNames = append(fileNames, "ldaps")
+	}
+
+	var listeners []net.Listener
+	for idx, fileName := range fileNames {
+		file := os.NewFile(uintptr(3+idx), fileName)
+		if file == nil {
+			return nil, nil, fmt.Errorf("missing file descriptor for %s listener", fileName)
+		}
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot use file descriptor for %s listener: %w", fileName, err)
+		}
+		file.Close() //FileListener() has made a copy
+		if opts.TLSConfig != nil && fileName == "ldaps" {
+			listener = tls.NewListener(listener, opts.TLSConfig)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	server, err := ldap.NewServer(nexus, opts)
+	return server, listeners, err
+}
+
+// certificateLoader provides the TLS certificate for the embedded LDAP server.
+// portunus-orchestrator replaces the files when the certificate is renewed.
+// We check for this on each handshake, so unlike slapd, we do not need to be
+// restarted to pick up the new certificate.
+type certificateLoader struct {
+	CertificatePath string
+	PrivateKeyPath  string
+
+	mutex   sync.Mutex
+	current *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate implements the interface required by tls.Config.
+func (l *certificateLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var modTime time.Time
+	for _, path := range []string{l.CertificatePath, l.PrivateKeyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return l.fallback(err)
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if l.current != nil && modTime.Equal(l.modTime) {
+		return l.current, nil
+	}
+
+	//while the files are being replaced, we could observe the new certificate
+	//with the old key or vice versa; in that case, we try again on the next
+	//handshake
+	cert, err := tls.LoadX509KeyPair(l.CertificatePath, l.PrivateKeyPath)
+	if err != nil {
+		return l.fallback(err)
+	}
+	l.current = &cert
+	l.modTime = modTime
+	return l.current, nil
+}
+
+func (l *certificateLoader) fallback(err error) (*tls.Certificate, error) {
+	if l.current == nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	return l.current, nil
+}
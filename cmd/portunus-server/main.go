@@ -8,18 +8,37 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"slices"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/majewsky/portunus/internal/api"
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/buildinfo"
+	"github.com/majewsky/portunus/internal/clientinfo"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/digest"
+	"github.com/majewsky/portunus/internal/envconfig"
 	"github.com/majewsky/portunus/internal/frontend"
 	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/policy"
+	"github.com/majewsky/portunus/internal/provisioning"
+	"github.com/majewsky/portunus/internal/risk"
+	"github.com/majewsky/portunus/internal/siem"
+	"github.com/majewsky/portunus/internal/stats"
 	"github.com/majewsky/portunus/internal/store"
 	_ "github.com/majewsky/xyrillian.css"
+	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/go-bits/osext"
@@ -27,40 +46,485 @@ import (
 
 func main() {
 	logg.ShowDebug = os.Getenv("PORTUNUS_DEBUG") == "true"
-	dropPrivileges()
+
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	seedPath := flag.String("validate-seed", "", "seed file to validate (instead of running the server)")
+	databasePath := flag.String("database", "", "database file to validate the seed against")
+	migratePath := flag.String("migrate-database", "", "database file to migrate (instead of running the server)")
+	schemaVersion := flag.Uint("schema-version", 0, "schema version to migrate the database file to (default: current)")
+	showVersion := flag.Bool("version", false, "show version information and exit")
+	flag.Parse()
+	schemaVersionGiven := false
+	flag.Visit(func(f *flag.Flag) { schemaVersionGiven = schemaVersionGiven || f.Name == "schema-version" })
+	if flag.NArg() > 0 || (*databasePath != "" && *seedPath == "") || (schemaVersionGiven && *migratePath == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *showVersion {
+		fmt.Println("portunus-server " + buildinfo.Get().String())
+		return
+	}
+	if *seedPath != "" {
+		os.Exit(validateSeed(*seedPath, *databasePath))
+	}
+	if *migratePath != "" {
+		if !schemaVersionGiven {
+			*schemaVersion = store.CurrentSchemaVersion()
+		}
+		os.Exit(migrateDatabaseFile(*migratePath, *schemaVersion))
+	}
+
+	if isStandalone() {
+		prepareStandaloneMode()
+	} else {
+		dropPrivileges()
+	}
+	logg.Info("starting portunus-server %s", buildinfo.Get().String())
 
 	vcfg := must.Return(core.ReadValidationConfigFromEnvironment())
 	seed, errs := core.ReadDatabaseSeedFromEnvironment(vcfg)
-	errs.LogFatalIfError()
+	if !errs.IsEmpty() {
+		for _, problem := range core.BuildSeedReport(seed, errs, vcfg).Problems {
+			logg.Error("%s", problem.String())
+		}
+		logg.Fatal("cannot use the seed from PORTUNUS_SEED_PATH because of the problems listed above")
+	}
 
-	ctx := context.TODO()
-	hasher := must.Return(crypt.NewPasswordHasher())
+	hasher := must.Return(newPasswordHasher())
 	nexus := core.NewNexus(seed, vcfg, hasher)
 
-	storePath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "database.json")
-	storeAdapter := store.NewAdapter(nexus, storePath)
+	webhookURL := os.Getenv("PORTUNUS_POLICY_WEBHOOK_URL")
+	if webhookURL != "" {
+		timeout := must.Return(envconfig.GetPositiveDuration("PORTUNUS_POLICY_WEBHOOK_TIMEOUT", 2*time.Second))
+		if timeout > policy.MaxTimeout {
+			logg.Fatal("PORTUNUS_POLICY_WEBHOOK_TIMEOUT must not be larger than %s, but got %s", policy.MaxTimeout, timeout)
+		}
+		webhook := policy.NewWebhook(policy.WebhookOptions{
+			URL:      webhookURL,
+			Timeout:  timeout,
+			FailOpen: os.Getenv("PORTUNUS_POLICY_WEBHOOK_FAIL_OPEN") == "true",
+		})
+		nexus.AddPreCommitHook(webhook.Check)
+	}
+
+	//The adapters get a separate context that is only canceled once the HTTP
+	//server has shut down, since in-flight requests may still cause database
+	//updates that need to be persisted.
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	//SIGHUP is handled below, but needs to be caught early since its default
+	//action would terminate the process
+	reconnectChan := make(chan os.Signal, 1)
+	signal.Notify(reconnectChan, syscall.SIGHUP)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+
+	//in active/standby mode, the other instance may be using the state
+	//directory right now, so we must not touch anything in there before we
+	//are the leader
+	lease := newLeaderLease()
+	if lease != nil {
+		if !runStandbyMode(shutdownCtx, lease) {
+			return
+		}
+		go func() {
+			err := lease.Hold(ctx)
+			if err != nil {
+				//the other instance may be taking over right now
+				logg.Fatal("stopping because leadership lease was lost: %s", err.Error())
+			}
+		}()
+	}
+
+	auditLog := must.Return(audit.OpenLog(filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "audit.log")))
+	var geoIP *clientinfo.GeoIPDatabase
+	if geoIPPath := os.Getenv("PORTUNUS_SERVER_GEOIP_DATABASE"); geoIPPath != "" {
+		geoIP = must.Return(clientinfo.LoadGeoIPDatabase(geoIPPath))
+	}
+	loadSeed := func() (*core.DatabaseSeed, errext.ErrorSet) {
+		return core.ReadDatabaseSeedFromEnvironment(vcfg)
+	}
+	handlerOpts := frontend.HandlerOptions{
+		AuditLog:           auditLog,
+		LoadSeed:           loadSeed,
+		GeoIP:              geoIP,
+		LoginRiskProvider:  newLoginRiskProvider(),
+		IsBehindTLSProxy:   os.Getenv("PORTUNUS_SERVER_HTTP_SECURE") == "true",
+		RequireHTTPS:       os.Getenv("PORTUNUS_SERVER_HTTP_REQUIRE_HTTPS") == "true",
+		RememberLoginName:  os.Getenv("PORTUNUS_SERVER_REMEMBER_LOGIN_NAME") == "true",
+		SelfServicePrivacy: os.Getenv("PORTUNUS_SERVER_SELF_SERVICE_PRIVACY") == "true",
+		Features:           must.Return(core.ReadFeatureSetFromEnvironment()),
+		SiteInfo:           must.Return(frontend.ReadSiteInfoFromEnvironment()),
+		Branding:           must.Return(frontend.ReadBrandingFromEnvironment()),
+		Avatars:            must.Return(frontend.ReadAvatarSourceFromEnvironment()),
+		MaxRequestBodySize: int64(must.Return(envconfig.GetSize("PORTUNUS_SERVER_HTTP_MAX_BODY_SIZE", frontend.DefaultMaxRequestBodySize))),
+	}
+	if os.Getenv("PORTUNUS_SMTP_SERVER") != "" {
+		handlerOpts.SendMail = readMailOptions().Send
+	}
+
+	var (
+		storeAdapter store.Backend
+		storePath    string
+		backupDir    string //only set if timestamped backups are taken
+	)
+	switch storeBackend := osext.GetenvOrDefault("PORTUNUS_STORE_BACKEND", "file"); storeBackend {
+	case "file":
+		//if the database file is broken, do not start the adapters on it
+		storePath = filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "database.json")
+		_, err := store.ReadDatabaseFile(storePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			if !runMaintenanceMode(shutdownCtx, storePath, err, seed, vcfg, hasher, handlerOpts) {
+				return
+			}
+		}
+		backups := store.BackupOptions{
+			Dir:         filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "backups"),
+			Retention:   must.Return(envconfig.GetUint("PORTUNUS_STORE_BACKUP_RETENTION", 0)),
+			MinInterval: must.Return(envconfig.GetDuration("PORTUNUS_STORE_BACKUP_INTERVAL", 0)),
+		}
+		if backups.Retention > 0 {
+			backupDir = backups.Dir
+		}
+		storeAdapter = store.NewAdapter(nexus, storePath, backups)
+	case "sqlite", "postgres":
+		opts := store.SQLOptions{
+			Driver:       storeBackend,
+			DSN:          os.Getenv("PORTUNUS_STORE_DSN"),
+			PollInterval: must.Return(envconfig.GetPositiveDuration("PORTUNUS_STORE_POLL_INTERVAL", 5*time.Second)),
+		}
+		if storeBackend == "sqlite" {
+			if opts.DSN == "" {
+				opts.DSN = filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "database.sqlite")
+			}
+			storePath = opts.DSN
+		} else if opts.DSN == "" {
+			logg.Fatal("missing environment variable: PORTUNUS_STORE_DSN")
+		}
+		storeAdapter = must.Return(store.NewSQLAdapter(nexus, opts))
+	default:
+		logg.Fatal("unknown value for PORTUNUS_STORE_BACKEND: %q", storeBackend)
+	}
+
+	auditLog.RecordChanges(ctx, nexus)
+	//the environment does not change while we are running
+	envUpgradeNotes := core.EnvironmentUpgradeNotes()
+	collectUpgradeNotes := func(db core.Database) []core.UpgradeNote {
+		notes := append(slices.Clone(envUpgradeNotes), storeAdapter.UpgradeNotes()...)
+		return append(notes, db.UpgradeNotes(hasher)...)
+	}
+	handlerOpts.UpgradeNotes = func() []core.UpgradeNote {
+		return collectUpgradeNotes(core.Database{Users: nexus.ListUsers(), ServiceAccounts: nexus.ListServiceAccounts()})
+	}
+	logUpgradeNotesOnStartup(ctx, nexus, collectUpgradeNotes)
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		must.Succeed(storeAdapter.Run(ctx))
 	}()
 
-	ldapConn := must.Return(ldap.Connect(ldap.ConnectionOptions{
-		DNSuffix:      osext.MustGetenv("PORTUNUS_LDAP_SUFFIX"),
-		Password:      osext.MustGetenv("PORTUNUS_LDAP_PASSWORD"),
-		TLSDomainName: os.Getenv("PORTUNUS_SLAPD_TLS_DOMAIN_NAME"),
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		core.RunUserPurge(ctx, nexus)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		core.RunExpiry(ctx, nexus)
+	}()
+
+	if sender := newDigestSender(auditLog); sender != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sender.Run(ctx)
+		}()
+	}
+
+	if exporter := newSIEMExporter(auditLog); exporter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exporter.Run(ctx)
+		}()
+	}
+
+	switch {
+	case os.Getenv("PORTUNUS_LDAP_DISABLED") == "true":
+		//there is no LDAPStatus or ServiceAccountDN (etc.) since there is no LDAP directory
+		logg.Info("LDAP is disabled: users and groups will only be available through the web UI and the admin API")
+	case os.Getenv("PORTUNUS_LDAP_BACKEND") == "embedded":
+		ldapServer, ldapListeners, err := newEmbeddedLDAPServer(nexus)
+		if err != nil {
+			logg.Fatal("cannot start embedded LDAP server: %s", err.Error())
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			must.Succeed(ldapServer.Run(ctx, ldapListeners...))
+		}()
+		//there is no LDAPStatus since there is nothing to synchronize
+		handlerOpts.ServiceAccountDN = ldapServer.ServiceAccountDN
+		handlerOpts.UserDN = ldapServer.UserDN
+		handlerOpts.GroupDNs = ldapServer.GroupDNs
+		handlerOpts.LDAPObjects = ldapServer.Objects
+	default:
+		ldapConn := must.Return(ldap.Connect(ldap.ConnectionOptions{
+			DNSuffix:      osext.MustGetenv("PORTUNUS_LDAP_SUFFIX"),
+			Password:      osext.MustGetenv("PORTUNUS_LDAP_PASSWORD"),
+			TLSDomainName: os.Getenv("PORTUNUS_SLAPD_TLS_DOMAIN_NAME"),
+			SocketPath:    os.Getenv("PORTUNUS_SLAPD_LDAPI_SOCKET"),
+		}))
+		ldapAdapter := ldap.NewAdapter(nexus, ldapConn, ldap.AdapterOptions{
+			ChangelogSize:  must.Return(envconfig.GetUint64("PORTUNUS_LDAP_CHANGELOG_SIZE", 0)),
+			RenderLabels:   os.Getenv("PORTUNUS_LDAP_RENDER_LABELS") == "true",
+			Layout:         must.Return(ldap.LayoutFromEnvironment()),
+			RetryInterval:  must.Return(envconfig.GetDuration("PORTUNUS_LDAP_RETRY_INTERVAL", 0)),
+			RetryQueuePath: filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "ldap-retry-queue.json"),
+
+			AcceptPasswordChanges: os.Getenv("PORTUNUS_LDAP_ACCEPT_PASSWORD_CHANGES") == "true",
+			DriftHandling:         must.Return(ldap.ParseDriftHandling(os.Getenv("PORTUNUS_LDAP_DRIFT_HANDLING"))),
+			DisabledUserHandling:  must.Return(ldap.ParseDisabledUserHandling(os.Getenv("PORTUNUS_LDAP_DISABLED_USER_HANDLING"))),
+			AuditLog:              auditLog,
+		})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			must.Succeed(ldapAdapter.Run(ctx))
+		}()
+		//portunus-orchestrator sends SIGHUP after restarting slapd to load a renewed
+		//TLS certificate
+		go func() {
+			for range reconnectChan {
+				logg.Info("reconnecting to LDAP server because of SIGHUP")
+				err := ldapAdapter.Reconnect()
+				if err != nil {
+					logg.Error("could not reconnect to LDAP server: %s", err.Error())
+				}
+			}
+		}()
+
+		handlerOpts.LDAPStatus = ldapAdapter.Status
+		handlerOpts.ServiceAccountDN = ldapAdapter.ServiceAccountDN
+		handlerOpts.UserDN = ldapAdapter.UserDN
+		handlerOpts.GroupDNs = ldapAdapter.GroupDNs
+		handlerOpts.LDAPObjects = ldapAdapter.Objects
+		handlerOpts.TestLDAPBind = ldapAdapter.TestBind
+	}
+
+	statsCollector := must.Return(stats.NewCollector(nexus, stats.CollectorOptions{
+		StorePath:   storePath,
+		HistoryPath: filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "stats-history.json"),
+		LDAPStatus:  handlerOpts.LDAPStatus,
 	}))
-	ldapAdapter := ldap.NewAdapter(nexus, ldapConn)
+	wg.Add(1)
 	go func() {
-		must.Succeed(ldapAdapter.Run(ctx))
+		defer wg.Done()
+		statsCollector.Run(ctx)
 	}()
+	handlerOpts.Stats = statsCollector
+	handlerOpts.ProvisioningWebhook = newProvisioningWebhook(nexus)
+
+	server := newHTTPServer(frontend.HTTPHandler(nexus, handlerOpts))
+	go func() {
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			logg.Fatal(err.Error())
+		}
+	}()
+
+	//the admin API for portunusctl is only reachable through a Unix socket
+	adminSocketPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "admin.sock")
+	var adminServer *http.Server
+	if handlerOpts.Features.IsEnabled(core.FeatureAdminAPI) {
+		adminListener := must.Return(api.ListenUnix(adminSocketPath))
+		adminServer = api.NewAdminServer(nexus, loadSeed, backupDir)
+		go func() {
+			err := adminServer.Serve(adminListener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				logg.Fatal(err.Error())
+			}
+		}()
+	} else {
+		//do not leave behind a socket from a previous run that nobody is listening on
+		err := os.Remove(adminSocketPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logg.Error("could not remove %s: %s", adminSocketPath, err.Error())
+		}
+	}
+
+	//on SIGINT/SIGTERM: stop accepting new requests, and give in-flight requests a bit of time to complete
+	<-shutdownCtx.Done()
+	logg.Info("shutting down...")
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelTimeout()
+	err := server.Shutdown(timeoutCtx)
+	if err != nil {
+		logg.Error("while shutting down HTTP server: %s", err.Error())
+	}
+	if adminServer != nil {
+		err = adminServer.Shutdown(timeoutCtx)
+		if err != nil {
+			logg.Error("while shutting down admin API: %s", err.Error())
+		}
+	}
+
+	//now that no more database updates can come in through the HTTP server, the
+	//adapters can be stopped (they will flush pending writes before returning)
+	cancel()
+	wg.Wait()
+	if lease != nil {
+		err = lease.Release()
+		if err != nil {
+			logg.Error("could not release leadership lease: %s", err.Error())
+		}
+	}
+}
+
+func newHTTPServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              os.Getenv("PORTUNUS_SERVER_HTTP_LISTEN"),
+		Handler:           handler,
+		ReadHeaderTimeout: must.Return(envconfig.GetDuration("PORTUNUS_SERVER_HTTP_READ_HEADER_TIMEOUT", 10*time.Second)),
+		ReadTimeout:       must.Return(envconfig.GetDuration("PORTUNUS_SERVER_HTTP_READ_TIMEOUT", 30*time.Second)),
+		WriteTimeout:      must.Return(envconfig.GetDuration("PORTUNUS_SERVER_HTTP_WRITE_TIMEOUT", 30*time.Second)),
+		IdleTimeout:       must.Return(envconfig.GetDuration("PORTUNUS_SERVER_HTTP_IDLE_TIMEOUT", 2*time.Minute)),
+		Protocols:         new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	if os.Getenv("PORTUNUS_SERVER_HTTP_H2C") == "true" {
+		//HTTP/2 without TLS, for when we are behind a reverse proxy that speaks HTTP/2 to its backends
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
+}
+
+func newPasswordHasher() (crypt.PasswordHasher, error) {
+	hashCost, err := envconfig.GetUint("PORTUNUS_PASSWORD_HASH_COST", 0)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewPasswordHasher(crypt.HasherOptions{Cost: hashCost})
+}
+
+// Returns nil if no login risk providers are configured.
+func newLoginRiskProvider() risk.Provider {
+	timeout := must.Return(envconfig.GetDuration("PORTUNUS_LOGIN_RISK_TIMEOUT", 2*time.Second))
+	var providers []risk.Provider
+	if path := os.Getenv("PORTUNUS_LOGIN_RISK_STATIC_LIST"); path != "" {
+		providers = append(providers, must.Return(risk.LoadStaticList(path)))
+	}
+	if lapiURL := os.Getenv("PORTUNUS_LOGIN_RISK_CROWDSEC_URL"); lapiURL != "" {
+		providers = append(providers, risk.NewCrowdSec(risk.CrowdSecOptions{
+			URL:     lapiURL,
+			APIKey:  osext.MustGetenv("PORTUNUS_LOGIN_RISK_CROWDSEC_API_KEY"),
+			Timeout: timeout,
+		}))
+	}
+	if webhookURL := os.Getenv("PORTUNUS_LOGIN_RISK_WEBHOOK_URL"); webhookURL != "" {
+		providers = append(providers, risk.NewWebhook(risk.WebhookOptions{
+			URL:     webhookURL,
+			Timeout: timeout,
+		}))
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+
+	failureLevel := risk.LevelChallenge
+	if os.Getenv("PORTUNUS_LOGIN_RISK_FAIL_OPEN") == "true" {
+		failureLevel = risk.LevelAllow
+	}
+	return risk.Chain{Providers: providers, FailureLevel: failureLevel}
+}
+
+// Returns nil if the change digest is not enabled.
+func newDigestSender(auditLog *audit.Log) *digest.Sender {
+	recipients := strings.Fields(os.Getenv("PORTUNUS_DIGEST_RECIPIENTS"))
+	if len(recipients) == 0 {
+		return nil
+	}
+	threshold := must.Return(envconfig.GetUint("PORTUNUS_DIGEST_GROUP_GROWTH_THRESHOLD", 10))
+	return digest.NewSender(auditLog, digest.SenderOptions{
+		Recipients:      recipients,
+		GrowthThreshold: int(threshold),
+		StatePath:       filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "digest-state.json"),
+		Mail:            readMailOptions(),
+	})
+}
+
+// Used by newDigestSender(), and for notifying users about security events.
+func readMailOptions() digest.MailOptions {
+	return digest.MailOptions{
+		ServerAddress: osext.MustGetenv("PORTUNUS_SMTP_SERVER"),
+		FromAddress:   osext.MustGetenv("PORTUNUS_SMTP_FROM"),
+		Username:      os.Getenv("PORTUNUS_SMTP_USERNAME"),
+		Password:      os.Getenv("PORTUNUS_SMTP_PASSWORD"),
+	}
+}
+
+// Returns nil if the SIEM export is not enabled.
+func newSIEMExporter(auditLog *audit.Log) *siem.Exporter {
+	exportURL := os.Getenv("PORTUNUS_SIEM_EXPORT_URL")
+	if exportURL == "" {
+		return nil
+	}
+	exporter, err := siem.NewExporter(auditLog, siem.ExporterOptions{
+		URL:           exportURL,
+		Format:        must.Return(siem.ParseFormat(os.Getenv("PORTUNUS_SIEM_EXPORT_FORMAT"))),
+		Authorization: os.Getenv("PORTUNUS_SIEM_EXPORT_AUTHORIZATION"),
+		StatePath:     filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "siem-export-state.json"),
+	})
+	if err != nil {
+		logg.Fatal(err.Error())
+	}
+	return exporter
+}
+
+// Returns nil if the provisioning webhook is not enabled.
+func newProvisioningWebhook(nexus core.Nexus) http.Handler {
+	secret := os.Getenv("PORTUNUS_PROVISIONING_WEBHOOK_SECRET")
+	if secret == "" {
+		return nil
+	}
+	return provisioning.NewReceiver(nexus, provisioning.ReceiverOptions{
+		Secret:  secret,
+		Mapping: must.Return(provisioning.ReadFieldMapping(os.Getenv("PORTUNUS_PROVISIONING_WEBHOOK_MAPPING_PATH"))),
+	})
+}
+
+// Once the database has been loaded, all pending upgrade notes are logged in
+// one block, so that they are not missed among the other log messages.
+func logUpgradeNotesOnStartup(ctx context.Context, nexus core.Nexus, collectUpgradeNotes func(core.Database) []core.UpgradeNote) {
+	ctx, cancel := context.WithCancel(ctx)
+	//NOTE: The listener runs while the nexus is locked, so it must only look at
+	//the `db` that it is given.
+	nexus.AddListener(ctx, func(db core.Database) {
+		//only the initial load is of interest
+		if ctx.Err() != nil {
+			return
+		}
+		cancel()
 
-	handler := frontend.HTTPHandler(nexus, os.Getenv("PORTUNUS_SERVER_HTTP_SECURE") == "true")
-	logg.Fatal(http.ListenAndServe(os.Getenv("PORTUNUS_SERVER_HTTP_LISTEN"), handler).Error())
+		notes := collectUpgradeNotes(db)
+		if len(notes) == 0 {
+			return
+		}
+		logg.Info("==== %d pending upgrade note(s), also shown on the status page ====", len(notes))
+		for _, note := range notes {
+			logg.Info("- %s", note.String())
+		}
+		logg.Info("==== end of upgrade notes ====")
+	})
 }
 
 func dropPrivileges() {
-	gidParsed, err := strconv.ParseUint(os.Getenv("PORTUNUS_SERVER_GID"), 10, 32)
+	gidParsed, err := envconfig.ParseUint(os.Getenv("PORTUNUS_SERVER_GID"), 32)
 	if err != nil {
-		logg.Fatal("cannot parse PORTUNUS_SERVER_GID: " + err.Error())
+		logg.Fatal("malformed value for PORTUNUS_SERVER_GID: " + err.Error())
 	}
 	gid := int(gidParsed)
 	err = syscall.Setresgid(gid, gid, gid)
@@ -68,9 +532,9 @@ func dropPrivileges() {
 		logg.Fatal("change GID failed: " + err.Error())
 	}
 
-	uidParsed, err := strconv.ParseUint(os.Getenv("PORTUNUS_SERVER_UID"), 10, 32)
+	uidParsed, err := envconfig.ParseUint(os.Getenv("PORTUNUS_SERVER_UID"), 32)
 	if err != nil {
-		logg.Fatal("cannot parse PORTUNUS_SERVER_UID: " + err.Error())
+		logg.Fatal("malformed value for PORTUNUS_SERVER_UID: " + err.Error())
 	}
 	uid := int(uidParsed)
 	err = syscall.Setresuid(uid, uid, uid)
@@ -0,0 +1,113 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/frontend"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// runMaintenanceMode is used instead of the regular startup when the database
+// file exists, but cannot be loaded. Instead of going dark, we serve the UI
+// on a read-only snapshot from the database backup (if any), so that admins
+// can see what is going on and restore the backup from the UI.
+//
+// Neither the store adapter nor the LDAP adapter are run in this mode. The
+// return value is true if the backup was restored, in which case the caller
+// shall proceed with the regular startup. Otherwise, the server was asked to
+// shut down.
+func runMaintenanceMode(ctx context.Context, storePath string, loadErr error, seed *core.DatabaseSeed, vcfg *core.ValidationConfig, hasher crypt.PasswordHasher, handlerOpts frontend.HandlerOptions) bool {
+	logg.Error("cannot load database: %s", loadErr.Error())
+	logg.Error("starting in maintenance mode")
+
+	nexus := core.NewNexus(seed, vcfg, hasher)
+	info := frontend.MaintenanceInfo{
+		LoadError: loadErr,
+		StorePath: storePath,
+	}
+	restored := make(chan struct{})
+
+	backupPath := store.BackupPathFor(storePath)
+	snapshot, err := store.ReadDatabaseFile(backupPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logg.Error("no backup found at %s, so there is no snapshot to show", backupPath)
+	case err != nil:
+		logg.Error("cannot load backup: %s", err.Error())
+	default:
+		errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+			*db = snapshot
+			return nil
+		}, nil)
+		if !errs.IsEmpty() {
+			logg.Error("cannot use backup from %s: %s", backupPath, errs.Join(", "))
+			break
+		}
+		fi, err := os.Stat(backupPath)
+		if err == nil {
+			info.SnapshotTime = fi.ModTime()
+		}
+
+		var mutex sync.Mutex
+		isRestored := false
+		info.Restore = func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if isRestored {
+				return nil
+			}
+			err := store.RestoreBackup(storePath, time.Now())
+			if err != nil {
+				return err
+			}
+			logg.Info("database was restored from %s", backupPath)
+			isRestored = true
+			close(restored)
+			return nil
+		}
+	}
+	nexus.AddPreCommitHook(frontend.RejectChangesInMaintenanceMode)
+
+	handlerOpts.Maintenance = &info
+	handlerOpts.LDAPStatus = func() ldap.AdapterStatus { return ldap.AdapterStatus{} }
+	server := newHTTPServer(frontend.HTTPHandler(nexus, handlerOpts))
+	go func() {
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			logg.Fatal(err.Error())
+		}
+	}()
+
+	isRestored := false
+	select {
+	case <-ctx.Done():
+	case <-restored:
+		isRestored = true
+		logg.Info("leaving maintenance mode")
+	}
+
+	//give the request that restored the backup a chance to complete
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelTimeout()
+	err = server.Shutdown(timeoutCtx)
+	if err != nil {
+		logg.Error("while shutting down HTTP server: %s", err.Error())
+	}
+	return isRestored
+}
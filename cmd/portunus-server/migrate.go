@@ -0,0 +1,44 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/majewsky/portunus/internal/store"
+)
+
+// migrateDatabaseFile implements the -migrate-database mode. The return value
+// is the exit code.
+func migrateDatabaseFile(path string, targetVersion uint) int {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		return 1
+	}
+	newBuf, err := store.MigrateDatabase(buf, targetVersion)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: while migrating %s: %s\n", path, err.Error())
+		return 1
+	}
+
+	//keep the previous contents around in case the migration needs to be undone
+	err = os.WriteFile(path+".bak", buf, 0600)
+	if err == nil {
+		err = os.WriteFile(path+".new", newBuf, 0600)
+	}
+	if err == nil {
+		err = os.Rename(path+".new", path)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		return 1
+	}
+	fmt.Printf("database in %s now has schema version %d (previous contents are in %s.bak)\n", path, targetVersion, path)
+	return 0
+}
@@ -0,0 +1,50 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"os"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// These are the same defaults as in portunus-orchestrator, but only for those
+// variables that portunus-server does not already have a default for.
+var standaloneDefaults = map[string]string{
+	"PORTUNUS_GROUP_NAME_REGEX":           defaultNamePattern,
+	"PORTUNUS_SERVER_HTTP_LISTEN":         "127.0.0.1:8080",
+	"PORTUNUS_SERVER_HTTP_SECURE":         "true",
+	"PORTUNUS_SERVER_REMEMBER_LOGIN_NAME": "true",
+	"PORTUNUS_SERVER_STATE_DIR":           "/var/lib/portunus",
+	"PORTUNUS_USER_NAME_REGEX":            defaultNamePattern,
+}
+
+// isStandalone returns whether portunus-server was started directly instead
+// of by portunus-orchestrator. This is only supported when there is no LDAP
+// server for portunus-orchestrator to set up.
+func isStandalone() bool {
+	return os.Getenv("PORTUNUS_LDAP_DISABLED") == "true" && os.Getenv("PORTUNUS_SERVER_UID") == ""
+}
+
+// prepareStandaloneMode takes the place of dropPrivileges() when
+// isStandalone(). Instead of dropping privileges, we expect to be started as
+// an unprivileged user (e.g. through User= in a systemd unit), and we prepare
+// the environment and state directory like portunus-orchestrator would.
+func prepareStandaloneMode() {
+	if os.Geteuid() == 0 {
+		logg.Fatal("refusing to run as root: either start portunus-server as an unprivileged user, or start portunus-orchestrator instead")
+	}
+	for key, value := range standaloneDefaults {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, value)
+		}
+	}
+	err := os.MkdirAll(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), 0770)
+	if err != nil {
+		logg.Fatal("cannot create state directory: %s", err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/majewsky/portunus/internal/envconfig"
+	"github.com/majewsky/portunus/internal/ha"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/must"
+)
+
+// newLeaderLease returns nil unless active/standby mode is enabled through
+// PORTUNUS_HA_NODE_NAME.
+func newLeaderLease() *ha.Lease {
+	nodeName := os.Getenv("PORTUNUS_HA_NODE_NAME")
+	if nodeName == "" {
+		return nil
+	}
+	lease, err := ha.NewLease(ha.LeaseOptions{
+		Path:     filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "leader.json"),
+		NodeName: nodeName,
+		TTL:      must.Return(envconfig.GetDuration("PORTUNUS_HA_LEASE_TTL", 30*time.Second)),
+	})
+	if err != nil {
+		logg.Fatal("malformed value for PORTUNUS_HA_LEASE_TTL: %s", err.Error())
+	}
+	return lease
+}
+
+// runStandbyMode is used before the regular startup when active/standby mode
+// is enabled. Until we acquire the leadership lease, none of the adapters are
+// run (since the other instance is writing into the shared state directory),
+// and the HTTP server answers every request with 503 so that load balancers
+// can tell the standby instance apart from the active one.
+//
+// The return value is true if the lease was acquired, in which case the caller
+// shall proceed with the regular startup. Otherwise, the server was asked to
+// shut down.
+func runStandbyMode(ctx context.Context, lease *ha.Lease) bool {
+	logg.Info("waiting to acquire leadership lease...")
+	server := newHTTPServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := "This Portunus instance is on standby."
+		holder, err := lease.CurrentHolder()
+		if err == nil && holder != "" {
+			msg += fmt.Sprintf(" The active instance is %q.", holder)
+		}
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	}))
+	go func() {
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			logg.Fatal(err.Error())
+		}
+	}()
+
+	isLeader := lease.Acquire(ctx)
+	if isLeader {
+		logg.Info("acquired leadership lease, leaving standby mode")
+	}
+
+	timeoutCtx, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelTimeout()
+	err := server.Shutdown(timeoutCtx)
+	if err != nil {
+		logg.Error("while shutting down HTTP server: %s", err.Error())
+	}
+	return isLeader
+}
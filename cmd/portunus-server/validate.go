@@ -0,0 +1,111 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/store"
+)
+
+const usage = `Usage: portunus-server
+       portunus-server -validate-seed <seed-file> [-database <database-file>]
+       portunus-server -migrate-database <database-file> [-schema-version <version>]
+       portunus-server -version
+
+portunus-server is usually started by portunus-orchestrator and takes its
+configuration from environment variables. With PORTUNUS_LDAP_DISABLED=true,
+it can also be started directly as an unprivileged user.
+
+With -validate-seed, the given seed file is parsed and validated under the
+validation config from PORTUNUS_USER_NAME_REGEX and PORTUNUS_GROUP_NAME_REGEX
+(or their defaults) instead, and the server is not started. Seed variables are
+taken from PORTUNUS_SEED_VALUES_PATH and PORTUNUS_SEED_VAR_* as usual. If a
+database file is given with -database, the seed is additionally checked
+against its contents, and all changes that applying the seed would make are
+listed. The exit code is non-zero if any problems were found. Note that
+commands in "from_command" will be executed while parsing the seed.
+
+With -migrate-database, the given database file is converted into the given
+schema version (or the schema version used by this portunus-server, if none
+is given), and the server is not started. The previous contents are kept in
+a file with the suffix ".bak". This can be used to downgrade the database file
+before going back to an older version of Portunus. Portunus must not be
+running while its database file is being migrated.
+
+With -version, the version of portunus-server is shown, and the server is not
+started.
+`
+
+// defaultNamePattern is the same default as in portunus-orchestrator.
+const defaultNamePattern = `^[a-z_][a-z0-9_-]*\$?$`
+
+// validateSeed implements the -validate-seed mode. The return value is the
+// exit code.
+func validateSeed(seedPath, databasePath string) int {
+	for _, key := range []string{"PORTUNUS_GROUP_NAME_REGEX", "PORTUNUS_USER_NAME_REGEX"} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, defaultNamePattern)
+		}
+	}
+	vcfg, err := core.ReadValidationConfigFromEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		return 1
+	}
+	vars, err := core.ReadSeedVariablesFromEnvironment()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		return 1
+	}
+
+	seed, errs := core.ReadDatabaseSeed(seedPath, vars, vcfg)
+	if !errs.IsEmpty() {
+		problems := core.BuildSeedReport(seed, errs, vcfg).Problems
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "ERROR: "+problem.String())
+		}
+		fmt.Fprintf(os.Stderr, "seed in %s is invalid (%d problems)\n", seedPath, len(problems))
+		return 1
+	}
+	if databasePath == "" {
+		fmt.Printf("seed in %s is valid (%d users, %d groups)\n", seedPath, len(seed.Users), len(seed.Groups))
+		return 0
+	}
+
+	buf, err := os.ReadFile(databasePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		return 1
+	}
+	db, err := store.UnmarshalDatabase(buf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: while reading %s: %s\n", databasePath, err.Error())
+		return 1
+	}
+	hasher, err := newPasswordHasher()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+		return 1
+	}
+
+	changes, errs := seed.CheckAgainstDatabase(db, vcfg, hasher)
+	for _, change := range changes {
+		fmt.Println("will enforce seed: " + change.Error())
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "ERROR: "+err.Error())
+	}
+	if !errs.IsEmpty() {
+		fmt.Fprintf(os.Stderr, "seed in %s cannot be applied to the database in %s (%d problems)\n", seedPath, databasePath, len(errs))
+		return 1
+	}
+	fmt.Printf("seed in %s is valid and can be applied to the database in %s (%d changes)\n", seedPath, databasePath, len(changes))
+	return 0
+}
@@ -0,0 +1,405 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: portunusctl [-socket <path>] <command> [<args>...]
+
+Commands:
+  user list [<label-selector>...]
+  user show <login-name>
+  user create <file>
+  user update <login-name> <file>
+  user delete <login-name>
+  user reset-password <login-name>
+  user rename <login-name> <new-login-name>
+  user list-deactivated
+  user restore <login-name>
+  user purge <login-name>
+  group list [<label-selector>...]
+  group show <name>
+  group create <file>
+  group update <name> <file>
+  group delete <name>
+  group rename <name> <new-name>
+  group add-member <name> <login-name>
+  group remove-member <name> <login-name>
+  seed reload
+  seed check
+  backup list
+  backup restore <name>
+
+Users and groups are given and shown in the same JSON format as in
+Portunus' database file. Instead of a file name, "-" can be given to read
+from stdin. For "user update", a missing or empty password hash retains the
+previous hash. For "user reset-password", the new password is read from the
+first line of stdin.
+
+Unless PORTUNUS_USER_RETENTION_DAYS is 0, "user delete" only deactivates the
+user. "user list-deactivated" shows the deactivated users with the date on which
+they were deactivated. "user restore" reactivates such a user, and "user purge"
+deletes it permanently.
+
+"user rename" and "group rename" update all references to the object (e.g.
+group memberships), and record the old name in "former_login_names" or
+"former_names", respectively. Seeded objects cannot be renamed.
+
+"group add-member" and "group remove-member" change the membership of a single
+user without sending the whole group. They succeed without changing anything
+if the user already is (or is not) a member of the group.
+
+Lists can be filtered by labels. A selector like "team=infra" matches objects
+with this label and value, and a selector like "team" matches objects that have
+this label with any value. When multiple selectors are given, all of them must
+match.
+
+"seed check" validates the seed file from PORTUNUS_SEED_PATH (as it currently
+exists on disk) against the validation rules of the running portunus-server,
+including the configured PORTUNUS_USER_NAME_REGEX and PORTUNUS_GROUP_NAME_REGEX,
+and prints each problem on a separate line. The exit code is non-zero if there
+are any problems. Unlike "seed reload", this does not change anything.
+
+"backup list" shows the timestamped backups of the database file (if enabled
+with PORTUNUS_STORE_BACKUP_RETENTION), newest first. "backup restore" replaces
+all users, groups and other objects with the contents of the given backup.
+Seeded objects and fields are enforced on the restored contents as usual.
+`
+
+func main() {
+	defaultSocketPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "admin.sock")
+	if os.Getenv("PORTUNUS_SERVER_STATE_DIR") == "" {
+		defaultSocketPath = "/var/lib/portunus/admin.sock"
+	}
+
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	socketPath := flag.String("socket", defaultSocketPath, "path to the admin socket of portunus-server")
+	flag.Parse()
+
+	c := client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", *socketPath)
+				},
+			},
+		},
+	}
+	err := run(c, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "portunusctl: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("invalid usage (run with -h for help)")
+
+func run(c client, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	command := args[0] + " " + args[1]
+	args = args[2:]
+
+	switch {
+	case command == "user list":
+		return c.list("/v1/users"+labelQuery(args), "login_name")
+	case command == "group list":
+		return c.list("/v1/groups"+labelQuery(args), "name")
+
+	case command == "user show" && len(args) == 1:
+		return c.printResponse(c.do("GET", "/v1/users/"+url.PathEscape(args[0]), nil))
+	case command == "group show" && len(args) == 1:
+		return c.printResponse(c.do("GET", "/v1/groups/"+url.PathEscape(args[0]), nil))
+
+	case command == "user create" && len(args) == 1:
+		return c.sendFile("POST", "/v1/users", args[0])
+	case command == "group create" && len(args) == 1:
+		return c.sendFile("POST", "/v1/groups", args[0])
+
+	case command == "user update" && len(args) == 2:
+		return c.sendFile("PUT", "/v1/users/"+url.PathEscape(args[0]), args[1])
+	case command == "group update" && len(args) == 2:
+		return c.sendFile("PUT", "/v1/groups/"+url.PathEscape(args[0]), args[1])
+
+	case command == "user delete" && len(args) == 1:
+		return c.printResponse(c.do("DELETE", "/v1/users/"+url.PathEscape(args[0]), nil))
+	case command == "group delete" && len(args) == 1:
+		return c.printResponse(c.do("DELETE", "/v1/groups/"+url.PathEscape(args[0]), nil))
+
+	case command == "user rename" && len(args) == 2:
+		return c.rename("/v1/users/"+url.PathEscape(args[0])+"/rename", args[1])
+	case command == "group rename" && len(args) == 2:
+		return c.rename("/v1/groups/"+url.PathEscape(args[0])+"/rename", args[1])
+
+	case command == "group add-member" && len(args) == 2:
+		return c.printResponse(c.do("POST", groupMemberPath(args[0], args[1]), nil))
+	case command == "group remove-member" && len(args) == 2:
+		return c.printResponse(c.do("DELETE", groupMemberPath(args[0], args[1]), nil))
+
+	case command == "user reset-password" && len(args) == 1:
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		body, err := json.Marshal(passwordRequest{Password: strings.TrimSuffix(password, "\n")})
+		if err != nil {
+			return err
+		}
+		return c.printResponse(c.do("POST", "/v1/users/"+url.PathEscape(args[0])+"/password", body))
+
+	case command == "user list-deactivated" && len(args) == 0:
+		return c.listDeactivatedUsers()
+	case command == "user restore" && len(args) == 1:
+		return c.printResponse(c.do("POST", "/v1/deactivated-users/"+url.PathEscape(args[0])+"/restore", nil))
+	case command == "user purge" && len(args) == 1:
+		return c.printResponse(c.do("DELETE", "/v1/deactivated-users/"+url.PathEscape(args[0]), nil))
+
+	case command == "seed reload" && len(args) == 0:
+		return c.printResponse(c.do("POST", "/v1/seed/reload", nil))
+	case command == "seed check" && len(args) == 0:
+		return c.checkSeed()
+
+	case command == "backup list" && len(args) == 0:
+		return c.listBackups()
+	case command == "backup restore" && len(args) == 1:
+		return c.printResponse(c.do("POST", "/v1/backups/"+url.PathEscape(args[0])+"/restore", nil))
+
+	default:
+		return errUsage
+	}
+}
+
+func groupMemberPath(groupName, loginName string) string {
+	return "/v1/groups/" + url.PathEscape(groupName) + "/members/" + url.PathEscape(loginName)
+}
+
+// labelQuery renders label selectors into a query string for the list endpoints.
+func labelQuery(selectors []string) string {
+	if len(selectors) == 0 {
+		return ""
+	}
+	return "?" + url.Values{"label": selectors}.Encode()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type client
+
+// NOTE: These types mirror those in internal/api. We do not import that package
+// since it would pull in internal/core and thus link libcrypt into this binary.
+type errorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type renameRequest struct {
+	NewName string `json:"new_name"`
+}
+
+type seedReport struct {
+	Problems []struct {
+		ObjectType string `json:"object_type"`
+		ObjectName string `json:"object_name"`
+		Field      string `json:"field"`
+		Message    string `json:"message"`
+	} `json:"problems"`
+}
+
+type backupInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+type deactivatedUserInfo struct {
+	User struct {
+		LoginName string `json:"login_name"`
+	} `json:"user"`
+	DeactivatedAt string `json:"deactivated_at"`
+}
+
+type client struct {
+	http *http.Client
+}
+
+// do sends a request to the admin API. If the response indicates an error,
+// the error messages from the response body are returned as an error.
+func (c client) do(method, path string, body []byte) ([]byte, error) {
+	//the host name is irrelevant since we always connect to the socket
+	req, err := http.NewRequest(method, "http://portunus"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("admin socket not found (is portunus-server running, with the admin-api feature enabled?): %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		var data errorResponse
+		err := json.Unmarshal(respBody, &data)
+		if err != nil || len(data.Errors) == 0 {
+			return nil, fmt.Errorf("%s %s returned %s", method, path, resp.Status)
+		}
+		return nil, errors.New(strings.Join(data.Errors, "\n"))
+	}
+	return respBody, nil
+}
+
+// printResponse prints the response body from do(), if any.
+func (c client) printResponse(body []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	err = json.Indent(&buf, body, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
+
+// list prints the given key of each object in the response, one per line.
+func (c client) list(path, key string) error {
+	body, err := c.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	var objects []map[string]any
+	err = json.Unmarshal(body, &objects)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		fmt.Println(obj[key])
+	}
+	return nil
+}
+
+// checkSeed prints the problems from the seed report, one per line.
+func (c client) checkSeed() error {
+	body, err := c.do("GET", "/v1/seed/report", nil)
+	if err != nil {
+		return err
+	}
+	var report seedReport
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		//this matches SeedProblem.String() in internal/core
+		switch {
+		case p.Field != "":
+			fmt.Printf("field %q in %s %q %s\n", p.Field, p.ObjectType, p.ObjectName, p.Message)
+		case p.ObjectType != "":
+			fmt.Printf("%s %q: %s\n", p.ObjectType, p.ObjectName, p.Message)
+		default:
+			fmt.Println(p.Message)
+		}
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("found %d problems in the seed", len(report.Problems))
+	}
+	return nil
+}
+
+// listDeactivatedUsers prints one line per deactivated user.
+func (c client) listDeactivatedUsers() error {
+	body, err := c.do("GET", "/v1/deactivated-users", nil)
+	if err != nil {
+		return err
+	}
+	var users []deactivatedUserInfo
+	err = json.Unmarshal(body, &users)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		fmt.Printf("%s\tdeactivated on %s\n", u.User.LoginName, u.DeactivatedAt)
+	}
+	return nil
+}
+
+// listBackups prints one line per backup, newest first.
+func (c client) listBackups() error {
+	body, err := c.do("GET", "/v1/backups", nil)
+	if err != nil {
+		return err
+	}
+	var backups []backupInfo
+	err = json.Unmarshal(body, &backups)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups {
+		fmt.Printf("%s\t%s\t%d bytes\n", b.Name, b.CreatedAt.Local().Format(time.DateTime), b.Size)
+	}
+	return nil
+}
+
+// sendFile sends the contents of the given file (or stdin, for "-") as the
+// request body.
+func (c client) sendFile(method, path, fileName string) error {
+	var (
+		body []byte
+		err  error
+	)
+	if fileName == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(fileName)
+	}
+	if err != nil {
+		return err
+	}
+	return c.printResponse(c.do(method, path, body))
+}
+
+func (c client) rename(path, newName string) error {
+	body, err := json.Marshal(renameRequest{NewName: newName})
+	if err != nil {
+		return err
+	}
+	return c.printResponse(c.do("POST", path, body))
+}
@@ -1,23 +1,26 @@
 module github.com/majewsky/portunus
 
-go 1.22
+go 1.24
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0
+	github.com/go-asn1-ber/asn1-ber v1.5.5
 	github.com/go-ldap/ldap/v3 v3.4.7
 	github.com/gorilla/csrf v1.7.2
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/securecookie v1.1.2
 	github.com/gorilla/sessions v1.2.2
+	github.com/lib/pq v1.10.9
 	github.com/majewsky/xyrillian.css v0.0.0-20220726195116-0374c0b40e25
+	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/sapcc/go-bits v0.0.0-20240412131404-c19f29da6dd1
 	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
-	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/securecookie v1.1.2 // indirect
 	github.com/sergi/go-diff v1.3.1 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 )
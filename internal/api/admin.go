@@ -0,0 +1,748 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package api implements the admin API that portunus-server offers on a Unix
+// socket in its state directory. This API is used by portunusctl.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// SeedLoader is a function that reads the database seed from its source.
+// It appears in NewAdminServer.
+type SeedLoader func() (*core.DatabaseSeed, errext.ErrorSet)
+
+// ListenUnix opens the Unix socket for the admin API at the given path. Any
+// leftover socket from a previous run is removed first. The socket is only
+// accessible to the user running portunus-server (and to root).
+func ListenUnix(path string) (net.Listener, error) {
+	//net.Listen() creates the socket with permissions according to the umask,
+	//so there would be a brief window where other users in the group of the
+	//state directory could connect; to avoid this, the socket is created in a
+	//private directory and only moved into place once it has been restricted
+	tmpDir, err := os.MkdirTemp(filepath.Dir(path), ".admin-sock-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, filepath.Base(path))
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	//the listener would try to remove the socket at `tmpPath` when closed,
+	//but after the rename, the socket is at `path` (and will be removed on
+	//the next start, like after a crash)
+	listener.SetUnlinkOnClose(false)
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// NewAdminServer builds the HTTP server for the admin API. It is expected to
+// be served on a listener obtained from ListenUnix. If timestamped backups of
+// the database file are taken (see store.BackupOptions), backupDir is where
+// they are. Otherwise, it is empty and the backup endpoints are unavailable.
+func NewAdminServer(nexus core.Nexus, loadSeed SeedLoader, backupDir string) *http.Server {
+	a := adminAPI{nexus, loadSeed, backupDir}
+	r := mux.NewRouter()
+	r.Methods("GET").Path(`/v1/users`).HandlerFunc(a.listUsers)
+	r.Methods("POST").Path(`/v1/users`).HandlerFunc(a.createUser)
+	r.Methods("GET").Path(`/v1/users/{name}`).HandlerFunc(a.showUser)
+	r.Methods("PUT").Path(`/v1/users/{name}`).HandlerFunc(a.updateUser)
+	r.Methods("DELETE").Path(`/v1/users/{name}`).HandlerFunc(a.deleteUser)
+	r.Methods("POST").Path(`/v1/users/{name}/password`).HandlerFunc(a.resetPassword)
+	r.Methods("POST").Path(`/v1/users/{name}/rename`).HandlerFunc(a.renameUser)
+	r.Methods("GET").Path(`/v1/deactivated-users`).HandlerFunc(a.listDeactivatedUsers)
+	r.Methods("POST").Path(`/v1/deactivated-users/{name}/restore`).HandlerFunc(a.restoreDeactivatedUser)
+	r.Methods("DELETE").Path(`/v1/deactivated-users/{name}`).HandlerFunc(a.purgeDeactivatedUser)
+	r.Methods("GET").Path(`/v1/groups`).HandlerFunc(a.listGroups)
+	r.Methods("POST").Path(`/v1/groups`).HandlerFunc(a.createGroup)
+	r.Methods("GET").Path(`/v1/groups/{name}`).HandlerFunc(a.showGroup)
+	r.Methods("PUT").Path(`/v1/groups/{name}`).HandlerFunc(a.updateGroup)
+	r.Methods("DELETE").Path(`/v1/groups/{name}`).HandlerFunc(a.deleteGroup)
+	r.Methods("POST").Path(`/v1/groups/{name}/rename`).HandlerFunc(a.renameGroup)
+	r.Methods("POST").Path(`/v1/groups/{name}/members/{login}`).HandlerFunc(a.addGroupMember)
+	r.Methods("DELETE").Path(`/v1/groups/{name}/members/{login}`).HandlerFunc(a.removeGroupMember)
+	r.Methods("POST").Path(`/v1/seed/reload`).HandlerFunc(a.reloadSeed)
+	r.Methods("GET").Path(`/v1/seed/report`).HandlerFunc(a.reportSeed)
+	r.Methods("GET").Path(`/v1/backups`).HandlerFunc(a.listBackups)
+	r.Methods("POST").Path(`/v1/backups/{name}/restore`).HandlerFunc(a.restoreBackup)
+
+	return &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext:       withPeerActor,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// identification of clients
+
+type actorContextKey struct{}
+
+// withPeerActor identifies the client process on the other end of the Unix
+// socket, so that changes can be attributed to it.
+func withPeerActor(ctx context.Context, c net.Conn) context.Context {
+	actor := core.Actor{Type: core.ActorTypeAdminSocket}
+	if uc, ok := c.(*net.UnixConn); ok {
+		uid, err := getPeerUID(uc)
+		if err == nil {
+			actor.Name = fmt.Sprintf("uid=%d", uid)
+		} else {
+			logg.Error("cannot identify client of admin socket: %s", err.Error())
+		}
+	}
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+func getPeerUID(c *net.UnixConn) (uint32, error) {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
+
+func actorFromRequest(r *http.Request) core.Actor {
+	actor, ok := r.Context().Value(actorContextKey{}).(core.Actor)
+	if !ok {
+		return core.Actor{Type: core.ActorTypeAdminSocket}
+	}
+	return actor
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// helper functions
+
+type adminAPI struct {
+	nexus     core.Nexus
+	loadSeed  SeedLoader
+	backupDir string
+}
+
+// PasswordRequest is the request body for resetting a user's password.
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// RenameRequest is the request body for renaming a user or group.
+type RenameRequest struct {
+	NewName string `json:"new_name"`
+}
+
+// UserResponse is how users appear in response bodies. Request bodies are
+// decoded into the same type so that a response can be edited and sent back,
+// but ManagedBySeed is ignored there.
+type UserResponse struct {
+	core.User
+	//These shadow the respective fields of core.User. Password hashes and TOTP
+	//keys are never included in responses, like in the CSV export. In request
+	//bodies, a password hash may be given to import it.
+	PasswordHash string `json:"password,omitempty"`
+	TOTPKeyURL   string `json:"totp_key_url,omitempty"`
+	//Whether the user appears in the seed. Changes to seeded fields are rejected.
+	ManagedBySeed bool `json:"managed_by_seed"`
+}
+
+// Returns the user described by a request body.
+func (r UserResponse) toUser() core.User {
+	user := r.User
+	user.PasswordHash = r.PasswordHash
+	//second factors can only be enrolled by the users themselves
+	user.TOTPKeyURL = ""
+	return user
+}
+
+// DeactivatedUserResponse is how deactivated users appear in response bodies.
+type DeactivatedUserResponse struct {
+	core.DeactivatedUser
+	//shadows the respective field of core.DeactivatedUser to redact secrets
+	User UserResponse `json:"user"`
+}
+
+// GroupResponse is like UserResponse, but for groups.
+type GroupResponse struct {
+	core.Group
+	ManagedBySeed bool `json:"managed_by_seed"`
+}
+
+func (a adminAPI) renderUser(user core.User) UserResponse {
+	user.PasswordHash = ""
+	user.TOTPKeyURL = ""
+	return UserResponse{User: user, ManagedBySeed: !a.nexus.SeededFieldsOf(user.Ref()).IsEmpty()}
+}
+
+func (a adminAPI) renderGroup(group core.Group) GroupResponse {
+	return GroupResponse{group, !a.nexus.SeededFieldsOf(group.Ref()).IsEmpty()}
+}
+
+func respondWithJSON(w http.ResponseWriter, status int, data any) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf)
+}
+
+func decodeRequestBody(w http.ResponseWriter, r *http.Request, target any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(target)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "malformed request body: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+// update runs the given action in the nexus and reports any errors to the
+// client. On success, true is returned, and the caller shall write a response.
+func (a adminAPI) update(w http.ResponseWriter, r *http.Request, action core.UpdateAction) bool {
+	errs := a.nexus.Update(action, &core.UpdateOptions{
+		ConflictWithSeedIsError: true,
+		Actor:                   actorFromRequest(r),
+	})
+	if errs.IsEmpty() {
+		return true
+	}
+	for _, err := range errs {
+		var nfe notFoundError
+		if errors.As(err, &nfe) {
+			RespondWithErrors(w, http.StatusNotFound, errs)
+			return false
+		}
+	}
+	RespondWithErrors(w, http.StatusUnprocessableEntity, errs)
+	return false
+}
+
+// notFoundError is returned by update actions when the object in question
+// does not exist. This is reported with status 404 instead of 422.
+type notFoundError string
+
+// Error implements the builtin/error interface.
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// users
+
+// Lists can be filtered with one or more "?label=key=value" or "?label=key"
+// query parameters (see core.Labels.Matches).
+func (a adminAPI) listUsers(w http.ResponseWriter, r *http.Request) {
+	selectors := r.URL.Query()["label"]
+	users := []UserResponse{}
+	for _, user := range a.nexus.ListUsers() {
+		if user.Labels.MatchesAll(selectors) {
+			users = append(users, a.renderUser(user))
+		}
+	}
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+func (a adminAPI) findUser(loginName string) (core.User, bool) {
+	user, exists := a.nexus.FindUser(func(u core.User) bool { return u.LoginName == loginName })
+	return user.User, exists
+}
+
+func (a adminAPI) showUser(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	user, exists := a.findUser(loginName)
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "user %q does not exist", loginName)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, a.renderUser(user))
+}
+
+func (a adminAPI) createUser(w http.ResponseWriter, r *http.Request) {
+	var req UserResponse
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	user := req.toUser()
+	//former names are only recorded by the rename endpoint
+	user.FormerLoginNames = nil
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		err := importPasswordHash(&user)
+		if err != nil {
+			errs.Add(err)
+			return
+		}
+		//uniqueness of the login name is checked by the database validation
+		db.Users = append(db.Users, user)
+		db.AddDefaultMemberships(user)
+		return
+	})
+	if ok {
+		user, _ = a.findUser(user.LoginName)
+		respondWithJSON(w, http.StatusCreated, a.renderUser(user))
+	}
+}
+
+func (a adminAPI) updateUser(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	var req UserResponse
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	user := req.toUser()
+	if user.LoginName == "" {
+		user.LoginName = loginName
+	}
+	if user.LoginName != loginName {
+		respondWithError(w, http.StatusBadRequest, "login name %q in request body does not match URL", user.LoginName)
+		return
+	}
+
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		oldUser, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == loginName })
+		if !exists {
+			errs.Add(notFoundError(fmt.Sprintf("user %q does not exist", loginName)))
+			return
+		}
+		//passwords are changed through a separate endpoint, so that scripts do
+		//not need to round-trip the password hash
+		if user.PasswordHash == "" {
+			user.PasswordHash = oldUser.PasswordHash
+		} else if user.PasswordHash != oldUser.PasswordHash {
+			err := importPasswordHash(&user)
+			if err != nil {
+				errs.Add(err)
+				return
+			}
+		}
+		//second factors can only be enrolled by the users themselves
+		user.TOTPKeyURL = oldUser.TOTPKeyURL
+		//photos are usually uploaded by the users themselves, so scripts that do
+		//not know about them shall not remove them by accident (an explicit empty
+		//string still removes the photo)
+		if user.JPEGPhoto == nil {
+			user.JPEGPhoto = oldUser.JPEGPhoto
+		}
+		//likewise, such scripts shall not publish attributes that were hidden from
+		//LDAP on purpose (an explicit empty list still publishes them)
+		if user.HiddenLDAPAttributes == nil {
+			user.HiddenLDAPAttributes = oldUser.HiddenLDAPAttributes
+		}
+		//former names are only recorded by the rename endpoint
+		user.FormerLoginNames = oldUser.FormerLoginNames
+		errs.Add(db.Users.Update(user))
+		return
+	})
+	if ok {
+		user, _ = a.findUser(loginName)
+		respondWithJSON(w, http.StatusOK, a.renderUser(user))
+	}
+}
+
+// Password hashes given to the API may come from other systems, so they are
+// checked and brought into the form that Portunus stores (see
+// crypt.ImportPasswordHash). Hashes in foreign schemes are replaced by a
+// hash in Portunus' preferred scheme when the user next logs in.
+func importPasswordHash(user *core.User) error {
+	if user.PasswordHash == "" {
+		return nil
+	}
+	passwordHash, err := crypt.ImportPasswordHash(user.PasswordHash)
+	if err != nil {
+		return user.Ref().Field("password").Wrap(fmt.Errorf("must contain a supported password hash: %w", err))
+	}
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+func (a adminAPI) deleteUser(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		err := db.DeactivateUser(loginName, actorFromRequest(r), time.Now(), a.nexus.ValidationConfig())
+		if err != nil {
+			errs.Add(notFoundError(fmt.Sprintf("user %q does not exist", loginName)))
+		}
+		return
+	})
+	if ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a adminAPI) listDeactivatedUsers(w http.ResponseWriter, r *http.Request) {
+	users := []DeactivatedUserResponse{}
+	for _, u := range a.nexus.ListDeactivatedUsers() {
+		users = append(users, DeactivatedUserResponse{u, a.renderUser(u.User)})
+	}
+	respondWithJSON(w, http.StatusOK, users)
+}
+
+func (a adminAPI) restoreDeactivatedUser(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		err := db.RestoreUser(loginName)
+		if err != nil {
+			errs.Add(notFoundError(err.Error()))
+		}
+		return
+	})
+	if ok {
+		user, _ := a.findUser(loginName)
+		respondWithJSON(w, http.StatusOK, a.renderUser(user))
+	}
+}
+
+func (a adminAPI) purgeDeactivatedUser(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		err := db.PurgeUser(loginName)
+		if err != nil {
+			errs.Add(notFoundError(err.Error()))
+		}
+		return
+	})
+	if ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Renaming updates all references to the user, see core.Database.RenameUser.
+func (a adminAPI) renameUser(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	var req RenameRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		if _, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == loginName }); !exists {
+			errs.Add(notFoundError(fmt.Sprintf("user %q does not exist", loginName)))
+			return
+		}
+		errs.Add(db.RenameUser(loginName, req.NewName, time.Now()))
+		return
+	})
+	if ok {
+		user, _ := a.findUser(req.NewName)
+		respondWithJSON(w, http.StatusOK, a.renderUser(user))
+	}
+}
+
+func (a adminAPI) resetPassword(w http.ResponseWriter, r *http.Request) {
+	loginName := mux.Vars(r)["name"]
+	var req PasswordRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	if req.Password == "" {
+		respondWithError(w, http.StatusUnprocessableEntity, "password must not be empty")
+		return
+	}
+
+	hasher := a.nexus.PasswordHasher()
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		user, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == loginName })
+		if !exists {
+			errs.Add(notFoundError(fmt.Sprintf("user %q does not exist", loginName)))
+			return
+		}
+		user.PasswordHash = hasher.HashPassword(req.Password)
+		errs.Add(db.Users.Update(user))
+		return
+	})
+	if ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// groups
+
+func (a adminAPI) listGroups(w http.ResponseWriter, r *http.Request) {
+	selectors := r.URL.Query()["label"]
+	groups := []GroupResponse{}
+	for _, group := range a.nexus.ListGroups() {
+		if group.Labels.MatchesAll(selectors) {
+			groups = append(groups, a.renderGroup(group))
+		}
+	}
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+func (a adminAPI) findGroup(name string) (core.Group, bool) {
+	return a.nexus.FindGroup(func(g core.Group) bool { return g.Name == name })
+}
+
+func (a adminAPI) showGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	group, exists := a.findGroup(name)
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "group %q does not exist", name)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, a.renderGroup(group))
+}
+
+func (a adminAPI) createGroup(w http.ResponseWriter, r *http.Request) {
+	var req GroupResponse
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	group := req.Group
+	//former names are only recorded by the rename endpoint
+	group.FormerNames = nil
+	ok := a.update(w, r, func(db *core.Database) errext.ErrorSet {
+		db.Groups = append(db.Groups, group)
+		return nil
+	})
+	if ok {
+		group, _ = a.findGroup(group.Name)
+		respondWithJSON(w, http.StatusCreated, a.renderGroup(group))
+	}
+}
+
+func (a adminAPI) updateGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var req GroupResponse
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	group := req.Group
+	if group.Name == "" {
+		group.Name = name
+	}
+	if group.Name != name {
+		respondWithError(w, http.StatusBadRequest, "group name %q in request body does not match URL", group.Name)
+		return
+	}
+
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		oldGroup, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == name })
+		if !exists {
+			errs.Add(notFoundError(fmt.Sprintf("group %q does not exist", name)))
+			return
+		}
+		//former names are only recorded by the rename endpoint
+		group.FormerNames = oldGroup.FormerNames
+		errs.Add(db.Groups.Update(group))
+		return
+	})
+	if ok {
+		group, _ = a.findGroup(name)
+		respondWithJSON(w, http.StatusOK, a.renderGroup(group))
+	}
+}
+
+func (a adminAPI) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		err := db.DeleteGroup(name)
+		if err != nil {
+			errs.Add(notFoundError(fmt.Sprintf("group %q does not exist", name)))
+		}
+		return
+	})
+	if ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Like renameUser, but for groups.
+func (a adminAPI) renameGroup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var req RenameRequest
+	if !decodeRequestBody(w, r, &req) {
+		return
+	}
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		if _, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == name }); !exists {
+			errs.Add(notFoundError(fmt.Sprintf("group %q does not exist", name)))
+			return
+		}
+		errs.Add(db.RenameGroup(name, req.NewName, time.Now()))
+		return
+	})
+	if ok {
+		group, _ := a.findGroup(req.NewName)
+		respondWithJSON(w, http.StatusOK, a.renderGroup(group))
+	}
+}
+
+// Adding or removing a single member does not require the client to send the
+// whole group, so concurrent changes to the same group cannot overwrite each
+// other: The action always runs on the current state of the database while
+// the nexus is locked. Both endpoints are idempotent, i.e. adding an existing
+// member or removing a non-member succeeds without changing anything.
+func (a adminAPI) addGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.setGroupMember(w, r, true)
+}
+
+func (a adminAPI) removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	a.setGroupMember(w, r, false)
+}
+
+func (a adminAPI) setGroupMember(w http.ResponseWriter, r *http.Request, isMember bool) {
+	name := mux.Vars(r)["name"]
+	loginName := mux.Vars(r)["login"]
+	ok := a.update(w, r, func(db *core.Database) (errs errext.ErrorSet) {
+		group, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == name })
+		if !exists {
+			errs.Add(notFoundError(fmt.Sprintf("group %q does not exist", name)))
+			return
+		}
+		//removing a user that does not exist (anymore) is fine, since it is
+		//not a member either way
+		_, exists = db.Users.Find(func(u core.User) bool { return u.LoginName == loginName })
+		if !exists && isMember {
+			errs.Add(notFoundError(fmt.Sprintf("user %q does not exist", loginName)))
+			return
+		}
+		if group.MemberLoginNames[loginName] == isMember {
+			return
+		}
+
+		group = group.Cloned()
+		if group.MemberLoginNames == nil {
+			group.MemberLoginNames = make(core.GroupMemberNames)
+		}
+		if isMember {
+			group.MemberLoginNames[loginName] = true
+		} else {
+			delete(group.MemberLoginNames, loginName)
+		}
+		errs.Add(db.Groups.Update(group))
+		return
+	})
+	if ok {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// seed
+
+func (a adminAPI) reloadSeed(w http.ResponseWriter, r *http.Request) {
+	seed, errs := a.loadSeed()
+	if !errs.IsEmpty() {
+		RespondWithErrors(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	if seed == nil {
+		respondWithError(w, http.StatusConflict, "no seed is configured")
+		return
+	}
+	errs = a.nexus.ReplaceSeed(seed, &core.UpdateOptions{Actor: actorFromRequest(r)})
+	if !errs.IsEmpty() {
+		RespondWithErrors(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reads the seed file like reloadSeed, but instead of applying it, reports all
+// problems that it has under the current validation config. A seed with
+// problems is still reported with status 200.
+func (a adminAPI) reportSeed(w http.ResponseWriter, r *http.Request) {
+	seed, errs := a.loadSeed()
+	if seed == nil && errs.IsEmpty() {
+		respondWithError(w, http.StatusConflict, "no seed is configured")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, core.BuildSeedReport(seed, errs, a.nexus.ValidationConfig()))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// backups
+
+func (a adminAPI) listBackups(w http.ResponseWriter, r *http.Request) {
+	if a.backupDir == "" {
+		respondWithError(w, http.StatusConflict, "backups are not enabled")
+		return
+	}
+	backups, err := store.ListBackups(a.backupDir)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "cannot list backups: %s", err.Error())
+		return
+	}
+	if backups == nil {
+		backups = []store.BackupInfo{}
+	}
+	respondWithJSON(w, http.StatusOK, backups)
+}
+
+// Restoring a backup goes through the nexus like every other change, so the
+// seed is enforced on the restored contents. Conflicts with the seed are not
+// errors here since the seed may well have changed after the backup was taken.
+func (a adminAPI) restoreBackup(w http.ResponseWriter, r *http.Request) {
+	if a.backupDir == "" {
+		respondWithError(w, http.StatusConflict, "backups are not enabled")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	backup, err := store.ReadBackup(a.backupDir, name)
+	if errors.Is(err, os.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "backup %q does not exist", name)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnprocessableEntity, "cannot read backup: %s", err.Error())
+		return
+	}
+
+	errs := a.nexus.Update(func(db *core.Database) errext.ErrorSet {
+		store.RestoreTimestampedBackup(db, backup)
+		return nil
+	}, &core.UpdateOptions{Actor: actorFromRequest(r)})
+	if !errs.IsEmpty() {
+		RespondWithErrors(w, http.StatusUnprocessableEntity, errs)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,433 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/store"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func setupAdminAPI(t *testing.T, seed *core.DatabaseSeed) (core.Nexus, http.Handler) {
+	t.Helper()
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "jane",
+			GivenName:    "Jane",
+			FamilyName:   "Doe",
+			PasswordHash: "{PLAINTEXT}secret",
+		}}
+		db.Groups = []core.Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	loadSeed := func() (*core.DatabaseSeed, errext.ErrorSet) { return seed, nil }
+	return nexus, NewAdminServer(nexus, loadSeed, "").Handler
+}
+
+func request(t *testing.T, h http.Handler, method, path, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	respBody, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return rec.Code, strings.TrimSpace(string(respBody))
+}
+
+func TestUserLifecycle(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+
+	//create a user
+	status, _ := request(t, h, "POST", "/v1/users", `{"login_name":"john","given_name":"John","family_name":"Doe","password":""}`)
+	assert.DeepEqual(t, "status for POST", status, http.StatusCreated)
+	status, body := request(t, h, "POST", "/v1/users", `{"login_name":"john","given_name":"John","family_name":"Doe","password":""}`)
+	assert.DeepEqual(t, "status for duplicate POST", status, http.StatusUnprocessableEntity)
+	assert.DeepEqual(t, "body for duplicate POST", body, `{"code":"validation_error","errors":["field \"login_name\" in user \"john\" is already in use"],"fields":{"users/john/login_name":["is already in use"]}}`)
+
+	//update it (without touching the password)
+	request(t, h, "POST", "/v1/users/john/password", `{"password":"hunter2"}`)
+	status, _ = request(t, h, "PUT", "/v1/users/john", `{"given_name":"Jonathan","family_name":"Doe"}`)
+	assert.DeepEqual(t, "status for PUT", status, http.StatusOK)
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "updated user", user.User, core.User{
+		LoginName:    "john",
+		GivenName:    "Jonathan",
+		FamilyName:   "Doe",
+		PasswordHash: "{PLAINTEXT}hunter2",
+	})
+
+	status, body = request(t, h, "PUT", "/v1/users/unknown", `{"given_name":"Unknown","family_name":"User"}`)
+	assert.DeepEqual(t, "status for PUT of unknown user", status, http.StatusNotFound)
+	assert.DeepEqual(t, "body for PUT of unknown user", body, `{"code":"not_found","errors":["user \"unknown\" does not exist"]}`)
+	status, _ = request(t, h, "PUT", "/v1/users/john", `{"login_name":"jane","given_name":"Jane","family_name":"Doe"}`)
+	assert.DeepEqual(t, "status for PUT with mismatching name", status, http.StatusBadRequest)
+	status, _ = request(t, h, "PUT", "/v1/users/john", `{"given_name":"","family_name":"Doe"}`)
+	assert.DeepEqual(t, "status for invalid PUT", status, http.StatusUnprocessableEntity)
+
+	//deleting a user also removes their group memberships
+	status, _ = request(t, h, "DELETE", "/v1/users/jane", "")
+	assert.DeepEqual(t, "status for DELETE", status, http.StatusNoContent)
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "members after DELETE", group.MemberLoginNames, core.GroupMemberNames{})
+
+	status, body = request(t, h, "GET", "/v1/users", "")
+	assert.DeepEqual(t, "status for GET", status, http.StatusOK)
+	var users []core.User
+	err := json.Unmarshal([]byte(body), &users)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "user count", len(users), 1)
+}
+
+func TestGroupLifecycle(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+
+	status, _ := request(t, h, "POST", "/v1/groups", `{"name":"admins","long_name":"Admins","members":["jane"],"permissions":{"portunus":{"is_admin":true}}}`)
+	assert.DeepEqual(t, "status for POST", status, http.StatusCreated)
+	status, _ = request(t, h, "PUT", "/v1/groups/admins", `{"long_name":"Administrators","members":[]}`)
+	assert.DeepEqual(t, "status for PUT", status, http.StatusOK)
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "admins" })
+	assert.DeepEqual(t, "updated group", group, core.Group{
+		Name:             "admins",
+		LongName:         "Administrators",
+		MemberLoginNames: core.GroupMemberNames{},
+	})
+
+	status, _ = request(t, h, "DELETE", "/v1/groups/admins", "")
+	assert.DeepEqual(t, "status for DELETE", status, http.StatusNoContent)
+	status, _ = request(t, h, "GET", "/v1/groups/admins", "")
+	assert.DeepEqual(t, "status for GET after DELETE", status, http.StatusNotFound)
+}
+
+func TestGroupMembership(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+	request(t, h, "POST", "/v1/users", `{"login_name":"john","given_name":"John","family_name":"Doe","password":""}`)
+	getMembers := func() core.GroupMemberNames {
+		group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+		return group.MemberLoginNames
+	}
+
+	//adding is idempotent
+	for range 2 {
+		status, _ := request(t, h, "POST", "/v1/groups/staff/members/john", "")
+		assert.DeepEqual(t, "status for POST", status, http.StatusNoContent)
+		assert.DeepEqual(t, "members after POST", getMembers(), core.GroupMemberNames{"jane": true, "john": true})
+	}
+
+	//removing is idempotent
+	for range 2 {
+		status, _ := request(t, h, "DELETE", "/v1/groups/staff/members/jane", "")
+		assert.DeepEqual(t, "status for DELETE", status, http.StatusNoContent)
+		assert.DeepEqual(t, "members after DELETE", getMembers(), core.GroupMemberNames{"john": true})
+	}
+	status, _ := request(t, h, "DELETE", "/v1/groups/staff/members/unknown", "")
+	assert.DeepEqual(t, "status for DELETE of unknown user", status, http.StatusNoContent)
+
+	status, body := request(t, h, "POST", "/v1/groups/staff/members/unknown", "")
+	assert.DeepEqual(t, "status for POST of unknown user", status, http.StatusNotFound)
+	assert.DeepEqual(t, "body for POST of unknown user", body, `{"code":"not_found","errors":["user \"unknown\" does not exist"]}`)
+	status, _ = request(t, h, "POST", "/v1/groups/unknown/members/john", "")
+	assert.DeepEqual(t, "status for POST into unknown group", status, http.StatusNotFound)
+}
+
+func TestRename(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+
+	status, body := request(t, h, "POST", "/v1/users/jane/rename", `{"new_name":"jsmith"}`)
+	assert.DeepEqual(t, "status for user rename", status, http.StatusOK)
+	var user UserResponse
+	err := json.Unmarshal([]byte(body), &user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "login name after rename", user.LoginName, "jsmith")
+	assert.DeepEqual(t, "former login names after rename", len(user.FormerLoginNames), 1)
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "members after user rename", group.MemberLoginNames, core.GroupMemberNames{"jsmith": true})
+
+	//former names cannot be removed or forged through PUT
+	status, _ = request(t, h, "PUT", "/v1/users/jsmith", `{"given_name":"Jane","family_name":"Smith","former_login_names":[]}`)
+	assert.DeepEqual(t, "status for PUT after rename", status, http.StatusOK)
+	updated, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jsmith" })
+	assert.DeepEqual(t, "former login names after PUT", updated.FormerLoginNames, user.FormerLoginNames)
+
+	status, _ = request(t, h, "POST", "/v1/groups/staff/rename", `{"new_name":"employees"}`)
+	assert.DeepEqual(t, "status for group rename", status, http.StatusOK)
+	status, _ = request(t, h, "GET", "/v1/groups/employees", "")
+	assert.DeepEqual(t, "status for GET of renamed group", status, http.StatusOK)
+
+	status, body = request(t, h, "POST", "/v1/users/unknown/rename", `{"new_name":"other"}`)
+	assert.DeepEqual(t, "status for rename of unknown user", status, http.StatusNotFound)
+	assert.DeepEqual(t, "body for rename of unknown user", body, `{"code":"not_found","errors":["user \"unknown\" does not exist"]}`)
+	request(t, h, "POST", "/v1/groups", `{"name":"admins","long_name":"Admins","members":[]}`)
+	status, _ = request(t, h, "POST", "/v1/groups/admins/rename", `{"new_name":"employees"}`)
+	assert.DeepEqual(t, "status for rename to existing group", status, http.StatusUnprocessableEntity)
+}
+
+func TestGroupMembershipConcurrently(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+	const count = 20
+	for idx := range count {
+		request(t, h, "POST", "/v1/users", fmt.Sprintf(`{"login_name":"user%d","given_name":"User","family_name":"%d","password":""}`, idx, idx))
+	}
+
+	//none of the concurrent additions may be lost
+	var wg sync.WaitGroup
+	for idx := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request(t, h, "POST", fmt.Sprintf("/v1/groups/staff/members/user%d", idx), "")
+		}()
+	}
+	wg.Wait()
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "member count", len(group.MemberLoginNames), count+1)
+}
+
+func TestSeedReload(t *testing.T) {
+	_, h := setupAdminAPI(t, nil)
+	status, body := request(t, h, "POST", "/v1/seed/reload", "")
+	assert.DeepEqual(t, "status without seed", status, http.StatusConflict)
+	assert.DeepEqual(t, "body without seed", body, `{"code":"conflict","errors":["no seed is configured"]}`)
+
+	var seed core.DatabaseSeed
+	err := json.Unmarshal([]byte(`{"groups":[{"name":"staff","long_name":"Seeded Staff"}]}`), &seed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nexus, h := setupAdminAPI(t, &seed)
+	status, _ = request(t, h, "POST", "/v1/seed/reload", "")
+	assert.DeepEqual(t, "status with seed", status, http.StatusNoContent)
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "long name after seed reload", group.LongName, "Seeded Staff")
+
+	//responses show which objects are managed by the seed
+	_, body = request(t, h, "GET", "/v1/groups/staff", "")
+	assert.DeepEqual(t, "seeded group", body, `{"name":"staff","long_name":"Seeded Staff","members":["jane"],"permissions":{"portunus":{"is_admin":false},"ldap":{"can_read":false}},"managed_by_seed":true}`)
+	_, body = request(t, h, "GET", "/v1/users/jane", "")
+	assert.DeepEqual(t, "unseeded user", strings.Contains(body, `"managed_by_seed":false`), true)
+
+	//responses can be sent back as request bodies
+	status, _ = request(t, h, "PUT", "/v1/users/jane", body)
+	assert.DeepEqual(t, "status for PUT with response body", status, http.StatusOK)
+}
+
+func TestLabelSelectors(t *testing.T) {
+	_, h := setupAdminAPI(t, nil)
+	status, _ := request(t, h, "POST", "/v1/users", `{"login_name":"john","given_name":"John","family_name":"Doe","password":"","labels":{"team":"ops","cost-center":"1234"}}`)
+	assert.DeepEqual(t, "status for POST", status, http.StatusCreated)
+	status, body := request(t, h, "POST", "/v1/users", `{"login_name":"jim","given_name":"Jim","family_name":"Doe","password":"","labels":{"Team":"ops"}}`)
+	assert.DeepEqual(t, "status for POST with malformed label", status, http.StatusUnprocessableEntity)
+	assert.DeepEqual(t, "body for POST with malformed label", body,
+		`{"code":"validation_error","errors":["field \"labels\" in user \"jim\" must have label keys consisting of lowercase letters, digits, dots, slashes, underscores and dashes, starting and ending with a letter or digit (found \"Team\")"],"fields":{"users/jim/labels":["must have label keys consisting of lowercase letters, digits, dots, slashes, underscores and dashes, starting and ending with a letter or digit (found \"Team\")"]}}`)
+
+	listUserNames := func(query string) []string {
+		t.Helper()
+		status, body := request(t, h, "GET", "/v1/users"+query, "")
+		assert.DeepEqual(t, "status for GET "+query, status, http.StatusOK)
+		var users []core.User
+		err := json.Unmarshal([]byte(body), &users)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		names := []string{}
+		for _, u := range users {
+			names = append(names, u.LoginName)
+		}
+		return names
+	}
+	assert.DeepEqual(t, "users without selector", listUserNames(""), []string{"jane", "john"})
+	assert.DeepEqual(t, "users with key selector", listUserNames("?label=team"), []string{"john"})
+	assert.DeepEqual(t, "users with two selectors", listUserNames("?label=team=ops&label=cost-center=1234"), []string{"john"})
+	assert.DeepEqual(t, "users with mismatching selector", listUserNames("?label=team=dev"), []string{})
+}
+
+func TestPasswordHashImport(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+
+	//hashes from other systems are accepted if Portunus can verify them
+	status, _ := request(t, h, "POST", "/v1/users", `{"login_name":"john","given_name":"John","family_name":"Doe","password":"$2b$05$abcdefghijklmnopqrstuuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZa"}`)
+	assert.DeepEqual(t, "status for POST with bcrypt hash", status, http.StatusCreated)
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "imported bcrypt hash", user.PasswordHash, "{CRYPT}$2b$05$abcdefghijklmnopqrstuuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZa")
+
+	status, _ = request(t, h, "PUT", "/v1/users/john", `{"given_name":"John","family_name":"Doe","password":"{ssha}88m3dY86bbB/46jjYMWWejSEkOxwZXBwZXIxMg=="}`)
+	assert.DeepEqual(t, "status for PUT with SSHA hash", status, http.StatusOK)
+	user, _ = nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "imported SSHA hash", user.PasswordHash, "{SSHA}88m3dY86bbB/46jjYMWWejSEkOxwZXBwZXIxMg==")
+
+	status, body := request(t, h, "POST", "/v1/users", `{"login_name":"jim","given_name":"Jim","family_name":"Doe","password":"{MD5}X03MO1qnZdYdgyfeuILPmQ=="}`)
+	assert.DeepEqual(t, "status for POST with unsupported hash", status, http.StatusUnprocessableEntity)
+	assert.DeepEqual(t, "body for POST with unsupported hash", body, `{"code":"validation_error","errors":["field \"password\" in user \"jim\" must contain a supported password hash: password hashes in the {MD5} scheme are not supported"],"fields":{"users/jim/password":["must contain a supported password hash: password hashes in the {MD5} scheme are not supported"]}}`)
+
+	//an existing hash can be round-tripped even if it is not in a supported scheme
+	status, _ = request(t, h, "PUT", "/v1/users/jane", `{"given_name":"Jane","family_name":"Doe","password":"{PLAINTEXT}secret"}`)
+	assert.DeepEqual(t, "status for PUT with unchanged hash", status, http.StatusOK)
+}
+
+func TestSeedReport(t *testing.T) {
+	_, h := setupAdminAPI(t, nil)
+	status, body := request(t, h, "GET", "/v1/seed/report", "")
+	assert.DeepEqual(t, "status without seed", status, http.StatusConflict)
+	assert.DeepEqual(t, "body without seed", body, `{"code":"conflict","errors":["no seed is configured"]}`)
+
+	var seed core.DatabaseSeed
+	err := json.Unmarshal([]byte(`{"groups":[{"name":"staff","long_name":"Seeded Staff"}]}`), &seed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, h = setupAdminAPI(t, &seed)
+	status, body = request(t, h, "GET", "/v1/seed/report", "")
+	assert.DeepEqual(t, "status with seed", status, http.StatusOK)
+	assert.DeepEqual(t, "body with seed", body, `{"user_name_regex":"^[a-z0-9.,-]+$","group_name_regex":"^[a-z0-9.,-]+$","problems":[]}`)
+}
+
+func TestBackupRestore(t *testing.T) {
+	_, h := setupAdminAPI(t, nil)
+	status, body := request(t, h, "GET", "/v1/backups", "")
+	assert.DeepEqual(t, "status without backups", status, http.StatusConflict)
+	assert.DeepEqual(t, "body without backups", body, `{"code":"conflict","errors":["backups are not enabled"]}`)
+
+	//take a backup of the initial state (this is usually done by store.Adapter)
+	nexus, _ := setupAdminAPI(t, nil)
+	backupDir := t.TempDir()
+	buf, err := store.MarshalDatabase(core.Database{
+		Users:  nexus.ListUsers(),
+		Groups: nexus.ListGroups(),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.WriteFile(filepath.Join(backupDir, "database-20240304-080000.json"), buf, 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	loadSeed := func() (*core.DatabaseSeed, errext.ErrorSet) { return nil, nil }
+	h = NewAdminServer(nexus, loadSeed, backupDir).Handler
+
+	status, body = request(t, h, "GET", "/v1/backups", "")
+	assert.DeepEqual(t, "status for GET", status, http.StatusOK)
+	assert.DeepEqual(t, "body for GET", body, fmt.Sprintf(`[{"name":"database-20240304-080000.json","created_at":"2024-03-04T08:00:00Z","size":%d}]`, len(buf)))
+
+	//an accidental deletion...
+	status, _ = request(t, h, "DELETE", "/v1/users/jane", "")
+	assert.DeepEqual(t, "status for DELETE", status, http.StatusNoContent)
+	status, _ = request(t, h, "DELETE", "/v1/groups/staff", "")
+	assert.DeepEqual(t, "status for DELETE", status, http.StatusNoContent)
+
+	//...can be undone by restoring the backup
+	status, body = request(t, h, "POST", "/v1/backups/database-20240304-090000.json/restore", "")
+	assert.DeepEqual(t, "status for restore of unknown backup", status, http.StatusNotFound)
+	assert.DeepEqual(t, "body for restore of unknown backup", body, `{"code":"not_found","errors":["backup \"database-20240304-090000.json\" does not exist"]}`)
+	status, _ = request(t, h, "POST", "/v1/backups/database-20240304-080000.json/restore", "")
+	assert.DeepEqual(t, "status for restore", status, http.StatusNoContent)
+	group, ok := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "group exists after restore", ok, true)
+	assert.DeepEqual(t, "members after restore", group.MemberLoginNames, core.GroupMemberNames{"jane": true})
+}
+
+func TestListenUnix(t *testing.T) {
+	stateDir := t.TempDir()
+	err := os.Chmod(stateDir, 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(stateDir, "admin.sock")
+
+	//a leftover socket from a previous run is replaced
+	for range 2 {
+		listener, err := ListenUnix(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.DeepEqual(t, "socket type", fi.Mode().Type(), os.ModeSocket)
+		assert.DeepEqual(t, "socket permissions", fi.Mode().Perm(), os.FileMode(0600))
+
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		listener.Close()
+	}
+
+	//the temporary directory in which the socket was created is gone
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "number of files in state directory", len(entries), 1)
+}
+
+func TestSecretsAreNotExposed(t *testing.T) {
+	nexus, h := setupAdminAPI(t, nil)
+	totpKeyURL := "otpauth://totp/Portunus:jane?secret=JBSWY3DPEHPK3PXP"
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users[0].TOTPKeyURL = totpKeyURL
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	expectNoSecrets := func(action, body string) {
+		t.Helper()
+		for _, field := range []string{`"password"`, `"totp_key_url"`, "secret"} {
+			if strings.Contains(body, field) {
+				t.Errorf("response for %s contains %s: %s", action, field, body)
+			}
+		}
+	}
+
+	_, body := request(t, h, "GET", "/v1/users/jane", "")
+	expectNoSecrets("GET /v1/users/jane", body)
+	_, listBody := request(t, h, "GET", "/v1/users", "")
+	expectNoSecrets("GET /v1/users", listBody)
+
+	//a response can be sent back without losing the redacted secrets
+	status, putBody := request(t, h, "PUT", "/v1/users/jane", body)
+	assert.DeepEqual(t, "status for PUT of GET response", status, http.StatusOK)
+	expectNoSecrets("PUT /v1/users/jane", putBody)
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "password hash after PUT", user.PasswordHash, "{PLAINTEXT}secret")
+	assert.DeepEqual(t, "TOTP key after PUT", user.TOTPKeyURL, totpKeyURL)
+
+	nexus.ValidationConfig().UserRetentionDays = 30 //to deactivate instead of deleting
+	request(t, h, "DELETE", "/v1/users/jane", "")
+	_, body = request(t, h, "GET", "/v1/deactivated-users", "")
+	assert.DeepEqual(t, "deactivated user is listed", strings.Contains(body, `"login_name":"jane"`), true)
+	expectNoSecrets("GET /v1/deactivated-users", body)
+}
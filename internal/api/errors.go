@@ -0,0 +1,119 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// ErrorCode is a machine-readable classification of an error. It appears in
+// type ErrorResponse. Clients may rely on these values staying the same, so
+// they must never be renamed.
+type ErrorCode string
+
+const (
+	// ErrorCodeBadRequest means that the request was malformed, e.g. because
+	// the body was not valid JSON.
+	ErrorCodeBadRequest ErrorCode = "bad_request"
+	// ErrorCodeUnauthorized means that the request did not carry valid
+	// credentials, e.g. a wrong signature on a webhook delivery.
+	ErrorCodeUnauthorized ErrorCode = "unauthorized"
+	// ErrorCodeNotFound means that the object in question does not exist.
+	ErrorCodeNotFound ErrorCode = "not_found"
+	// ErrorCodeConflict means that the request cannot be fulfilled in the
+	// current state of the server, e.g. because no seed is configured.
+	ErrorCodeConflict ErrorCode = "conflict"
+	// ErrorCodeValidationError means that the request was well-formed, but
+	// would have resulted in an invalid database. If the errors can be traced
+	// to specific fields, ErrorResponse.Fields says which ones.
+	ErrorCodeValidationError ErrorCode = "validation_error"
+	// ErrorCodeInternal is used for all errors that do not fit any other code.
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+// ErrorResponse is the response body for all failed requests. It is used by
+// the admin API, and shall be used by all other APIs that Portunus offers.
+type ErrorResponse struct {
+	Code ErrorCode `json:"code"`
+	//Human-readable messages for all errors, including those in Fields.
+	Errors []string `json:"errors"`
+	//Errors that concern specific fields, grouped by field path (see
+	//FieldPath). The messages are sentences without subject, e.g. "may not be
+	//missing", like next to the respective input field in the HTML forms.
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
+// NewErrorResponse builds an ErrorResponse for the given errors. The error
+// code is chosen based on the HTTP status code that the response will be sent
+// with.
+func NewErrorResponse(status int, errs errext.ErrorSet) ErrorResponse {
+	resp := ErrorResponse{
+		Code:   errorCodeForStatus(status),
+		Errors: make([]string, len(errs)),
+	}
+	for idx, err := range errs {
+		resp.Errors[idx] = err.Error()
+		var verr core.ValidationError
+		if errors.As(err, &verr) {
+			if resp.Fields == nil {
+				resp.Fields = make(map[string][]string)
+			}
+			path := FieldPath(verr.FieldRef)
+			resp.Fields[path] = append(resp.Fields[path], verr.FieldError.Error())
+		}
+	}
+	return resp
+}
+
+func errorCodeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusConflict:
+		return ErrorCodeConflict
+	case http.StatusUnprocessableEntity:
+		return ErrorCodeValidationError
+	default:
+		return ErrorCodeInternal
+	}
+}
+
+// FieldPath renders a core.FieldRef into the form that appears in
+// ErrorResponse.Fields, e.g. "users/john/given_name" or
+// "groups/admins/posix_gid". The first two components mirror the URL of the
+// respective object in the admin API. The last component is the field name
+// from the FieldRef, which is the name of the input field in the HTML forms.
+// For most fields, this is also the key in the JSON representation of the
+// object, except for nested objects like "posix" in a user (e.g. "posix_uid").
+func FieldPath(ref core.FieldRef) string {
+	return strings.Join([]string{
+		strings.ReplaceAll(ref.Object.Type, " ", "_") + "s",
+		url.PathEscape(ref.Object.Name),
+		ref.Name,
+	}, "/")
+}
+
+// RespondWithErrors writes an ErrorResponse for the given errors.
+func RespondWithErrors(w http.ResponseWriter, status int, errs errext.ErrorSet) {
+	respondWithJSON(w, status, NewErrorResponse(status, errs))
+}
+
+func respondWithError(w http.ResponseWriter, status int, format string, args ...any) {
+	var errs errext.ErrorSet
+	errs.Addf(format, args...)
+	RespondWithErrors(w, status, errs)
+}
@@ -0,0 +1,50 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestNewErrorResponse(t *testing.T) {
+	userRef := core.ObjectRef{Type: "user", Name: "john"}
+	serviceAccountRef := core.ObjectRef{Type: "service account", Name: "nextcloud"}
+
+	var errs errext.ErrorSet
+	errs.Add(userRef.Field("given_name").Wrap(errors.New("may not be missing")))
+	errs.Add(userRef.Field("given_name").Wrap(errors.New("may not have leading or trailing spaces")))
+	errs.Add(serviceAccountRef.Field("name").Wrap(errors.New("is already in use")))
+	errs.Addf("something else went wrong")
+
+	assert.DeepEqual(t, "error response", NewErrorResponse(http.StatusUnprocessableEntity, errs), ErrorResponse{
+		Code: ErrorCodeValidationError,
+		Errors: []string{
+			`field "given_name" in user "john" may not be missing`,
+			`field "given_name" in user "john" may not have leading or trailing spaces`,
+			`field "name" in service account "nextcloud" is already in use`,
+			`something else went wrong`,
+		},
+		Fields: map[string][]string{
+			"users/john/given_name":           {"may not be missing", "may not have leading or trailing spaces"},
+			"service_accounts/nextcloud/name": {"is already in use"},
+		},
+	})
+
+	//errors without field refs do not produce an empty "fields" object
+	errs = nil
+	errs.Addf("no seed is configured")
+	assert.DeepEqual(t, "error response", NewErrorResponse(http.StatusConflict, errs), ErrorResponse{
+		Code:   ErrorCodeConflict,
+		Errors: []string{"no seed is configured"},
+	})
+}
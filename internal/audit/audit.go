@@ -0,0 +1,282 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package audit records security-relevant events that are not visible in the
+// database itself, e.g. who reset a user's second factor and why. Events are
+// appended to a file in the state directory (one JSON object per line), and
+// the most recent events are also kept in memory for display in the UI.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// EventType is an enum that appears in type Event.
+type EventType string
+
+const (
+	// EventTOTPReset is recorded when an admin removes the second factor of a
+	// user, e.g. because the user lost their authenticator device.
+	EventTOTPReset EventType = "totp-reset"
+	// EventTOTPEnabled is recorded when a user sets up an authenticator app.
+	EventTOTPEnabled EventType = "totp-enabled"
+	// EventTOTPDisabled is recorded when a user removes their authenticator app.
+	EventTOTPDisabled EventType = "totp-disabled"
+	// EventLogin is recorded when a user logs into the web UI.
+	EventLogin EventType = "login"
+	// EventLoginFailed is recorded when someone tries to log into the web UI
+	// as an existing user, but with the wrong password (or with the right
+	// password, but for a disabled user).
+	EventLoginFailed EventType = "login-failed"
+	// EventLoginBlocked is recorded when a login attempt for an existing user
+	// is rejected by the login risk check (see package risk).
+	EventLoginBlocked EventType = "login-blocked"
+	// EventPasswordChange is recorded when a user's password is changed,
+	// either by the user themselves or by an admin.
+	EventPasswordChange EventType = "password-change"
+	// EventDatabaseRestored is recorded when an admin restores the database
+	// from its backup in maintenance mode. The subject is the admin themselves.
+	EventDatabaseRestored EventType = "database-restored"
+	// EventLDAPImport is recorded when changes to a user's attributes that were
+	// made directly in the LDAP directory are imported into the Portunus
+	// database (see ldap.DriftHandlingImport).
+	EventLDAPImport EventType = "ldap-import"
+	// EventUserCreated is recorded when a user is added to the database.
+	EventUserCreated EventType = "user-created"
+	// EventUserDeleted is recorded when a user is removed from the database.
+	EventUserDeleted EventType = "user-deleted"
+	// EventGroupPermissionsChanged is recorded when the permissions granted by
+	// a group change. The details contain the "old" and "new" permissions in
+	// human-readable form.
+	EventGroupPermissionsChanged EventType = "group-permissions-changed"
+	// EventGroupMembersChanged is recorded when users are added to or removed
+	// from a group. The details contain the "added" and "removed" login names
+	// (space-separated), and the "permissions" that the group grants.
+	EventGroupMembersChanged EventType = "group-members-changed"
+)
+
+// Event is a single entry in the audit log.
+type Event struct {
+	Time  time.Time  `json:"time"`
+	Type  EventType  `json:"type"`
+	Actor core.Actor `json:"actor"`
+	//The login name of the user that is affected by this event.
+	Subject string `json:"subject"`
+	//The name of the group that is affected by this event (instead of a user).
+	Group string `json:"group,omitempty"`
+	//A human-readable explanation of what happened.
+	Message string `json:"message"`
+	//Additional information depending on Type.
+	Details map[string]string `json:"details,omitempty"`
+	//If true, the subject shall be notified of this event.
+	Notify bool `json:"notify,omitempty"`
+}
+
+// String returns a human-readable representation of this Event, e.g. for logging.
+func (e Event) String() string {
+	if e.Group != "" {
+		return fmt.Sprintf("%s by %s for group %q: %s", e.Type, e.Actor.String(), e.Group, e.Message)
+	}
+	return fmt.Sprintf("%s by %s for user %q: %s", e.Type, e.Actor.String(), e.Subject, e.Message)
+}
+
+// How many events are kept in memory. Since every login produces an event,
+// this needs to be generous enough that rarer events (like TOTP resets) do not
+// drop out of the profile page of the affected user too quickly.
+const recentEventsLimit = 10000
+
+// Log is the audit log. It can be used from multiple goroutines.
+type Log struct {
+	path   string
+	mutex  sync.Mutex
+	recent []Event
+}
+
+// OpenLog opens the audit log at the given path. The file is created on the
+// first call to Record(), so a missing file is not an error.
+func OpenLog(path string) (*Log, error) {
+	l := &Log{path: path}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var e Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: in line %d: %w", path, lineNo, err)
+		}
+		l.recent = append(l.recent, e)
+		if len(l.recent) > 2*recentEventsLimit {
+			l.recent = slices.Clone(l.recent[len(l.recent)-recentEventsLimit:])
+		}
+	}
+	if len(l.recent) > recentEventsLimit {
+		l.recent = slices.Clone(l.recent[len(l.recent)-recentEventsLimit:])
+	}
+	return l, scanner.Err()
+}
+
+// Record appends an event to the audit log. If e.Time is zero, the current
+// time is filled in.
+func (l *Log) Record(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(buf, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("while writing to %s: %w", l.path, err)
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	logg.Info("audit: %s", e.String())
+	l.recent = append(l.recent, e)
+	if len(l.recent) > recentEventsLimit {
+		l.recent = slices.Clone(l.recent[len(l.recent)-recentEventsLimit:])
+	}
+	return nil
+}
+
+// ListEventsBetween returns all events with `since < e.Time <= until`, with
+// the oldest events first. Unlike the other List methods, this reads the full
+// log file instead of only the recent events kept in memory, so that frequent
+// events (like logins) cannot displace the rarer ones.
+func (l *Log) ListEventsBetween(since, until time.Time) ([]Event, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	file, err := os.Open(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []Event
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var e Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s: in line %d: %w", l.path, lineNo, err)
+		}
+		if e.Time.After(since) && !e.Time.After(until) {
+			result = append(result, e)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// ErrOffsetOutOfRange is returned by ReadEventsAt() when the log file is
+// shorter than the given offset, e.g. because it was replaced by an older copy.
+var ErrOffsetOutOfRange = errors.New("offset is beyond the end of the audit log")
+
+// ReadEventsAt returns up to `limit` events from the log file, starting at the
+// given byte offset. The offset must be 0 or a value that was previously
+// returned by this method. The returned offset points behind the last
+// returned event, so that the next call can continue from there.
+func (l *Log) ReadEventsAt(offset int64, limit int) ([]Event, int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	file, err := os.Open(l.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if offset > 0 {
+			return nil, offset, ErrOffsetOutOfRange
+		}
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, offset, err
+	}
+	if fi.Size() < offset {
+		return nil, offset, ErrOffsetOutOfRange
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	var result []Event
+	reader := bufio.NewReader(file)
+	for len(result) < limit {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			//end of file, or an incomplete line that was cut off by a crash during
+			//Record() (which writes each line at once while holding the mutex)
+			break
+		}
+		if err != nil {
+			return nil, offset, err
+		}
+		var e Event
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return nil, offset, fmt.Errorf("while reading %s: at offset %d: %w", l.path, offset, err)
+		}
+		result = append(result, e)
+		offset += int64(len(line))
+	}
+	return result, offset, nil
+}
+
+// ListEventsForSubject returns all recent events concerning the given user,
+// with the newest events first.
+func (l *Log) ListEventsForSubject(loginName string) []Event {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var result []Event
+	for idx := len(l.recent) - 1; idx >= 0; idx-- {
+		if l.recent[idx].Subject == loginName {
+			result = append(result, l.recent[idx])
+		}
+	}
+	return result
+}
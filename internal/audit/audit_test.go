@@ -0,0 +1,164 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRecordAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	t0 := time.Unix(1700000000, 0).UTC()
+	events := []Event{
+		{
+			Time:    t0,
+			Type:    EventTOTPReset,
+			Actor:   core.Actor{Type: core.ActorTypeUser, Name: "admin"},
+			Subject: "jane",
+			Message: "two-factor authentication was reset",
+			Details: map[string]string{"verification": "video call"},
+			Notify:  true,
+		},
+		{
+			Time:    t0.Add(time.Minute),
+			Type:    EventTOTPReset,
+			Actor:   core.Actor{Type: core.ActorTypeUser, Name: "admin"},
+			Subject: "john",
+			Message: "two-factor authentication was reset",
+		},
+		{
+			Time:    t0.Add(2 * time.Minute),
+			Type:    EventTOTPReset,
+			Actor:   core.Actor{Type: core.ActorTypeUser, Name: "admin"},
+			Subject: "jane",
+			Message: "two-factor authentication was reset again",
+		},
+	}
+	for _, e := range events {
+		err := l.Record(e)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	expected := []Event{events[2], events[0]}
+	assert.DeepEqual(t, "events for jane", l.ListEventsForSubject("jane"), expected)
+	assert.DeepEqual(t, "events for nobody", l.ListEventsForSubject("nobody"), []Event(nil))
+
+	//events must survive a restart
+	l, err = OpenLog(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "events for jane after reopening", l.ListEventsForSubject("jane"), expected)
+
+	//events can be read from the file in batches
+	batch, offset, err := l.ReadEventsAt(0, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "first batch", batch, events[:2])
+	batch, offset, err = l.ReadEventsAt(offset, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "second batch", batch, events[2:])
+	batch, nextOffset, err := l.ReadEventsAt(offset, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "batch at end of file", batch, []Event(nil))
+	assert.DeepEqual(t, "offset at end of file", nextOffset, offset)
+	_, _, err = l.ReadEventsAt(offset+1, 2)
+	assert.DeepEqual(t, "error for offset beyond end of file", err, ErrOffsetOutOfRange)
+}
+
+func TestEventsFromChange(t *testing.T) {
+	actor := core.Actor{Type: core.ActorTypeUser, Name: "admin"}
+	admins := core.Group{
+		Name:             "admins",
+		MemberLoginNames: core.GroupMemberNames{"alice": true},
+		Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+	}
+	newAdmins := admins.Cloned()
+	newAdmins.MemberLoginNames = core.GroupMemberNames{"bob": true, "carol": true}
+	change := core.Change{
+		Actor: actor,
+		Diff: core.DatabaseDiff{
+			Users: core.ObjectDiff[core.User]{
+				Created: []core.User{{LoginName: "carol"}},
+				Deleted: []core.User{{LoginName: "dave"}},
+			},
+			Groups: core.ObjectDiff[core.Group]{
+				Created: []core.Group{{
+					Name:        "readers",
+					Permissions: core.Permissions{LDAP: core.LDAPPermissions{CanReadUsers: true, WriteSubtree: "apps"}},
+				}},
+				Updated: []core.ObjectUpdate[core.Group]{{Old: admins, New: newAdmins}},
+			},
+		},
+	}
+
+	assert.DeepEqual(t, "events", EventsFromChange(change), []Event{
+		{Type: EventUserCreated, Actor: actor, Subject: "carol", Message: "user was created"},
+		{Type: EventUserDeleted, Actor: actor, Subject: "dave", Message: "user was deleted"},
+		{
+			Type:    EventGroupPermissionsChanged,
+			Actor:   actor,
+			Group:   "readers",
+			Message: `permissions were changed from "none" to "LDAP read access to users, LDAP write access to subtree \"apps\""`,
+			Details: map[string]string{"old": "none", "new": `LDAP read access to users, LDAP write access to subtree "apps"`},
+		},
+		{
+			Type:    EventGroupMembersChanged,
+			Actor:   actor,
+			Group:   "admins",
+			Message: "members were changed (2 added, 1 removed)",
+			Details: map[string]string{"added": "bob carol", "removed": "alice", "permissions": "Portunus admin"},
+		},
+	})
+
+	//when recording changes from the nexus, the initial load is ignored
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	l.RecordChanges(t.Context(), nexus)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "alice", GivenName: "Alice", FamilyName: "Admin"}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	errs = nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{LoginName: "bob", GivenName: "Bob", FamilyName: "Builder"})
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	events, err := l.ListEventsBetween(time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of recorded events", len(events), 1)
+	assert.DeepEqual(t, "recorded event", events[0].String(), `user-created by system for user "bob": user was created`)
+}
@@ -0,0 +1,148 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package audit
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// RecordChanges registers a change listener with the nexus that records
+// events for all database changes that are interesting for the change digest
+// (see package digest): users being created or deleted, and changes to the
+// permissions and members of groups. The initial load of the database on
+// startup is not recorded.
+func (l *Log) RecordChanges(ctx context.Context, nexus core.Nexus) {
+	nexus.AddChangeListener(ctx, func(change core.Change) {
+		if change.IsInitialLoad {
+			return
+		}
+		for _, e := range EventsFromChange(change) {
+			err := l.Record(e)
+			if err != nil {
+				logg.Error("could not record event in audit log: %s (event was: %s)", err.Error(), e.String())
+			}
+		}
+	})
+}
+
+// EventsFromChange returns the events that RecordChanges() records for the
+// given change.
+func EventsFromChange(change core.Change) []Event {
+	var result []Event
+	for _, u := range change.Diff.Users.Created {
+		result = append(result, Event{
+			Type:    EventUserCreated,
+			Actor:   change.Actor,
+			Subject: u.LoginName,
+			Message: "user was created",
+		})
+	}
+	for _, u := range change.Diff.Users.Deleted {
+		result = append(result, Event{
+			Type:    EventUserDeleted,
+			Actor:   change.Actor,
+			Subject: u.LoginName,
+			Message: "user was deleted",
+		})
+	}
+
+	//new groups are treated like updates of an empty group with the same name
+	var groupUpdates []core.ObjectUpdate[core.Group]
+	for _, g := range change.Diff.Groups.Created {
+		groupUpdates = append(groupUpdates, core.ObjectUpdate[core.Group]{
+			Old: core.Group{Name: g.Name},
+			New: g,
+		})
+	}
+	groupUpdates = append(groupUpdates, change.Diff.Groups.Updated...)
+
+	for _, upd := range groupUpdates {
+		if !reflect.DeepEqual(upd.Old.Permissions, upd.New.Permissions) {
+			oldDesc := DescribePermissions(upd.Old.Permissions)
+			newDesc := DescribePermissions(upd.New.Permissions)
+			result = append(result, Event{
+				Type:    EventGroupPermissionsChanged,
+				Actor:   change.Actor,
+				Group:   upd.New.Name,
+				Message: fmt.Sprintf("permissions were changed from %q to %q", oldDesc, newDesc),
+				Details: map[string]string{"old": oldDesc, "new": newDesc},
+			})
+		}
+
+		var added, removed []string
+		for loginName, isMember := range upd.New.MemberLoginNames {
+			if isMember && !upd.Old.MemberLoginNames[loginName] {
+				added = append(added, loginName)
+			}
+		}
+		for loginName, isMember := range upd.Old.MemberLoginNames {
+			if isMember && !upd.New.MemberLoginNames[loginName] {
+				removed = append(removed, loginName)
+			}
+		}
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		slices.Sort(added)
+		slices.Sort(removed)
+		result = append(result, Event{
+			Type:    EventGroupMembersChanged,
+			Actor:   change.Actor,
+			Group:   upd.New.Name,
+			Message: fmt.Sprintf("members were changed (%d added, %d removed)", len(added), len(removed)),
+			Details: map[string]string{
+				"added":       strings.Join(added, " "),
+				"removed":     strings.Join(removed, " "),
+				"permissions": DescribePermissions(upd.New.Permissions),
+			},
+		})
+	}
+	return result
+}
+
+// DescribePermissions returns a human-readable summary of the given
+// permissions, e.g. "Portunus admin, LDAP read access".
+func DescribePermissions(p core.Permissions) string {
+	var parts []string
+	if p.Portunus.IsAdmin {
+		parts = append(parts, "Portunus admin")
+	}
+	switch {
+	case p.LDAP.CanRead:
+		parts = append(parts, "LDAP read access")
+	case p.LDAP.CanReadUsers && p.LDAP.CanReadGroups:
+		parts = append(parts, "LDAP read access to users and groups")
+	case p.LDAP.CanReadUsers:
+		parts = append(parts, "LDAP read access to users")
+	case p.LDAP.CanReadGroups:
+		parts = append(parts, "LDAP read access to groups")
+	}
+	var readGroupNames []string
+	for name, isReadable := range p.LDAP.ReadGroupNames {
+		if isReadable {
+			readGroupNames = append(readGroupNames, name)
+		}
+	}
+	slices.Sort(readGroupNames)
+	for _, name := range readGroupNames {
+		parts = append(parts, fmt.Sprintf("LDAP read access to group %q", name))
+	}
+	if p.LDAP.WriteSubtree != "" {
+		parts = append(parts, fmt.Sprintf("LDAP write access to subtree %q", p.LDAP.WriteSubtree))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,79 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package buildinfo reports which version of Portunus is running.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// These are set at build time by the Makefile through
+// `-ldflags "-X github.com/majewsky/portunus/internal/buildinfo.Version=..."`.
+// When they are not set (e.g. for plain `go build`), Get() falls back to the
+// information that the Go toolchain embeds in the binary.
+var (
+	Version = ""
+	Commit  = ""
+)
+
+// Info describes the running binary. This is what the version endpoint
+// serializes.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the Info for the running binary.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		if info.Commit == "" {
+			info.Commit = commitFromSettings(bi.Settings)
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "unknown"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	return info
+}
+
+func commitFromSettings(settings []debug.BuildSetting) string {
+	var revision string
+	isModified := false
+	for _, s := range settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			isModified = s.Value == "true"
+		}
+	}
+	if revision != "" && isModified {
+		return revision + "-dirty"
+	}
+	return revision
+}
+
+// String returns a human-readable description, e.g. for log messages.
+func (i Info) String() string {
+	return i.Version + " (commit " + i.Commit + ", built with " + i.GoVersion + ")"
+}
@@ -0,0 +1,37 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package buildinfo
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestInjectedValuesTakePrecedence(t *testing.T) {
+	Version, Commit = "v2.2.0", "0123456789abcdef"
+	t.Cleanup(func() { Version, Commit = "", "" })
+
+	info := Get()
+	assert.DeepEqual(t, "version", info.Version, "v2.2.0")
+	assert.DeepEqual(t, "commit", info.Commit, "0123456789abcdef")
+}
+
+func TestCommitFromSettings(t *testing.T) {
+	settings := []debug.BuildSetting{
+		{Key: "vcs", Value: "git"},
+		{Key: "vcs.revision", Value: "0123456789abcdef"},
+		{Key: "vcs.modified", Value: "false"},
+	}
+	assert.DeepEqual(t, "clean commit", commitFromSettings(settings), "0123456789abcdef")
+
+	settings[2].Value = "true"
+	assert.DeepEqual(t, "dirty commit", commitFromSettings(settings), "0123456789abcdef-dirty")
+
+	assert.DeepEqual(t, "no commit", commitFromSettings(nil), "")
+}
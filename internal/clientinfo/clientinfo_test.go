@@ -0,0 +1,98 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package clientinfo
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestGeoIPLookup(t *testing.T) {
+	db, err := parseGeoIPDatabase(strings.NewReader(`10.0.0.0,10.255.255.255,zz
+1.0.0.0,1.0.0.255,AU
+2001:db8::,2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,DE
+1.0.4.0,1.0.7.255,AU
+`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for addr, expected := range map[string]string{
+		"1.0.0.0":          "AU",
+		"1.0.0.42":         "AU",
+		"1.0.0.255":        "AU",
+		"1.0.1.0":          "",
+		"1.0.5.1":          "AU",
+		"10.1.2.3":         "ZZ",
+		"::ffff:10.1.2.3":  "ZZ",
+		"0.0.0.1":          "",
+		"192.168.0.1":      "",
+		"2001:db8::1":      "DE",
+		"2001:db9::1":      "",
+		"::1":              "",
+		"1.0.0.0.invalid?": "",
+	} {
+		ip, _ := netip.ParseAddr(addr)
+		actual := db.LookupCountry(ip)
+		if actual != expected {
+			t.Errorf("expected %s -> %q, but got %q", addr, expected, actual)
+		}
+	}
+
+	//a missing database does not know any countries
+	var nilDB *GeoIPDatabase
+	if country := nilDB.LookupCountry(netip.MustParseAddr("1.0.0.1")); country != "" {
+		t.Errorf("expected nil database to return no country, but got %q", country)
+	}
+
+	_, err = parseGeoIPDatabase(strings.NewReader("1.0.0.0,1.0.0.255,AU\n1.0.0.128,1.0.1.255,CN\n"))
+	expectedError := "address ranges 1.0.0.0-1.0.0.255 and 1.0.0.128-1.0.1.255 overlap"
+	if err == nil || err.Error() != expectedError {
+		t.Errorf("expected error %q, but got %v", expectedError, err)
+	}
+}
+
+func TestDescribeUserAgent(t *testing.T) {
+	for ua, expected := range map[string]string{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0":                                                                  "Firefox on Linux",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0":           "Edge on Windows",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.6367.82 Mobile Safari/537.36":                        "Chrome on Android",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15":                   "Safari on macOS",
+		"curl/8.7.1":                      "curl",
+		"Mozilla/5.0 (X11; Linux x86_64)": "Unknown browser on Linux",
+		"something else entirely":         "",
+		"":                                "",
+	} {
+		actual := DescribeUserAgent(ua)
+		if actual != expected {
+			t.Errorf("expected %q -> %q, but got %q", ua, expected, actual)
+		}
+	}
+}
+
+func TestLacksSameSiteSupport(t *testing.T) {
+	for ua, expected := range map[string]bool{
+		"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0":                                                                  false,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:52.0) Gecko/20100101 Firefox/52.0":                                                                    true,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0":           false,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Safari/537.36 Edge/15.15063":       true,
+		"Mozilla/5.0 (Windows NT 6.1; WOW64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/49.0.2623.112 Safari/537.36":                           true,
+		"Mozilla/5.0 (Windows NT 10.0; WOW64; Trident/7.0; rv:11.0) like Gecko":                                                                   true,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1": false,
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_12_6) AppleWebKit/603.3.8 (KHTML, like Gecko) Version/10.1.2 Safari/603.3.8":                   true,
+		"curl/8.7.1":              false,
+		"something else entirely": false,
+		"":                        false,
+	} {
+		actual := LacksSameSiteSupport(ua)
+		if actual != expected {
+			t.Errorf("expected %q -> %t, but got %t", ua, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package clientinfo derives coarse, human-readable information about the
+// client behind an HTTP request (country of origin, browser and operating
+// system) for display in the audit log. It works entirely offline: no
+// information about users is sent to any third party.
+package clientinfo
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// GeoIPDatabase maps IP addresses to countries. It is read from a CSV file in
+// the format of the "IP to Country Lite" database from db-ip.com, where each
+// line contains the first and last address of a range and the ISO 3166-1
+// alpha-2 country code for that range, e.g.
+//
+//	1.0.0.0,1.0.0.255,AU
+//
+// A nil *GeoIPDatabase is valid and does not know any countries.
+type GeoIPDatabase struct {
+	ranges []ipRange //sorted by first address, non-overlapping
+}
+
+type ipRange struct {
+	First   netip.Addr
+	Last    netip.Addr
+	Country string
+}
+
+// LoadGeoIPDatabase reads the database at the given path.
+func LoadGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db, err := parseGeoIPDatabase(file)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return db, nil
+}
+
+func parseGeoIPDatabase(r io.Reader) (*GeoIPDatabase, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.ReuseRecord = true
+
+	var db GeoIPDatabase
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lineNo, _ := reader.FieldPos(0)
+
+		first, err := netip.ParseAddr(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("in line %d: %w", lineNo, err)
+		}
+		last, err := netip.ParseAddr(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("in line %d: %w", lineNo, err)
+		}
+		first, last = first.Unmap(), last.Unmap()
+		if first.BitLen() != last.BitLen() || last.Less(first) {
+			return nil, fmt.Errorf("in line %d: invalid address range %s-%s", lineNo, first, last)
+		}
+		country := strings.ToUpper(strings.TrimSpace(record[2]))
+		db.ranges = append(db.ranges, ipRange{first, last, country})
+	}
+
+	slices.SortFunc(db.ranges, func(lhs, rhs ipRange) int {
+		return lhs.First.Compare(rhs.First)
+	})
+	for idx := 1; idx < len(db.ranges); idx++ {
+		prev, next := db.ranges[idx-1], db.ranges[idx]
+		if !prev.Last.Less(next.First) {
+			return nil, fmt.Errorf("address ranges %s-%s and %s-%s overlap", prev.First, prev.Last, next.First, next.Last)
+		}
+	}
+	return &db, nil
+}
+
+// LookupCountry returns the country code for the given IP address, or the
+// empty string if the address is not covered by this database.
+func (db *GeoIPDatabase) LookupCountry(addr netip.Addr) string {
+	if db == nil || !addr.IsValid() {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	//find the last range starting at or before `addr`
+	idx, found := slices.BinarySearchFunc(db.ranges, addr, func(r ipRange, addr netip.Addr) int {
+		return r.First.Compare(addr)
+	})
+	if !found {
+		if idx == 0 {
+			return ""
+		}
+		idx--
+	}
+	r := db.ranges[idx]
+	if addr.BitLen() != r.Last.BitLen() || r.Last.Less(addr) {
+		return ""
+	}
+	return r.Country
+}
@@ -0,0 +1,114 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package clientinfo
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The order of these lists matters: Many browsers include the product tokens
+// of the browsers they are derived from (e.g. Edge claims to be Chrome, and
+// Chrome claims to be Safari), so the more specific tokens need to come first.
+var (
+	browserTokens = []struct {
+		Token string
+		Name  string
+	}{
+		{"Edg/", "Edge"},
+		{"EdgA/", "Edge"},
+		{"EdgiOS/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Vivaldi/", "Vivaldi"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"Chromium/", "Chromium"},
+		{"Chrome/", "Chrome"},
+		{"CriOS/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"Wget/", "Wget"},
+	}
+	osTokens = []struct {
+		Token string
+		Name  string
+	}{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Macintosh", "macOS"},
+		{"Linux", "Linux"},
+		{"FreeBSD", "FreeBSD"},
+		{"OpenBSD", "OpenBSD"},
+	}
+)
+
+// DescribeUserAgent turns a User-Agent header into a short description like
+// "Firefox on Linux". The empty string is returned if neither the browser nor
+// the operating system could be recognized.
+func DescribeUserAgent(userAgent string) string {
+	var browser, system string
+	for _, t := range browserTokens {
+		if strings.Contains(userAgent, t.Token) {
+			browser = t.Name
+			break
+		}
+	}
+	for _, t := range osTokens {
+		if strings.Contains(userAgent, t.Token) {
+			system = t.Name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return "Unknown browser on " + system
+	default:
+		return ""
+	}
+}
+
+// The first versions of each browser that understand the SameSite attribute of
+// cookies, which the CSRF protection relies upon. As above, the more specific
+// tokens need to come first. For Safari, the version is in "Version/", since
+// "Safari/" contains the WebKit build number instead.
+var sameSiteMinimumVersions = []struct {
+	Token          string
+	MinimumVersion int
+}{
+	{"Edge/", 16}, //the old EdgeHTML-based Edge
+	{"Firefox/", 60},
+	{"Chrome/", 51},
+	{"Version/", 12},
+}
+
+// LacksSameSiteSupport returns true if the User-Agent header belongs to a
+// browser that is known to ignore the SameSite attribute of cookies. Unknown
+// browsers are assumed to support it.
+func LacksSameSiteSupport(userAgent string) bool {
+	if strings.Contains(userAgent, "MSIE ") || strings.Contains(userAgent, "Trident/") {
+		return true //Internet Explorer
+	}
+	for _, t := range sameSiteMinimumVersions {
+		_, rest, found := strings.Cut(userAgent, t.Token)
+		if !found {
+			continue
+		}
+		major, _, _ := strings.Cut(rest, ".")
+		version, err := strconv.Atoi(major)
+		return err == nil && version < t.MinimumVersion
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+// ActorType is an enum that appears in type Actor.
+type ActorType string
+
+const (
+	// ActorTypeUser describes changes made by a user through the UI.
+	// Actor.Name is their login name.
+	ActorTypeUser ActorType = "user"
+	// ActorTypeAPIToken describes changes made through an API.
+	// Actor.Name identifies the token that was used.
+	ActorTypeAPIToken ActorType = "api-token"
+	// ActorTypeAdminSocket describes changes made through the admin socket
+	// (usually by portunusctl). Actor.Name identifies the Unix user ID of the
+	// client process.
+	ActorTypeAdminSocket ActorType = "admin-socket"
+	// ActorTypeSeed describes changes that were made only to enforce the seed.
+	ActorTypeSeed ActorType = "seed"
+	// ActorTypeSystem describes changes that were made (or at least observed)
+	// by Portunus itself, e.g. edits of the database file. Actor.Name may
+	// identify the responsible component.
+	ActorTypeSystem ActorType = "system"
+)
+
+// Actor identifies who caused a change to the Database.
+type Actor struct {
+	Type ActorType `json:"type"`
+	Name string    `json:"name,omitempty"`
+}
+
+// IsInteractive returns whether changes by this actor were requested by
+// someone who can be told when the change is rejected.
+func (a Actor) IsInteractive() bool {
+	switch a.Type {
+	case ActorTypeUser, ActorTypeAPIToken, ActorTypeAdminSocket:
+		return true
+	default:
+		return false
+	}
+}
+
+// String returns a human-readable representation of this Actor, e.g. for logging.
+func (a Actor) String() string {
+	if a.Name == "" {
+		return string(a.Type)
+	}
+	return string(a.Type) + " " + a.Name
+}
@@ -8,35 +8,64 @@ package core
 
 import (
 	"fmt"
+	"slices"
 	"sort"
+	"strings"
 
 	"github.com/sapcc/go-bits/errext"
 )
 
 // Database contains the contents of Portunus' database.
 type Database struct {
-	Users  ObjectList[User]
-	Groups ObjectList[Group]
+	Users           ObjectList[User]
+	Groups          ObjectList[Group]
+	ServiceAccounts ObjectList[ServiceAccount]
+	AccessReviews   []AccessReview
+	JoinRequests    []JoinRequest
+	//Users that were deleted, but can still be restored.
+	DeactivatedUsers []DeactivatedUser
+	//Previous versions of users and groups, including deleted ones.
+	UserHistory  []ObjectHistory[User]
+	GroupHistory []ObjectHistory[Group]
 }
 
 // Cloned returns a deep copy of this database.
 func (d Database) Cloned() Database {
-	return Database{
-		Users:  d.Users.Cloned(),
-		Groups: d.Groups.Cloned(),
+	result := Database{
+		Users:        d.Users.Cloned(),
+		Groups:       d.Groups.Cloned(),
+		JoinRequests: slices.Clone(d.JoinRequests),
+		UserHistory:  cloneHistories(d.UserHistory),
+		GroupHistory: cloneHistories(d.GroupHistory),
 	}
+	if d.ServiceAccounts != nil {
+		result.ServiceAccounts = d.ServiceAccounts.Cloned()
+	}
+	if d.DeactivatedUsers != nil {
+		result.DeactivatedUsers = make([]DeactivatedUser, len(d.DeactivatedUsers))
+		for idx, u := range d.DeactivatedUsers {
+			result.DeactivatedUsers[idx] = u.Cloned()
+		}
+	}
+	if d.AccessReviews != nil {
+		result.AccessReviews = make([]AccessReview, len(d.AccessReviews))
+		for idx, r := range d.AccessReviews {
+			result.AccessReviews[idx] = r.Cloned()
+		}
+	}
+	return result
 }
 
 // IsEmpty returns whether this Database is zero-initialized.
 func (d Database) IsEmpty() bool {
-	return len(d.Users) == 0 && len(d.Groups) == 0
+	return len(d.Users) == 0 && len(d.Groups) == 0 && len(d.ServiceAccounts) == 0
 }
 
 // collectUserPermissions assembles a UserWithPerms for the given User.
 // This function assumes that `user` has already been cloned.
 func (d Database) collectUserPermissions(user User) UserWithPerms {
 	result := UserWithPerms{User: user}
-	for _, group := range d.Groups {
+	for _, group := range ResolveNestedGroups(d.Groups) {
 		if group.ContainsUser(user) {
 			result.GroupMemberships = append(result.GroupMemberships, group.Cloned())
 			result.Perms = result.Perms.Union(group.Permissions)
@@ -48,12 +77,62 @@ func (d Database) collectUserPermissions(user User) UserWithPerms {
 // Normalize applies idempotent transformations to this database to ensure
 // stable comparison and serialization.
 func (d *Database) Normalize() {
-	for _, g := range d.Groups {
+	for idx, g := range d.Groups {
 		for name, isMember := range g.MemberLoginNames {
 			if !isMember {
 				delete(g.MemberLoginNames, name)
 			}
 		}
+		for name, isMember := range g.MemberGroupNames {
+			if !isMember {
+				delete(g.MemberGroupNames, name)
+			}
+		}
+		if len(g.MemberGroupNames) == 0 {
+			d.Groups[idx].MemberGroupNames = nil
+		}
+		//expiry dates are dropped together with the membership
+		for name := range g.MemberValidUntil {
+			if !g.MemberLoginNames[name] {
+				delete(g.MemberValidUntil, name)
+			}
+		}
+		if len(g.MemberValidUntil) == 0 {
+			d.Groups[idx].MemberValidUntil = nil
+		}
+		for name, isReadable := range g.Permissions.LDAP.ReadGroupNames {
+			if !isReadable {
+				delete(g.Permissions.LDAP.ReadGroupNames, name)
+			}
+		}
+		if len(g.Permissions.LDAP.ReadGroupNames) == 0 {
+			d.Groups[idx].Permissions.LDAP.ReadGroupNames = nil
+		}
+		if len(g.DefaultMembership.ForEMailDomains) == 0 {
+			d.Groups[idx].DefaultMembership.ForEMailDomains = nil
+		} else {
+			sort.Strings(g.DefaultMembership.ForEMailDomains)
+		}
+		if len(g.Labels) == 0 {
+			d.Groups[idx].Labels = nil
+		}
+	}
+	for idx, u := range d.Users {
+		if len(u.Labels) == 0 {
+			d.Users[idx].Labels = nil
+		}
+		if len(u.ExtraAttributes) == 0 {
+			d.Users[idx].ExtraAttributes = nil
+		}
+		if len(u.JPEGPhoto) == 0 {
+			d.Users[idx].JPEGPhoto = nil
+		}
+		if len(u.HiddenLDAPAttributes) == 0 {
+			d.Users[idx].HiddenLDAPAttributes = nil
+		} else {
+			slices.Sort(u.HiddenLDAPAttributes)
+			d.Users[idx].HiddenLDAPAttributes = slices.Compact(u.HiddenLDAPAttributes)
+		}
 	}
 
 	sort.Slice(d.Groups, func(i, j int) bool {
@@ -62,9 +141,36 @@ func (d *Database) Normalize() {
 	sort.Slice(d.Users, func(i, j int) bool {
 		return d.Users[i].LoginName < d.Users[j].LoginName
 	})
+	if len(d.ServiceAccounts) == 0 {
+		d.ServiceAccounts = nil
+	}
+	sort.Slice(d.ServiceAccounts, func(i, j int) bool {
+		return d.ServiceAccounts[i].Name < d.ServiceAccounts[j].Name
+	})
+	sort.Slice(d.AccessReviews, func(i, j int) bool {
+		return d.AccessReviews[i].Name < d.AccessReviews[j].Name
+	})
+	for idx := range d.AccessReviews {
+		d.AccessReviews[idx].normalize()
+	}
+	sort.Slice(d.JoinRequests, func(i, j int) bool {
+		lhs, rhs := d.JoinRequests[i], d.JoinRequests[j]
+		if lhs.GroupName != rhs.GroupName {
+			return lhs.GroupName < rhs.GroupName
+		}
+		return lhs.LoginName < rhs.LoginName
+	})
+	if len(d.DeactivatedUsers) == 0 {
+		d.DeactivatedUsers = nil
+	}
+	sort.Slice(d.DeactivatedUsers, func(i, j int) bool {
+		return d.DeactivatedUsers[i].User.LoginName < d.DeactivatedUsers[j].User.LoginName
+	})
+	d.UserHistory = normalizeHistories(d.UserHistory)
+	d.GroupHistory = normalizeHistories(d.GroupHistory)
 }
 
-// Validate checks all users and groups in this Database for validity.
+// Validate checks all objects in this Database for validity.
 func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 	//check user attributes
 	userCount := make(map[string]uint)
@@ -72,6 +178,17 @@ func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		errs.Append(u.validateLocal(cfg))
 		userCount[u.LoginName]++
 	}
+	for _, u := range d.Users {
+		switch {
+		case u.ManagerLoginName == "":
+			continue
+		case u.ManagerLoginName == u.LoginName:
+			errs.Add(ValidationError{u.Ref().Field("manager"), errIsSelfReference})
+		case userCount[u.ManagerLoginName] == 0:
+			err := fmt.Errorf("refers to unknown user with login name %q", u.ManagerLoginName)
+			errs.Add(ValidationError{u.Ref().Field("manager"), err})
+		}
+	}
 
 	//check group attributes and membership
 	groupCount := make(map[string]uint)
@@ -85,6 +202,85 @@ func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 				errs.Add(ValidationError{g.Ref().Field("members"), err})
 			}
 		}
+		if g.OwnerLoginName != "" && userCount[g.OwnerLoginName] == 0 {
+			err := fmt.Errorf("refers to unknown user with login name %q", g.OwnerLoginName)
+			errs.Add(ValidationError{g.Ref().Field("owner"), err})
+		}
+	}
+
+	//check nested groups (this needs to happen after the loop above, since
+	//groups can contain groups that appear later in the list)
+	for _, g := range d.Groups {
+		for name, isMember := range g.MemberGroupNames {
+			if isMember && groupCount[name] == 0 {
+				err := fmt.Errorf("contains unknown group %q", name)
+				errs.Add(ValidationError{g.Ref().Field("member_groups"), err})
+			}
+		}
+		for name, isReadable := range g.Permissions.LDAP.ReadGroupNames {
+			if isReadable && groupCount[name] == 0 {
+				err := fmt.Errorf("refers to unknown group %q", name)
+				errs.Add(ValidationError{g.Ref().Field("ldap_read_groups"), err})
+			}
+		}
+	}
+	for _, cycle := range findGroupCycles(d.Groups) {
+		err := fmt.Errorf("must not contain a cycle, but found %s", strings.Join(cycle, " -> "))
+		errs.Add(ValidationError{Group{Name: cycle[0]}.Ref().Field("member_groups"), err})
+	}
+
+	//check service accounts (their names are separate from the user names
+	//since service accounts live in their own organizational unit)
+	serviceAccountCount := make(map[string]uint)
+	for _, s := range d.ServiceAccounts {
+		errs.Append(s.validateLocal(cfg))
+		serviceAccountCount[s.Name]++
+	}
+	for name, count := range serviceAccountCount {
+		if count > 1 {
+			ref := ServiceAccount{Name: name}.Ref().Field("name")
+			errs.Add(ref.Wrap(errIsDuplicate))
+		}
+	}
+
+	//check access reviews
+	reviewCount := make(map[string]uint)
+	for _, r := range d.AccessReviews {
+		errs.Append(r.validate())
+		reviewCount[r.Name]++
+	}
+	for name, count := range reviewCount {
+		if count > 1 {
+			ref := AccessReview{Name: name}.Ref().Field("name")
+			errs.Add(ref.Wrap(errIsDuplicate))
+		}
+	}
+
+	//check join requests
+	for _, r := range d.JoinRequests {
+		errs.Append(r.validate())
+		if userCount[r.LoginName] == 0 {
+			err := fmt.Errorf("refers to unknown user with login name %q", r.LoginName)
+			errs.Add(ValidationError{r.Ref().Field("user"), err})
+		}
+	}
+
+	//check deactivated users (their login names stay reserved until they are
+	//purged, so that restoring them cannot fail)
+	deactivatedUserCount := make(map[string]uint)
+	for _, u := range d.DeactivatedUsers {
+		errs.Append(u.validate())
+		deactivatedUserCount[u.User.LoginName]++
+	}
+	for loginName, count := range deactivatedUserCount {
+		if count > 1 {
+			ref := DeactivatedUser{User: User{LoginName: loginName}}.Ref().Field("login_name")
+			errs.Add(ref.Wrap(errIsDuplicate))
+		}
+		if userCount[loginName] > 0 {
+			ref := User{LoginName: loginName}.Ref().Field("login_name")
+			errs.Add(ref.Wrap(errBelongsToDeactivatedUser))
+		}
 	}
 
 	//check user name uniqueness
@@ -105,3 +301,135 @@ func (d Database) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 
 	return
 }
+
+// Warnings checks for problems that do not make this Database invalid, but
+// that are likely to cause trouble in systems consuming it. Unlike
+// Validate(), these do not block any updates; they are only shown to admins.
+func (d Database) Warnings(cfg *ValidationConfig) []ValidationError {
+	return checkPosixGroupLimit(d.Users, d.Groups, cfg)
+}
+
+// Returns cycles of nested groups, e.g. ["a", "b", "a"] if group "a" contains
+// group "b" and vice versa. Groups are checked in alphabetical order, and
+// groups that are part of an already reported cycle are not checked again, so
+// that the same cycle is not reported once for each of its groups.
+func findGroupCycles(groups []Group) (result [][]string) {
+	byName := make(map[string]Group, len(groups))
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+	sortedNames := func(names GroupMemberNames) []string {
+		var result []string
+		for name, isMember := range names {
+			if isMember {
+				result = append(result, name)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	allNames := make(GroupMemberNames, len(groups))
+	for _, g := range groups {
+		allNames[g.Name] = true
+	}
+
+	isReported := make(map[string]bool)
+	for _, start := range sortedNames(allNames) {
+		if isReported[start] {
+			continue
+		}
+		//breadth-first search for the shortest path from `start` back to itself
+		predecessor := make(map[string]string)
+		queue := []string{start}
+		found := false
+		for len(queue) > 0 && !found {
+			current := queue[0]
+			queue = queue[1:]
+			for _, next := range sortedNames(byName[current].MemberGroupNames) {
+				if next == start {
+					predecessor[start] = current
+					found = true
+					break
+				}
+				if _, seen := predecessor[next]; !seen {
+					predecessor[next] = current
+					queue = append(queue, next)
+				}
+			}
+		}
+		if !found {
+			continue
+		}
+
+		cycle := []string{start}
+		for current := predecessor[start]; current != start; current = predecessor[current] {
+			cycle = append(cycle, current)
+		}
+		cycle = append(cycle, start)
+		slices.Reverse(cycle)
+		for _, name := range cycle {
+			isReported[name] = true
+		}
+		result = append(result, cycle)
+	}
+	return result
+}
+
+// DeleteUser removes the user with the given login name, as well as all
+// references to it from groups, other users and join requests.
+func (d *Database) DeleteUser(loginName string) error {
+	err := d.Users.Delete(loginName)
+	if err != nil {
+		return err
+	}
+	for idx, group := range d.Groups {
+		if group.MemberLoginNames != nil {
+			group.MemberLoginNames[loginName] = false
+		}
+		if group.OwnerLoginName == loginName {
+			d.Groups[idx].OwnerLoginName = ""
+		}
+	}
+	for idx, user := range d.Users {
+		if user.ManagerLoginName == loginName {
+			d.Users[idx].ManagerLoginName = ""
+		}
+	}
+	d.JoinRequests = slices.DeleteFunc(d.JoinRequests, func(r JoinRequest) bool {
+		return r.LoginName == loginName
+	})
+	return nil
+}
+
+// DeleteGroup removes the group with the given name, as well as all
+// references to it from other groups.
+func (d *Database) DeleteGroup(name string) error {
+	err := d.Groups.Delete(name)
+	if err != nil {
+		return err
+	}
+	for _, group := range d.Groups {
+		if group.MemberGroupNames != nil {
+			group.MemberGroupNames[name] = false
+		}
+		if group.Permissions.LDAP.ReadGroupNames != nil {
+			group.Permissions.LDAP.ReadGroupNames[name] = false
+		}
+	}
+	return nil
+}
+
+// AddDefaultMemberships adds the given user to all groups whose
+// DefaultMembershipRules match it. This shall be called when a user is created.
+func (d *Database) AddDefaultMemberships(user User) {
+	for idx, group := range d.Groups {
+		if !group.DefaultMembership.Matches(user) {
+			continue
+		}
+		if group.MemberLoginNames == nil {
+			d.Groups[idx].MemberLoginNames = make(GroupMemberNames)
+		}
+		d.Groups[idx].MemberLoginNames[user.LoginName] = true
+	}
+}
@@ -0,0 +1,198 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/majewsky/portunus/internal/envconfig"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// DefaultUserRetentionDays is the default for
+// ValidationConfig.UserRetentionDays.
+const DefaultUserRetentionDays = 30
+
+func readUserRetentionDaysFromEnvironment() (uint, error) {
+	return envconfig.GetUint("PORTUNUS_USER_RETENTION_DAYS", DefaultUserRetentionDays)
+}
+
+// DeactivatedUser is a user that was deleted, but is kept around until its
+// retention period expires (see ValidationConfig.UserRetentionDays), so that
+// it can be restored if it was deleted by mistake. Deactivated users are not
+// part of Database.Users, so they do not appear in LDAP and cannot log in.
+type DeactivatedUser struct {
+	User          User   `json:"user"`
+	DeactivatedBy Actor  `json:"deactivated_by"`
+	DeactivatedAt string `json:"deactivated_at"` //in DateFormat
+	//The groups that the user was a member of. On restore, the user is added
+	//to those of these groups that still exist.
+	GroupNames []string `json:"groups,omitempty"`
+}
+
+// Ref returns an ObjectRef that can be used to build validation errors.
+func (u DeactivatedUser) Ref() ObjectRef {
+	return ObjectRef{
+		Type: "deactivated user",
+		Name: u.User.LoginName,
+	}
+}
+
+// Cloned returns a deep copy of this object.
+func (u DeactivatedUser) Cloned() DeactivatedUser {
+	u.User = u.User.Cloned()
+	u.GroupNames = slices.Clone(u.GroupNames)
+	return u
+}
+
+// PurgeDate returns the date on which this user will be purged under the
+// given retention period.
+func (u DeactivatedUser) PurgeDate(retentionDays uint) string {
+	deactivatedAt, err := time.Parse(DateFormat, u.DeactivatedAt)
+	if err != nil {
+		return ""
+	}
+	return deactivatedAt.AddDate(0, 0, int(retentionDays)).Format(DateFormat)
+}
+
+func (u DeactivatedUser) validate() (errs errext.ErrorSet) {
+	ref := u.Ref()
+	errs.Add(ref.Field("deactivated_at").WrapFirst(
+		MustNotBeEmpty(u.DeactivatedAt),
+		mustBeDate(u.DeactivatedAt),
+	))
+	return errs
+}
+
+var errBelongsToDeactivatedUser = errors.New("belongs to a deactivated user (restore or purge that user first)")
+
+// DeactivateUser removes the user with the given login name like DeleteUser,
+// but keeps it as a DeactivatedUser until it is restored or purged. If
+// cfg.UserRetentionDays is 0, the user is deleted right away.
+func (d *Database) DeactivateUser(loginName string, deactivatedBy Actor, now time.Time, cfg *ValidationConfig) error {
+	user, exists := d.Users.Find(func(u User) bool { return u.LoginName == loginName })
+	if !exists {
+		return fmt.Errorf("user %q does not exist", loginName)
+	}
+	if cfg.UserRetentionDays == 0 {
+		return d.DeleteUser(loginName)
+	}
+
+	deactivated := DeactivatedUser{
+		User:          user.Cloned(),
+		DeactivatedBy: deactivatedBy,
+		DeactivatedAt: now.Format(DateFormat),
+	}
+	for _, group := range d.Groups {
+		if group.MemberLoginNames[loginName] {
+			deactivated.GroupNames = append(deactivated.GroupNames, group.Name)
+		}
+	}
+	//the manager may be gone by the time the user is restored
+	deactivated.User.ManagerLoginName = ""
+
+	err := d.DeleteUser(loginName)
+	if err != nil {
+		return err
+	}
+	d.DeactivatedUsers = append(d.DeactivatedUsers, deactivated)
+	return nil
+}
+
+// RestoreUser moves the deactivated user with the given login name back into
+// Database.Users, and adds it back into its previous groups.
+func (d *Database) RestoreUser(loginName string) error {
+	idx := slices.IndexFunc(d.DeactivatedUsers, func(u DeactivatedUser) bool { return u.User.LoginName == loginName })
+	if idx == -1 {
+		return fmt.Errorf("deactivated user %q does not exist", loginName)
+	}
+	deactivated := d.DeactivatedUsers[idx]
+	d.DeactivatedUsers = slices.Delete(d.DeactivatedUsers, idx, idx+1)
+
+	d.Users = append(d.Users, deactivated.User)
+	for gidx, group := range d.Groups {
+		if !slices.Contains(deactivated.GroupNames, group.Name) {
+			continue
+		}
+		if group.MemberLoginNames == nil {
+			d.Groups[gidx].MemberLoginNames = make(GroupMemberNames)
+		}
+		d.Groups[gidx].MemberLoginNames[loginName] = true
+	}
+	return nil
+}
+
+// PurgeUser irrevocably deletes the deactivated user with the given login
+// name, including its change history.
+func (d *Database) PurgeUser(loginName string) error {
+	idx := slices.IndexFunc(d.DeactivatedUsers, func(u DeactivatedUser) bool { return u.User.LoginName == loginName })
+	if idx == -1 {
+		return fmt.Errorf("deactivated user %q does not exist", loginName)
+	}
+	d.DeactivatedUsers = slices.Delete(d.DeactivatedUsers, idx, idx+1)
+	d.dropUserHistory(loginName)
+	return nil
+}
+
+// PurgeExpiredUsers deletes all deactivated users whose retention period has
+// expired (like PurgeUser), and returns their login names.
+func (d *Database) PurgeExpiredUsers(now time.Time, cfg *ValidationConfig) (purged []string) {
+	today := now.Format(DateFormat)
+	d.DeactivatedUsers = slices.DeleteFunc(d.DeactivatedUsers, func(u DeactivatedUser) bool {
+		//both are in DateFormat, so they can be compared lexicographically
+		isExpired := u.PurgeDate(cfg.UserRetentionDays) <= today
+		if isExpired {
+			purged = append(purged, u.User.LoginName)
+		}
+		return isExpired
+	})
+	for _, loginName := range purged {
+		d.dropUserHistory(loginName)
+	}
+	return purged
+}
+
+func (d *Database) dropUserHistory(loginName string) {
+	d.UserHistory = slices.DeleteFunc(d.UserHistory, func(h ObjectHistory[User]) bool { return h.Name == loginName })
+}
+
+// RunUserPurge calls PurgeExpiredUsers() on the given nexus once when the
+// database has been loaded, and then once per hour, until `ctx` expires.
+func RunUserPurge(ctx context.Context, nexus Nexus) {
+	if !waitForInitialLoad(ctx, nexus) {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		purgeExpiredUsers(nexus)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeExpiredUsers(nexus Nexus) {
+	var purged []string
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		purged = db.PurgeExpiredUsers(time.Now(), nexus.ValidationConfig())
+		return nil
+	}, &UpdateOptions{Actor: Actor{Type: ActorTypeSystem, Name: "user purge"}})
+	for _, err := range errs {
+		logg.Error("could not purge deactivated users: %s", err.Error())
+	}
+	if errs.IsEmpty() && len(purged) > 0 {
+		logg.Info("purged deactivated users after end of retention period: %v", purged)
+	}
+}
@@ -0,0 +1,86 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestDeactivateAndRestoreUser(t *testing.T) {
+	cfg := GetValidationConfigForTests()
+	cfg.UserRetentionDays = 30
+	actor := Actor{Type: ActorTypeUser, Name: "admin"}
+	now := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	jane := User{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", ManagerLoginName: "john"}
+	db := Database{
+		Users: []User{jane, {LoginName: "john", GivenName: "John", FamilyName: "Doe"}},
+		Groups: []Group{
+			{Name: "admins", LongName: "Admins", MemberLoginNames: GroupMemberNames{"jane": true}},
+			{Name: "staff", LongName: "Staff", MemberLoginNames: GroupMemberNames{"jane": true, "john": true}},
+		},
+	}
+
+	//deactivating a user removes it, but remembers its memberships
+	err := db.DeactivateUser("jane", actor, now, cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db.Normalize()
+	assert.DeepEqual(t, "remaining users", len(db.Users), 1)
+	assert.DeepEqual(t, "admins members", db.Groups[0].MemberLoginNames, GroupMemberNames{})
+	jane.ManagerLoginName = ""
+	assert.DeepEqual(t, "deactivated users", db.DeactivatedUsers, []DeactivatedUser{{
+		User:          jane,
+		DeactivatedBy: actor,
+		DeactivatedAt: "2024-03-04",
+		GroupNames:    []string{"admins", "staff"},
+	}})
+	assert.DeepEqual(t, "purge date", db.DeactivatedUsers[0].PurgeDate(cfg.UserRetentionDays), "2024-04-03")
+
+	//the login name stays reserved
+	db.Users = append(db.Users, User{LoginName: "jane", GivenName: "Jane", FamilyName: "Smith"})
+	expectTheseErrors(t, db.Validate(cfg),
+		`field "login_name" in user "jane" belongs to a deactivated user (restore or purge that user first)`,
+	)
+	db.Users = db.Users[:1]
+
+	//restoring only adds the user back into the groups that still exist
+	err = db.DeleteGroup("admins")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = db.RestoreUser("jane")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db.Normalize()
+	assert.DeepEqual(t, "validation errors after restore", len(db.Validate(cfg)), 0)
+	assert.DeepEqual(t, "restored user", db.Users[0], jane)
+	assert.DeepEqual(t, "staff members", db.Groups[0].MemberLoginNames, GroupMemberNames{"jane": true, "john": true})
+	assert.DeepEqual(t, "deactivated users after restore", len(db.DeactivatedUsers), 0)
+
+	//deactivated users are purged once their retention period expires
+	err = db.DeactivateUser("jane", actor, now, cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "purged before expiry", db.PurgeExpiredUsers(now.AddDate(0, 0, 29), cfg), []string(nil))
+	assert.DeepEqual(t, "purged after expiry", db.PurgeExpiredUsers(now.AddDate(0, 0, 30), cfg), []string{"jane"})
+
+	//without retention, users are deleted right away
+	cfg.UserRetentionDays = 0
+	err = db.DeactivateUser("john", actor, now, cfg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "users after deletion", len(db.Users), 0)
+	assert.DeepEqual(t, "deactivated users after deletion", len(db.DeactivatedUsers), 0)
+}
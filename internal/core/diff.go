@@ -0,0 +1,76 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import "reflect"
+
+// DatabaseDiff describes the changes between two versions of a Database.
+type DatabaseDiff struct {
+	Users           ObjectDiff[User]
+	Groups          ObjectDiff[Group]
+	ServiceAccounts ObjectDiff[ServiceAccount]
+}
+
+// ObjectDiff describes the changes between two versions of an ObjectList.
+type ObjectDiff[T Object[T]] struct {
+	Created []T
+	Updated []ObjectUpdate[T]
+	Deleted []T
+}
+
+// ObjectUpdate appears in type ObjectDiff.
+type ObjectUpdate[T Object[T]] struct {
+	Old T
+	New T
+}
+
+// IsEmpty returns whether this diff does not contain any changes.
+func (d DatabaseDiff) IsEmpty() bool {
+	return d.Users.IsEmpty() && d.Groups.IsEmpty() && d.ServiceAccounts.IsEmpty()
+}
+
+// IsEmpty returns whether this diff does not contain any changes.
+func (d ObjectDiff[T]) IsEmpty() bool {
+	return len(d.Created) == 0 && len(d.Updated) == 0 && len(d.Deleted) == 0
+}
+
+// DiffDatabases computes the changes between two versions of a Database.
+// The objects in the result are deep clones of the respective inputs.
+func DiffDatabases(oldDB, newDB Database) DatabaseDiff {
+	return DatabaseDiff{
+		Users:           diffObjectLists(oldDB.Users, newDB.Users),
+		Groups:          diffObjectLists(oldDB.Groups, newDB.Groups),
+		ServiceAccounts: diffObjectLists(oldDB.ServiceAccounts, newDB.ServiceAccounts),
+	}
+}
+
+func diffObjectLists[T Object[T]](oldList, newList ObjectList[T]) (result ObjectDiff[T]) {
+	oldByKey := make(map[string]T, len(oldList))
+	for _, obj := range oldList {
+		oldByKey[obj.Key()] = obj
+	}
+	newKeys := make(map[string]bool, len(newList))
+	for _, newObj := range newList {
+		key := newObj.Key()
+		newKeys[key] = true
+		oldObj, exists := oldByKey[key]
+		switch {
+		case !exists:
+			result.Created = append(result.Created, newObj.Cloned())
+		case !reflect.DeepEqual(oldObj, newObj):
+			result.Updated = append(result.Updated, ObjectUpdate[T]{oldObj.Cloned(), newObj.Cloned()})
+		}
+	}
+
+	//iterate over `oldList` instead of `oldByKey` to get a deterministic order
+	for _, oldObj := range oldList {
+		if !newKeys[oldObj.Key()] {
+			result.Deleted = append(result.Deleted, oldObj.Cloned())
+		}
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/grammars"
+)
+
+// Besides the primary suffix from PORTUNUS_LDAP_SUFFIX, Portunus can maintain
+// users and groups below the additional suffixes from
+// PORTUNUS_LDAP_EXTRA_SUFFIXES. Each of these additional suffixes is a domain.
+// Domains are referred to by their DNS name (e.g. "example.com" for the suffix
+// "dc=example,dc=com"). Users and groups with an empty domain live below the
+// primary suffix.
+
+// DomainNameOfSuffix converts a suffix like "dc=example,dc=com" into the
+// domain name "example.com".
+func DomainNameOfSuffix(suffix string) string {
+	fields := strings.Split(suffix, ",")
+	for idx, field := range fields {
+		fields[idx] = strings.TrimPrefix(field, "dc=")
+	}
+	return strings.Join(fields, ".")
+}
+
+// SuffixOfDomainName is the inverse of DomainNameOfSuffix.
+func SuffixOfDomainName(domainName string) string {
+	return "dc=" + strings.ReplaceAll(domainName, ".", ",dc=")
+}
+
+var errUnknownDomain = errors.New("is not one of the domains from PORTUNUS_LDAP_EXTRA_SUFFIXES")
+
+// MustBeKnownDomain is a validation function. It accepts the empty string
+// (which refers to the primary suffix).
+func MustBeKnownDomain(domainName string, cfg *ValidationConfig) error {
+	if domainName != "" && !slices.Contains(cfg.Domains, domainName) {
+		return errUnknownDomain
+	}
+	return nil
+}
+
+func readDomainsFromEnvironment() ([]string, error) {
+	primarySuffix := os.Getenv("PORTUNUS_LDAP_SUFFIX")
+	var result []string
+	for _, suffix := range strings.Fields(os.Getenv("PORTUNUS_LDAP_EXTRA_SUFFIXES")) {
+		if !grammars.IsLDAPSuffix(suffix) {
+			return nil, fmt.Errorf("malformed suffix in PORTUNUS_LDAP_EXTRA_SUFFIXES: %q", suffix)
+		}
+		if suffix == primarySuffix {
+			return nil, fmt.Errorf("PORTUNUS_LDAP_EXTRA_SUFFIXES may not contain PORTUNUS_LDAP_SUFFIX (%q)", suffix)
+		}
+		name := DomainNameOfSuffix(suffix)
+		if slices.Contains(result, name) {
+			return nil, fmt.Errorf("duplicate suffix in PORTUNUS_LDAP_EXTRA_SUFFIXES: %q", suffix)
+		}
+		result = append(result, name)
+	}
+	slices.Sort(result)
+	return result, nil
+}
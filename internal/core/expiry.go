@@ -0,0 +1,89 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// ExpiryResult is returned by Database.ApplyExpiry.
+type ExpiryResult struct {
+	//Login names of users that were disabled.
+	DisabledUsers []string
+	//Memberships that were removed, as "<group name>/<login name>".
+	RemovedMemberships []string
+}
+
+// ApplyExpiry disables all users whose User.ValidUntil has passed, and removes
+// all group memberships whose Group.MemberValidUntil has passed. Expiry dates
+// are inclusive, i.e. a user that is valid until 2024-05-01 is disabled at the
+// start of 2024-05-02 (in the time zone of `now`).
+//
+// Expired users keep their ValidUntil, so that admins can see why they were
+// disabled. To enable such a user again, ValidUntil needs to be extended or
+// removed, otherwise the user will be disabled again right away.
+func (d *Database) ApplyExpiry(now time.Time) (result ExpiryResult) {
+	today := now.Format(DateFormat)
+	for idx, u := range d.Users {
+		//both are in DateFormat, so they can be compared lexicographically
+		if u.ValidUntil != "" && u.ValidUntil < today && !u.Disabled {
+			d.Users[idx].Disabled = true
+			result.DisabledUsers = append(result.DisabledUsers, u.LoginName)
+		}
+	}
+	for _, g := range d.Groups {
+		for loginName, validUntil := range g.MemberValidUntil {
+			if validUntil < today {
+				g.MemberLoginNames[loginName] = false
+				delete(g.MemberValidUntil, loginName)
+				result.RemovedMemberships = append(result.RemovedMemberships, g.Name+"/"+loginName)
+			}
+		}
+	}
+	slices.Sort(result.RemovedMemberships)
+	return result
+}
+
+// RunExpiry calls ApplyExpiry() on the given nexus once when the database
+// has been loaded, and then once per hour, until `ctx` expires.
+func RunExpiry(ctx context.Context, nexus Nexus) {
+	if !waitForInitialLoad(ctx, nexus) {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		applyExpiry(nexus)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func applyExpiry(nexus Nexus) {
+	var result ExpiryResult
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		result = db.ApplyExpiry(time.Now())
+		return nil
+	}, &UpdateOptions{Actor: Actor{Type: ActorTypeSystem, Name: "expiry"}})
+	for _, err := range errs {
+		logg.Error("could not apply expiry dates: %s", err.Error())
+	}
+	if errs.IsEmpty() && len(result.DisabledUsers) > 0 {
+		logg.Info("disabled users after their expiry date: %v", result.DisabledUsers)
+	}
+	if errs.IsEmpty() && len(result.RemovedMemberships) > 0 {
+		logg.Info("removed group memberships after their expiry date: %v", result.RemovedMemberships)
+	}
+}
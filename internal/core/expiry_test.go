@@ -0,0 +1,109 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestApplyExpiry(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", ValidUntil: "2024-05-01"},
+			{LoginName: "jim", GivenName: "Jim", FamilyName: "Doe", ValidUntil: "2024-05-02"},
+		}
+		db.Groups = []Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: GroupMemberNames{"jane": true, "john": true, "jim": true},
+			MemberValidUntil: map[string]string{"jane": "2024-05-01", "jim": "2024-06-01"},
+		}}
+		return nil
+	}, nil))
+
+	getUser := func(loginName string) User {
+		user, _ := nexus.FindUser(func(u User) bool { return u.LoginName == loginName })
+		return user.User
+	}
+	getGroup := func() Group {
+		group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "staff" })
+		return group
+	}
+	applyExpiry := func(now time.Time) (result ExpiryResult) {
+		expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+			result = db.ApplyExpiry(now)
+			return nil
+		}, nil))
+		return result
+	}
+
+	//expiry dates are inclusive
+	result := applyExpiry(time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC))
+	assert.DeepEqual(t, "result on last valid day", result, ExpiryResult{})
+	assert.DeepEqual(t, "john disabled on last valid day", getUser("john").Disabled, false)
+
+	result = applyExpiry(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC))
+	assert.DeepEqual(t, "result on next day", result, ExpiryResult{
+		DisabledUsers:      []string{"john"},
+		RemovedMemberships: []string{"staff/jane"},
+	})
+	assert.DeepEqual(t, "john disabled on next day", getUser("john").Disabled, true)
+	assert.DeepEqual(t, "john keeps expiry date", getUser("john").ValidUntil, "2024-05-01")
+	assert.DeepEqual(t, "jim disabled on next day", getUser("jim").Disabled, false)
+	assert.DeepEqual(t, "members on next day", getGroup().MemberLoginNames, GroupMemberNames{"john": true, "jim": true})
+	assert.DeepEqual(t, "member expiry on next day", getGroup().MemberValidUntil, map[string]string{"jim": "2024-06-01"})
+
+	//nothing happens twice
+	result = applyExpiry(time.Date(2024, 5, 2, 1, 0, 0, 0, time.UTC))
+	assert.DeepEqual(t, "result on repeated run", result, ExpiryResult{})
+
+	//expiry dates of removed members are dropped
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups[0].MemberLoginNames["jim"] = false
+		return nil
+	}, nil))
+	assert.DeepEqual(t, "member expiry after removal", getGroup().MemberValidUntil, map[string]string(nil))
+
+	//expiry dates are validated
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].ValidUntil = "next week"
+		return nil
+	}, nil)
+	assert.DeepEqual(t, "error for malformed date", errs.Join(", "), `field "valid_until" in user "jane" is not a valid date in the format YYYY-MM-DD`)
+}
+
+func TestRunExpiryAppliesRightAfterLoad(t *testing.T) {
+	nexus := NewNexus(nil, GetValidationConfigForTests(), &NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RunExpiry(ctx, nexus)
+	}()
+
+	//the first run waits for the database to be loaded, and then happens
+	//without waiting for the first tick
+	time.Sleep(10 * time.Millisecond)
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{{LoginName: "john", GivenName: "John", FamilyName: "Doe", ValidUntil: "2024-05-01"}}
+		return nil
+	}, nil))
+	time.Sleep(10 * time.Millisecond)
+	user, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "john disabled after load", user.Disabled, true)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,104 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// ExtraAttributes contains LDAP attributes of a user that Portunus does not
+// model natively, e.g. "employeeNumber". They are rendered into the user's
+// LDAP object as-is. Only attributes that are listed in
+// ValidationConfig.ExtraUserAttributes may appear here.
+type ExtraAttributes map[string]string
+
+// Cloned returns a deep copy of this map.
+func (a ExtraAttributes) Cloned() ExtraAttributes {
+	if len(a) == 0 {
+		return nil
+	}
+	return maps.Clone(a)
+}
+
+// Lines renders these attributes as a sorted list of "name=value" strings.
+func (a ExtraAttributes) Lines() []string {
+	return Labels(a).Lines()
+}
+
+func (a ExtraAttributes) validate(ref ObjectRef, cfg *ValidationConfig) (errs errext.ErrorSet) {
+	for _, name := range slices.Sorted(maps.Keys(a)) {
+		value := a[name]
+		fref := ref.Field("extra_attributes." + name)
+		if !slices.Contains(cfg.ExtraUserAttributes, name) {
+			errs.Add(fref.Wrap(errExtraAttributeNotAllowed))
+			continue
+		}
+		errs.Add(fref.WrapFirst(
+			MustNotBeEmpty(value),
+			MustNotHaveSurroundingSpaces(value),
+			mustBeSingleLine(value),
+		))
+	}
+	return
+}
+
+var (
+	errExtraAttributeNotAllowed = errors.New("is not allowed by PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES")
+	errMultipleLines            = errors.New("may not contain line breaks")
+)
+
+func mustBeSingleLine(val string) error {
+	if strings.ContainsAny(val, "\r\n") {
+		return errMultipleLines
+	}
+	return nil
+}
+
+// The attribute type names that may appear in PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES.
+// This is the "descr" syntax from RFC 4512, section 1.4.
+var extraAttributeNameRx = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// These attributes are generated by Portunus itself (see package ldap), so
+// they cannot be set through ExtraAttributes.
+var reservedUserAttributes = []string{
+	"cn", "gecos", "gidNumber", "givenName", "homeDirectory", "isMemberOf", "jpegPhoto", "loginShell", "mail",
+	"manager", "mobile", "objectClass", "portunusDisabled", "portunusLabel", "postalAddress", "sn", "sshPublicKey",
+	"telephoneNumber", "uid", "uidNumber", "userPassword",
+}
+
+func readExtraUserAttributesFromEnvironment() ([]string, error) {
+	return ParseExtraUserAttributes(os.Getenv("PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES"))
+}
+
+// ParseExtraUserAttributes parses the value of
+// PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES into a sorted list of attribute names.
+// This is also used by portunus-orchestrator to validate the value before
+// starting anything.
+func ParseExtraUserAttributes(input string) ([]string, error) {
+	names := strings.Fields(input)
+	for _, name := range names {
+		if !extraAttributeNameRx.MatchString(name) {
+			return nil, fmt.Errorf("malformed attribute name in PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES: %q", name)
+		}
+		for _, reserved := range reservedUserAttributes {
+			//LDAP attribute names are case-insensitive
+			if strings.EqualFold(name, reserved) {
+				return nil, fmt.Errorf("attribute %q in PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES is already managed by Portunus", name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
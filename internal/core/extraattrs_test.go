@@ -0,0 +1,67 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestValidateExtraAttributes(t *testing.T) {
+	cfg := GetValidationConfigForTests()
+	ref := User{LoginName: "jane"}.Ref()
+
+	expectNoErrors(t, ExtraAttributes{"employeeNumber": "42", "departmentNumber": "A-7"}.validate(ref, cfg))
+	expectTheseErrors(t, ExtraAttributes{"title": "CEO", "employeeNumber": " 42", "departmentNumber": "A\nB"}.validate(ref, cfg),
+		`field "extra_attributes.departmentNumber" in user "jane" may not contain line breaks`,
+		`field "extra_attributes.employeeNumber" in user "jane" may not start with a space character`,
+		`field "extra_attributes.title" in user "jane" is not allowed by PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES`,
+	)
+
+	t.Setenv("PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES", "employeeNumber departmentNumber employeeNumber")
+	names, err := readExtraUserAttributesFromEnvironment()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "attribute names", names, []string{"departmentNumber", "employeeNumber"})
+
+	for value, expected := range map[string]string{
+		"employeeNumber Mail": `attribute "Mail" in PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES is already managed by Portunus`,
+		"employee_number":     `malformed attribute name in PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES: "employee_number"`,
+	} {
+		t.Setenv("PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES", value)
+		_, err := readExtraUserAttributesFromEnvironment()
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected error %q for %q, but got %v", expected, value, err)
+		}
+	}
+}
+
+func TestSeededExtraAttributes(t *testing.T) {
+	//Seeded attributes are enforced, but other attributes are left alone.
+	var seed DatabaseSeed
+	err := json.Unmarshal([]byte(`{"users":[{"login_name":"jane","given_name":"Jane","family_name":"Doe","extra_attributes":{"employeeNumber":"42"}}]}`), &seed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hasher := &NoopHasher{}
+	db := Database{Users: []User{{
+		LoginName:       "jane",
+		GivenName:       "Jane",
+		FamilyName:      "Doe",
+		ExtraAttributes: ExtraAttributes{"employeeNumber": "23", "departmentNumber": "A-7"},
+	}}}
+
+	expectTheseErrors(t, seed.CheckConflicts(db, hasher),
+		`field "extra_attributes.employeeNumber" in user "jane" must be equal to the seeded value`,
+	)
+	seed.ApplyTo(&db, hasher)
+	assert.DeepEqual(t, "attributes after seeding", db.Users[0].ExtraAttributes, ExtraAttributes{"employeeNumber": "42", "departmentNumber": "A-7"})
+	expectNoErrors(t, seed.CheckConflicts(db, hasher))
+}
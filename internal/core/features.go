@@ -0,0 +1,110 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Feature is an optional subsystem of Portunus that can be switched on or off
+// in PORTUNUS_FEATURES, so that operators can roll out larger new subsystems
+// at their own pace.
+type Feature string
+
+const (
+	// FeatureAccessReviews enables access reviews (see type AccessReview).
+	FeatureAccessReviews Feature = "access-reviews"
+	// FeatureAdminAPI enables the admin API on the Unix socket that portunusctl uses.
+	FeatureAdminAPI Feature = "admin-api"
+	// FeatureJoinRequests enables join requests (see type JoinRequest).
+	FeatureJoinRequests Feature = "join-requests"
+)
+
+// AllFeatures lists all known features (sorted).
+var AllFeatures = []Feature{
+	FeatureAccessReviews,
+	FeatureAdminAPI,
+	FeatureJoinRequests,
+}
+
+// DefaultFeatures lists the features that are enabled unless disabled
+// explicitly in PORTUNUS_FEATURES (sorted). All features that were available
+// before PORTUNUS_FEATURES was introduced are on this list, so that upgrading
+// does not make them disappear. New features may start out disabled.
+var DefaultFeatures = []Feature{
+	FeatureAccessReviews,
+	FeatureAdminAPI,
+	FeatureJoinRequests,
+}
+
+// FeatureSet describes which features are enabled. The zero value has all
+// features disabled.
+type FeatureSet struct {
+	enabled []Feature //sorted
+}
+
+// NewFeatureSet builds a FeatureSet where exactly the given features are
+// enabled. This is intended for tests; in production, use
+// ReadFeatureSetFromEnvironment() instead.
+func NewFeatureSet(features ...Feature) FeatureSet {
+	enabled := slices.Clone(features)
+	slices.Sort(enabled)
+	return FeatureSet{slices.Compact(enabled)}
+}
+
+// ParseFeatureSet parses a space-separated list of changes to
+// DefaultFeatures, as found in PORTUNUS_FEATURES: A feature name enables that
+// feature, and a feature name with a "-" prefix disables it.
+func ParseFeatureSet(input string) (FeatureSet, error) {
+	features := slices.Clone(DefaultFeatures)
+	for _, word := range strings.Fields(input) {
+		name, isDisable := strings.CutPrefix(word, "-")
+		feature := Feature(name)
+		if !slices.Contains(AllFeatures, feature) {
+			return FeatureSet{}, fmt.Errorf("unknown feature %q (known features are: %s)", name, FeatureSet{AllFeatures}.String())
+		}
+		if isDisable {
+			features = slices.DeleteFunc(features, func(f Feature) bool { return f == feature })
+		} else {
+			features = append(features, feature)
+		}
+	}
+	return NewFeatureSet(features...), nil
+}
+
+// ReadFeatureSetFromEnvironment builds a FeatureSet from PORTUNUS_FEATURES.
+func ReadFeatureSetFromEnvironment() (FeatureSet, error) {
+	fs, err := ParseFeatureSet(os.Getenv("PORTUNUS_FEATURES"))
+	if err != nil {
+		return FeatureSet{}, fmt.Errorf("malformed environment variable PORTUNUS_FEATURES: %w", err)
+	}
+	return fs, nil
+}
+
+// IsEnabled returns whether the given feature is enabled.
+func (fs FeatureSet) IsEnabled(f Feature) bool {
+	_, found := slices.BinarySearch(fs.enabled, f)
+	return found
+}
+
+// List returns all enabled features (sorted).
+func (fs FeatureSet) List() []Feature {
+	return slices.Clone(fs.enabled)
+}
+
+// String returns the enabled features as a space-separated list, in the same
+// format that ParseFeatureSet() accepts.
+func (fs FeatureSet) String() string {
+	names := make([]string, len(fs.enabled))
+	for idx, f := range fs.enabled {
+		names[idx] = string(f)
+	}
+	return strings.Join(names, " ")
+}
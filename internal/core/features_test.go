@@ -0,0 +1,52 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestParseFeatureSet(t *testing.T) {
+	//by default, all features that existed before PORTUNUS_FEATURES are enabled
+	fs, err := ParseFeatureSet("")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, f := range AllFeatures {
+		assert.DeepEqual(t, "IsEnabled("+string(f)+")", fs.IsEnabled(f), true)
+	}
+	assert.DeepEqual(t, "String()", fs.String(), "access-reviews admin-api join-requests")
+
+	//features can be disabled in any order, and duplicates are ignored
+	fs, err = ParseFeatureSet(" -join-requests -admin-api\t-join-requests ")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "IsEnabled(access-reviews)", fs.IsEnabled(FeatureAccessReviews), true)
+	assert.DeepEqual(t, "IsEnabled(admin-api)", fs.IsEnabled(FeatureAdminAPI), false)
+	assert.DeepEqual(t, "IsEnabled(join-requests)", fs.IsEnabled(FeatureJoinRequests), false)
+	assert.DeepEqual(t, "List()", fs.List(), []Feature{FeatureAccessReviews})
+	assert.DeepEqual(t, "String()", fs.String(), "access-reviews")
+
+	//later words override earlier ones, and enabling a default feature is a no-op
+	fs, err = ParseFeatureSet("-access-reviews access-reviews join-requests")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "String()", fs.String(), "access-reviews admin-api join-requests")
+
+	//unknown features are rejected
+	_, err = ParseFeatureSet("access-reviews -time-travel")
+	if err == nil {
+		t.Error("expected unknown feature to be rejected, but got no error")
+	} else {
+		assert.DeepEqual(t, "error message", err.Error(),
+			`unknown feature "time-travel" (known features are: access-reviews admin-api join-requests)`)
+	}
+}
@@ -8,6 +8,10 @@ package core
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,11 +23,73 @@ import (
 // Group represents a single group of users. Membership in a group implicitly
 // grants its Permissions to all users in that group.
 type Group struct {
-	Name             string           `json:"name"`
-	LongName         string           `json:"long_name"`
+	Name     string `json:"name"`
+	LongName string `json:"long_name"`
+	//Domain works like the field of the same name on type User.
+	Domain           string           `json:"domain,omitempty"`
 	MemberLoginNames GroupMemberNames `json:"members"`
+	//Groups whose members are also members of this group. Nesting can be
+	//arbitrarily deep, but must not contain cycles.
+	MemberGroupNames GroupMemberNames `json:"member_groups,omitempty"`
 	Permissions      Permissions      `json:"permissions"`
 	PosixGID         *PosixID         `json:"posix_gid,omitempty"`
+
+	//Optional metadata that tells admins whom to talk to about this group.
+	EMailAddress   string `json:"email,omitempty"`
+	OwnerLoginName string `json:"owner,omitempty"`
+	Notes          string `json:"notes,omitempty"`
+
+	//Which new users will be added to this group automatically.
+	DefaultMembership DefaultMembershipRules `json:"default_membership,omitzero"`
+	//Whether users can request to join this group through the UI.
+	IsJoinable bool `json:"joinable,omitempty"`
+	//If true, this group is not rendered into the LDAP directory. This is
+	//useful for groups that only grant permissions, since these permissions
+	//still apply to the group's members.
+	IsHiddenFromLDAP bool `json:"hidden_from_ldap,omitempty"`
+
+	Labels Labels `json:"labels,omitempty"`
+	//Names that this group had before it was renamed (see
+	//Database.RenameGroup), oldest first.
+	FormerNames []FormerName `json:"former_names,omitempty"`
+	//For temporary members, the last day (in DateFormat) on which they are a
+	//member. Afterwards, they are removed from the group automatically (see
+	//RunExpiry). Keys are login names. Entries for users that are not members
+	//are dropped by Database.Normalize().
+	MemberValidUntil map[string]string `json:"member_valid_until,omitempty"`
+}
+
+// DefaultMembershipRules appears in type Group. The rules are evaluated once
+// when a user is created (either through the UI or through the admin API), and
+// the new user is added to the group if any of the rules match.
+type DefaultMembershipRules struct {
+	ForAllUsers bool `json:"all_users,omitempty"`
+	//Matches users whose email address is in one of these domains.
+	ForEMailDomains []string `json:"email_domains,omitempty"`
+}
+
+// IsEmpty returns whether no rules are configured.
+func (r DefaultMembershipRules) IsEmpty() bool {
+	return !r.ForAllUsers && len(r.ForEMailDomains) == 0
+}
+
+// Matches returns whether a new user with the given attributes shall be added
+// to the group.
+func (r DefaultMembershipRules) Matches(u User) bool {
+	if r.ForAllUsers {
+		return true
+	}
+	idx := strings.LastIndex(u.EMailAddress, "@")
+	if idx < 0 {
+		return false
+	}
+	domain := u.EMailAddress[idx+1:]
+	for _, d := range r.ForEMailDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
 }
 
 // Key implements the Object interface.
@@ -40,18 +106,82 @@ func (g Group) Cloned() Group {
 			g.MemberLoginNames[name] = true
 		}
 	}
+	groupNames := g.MemberGroupNames
+	g.MemberGroupNames = nil
+	for name, isMember := range groupNames {
+		if isMember {
+			if g.MemberGroupNames == nil {
+				g.MemberGroupNames = make(GroupMemberNames)
+			}
+			g.MemberGroupNames[name] = true
+		}
+	}
+	if g.Permissions.LDAP.ReadGroupNames != nil {
+		g.Permissions.LDAP.ReadGroupNames = maps.Clone(g.Permissions.LDAP.ReadGroupNames)
+	}
 	if g.PosixGID != nil {
 		val := *g.PosixGID
 		g.PosixGID = &val
 	}
+	if g.DefaultMembership.ForEMailDomains != nil {
+		g.DefaultMembership.ForEMailDomains = slices.Clone(g.DefaultMembership.ForEMailDomains)
+	}
+	g.Labels = g.Labels.Cloned()
+	g.FormerNames = slices.Clone(g.FormerNames)
+	g.MemberValidUntil = maps.Clone(g.MemberValidUntil)
 	return g
 }
 
-// ContainsUser checks whether this group contains the given user.
+// ContainsUser checks whether this group contains the given user. Only direct
+// memberships are considered, unless the group was obtained from
+// ResolveNestedGroups().
 func (g Group) ContainsUser(u User) bool {
 	return g.MemberLoginNames[u.LoginName]
 }
 
+// ResolveNestedGroups returns clones of the given groups, with the members of
+// all nested groups (see Group.MemberGroupNames) added to MemberLoginNames.
+// Cycles and references to unknown groups are rejected by
+// Database.Validate(), but are tolerated here.
+func ResolveNestedGroups(groups []Group) []Group {
+	byName := make(map[string]Group, len(groups))
+	for _, g := range groups {
+		byName[g.Name] = g
+	}
+
+	result := make([]Group, len(groups))
+	for idx, g := range groups {
+		result[idx] = g.Cloned()
+		isVisited := map[string]bool{g.Name: true}
+		var stack []string
+		for name, isMember := range g.MemberGroupNames {
+			if isMember {
+				stack = append(stack, name)
+			}
+		}
+		for len(stack) > 0 {
+			name := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			nested, exists := byName[name]
+			if isVisited[name] || !exists {
+				continue
+			}
+			isVisited[name] = true
+			for loginName, isMember := range nested.MemberLoginNames {
+				if isMember {
+					result[idx].MemberLoginNames[loginName] = true
+				}
+			}
+			for nestedName, isMember := range nested.MemberGroupNames {
+				if isMember {
+					stack = append(stack, nestedName)
+				}
+			}
+		}
+	}
+	return result
+}
+
 // GroupMemberNames is the type of Group.MemberLoginNames.
 type GroupMemberNames map[string]bool
 
@@ -104,9 +234,48 @@ func (g Group) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		MustNotBeEmpty(g.LongName),
 		MustNotHaveSurroundingSpaces(g.LongName),
 	))
+	errs.Add(ref.Field("domain").Wrap(MustBeKnownDomain(g.Domain, cfg)))
+	errs.Add(ref.Field("email").Wrap(MustNotHaveSurroundingSpaces(g.EMailAddress)))
+	errs.Add(ref.Field("notes").Wrap(MustNotHaveSurroundingSpaces(g.Notes)))
+	errs.Add(ref.Field("ldap_write_subtree").Wrap(mustBeSubtreeName(g.Permissions.LDAP.WriteSubtree)))
+	errs.Append(g.Labels.validate(ref.Field("labels")))
+	for _, loginName := range slices.Sorted(maps.Keys(g.MemberValidUntil)) {
+		err := mustBeDate(g.MemberValidUntil[loginName])
+		if err != nil {
+			errs.Add(ref.Field("member_valid_until").Wrap(fmt.Errorf("%w (found %q for %q)", err, g.MemberValidUntil[loginName], loginName)))
+		}
+	}
+	for _, domain := range g.DefaultMembership.ForEMailDomains {
+		errs.Add(ref.Field("default_email_domains").WrapFirst(
+			MustNotBeEmpty(domain),
+			mustBeEMailDomain(domain),
+		))
+	}
 	return
 }
 
+var (
+	errMalformedEMailDomain = errors.New("must contain domain names without spaces or \"@\"")
+	errMalformedSubtreeName = errors.New("may only contain lowercase letters, digits and dashes")
+)
+
+func mustBeSubtreeName(val string) error {
+	//the subtree name ends up in an RDN and in the slapd ACLs, so we are very strict here
+	for _, r := range val {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return errMalformedSubtreeName
+		}
+	}
+	return nil
+}
+
+func mustBeEMailDomain(val string) error {
+	if strings.ContainsAny(val, "@ \t\r\n") {
+		return errMalformedEMailDomain
+	}
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // PosixID represents a POSIX user or group ID.
@@ -0,0 +1,321 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/majewsky/portunus/internal/envconfig"
+)
+
+// DefaultHistoryDepth is the default for ValidationConfig.HistoryDepth.
+const DefaultHistoryDepth = 10
+
+func readHistoryDepthFromEnvironment() (uint, error) {
+	return envconfig.GetUint("PORTUNUS_HISTORY_DEPTH", DefaultHistoryDepth)
+}
+
+// Revision is a version of a user or group, as recorded in ObjectHistory.
+type Revision[T Object[T]] struct {
+	//Counts up from 1 for each object.
+	Number uint `json:"number"`
+	//When and by whom this version was created, in RFC 3339 format (UTC).
+	//Both are empty for the version that existed before the history of the
+	//object was first recorded.
+	ChangedAt string `json:"changed_at,omitempty"`
+	ChangedBy Actor  `json:"changed_by,omitzero"`
+	//The object as it was after this change, or nil if the object was deleted
+	//by this change. Secrets like password hashes are not recorded.
+	Object *T `json:"object,omitempty"`
+}
+
+// Cloned returns a deep copy of this object.
+func (r Revision[T]) Cloned() Revision[T] {
+	if r.Object != nil {
+		obj := (*r.Object).Cloned()
+		r.Object = &obj
+	}
+	return r
+}
+
+// ObjectHistory holds the most recent revisions of a single user or group
+// (see ValidationConfig.HistoryDepth). Histories are recorded by the Nexus
+// and survive the deletion of their object, so deleted objects can be
+// restored from them.
+type ObjectHistory[T Object[T]] struct {
+	Name string `json:"name"`
+	//Oldest first.
+	Revisions []Revision[T] `json:"revisions"`
+}
+
+// Cloned returns a deep copy of this object.
+func (h ObjectHistory[T]) Cloned() ObjectHistory[T] {
+	revisions := make([]Revision[T], len(h.Revisions))
+	for idx, r := range h.Revisions {
+		revisions[idx] = r.Cloned()
+	}
+	h.Revisions = revisions
+	return h
+}
+
+// FindRevision returns the revision with the given number, if it is still
+// retained.
+func (h ObjectHistory[T]) FindRevision(number uint) (Revision[T], bool) {
+	for _, r := range h.Revisions {
+		if r.Number == number {
+			return r.Cloned(), true
+		}
+	}
+	return Revision[T]{}, false
+}
+
+// FieldChange appears in the result of ObjectHistory.ChangesIn().
+type FieldChange struct {
+	//As in the database file, e.g. "given_name".
+	Field string
+	//In JSON format, or empty if the field (or the whole object) was absent.
+	OldValue string
+	NewValue string
+}
+
+// ChangesIn describes the changes between the given revision and its
+// predecessor on the level of individual fields. For the oldest retained
+// revision, all fields are reported as new.
+func (h ObjectHistory[T]) ChangesIn(number uint) []FieldChange {
+	idx := slices.IndexFunc(h.Revisions, func(r Revision[T]) bool { return r.Number == number })
+	if idx == -1 {
+		return nil
+	}
+	var oldFields map[string]string
+	if idx > 0 {
+		oldFields = fieldsOf(h.Revisions[idx-1].Object)
+	}
+	newFields := fieldsOf(h.Revisions[idx].Object)
+
+	keys := make(map[string]bool)
+	for key := range oldFields {
+		keys[key] = true
+	}
+	for key := range newFields {
+		keys[key] = true
+	}
+	var result []FieldChange
+	for key := range keys {
+		if oldFields[key] != newFields[key] {
+			result = append(result, FieldChange{key, oldFields[key], newFields[key]})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Field < result[j].Field })
+	return result
+}
+
+func fieldsOf[T Object[T]](obj *T) map[string]string {
+	if obj == nil {
+		return nil
+	}
+	//going through JSON gives the same field names as in the database file
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(buf, &fields)
+	if err != nil {
+		return nil
+	}
+	result := make(map[string]string, len(fields))
+	for key, value := range fields {
+		result[key] = string(value)
+	}
+	return result
+}
+
+// recordHistory appends the changes in the given diff to the histories in
+// this database, and drops the oldest revisions beyond the given depth.
+func (d *Database) recordHistory(diff DatabaseDiff, actor Actor, now time.Time, depth uint) {
+	changedAt := now.UTC().Format(time.RFC3339)
+	//a rename shows up in the diff as a deletion of the old name and a creation
+	//of the new name, but the history has already been moved to the new name
+	//by RenameUser() or RenameGroup()
+	diff.Users.Deleted = withoutRenamed(diff.Users, func(u User) []FormerName { return u.FormerLoginNames })
+	diff.Groups.Deleted = withoutRenamed(diff.Groups, func(g Group) []FormerName { return g.FormerNames })
+	d.UserHistory = recordRevisions(d.UserHistory, diff.Users, actor, changedAt, depth, stripUserSecrets)
+	d.GroupHistory = recordRevisions(d.GroupHistory, diff.Groups, actor, changedAt, depth, func(g Group) Group { return g })
+}
+
+func withoutRenamed[T Object[T]](diff ObjectDiff[T], formerNames func(T) []FormerName) []T {
+	renamedFrom := make(map[string]bool)
+	for _, obj := range diff.Created {
+		if name := lastFormerName(formerNames(obj)); name != "" {
+			renamedFrom[name] = true
+		}
+	}
+	if len(renamedFrom) == 0 {
+		return diff.Deleted
+	}
+	var result []T
+	for _, obj := range diff.Deleted {
+		if !renamedFrom[obj.Key()] {
+			result = append(result, obj)
+		}
+	}
+	return result
+}
+
+func stripUserSecrets(u User) User {
+	u.PasswordHash = ""
+	u.TOTPKeyURL = ""
+	return u
+}
+
+func recordRevisions[T Object[T]](histories []ObjectHistory[T], diff ObjectDiff[T], actor Actor, changedAt string, depth uint, strip func(T) T) []ObjectHistory[T] {
+	indexByName := make(map[string]int, len(histories))
+	for idx, h := range histories {
+		indexByName[h.Name] = idx
+	}
+	record := func(name string, oldObj, newObj *T) {
+		idx, exists := indexByName[name]
+		if !exists {
+			idx = len(histories)
+			indexByName[name] = idx
+			histories = append(histories, ObjectHistory[T]{Name: name})
+		}
+		h := &histories[idx]
+
+		//without a previous revision, the previous version becomes the baseline
+		//to diff against
+		if len(h.Revisions) == 0 && oldObj != nil {
+			h.Revisions = append(h.Revisions, Revision[T]{Number: 1, Object: oldObj})
+		}
+		if len(h.Revisions) > 0 && reflect.DeepEqual(h.Revisions[len(h.Revisions)-1].Object, newObj) {
+			//nothing changed apart from secrets
+			return
+		}
+		var number uint = 1
+		if len(h.Revisions) > 0 {
+			number = h.Revisions[len(h.Revisions)-1].Number + 1
+		}
+		h.Revisions = append(h.Revisions, Revision[T]{number, changedAt, actor, newObj})
+		if excess := len(h.Revisions) - int(depth); excess > 0 {
+			h.Revisions = slices.Delete(h.Revisions, 0, excess)
+		}
+	}
+	stripped := func(obj T) *T {
+		result := strip(obj.Cloned())
+		return &result
+	}
+
+	for _, obj := range diff.Created {
+		record(obj.Key(), nil, stripped(obj))
+	}
+	for _, upd := range diff.Updated {
+		record(upd.New.Key(), stripped(upd.Old), stripped(upd.New))
+	}
+	for _, obj := range diff.Deleted {
+		record(obj.Key(), stripped(obj), nil)
+	}
+	return histories
+}
+
+// RevertUser replaces the user with the given login name with the given
+// revision from its history, or recreates it if it has been deleted. The
+// current password hash and second factor of the user are retained.
+func (d *Database) RevertUser(loginName string, number uint) error {
+	target, err := findRevisionForRevert(d.UserHistory, "user", loginName, number)
+	if err != nil {
+		return err
+	}
+	idx := slices.IndexFunc(d.Users, func(u User) bool { return u.LoginName == loginName })
+	if idx == -1 {
+		d.Users = append(d.Users, target)
+		return nil
+	}
+	target.PasswordHash = d.Users[idx].PasswordHash
+	target.TOTPKeyURL = d.Users[idx].TOTPKeyURL
+	d.Users[idx] = target
+	return nil
+}
+
+// RevertGroup replaces the group with the given name with the given revision
+// from its history, or recreates it if it has been deleted. Members that do
+// not exist anymore are left out.
+func (d *Database) RevertGroup(name string, number uint) error {
+	target, err := findRevisionForRevert(d.GroupHistory, "group", name, number)
+	if err != nil {
+		return err
+	}
+	for loginName := range target.MemberLoginNames {
+		if _, exists := d.Users.Find(func(u User) bool { return u.LoginName == loginName }); !exists {
+			delete(target.MemberLoginNames, loginName)
+		}
+	}
+	for groupName := range target.MemberGroupNames {
+		if _, exists := d.Groups.Find(func(g Group) bool { return g.Name == groupName }); !exists {
+			delete(target.MemberGroupNames, groupName)
+		}
+	}
+
+	idx := slices.IndexFunc(d.Groups, func(g Group) bool { return g.Name == name })
+	if idx == -1 {
+		d.Groups = append(d.Groups, target)
+	} else {
+		d.Groups[idx] = target
+	}
+	return nil
+}
+
+func findRevisionForRevert[T Object[T]](histories []ObjectHistory[T], objectType, name string, number uint) (T, error) {
+	var zero T
+	idx := slices.IndexFunc(histories, func(h ObjectHistory[T]) bool { return h.Name == name })
+	if idx == -1 {
+		return zero, fmt.Errorf("no history recorded for %s %q", objectType, name)
+	}
+	r, exists := histories[idx].FindRevision(number)
+	switch {
+	case !exists:
+		return zero, fmt.Errorf("revision %d of %s %q does not exist (anymore)", number, objectType, name)
+	case r.Object == nil:
+		return zero, fmt.Errorf("cannot revert to revision %d of %s %q, since that revision deleted it", number, objectType, name)
+	default:
+		return *r.Object, nil
+	}
+}
+
+func findHistory[T Object[T]](histories []ObjectHistory[T], name string) (ObjectHistory[T], bool) {
+	for _, h := range histories {
+		if h.Name == name {
+			return h.Cloned(), true
+		}
+	}
+	return ObjectHistory[T]{}, false
+}
+
+// cloneHistories is used by Database.Cloned().
+func cloneHistories[T Object[T]](histories []ObjectHistory[T]) []ObjectHistory[T] {
+	if histories == nil {
+		return nil
+	}
+	result := make([]ObjectHistory[T], len(histories))
+	for idx, h := range histories {
+		result[idx] = h.Cloned()
+	}
+	return result
+}
+
+// normalizeHistories is used by Database.Normalize().
+func normalizeHistories[T Object[T]](histories []ObjectHistory[T]) []ObjectHistory[T] {
+	if len(histories) == 0 {
+		return nil
+	}
+	sort.Slice(histories, func(i, j int) bool { return histories[i].Name < histories[j].Name })
+	return histories
+}
@@ -0,0 +1,105 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestHistoryAndRevert(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	vcfg.HistoryDepth = 3
+	nexus := NewNexus(nil, vcfg, &NoopHasher{})
+	admin := &UpdateOptions{Actor: Actor{Type: ActorTypeUser, Name: "admin"}}
+
+	//the initial load is not recorded
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "first"}}
+		db.Groups = []Group{{Name: "staff", LongName: "Staff", MemberLoginNames: GroupMemberNames{"jane": true}}}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	_, exists := nexus.FindUserHistory("jane")
+	assert.DeepEqual(t, "history exists after initial load", exists, false)
+
+	//the first change records the previous version as a baseline
+	setFamilyName := func(name string) UpdateAction {
+		return func(db *Database) errext.ErrorSet {
+			db.Users[0].FamilyName = name
+			return nil
+		}
+	}
+	expectNoErrors(t, nexus.Update(setFamilyName("Smith"), admin))
+	history, _ := nexus.FindUserHistory("jane")
+	assert.DeepEqual(t, "revision count", len(history.Revisions), 2)
+	assert.DeepEqual(t, "baseline revision", history.Revisions[0], Revision[User]{
+		Number: 1,
+		Object: &User{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+	})
+	assert.DeepEqual(t, "actor of revision 2", history.Revisions[1].ChangedBy, admin.Actor)
+	assert.DeepEqual(t, "changes in revision 2", history.ChangesIn(2), []FieldChange{
+		{Field: "family_name", OldValue: `"Doe"`, NewValue: `"Smith"`},
+	})
+
+	//password changes do not show up in the history
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].PasswordHash = "second"
+		return nil
+	}, admin))
+	history, _ = nexus.FindUserHistory("jane")
+	assert.DeepEqual(t, "revision count after password change", len(history.Revisions), 2)
+
+	//only the configured number of revisions is retained
+	expectNoErrors(t, nexus.Update(setFamilyName("Miller"), admin))
+	expectNoErrors(t, nexus.Update(setFamilyName("Jones"), admin))
+	history, _ = nexus.FindUserHistory("jane")
+	numbers := []uint{}
+	for _, r := range history.Revisions {
+		numbers = append(numbers, r.Number)
+	}
+	assert.DeepEqual(t, "retained revisions", numbers, []uint{2, 3, 4})
+
+	//reverting keeps the current password hash
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		var errs errext.ErrorSet
+		errs.Add(db.RevertUser("jane", 2))
+		return errs
+	}, admin))
+	user, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "reverted family name", user.User.FamilyName, "Smith")
+	assert.DeepEqual(t, "password hash after revert", user.User.PasswordHash, "second")
+
+	//deleted groups can be restored from their history
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		var errs errext.ErrorSet
+		errs.Add(db.DeleteGroup("staff"))
+		return errs
+	}, admin))
+	groupHistory, _ := nexus.FindGroupHistory("staff")
+	assert.DeepEqual(t, "changes in deletion", groupHistory.ChangesIn(2), []FieldChange{
+		{Field: "long_name", OldValue: `"Staff"`},
+		{Field: "members", OldValue: `["jane"]`},
+		{Field: "name", OldValue: `"staff"`},
+		{Field: "permissions", OldValue: `{"portunus":{"is_admin":false},"ldap":{"can_read":false}}`},
+	})
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		var errs errext.ErrorSet
+		errs.Add(db.RevertGroup("staff", 2))
+		return errs
+	}, admin)
+	expectTheseErrors(t, errs, `cannot revert to revision 2 of group "staff", since that revision deleted it`)
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		var errs errext.ErrorSet
+		errs.Add(db.RevertGroup("staff", 1))
+		return errs
+	}, admin))
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "restored group members", group.MemberLoginNames, GroupMemberNames{"jane": true})
+}
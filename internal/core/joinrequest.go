@@ -0,0 +1,125 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// JoinRequest is a request by a user to be added to a joinable group. The
+// request is decided on by the owner of the group (or by the admins, if the
+// group does not have an owner).
+//
+// There is at most one JoinRequest per group and user. When a user requests to
+// join the same group again (e.g. after a rejection), the previous request is
+// replaced.
+type JoinRequest struct {
+	GroupName   string           `json:"group"`
+	LoginName   string           `json:"user"`
+	Comment     string           `json:"comment,omitempty"`
+	RequestedAt string           `json:"requested_at"` //in DateFormat
+	State       JoinRequestState `json:"state,omitempty"`
+	DecidedBy   string           `json:"decided_by,omitempty"`
+	DecidedAt   string           `json:"decided_at,omitempty"` //in DateFormat
+}
+
+// JoinRequestState is an enum that appears in type JoinRequest.
+type JoinRequestState string
+
+const (
+	// JoinRequestPending is the initial state of each JoinRequest.
+	JoinRequestPending JoinRequestState = ""
+	// JoinRequestApproved denotes that the user was added to the group.
+	JoinRequestApproved JoinRequestState = "approved"
+	// JoinRequestRejected denotes that the user was not added to the group.
+	JoinRequestRejected JoinRequestState = "rejected"
+)
+
+// Ref returns an ObjectRef that can be used to build validation errors.
+func (r JoinRequest) Ref() ObjectRef {
+	return ObjectRef{
+		Type: "join request",
+		Name: r.LoginName + " -> " + r.GroupName,
+	}
+}
+
+func (r JoinRequest) validate() (errs errext.ErrorSet) {
+	//NOTE: Requests may refer to groups that have been deleted since the request
+	//was made. This is not an error since it does not break anything.
+	ref := r.Ref()
+	errs.Add(ref.Field("comment").Wrap(MustNotHaveSurroundingSpaces(r.Comment)))
+	errs.Add(ref.Field("requested_at").WrapFirst(
+		MustNotBeEmpty(r.RequestedAt),
+		mustBeDate(r.RequestedAt),
+	))
+	switch r.State {
+	case JoinRequestPending, JoinRequestApproved, JoinRequestRejected:
+	default:
+		errs.Add(ref.Field("state").Wrap(fmt.Errorf("contains invalid value %q", r.State)))
+	}
+	return errs
+}
+
+// RequestGroupJoin records a request by the given user to join the given group.
+func (d *Database) RequestGroupJoin(groupName, loginName, comment string, now time.Time) error {
+	group, exists := d.Groups.Find(func(g Group) bool { return g.Name == groupName })
+	if !exists || !group.IsJoinable {
+		return fmt.Errorf("group %q does not accept join requests", groupName)
+	}
+	if group.MemberLoginNames[loginName] {
+		return fmt.Errorf("user %q is already a member of group %q", loginName, groupName)
+	}
+
+	request := JoinRequest{
+		GroupName:   groupName,
+		LoginName:   loginName,
+		Comment:     comment,
+		RequestedAt: now.Format(DateFormat),
+	}
+	for idx, r := range d.JoinRequests {
+		if r.GroupName != groupName || r.LoginName != loginName {
+			continue
+		}
+		if r.State == JoinRequestPending {
+			return fmt.Errorf("user %q has already requested to join group %q", loginName, groupName)
+		}
+		d.JoinRequests[idx] = request
+		return nil
+	}
+	d.JoinRequests = append(d.JoinRequests, request)
+	return nil
+}
+
+// DecideJoinRequest approves or rejects the pending request by the given user
+// to join the given group. If the request is approved, the user is added to
+// the group.
+func (d *Database) DecideJoinRequest(groupName, loginName string, state JoinRequestState, decidedBy string, now time.Time) error {
+	for idx, r := range d.JoinRequests {
+		if r.GroupName != groupName || r.LoginName != loginName || r.State != JoinRequestPending {
+			continue
+		}
+		d.JoinRequests[idx].State = state
+		d.JoinRequests[idx].DecidedBy = decidedBy
+		d.JoinRequests[idx].DecidedAt = now.Format(DateFormat)
+		if state == JoinRequestApproved {
+			for gidx, group := range d.Groups {
+				if group.Name != groupName {
+					continue
+				}
+				if group.MemberLoginNames == nil {
+					d.Groups[gidx].MemberLoginNames = make(GroupMemberNames)
+				}
+				d.Groups[gidx].MemberLoginNames[loginName] = true
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("user %q does not have a pending request to join group %q", loginName, groupName)
+}
@@ -0,0 +1,110 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// Labels are free-form key-value pairs that can be attached to users and
+// groups for use by automation, e.g. "cost-center=1234". Portunus itself does
+// not assign any meaning to them.
+type Labels map[string]string
+
+// Cloned returns a deep copy of this map.
+func (l Labels) Cloned() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+	return maps.Clone(l)
+}
+
+// Lines renders these labels as a sorted list of "key=value" strings.
+func (l Labels) Lines() []string {
+	result := make([]string, 0, len(l))
+	for _, key := range slices.Sorted(maps.Keys(l)) {
+		result = append(result, key+"="+l[key])
+	}
+	return result
+}
+
+// Matches returns whether these labels match the given selector. The selector
+// is either "key=value" (a label with this key and value must exist) or just
+// "key" (a label with this key must exist, regardless of its value).
+func (l Labels) Matches(selector string) bool {
+	key, value, hasValue := strings.Cut(selector, "=")
+	actualValue, exists := l[key]
+	if !hasValue {
+		return exists
+	}
+	return exists && actualValue == value
+}
+
+// MatchesAll returns whether these labels match all of the given selectors.
+// See Matches() for the selector syntax.
+func (l Labels) MatchesAll(selectors []string) bool {
+	for _, selector := range selectors {
+		if !l.Matches(selector) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLabels parses labels from a list of "key=value" lines, as entered in
+// the UI. Empty lines are ignored. If the parse fails, a ValidationError is
+// returned, using the provided FieldRef.
+func ParseLabels(input string, ref FieldRef) (Labels, error) {
+	var result Labels
+	for idx, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			err := fmt.Errorf("must have a label of the form key=value on each line (parse error on line %d)", idx+1)
+			return nil, ref.Wrap(err)
+		}
+		key = strings.TrimSpace(key)
+		if _, exists := result[key]; exists {
+			return nil, ref.Wrap(fmt.Errorf("contains the label %q multiple times", key))
+		}
+		if result == nil {
+			result = make(Labels)
+		}
+		result[key] = strings.TrimSpace(value)
+	}
+	return result, nil
+}
+
+var (
+	labelKeyRx           = regexp.MustCompile(`^[a-z0-9]([a-z0-9./_-]*[a-z0-9])?$`)
+	errMalformedLabelKey = errors.New("must have label keys consisting of lowercase letters, digits, dots, slashes, underscores and dashes, starting and ending with a letter or digit")
+)
+
+func (l Labels) validate(ref FieldRef) (errs errext.ErrorSet) {
+	for _, key := range slices.Sorted(maps.Keys(l)) {
+		if !labelKeyRx.MatchString(key) {
+			errs.Add(ref.Wrap(fmt.Errorf("%w (found %q)", errMalformedLabelKey, key)))
+		}
+		value := l[key]
+		if strings.ContainsAny(value, "\r\n") {
+			errs.Add(ref.Wrap(fmt.Errorf("may not have line breaks in label values (found in %q)", key)))
+		} else if MustNotHaveSurroundingSpaces(value) != nil {
+			errs.Add(ref.Wrap(fmt.Errorf("may not have surrounding spaces in label values (found in %q)", key)))
+		}
+	}
+	return errs
+}
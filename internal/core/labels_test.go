@@ -0,0 +1,68 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestParseAndMatchLabels(t *testing.T) {
+	ref := User{LoginName: "jane"}.Ref().Field("labels")
+
+	labels, err := ParseLabels("team = ops\r\n\r\ncost-center=1234\r\nempty=", ref)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "parsed labels", labels, Labels{"team": "ops", "cost-center": "1234", "empty": ""})
+	assert.DeepEqual(t, "rendered labels", labels.Lines(), []string{"cost-center=1234", "empty=", "team=ops"})
+
+	assert.DeepEqual(t, "match by key", labels.Matches("team"), true)
+	assert.DeepEqual(t, "match by key and value", labels.Matches("team=ops"), true)
+	assert.DeepEqual(t, "match by empty value", labels.Matches("empty="), true)
+	assert.DeepEqual(t, "mismatch by value", labels.Matches("team=dev"), false)
+	assert.DeepEqual(t, "mismatch by key", labels.Matches("owner"), false)
+	assert.DeepEqual(t, "match all", labels.MatchesAll([]string{"team=ops", "cost-center"}), true)
+	assert.DeepEqual(t, "mismatch all", labels.MatchesAll([]string{"team=ops", "owner"}), false)
+
+	_, err = ParseLabels("team=ops\nteam=dev", ref)
+	expectTheseErrors(t, errext.ErrorSet{err}, `field "labels" in user "jane" contains the label "team" multiple times`)
+	_, err = ParseLabels("team=ops\nsomething", ref)
+	expectTheseErrors(t, errext.ErrorSet{err}, `field "labels" in user "jane" must have a label of the form key=value on each line (parse error on line 2)`)
+
+	expectTheseErrors(t, Labels{"Team": "ops", "-foo": "", "ok": " value", "multi": "line\nbreak"}.validate(ref),
+		`field "labels" in user "jane" must have label keys consisting of lowercase letters, digits, dots, slashes, underscores and dashes, starting and ending with a letter or digit (found "-foo")`,
+		`field "labels" in user "jane" must have label keys consisting of lowercase letters, digits, dots, slashes, underscores and dashes, starting and ending with a letter or digit (found "Team")`,
+		`field "labels" in user "jane" may not have line breaks in label values (found in "multi")`,
+		`field "labels" in user "jane" may not have surrounding spaces in label values (found in "ok")`,
+	)
+}
+
+func TestSeededLabels(t *testing.T) {
+	//Seeded labels are enforced, but other labels are left alone.
+	var seed DatabaseSeed
+	err := json.Unmarshal([]byte(`{"groups":[{"name":"staff","long_name":"Staff","labels":{"managed-by":"seed"}}]}`), &seed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hasher := &NoopHasher{}
+	db := Database{Groups: []Group{{
+		Name:     "staff",
+		LongName: "Staff",
+		Labels:   Labels{"managed-by": "someone-else", "team": "ops"},
+	}}}
+
+	expectTheseErrors(t, seed.CheckConflicts(db, hasher),
+		`field "labels" in group "staff" must be equal to the seeded value`,
+	)
+	seed.ApplyTo(&db, hasher)
+	assert.DeepEqual(t, "labels after seeding", db.Groups[0].Labels, Labels{"managed-by": "seed", "team": "ops"})
+	expectNoErrors(t, seed.CheckConflicts(db, hasher))
+}
@@ -15,7 +15,7 @@ import (
 type Object[Self any] interface {
 	// List of permitted types. This is required for type inference, as explained here:
 	// <https://stackoverflow.com/a/73851453>
-	User | Group
+	User | Group | ServiceAccount
 
 	// Returns a field from this struct that uniquely identifies it within the List.
 	Key() string
@@ -23,7 +23,8 @@ type Object[Self any] interface {
 	Cloned() Self
 }
 
-// ObjectList adds convenience methods for working with lists of users and groups.
+// ObjectList adds convenience methods for working with lists of users, groups
+// and service accounts.
 type ObjectList[T Object[T]] []T
 
 // Cloned returns a deep copy of this list.
@@ -11,15 +11,34 @@ import (
 	"errors"
 	"reflect"
 	"sync"
+	"time"
 
 	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
 )
 
 // UpdateAction is an action that modifies the contents of the Database.
 // This type appears in the Nexus.Update() interface method.
 type UpdateAction func(*Database) errext.ErrorSet
 
+// Change describes an update of the Database. This type appears in the
+// Nexus.AddChangeListener() and Nexus.AddPreCommitHook() interface methods.
+type Change struct {
+	Actor Actor
+	Diff  DatabaseDiff
+	//True for the change that fills the empty database on startup, either by
+	//loading the database file or by first-time initialization. Consumers that
+	//are only interested in actual modifications can ignore such changes.
+	IsInitialLoad bool
+	//Same as UpdateOptions.IsRehash.
+	IsRehash bool
+}
+
+// PreCommitHook is a callback that can veto changes to the Database. This
+// type appears in the Nexus.AddPreCommitHook() interface method.
+type PreCommitHook func(change Change) error
+
 // Nexus stores the contents of the Database. All other parts of the
 // application use a reference to the Nexus to read and update the Database.
 type Nexus interface {
@@ -33,33 +52,78 @@ type Nexus interface {
 	// callback should send into a channel from which that goroutine is receiving.
 	AddListener(ctx context.Context, callback func(Database))
 
+	// AddChangeListener is like AddListener, but instead of the full database,
+	// the callback receives a description of each change, including who made
+	// it. Unlike with AddListener, there is no initial callback for the
+	// database contents that exist at the time of registration. The Change
+	// instance is shared between all change listeners, so they must not
+	// modify it.
+	AddChangeListener(ctx context.Context, callback func(Change))
+
+	// AddPreCommitHook registers a hook with the nexus. Whenever an update has
+	// passed validation and would change the database, the hook is invoked with
+	// the proposed changes. If it returns an error, the update is rejected and
+	// the error is reported to the caller of Update().
+	//
+	// Hooks are only invoked for changes by interactive actors (see
+	// Actor.IsInteractive), and never for dry runs. Like listener callbacks,
+	// hooks are invoked while the nexus is locked, so they must not call back
+	// into the nexus.
+	AddPreCommitHook(hook PreCommitHook)
+
 	// Update changes the contents of the database. This interface follows the
 	// State Reducer pattern: The action callback is invoked with the current
 	// Database, and is expected to return the updated Database. The updated
 	// Database is then validated and the database seed is enforced, if any.
 	Update(action UpdateAction, opts *UpdateOptions) errext.ErrorSet
 
+	// ReplaceSeed replaces the database seed that was given to NewNexus(), and
+	// enforces the new seed on the current database contents right away.
+	// Conflicts with the new seed are always corrected, regardless of
+	// opts.ConflictWithSeedIsError.
+	ReplaceSeed(seed *DatabaseSeed, opts *UpdateOptions) errext.ErrorSet
+
 	// Assorted querying functions. The return values are always deep clones
 	// of their respective database entries.
 	ListGroups() []Group
 	ListUsers() []User
+	ListServiceAccounts() []ServiceAccount
 	FindGroup(predicate func(Group) bool) (Group, bool)
 	FindUser(predicate func(User) bool) (UserWithPerms, bool)
+	ListAccessReviews() []AccessReview
+	ListJoinRequests() []JoinRequest
+	ListDeactivatedUsers() []DeactivatedUser
+	FindUserHistory(loginName string) (ObjectHistory[User], bool)
+	FindGroupHistory(name string) (ObjectHistory[Group], bool)
+	// SeededFieldsOf returns which fields of the given user or group are
+	// enforced by the current seed.
+	SeededFieldsOf(ref ObjectRef) SeededFields
 
 	// Components carried by the Nexus.
 	PasswordHasher() crypt.PasswordHasher
+	ValidationConfig() *ValidationConfig
 }
 
 // UpdateOptions controls optional behavior in Nexus.Update().
 type UpdateOptions struct {
 	//If true, conflicts with the seed will be reported as validation errors.
-	//If false (default), conflicts with the seed will be corrected silently.
+	//If false (default), conflicts with the seed will be corrected (and logged).
 	ConflictWithSeedIsError bool
 
 	//If true, the updated database will be computed and validated, but not
 	//saved. This is used to obtain a more complete set of errors for the UI
 	//after a preliminary validation step already failed.
 	DryRun bool
+
+	//Who requested this update. If empty, ActorTypeSystem is assumed. If the
+	//update only changes the database because of seed enforcement, the
+	//resulting Change will report ActorTypeSeed instead.
+	Actor Actor
+
+	//If true, the action only replaces password hashes with stronger hashes of
+	//the same passwords. Change listeners can use this to tell such upgrades
+	//apart from actual password changes.
+	IsRehash bool
 }
 
 // ErrDatabaseNeedsInitialization is used by the disk store connection to
@@ -76,10 +140,12 @@ type nexusImpl struct {
 	hasher crypt.PasswordHasher
 	vcfg   *ValidationConfig
 	//The mutex guards access to all fields listed below it in this struct.
-	mutex     sync.RWMutex
-	seed      *DatabaseSeed
-	db        Database
-	listeners []listener
+	mutex           sync.RWMutex
+	seed            *DatabaseSeed
+	db              Database
+	listeners       []listener
+	changeListeners []changeListener
+	hooks           []PreCommitHook
 }
 
 type listener struct {
@@ -87,11 +153,21 @@ type listener struct {
 	callback func(Database)
 }
 
+type changeListener struct {
+	ctx      context.Context
+	callback func(Change)
+}
+
 // PasswordHasher implements the Nexus interface.
 func (n *nexusImpl) PasswordHasher() crypt.PasswordHasher {
 	return n.hasher
 }
 
+// ValidationConfig implements the Nexus interface.
+func (n *nexusImpl) ValidationConfig() *ValidationConfig {
+	return n.vcfg
+}
+
 // ListGroups implements the Nexus interface.
 func (n *nexusImpl) ListGroups() []Group {
 	n.mutex.RLock()
@@ -106,6 +182,13 @@ func (n *nexusImpl) ListUsers() []User {
 	return n.db.Users.Cloned()
 }
 
+// ListServiceAccounts implements the Nexus interface.
+func (n *nexusImpl) ListServiceAccounts() []ServiceAccount {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.ServiceAccounts.Cloned()
+}
+
 // FindGroup implements the Nexus interface.
 func (n *nexusImpl) FindGroup(predicate func(Group) bool) (Group, bool) {
 	n.mutex.RLock()
@@ -125,6 +208,51 @@ func (n *nexusImpl) FindUser(predicate func(User) bool) (UserWithPerms, bool) {
 	return UserWithPerms{}, false
 }
 
+// ListAccessReviews implements the Nexus interface.
+func (n *nexusImpl) ListAccessReviews() []AccessReview {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.Cloned().AccessReviews
+}
+
+// ListJoinRequests implements the Nexus interface.
+func (n *nexusImpl) ListJoinRequests() []JoinRequest {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.Cloned().JoinRequests
+}
+
+// ListDeactivatedUsers implements the Nexus interface.
+func (n *nexusImpl) ListDeactivatedUsers() []DeactivatedUser {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.db.Cloned().DeactivatedUsers
+}
+
+// FindUserHistory implements the Nexus interface.
+func (n *nexusImpl) FindUserHistory(loginName string) (ObjectHistory[User], bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return findHistory(n.db.UserHistory, loginName)
+}
+
+// FindGroupHistory implements the Nexus interface.
+func (n *nexusImpl) FindGroupHistory(name string) (ObjectHistory[Group], bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return findHistory(n.db.GroupHistory, name)
+}
+
+// SeededFieldsOf implements the Nexus interface.
+func (n *nexusImpl) SeededFieldsOf(ref ObjectRef) SeededFields {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.seed == nil {
+		return SeededFields{}
+	}
+	return n.seed.SeededFieldsOf(ref)
+}
+
 // AddListener implements the Nexus interface.
 func (n *nexusImpl) AddListener(ctx context.Context, callback func(Database)) {
 	n.mutex.Lock()
@@ -138,12 +266,30 @@ func (n *nexusImpl) AddListener(ctx context.Context, callback func(Database)) {
 	}
 }
 
+// AddChangeListener implements the Nexus interface.
+func (n *nexusImpl) AddChangeListener(ctx context.Context, callback func(Change)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.changeListeners = append(n.changeListeners, changeListener{ctx, callback})
+}
+
+// AddPreCommitHook implements the Nexus interface.
+func (n *nexusImpl) AddPreCommitHook(hook PreCommitHook) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.hooks = append(n.hooks, hook)
+}
+
 // Update implements the Nexus interface.
 func (n *nexusImpl) Update(action UpdateAction, optsPtr *UpdateOptions) (errs errext.ErrorSet) {
 	var opts UpdateOptions
 	if optsPtr != nil {
 		opts = *optsPtr
 	}
+	actor := opts.Actor
+	if actor.Type == "" {
+		actor.Type = ActorTypeSystem
+	}
 
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
@@ -171,6 +317,16 @@ func (n *nexusImpl) Update(action UpdateAction, optsPtr *UpdateOptions) (errs er
 		if opts.ConflictWithSeedIsError {
 			errs.Append(n.seed.CheckConflicts(newDB, n.hasher))
 		} else {
+			//conflicts are corrected without bothering the caller, but the
+			//reverted changes shall at least show up in the log
+			for _, err := range n.seed.CheckConflicts(newDB, n.hasher) {
+				logg.Info("enforcing seed: %s", err.Error())
+			}
+			//if the action did not change anything by itself, any change that
+			//remains can only be attributed to the seed
+			if !n.db.IsEmpty() && reflect.DeepEqual(n.db, newDB) {
+				actor = Actor{Type: ActorTypeSeed}
+			}
 			n.seed.ApplyTo(&newDB, n.hasher)
 		}
 	}
@@ -185,11 +341,78 @@ func (n *nexusImpl) Update(action UpdateAction, optsPtr *UpdateOptions) (errs er
 	if reflect.DeepEqual(n.db, newDB) {
 		return nil
 	}
+
+	change := Change{
+		Actor:         actor,
+		Diff:          DiffDatabases(n.db, newDB),
+		IsInitialLoad: n.db.IsEmpty(),
+		IsRehash:      opts.IsRehash,
+	}
+
+	//give external policies a chance to veto the change (but only if there is
+	//someone who we can report the rejection to)
+	if actor.IsInteractive() {
+		for _, hook := range n.hooks {
+			err := hook(change)
+			if err != nil {
+				errs.Add(err)
+			}
+		}
+		if !errs.IsEmpty() {
+			return errs
+		}
+	}
+
+	if !change.IsInitialLoad && n.vcfg.HistoryDepth > 0 {
+		newDB.recordHistory(change.Diff, actor, time.Now(), n.vcfg.HistoryDepth)
+	}
 	n.db = newDB
 	for _, listener := range n.listeners {
 		if listener.ctx.Err() == nil {
 			listener.callback(n.db.Cloned())
 		}
 	}
+	for _, listener := range n.changeListeners {
+		if listener.ctx.Err() == nil {
+			listener.callback(change)
+		}
+	}
 	return nil
 }
+
+// ReplaceSeed implements the Nexus interface.
+func (n *nexusImpl) ReplaceSeed(seed *DatabaseSeed, optsPtr *UpdateOptions) errext.ErrorSet {
+	var opts UpdateOptions
+	if optsPtr != nil {
+		opts = *optsPtr
+	}
+	opts.ConflictWithSeedIsError = false
+
+	n.mutex.Lock()
+	n.seed = seed
+	n.mutex.Unlock()
+
+	//an update that does not change anything by itself will enforce the new seed
+	return n.Update(func(*Database) errext.ErrorSet { return nil }, &opts)
+}
+
+// waitForInitialLoad blocks until the database has been loaded into the
+// nexus (or initialized for the first time), or until `ctx` expires. Returns
+// whether the database was loaded. Periodic jobs use this to not operate on
+// the empty database that the nexus starts out with.
+func waitForInitialLoad(ctx context.Context, nexus Nexus) bool {
+	ctxListen, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	loaded := make(chan struct{})
+	var once sync.Once
+	nexus.AddListener(ctxListen, func(Database) {
+		once.Do(func() { close(loaded) })
+	})
+	select {
+	case <-loaded:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -8,7 +8,9 @@ package core
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/errext"
@@ -84,3 +86,363 @@ func TestDryRun(t *testing.T) {
 	assert.DeepEqual(t, "user given name", actualDB.Users[0].FullName(), "Changed User")
 	assert.DeepEqual(t, "run counter", counter, 2)
 }
+
+func TestPreCommitHookAndChangeListener(t *testing.T) {
+	//This test checks that pre-commit hooks can veto updates, and that change
+	//listeners are informed about who made each change.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vcfg := GetValidationConfigForTests()
+	hasher := &NoopHasher{}
+	nexus := NewNexus(nil, vcfg, hasher)
+	var actualDB Database
+	nexus.AddListener(ctx, func(db Database) {
+		actualDB = db
+	})
+	var changes []Change
+	nexus.AddChangeListener(ctx, func(change Change) {
+		changes = append(changes, change)
+	})
+
+	hookInvocations := 0
+	nexus.AddPreCommitHook(func(change Change) error {
+		hookInvocations++
+		for _, upd := range change.Diff.Users.Updated {
+			if upd.New.GivenName == "Forbidden" {
+				return errors.New("forbidden by policy")
+			}
+		}
+		return nil
+	})
+
+	//changes without an interactive actor (like the initial load) do not go through the hook
+	actionLoad := func(db *Database) errext.ErrorSet {
+		db.Users = []User{{
+			LoginName:  "minuser",
+			GivenName:  "Minimal",
+			FamilyName: "User",
+		}}
+		return nil
+	}
+	expectNoErrors(t, nexus.Update(actionLoad, nil))
+	assert.DeepEqual(t, "hook invocations", hookInvocations, 0)
+	assert.DeepEqual(t, "actor", changes[0].Actor, Actor{Type: ActorTypeSystem})
+	assert.DeepEqual(t, "initial load", changes[0].IsInitialLoad, true)
+
+	//neither do dry runs or updates without changes
+	actor := Actor{Type: ActorTypeUser, Name: "admin"}
+	actionRename := func(name string) UpdateAction {
+		return func(db *Database) errext.ErrorSet {
+			db.Users[0].GivenName = name
+			return nil
+		}
+	}
+	expectNoErrors(t, nexus.Update(actionRename("Changed"), &UpdateOptions{DryRun: true, Actor: actor}))
+	expectNoErrors(t, nexus.Update(actionRename("Minimal"), &UpdateOptions{Actor: actor}))
+	assert.DeepEqual(t, "hook invocations", hookInvocations, 0)
+
+	//a rejected update is not committed
+	errs := nexus.Update(actionRename("Forbidden"), &UpdateOptions{Actor: actor})
+	expectTheseErrors(t, errs, "forbidden by policy")
+	assert.DeepEqual(t, "user given name", actualDB.Users[0].FullName(), "Minimal User")
+	assert.DeepEqual(t, "change count", len(changes), 1)
+
+	//an allowed update is committed, and the listener sees exactly what changed and who did it
+	expectNoErrors(t, nexus.Update(actionRename("Changed"), &UpdateOptions{Actor: actor}))
+	assert.DeepEqual(t, "user given name", actualDB.Users[0].FullName(), "Changed User")
+	assert.DeepEqual(t, "hook invocations", hookInvocations, 2)
+	assert.DeepEqual(t, "change count", len(changes), 2)
+	assert.DeepEqual(t, "change", changes[1], Change{
+		Actor: actor,
+		Diff: DatabaseDiff{
+			Users: ObjectDiff[User]{
+				Updated: []ObjectUpdate[User]{{
+					Old: User{LoginName: "minuser", GivenName: "Minimal", FamilyName: "User"},
+					New: User{LoginName: "minuser", GivenName: "Changed", FamilyName: "User"},
+				}},
+			},
+		},
+	})
+}
+
+func TestAccessReview(t *testing.T) {
+	//This test checks the lifecycle of an AccessReview, from its creation
+	//until all memberships have been decided on.
+	vcfg := GetValidationConfigForTests()
+	hasher := &NoopHasher{}
+	nexus := NewNexus(nil, vcfg, hasher)
+
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "User"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "User"},
+		}
+		db.Groups = []Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: GroupMemberNames{"alice": true, "bob": true},
+			OwnerLoginName:   "alice",
+		}}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	//starting a review with malformed values fails
+	startedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.AccessReviews = append(db.AccessReviews,
+			NewAccessReview("Q1 Review", "2024-02-30", "alice", startedAt, db.Groups),
+			NewAccessReview("early", "2024-02-01", "alice", startedAt, db.Groups),
+		)
+		return nil
+	}, nil)
+	expectTheseErrors(t, errs,
+		`field "name" in access review "Q1 Review" may only contain lowercase letters, digits, dashes and underscores`,
+		`field "deadline" in access review "Q1 Review" is not a valid date in the format YYYY-MM-DD`,
+		`field "deadline" in access review "early" may not be before the start of the review`,
+	)
+
+	//starting a proper review takes a snapshot of the memberships
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.AccessReviews = append(db.AccessReviews,
+			NewAccessReview("q1", "2024-03-31", "alice", startedAt, db.Groups))
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+	reviews := nexus.ListAccessReviews()
+	assert.DeepEqual(t, "review items", reviews[0].Items, []AccessReviewItem{
+		{GroupName: "staff", LoginName: "alice"},
+		{GroupName: "staff", LoginName: "bob"},
+	})
+	assert.DeepEqual(t, "IsFlagged before deadline", reviews[0].IsFlagged(reviews[0].Items[0], startedAt), false)
+	assert.DeepEqual(t, "IsFlagged after deadline", reviews[0].IsFlagged(reviews[0].Items[0], startedAt.AddDate(0, 1, 0)), true)
+
+	//removing a member through the review also removes the membership
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DecideAccessReviewItem("q1", "staff", "alice", AccessReviewConfirmed, "alice"))
+		errs.Add(db.DecideAccessReviewItem("q1", "staff", "bob", AccessReviewRemoved, "alice"))
+		errs.Add(db.DecideAccessReviewItem("q1", "staff", "carol", AccessReviewRemoved, "alice"))
+		errs.Add(db.DecideAccessReviewItem("q2", "staff", "bob", AccessReviewRemoved, "alice"))
+		return
+	}, nil)
+	expectTheseErrors(t, errs,
+		`access review "q1" does not cover user "carol" in group "staff"`,
+		`access review "q2" does not exist`,
+	)
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DecideAccessReviewItem("q1", "staff", "alice", AccessReviewConfirmed, "alice"))
+		errs.Add(db.DecideAccessReviewItem("q1", "staff", "bob", AccessReviewRemoved, "alice"))
+		return
+	}, nil)
+	expectNoErrors(t, errs)
+
+	review := nexus.ListAccessReviews()[0]
+	assert.DeepEqual(t, "confirmed count", review.CountItems("staff", AccessReviewConfirmed), 1)
+	assert.DeepEqual(t, "removed count", review.CountItems("", AccessReviewRemoved), 1)
+	assert.DeepEqual(t, "pending count", review.CountItems("", AccessReviewPending), 0)
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "group members", group.MemberLoginNames, GroupMemberNames{"alice": true})
+}
+
+func TestDefaultMemberships(t *testing.T) {
+	db := Database{
+		Groups: []Group{
+			{Name: "everyone", DefaultMembership: DefaultMembershipRules{ForAllUsers: true}},
+			{Name: "staff", DefaultMembership: DefaultMembershipRules{ForEMailDomains: []string{"example.org"}}},
+			{Name: "other"},
+		},
+	}
+
+	db.AddDefaultMemberships(User{LoginName: "jane", EMailAddress: "jane@Example.ORG"})
+	db.AddDefaultMemberships(User{LoginName: "john", EMailAddress: "john@example.org.evil"})
+	db.AddDefaultMemberships(User{LoginName: "nomail"})
+	assert.DeepEqual(t, "members of everyone", db.Groups[0].MemberLoginNames, GroupMemberNames{"jane": true, "john": true, "nomail": true})
+	assert.DeepEqual(t, "members of staff", db.Groups[1].MemberLoginNames, GroupMemberNames{"jane": true})
+	assert.DeepEqual(t, "members of other", db.Groups[2].MemberLoginNames, GroupMemberNames(nil))
+}
+
+func TestJoinRequests(t *testing.T) {
+	hasher := &NoopHasher{}
+	nexus := NewNexus(nil, GetValidationConfigForTests(), hasher)
+
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "User"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "User"},
+		}
+		db.Groups = []Group{
+			{Name: "closed", LongName: "Closed", MemberLoginNames: GroupMemberNames{}},
+			{Name: "open", LongName: "Open", MemberLoginNames: GroupMemberNames{"alice": true}, IsJoinable: true},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	//only joinable groups accept requests, and only from non-members
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RequestGroupJoin("closed", "bob", "", now))
+		errs.Add(db.RequestGroupJoin("open", "alice", "", now))
+		errs.Add(db.RequestGroupJoin("open", "bob", "I need this", now))
+		errs.Add(db.RequestGroupJoin("open", "bob", "Really", now))
+		return
+	}, nil)
+	expectTheseErrors(t, errs,
+		`group "closed" does not accept join requests`,
+		`user "alice" is already a member of group "open"`,
+		`user "bob" has already requested to join group "open"`,
+	)
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.RequestGroupJoin("open", "bob", "I need this", now))
+		return
+	}, nil)
+	expectNoErrors(t, errs)
+
+	//a rejected request can be renewed, and an approved request adds the membership
+	later := now.AddDate(0, 0, 1)
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DecideJoinRequest("open", "bob", JoinRequestRejected, "alice", now))
+		errs.Add(db.RequestGroupJoin("open", "bob", "Please reconsider", later))
+		errs.Add(db.DecideJoinRequest("open", "bob", JoinRequestApproved, "alice", later))
+		errs.Add(db.DecideJoinRequest("open", "bob", JoinRequestRejected, "alice", later))
+		return
+	}, nil)
+	expectTheseErrors(t, errs,
+		`user "bob" does not have a pending request to join group "open"`,
+	)
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DecideJoinRequest("open", "bob", JoinRequestRejected, "alice", now))
+		errs.Add(db.RequestGroupJoin("open", "bob", "Please reconsider", later))
+		errs.Add(db.DecideJoinRequest("open", "bob", JoinRequestApproved, "alice", later))
+		return
+	}, nil)
+	expectNoErrors(t, errs)
+
+	assert.DeepEqual(t, "join requests", nexus.ListJoinRequests(), []JoinRequest{{
+		GroupName:   "open",
+		LoginName:   "bob",
+		Comment:     "Please reconsider",
+		RequestedAt: "2024-03-02",
+		State:       JoinRequestApproved,
+		DecidedBy:   "alice",
+		DecidedAt:   "2024-03-02",
+	}})
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "open" })
+	assert.DeepEqual(t, "group members", group.MemberLoginNames, GroupMemberNames{"alice": true, "bob": true})
+
+	//deleting a user also deletes their join requests
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DeleteUser("bob"))
+		return
+	}, nil)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "join requests after user deletion", len(nexus.ListJoinRequests()), 0)
+}
+
+func TestNestedGroups(t *testing.T) {
+	hasher := &NoopHasher{}
+	nexus := NewNexus(nil, GetValidationConfigForTests(), hasher)
+
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "User"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "User"},
+		}
+		db.Groups = []Group{
+			{
+				Name:             "admins",
+				LongName:         "Admins",
+				MemberLoginNames: GroupMemberNames{},
+				MemberGroupNames: GroupMemberNames{"ops": true},
+				Permissions:      Permissions{Portunus: PortunusPermissions{IsAdmin: true}},
+			},
+			{Name: "ops", LongName: "Ops", MemberLoginNames: GroupMemberNames{}, MemberGroupNames: GroupMemberNames{"oncall": true}},
+			{Name: "oncall", LongName: "On call", MemberLoginNames: GroupMemberNames{"alice": true}},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	//permissions are granted through nested groups
+	alice, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "alice" })
+	assert.DeepEqual(t, "alice is admin", alice.Perms.Portunus.IsAdmin, true)
+	bob, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "bob" })
+	assert.DeepEqual(t, "bob is admin", bob.Perms.Portunus.IsAdmin, false)
+	resolved := ResolveNestedGroups(nexus.ListGroups())
+	assert.DeepEqual(t, "resolved members of admins", resolved[0].MemberLoginNames, GroupMemberNames{"alice": true})
+
+	//cycles and unknown groups are rejected
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		for idx, g := range db.Groups {
+			if g.Name == "oncall" {
+				db.Groups[idx].MemberGroupNames = GroupMemberNames{"admins": true, "unknown": true}
+			}
+		}
+		return nil
+	}, nil)
+	expectTheseErrors(t, errs,
+		`field "member_groups" in group "oncall" contains unknown group "unknown"`,
+		`field "member_groups" in group "admins" must not contain a cycle, but found admins -> ops -> oncall -> admins`,
+	)
+
+	//deleting a group removes it from the groups containing it
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DeleteGroup("ops"))
+		return
+	}, nil)
+	expectNoErrors(t, errs)
+	admins, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "admins" })
+	assert.DeepEqual(t, "member groups of admins", admins.MemberGroupNames, GroupMemberNames(nil))
+}
+
+func TestReadAccessToIndividualGroups(t *testing.T) {
+	hasher := &NoopHasher{}
+	nexus := NewNexus(nil, GetValidationConfigForTests(), hasher)
+
+	//groups granting read access must refer to existing groups
+	errs := nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Admins"},
+			{
+				Name:        "auditors",
+				LongName:    "Auditors",
+				Permissions: Permissions{LDAP: LDAPPermissions{ReadGroupNames: GroupMemberNames{"admins": true, "unknown": true}}},
+			},
+		}
+		return nil
+	}, nil)
+	expectTheseErrors(t, errs,
+		`field "ldap_read_groups" in group "auditors" refers to unknown group "unknown"`,
+	)
+
+	errs = nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Groups = []Group{
+			{Name: "admins", LongName: "Admins"},
+			{
+				Name:        "auditors",
+				LongName:    "Auditors",
+				Permissions: Permissions{LDAP: LDAPPermissions{ReadGroupNames: GroupMemberNames{"admins": true}}},
+			},
+		}
+		return nil
+	}, nil)
+	expectNoErrors(t, errs)
+
+	//deleting a group removes it from the groups granting read access to it
+	errs = nexus.Update(func(db *Database) (errs errext.ErrorSet) {
+		errs.Add(db.DeleteGroup("admins"))
+		return
+	}, nil)
+	expectNoErrors(t, errs)
+	auditors, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "auditors" })
+	assert.DeepEqual(t, "read groups of auditors", auditors.Permissions.LDAP.ReadGroupNames, GroupMemberNames(nil))
+}
+
+func TestPermissionsIncludes(t *testing.T) {
+	full := Permissions{LDAP: LDAPPermissions{CanRead: true, WriteSubtree: "printers"}}
+	partial := Permissions{LDAP: LDAPPermissions{CanReadUsers: true}}
+	assert.DeepEqual(t, "full includes nothing", full.Includes(Permissions{}), true)
+	assert.DeepEqual(t, "full includes partial", full.Includes(partial), false)
+	assert.DeepEqual(t, "union includes partial", full.Union(partial).Includes(partial), true)
+}
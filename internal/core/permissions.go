@@ -6,6 +6,8 @@
 
 package core
 
+import "reflect"
+
 // Permissions represents the permissions that membership in a certain group
 // gives its members.
 type Permissions struct {
@@ -21,18 +23,33 @@ type PortunusPermissions struct {
 // LDAPPermissions appears in type Permissions.
 type LDAPPermissions struct {
 	CanRead bool `json:"can_read"`
+	//These grant read access to parts of the directory only. They are redundant
+	//if CanRead is true.
+	CanReadUsers  bool `json:"can_read_users,omitempty"`
+	CanReadGroups bool `json:"can_read_groups,omitempty"`
+	//Grants read access to the groups with these names (and their POSIX
+	//duplicates, if any).
+	ReadGroupNames GroupMemberNames `json:"read_groups,omitempty"`
+	//If not empty, grants write access to the LDAP subtree
+	//"ou=${WriteSubtree},ou=subtrees,${PORTUNUS_LDAP_SUFFIX}".
+	WriteSubtree string `json:"write_subtree,omitempty"`
 }
 
 // Includes returns true when all the permissions are included in this
-// Permissions instance.
+// Permissions instance. The fields that Union() does not merge are ignored.
 func (p Permissions) Includes(other Permissions) bool {
-	return p.Union(other) == p
+	return reflect.DeepEqual(p.Union(other), p.Union(Permissions{}))
 }
 
 // Union returns the union of the given permission sets.
+//
+// LDAP.ReadGroupNames and LDAP.WriteSubtree are not merged: They are only ever
+// evaluated for each group individually, so they are always empty in the result.
 func (p Permissions) Union(other Permissions) Permissions {
 	var result Permissions
 	result.Portunus.IsAdmin = p.Portunus.IsAdmin || other.Portunus.IsAdmin
 	result.LDAP.CanRead = p.LDAP.CanRead || other.LDAP.CanRead
+	result.LDAP.CanReadUsers = p.LDAP.CanReadUsers || other.LDAP.CanReadUsers
+	result.LDAP.CanReadGroups = p.LDAP.CanReadGroups || other.LDAP.CanReadGroups
 	return result
 }
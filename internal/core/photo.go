@@ -0,0 +1,134 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" //register decoder for image.Decode()
+	"image/jpeg"
+	_ "image/png" //register decoder for image.Decode()
+)
+
+const (
+	// MaxUserPhotoSize is the maximum size of User.JPEGPhoto in bytes. The
+	// photo is stored in the database and in LDAP, and sent along with every
+	// search result for the user, so it should be kept small.
+	MaxUserPhotoSize = 64 << 10 // 64 KiB
+	// MaxUserPhotoDimension is the maximum width and height of a photo in
+	// pixels. Larger images are scaled down by PrepareUserPhoto.
+	MaxUserPhotoDimension = 256
+	// Uploaded images are rejected if they are larger than this, even before
+	// being scaled down. Decoding needs up to 8 bytes per pixel, so this keeps
+	// each upload below about 128 MiB of memory. This is enough for typical
+	// phone photos; larger images need to be scaled down before uploading.
+	maxUploadedPhotoPixels = 16 * 1000 * 1000
+)
+
+var errNotJPEG = errors.New("must be a JPEG image")
+
+func isJPEG(data []byte) bool {
+	//all JPEG files start with an SOI marker, followed by the start of another marker
+	return bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF})
+}
+
+func validateUserPhoto(data []byte) error {
+	if len(data) > MaxUserPhotoSize {
+		return fmt.Errorf("must not be larger than %d KiB", MaxUserPhotoSize>>10)
+	}
+	if !isJPEG(data) {
+		return errNotJPEG
+	}
+	return nil
+}
+
+// PrepareUserPhoto converts an uploaded image (JPEG, PNG or GIF) into a form
+// that is suitable for User.JPEGPhoto: It is scaled down to at most
+// MaxUserPhotoDimension pixels in each direction, and reencoded as JPEG.
+// Reencoding also removes all metadata (e.g. the GPS coordinates that phones
+// like to put into photos).
+func PrepareUserPhoto(data []byte) ([]byte, error) {
+	errUnsupported := errors.New("must be a JPEG, PNG or GIF image")
+	//check the dimensions before decoding: a small file can still decode into
+	//an enormous image that exhausts our memory
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupported
+	}
+	if cfg.Width*cfg.Height > maxUploadedPhotoPixels {
+		return nil, fmt.Errorf("must not have more than %d megapixels", maxUploadedPhotoPixels/1000000)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupported
+	}
+	img = flattenImage(img, MaxUserPhotoDimension)
+
+	//try successively lower quality until the size limit is met
+	var buf bytes.Buffer
+	for _, quality := range []int{90, 80, 70, 60, 50} {
+		buf.Reset()
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() <= MaxUserPhotoSize {
+			return buf.Bytes(), nil
+		}
+	}
+	return nil, fmt.Errorf("must not be larger than %d KiB", MaxUserPhotoSize>>10)
+}
+
+// flattenImage scales the image such that its width and height do not
+// exceed maxDimension, retaining the aspect ratio, and removes transparency.
+// Each output pixel is the average of the input pixels that it covers, which
+// is good enough for shrinking photos and does not need any libraries beyond
+// the standard library.
+func flattenImage(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := srcWidth, srcHeight
+	if srcWidth > maxDimension || srcHeight > maxDimension {
+		if srcWidth > srcHeight {
+			dstWidth, dstHeight = maxDimension, max(1, srcHeight*maxDimension/srcWidth)
+		} else {
+			dstWidth, dstHeight = max(1, srcWidth*maxDimension/srcHeight), maxDimension
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := range dstHeight {
+		y0 := bounds.Min.Y + y*srcHeight/dstHeight
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcHeight/dstHeight)
+		for x := range dstWidth {
+			x0 := bounds.Min.X + x*srcWidth/dstWidth
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcWidth/dstWidth)
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					count++
+				}
+			}
+			//JPEG does not support transparency, so put transparent areas on a
+			//white background (the color values are premultiplied by alpha)
+			transparency := 0xFFFF - a/count
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/count + transparency),
+				G: uint16(g/count + transparency),
+				B: uint16(b/count + transparency),
+				A: 0xFFFF,
+			})
+		}
+	}
+	return dst
+}
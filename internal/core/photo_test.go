@@ -0,0 +1,105 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestPrepareUserPhoto(t *testing.T) {
+	//a wide PNG with a transparent half
+	src := image.NewNRGBA(image.Rect(0, 0, 1000, 500))
+	for y := range 500 {
+		for x := range 1000 {
+			if x < 500 {
+				src.Set(x, y, color.NRGBA{R: 0xFF, A: 0xFF})
+			} else {
+				src.Set(x, y, color.NRGBA{})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, src)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	photo, err := PrepareUserPhoto(buf.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := validateUserPhoto(photo); err != nil {
+		t.Error(err.Error())
+	}
+	img, err := jpeg.Decode(bytes.NewReader(photo))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "photo size", img.Bounds(), image.Rect(0, 0, 256, 128))
+
+	//the opaque half keeps its color, the transparent half becomes white
+	//(with some tolerance for JPEG compression artifacts)
+	for _, tc := range []struct {
+		X, Y     int
+		Expected color.RGBA
+	}{
+		{64, 64, color.RGBA{R: 0xFF, A: 0xFF}},
+		{192, 64, color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}},
+	} {
+		r, g, b, _ := img.At(tc.X, tc.Y).RGBA()
+		if !isCloseTo(r>>8, tc.Expected.R) || !isCloseTo(g>>8, tc.Expected.G) || !isCloseTo(b>>8, tc.Expected.B) {
+			t.Errorf("expected pixel (%d,%d) to be close to %v, but got (%d,%d,%d)", tc.X, tc.Y, tc.Expected, r>>8, g>>8, b>>8)
+		}
+	}
+
+	_, err = PrepareUserPhoto([]byte("not an image"))
+	if err == nil || err.Error() != "must be a JPEG, PNG or GIF image" {
+		t.Errorf("expected error for non-image, but got %v", err)
+	}
+
+	//images with too many pixels are rejected before decoding
+	buf.Reset()
+	err = png.Encode(&buf, image.NewGray(image.Rect(0, 0, 5000, 4000)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = PrepareUserPhoto(buf.Bytes())
+	if err == nil || err.Error() != "must not have more than 16 megapixels" {
+		t.Errorf("expected error for oversized image, but got %v", err)
+	}
+}
+
+func isCloseTo(actual uint32, expected uint8) bool {
+	diff := int(actual) - int(expected)
+	return diff > -16 && diff < 16
+}
+
+func TestValidateUserPhoto(t *testing.T) {
+	cfg := GetValidationConfigForTests()
+	user := User{
+		LoginName:    "jane",
+		GivenName:    "Jane",
+		FamilyName:   "Doe",
+		PasswordHash: "{CRYPT}$6$rounds=10$salt$hash",
+	}
+
+	user.JPEGPhoto = []byte("GIF89a")
+	expectTheseErrors(t, user.validateLocal(cfg),
+		`field "jpeg_photo" in user "jane" must be a JPEG image`,
+	)
+	user.JPEGPhoto = append([]byte{0xFF, 0xD8, 0xFF}, make([]byte, MaxUserPhotoSize)...)
+	expectTheseErrors(t, user.validateLocal(cfg),
+		`field "jpeg_photo" in user "jane" must not be larger than 64 KiB`,
+	)
+}
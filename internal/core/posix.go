@@ -0,0 +1,159 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/majewsky/portunus/internal/envconfig"
+)
+
+// DefaultPosixGroupLimit is the default value for
+// ValidationConfig.PosixGroupLimit. This is how many supplementary groups fit
+// into the credentials of the AUTH_SYS flavor of Sun RPC (RFC 5531, appendix A),
+// which is still the default for NFS.
+const DefaultPosixGroupLimit = 16
+
+func readPosixGroupLimitFromEnvironment() (uint, error) {
+	return envconfig.GetUint("PORTUNUS_POSIX_GROUP_LIMIT", DefaultPosixGroupLimit)
+}
+
+// Reads PORTUNUS_DEFAULT_LOGIN_SHELL or PORTUNUS_DEFAULT_HOME_PREFIX, which
+// must be absolute paths if given.
+func readDefaultPosixPathFromEnvironment(key string) (string, error) {
+	value := os.Getenv(key)
+	if value != "" && MustBeAbsolutePath(value) != nil {
+		return "", fmt.Errorf("malformed value for %s: %q (must be an absolute path)", key, value)
+	}
+	return value, nil
+}
+
+// DefaultHomeDirectory returns the home directory that is assumed for the
+// given POSIX user when none is given explicitly, or the empty string if
+// PORTUNUS_DEFAULT_HOME_PREFIX is not set.
+func (cfg ValidationConfig) DefaultHomeDirectory(loginName string) string {
+	if cfg.DefaultHomePrefix == "" {
+		return ""
+	}
+	return path.Join(cfg.DefaultHomePrefix, loginName)
+}
+
+// Finds POSIX users whose supplementary POSIX groups (i.e. all POSIX groups
+// containing them, except for the one with their primary GID) exceed
+// cfg.PosixGroupLimit. Systems like NFS with AUTH_SYS silently drop the
+// groups beyond the limit, so file access through these groups fails.
+func checkPosixGroupLimit(users []User, groups []Group, cfg *ValidationConfig) (warnings []ValidationError) {
+	if cfg.PosixGroupLimit == 0 {
+		return nil
+	}
+	groups = ResolveNestedGroups(groups)
+	for _, user := range users {
+		if user.POSIX == nil {
+			continue
+		}
+		count := uint(0)
+		for _, group := range groups {
+			if group.PosixGID != nil && *group.PosixGID != user.POSIX.GID && group.MemberLoginNames[user.LoginName] {
+				count++
+			}
+		}
+		if count > cfg.PosixGroupLimit {
+			err := fmt.Errorf("includes %d supplementary POSIX groups, more than the %d that NFS with AUTH_SYS supports", count, cfg.PosixGroupLimit)
+			warnings = append(warnings, ValidationError{user.Ref().Field("memberships"), err})
+		}
+	}
+	return warnings
+}
+
+// PosixGIDReport describes how POSIX group IDs are used across users and
+// groups. It helps with reconciling GIDs with systems outside of Portunus
+// (e.g. file ownership on NFS exports). Build it with BuildPosixGIDReport().
+type PosixGIDReport struct {
+	//All POSIX groups, sorted by GID (and by name for equal GIDs).
+	Groups []PosixGroupReportEntry
+	//All GIDs that are used by more than one group, sorted by GID.
+	Collisions []PosixGIDCollision
+	//All POSIX users whose primary GID does not belong to any POSIX group,
+	//sorted by login name.
+	UsersWithUnknownGID []User
+}
+
+// PosixGroupReportEntry appears in type PosixGIDReport.
+type PosixGroupReportEntry struct {
+	GID   PosixID
+	Group Group
+	//Members including those of nested groups, as rendered into LDAP (sorted).
+	MemberLoginNames []string
+	//Users that have this GID as their primary GID (sorted).
+	PrimaryLoginNames []string
+}
+
+// PosixGIDCollision appears in type PosixGIDReport.
+type PosixGIDCollision struct {
+	GID        PosixID
+	GroupNames []string //sorted
+}
+
+// BuildPosixGIDReport builds a PosixGIDReport for the given users and groups.
+func BuildPosixGIDReport(users []User, groups []Group) (report PosixGIDReport) {
+	groupNamesByGID := make(map[PosixID][]string)
+	for _, group := range ResolveNestedGroups(groups) {
+		if group.PosixGID == nil {
+			continue
+		}
+		gid := *group.PosixGID
+		groupNamesByGID[gid] = append(groupNamesByGID[gid], group.Name)
+
+		var memberNames []string
+		for loginName, isMember := range group.MemberLoginNames {
+			if isMember {
+				memberNames = append(memberNames, loginName)
+			}
+		}
+		slices.Sort(memberNames)
+		report.Groups = append(report.Groups, PosixGroupReportEntry{
+			GID:              gid,
+			Group:            group,
+			MemberLoginNames: memberNames,
+		})
+	}
+	slices.SortFunc(report.Groups, func(lhs, rhs PosixGroupReportEntry) int {
+		return cmp.Or(cmp.Compare(lhs.GID, rhs.GID), cmp.Compare(lhs.Group.Name, rhs.Group.Name))
+	})
+
+	for _, gid := range slices.Sorted(maps.Keys(groupNamesByGID)) {
+		names := groupNamesByGID[gid]
+		if len(names) > 1 {
+			slices.Sort(names)
+			report.Collisions = append(report.Collisions, PosixGIDCollision{GID: gid, GroupNames: names})
+		}
+	}
+
+	users = slices.Clone(users)
+	slices.SortFunc(users, func(lhs, rhs User) int { return cmp.Compare(lhs.LoginName, rhs.LoginName) })
+	for _, user := range users {
+		if user.POSIX == nil {
+			continue
+		}
+		gid := user.POSIX.GID
+		if len(groupNamesByGID[gid]) == 0 {
+			report.UsersWithUnknownGID = append(report.UsersWithUnknownGID, user)
+			continue
+		}
+		for idx := range report.Groups {
+			if report.Groups[idx].GID == gid {
+				report.Groups[idx].PrimaryLoginNames = append(report.Groups[idx].PrimaryLoginNames, user.LoginName)
+			}
+		}
+	}
+	return report
+}
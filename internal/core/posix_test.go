@@ -0,0 +1,93 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestBuildPosixGIDReport(t *testing.T) {
+	gid := func(id PosixID) *PosixID { return &id }
+	posixUser := func(loginName string, gid PosixID) User {
+		return User{LoginName: loginName, POSIX: &UserPosixAttributes{UID: 1000, GID: gid, HomeDirectory: "/home/" + loginName}}
+	}
+
+	users := []User{
+		posixUser("mallory", 4242),
+		posixUser("jane", 100),
+		posixUser("john", 200),
+		{LoginName: "alice"}, //not a POSIX user
+	}
+	groups := []Group{
+		{Name: "users", PosixGID: gid(100), MemberLoginNames: GroupMemberNames{"jane": true}, MemberGroupNames: GroupMemberNames{"staff": true}},
+		{Name: "staff", PosixGID: gid(200), MemberLoginNames: GroupMemberNames{"john": true, "alice": false}},
+		{Name: "ops", PosixGID: gid(200)},
+		{Name: "admins"}, //not a POSIX group
+	}
+	report := BuildPosixGIDReport(users, groups)
+
+	//groups are sorted by GID, and include members of nested groups
+	var summary [][]string
+	for _, entry := range report.Groups {
+		summary = append(summary, append([]string{entry.GID.String(), entry.Group.Name}, entry.MemberLoginNames...))
+	}
+	assert.DeepEqual(t, "groups", summary, [][]string{
+		{"100", "users", "jane", "john"},
+		{"200", "ops"},
+		{"200", "staff", "john"},
+	})
+	assert.DeepEqual(t, "primary users of group users", report.Groups[0].PrimaryLoginNames, []string{"jane"})
+	assert.DeepEqual(t, "primary users of group ops", report.Groups[1].PrimaryLoginNames, []string{"john"})
+	assert.DeepEqual(t, "primary users of group staff", report.Groups[2].PrimaryLoginNames, []string{"john"})
+
+	assert.DeepEqual(t, "collisions", report.Collisions, []PosixGIDCollision{
+		{GID: 200, GroupNames: []string{"ops", "staff"}},
+	})
+
+	var unknownNames []string
+	for _, user := range report.UsersWithUnknownGID {
+		unknownNames = append(unknownNames, user.LoginName)
+	}
+	assert.DeepEqual(t, "users with unknown GID", unknownNames, []string{"mallory"})
+}
+
+func TestPosixGroupLimitWarnings(t *testing.T) {
+	users := []User{
+		{LoginName: "jane", POSIX: &UserPosixAttributes{UID: 1000, GID: 100, HomeDirectory: "/home/jane"}},
+		{LoginName: "john", POSIX: &UserPosixAttributes{UID: 1001, GID: 100, HomeDirectory: "/home/john"}},
+		{LoginName: "alice"}, //not a POSIX user, so the limit does not apply
+	}
+	//jane and alice are in three POSIX groups besides the primary group (one
+	//of them through a nested group), john only in two
+	groups := []Group{
+		{Name: "users", PosixGID: gidPtr(100), MemberLoginNames: GroupMemberNames{"jane": true, "john": true}},
+		{Name: "dev", PosixGID: gidPtr(101), MemberLoginNames: GroupMemberNames{"jane": true, "john": true, "alice": true}},
+		{Name: "ops", PosixGID: gidPtr(102), MemberLoginNames: GroupMemberNames{"john": true, "alice": true}, MemberGroupNames: GroupMemberNames{"oncall": true}},
+		{Name: "oncall", PosixGID: gidPtr(103), MemberLoginNames: GroupMemberNames{"jane": true, "alice": true}},
+		{Name: "admins", MemberLoginNames: GroupMemberNames{"jane": true, "john": true, "alice": true}}, //not a POSIX group
+	}
+	db := Database{Users: users, Groups: groups}
+
+	cfg := *GetValidationConfigForTests()
+	cfg.PosixGroupLimit = 2
+	var messages []string
+	for _, w := range db.Warnings(&cfg) {
+		messages = append(messages, w.Error())
+	}
+	assert.DeepEqual(t, "warnings", messages, []string{
+		`field "memberships" in user "jane" includes 3 supplementary POSIX groups, more than the 2 that NFS with AUTH_SYS supports`,
+	})
+
+	cfg.PosixGroupLimit = 0
+	assert.DeepEqual(t, "warnings with disabled limit", len(db.Warnings(&cfg)), 0)
+}
+
+func gidPtr(id PosixID) *PosixID {
+	return &id
+}
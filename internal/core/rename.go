@@ -0,0 +1,160 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// FormerName appears in types User and Group. It records a name that the
+// object had before it was renamed, so that references from before the rename
+// (e.g. in tickets or logs) can still be resolved.
+type FormerName struct {
+	Name      string `json:"name"`
+	RenamedAt string `json:"renamed_at"` //in RFC 3339 format
+}
+
+// Returns the most recent of the given former names, or "" if there are none.
+func lastFormerName(names []FormerName) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return names[len(names)-1].Name
+}
+
+// MatchesFormerName returns whether the given name appears in the list.
+func MatchesFormerName(names []FormerName, name string) bool {
+	return slices.ContainsFunc(names, func(n FormerName) bool { return n.Name == name })
+}
+
+// RenameUser changes the login name of the given user, and updates all
+// references to it in groups, other users, join requests and access reviews.
+// The old login name is recorded in User.FormerLoginNames, and the change
+// history of the user continues under its new login name.
+//
+// The new login name is validated like any other login name in
+// Database.Validate(). The returned error only covers the cases that cannot be
+// reported there.
+func (d *Database) RenameUser(oldName, newName string, now time.Time) error {
+	idx := slices.IndexFunc(d.Users, func(u User) bool { return u.LoginName == oldName })
+	if idx == -1 {
+		return fmt.Errorf("user %q does not exist", oldName)
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, exists := d.Users.Find(func(u User) bool { return u.LoginName == newName }); exists {
+		return fmt.Errorf("user %q already exists", newName)
+	}
+	if slices.ContainsFunc(d.DeactivatedUsers, func(u DeactivatedUser) bool { return u.User.LoginName == newName }) {
+		return fmt.Errorf("login name %q %w", newName, errBelongsToDeactivatedUser)
+	}
+
+	user := &d.Users[idx]
+	user.LoginName = newName
+	user.FormerLoginNames = append(slices.Clone(user.FormerLoginNames), FormerName{
+		Name:      oldName,
+		RenamedAt: now.UTC().Format(time.RFC3339),
+	})
+
+	for gidx, group := range d.Groups {
+		if group.MemberLoginNames[oldName] {
+			group.MemberLoginNames[oldName] = false
+			group.MemberLoginNames[newName] = true
+		}
+		if validUntil, exists := group.MemberValidUntil[oldName]; exists {
+			delete(group.MemberValidUntil, oldName)
+			group.MemberValidUntil[newName] = validUntil
+		}
+		if group.OwnerLoginName == oldName {
+			d.Groups[gidx].OwnerLoginName = newName
+		}
+	}
+	for uidx, u := range d.Users {
+		if u.ManagerLoginName == oldName {
+			d.Users[uidx].ManagerLoginName = newName
+		}
+	}
+	for ridx, r := range d.JoinRequests {
+		if r.LoginName == oldName {
+			d.JoinRequests[ridx].LoginName = newName
+		}
+	}
+	for _, r := range d.AccessReviews {
+		for iidx, item := range r.Items {
+			if item.LoginName == oldName {
+				r.Items[iidx].LoginName = newName
+			}
+		}
+	}
+	for hidx, h := range d.UserHistory {
+		if h.Name == oldName {
+			d.UserHistory[hidx].Name = newName
+		}
+	}
+	return nil
+}
+
+// RenameGroup is like RenameUser, but for groups. The old name is recorded in
+// Group.FormerNames.
+func (d *Database) RenameGroup(oldName, newName string, now time.Time) error {
+	idx := slices.IndexFunc(d.Groups, func(g Group) bool { return g.Name == oldName })
+	if idx == -1 {
+		return fmt.Errorf("group %q does not exist", oldName)
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, exists := d.Groups.Find(func(g Group) bool { return g.Name == newName }); exists {
+		return fmt.Errorf("group %q already exists", newName)
+	}
+
+	group := &d.Groups[idx]
+	group.Name = newName
+	group.FormerNames = append(slices.Clone(group.FormerNames), FormerName{
+		Name:      oldName,
+		RenamedAt: now.UTC().Format(time.RFC3339),
+	})
+
+	for _, g := range d.Groups {
+		if g.MemberGroupNames[oldName] {
+			g.MemberGroupNames[oldName] = false
+			g.MemberGroupNames[newName] = true
+		}
+		if g.Permissions.LDAP.ReadGroupNames[oldName] {
+			g.Permissions.LDAP.ReadGroupNames[oldName] = false
+			g.Permissions.LDAP.ReadGroupNames[newName] = true
+		}
+	}
+	for uidx, u := range d.DeactivatedUsers {
+		for gidx, name := range u.GroupNames {
+			if name == oldName {
+				d.DeactivatedUsers[uidx].GroupNames[gidx] = newName
+			}
+		}
+	}
+	for ridx, r := range d.JoinRequests {
+		if r.GroupName == oldName {
+			d.JoinRequests[ridx].GroupName = newName
+		}
+	}
+	for _, r := range d.AccessReviews {
+		for iidx, item := range r.Items {
+			if item.GroupName == oldName {
+				r.Items[iidx].GroupName = newName
+			}
+		}
+	}
+	for hidx, h := range d.GroupHistory {
+		if h.Name == oldName {
+			d.GroupHistory[hidx].Name = newName
+		}
+	}
+	return nil
+}
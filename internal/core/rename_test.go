@@ -0,0 +1,87 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRenameUserAndGroup(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	vcfg.HistoryDepth = 10
+	nexus := NewNexus(nil, vcfg, &NoopHasher{})
+	admin := &UpdateOptions{Actor: Actor{Type: ActorTypeUser, Name: "admin"}}
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users = []User{
+			{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe"},
+			{LoginName: "john", GivenName: "John", FamilyName: "Doe", ManagerLoginName: "jane"},
+		}
+		db.Groups = []Group{
+			{Name: "staff", LongName: "Staff", MemberLoginNames: GroupMemberNames{"jane": true}, OwnerLoginName: "jane"},
+			{Name: "everyone", LongName: "Everyone", MemberGroupNames: GroupMemberNames{"staff": true}},
+		}
+		db.JoinRequests = []JoinRequest{{GroupName: "staff", LoginName: "john", RequestedAt: "2024-01-01"}}
+		return nil
+	}, nil))
+
+	//make a change before the rename, so that there is a history to carry over
+	expectNoErrors(t, nexus.Update(func(db *Database) errext.ErrorSet {
+		db.Users[0].FamilyName = "Smith"
+		return nil
+	}, admin))
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	rename := func(rename func(*Database) error) UpdateAction {
+		return func(db *Database) (errs errext.ErrorSet) {
+			errs.Add(rename(db))
+			return
+		}
+	}
+	expectNoErrors(t, nexus.Update(rename(func(db *Database) error { return db.RenameUser("jane", "jsmith", now) }), admin))
+	expectNoErrors(t, nexus.Update(rename(func(db *Database) error { return db.RenameGroup("staff", "employees", now) }), admin))
+
+	user, exists := nexus.FindUser(func(u User) bool { return u.LoginName == "jsmith" })
+	assert.DeepEqual(t, "renamed user exists", exists, true)
+	assert.DeepEqual(t, "former login names", user.FormerLoginNames, []FormerName{{Name: "jane", RenamedAt: "2024-05-01T12:00:00Z"}})
+	_, exists = nexus.FindUser(func(u User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "user exists under old name", exists, false)
+
+	//references are updated
+	john, _ := nexus.FindUser(func(u User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "manager after rename", john.ManagerLoginName, "jsmith")
+	group, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "employees" })
+	assert.DeepEqual(t, "members after rename", group.MemberLoginNames, GroupMemberNames{"jsmith": true})
+	assert.DeepEqual(t, "owner after rename", group.OwnerLoginName, "jsmith")
+	assert.DeepEqual(t, "former group names", group.FormerNames, []FormerName{{Name: "staff", RenamedAt: "2024-05-01T12:00:00Z"}})
+	parent, _ := nexus.FindGroup(func(g Group) bool { return g.Name == "everyone" })
+	assert.DeepEqual(t, "member groups after rename", parent.MemberGroupNames, GroupMemberNames{"employees": true})
+	requests := nexus.ListJoinRequests()
+	assert.DeepEqual(t, "join request after rename", requests[0].GroupName, "employees")
+
+	//the history continues under the new name, and is not split into a deletion
+	//of the old name and a creation of the new name
+	history, _ := nexus.FindUserHistory("jsmith")
+	assert.DeepEqual(t, "revision count after rename", len(history.Revisions), 3)
+	assert.DeepEqual(t, "changes in rename revision", history.ChangesIn(3), []FieldChange{
+		{Field: "former_login_names", OldValue: "", NewValue: `[{"name":"jane","renamed_at":"2024-05-01T12:00:00Z"}]`},
+		{Field: "login_name", OldValue: `"jane"`, NewValue: `"jsmith"`},
+	})
+	_, exists = nexus.FindUserHistory("jane")
+	assert.DeepEqual(t, "history exists under old name", exists, false)
+
+	//names that are in use cannot be taken
+	errs := nexus.Update(rename(func(db *Database) error { return db.RenameUser("john", "jsmith", now) }), admin)
+	assert.DeepEqual(t, "error for rename to existing user", errs.Join(", "), `user "jsmith" already exists`)
+	errs = nexus.Update(rename(func(db *Database) error { return db.RenameGroup("unknown", "other", now) }), admin)
+	assert.DeepEqual(t, "error for rename of unknown group", errs.Join(", "), `group "unknown" does not exist`)
+	errs = nexus.Update(rename(func(db *Database) error { return db.RenameUser("john", "John Doe", now) }), admin)
+	assert.DeepEqual(t, "rename to invalid login name is rejected", errs.IsEmpty(), false)
+}
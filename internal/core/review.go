@@ -0,0 +1,204 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// DateFormat is the format used for dates in the Database (and the format
+// produced by <input type="date">).
+const DateFormat = "2006-01-02"
+
+// AccessReview is a campaign in which the owners of groups confirm or remove
+// each membership in their groups. When the review is started, it takes a
+// snapshot of all group memberships, such that memberships added later on do
+// not show up in the review.
+type AccessReview struct {
+	Name      string             `json:"name"`
+	StartedBy string             `json:"started_by"`
+	StartedAt string             `json:"started_at"` //in DateFormat
+	Deadline  string             `json:"deadline"`   //in DateFormat
+	Items     []AccessReviewItem `json:"items"`
+}
+
+// AccessReviewItem appears in type AccessReview.
+type AccessReviewItem struct {
+	GroupName string               `json:"group"`
+	LoginName string               `json:"user"`
+	Decision  AccessReviewDecision `json:"decision,omitempty"`
+	DecidedBy string               `json:"decided_by,omitempty"`
+}
+
+// AccessReviewDecision is an enum that appears in type AccessReviewItem.
+type AccessReviewDecision string
+
+const (
+	// AccessReviewPending is the initial state of each AccessReviewItem.
+	AccessReviewPending AccessReviewDecision = ""
+	// AccessReviewConfirmed denotes that the membership shall be retained.
+	AccessReviewConfirmed AccessReviewDecision = "confirmed"
+	// AccessReviewRemoved denotes that the membership was removed.
+	AccessReviewRemoved AccessReviewDecision = "removed"
+)
+
+// NewAccessReview starts an AccessReview covering all memberships in the
+// given groups.
+func NewAccessReview(name, deadline string, startedBy string, now time.Time, groups []Group) AccessReview {
+	r := AccessReview{
+		Name:      name,
+		StartedBy: startedBy,
+		StartedAt: now.Format(DateFormat),
+		Deadline:  deadline,
+		Items:     []AccessReviewItem{},
+	}
+	for _, g := range groups {
+		for loginName, isMember := range g.MemberLoginNames {
+			if isMember {
+				r.Items = append(r.Items, AccessReviewItem{GroupName: g.Name, LoginName: loginName})
+			}
+		}
+	}
+	r.normalize()
+	return r
+}
+
+// Ref returns an ObjectRef that can be used to build validation errors.
+func (r AccessReview) Ref() ObjectRef {
+	return ObjectRef{
+		Type: "access review",
+		Name: r.Name,
+	}
+}
+
+// Cloned returns a deep copy of this review.
+func (r AccessReview) Cloned() AccessReview {
+	r.Items = slices.Clone(r.Items)
+	return r
+}
+
+func (r *AccessReview) normalize() {
+	sort.Slice(r.Items, func(i, j int) bool {
+		lhs, rhs := r.Items[i], r.Items[j]
+		if lhs.GroupName != rhs.GroupName {
+			return lhs.GroupName < rhs.GroupName
+		}
+		return lhs.LoginName < rhs.LoginName
+	})
+}
+
+// IsOverdue returns whether the deadline of this review has passed.
+func (r AccessReview) IsOverdue(now time.Time) bool {
+	return now.Format(DateFormat) > r.Deadline
+}
+
+// IsFlagged returns whether the given item needs the attention of an admin
+// because it was not decided on before the deadline.
+func (r AccessReview) IsFlagged(item AccessReviewItem, now time.Time) bool {
+	return item.Decision == AccessReviewPending && r.IsOverdue(now)
+}
+
+// CountItems returns how many items in this review have the given decision.
+// If a group name is given, only items for that group are counted.
+func (r AccessReview) CountItems(groupName string, decision AccessReviewDecision) (count int) {
+	for _, item := range r.Items {
+		if item.Decision == decision && (groupName == "" || item.GroupName == groupName) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r AccessReview) validate() (errs errext.ErrorSet) {
+	ref := r.Ref()
+	errs.Add(ref.Field("name").WrapFirst(
+		MustNotBeEmpty(r.Name),
+		mustBeAccessReviewName(r.Name),
+	))
+	errs.Add(ref.Field("deadline").WrapFirst(
+		MustNotBeEmpty(r.Deadline),
+		mustBeDate(r.Deadline),
+		mustNotBeBefore(r.Deadline, r.StartedAt),
+	))
+	//NOTE: Items may refer to groups or users that have been deleted since the
+	//review was started. This is not an error since it does not break anything.
+	for _, item := range r.Items {
+		switch item.Decision {
+		case AccessReviewPending, AccessReviewConfirmed, AccessReviewRemoved:
+		default:
+			err := fmt.Errorf("contains invalid decision %q for user %q in group %q",
+				item.Decision, item.LoginName, item.GroupName)
+			errs.Add(ref.Field("items").Wrap(err))
+		}
+	}
+	return errs
+}
+
+var (
+	errMalformedAccessReviewName = errors.New("may only contain lowercase letters, digits, dashes and underscores")
+	errMalformedDate             = errors.New("is not a valid date in the format YYYY-MM-DD")
+	errDeadlineBeforeStart       = errors.New("may not be before the start of the review")
+)
+
+func mustBeAccessReviewName(val string) error {
+	for _, r := range val {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return errMalformedAccessReviewName
+		}
+	}
+	return nil
+}
+
+func mustBeDate(val string) error {
+	_, err := time.Parse(DateFormat, val)
+	if err != nil {
+		return errMalformedDate
+	}
+	return nil
+}
+
+func mustNotBeBefore(deadline, startedAt string) error {
+	//both are in DateFormat, so they can be compared lexicographically
+	if deadline < startedAt {
+		return errDeadlineBeforeStart
+	}
+	return nil
+}
+
+// DecideAccessReviewItem records a decision for the given membership in the
+// given review. If the decision is AccessReviewRemoved, the membership is
+// removed as well.
+func (d *Database) DecideAccessReviewItem(reviewName, groupName, loginName string, decision AccessReviewDecision, decidedBy string) error {
+	for ridx, review := range d.AccessReviews {
+		if review.Name != reviewName {
+			continue
+		}
+		for iidx, item := range review.Items {
+			if item.GroupName != groupName || item.LoginName != loginName {
+				continue
+			}
+			d.AccessReviews[ridx].Items[iidx].Decision = decision
+			d.AccessReviews[ridx].Items[iidx].DecidedBy = decidedBy
+			if decision == AccessReviewRemoved {
+				for _, group := range d.Groups {
+					if group.Name == groupName && group.MemberLoginNames != nil {
+						group.MemberLoginNames[loginName] = false
+					}
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("access review %q does not cover user %q in group %q", reviewName, loginName, groupName)
+	}
+	return fmt.Errorf("access review %q does not exist", reviewName)
+}
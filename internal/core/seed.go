@@ -12,14 +12,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 
 	"github.com/majewsky/portunus/internal/crypt"
 	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/logg"
+	"gopkg.in/yaml.v3"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -29,35 +33,151 @@ import (
 type DatabaseSeed struct {
 	Groups []GroupSeed `json:"groups"`
 	Users  []UserSeed  `json:"users"`
+	//Service accounts always live below the primary suffix.
+	ServiceAccounts []ServiceAccountSeed `json:"service_accounts,omitempty"`
+	//Users and groups below the additional LDAP suffixes from
+	//PORTUNUS_LDAP_EXTRA_SUFFIXES, keyed by domain name. When the seed is read,
+	//these are moved into the lists above (with their Domain fields filled).
+	Domains map[string]DomainSeed `json:"domains,omitempty"`
+	//If true, users, groups and service accounts that do not appear in the
+	//seed are deleted.
+	Authoritative bool `json:"authoritative,omitempty"`
+	//Only used when the seed is split into multiple fragments (see
+	//readSeedFragments). If several fragments define the same object, the one
+	//with the highest priority owns it.
+	Priority int `json:"priority,omitempty"`
+	//Definitions from lower-priority fragments that were ignored because the
+	//respective object is owned by a different fragment.
+	Conflicts []SeedConflict `json:"-"`
+}
+
+// DomainSeed appears in type DatabaseSeed.
+type DomainSeed struct {
+	Groups []GroupSeed `json:"groups"`
+	Users  []UserSeed  `json:"users"`
 }
 
 // ReadDatabaseSeedFromEnvironment reads and validates the file at
-// PORTUNUS_SEED_PATH. If that environment variable was not provided, nil is
-// returned instead.
+// PORTUNUS_SEED_PATH, using the variables from ReadSeedVariablesFromEnvironment().
+// If PORTUNUS_SEED_PATH was not provided, nil is returned instead.
 func ReadDatabaseSeedFromEnvironment(cfg *ValidationConfig) (*DatabaseSeed, errext.ErrorSet) {
 	path := os.Getenv("PORTUNUS_SEED_PATH")
 	if path == "" {
 		return nil, nil
 	}
-	return ReadDatabaseSeed(path, cfg)
+	vars, err := ReadSeedVariablesFromEnvironment()
+	if err != nil {
+		return nil, errext.ErrorSet{err}
+	}
+	seed, errs := ReadDatabaseSeed(path, vars, cfg)
+	if seed != nil {
+		for _, c := range seed.Conflicts {
+			logg.Error("seed conflict: %s", c.String())
+		}
+	}
+	return seed, errs
 }
 
 // ReadDatabaseSeed reads and validates the seed file at the given path.
-func ReadDatabaseSeed(path string, cfg *ValidationConfig) (result *DatabaseSeed, errs errext.ErrorSet) {
-	buf, err := os.ReadFile(path)
+// Files with the extension ".yaml" or ".yml" are parsed as YAML, all other
+// files are parsed as JSON. Variable references like "${DOMAIN}" in string
+// values are expanded using the given variables.
+//
+// If the path refers to a directory, each seed file therein is read as one
+// fragment of the seed (see readSeedFragments).
+func ReadDatabaseSeed(path string, vars SeedVariables, cfg *ValidationConfig) (result *DatabaseSeed, errs errext.ErrorSet) {
+	fi, err := os.Stat(path)
 	if err != nil {
 		errs.Add(err)
 		return nil, errs
 	}
+	if fi.IsDir() {
+		return readSeedFragments(path, vars, cfg)
+	}
+
+	seed, err := readSeedFile(path, vars)
+	if err != nil {
+		errs.Add(err)
+		return nil, errs
+	}
+	seed.fillPosixDefaults(cfg)
+	return seed, seed.Validate(cfg)
+}
+
+// Parses a single seed file, but does not validate it yet.
+func readSeedFile(path string, vars SeedVariables) (*DatabaseSeed, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		buf, err = convertYAMLToJSON(buf)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing %s: %w", path, err)
+		}
+	}
+	buf, err = expandSeedVariables(buf, vars)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", path, err)
+	}
 	dec := json.NewDecoder(bytes.NewReader(buf))
 	dec.DisallowUnknownFields()
 	var seed DatabaseSeed
 	err = dec.Decode(&seed)
 	if err != nil {
-		errs.Addf("while parsing %s: %w", path, err)
-		return nil, errs
+		return nil, fmt.Errorf("while parsing %s: %w", path, err)
+	}
+	seed.mergeDomains()
+	return &seed, nil
+}
+
+// Moves the contents of d.Domains into d.Groups and d.Users.
+func (d *DatabaseSeed) mergeDomains() {
+	for _, domainName := range slices.Sorted(maps.Keys(d.Domains)) {
+		for _, groupSeed := range d.Domains[domainName].Groups {
+			groupSeed.Domain = domainName
+			d.Groups = append(d.Groups, groupSeed)
+		}
+		for _, userSeed := range d.Domains[domainName].Users {
+			userSeed.Domain = domainName
+			d.Users = append(d.Users, userSeed)
+		}
+	}
+	d.Domains = nil
+}
+
+// Fills the login shell and home directory of seeded POSIX users from the
+// defaults in `cfg`, where the seed does not give them explicitly.
+func (d *DatabaseSeed) fillPosixDefaults(cfg *ValidationConfig) {
+	for idx := range d.Users {
+		p := d.Users[idx].POSIX
+		if p == nil {
+			continue
+		}
+		if p.LoginShell == "" {
+			p.LoginShell = StringSeed(cfg.DefaultLoginShell)
+		}
+		if p.HomeDirectory == "" {
+			p.HomeDirectory = StringSeed(cfg.DefaultHomeDirectory(string(d.Users[idx].LoginName)))
+		}
+	}
+}
+
+// YAML seeds are converted into JSON before decoding, so that the same rules
+// apply to both formats (e.g. unknown fields are rejected).
+func convertYAMLToJSON(buf []byte) ([]byte, error) {
+	var data any
+	err := yaml.Unmarshal(buf, &data)
+	if err != nil {
+		return nil, err
 	}
-	return &seed, seed.Validate(cfg)
+	buf, err = json.Marshal(data)
+	if err != nil {
+		//this happens when a mapping has non-string keys, which JSON does not support
+		return nil, fmt.Errorf("cannot convert YAML to JSON: %w", err)
+	}
+	return buf, nil
 }
 
 // Validate returns an error if the seed contains any invalid or missing values.
@@ -92,6 +212,17 @@ func (d DatabaseSeed) Validate(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		}
 	}
 
+	serviceAccountNameCounts := make(map[string]int)
+	for _, serviceAccountSeed := range d.ServiceAccounts {
+		serviceAccountNameCounts[string(serviceAccountSeed.Name)]++
+	}
+	for name, count := range serviceAccountNameCounts {
+		if count > 1 {
+			ref := ServiceAccount{Name: name}.Ref()
+			errs.Add(ref.Field("name").Wrap(errIsDuplicateInSeed))
+		}
+	}
+
 	//non-nil-ness of posix.uid and posix.gid on UserSeeds cannot be checked in
 	//Database.Validate() because those fields are not pointers on type User
 	for _, userSeed := range d.Users {
@@ -133,6 +264,9 @@ func (d DatabaseSeed) ApplyTo(db *Database, hasher crypt.PasswordHasher) {
 
 	//same for the user seeds
 	for _, userSeed := range d.Users {
+		//seeded users cannot be deleted, so they cannot stay deactivated either
+		_ = db.RestoreUser(string(userSeed.LoginName))
+
 		hasUser := false
 		for idx, user := range db.Users {
 			if user.LoginName == string(userSeed.LoginName) {
@@ -148,11 +282,82 @@ func (d DatabaseSeed) ApplyTo(db *Database, hasher crypt.PasswordHasher) {
 		}
 	}
 
+	//same for the service account seeds
+	for _, serviceAccountSeed := range d.ServiceAccounts {
+		hasServiceAccount := false
+		for idx, serviceAccount := range db.ServiceAccounts {
+			if serviceAccount.Name == string(serviceAccountSeed.Name) {
+				serviceAccountSeed.ApplyTo(&db.ServiceAccounts[idx], hasher)
+				hasServiceAccount = true
+				break
+			}
+		}
+		if !hasServiceAccount {
+			serviceAccount := ServiceAccount{Name: string(serviceAccountSeed.Name)}
+			serviceAccountSeed.ApplyTo(&serviceAccount, hasher)
+			db.ServiceAccounts = append(db.ServiceAccounts, serviceAccount)
+		}
+	}
+
+	if d.Authoritative {
+		d.deleteUnseededObjects(db)
+	}
 	db.Normalize()
 }
 
+func (d DatabaseSeed) deleteUnseededObjects(db *Database) {
+	isSeededGroup := make(map[string]bool, len(d.Groups))
+	for _, groupSeed := range d.Groups {
+		isSeededGroup[string(groupSeed.Name)] = true
+	}
+	db.Groups = slices.DeleteFunc(db.Groups, func(g Group) bool {
+		return !isSeededGroup[g.Name]
+	})
+	for _, group := range db.Groups {
+		for name := range group.MemberGroupNames {
+			if !isSeededGroup[name] {
+				delete(group.MemberGroupNames, name)
+			}
+		}
+		for name := range group.Permissions.LDAP.ReadGroupNames {
+			if !isSeededGroup[name] {
+				delete(group.Permissions.LDAP.ReadGroupNames, name)
+			}
+		}
+	}
+
+	isSeededUser := make(map[string]bool, len(d.Users))
+	for _, userSeed := range d.Users {
+		isSeededUser[string(userSeed.LoginName)] = true
+	}
+	var unseededLoginNames []string
+	for _, user := range db.Users {
+		if !isSeededUser[user.LoginName] {
+			unseededLoginNames = append(unseededLoginNames, user.LoginName)
+		}
+	}
+	for _, loginName := range unseededLoginNames {
+		//DeleteUser() also cleans up group memberships etc.
+		_ = db.DeleteUser(loginName)
+	}
+
+	isSeededServiceAccount := make(map[string]bool, len(d.ServiceAccounts))
+	for _, serviceAccountSeed := range d.ServiceAccounts {
+		isSeededServiceAccount[string(serviceAccountSeed.Name)] = true
+	}
+	db.ServiceAccounts = slices.DeleteFunc(db.ServiceAccounts, func(s ServiceAccount) bool {
+		return !isSeededServiceAccount[s.Name]
+	})
+}
+
 var errSeededField = errors.New("must be equal to the seeded value")
 
+// IsSeedConflict returns whether this error was generated by CheckConflicts()
+// because a field deviates from its seeded value.
+func IsSeedConflict(err error) bool {
+	return errors.Is(err, errSeededField)
+}
+
 // CheckConflicts returns errors for all ways in which the Database deviates
 // from the seed's expectation.
 func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
@@ -163,9 +368,29 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 	rightDB := db.Cloned()
 	d.ApplyTo(&rightDB, hasher) //includes Normalize
 
-	//NOTE: We do not need to check for users/groups that exist on the left but
-	//not on the right, because seeding only ever creates and updates objects,
-	//but never deletes any objects.
+	//NOTE: Seeding only ever creates and updates objects, so users/groups that
+	//exist on the left but not on the right can only occur for an
+	//authoritative seed.
+	if d.Authoritative {
+		for _, leftGroup := range leftDB.Groups {
+			_, exists := rightDB.Groups.Find(func(g Group) bool { return g.Name == leftGroup.Name })
+			if !exists {
+				errs.Addf("group %q is not seeded and cannot exist because the seed is authoritative", leftGroup.Name)
+			}
+		}
+		for _, leftUser := range leftDB.Users {
+			_, exists := rightDB.Users.Find(func(u User) bool { return u.LoginName == leftUser.LoginName })
+			if !exists {
+				errs.Addf("user %q is not seeded and cannot exist because the seed is authoritative", leftUser.LoginName)
+			}
+		}
+		for _, leftServiceAccount := range leftDB.ServiceAccounts {
+			_, exists := rightDB.ServiceAccounts.Find(func(s ServiceAccount) bool { return s.Name == leftServiceAccount.Name })
+			if !exists {
+				errs.Addf("service account %q is not seeded and cannot exist because the seed is authoritative", leftServiceAccount.Name)
+			}
+		}
+	}
 
 	for _, rightGroup := range rightDB.Groups {
 		leftGroup, exists := leftDB.Groups.Find(func(g Group) bool { return g.Name == rightGroup.Name })
@@ -178,24 +403,66 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 		if leftGroup.LongName != rightGroup.LongName {
 			errs.Add(ref.Field("long_name").Wrap(errSeededField))
 		}
+		if leftGroup.Domain != rightGroup.Domain {
+			errs.Add(ref.Field("domain").Wrap(errSeededField))
+		}
 		if leftGroup.Permissions.Portunus.IsAdmin != rightGroup.Permissions.Portunus.IsAdmin {
 			errs.Add(ref.Field("portunus_perms").Wrap(errSeededField))
 		}
-		if leftGroup.Permissions.LDAP.CanRead != rightGroup.Permissions.LDAP.CanRead {
+		leftLDAPPerms, rightLDAPPerms := leftGroup.Permissions.LDAP, rightGroup.Permissions.LDAP
+		if leftLDAPPerms.CanRead != rightLDAPPerms.CanRead || leftLDAPPerms.CanReadUsers != rightLDAPPerms.CanReadUsers || leftLDAPPerms.CanReadGroups != rightLDAPPerms.CanReadGroups {
 			errs.Add(ref.Field("ldap_perms").Wrap(errSeededField))
 		}
+		if leftGroup.Permissions.LDAP.WriteSubtree != rightGroup.Permissions.LDAP.WriteSubtree {
+			errs.Add(ref.Field("ldap_write_subtree").Wrap(errSeededField))
+		}
 		if !reflect.DeepEqual(leftGroup.PosixGID, rightGroup.PosixGID) {
 			errs.Add(ref.Field("posix_gid").Wrap(errSeededField))
 		}
+		if leftGroup.EMailAddress != rightGroup.EMailAddress {
+			errs.Add(ref.Field("email").Wrap(errSeededField))
+		}
+		if leftGroup.OwnerLoginName != rightGroup.OwnerLoginName {
+			errs.Add(ref.Field("owner").Wrap(errSeededField))
+		}
+		if leftGroup.Notes != rightGroup.Notes {
+			errs.Add(ref.Field("notes").Wrap(errSeededField))
+		}
+		if !reflect.DeepEqual(leftGroup.DefaultMembership, rightGroup.DefaultMembership) {
+			errs.Add(ref.Field("default_membership").Wrap(errSeededField))
+		}
+		if leftGroup.IsJoinable != rightGroup.IsJoinable {
+			errs.Add(ref.Field("joinable").Wrap(errSeededField))
+		}
+		if leftGroup.IsHiddenFromLDAP != rightGroup.IsHiddenFromLDAP {
+			errs.Add(ref.Field("publish_to_ldap").Wrap(errSeededField))
+		}
+		if !reflect.DeepEqual(leftGroup.Labels, rightGroup.Labels) {
+			errs.Add(ref.Field("labels").Wrap(errSeededField))
+		}
 
-		//NOTE: Same logic as above. Seeds only ever add group memberships and
-		//never remove them, so we only need to check in one direction.
+		//NOTE: Seeds only ever add group memberships and never remove them
+		//(except for memberships of users deleted by an authoritative seed,
+		//which are covered above), so we only need to check in one direction.
 		for loginName, isRightMember := range rightGroup.MemberLoginNames {
 			if isRightMember && !leftGroup.MemberLoginNames[loginName] {
 				err := fmt.Errorf("must contain user %q because of seeded group membership", loginName)
 				errs.Add(ref.Field("members").Wrap(err))
 			}
 		}
+		for name, isRightMember := range rightGroup.MemberGroupNames {
+			if isRightMember && !leftGroup.MemberGroupNames[name] {
+				err := fmt.Errorf("must contain group %q because of seeded group membership", name)
+				errs.Add(ref.Field("member_groups").Wrap(err))
+			}
+		}
+		//same for seeded read access to individual groups
+		for name, isRightReadable := range rightGroup.Permissions.LDAP.ReadGroupNames {
+			if isRightReadable && !leftGroup.Permissions.LDAP.ReadGroupNames[name] {
+				err := fmt.Errorf("must contain group %q because of seeded read access", name)
+				errs.Add(ref.Field("ldap_read_groups").Wrap(err))
+			}
+		}
 	}
 
 	for _, rightUser := range rightDB.Users {
@@ -212,15 +479,44 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 		if leftUser.FamilyName != rightUser.FamilyName {
 			errs.Add(ref.Field("family_name").Wrap(errSeededField))
 		}
+		if leftUser.FamilyNameFirst != rightUser.FamilyNameFirst {
+			errs.Add(ref.Field("family_name_first").Wrap(errSeededField))
+		}
+		if leftUser.Domain != rightUser.Domain {
+			errs.Add(ref.Field("domain").Wrap(errSeededField))
+		}
 		if leftUser.EMailAddress != rightUser.EMailAddress {
 			errs.Add(ref.Field("email").Wrap(errSeededField))
 		}
+		if leftUser.TelephoneNumber != rightUser.TelephoneNumber {
+			errs.Add(ref.Field("telephone_number").Wrap(errSeededField))
+		}
+		if leftUser.MobileNumber != rightUser.MobileNumber {
+			errs.Add(ref.Field("mobile").Wrap(errSeededField))
+		}
+		if leftUser.PostalAddress != rightUser.PostalAddress {
+			errs.Add(ref.Field("postal_address").Wrap(errSeededField))
+		}
+		if leftUser.ManagerLoginName != rightUser.ManagerLoginName {
+			errs.Add(ref.Field("manager").Wrap(errSeededField))
+		}
 		if !reflect.DeepEqual(leftUser.SSHPublicKeys, rightUser.SSHPublicKeys) {
 			errs.Add(ref.Field("ssh_public_keys").Wrap(errSeededField))
 		}
+		if !reflect.DeepEqual(leftUser.HiddenLDAPAttributes, rightUser.HiddenLDAPAttributes) {
+			errs.Add(ref.Field("hidden_ldap_attributes").Wrap(errSeededField))
+		}
 		if leftUser.PasswordHash != rightUser.PasswordHash {
 			errs.Add(ref.Field("password").Wrap(errSeededField))
 		}
+		if !reflect.DeepEqual(leftUser.Labels, rightUser.Labels) {
+			errs.Add(ref.Field("labels").Wrap(errSeededField))
+		}
+		for _, name := range slices.Sorted(maps.Keys(rightUser.ExtraAttributes)) {
+			if leftUser.ExtraAttributes[name] != rightUser.ExtraAttributes[name] {
+				errs.Add(ref.Field("extra_attributes." + name).Wrap(errSeededField))
+			}
+		}
 		if (leftUser.POSIX == nil) != (rightUser.POSIX == nil) {
 			errs.Add(ref.Field("posix").Wrap(errSeededField))
 		}
@@ -246,9 +542,42 @@ func (d DatabaseSeed) CheckConflicts(db Database, hasher crypt.PasswordHasher) (
 		}
 	}
 
+	for _, rightServiceAccount := range rightDB.ServiceAccounts {
+		leftServiceAccount, exists := leftDB.ServiceAccounts.Find(func(s ServiceAccount) bool { return s.Name == rightServiceAccount.Name })
+		if !exists {
+			errs.Addf("service account %q is seeded and cannot be deleted", rightServiceAccount.Name)
+			continue
+		}
+
+		ref := leftServiceAccount.Ref()
+		if leftServiceAccount.Description != rightServiceAccount.Description {
+			errs.Add(ref.Field("description").Wrap(errSeededField))
+		}
+		if leftServiceAccount.PasswordHash != rightServiceAccount.PasswordHash {
+			errs.Add(ref.Field("password").Wrap(errSeededField))
+		}
+		if leftServiceAccount.ReadScopes != rightServiceAccount.ReadScopes {
+			errs.Add(ref.Field("read_scopes").Wrap(errSeededField))
+		}
+	}
+
 	return errs
 }
 
+// CheckAgainstDatabase simulates what happens when this seed is applied to the
+// given Database on startup. The first return value lists all changes that
+// applying the seed would make (in the same format as CheckConflicts()). The
+// second return value lists all validation errors in the resulting Database,
+// e.g. when existing unseeded users have names that are not acceptable under
+// the given ValidationConfig.
+func (d DatabaseSeed) CheckAgainstDatabase(db Database, cfg *ValidationConfig, hasher crypt.PasswordHasher) (changes, errs errext.ErrorSet) {
+	newDB := db.Cloned()
+	newDB.Normalize()
+	changes = d.CheckConflicts(newDB, hasher)
+	d.ApplyTo(&newDB, hasher)
+	return changes, newDB.Validate(cfg)
+}
+
 // Initializes the Database from the given seed on first use.
 // If the seed is nil, the default initialization behavior is used.
 func initializeDatabase(d *DatabaseSeed, hasher crypt.PasswordHasher) Database {
@@ -287,18 +616,37 @@ func initializeDatabase(d *DatabaseSeed, hasher crypt.PasswordHasher) Database {
 
 // GroupSeed contains the seeded configuration for a single group.
 type GroupSeed struct {
-	Name             StringSeed   `json:"name"`
-	LongName         StringSeed   `json:"long_name"`
+	Name     StringSeed `json:"name"`
+	LongName StringSeed `json:"long_name"`
+	//Domain is not read from the seed file directly, but filled from the
+	//section in DatabaseSeed.Domains that this seed appears in.
+	Domain string `json:"-"`
+	//Fragment is the file name of the seed fragment that owns this group. It is
+	//empty if the seed is not split into fragments.
+	Fragment         string       `json:"-"`
 	MemberLoginNames []StringSeed `json:"members"`
+	MemberGroupNames []StringSeed `json:"member_groups"`
 	Permissions      struct {
 		Portunus struct {
 			IsAdmin *bool `json:"is_admin"`
 		} `json:"portunus"`
 		LDAP struct {
-			CanRead *bool `json:"can_read"`
+			CanRead       *bool        `json:"can_read"`
+			CanReadUsers  *bool        `json:"can_read_users"`
+			CanReadGroups *bool        `json:"can_read_groups"`
+			ReadGroups    []StringSeed `json:"read_groups"`
+			WriteSubtree  StringSeed   `json:"write_subtree"`
 		} `json:"ldap"`
 	} `json:"permissions"`
-	PosixGID *PosixID `json:"posix_gid"`
+	PosixGID       *PosixID   `json:"posix_gid"`
+	EMailAddress   StringSeed `json:"email"`
+	OwnerLoginName StringSeed `json:"owner"`
+	Notes          StringSeed `json:"notes"`
+
+	DefaultMembership *DefaultMembershipRules `json:"default_membership"`
+	IsJoinable        *bool                   `json:"joinable"`
+	IsHiddenFromLDAP  *bool                   `json:"hidden_from_ldap"`
+	Labels            map[string]StringSeed   `json:"labels"`
 }
 
 // ApplyTo changes the attributes of this group to conform to the given seed.
@@ -310,6 +658,7 @@ func (g GroupSeed) ApplyTo(target *Group) {
 	}
 
 	target.LongName = string(g.LongName)
+	target.Domain = g.Domain
 
 	if target.MemberLoginNames == nil {
 		target.MemberLoginNames = make(GroupMemberNames)
@@ -317,6 +666,12 @@ func (g GroupSeed) ApplyTo(target *Group) {
 	for _, loginName := range g.MemberLoginNames {
 		target.MemberLoginNames[string(loginName)] = true
 	}
+	if len(g.MemberGroupNames) > 0 && target.MemberGroupNames == nil {
+		target.MemberGroupNames = make(GroupMemberNames)
+	}
+	for _, name := range g.MemberGroupNames {
+		target.MemberGroupNames[string(name)] = true
+	}
 
 	if g.Permissions.Portunus.IsAdmin != nil {
 		target.Permissions.Portunus.IsAdmin = *g.Permissions.Portunus.IsAdmin
@@ -324,9 +679,61 @@ func (g GroupSeed) ApplyTo(target *Group) {
 	if g.Permissions.LDAP.CanRead != nil {
 		target.Permissions.LDAP.CanRead = *g.Permissions.LDAP.CanRead
 	}
+	if g.Permissions.LDAP.CanReadUsers != nil {
+		target.Permissions.LDAP.CanReadUsers = *g.Permissions.LDAP.CanReadUsers
+	}
+	if g.Permissions.LDAP.CanReadGroups != nil {
+		target.Permissions.LDAP.CanReadGroups = *g.Permissions.LDAP.CanReadGroups
+	}
+	if len(g.Permissions.LDAP.ReadGroups) > 0 && target.Permissions.LDAP.ReadGroupNames == nil {
+		target.Permissions.LDAP.ReadGroupNames = make(GroupMemberNames)
+	}
+	for _, name := range g.Permissions.LDAP.ReadGroups {
+		target.Permissions.LDAP.ReadGroupNames[string(name)] = true
+	}
+	if g.Permissions.LDAP.WriteSubtree != "" {
+		target.Permissions.LDAP.WriteSubtree = string(g.Permissions.LDAP.WriteSubtree)
+	}
 	if g.PosixGID != nil {
 		target.PosixGID = g.PosixGID
 	}
+	if g.EMailAddress != "" {
+		target.EMailAddress = string(g.EMailAddress)
+	}
+	if g.OwnerLoginName != "" {
+		target.OwnerLoginName = string(g.OwnerLoginName)
+	}
+	if g.Notes != "" {
+		target.Notes = string(g.Notes)
+	}
+	if g.DefaultMembership != nil {
+		target.DefaultMembership = DefaultMembershipRules{
+			ForAllUsers:     g.DefaultMembership.ForAllUsers,
+			ForEMailDomains: slices.Clone(g.DefaultMembership.ForEMailDomains),
+		}
+	}
+	if g.IsJoinable != nil {
+		target.IsJoinable = *g.IsJoinable
+	}
+	if g.IsHiddenFromLDAP != nil {
+		target.IsHiddenFromLDAP = *g.IsHiddenFromLDAP
+	}
+	target.Labels = applyMapSeeds(target.Labels, g.Labels)
+}
+
+// Seeded labels (or extra attributes) are enforced, but keys not mentioned in
+// the seed are left alone, so that they can be maintained through other means.
+func applyMapSeeds[M ~map[string]string](target M, seeds map[string]StringSeed) M {
+	if len(seeds) == 0 {
+		return target
+	}
+	if target == nil {
+		target = make(M, len(seeds))
+	}
+	for key, value := range seeds {
+		target[key] = string(value)
+	}
+	return target
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -337,16 +744,31 @@ type UserSeed struct {
 	LoginName     StringSeed   `json:"login_name"`
 	GivenName     StringSeed   `json:"given_name"`
 	FamilyName    StringSeed   `json:"family_name"`
+	Domain        string       `json:"-"` //like GroupSeed.Domain
+	Fragment      string       `json:"-"` //like GroupSeed.Fragment
 	EMailAddress  StringSeed   `json:"email"`
 	SSHPublicKeys []StringSeed `json:"ssh_public_keys"`
 	Password      StringSeed   `json:"password"`
-	POSIX         *struct {
+	//PostalAddress uses "\n" to separate lines, like User.PostalAddress.
+	TelephoneNumber StringSeed `json:"telephone_number"`
+	MobileNumber    StringSeed `json:"mobile"`
+	PostalAddress   StringSeed `json:"postal_address"`
+	//The referenced user must be defined statically as well.
+	ManagerLoginName StringSeed `json:"manager"`
+	POSIX            *struct {
 		UID           *PosixID   `json:"uid"`
 		GID           *PosixID   `json:"gid"`
 		HomeDirectory StringSeed `json:"home"`
 		LoginShell    StringSeed `json:"shell"`
 		GECOS         StringSeed `json:"gecos"`
 	} `json:"posix"`
+	Labels          map[string]StringSeed `json:"labels"`
+	ExtraAttributes map[string]StringSeed `json:"extra_attributes"`
+	//Unlike for SSHPublicKeys, an empty list is applied as well (to enforce
+	//that all attributes are published).
+	HiddenLDAPAttributes []StringSeed `json:"hidden_ldap_attributes"`
+	//If not given, the name order is not enforced.
+	FamilyNameFirst *bool `json:"family_name_first"`
 }
 
 // ApplyTo changes the attributes of this group to conform to the given seed.
@@ -359,9 +781,25 @@ func (u UserSeed) ApplyTo(target *User, hasher crypt.PasswordHasher) {
 
 	target.GivenName = string(u.GivenName)
 	target.FamilyName = string(u.FamilyName)
+	if u.FamilyNameFirst != nil {
+		target.FamilyNameFirst = *u.FamilyNameFirst
+	}
+	target.Domain = u.Domain
 	if u.EMailAddress != "" {
 		target.EMailAddress = string(u.EMailAddress)
 	}
+	if u.TelephoneNumber != "" {
+		target.TelephoneNumber = string(u.TelephoneNumber)
+	}
+	if u.MobileNumber != "" {
+		target.MobileNumber = string(u.MobileNumber)
+	}
+	if u.PostalAddress != "" {
+		target.PostalAddress = string(u.PostalAddress)
+	}
+	if u.ManagerLoginName != "" {
+		target.ManagerLoginName = string(u.ManagerLoginName)
+	}
 
 	if len(u.SSHPublicKeys) > 0 {
 		target.SSHPublicKeys = nil
@@ -370,18 +808,17 @@ func (u UserSeed) ApplyTo(target *User, hasher crypt.PasswordHasher) {
 		}
 	}
 
-	if u.Password != "" {
-		//to avoid useless rehashing, the password is only applied:
-		//- on creation (when no PasswordHash exists),
-		//- on method mismatch (i.e. when the hasher wants us to change hash methods), or
-		//- on password mismatch (i.e. when the password is updated in the seed)
-		pw := string(u.Password)
-		hash := target.PasswordHash
-		if hash == "" || hasher.IsWeakHash(hash) || !hasher.CheckPasswordHash(pw, hash) {
-			target.PasswordHash = hasher.HashPassword(pw)
+	if u.HiddenLDAPAttributes != nil {
+		target.HiddenLDAPAttributes = nil
+		for _, name := range u.HiddenLDAPAttributes {
+			target.HiddenLDAPAttributes = append(target.HiddenLDAPAttributes, string(name))
 		}
 	}
 
+	if u.Password != "" {
+		target.PasswordHash = applyPasswordSeed(target.PasswordHash, string(u.Password), hasher)
+	}
+
 	if u.POSIX != nil {
 		if target.POSIX == nil {
 			target.POSIX = &UserPosixAttributes{}
@@ -404,6 +841,57 @@ func (u UserSeed) ApplyTo(target *User, hasher crypt.PasswordHasher) {
 			target.POSIX.GECOS = string(p.GECOS)
 		}
 	}
+
+	target.Labels = applyMapSeeds(target.Labels, u.Labels)
+	target.ExtraAttributes = applyMapSeeds(target.ExtraAttributes, u.ExtraAttributes)
+}
+
+// To avoid useless rehashing, the password is only applied:
+// - on creation (when no PasswordHash exists),
+// - on method mismatch (i.e. when the hasher wants us to change hash methods), or
+// - on password mismatch (i.e. when the password is updated in the seed)
+func applyPasswordSeed(hash, password string, hasher crypt.PasswordHasher) string {
+	if hash == "" || hasher.IsWeakHash(hash) || !hasher.CheckPasswordHash(password, hash) {
+		return hasher.HashPassword(password)
+	}
+	return hash
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type ServiceAccountSeed
+
+// ServiceAccountSeed contains the seeded configuration for a single service account.
+type ServiceAccountSeed struct {
+	Name        StringSeed `json:"name"`
+	Fragment    string     `json:"-"` //like GroupSeed.Fragment
+	Description StringSeed `json:"description"`
+	Password    StringSeed `json:"password"`
+	ReadScopes  struct {
+		Users  *bool `json:"users"`
+		Groups *bool `json:"groups"`
+	} `json:"read_scopes"`
+}
+
+// ApplyTo changes the attributes of this service account to conform to the given seed.
+func (s ServiceAccountSeed) ApplyTo(target *ServiceAccount, hasher crypt.PasswordHasher) {
+	//consistency check (the caller must ensure that the seed matches the object)
+	if target.Name != string(s.Name) {
+		panic(fmt.Sprintf("cannot apply seed with Name = %q to service account with Name = %q",
+			string(s.Name), target.Name))
+	}
+
+	if s.Description != "" {
+		target.Description = string(s.Description)
+	}
+	if s.Password != "" {
+		target.PasswordHash = applyPasswordSeed(target.PasswordHash, string(s.Password), hasher)
+	}
+	if s.ReadScopes.Users != nil {
+		target.ReadScopes.Users = *s.ReadScopes.Users
+	}
+	if s.ReadScopes.Groups != nil {
+		target.ReadScopes.Groups = *s.ReadScopes.Groups
+	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -8,6 +8,10 @@ package core
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sort"
 	"testing"
 
@@ -36,7 +40,13 @@ func dbWithBasicSeedApplied() Database {
 				Permissions: Permissions{
 					LDAP: LDAPPermissions{CanRead: true},
 				},
-				PosixGID: pointerTo(PosixID(23)),
+				PosixGID:       pointerTo(PosixID(23)),
+				EMailAddress:   "maxgroup@example.org",
+				OwnerLoginName: "maxuser",
+				Notes:          "Maximal notes",
+				DefaultMembership: DefaultMembershipRules{
+					ForEMailDomains: []string{"example.org"},
+				},
 			},
 			{
 				Name:             "mingroup",
@@ -84,6 +94,10 @@ func reducerOverwriteSeededAttrs1(hasher crypt.PasswordHasher) func(*Database) e
 		db.Groups[0].Permissions.Portunus.IsAdmin = true
 		db.Groups[0].Permissions.LDAP.CanRead = false
 		db.Groups[0].PosixGID = pointerTo(*db.Groups[0].PosixGID + 1)
+		db.Groups[0].EMailAddress = "changed@example.org"
+		db.Groups[0].OwnerLoginName = "minuser"
+		db.Groups[0].Notes += "-changed"
+		db.Groups[0].DefaultMembership.ForAllUsers = true
 		db.Users[0].GivenName += "-changed"
 		db.Users[0].FamilyName += "-changed"
 		db.Users[0].EMailAddress = "changed@example.org"
@@ -113,8 +127,9 @@ func reducerOverwriteSeededIdentifiers(db *Database) errext.ErrorSet {
 	db.Groups[0].Name += "-renamed"
 	db.Users[0].LoginName += "-renamed"
 
-	//avoid complaints about an invalid group membership (that's not what we're testing here)
+	//avoid complaints about an invalid group membership or owner (that's not what we're testing here)
 	db.Groups[0].MemberLoginNames[previousUserName] = false
+	db.Groups[0].OwnerLoginName = ""
 
 	return nil
 }
@@ -146,6 +161,10 @@ func reducerOverwriteUnseededAttributes(hasher crypt.PasswordHasher) func(*Datab
 		db.Groups[1].Permissions.Portunus.IsAdmin = true
 		db.Groups[1].Permissions.LDAP.CanRead = true
 		db.Groups[1].PosixGID = pointerTo(PosixID(123))
+		db.Groups[1].EMailAddress = "mingroup@example.org"
+		db.Groups[1].OwnerLoginName = "minuser"
+		db.Groups[1].Notes = "Minimal notes"
+		db.Groups[1].DefaultMembership.ForEMailDomains = []string{"example.com"}
 		db.Users[1].EMailAddress = "minuser@example.org"
 		db.Users[1].SSHPublicKeys = []string{dummySSHPublicKey}
 		db.Users[1].PasswordHash = hasher.HashPassword("qwerty")
@@ -169,7 +188,7 @@ func TestSeedEnforcementRelaxed(t *testing.T) {
 	defer cancel()
 
 	vcfg := GetValidationConfigForTests()
-	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", vcfg)
+	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", nil, vcfg)
 	expectNoErrors(t, errs)
 
 	//register a listener to observe the real DB changes
@@ -226,7 +245,7 @@ func TestSeedEnforcementStrict(t *testing.T) {
 	defer cancel()
 
 	vcfg := GetValidationConfigForTests()
-	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", vcfg)
+	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", nil, vcfg)
 	expectNoErrors(t, errs)
 
 	//register a listener to observe the real DB changes
@@ -256,6 +275,10 @@ func TestSeedEnforcementStrict(t *testing.T) {
 		`field "portunus_perms" in group "maxgroup" must be equal to the seeded value`,
 		`field "ldap_perms" in group "maxgroup" must be equal to the seeded value`,
 		`field "posix_gid" in group "maxgroup" must be equal to the seeded value`,
+		`field "email" in group "maxgroup" must be equal to the seeded value`,
+		`field "owner" in group "maxgroup" must be equal to the seeded value`,
+		`field "notes" in group "maxgroup" must be equal to the seeded value`,
+		`field "default_membership" in group "maxgroup" must be equal to the seeded value`,
 		`field "given_name" in user "maxuser" must be equal to the seeded value`,
 		`field "family_name" in user "maxuser" must be equal to the seeded value`,
 		`field "email" in user "maxuser" must be equal to the seeded value`,
@@ -274,6 +297,9 @@ func TestSeedEnforcementStrict(t *testing.T) {
 		`field "posix" in user "maxuser" must be equal to the seeded value`,
 	)
 	assert.DeepEqual(t, "update count", updateCount, 1) //same as before (listener was not called)
+	if !IsSeedConflict(errs[0]) {
+		t.Error("expected IsSeedConflict() to recognize the error from the previous update")
+	}
 
 	//renaming seeded objects is not allowed
 	errs = nexus.Update(reducerOverwriteSeededIdentifiers, &opts)
@@ -306,17 +332,210 @@ func TestSeedEnforcementStrict(t *testing.T) {
 	assert.DeepEqual(t, "update count", updateCount, 3)
 }
 
+func TestSeedInYAMLFormat(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	jsonSeed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", nil, vcfg)
+	expectNoErrors(t, errs)
+	yamlSeed, errs := ReadDatabaseSeed("fixtures/seed-basic.yaml", nil, vcfg)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "seed contents", yamlSeed, jsonSeed)
+
+	//YAML seeds are parsed with the same strict rules as JSON seeds
+	_, errs = ReadDatabaseSeed("fixtures/seed-parse-error-1.yaml", nil, vcfg)
+	expectTheseErrors(t, errs,
+		`while parsing fixtures/seed-parse-error-1.yaml: json: unknown field "unknown_attribute"`,
+	)
+}
+
+func TestSeedWithVariables(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	expectedSeed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", nil, vcfg)
+	expectNoErrors(t, errs)
+
+	//values from the environment take precedence over the values file
+	t.Setenv("PORTUNUS_SEED_PATH", "fixtures/seed-templated.yaml")
+	t.Setenv("PORTUNUS_SEED_VALUES_PATH", "fixtures/seed-values.yaml")
+	t.Setenv("PORTUNUS_SEED_VAR_DEFAULT_SHELL", "/bin/bash")
+	actualSeed, errs := ReadDatabaseSeedFromEnvironment(vcfg)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "seed contents", actualSeed, expectedSeed)
+
+	//undefined variables are reported without making up a value
+	_, errs = ReadDatabaseSeed("fixtures/seed-templated.yaml", SeedVariables{"DOMAIN": "example.org"}, vcfg)
+	expectTheseErrors(t, errs,
+		`while parsing fixtures/seed-templated.yaml: undefined seed variables: ${DEFAULT_SHELL}`,
+	)
+
+	//"$${" escapes a literal "${", other dollar signs are left alone
+	buf, err := expandSeedVariables([]byte(`{"a":["$${DOMAIN}","$6$${DOMAIN}$", "${DOMAIN}"]}`), SeedVariables{"DOMAIN": "example.org"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "expanded JSON", string(buf), `{"a":["${DOMAIN}","$6${DOMAIN}$","example.org"]}`)
+}
+
+func TestSeedWithDomains(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	_, errs := ReadDatabaseSeed("fixtures/seed-domains.yaml", nil, vcfg)
+	expectTheseErrors(t, errs,
+		`field "domain" in user "carol" is not one of the domains from PORTUNUS_LDAP_EXTRA_SUFFIXES`,
+	)
+
+	vcfg.Domains = []string{"example.com", "example.net"}
+	seed, errs := ReadDatabaseSeed("fixtures/seed-domains.yaml", nil, vcfg)
+	expectNoErrors(t, errs)
+	var db Database
+	seed.ApplyTo(&db, &NoopHasher{})
+
+	domainOfUser := make(map[string]string)
+	for _, u := range db.Users {
+		domainOfUser[u.LoginName] = u.Domain
+	}
+	assert.DeepEqual(t, "user domains", domainOfUser, map[string]string{
+		"alice": "",
+		"bob":   "example.net",
+		"carol": "example.com",
+	})
+	domainOfGroup := make(map[string]string)
+	for _, g := range db.Groups {
+		domainOfGroup[g.Name] = g.Domain
+	}
+	assert.DeepEqual(t, "group domains", domainOfGroup, map[string]string{
+		"admins": "",
+		"staff":  "example.net",
+	})
+
+	//the domain of seeded objects is enforced
+	db.Users[1].Domain = ""
+	expectTheseErrors(t, seed.CheckConflicts(db, &NoopHasher{}),
+		`field "domain" in user "bob" must be equal to the seeded value`,
+	)
+}
+
+func TestSeedWithPosixDefaults(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	_, errs := ReadDatabaseSeed("fixtures/seed-posix-defaults.yaml", nil, vcfg)
+	expectTheseErrors(t, errs,
+		`field "posix_home" in user "alice" is missing`,
+	)
+
+	//the defaults only apply where the seed does not give explicit values
+	vcfg.DefaultLoginShell = "/bin/bash"
+	vcfg.DefaultHomePrefix = "/home"
+	seed, errs := ReadDatabaseSeed("fixtures/seed-posix-defaults.yaml", nil, vcfg)
+	expectNoErrors(t, errs)
+	var db Database
+	seed.ApplyTo(&db, &NoopHasher{})
+
+	posixPathsOfUser := make(map[string]string)
+	for _, u := range db.Users {
+		posixPathsOfUser[u.LoginName] = u.POSIX.HomeDirectory + " " + u.POSIX.LoginShell
+	}
+	assert.DeepEqual(t, "POSIX paths", posixPathsOfUser, map[string]string{
+		"alice": "/home/alice /bin/bash",
+		"bob":   "/srv/bob /bin/zsh",
+	})
+
+	//the defaults are enforced like any other seeded value
+	db.Users[0].POSIX.LoginShell = ""
+	expectTheseErrors(t, seed.CheckConflicts(db, &NoopHasher{}),
+		`field "posix_shell" in user "alice" must be equal to the seeded value`,
+	)
+}
+
+func TestSeedWithServiceAccounts(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-service-accounts.yaml", nil, vcfg)
+	expectNoErrors(t, errs)
+	var db Database
+	seed.ApplyTo(&db, &NoopHasher{})
+	assert.DeepEqual(t, "service accounts", db.ServiceAccounts, ObjectList[ServiceAccount]{
+		{
+			Name:         "grafana",
+			Description:  "Grafana login",
+			PasswordHash: "{PLAINTEXT}swordfish",
+			ReadScopes:   ServiceAccountScopes{Users: true},
+		},
+		{
+			Name:         "nextcloud",
+			PasswordHash: "{PLAINTEXT}hunter2",
+			ReadScopes:   ServiceAccountScopes{Users: true, Groups: true},
+		},
+	})
+
+	//seeded service accounts and their attributes are enforced
+	db.ServiceAccounts[0].ReadScopes.Users = false
+	db.ServiceAccounts = db.ServiceAccounts[:1]
+	expectTheseErrors(t, seed.CheckConflicts(db, &NoopHasher{}),
+		`field "read_scopes" in service account "grafana" must be equal to the seeded value`,
+		`service account "nextcloud" is seeded and cannot be deleted`,
+	)
+}
+
+func TestSeedFragments(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-fragments", nil, vcfg)
+	expectNoErrors(t, errs)
+
+	//each object is owned by exactly one fragment
+	owners := make(map[string]string)
+	for _, g := range seed.Groups {
+		owners["group "+string(g.Name)] = g.Fragment
+	}
+	for _, u := range seed.Users {
+		owners["user "+string(u.LoginName)] = u.Fragment
+	}
+	for _, s := range seed.ServiceAccounts {
+		owners["service account "+string(s.Name)] = s.Fragment
+	}
+	assert.DeepEqual(t, "owners", owners, map[string]string{
+		"group admins":            "00-platform.yaml",
+		"group team-a":            "team-a.json",
+		"user alice":              "00-platform.yaml",
+		"user bob":                "team-a.json",
+		"service account grafana": "team-b.yml",
+	})
+
+	//the lower-priority definition of an object that is owned by another
+	//fragment is ignored entirely, but reported
+	var db Database
+	seed.ApplyTo(&db, &NoopHasher{})
+	admins, _ := db.Groups.Find(func(g Group) bool { return g.Name == "admins" })
+	assert.DeepEqual(t, "long name of admins", admins.LongName, "Administrators")
+	assert.DeepEqual(t, "members of admins", admins.MemberLoginNames, GroupMemberNames{"alice": true})
+	assert.DeepEqual(t, "problems", BuildSeedReport(seed, errs, vcfg).Problems, []SeedProblem{{
+		ObjectType: "group",
+		ObjectName: "admins",
+		Message:    `is also seeded by "team-a.json", but that definition is ignored because "00-platform.yaml" has a higher priority`,
+	}})
+
+	//if no single fragment has the highest priority, there is no owner
+	dirPath := t.TempDir()
+	for _, fileName := range []string{"team-a.json", "team-b.json"} {
+		err := os.WriteFile(filepath.Join(dirPath, fileName), []byte(`{
+			"users": [ { "login_name": "jane", "given_name": "Jane", "family_name": "Doe" } ]
+		}`), 0o666)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	_, errs = ReadDatabaseSeed(dirPath, nil, vcfg)
+	expectTheseErrors(t, errs,
+		`field "login_name" in user "jane" is seeded by both "team-a.json" and "team-b.json" with the same priority`,
+	)
+}
+
 func TestSeedParseAndValidationErrors(t *testing.T) {
 	vcfg := GetValidationConfigForTests()
 
 	//test a seed file with unknown attributes (we parse with strict rules)
-	_, errs := ReadDatabaseSeed("fixtures/seed-parse-error-1.json", vcfg)
+	_, errs := ReadDatabaseSeed("fixtures/seed-parse-error-1.json", nil, vcfg)
 	expectTheseErrors(t, errs,
 		`while parsing fixtures/seed-parse-error-1.json: json: unknown field "unknown_attribute"`,
 	)
 
 	//test a seed file with a malformatted command substitution
-	_, errs = ReadDatabaseSeed("fixtures/seed-parse-error-2.json", vcfg)
+	_, errs = ReadDatabaseSeed("fixtures/seed-parse-error-2.json", nil, vcfg)
 	expectTheseErrors(t, errs,
 		`while parsing fixtures/seed-parse-error-2.json: json: cannot unmarshal object into Go struct field UserSeed.users.password of type string`,
 	)
@@ -327,7 +546,7 @@ func TestSeedParseAndValidationErrors(t *testing.T) {
 
 	//test a seed file with every possible validation error (each user and group
 	//has one validation error, as indicated in their name fields)
-	_, errs = ReadDatabaseSeed("fixtures/seed-validation-errors.json", vcfg)
+	_, errs = ReadDatabaseSeed("fixtures/seed-validation-errors.json", nil, vcfg)
 	expectTheseErrors(t, errs,
 		`field "login_name" in user "" is missing`,
 		`field "login_name" in user " spaces-in-name " may not start with a space character`,
@@ -357,6 +576,9 @@ func TestSeedParseAndValidationErrors(t *testing.T) {
 		`field "long_name" in group "missing-long-name" is missing`,
 		`field "long_name" in group "spaces-in-long-name" may not start with a space character`,
 		`field "members" in group "unknown-member" contains unknown user with login name "incognito"`,
+		`field "owner" in group "unknown-owner" refers to unknown user with login name "incognito"`,
+		`field "email" in group "spaces-in-email" may not start with a space character`,
+		`field "default_email_domains" in group "malformed-default-domain" must contain domain names without spaces or "@"`,
 	)
 }
 
@@ -368,7 +590,7 @@ func TestSeedCryptoAgility(t *testing.T) {
 	defer cancel()
 
 	vcfg := GetValidationConfigForTests()
-	seed, errs := ReadDatabaseSeed("fixtures/seed-one-user-with-password.json", vcfg)
+	seed, errs := ReadDatabaseSeed("fixtures/seed-one-user-with-password.json", nil, vcfg)
 	expectNoErrors(t, errs)
 	_ = seed
 
@@ -437,3 +659,139 @@ func expectTheseErrors(t *testing.T, errs errext.ErrorSet, expected ...string) {
 func pointerTo[T any](val T) *T {
 	return &val
 }
+
+func TestSeedReport(t *testing.T) {
+	//This seed was written for a more liberal PORTUNUS_USER_NAME_REGEX than the
+	//one from GetValidationConfigForTests().
+	path := filepath.Join(t.TempDir(), "seed.json")
+	err := os.WriteFile(path, []byte(`{
+		"groups": [
+			{ "name": "Admins", "long_name": "Administrators" },
+			{ "name": "staff", "long_name": "Staff", "members": [ "John.Doe", "jane" ] }
+		],
+		"users": [
+			{ "login_name": "John.Doe", "given_name": "John", "family_name": "Doe" },
+			{ "login_name": "jane", "given_name": "Jane", "family_name": "Doe" }
+		]
+	}`), 0o666)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed(path, nil, vcfg)
+	report := BuildSeedReport(seed, errs, vcfg)
+	assert.DeepEqual(t, "seed report", report, SeedReport{
+		UserNameRegex:  `^[a-z0-9.,-]+$`,
+		GroupNameRegex: `^[a-z0-9.,-]+$`,
+		Problems: []SeedProblem{
+			{
+				ObjectType: "group",
+				ObjectName: "Admins",
+				Field:      "name",
+				Message:    "is not an acceptable group name (PORTUNUS_GROUP_NAME_REGEX is /^[a-z0-9.,-]+$/)",
+			},
+			{
+				ObjectType: "group",
+				ObjectName: "staff",
+				Field:      "members",
+				Message:    `contains user "John.Doe", which is invalid`,
+			},
+			{
+				ObjectType: "user",
+				ObjectName: "John.Doe",
+				Field:      "login_name",
+				Message:    "is not an acceptable user name (PORTUNUS_USER_NAME_REGEX is /^[a-z0-9.,-]+$/)",
+			},
+		},
+	})
+	assert.DeepEqual(t, "rendered problem", report.Problems[2].String(),
+		`field "login_name" in user "John.Doe" is not an acceptable user name (PORTUNUS_USER_NAME_REGEX is /^[a-z0-9.,-]+$/)`)
+
+	//parse errors are reported without an object reference
+	err = os.WriteFile(path, []byte(`{"groups":[{"name":"staff","unknown":true}]}`), 0o666)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	seed, errs = ReadDatabaseSeed(path, nil, vcfg)
+	report = BuildSeedReport(seed, errs, vcfg)
+	assert.DeepEqual(t, "problems for unparseable seed", report.Problems, []SeedProblem{{
+		Message: fmt.Sprintf(`while parsing %s: json: unknown field "unknown"`, path),
+	}})
+}
+
+func TestSeedAuthoritative(t *testing.T) {
+	var seed DatabaseSeed
+	err := json.Unmarshal([]byte(`{
+		"authoritative": true,
+		"groups": [ { "name": "staff", "long_name": "Staff", "members": [ "jane" ] } ],
+		"users": [ { "login_name": "jane", "given_name": "Jane", "family_name": "Doe" } ]
+	}`), &seed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectNoErrors(t, seed.Validate(GetValidationConfigForTests()))
+
+	nexus := NewNexus(&seed, GetValidationConfigForTests(), &NoopHasher{})
+	reducerAddUnseededObjects := func(db *Database) errext.ErrorSet {
+		db.Users = append(db.Users, User{LoginName: "john", GivenName: "John", FamilyName: "Doe"})
+		for idx := range db.Groups {
+			db.Groups[idx].MemberLoginNames["john"] = true
+		}
+		db.Groups = append(db.Groups, Group{Name: "others", LongName: "Others", OwnerLoginName: "john"})
+		return nil
+	}
+
+	//when conflicts are errors, unseeded objects cannot be created...
+	errs := nexus.Update(reducerReturnEmpty, nil)
+	expectNoErrors(t, errs)
+	errs = nexus.Update(reducerAddUnseededObjects, &UpdateOptions{ConflictWithSeedIsError: true})
+	expectTheseErrors(t, errs,
+		`group "others" is not seeded and cannot exist because the seed is authoritative`,
+		`user "john" is not seeded and cannot exist because the seed is authoritative`,
+	)
+
+	//...otherwise they are deleted right away, including all references to them
+	errs = nexus.Update(reducerAddUnseededObjects, nil)
+	expectNoErrors(t, errs)
+	assert.DeepEqual(t, "groups", nexus.ListGroups(), []Group{{
+		Name:             "staff",
+		LongName:         "Staff",
+		MemberLoginNames: GroupMemberNames{"jane": true},
+	}})
+	assert.DeepEqual(t, "user count", len(nexus.ListUsers()), 1)
+}
+
+func TestSeedCheckAgainstDatabase(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	var seed DatabaseSeed
+	err := json.Unmarshal([]byte(`{
+		"groups": [ { "name": "staff", "long_name": "Staff", "members": [ "jane" ] } ],
+		"users": [ { "login_name": "jane", "given_name": "Jane", "family_name": "Doe" } ]
+	}`), &seed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectNoErrors(t, seed.Validate(vcfg))
+
+	//the existing DB deviates from the seed, and also contains a user that is
+	//not acceptable under the current validation config
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", GivenName: "Janet", FamilyName: "Doe"},
+			{LoginName: "John", GivenName: "John", FamilyName: "Doe"},
+		},
+	}
+	changes, errs := seed.CheckAgainstDatabase(db, vcfg, &NoopHasher{})
+	expectTheseErrors(t, changes,
+		`group "staff" is seeded and cannot be deleted`,
+		`field "given_name" in user "jane" must be equal to the seeded value`,
+	)
+	expectTheseErrors(t, errs,
+		`field "login_name" in user "John" is not an acceptable user name`,
+	)
+
+	//the given DB is not changed by the simulation
+	assert.DeepEqual(t, "user count", len(db.Users), 2)
+	assert.DeepEqual(t, "given name", db.Users[0].GivenName, "Janet")
+}
@@ -0,0 +1,154 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+// SeededFields describes which fields of a user or group are enforced by the
+// seed. The UI uses this to render these fields as read-only, instead of
+// rejecting changes to them on save.
+//
+// Field names are the same as in the FieldRef of the errors reported by
+// CheckConflicts(), i.e. they match the input element names in the respective
+// HTML forms. For fields where the seed only enforces some values (e.g. group
+// memberships or labels), there is one entry per enforced value, with the
+// value appended after a dot, e.g. "members.alice" or "labels.team". The same
+// applies to the individual checkboxes in "portunus_perms" and "ldap_perms".
+type SeededFields struct {
+	//The file name of the seed fragment that defines this object, or "" if the
+	//seed is not split into fragments.
+	Fragment string
+	Names    map[string]bool
+}
+
+// IsEmpty returns whether no fields are enforced by the seed. This is the
+// case for objects that do not appear in the seed.
+func (s SeededFields) IsEmpty() bool {
+	return len(s.Names) == 0
+}
+
+// Contains returns whether the field with the given name is enforced by the
+// seed.
+func (s SeededFields) Contains(name string) bool {
+	return s.Names[name]
+}
+
+// SeededFieldsOf returns which fields of the given user or group are enforced
+// by this seed.
+func (d DatabaseSeed) SeededFieldsOf(ref ObjectRef) SeededFields {
+	switch ref.Type {
+	case "user":
+		for _, u := range d.Users {
+			if string(u.LoginName) == ref.Name {
+				return d.seededFieldsOfUser(u)
+			}
+		}
+	case "group":
+		for _, g := range d.Groups {
+			if string(g.Name) == ref.Name {
+				return g.seededFields()
+			}
+		}
+	}
+	return SeededFields{}
+}
+
+// This follows the behavior of GroupSeed.ApplyTo().
+func (g GroupSeed) seededFields() SeededFields {
+	result := SeededFields{
+		Fragment: g.Fragment,
+		Names: map[string]bool{
+			"long_name": true,
+			"domain":    true,
+		},
+	}
+	add := func(name string, isSeeded bool) {
+		if isSeeded {
+			result.Names[name] = true
+		}
+	}
+
+	add("portunus_perms.is_admin", g.Permissions.Portunus.IsAdmin != nil)
+	add("ldap_perms.can_read", g.Permissions.LDAP.CanRead != nil)
+	add("ldap_perms.can_read_users", g.Permissions.LDAP.CanReadUsers != nil)
+	add("ldap_perms.can_read_groups", g.Permissions.LDAP.CanReadGroups != nil)
+	add("ldap_write_subtree", g.Permissions.LDAP.WriteSubtree != "")
+	add("posix", g.PosixGID != nil)
+	add("posix_gid", g.PosixGID != nil)
+	add("email", g.EMailAddress != "")
+	add("owner", g.OwnerLoginName != "")
+	add("notes", g.Notes != "")
+	//in the UI, the list of email domains is a separate field
+	add("default_membership", g.DefaultMembership != nil)
+	add("default_email_domains", g.DefaultMembership != nil)
+	add("joinable", g.IsJoinable != nil)
+	add("publish_to_ldap", g.IsHiddenFromLDAP != nil)
+
+	for _, loginName := range g.MemberLoginNames {
+		result.Names["members."+string(loginName)] = true
+	}
+	for _, name := range g.MemberGroupNames {
+		result.Names["member_groups."+string(name)] = true
+	}
+	for _, name := range g.Permissions.LDAP.ReadGroups {
+		result.Names["ldap_read_groups."+string(name)] = true
+	}
+	for key := range g.Labels {
+		result.Names["labels."+key] = true
+	}
+	return result
+}
+
+// This follows the behavior of UserSeed.ApplyTo(). Since group memberships
+// are edited on the user form as well, seeded memberships appear as
+// "memberships.<group name>".
+func (d DatabaseSeed) seededFieldsOfUser(u UserSeed) SeededFields {
+	result := SeededFields{
+		Fragment: u.Fragment,
+		Names: map[string]bool{
+			"given_name":  true,
+			"family_name": true,
+			"domain":      true,
+		},
+	}
+	add := func(name string, isSeeded bool) {
+		if isSeeded {
+			result.Names[name] = true
+		}
+	}
+
+	add("family_name_first", u.FamilyNameFirst != nil)
+	add("email", u.EMailAddress != "")
+	add("telephone_number", u.TelephoneNumber != "")
+	add("mobile", u.MobileNumber != "")
+	add("postal_address", u.PostalAddress != "")
+	add("manager", u.ManagerLoginName != "")
+	add("ssh_public_keys", len(u.SSHPublicKeys) > 0)
+	add("hidden_ldap_attributes", u.HiddenLDAPAttributes != nil)
+	add("password", u.Password != "")
+	if u.POSIX != nil {
+		result.Names["posix"] = true
+		result.Names["posix_uid"] = true
+		result.Names["posix_gid"] = true
+		result.Names["posix_home"] = true
+		add("posix_shell", u.POSIX.LoginShell != "")
+		add("posix_gecos", u.POSIX.GECOS != "")
+	}
+
+	for key := range u.Labels {
+		result.Names["labels."+key] = true
+	}
+	for name := range u.ExtraAttributes {
+		result.Names["extra_attributes."+name] = true
+	}
+	for _, g := range d.Groups {
+		for _, loginName := range g.MemberLoginNames {
+			if loginName == u.LoginName {
+				result.Names["memberships."+string(g.Name)] = true
+			}
+		}
+	}
+	return result
+}
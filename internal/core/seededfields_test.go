@@ -0,0 +1,55 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSeededFields(t *testing.T) {
+	vcfg := GetValidationConfigForTests()
+	seed, errs := ReadDatabaseSeed("fixtures/seed-basic.json", nil, vcfg)
+	expectNoErrors(t, errs)
+
+	namesOf := func(ref ObjectRef) []string {
+		sf := seed.SeededFieldsOf(ref)
+		assert.DeepEqual(t, "fragment of "+ref.Name, sf.Fragment, "")
+		var names []string
+		for name := range sf.Names {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	//only the fields that the seed actually specifies are enforced
+	assert.DeepEqual(t, "seeded fields of minuser", namesOf(ObjectRef{"user", "minuser"}), []string{
+		"domain", "family_name", "given_name",
+	})
+	assert.DeepEqual(t, "seeded fields of maxuser", namesOf(ObjectRef{"user", "maxuser"}), []string{
+		"domain", "email", "family_name", "given_name", "memberships.maxgroup", "password",
+		"posix", "posix_gecos", "posix_gid", "posix_home", "posix_shell", "posix_uid", "ssh_public_keys",
+	})
+	assert.DeepEqual(t, "seeded fields of maxgroup", namesOf(ObjectRef{"group", "maxgroup"}), []string{
+		"default_email_domains", "default_membership", "domain", "email", "ldap_perms.can_read", "long_name",
+		"members.maxuser", "notes", "owner", "portunus_perms.is_admin", "posix", "posix_gid",
+	})
+
+	//unseeded objects do not have any seeded fields
+	assert.DeepEqual(t, "unseeded user is empty", seed.SeededFieldsOf(ObjectRef{"user", "john"}).IsEmpty(), true)
+	assert.DeepEqual(t, "unseeded group is empty", seed.SeededFieldsOf(ObjectRef{"group", "users"}).IsEmpty(), true)
+
+	//with seed fragments, the owning fragment is reported
+	seed, errs = ReadDatabaseSeed("fixtures/seed-fragments", nil, vcfg)
+	expectNoErrors(t, errs)
+	sf := seed.SeededFieldsOf(ObjectRef{"user", "bob"})
+	assert.DeepEqual(t, "fragment of bob", sf.Fragment, "team-a.json")
+	assert.DeepEqual(t, "bob is seeded into team-a", sf.Contains("memberships.team-a"), true)
+}
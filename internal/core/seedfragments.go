@@ -0,0 +1,180 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// SeedConflict describes an object that is defined in multiple seed
+// fragments. It appears in type DatabaseSeed.
+type SeedConflict struct {
+	Object ObjectRef
+	//The fragment whose definition of the object is used.
+	Owner string
+	//The fragment whose definition of the object is ignored.
+	Ignored string
+}
+
+// String returns a human-readable description of this conflict.
+func (c SeedConflict) String() string {
+	return fmt.Sprintf("%s %q: %s", c.Object.Type, c.Object.Name, c.message())
+}
+
+// Like String(), but without the object reference. This is used by BuildSeedReport().
+func (c SeedConflict) message() string {
+	return fmt.Sprintf("is also seeded by %q, but that definition is ignored because %q has a higher priority",
+		c.Ignored, c.Owner)
+}
+
+type seedFragment struct {
+	Name string //file name within the seed directory
+	Seed *DatabaseSeed
+}
+
+// readSeedFragments reads all seed files in the given directory (files
+// starting with a dot are ignored), and merges them into one seed. Each
+// group, user and service account is owned by exactly one fragment: If
+// several fragments define the same object, the one with the highest
+// priority wins, and the other definitions are ignored and reported in
+// DatabaseSeed.Conflicts. If there is no single fragment with the highest
+// priority, that is an error.
+//
+// This allows multiple teams to manage their part of the seed in separate
+// repositories without being able to overwrite each other's objects.
+func readSeedFragments(dirPath string, vars SeedVariables, cfg *ValidationConfig) (*DatabaseSeed, errext.ErrorSet) {
+	var errs errext.ErrorSet
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		errs.Add(err)
+		return nil, errs
+	}
+
+	var fragments []seedFragment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		seed, err := readSeedFile(filepath.Join(dirPath, name), vars)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		fragments = append(fragments, seedFragment{name, seed})
+	}
+	if !errs.IsEmpty() {
+		return nil, errs
+	}
+	if len(fragments) == 0 {
+		errs.Addf("no seed files found in %s", dirPath)
+		return nil, errs
+	}
+
+	seed, errs := mergeSeedFragments(fragments)
+	seed.fillPosixDefaults(cfg)
+	errs.Append(seed.Validate(cfg))
+	return seed, errs
+}
+
+// The interface implemented by GroupSeed, UserSeed and ServiceAccountSeed
+// that mergeSeedFragments() requires.
+type fragmentObjectSeed[S any] interface {
+	//Returns the field that identifies the object.
+	identityField() FieldRef
+	withFragment(name string) S
+}
+
+func (g GroupSeed) identityField() FieldRef {
+	return Group{Name: string(g.Name)}.Ref().Field("name")
+}
+
+func (g GroupSeed) withFragment(name string) GroupSeed {
+	g.Fragment = name
+	return g
+}
+
+func (u UserSeed) identityField() FieldRef {
+	return User{LoginName: string(u.LoginName)}.Ref().Field("login_name")
+}
+
+func (u UserSeed) withFragment(name string) UserSeed {
+	u.Fragment = name
+	return u
+}
+
+func (s ServiceAccountSeed) identityField() FieldRef {
+	return ServiceAccount{Name: string(s.Name)}.Ref().Field("name")
+}
+
+func (s ServiceAccountSeed) withFragment(name string) ServiceAccountSeed {
+	s.Fragment = name
+	return s
+}
+
+func mergeSeedFragments(fragments []seedFragment) (*DatabaseSeed, errext.ErrorSet) {
+	result := &DatabaseSeed{}
+	var errs errext.ErrorSet
+	for _, f := range fragments {
+		//an authoritative fragment deletes everything that is not in any fragment
+		result.Authoritative = result.Authoritative || f.Seed.Authoritative
+	}
+
+	result.Groups = mergeFragmentObjects(fragments, result, &errs, func(d *DatabaseSeed) []GroupSeed { return d.Groups })
+	result.Users = mergeFragmentObjects(fragments, result, &errs, func(d *DatabaseSeed) []UserSeed { return d.Users })
+	result.ServiceAccounts = mergeFragmentObjects(fragments, result, &errs, func(d *DatabaseSeed) []ServiceAccountSeed { return d.ServiceAccounts })
+	return result, errs
+}
+
+func mergeFragmentObjects[S fragmentObjectSeed[S]](fragments []seedFragment, result *DatabaseSeed, errs *errext.ErrorSet, getSeeds func(*DatabaseSeed) []S) []S {
+	//find the owner of each object (the first of several fragments with the
+	//same priority is chosen, so that the merged seed can still be validated)
+	owners := make(map[ObjectRef]seedFragment)
+	for _, f := range fragments {
+		for _, objectSeed := range getSeeds(f.Seed) {
+			ref := objectSeed.identityField()
+			owner, exists := owners[ref.Object]
+			switch {
+			case !exists || f.Seed.Priority > owner.Seed.Priority:
+				owners[ref.Object] = f
+			case f.Seed.Priority == owner.Seed.Priority && f.Name != owner.Name:
+				err := fmt.Errorf("is seeded by both %q and %q with the same priority", owner.Name, f.Name)
+				errs.Add(ref.Wrap(err))
+			}
+		}
+	}
+
+	var merged []S
+	for _, f := range fragments {
+		for _, objectSeed := range getSeeds(f.Seed) {
+			ref := objectSeed.identityField()
+			owner := owners[ref.Object]
+			switch {
+			case owner.Name == f.Name:
+				//duplicates within the same fragment are kept, so that Validate() complains about them
+				merged = append(merged, objectSeed.withFragment(f.Name))
+			case owner.Seed.Priority > f.Seed.Priority:
+				result.Conflicts = append(result.Conflicts, SeedConflict{
+					Object:  ref.Object,
+					Owner:   owner.Name,
+					Ignored: f.Name,
+				})
+			}
+		}
+	}
+	return merged
+}
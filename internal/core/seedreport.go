@@ -0,0 +1,124 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/sapcc/go-bits/errext"
+)
+
+// SeedReport lists all problems that a seed has under the current
+// ValidationConfig. Unlike the plain list of errors from ReadDatabaseSeed(),
+// it is structured by object and explains which part of the runtime
+// configuration caused a name to be rejected. This is useful when
+// PORTUNUS_USER_NAME_REGEX or PORTUNUS_GROUP_NAME_REGEX are customized, since
+// a seed that was written for one configuration may be invalid in another.
+type SeedReport struct {
+	UserNameRegex  string        `json:"user_name_regex"`
+	GroupNameRegex string        `json:"group_name_regex"`
+	Problems       []SeedProblem `json:"problems"`
+}
+
+// SeedProblem appears in type SeedReport.
+type SeedProblem struct {
+	//These are empty for problems that concern the seed file as a whole,
+	//e.g. parse errors.
+	ObjectType string `json:"object_type,omitempty"`
+	ObjectName string `json:"object_name,omitempty"`
+	Field      string `json:"field,omitempty"`
+
+	Message string `json:"message"` //sentence without subject if Field is not empty
+}
+
+// String renders this problem in the same way as the respective error.
+func (p SeedProblem) String() string {
+	switch {
+	case p.Field != "":
+		return fmt.Sprintf("field %q in %s %q %s", p.Field, p.ObjectType, p.ObjectName, p.Message)
+	case p.ObjectType != "":
+		return fmt.Sprintf("%s %q: %s", p.ObjectType, p.ObjectName, p.Message)
+	default:
+		return p.Message
+	}
+}
+
+// BuildSeedReport builds a SeedReport from the errors returned by
+// ReadDatabaseSeed(). The seed may be nil if it could not be parsed.
+func BuildSeedReport(seed *DatabaseSeed, errs errext.ErrorSet, cfg *ValidationConfig) SeedReport {
+	report := SeedReport{
+		UserNameRegex:  cfg.UserNameRegex.String(),
+		GroupNameRegex: cfg.GroupNameRegex.String(),
+		Problems:       []SeedProblem{},
+	}
+
+	isInvalidUser := make(map[string]bool)
+	for _, err := range errs {
+		var verr ValidationError
+		if !errors.As(err, &verr) {
+			report.Problems = append(report.Problems, SeedProblem{Message: err.Error()})
+			continue
+		}
+
+		ref := verr.FieldRef
+		msg := verr.FieldError.Error()
+		switch {
+		case errors.Is(verr.FieldError, errMalformedUserLoginName):
+			msg += fmt.Sprintf(" (PORTUNUS_USER_NAME_REGEX is /%s/)", report.UserNameRegex)
+		case errors.Is(verr.FieldError, errMalformedGroupName):
+			msg += fmt.Sprintf(" (PORTUNUS_GROUP_NAME_REGEX is /%s/)", report.GroupNameRegex)
+		}
+		report.Problems = append(report.Problems, SeedProblem{
+			ObjectType: ref.Object.Type,
+			ObjectName: ref.Object.Name,
+			Field:      ref.Name,
+			Message:    msg,
+		})
+		if ref.Object.Type == "user" {
+			isInvalidUser[ref.Object.Name] = true
+		}
+	}
+
+	//A seeded group membership is not reported by the validation itself if the
+	//user in question exists in the seed, even if that user is invalid. But
+	//the membership cannot be applied either, so it is reported here.
+	if seed != nil {
+		//conflicts between seed fragments do not prevent the seed from being
+		//applied, but are likely not intended by whoever wrote the ignored fragment
+		for _, c := range seed.Conflicts {
+			report.Problems = append(report.Problems, SeedProblem{
+				ObjectType: c.Object.Type,
+				ObjectName: c.Object.Name,
+				Message:    c.message(),
+			})
+		}
+		for _, groupSeed := range seed.Groups {
+			for _, loginName := range groupSeed.MemberLoginNames {
+				if isInvalidUser[string(loginName)] {
+					report.Problems = append(report.Problems, SeedProblem{
+						ObjectType: "group",
+						ObjectName: string(groupSeed.Name),
+						Field:      "members",
+						Message:    fmt.Sprintf("contains user %q, which is invalid", string(loginName)),
+					})
+				}
+			}
+		}
+	}
+
+	slices.SortStableFunc(report.Problems, func(lhs, rhs SeedProblem) int {
+		return cmp.Or(
+			cmp.Compare(lhs.ObjectType, rhs.ObjectType),
+			cmp.Compare(lhs.ObjectName, rhs.ObjectName),
+			cmp.Compare(lhs.Field, rhs.Field),
+		)
+	})
+	return report
+}
@@ -0,0 +1,147 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// SeedVariables contains the values for variable references like "${DOMAIN}"
+// in string values of the seed, so that the same seed can be reused across
+// multiple deployments.
+type SeedVariables map[string]string
+
+// Environment variables with this prefix define seed variables, e.g.
+// PORTUNUS_SEED_VAR_DOMAIN defines ${DOMAIN}. We do not allow references to
+// arbitrary environment variables, since the environment of portunus-server
+// also contains secrets like PORTUNUS_LDAP_PASSWORD.
+const seedVariableEnvPrefix = "PORTUNUS_SEED_VAR_"
+
+// ReadSeedVariablesFromEnvironment reads seed variables from the file at
+// PORTUNUS_SEED_VALUES_PATH (if any), and then from all environment variables
+// starting with PORTUNUS_SEED_VAR_. Values from the environment take
+// precedence over values from the file.
+func ReadSeedVariablesFromEnvironment() (SeedVariables, error) {
+	vars := make(SeedVariables)
+	path := os.Getenv("PORTUNUS_SEED_VALUES_PATH")
+	if path != "" {
+		var err error
+		vars, err = readSeedVariables(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, seedVariableEnvPrefix)
+		if ok && name != "" {
+			vars[name] = value
+		}
+	}
+	return vars, nil
+}
+
+// The values file is a flat mapping of variable names to values. Like seed
+// files, it is parsed as YAML if the extension says so, or as JSON otherwise.
+func readSeedVariables(path string) (SeedVariables, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		buf, err = convertYAMLToJSON(buf)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing %s: %w", path, err)
+		}
+	}
+	var vars SeedVariables
+	err = json.Unmarshal(buf, &vars)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", path, err)
+	}
+	for name := range vars {
+		if !seedVariableNameRx.MatchString(name) {
+			return nil, fmt.Errorf("while parsing %s: %q is not a valid variable name", path, name)
+		}
+	}
+	if vars == nil {
+		vars = make(SeedVariables)
+	}
+	return vars, nil
+}
+
+var (
+	seedVariableNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	//"$${" is an escaped "${" that shall not be expanded
+	seedVariableRefRx = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// Expands all variable references in the string values of the given JSON
+// document. Object keys are not expanded. References to undefined variables
+// are reported as an error.
+func expandSeedVariables(buf []byte, vars SeedVariables) ([]byte, error) {
+	//fast path: nothing to do (this also ensures that seeds without variables
+	//are decoded exactly like before)
+	if !bytes.Contains(buf, []byte("${")) {
+		return buf, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber() //to avoid losing precision in numbers
+	var data any
+	err := dec.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	undefined := make(map[string]bool)
+	data = expandSeedVariablesIn(data, vars, undefined)
+	if len(undefined) > 0 {
+		names := slices.Sorted(maps.Keys(undefined))
+		return nil, fmt.Errorf("undefined seed variables: ${%s}", strings.Join(names, "}, ${"))
+	}
+	return json.Marshal(data)
+}
+
+func expandSeedVariablesIn(data any, vars SeedVariables, undefined map[string]bool) any {
+	switch data := data.(type) {
+	case string:
+		return seedVariableRefRx.ReplaceAllStringFunc(data, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+			name := ref[2 : len(ref)-1]
+			value, exists := vars[name]
+			if !exists {
+				undefined[name] = true
+			}
+			return value
+		})
+	case []any:
+		for idx, elem := range data {
+			data[idx] = expandSeedVariablesIn(elem, vars, undefined)
+		}
+		return data
+	case map[string]any:
+		for key, value := range data {
+			data[key] = expandSeedVariablesIn(value, vars, undefined)
+		}
+		return data
+	default:
+		return data
+	}
+}
@@ -0,0 +1,77 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import "github.com/sapcc/go-bits/errext"
+
+// ServiceAccount is an account that an application uses to bind to the LDAP
+// server (e.g. for double-bind authentication). Unlike users, service
+// accounts cannot log into Portunus, and they cannot be members of groups.
+// What they can read is controlled by their ReadScopes alone.
+type ServiceAccount struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	//PasswordHash is in the same format as User.PasswordHash.
+	PasswordHash string               `json:"password"`
+	ReadScopes   ServiceAccountScopes `json:"read_scopes"`
+}
+
+// ServiceAccountScopes appears in type ServiceAccount.
+type ServiceAccountScopes struct {
+	//If true, the service account can read all user accounts.
+	Users bool `json:"users"`
+	//If true, the service account can read all groups (including POSIX groups).
+	Groups bool `json:"groups"`
+}
+
+// Key implements the Object interface.
+func (s ServiceAccount) Key() string {
+	return s.Name
+}
+
+// Cloned implements the Object interface.
+func (s ServiceAccount) Cloned() ServiceAccount {
+	//this type does not contain any reference types, so a shallow copy is enough
+	return s
+}
+
+// Ref returns an ObjectRef that can be used to build validation errors.
+func (s ServiceAccount) Ref() ObjectRef {
+	return ObjectRef{
+		Type: "service account",
+		Name: s.Name,
+	}
+}
+
+// Checks the individual attributes of this ServiceAccount. Uniqueness is
+// checked in Database.Validate().
+func (s ServiceAccount) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
+	ref := s.Ref()
+	errs.Add(ref.Field("name").WrapFirst(
+		MustNotBeEmpty(s.Name),
+		MustNotHaveSurroundingSpaces(s.Name),
+		MustBeUserLoginName(s.Name, cfg),
+		MustNotIncludeDNSyntaxElements(s.Name),
+	))
+	errs.Add(ref.Field("description").Wrap(MustNotHaveSurroundingSpaces(s.Description)))
+	errs.Add(ref.Field("password").Wrap(MustNotBeEmpty(s.PasswordHash)))
+	return
+}
+
+// String describes the read scopes for display purposes.
+func (s ServiceAccountScopes) String() string {
+	switch {
+	case s.Users && s.Groups:
+		return "users, groups"
+	case s.Users:
+		return "users"
+	case s.Groups:
+		return "groups"
+	default:
+		return "none"
+	}
+}
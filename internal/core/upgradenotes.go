@@ -0,0 +1,115 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/crypt"
+)
+
+// UpgradeNote describes an action that the operator of Portunus should take,
+// usually because of something that was left behind by an older version of
+// Portunus (or by the system that users were imported from). Instead of being
+// logged as one warning among many, all pending upgrade notes are shown on the
+// status page and in one block in the log on startup.
+type UpgradeNote struct {
+	Topic   string //short summary, e.g. "Weak password hashes"
+	Message string //what was found, and what the operator should do about it
+}
+
+// String returns a representation of this note for the log.
+func (n UpgradeNote) String() string {
+	return n.Topic + ": " + n.Message
+}
+
+// UpgradeNotes returns upgrade notes for problems in the contents of this
+// database.
+func (d Database) UpgradeNotes(hasher crypt.PasswordHasher) []UpgradeNote {
+	var (
+		weakUserNames           []string
+		weakServiceAccountNames []string
+	)
+	for _, u := range d.Users {
+		if u.PasswordHash != "" && hasher.IsWeakHash(u.PasswordHash) {
+			weakUserNames = append(weakUserNames, u.LoginName)
+		}
+	}
+	for _, s := range d.ServiceAccounts {
+		if hasher.IsWeakHash(s.PasswordHash) {
+			weakServiceAccountNames = append(weakServiceAccountNames, s.Name)
+		}
+	}
+
+	var result []UpgradeNote
+	if len(weakUserNames) > 0 {
+		result = append(result, UpgradeNote{
+			Topic: "Weak password hashes",
+			Message: fmt.Sprintf("Password hashes from an outdated hash method or cost setting, or from a foreign directory, are still in use for %s (%s). "+
+				"Each of these hashes is replaced when the respective user logs into Portunus. "+
+				"Reset the passwords of users that do not log in regularly.",
+				pluralize(len(weakUserNames), "user", "users"), summarizeNames(weakUserNames)),
+		})
+	}
+	if len(weakServiceAccountNames) > 0 {
+		result = append(result, UpgradeNote{
+			Topic: "Weak password hashes",
+			Message: fmt.Sprintf("Password hashes from an outdated hash method or cost setting, or from a foreign directory, are still in use for %s (%s). "+
+				"Since service accounts do not log into Portunus, these hashes are never replaced automatically. "+
+				"Set new passwords for these service accounts.",
+				pluralize(len(weakServiceAccountNames), "service account", "service accounts"), summarizeNames(weakServiceAccountNames)),
+		})
+	}
+	return result
+}
+
+// Environment variables that older versions of Portunus understood, but that
+// are ignored now, with instructions for what to do instead. There are none
+// yet, since every variable that was ever documented is still supported. When
+// a variable is retired, it must be listed here (not just in the changelog),
+// so that operators who still set it get an upgrade note.
+var retiredEnvironmentVariables = map[string]string{}
+
+// EnvironmentUpgradeNotes returns upgrade notes for environment variables that
+// are set, but ignored by this version of Portunus.
+func EnvironmentUpgradeNotes() []UpgradeNote {
+	return environmentUpgradeNotes(retiredEnvironmentVariables, os.Getenv)
+}
+
+func environmentUpgradeNotes(retired map[string]string, getenv func(string) string) []UpgradeNote {
+	var result []UpgradeNote
+	for _, name := range slices.Sorted(maps.Keys(retired)) {
+		if getenv(name) != "" {
+			result = append(result, UpgradeNote{
+				Topic:   "Ignored configuration",
+				Message: fmt.Sprintf("%s is not supported anymore and has no effect. %s", name, retired[name]),
+			})
+		}
+	}
+	return result
+}
+
+func pluralize(count int, singular, plural string) string {
+	if count == 1 {
+		return "1 " + singular
+	}
+	return fmt.Sprintf("%d %s", count, plural)
+}
+
+// Lists the first few of the given names, to keep messages short for large
+// user bases.
+func summarizeNames(names []string) string {
+	const maxShown = 5
+	if len(names) <= maxShown {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxShown], ", "), len(names)-maxShown)
+}
@@ -0,0 +1,65 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestDatabaseUpgradeNotes(t *testing.T) {
+	hasher := &NoopHasher{UpgradeWeakHashes: true}
+	db := Database{
+		Users: []User{
+			{LoginName: "jane", PasswordHash: "{PLAINTEXT}secret"},
+			{LoginName: "john", PasswordHash: "{WEAK-PLAINTEXT}secret"},
+			{LoginName: "nopass"},
+		},
+		ServiceAccounts: []ServiceAccount{
+			{Name: "dovecot", PasswordHash: "{PLAINTEXT}secret"},
+		},
+	}
+	assert.DeepEqual(t, "upgrade notes", db.UpgradeNotes(hasher), []UpgradeNote{{
+		Topic: "Weak password hashes",
+		Message: "Password hashes from an outdated hash method or cost setting, or from a foreign directory, are still in use for 1 user (john). " +
+			"Each of these hashes is replaced when the respective user logs into Portunus. " +
+			"Reset the passwords of users that do not log in regularly.",
+	}})
+
+	//long lists of names are shortened
+	db.Users = nil
+	for idx := range 7 {
+		db.ServiceAccounts = append(db.ServiceAccounts, ServiceAccount{Name: fmt.Sprintf("app%d", idx), PasswordHash: "{WEAK-PLAINTEXT}secret"})
+	}
+	notes := db.UpgradeNotes(hasher)
+	assert.DeepEqual(t, "number of upgrade notes", len(notes), 1)
+	assert.DeepEqual(t, "upgrade note for service accounts", notes[0].Message,
+		"Password hashes from an outdated hash method or cost setting, or from a foreign directory, are still in use for 7 service accounts (app0, app1, app2, app3, app4 and 2 more). "+
+			"Since service accounts do not log into Portunus, these hashes are never replaced automatically. "+
+			"Set new passwords for these service accounts.")
+}
+
+func TestEnvironmentUpgradeNotes(t *testing.T) {
+	//there are no retired variables yet, so this uses a made-up one
+	retired := map[string]string{
+		"PORTUNUS_OLD_SETTING":   "Set PORTUNUS_NEW_SETTING instead.",
+		"PORTUNUS_OTHER_SETTING": "Remove it from your configuration.",
+	}
+	getenv := func(name string) string {
+		if name == "PORTUNUS_OLD_SETTING" {
+			return "true"
+		}
+		return ""
+	}
+	assert.DeepEqual(t, "upgrade notes", environmentUpgradeNotes(retired, getenv), []UpgradeNote{{
+		Topic:   "Ignored configuration",
+		Message: "PORTUNUS_OLD_SETTING is not supported anymore and has no effect. Set PORTUNUS_NEW_SETTING instead.",
+	}})
+	assert.DeepEqual(t, "upgrade notes for current version", EnvironmentUpgradeNotes(), []UpgradeNote(nil))
+}
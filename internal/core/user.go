@@ -8,23 +8,71 @@ package core
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
+	"github.com/majewsky/portunus/internal/totp"
 	"github.com/sapcc/go-bits/errext"
 	"golang.org/x/crypto/ssh"
 )
 
 // User represents a single user account.
 type User struct {
-	LoginName     string   `json:"login_name"`
-	GivenName     string   `json:"given_name"`
-	FamilyName    string   `json:"family_name"`
+	LoginName  string `json:"login_name"`
+	GivenName  string `json:"given_name"`
+	FamilyName string `json:"family_name"`
+	//FamilyNameFirst flips the order of names in FullName(), e.g. for East
+	//Asian or Hungarian names.
+	FamilyNameFirst bool `json:"family_name_first,omitempty"`
+	//Domain selects the LDAP suffix that this user is placed below, see
+	//DomainNameOfSuffix(). The empty string refers to the primary suffix.
+	Domain        string   `json:"domain,omitempty"`
 	EMailAddress  string   `json:"email,omitempty"`
 	SSHPublicKeys []string `json:"ssh_public_keys,omitempty"`
-	//PasswordHash must be in the format generated by crypt(3).
+	//TelephoneNumber, MobileNumber and PostalAddress are optional contact
+	//details. PostalAddress may span multiple lines (separated by "\n").
+	TelephoneNumber string `json:"telephone_number,omitempty"`
+	MobileNumber    string `json:"mobile,omitempty"`
+	PostalAddress   string `json:"postal_address,omitempty"`
+	//ManagerLoginName optionally refers to the user's line manager.
+	ManagerLoginName string `json:"manager,omitempty"`
+	//PasswordHash is usually in the format generated by crypt(3), with a
+	//"{CRYPT}" prefix. Hashes imported from other systems may also be in one of
+	//the other schemes accepted by crypt.ImportPasswordHash().
 	PasswordHash string               `json:"password"`
 	POSIX        *UserPosixAttributes `json:"posix,omitempty"`
+	Labels       Labels               `json:"labels,omitempty"`
+	//ExtraAttributes are rendered into the user's LDAP object as-is.
+	ExtraAttributes ExtraAttributes `json:"extra_attributes,omitempty"`
+	//TOTPKeyURL is the "otpauth://" URL of the user's second factor (see
+	//package totp), or empty if the user has not enrolled one. It is only set
+	//once the user has proven that their authenticator app has the key.
+	TOTPKeyURL string `json:"totp_key_url,omitempty"`
+	//JPEGPhoto is published as the "jpegPhoto" attribute in LDAP. Images
+	//uploaded by users are normalized with PrepareUserPhoto() before being
+	//stored here.
+	JPEGPhoto []byte `json:"jpeg_photo,omitempty"`
+	//HiddenLDAPAttributes lists attributes (out of HideableUserLDAPAttributes)
+	//that are kept in Portunus, but left out of the user's LDAP object.
+	HiddenLDAPAttributes []string `json:"hidden_ldap_attributes,omitempty"`
+	//Disabled users cannot log into Portunus, and are removed from or marked in
+	//the LDAP directory (see ldap.DisabledUserHandling). Unlike deactivated
+	//users (see type DeactivatedUser), they keep their group memberships and
+	//can be enabled again at any time.
+	Disabled bool `json:"disabled,omitempty"`
+	//FormerLoginNames lists the login names that this user had before it was
+	//renamed (see Database.RenameUser), oldest first.
+	FormerLoginNames []FormerName `json:"former_login_names,omitempty"`
+	//ValidUntil is the last day (in DateFormat) on which this user can log in.
+	//Afterwards, the user is disabled automatically (see RunExpiry).
+	ValidUntil string `json:"valid_until,omitempty"`
 }
 
+// HideableUserLDAPAttributes lists the LDAP attributes that can be hidden for
+// individual users through User.HiddenLDAPAttributes. These are the
+// attributes that hold personal data which is not needed for authentication.
+var HideableUserLDAPAttributes = []string{"mail", "sshPublicKey", "jpegPhoto"}
+
 // UserPosixAttributes appears in type User.
 type UserPosixAttributes struct {
 	UID           PosixID `json:"uid"`
@@ -48,12 +96,29 @@ func (u User) Cloned() User {
 	if u.SSHPublicKeys != nil {
 		u.SSHPublicKeys = append([]string(nil), u.SSHPublicKeys...)
 	}
+	u.Labels = u.Labels.Cloned()
+	u.ExtraAttributes = u.ExtraAttributes.Cloned()
+	if u.JPEGPhoto != nil {
+		u.JPEGPhoto = slices.Clone(u.JPEGPhoto)
+	}
+	u.HiddenLDAPAttributes = slices.Clone(u.HiddenLDAPAttributes)
+	u.FormerLoginNames = slices.Clone(u.FormerLoginNames)
 	return u
 }
 
-// FullName returns the user's full name.
+// HidesLDAPAttribute returns whether the given attribute is left out of this
+// user's LDAP object (see HiddenLDAPAttributes).
+func (u User) HidesLDAPAttribute(name string) bool {
+	return slices.Contains(u.HiddenLDAPAttributes, name)
+}
+
+// FullName returns the user's full name. This is also used for the "cn" and
+// (unless overridden) "gecos" attributes in LDAP.
 func (u User) FullName() string {
-	return u.GivenName + " " + u.FamilyName //TODO: allow flipped order (family name first)
+	if u.FamilyNameFirst {
+		return u.FamilyName + " " + u.GivenName
+	}
+	return u.GivenName + " " + u.FamilyName
 }
 
 // Ref returns an ObjectRef that can be used to build validation errors.
@@ -83,7 +148,20 @@ func (u User) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		MustNotBeEmpty(u.FamilyName),
 		MustNotHaveSurroundingSpaces(u.FamilyName),
 	))
+	errs.Add(ref.Field("domain").Wrap(MustBeKnownDomain(u.Domain, cfg)))
 	errs.Add(ref.Field("email").Wrap(MustNotHaveSurroundingSpaces(u.EMailAddress)))
+	errs.Add(ref.Field("telephone_number").WrapFirst(
+		MustNotHaveSurroundingSpaces(u.TelephoneNumber),
+		MustBeTelephoneNumber(u.TelephoneNumber),
+	))
+	errs.Add(ref.Field("mobile").WrapFirst(
+		MustNotHaveSurroundingSpaces(u.MobileNumber),
+		MustBeTelephoneNumber(u.MobileNumber),
+	))
+	errs.Add(ref.Field("postal_address").Wrap(MustBePostalAddress(u.PostalAddress)))
+	if u.ValidUntil != "" {
+		errs.Add(ref.Field("valid_until").Wrap(mustBeDate(u.ValidUntil)))
+	}
 
 	for idx, key := range u.SSHPublicKeys {
 		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
@@ -93,6 +171,25 @@ func (u User) validateLocal(cfg *ValidationConfig) (errs errext.ErrorSet) {
 		}
 	}
 
+	errs.Append(u.Labels.validate(ref.Field("labels")))
+	errs.Append(u.ExtraAttributes.validate(ref, cfg))
+
+	if u.TOTPKeyURL != "" {
+		_, err := totp.ParseKeyURL(u.TOTPKeyURL)
+		if err != nil {
+			errs.Add(ref.Field("totp_key_url").Wrap(fmt.Errorf("must be a valid TOTP key URL: %w", err)))
+		}
+	}
+	if len(u.JPEGPhoto) > 0 {
+		errs.Add(ref.Field("jpeg_photo").Wrap(validateUserPhoto(u.JPEGPhoto)))
+	}
+	for _, name := range u.HiddenLDAPAttributes {
+		if !slices.Contains(HideableUserLDAPAttributes, name) {
+			err := fmt.Errorf("may only contain %s (found %q)", strings.Join(HideableUserLDAPAttributes, ", "), name)
+			errs.Add(ref.Field("hidden_ldap_attributes").Wrap(err))
+		}
+	}
+
 	if u.POSIX != nil {
 		errs.Add(ref.Field("posix_home").WrapFirst(
 			MustNotBeEmpty(u.POSIX.HomeDirectory),
@@ -0,0 +1,106 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package core
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestValidateContactDetails(t *testing.T) {
+	cfg := GetValidationConfigForTests()
+	user := User{
+		LoginName:       "jane",
+		GivenName:       "Jane",
+		FamilyName:      "Doe",
+		PasswordHash:    "{CRYPT}$6$rounds=10$salt$hash",
+		TelephoneNumber: "+49 (0)30 123456-78",
+		MobileNumber:    "0151/2345678",
+		PostalAddress:   "Jane Doe\nExample Street 1\n12345 Example City",
+	}
+	assert.DeepEqual(t, "error count", len(user.validateLocal(cfg)), 0)
+
+	user.TelephoneNumber = "call me maybe"
+	user.MobileNumber = " 0151 2345678"
+	user.PostalAddress = "Jane Doe\n\n12345 Example City"
+	expectTheseErrors(t, user.validateLocal(cfg),
+		`field "telephone_number" in user "jane" may only contain digits, spaces and the characters + ( ) - . /`,
+		`field "mobile" in user "jane" may not start with a space character`,
+		`field "postal_address" in user "jane" may not contain empty lines`,
+	)
+
+	user.TelephoneNumber = "+()"
+	user.MobileNumber = ""
+	user.PostalAddress = "Jane Doe \n12345 Example City"
+	expectTheseErrors(t, user.validateLocal(cfg),
+		`field "telephone_number" in user "jane" may only contain digits, spaces and the characters + ( ) - . /`,
+		`field "postal_address" in user "jane" may not have lines starting or ending with a space character`,
+	)
+}
+
+func TestValidateHiddenLDAPAttributes(t *testing.T) {
+	cfg := GetValidationConfigForTests()
+	user := User{
+		LoginName:            "jane",
+		GivenName:            "Jane",
+		FamilyName:           "Doe",
+		PasswordHash:         "{CRYPT}$6$rounds=10$salt$hash",
+		HiddenLDAPAttributes: []string{"mail", "jpegPhoto"},
+	}
+	assert.DeepEqual(t, "error count", len(user.validateLocal(cfg)), 0)
+
+	user.HiddenLDAPAttributes = []string{"mail", "userPassword"}
+	expectTheseErrors(t, user.validateLocal(cfg),
+		`field "hidden_ldap_attributes" in user "jane" may only contain mail, sshPublicKey, jpegPhoto (found "userPassword")`,
+	)
+}
+
+func TestFullName(t *testing.T) {
+	u := User{GivenName: "Taro", FamilyName: "Yamada"}
+	assert.DeepEqual(t, "full name", u.FullName(), "Taro Yamada")
+	u.FamilyNameFirst = true
+	assert.DeepEqual(t, "full name with family name first", u.FullName(), "Yamada Taro")
+}
+
+func TestSplitPostalAddress(t *testing.T) {
+	assert.DeepEqual(t, "SplitPostalAddress",
+		SplitPostalAddress("  Jane Doe\r\n\r\nExample Street 1 \n12345 Example City\n"),
+		"Jane Doe\nExample Street 1\n12345 Example City",
+	)
+	assert.DeepEqual(t, "SplitPostalAddress", SplitPostalAddress(" \n "), "")
+}
+
+func TestValidateManager(t *testing.T) {
+	cfg := GetValidationConfigForTests()
+	makeUser := func(loginName, managerLoginName string) User {
+		return User{
+			LoginName:        loginName,
+			GivenName:        "Jane",
+			FamilyName:       "Doe",
+			PasswordHash:     "{CRYPT}$6$rounds=10$salt$hash",
+			ManagerLoginName: managerLoginName,
+		}
+	}
+
+	db := Database{Users: []User{makeUser("jane", "john"), makeUser("john", "")}}
+	assert.DeepEqual(t, "error count", len(db.Validate(cfg)), 0)
+
+	db = Database{Users: []User{makeUser("jane", "jane"), makeUser("john", "jim")}}
+	expectTheseErrors(t, db.Validate(cfg),
+		`field "manager" in user "jane" may not refer to the object itself`,
+		`field "manager" in user "john" refers to unknown user with login name "jim"`,
+	)
+
+	//deleting a user also removes references to it
+	db = Database{Users: []User{makeUser("jane", "john"), makeUser("john", "")}}
+	err := db.DeleteUser("john")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manager after deletion", db.Users[0].ManagerLoginName, "")
+}
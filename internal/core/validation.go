@@ -18,10 +18,10 @@ import (
 	"github.com/majewsky/portunus/internal/grammars"
 )
 
-// ObjectRef identifies a User or Group. It appears in type FieldRef.
+// ObjectRef identifies a User, Group, AccessReview or JoinRequest. It appears in type FieldRef.
 type ObjectRef struct {
-	Type string //either "user" or "group"
-	Name string //the LoginName for users or the Name for groups
+	Type string //either "user" or "group" or "access review" or "join request"
+	Name string //the LoginName for users or the Name for groups and access reviews
 }
 
 // Field constructs a FieldRef for this object.
@@ -69,10 +69,33 @@ func (e ValidationError) Error() string {
 		r.Name, r.Object.Type, r.Object.Name, e.FieldError.Error())
 }
 
+// Unwrap implements the interface implied by errors.Unwrap().
+func (e ValidationError) Unwrap() error {
+	return e.FieldError
+}
+
 // ValidationConfig contains runtime configuration for user/group validation.
 type ValidationConfig struct {
 	GroupNameRegex *regexp.Regexp //from PORTUNUS_GROUP_NAME_REGEX
 	UserNameRegex  *regexp.Regexp //from PORTUNUS_USER_NAME_REGEX
+	//Which attributes may appear in User.ExtraAttributes (sorted).
+	ExtraUserAttributes []string //from PORTUNUS_LDAP_EXTRA_USER_ATTRIBUTES
+	//The names of the domains below the additional LDAP suffixes (sorted).
+	Domains []string //from PORTUNUS_LDAP_EXTRA_SUFFIXES
+	//How many supplementary POSIX groups a user may have before
+	//Database.Warnings() complains, or 0 to disable this check.
+	PosixGroupLimit uint //from PORTUNUS_POSIX_GROUP_LIMIT
+	//Used for POSIX users whose login shell or home directory is not given
+	//explicitly in the seed, and prefilled into the form for creating users.
+	//Empty if not configured.
+	DefaultLoginShell string //from PORTUNUS_DEFAULT_LOGIN_SHELL
+	DefaultHomePrefix string //from PORTUNUS_DEFAULT_HOME_PREFIX
+	//How many days deleted users are kept as DeactivatedUser before being
+	//purged, or 0 to delete users right away.
+	UserRetentionDays uint //from PORTUNUS_USER_RETENTION_DAYS
+	//How many revisions of each user and group are kept in Database.UserHistory
+	//and Database.GroupHistory, or 0 to not record any history.
+	HistoryDepth uint //from PORTUNUS_HISTORY_DEPTH
 }
 
 // ReadValidationConfigFromEnvironment builds a ValidationConfig from the
@@ -87,6 +110,34 @@ func ReadValidationConfigFromEnvironment() (result *ValidationConfig, err error)
 	if err != nil {
 		return nil, err
 	}
+	cfg.ExtraUserAttributes, err = readExtraUserAttributesFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Domains, err = readDomainsFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	cfg.PosixGroupLimit, err = readPosixGroupLimitFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	cfg.DefaultLoginShell, err = readDefaultPosixPathFromEnvironment("PORTUNUS_DEFAULT_LOGIN_SHELL")
+	if err != nil {
+		return nil, err
+	}
+	cfg.DefaultHomePrefix, err = readDefaultPosixPathFromEnvironment("PORTUNUS_DEFAULT_HOME_PREFIX")
+	if err != nil {
+		return nil, err
+	}
+	cfg.UserRetentionDays, err = readUserRetentionDaysFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	cfg.HistoryDepth, err = readHistoryDepthFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
@@ -98,8 +149,11 @@ func GetValidationConfigForTests() *ValidationConfig {
 	//meaning in LDAP DNs.
 	rx := regexp.MustCompile(`^[a-z0-9.,-]+$`)
 	return &ValidationConfig{
-		GroupNameRegex: rx,
-		UserNameRegex:  rx,
+		GroupNameRegex:      rx,
+		UserNameRegex:       rx,
+		ExtraUserAttributes: []string{"departmentNumber", "employeeNumber"},
+		Domains:             []string{"example.net"},
+		PosixGroupLimit:     DefaultPosixGroupLimit,
 	}
 }
 
@@ -119,6 +173,7 @@ var (
 	errIsDuplicate       = errors.New("is already in use")
 	errIsDuplicateInSeed = errors.New("is defined multiple times")
 	errIsMissing         = errors.New("is missing")
+	errIsSelfReference   = errors.New("may not refer to the object itself")
 	errLeadingSpaces     = errors.New("may not start with a space character")
 	errTrailingSpaces    = errors.New("may not end with a space character")
 
@@ -131,6 +186,10 @@ var (
 	errNotPosixUIDorGID    = errors.New("is not a number between 0 and 65535 inclusive")
 
 	errNotAbsolutePath = errors.New("must be an absolute path, i.e. start with a /")
+
+	errNotTelephoneNumber  = errors.New("may only contain digits, spaces and the characters + ( ) - . /")
+	errEmptyAddressLine    = errors.New("may not contain empty lines")
+	errSpacesInAddressLine = errors.New("may not have lines starting or ending with a space character")
 )
 
 // MustNotBeEmpty is a h.ValidationRule.
@@ -210,6 +269,50 @@ func MustBeAbsolutePath(val string) error {
 	return nil
 }
 
+// Telephone numbers are free-form in LDAP (RFC 4517, section 3.3.31), but we
+// restrict them to what is commonly used for writing them, e.g.
+// "+49 (0)30 123456-78".
+var telephoneNumberRx = regexp.MustCompile(`^\+?[0-9 ()./-]*[0-9][0-9 ()./-]*$`)
+
+// MustBeTelephoneNumber is a h.ValidationRule.
+func MustBeTelephoneNumber(val string) error {
+	if val != "" && !telephoneNumberRx.MatchString(val) {
+		return errNotTelephoneNumber
+	}
+	return nil
+}
+
+// MustBePostalAddress is a h.ValidationRule for multi-line postal addresses
+// as produced by SplitPostalAddress.
+func MustBePostalAddress(val string) error {
+	if val == "" {
+		return nil
+	}
+	for _, line := range strings.Split(val, "\n") {
+		if strings.TrimSpace(line) == "" {
+			return errEmptyAddressLine
+		}
+		if MustNotHaveSurroundingSpaces(line) != nil {
+			return errSpacesInAddressLine
+		}
+	}
+	return nil
+}
+
+// SplitPostalAddress preprocesses the content of a submitted <textarea> where
+// a postal address is expected. Surrounding spaces and empty lines are
+// removed, and the remaining lines are joined with "\n".
+func SplitPostalAddress(val string) string {
+	var lines []string
+	for _, line := range strings.Split(val, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // SplitSSHPublicKeys preprocesses the content of a submitted <textarea> where a
 // list of SSH public keys is expected. The result will have one public key per
 // array entry.
@@ -36,18 +36,39 @@ type PasswordHasher interface {
 	IsWeakHash(passwordHash string) bool
 }
 
+// HasherOptions contains tuning parameters for the PasswordHasher returned by
+// NewPasswordHasher().
+type HasherOptions struct {
+	// The processing cost for new password hashes, as given to the "count"
+	// argument of crypt_gensalt(3). The meaning of this value depends on the
+	// hash method: For yescrypt, it selects the memory and time cost (with
+	// parallelism derived from it); for bcrypt, it is the base-2 logarithm of
+	// the number of rounds; for sha512crypt, it is the number of rounds.
+	//
+	// If zero, libcrypt chooses a default cost for the preferred hash method.
+	Cost uint
+}
+
 // NewPasswordHasher returns the real PasswordHasher implementation.
-func NewPasswordHasher() (PasswordHasher, error) {
+func NewPasswordHasher(opts HasherOptions) (PasswordHasher, error) {
 	err := llFeatureTest()
 	if err != nil {
 		return nil, err
 	}
 
-	var h hasher
-	h.PreferredMethod = llPreferredMethod()
+	h := hasher{
+		PreferredMethod: llPreferredMethod(),
+		Cost:            opts.Cost,
+	}
 
-	bogusPassword, err := llGenerateSalt(h.PreferredMethod)
+	//this also serves as validation of opts.Cost: libcrypt will reject costs
+	//that are out of range for the preferred method
+	bogusPassword, err := llGenerateSalt(h.PreferredMethod, h.Cost)
 	if err != nil {
+		if h.Cost != 0 {
+			return nil, fmt.Errorf("while generating a bogus password with cost %d (maybe the cost is out of range for hash method %q?): %w",
+				h.Cost, h.PreferredMethod, err)
+		}
 		return nil, fmt.Errorf("while generating a bogus password: %w", err)
 	}
 	bogusPasswordHash, err := llCrypt(bogusPassword, bogusPassword)
@@ -56,6 +77,17 @@ func NewPasswordHasher() (PasswordHasher, error) {
 	}
 	h.BogusPasswordHash = cryptPrefix + bogusPasswordHash
 
+	//when an explicit cost is configured, hashes with a different cost shall be
+	//upgraded just like hashes with a different method; the setting string
+	//looks like "$y$j9T$<salt>" or "$2b$05$<salt>", so everything up to and
+	//including the last "$" describes the method and its parameters
+	if h.Cost != 0 {
+		idx := strings.LastIndex(bogusPassword, "$")
+		if idx > 0 {
+			h.PreferredSettings = bogusPassword[:idx+1]
+		}
+	}
+
 	//TODO: consider allowing manual override of the preferred method, to offer
 	//an upgrade path between libcrypt implementations with different preferences
 	return h, nil
@@ -63,12 +95,14 @@ func NewPasswordHasher() (PasswordHasher, error) {
 
 type hasher struct {
 	PreferredMethod   string
+	PreferredSettings string //only filled if Cost != 0
+	Cost              uint
 	BogusPasswordHash string
 }
 
 // HashPassword implements the PasswordHasher interface.
 func (h hasher) HashPassword(password string) string {
-	salt, err := llGenerateSalt(h.PreferredMethod)
+	salt, err := llGenerateSalt(h.PreferredMethod, h.Cost)
 	if err != nil {
 		logg.Fatal("cannot generate salt for password hashing: %s", err.Error())
 	}
@@ -93,6 +127,11 @@ func (h hasher) CheckPasswordHash(password, passwordHash string) bool {
 		passwordHash = h.BogusPasswordHash
 	}
 
+	//hashes imported from other systems are verified in Go code (see foreign.go)
+	if isForeignHash(passwordHash) {
+		return userExists && checkForeignHash(password, passwordHash)
+	}
+
 	//strip the required prefix that we attached at the end of HashPassword()
 	passwordHash, hasPrefix := strings.CutPrefix(passwordHash, cryptPrefix)
 	if !hasPrefix {
@@ -111,10 +150,16 @@ func (h hasher) CheckPasswordHash(password, passwordHash string) bool {
 
 // IsWeakHash implements the PasswordHasher interface.
 func (h hasher) IsWeakHash(passwordHash string) bool {
+	if isForeignHash(passwordHash) {
+		return true
+	}
 	passwordHash, hasPrefix := strings.CutPrefix(passwordHash, cryptPrefix)
 	if !hasPrefix {
 		return false
 	}
 
+	if h.PreferredSettings != "" {
+		return !strings.HasPrefix(passwordHash, h.PreferredSettings)
+	}
 	return !strings.HasPrefix(passwordHash, h.PreferredMethod)
 }
@@ -0,0 +1,156 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package crypt
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Besides the hashes generated by libcrypt, we accept some hash schemes that
+// are commonly found in other LDAP directories, so that users can be migrated
+// into Portunus without a mass password reset. These foreign hashes are
+// always reported as weak, so they get replaced on the next successful login.
+const (
+	sshaPrefix   = "{SSHA}"
+	pbkdf2Prefix = "{PBKDF2" //followed by "}" or "-SHA1}", "-SHA256}", "-SHA512}"
+)
+
+var pbkdf2Digests = map[string]func() hash.Hash{
+	"{PBKDF2}":        sha1.New,
+	"{PBKDF2-SHA1}":   sha1.New,
+	"{PBKDF2-SHA256}": sha256.New,
+	"{PBKDF2-SHA512}": sha512.New,
+}
+
+// The pw-pbkdf2 module of OpenLDAP uses the "adapted base64" encoding from
+// passlib, which uses "." instead of "+" and omits the padding.
+var ab64Encoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// ImportPasswordHash checks whether a password hash from another system can
+// be used in Portunus, and returns it in the form that Portunus stores. The
+// following formats are accepted:
+//
+//   - "{CRYPT}..." (as generated by HashPassword)
+//   - "$2a$...", "$2b$..." or "$2y$..." (bcrypt without scheme prefix)
+//   - "{SSHA}..." (salted SHA-1, as generated by slappasswd)
+//   - "{PBKDF2}...", "{PBKDF2-SHA256}..." etc. (as generated by slapd's pw-pbkdf2 module)
+//
+// The scheme prefix is matched case-insensitively, like in slapd.
+func ImportPasswordHash(passwordHash string) (string, error) {
+	scheme, _, hasScheme := strings.Cut(passwordHash, "}")
+	if !hasScheme || !strings.HasPrefix(scheme, "{") {
+		//bcrypt hashes are sometimes exported without the {CRYPT} prefix
+		for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+			if strings.HasPrefix(passwordHash, prefix) {
+				return cryptPrefix + passwordHash, nil
+			}
+		}
+		return "", errors.New("password hash does not start with a scheme like {CRYPT}")
+	}
+
+	scheme = strings.ToUpper(scheme + "}")
+	passwordHash = scheme + passwordHash[len(scheme):]
+	switch {
+	case scheme == cryptPrefix:
+		if passwordHash == cryptPrefix {
+			return "", errors.New("password hash in the {CRYPT} scheme is empty")
+		}
+	case scheme == sshaPrefix:
+		_, _, err := parseSSHA(passwordHash)
+		if err != nil {
+			return "", err
+		}
+	case strings.HasPrefix(scheme, pbkdf2Prefix):
+		_, _, _, _, err := parsePBKDF2(passwordHash)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("password hashes in the %s scheme are not supported", scheme)
+	}
+	return passwordHash, nil
+}
+
+func isForeignHash(passwordHash string) bool {
+	return strings.HasPrefix(passwordHash, sshaPrefix) || strings.HasPrefix(passwordHash, pbkdf2Prefix)
+}
+
+// Verifies a password against a hash in one of the foreign schemes.
+// Hashes in other schemes never match.
+func checkForeignHash(password, passwordHash string) bool {
+	var expected, actual []byte
+	switch {
+	case strings.HasPrefix(passwordHash, sshaPrefix):
+		digest, salt, err := parseSSHA(passwordHash)
+		if err != nil {
+			return false
+		}
+		sum := sha1.Sum([]byte(password + string(salt)))
+		expected, actual = digest, sum[:]
+	case strings.HasPrefix(passwordHash, pbkdf2Prefix):
+		newDigest, iterations, salt, digest, err := parsePBKDF2(passwordHash)
+		if err != nil {
+			return false
+		}
+		actual, err = pbkdf2.Key(newDigest, password, salt, iterations, len(digest))
+		if err != nil {
+			return false
+		}
+		expected = digest
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(expected, actual) == 1
+}
+
+// Parses "{SSHA}base64(sha1(password + salt) + salt)".
+func parseSSHA(passwordHash string) (digest, salt []byte, err error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(passwordHash, sshaPrefix))
+	if err != nil || len(buf) <= sha1.Size {
+		return nil, nil, errors.New("password hash in the {SSHA} scheme is malformed")
+	}
+	return buf[:sha1.Size], buf[sha1.Size:], nil
+}
+
+// Parses "{PBKDF2-SHA256}iterations$ab64(salt)$ab64(digest)".
+func parsePBKDF2(passwordHash string) (newDigest func() hash.Hash, iterations int, salt, digest []byte, err error) {
+	scheme, payload, _ := strings.Cut(passwordHash, "}")
+	scheme += "}"
+	newDigest, exists := pbkdf2Digests[scheme]
+	if !exists {
+		return nil, 0, nil, nil, fmt.Errorf("password hashes in the %s scheme are not supported", scheme)
+	}
+
+	errMalformed := fmt.Errorf("password hash in the %s scheme is malformed", scheme)
+	fields := strings.Split(payload, "$")
+	if len(fields) != 3 {
+		return nil, 0, nil, nil, errMalformed
+	}
+	iterations, err = strconv.Atoi(fields[0])
+	if err != nil || iterations <= 0 {
+		return nil, 0, nil, nil, errMalformed
+	}
+	salt, err = ab64Encoding.DecodeString(fields[1])
+	if err != nil || len(salt) == 0 {
+		return nil, 0, nil, nil, errMalformed
+	}
+	digest, err = ab64Encoding.DecodeString(fields[2])
+	if err != nil || len(digest) == 0 {
+		return nil, 0, nil, nil, errMalformed
+	}
+	return newDigest, iterations, salt, digest, nil
+}
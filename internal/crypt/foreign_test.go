@@ -0,0 +1,79 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package crypt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForeignHashes(t *testing.T) {
+	h, err := NewPasswordHasher(HasherOptions{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//bcrypt hashes are usually exported without scheme prefix
+	bcryptSalt, err := llGenerateSalt("$2b$", 4)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	bcryptHash, err := llCrypt("hunter2", bcryptSalt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//all these are hashes of "hunter2" (salted with "pepper12")
+	testCases := map[string]string{
+		bcryptHash: cryptPrefix + bcryptHash,
+		"{ssha}88m3dY86bbB/46jjYMWWejSEkOxwZXBwZXIxMg==":                                                                         "{SSHA}88m3dY86bbB/46jjYMWWejSEkOxwZXBwZXIxMg==",
+		"{PBKDF2}1000$cGVwcGVyMTI$pGWDN53MQzbZkfru25lkCWpopGU":                                                                   "",
+		"{PBKDF2-SHA256}1000$cGVwcGVyMTI$0/01WKqBkuqCn5gulqsHBvv2squHsrnYigU18uAOfKw":                                            "",
+		"{PBKDF2-SHA512}1000$cGVwcGVyMTI$bMitbd1M9z2WMRwHQRDmoChQ2Ijo8Vc/bjJgu0skr/jbm8kXHHcaIcAExr0PtEQT4RzUSOdzVeEROgdswAPVvA": "",
+	}
+	for input, expected := range testCases {
+		if expected == "" {
+			expected = input
+		}
+		actual, err := ImportPasswordHash(input)
+		if err != nil {
+			t.Errorf("ImportPasswordHash(%q) failed: %s", input, err.Error())
+			continue
+		}
+		if actual != expected {
+			t.Errorf("expected ImportPasswordHash(%q) = %q, but got %q", input, expected, actual)
+		}
+		if !h.CheckPasswordHash("hunter2", actual) {
+			t.Errorf("expected %q to match the correct password", actual)
+		}
+		if h.CheckPasswordHash("hunter3", actual) {
+			t.Errorf("expected %q to not match an incorrect password", actual)
+		}
+		//foreign hashes shall be upgraded on the next login
+		isForeign := !strings.HasPrefix(actual, cryptPrefix)
+		if isForeign && !h.IsWeakHash(actual) {
+			t.Errorf("expected %q to be reported as weak", actual)
+		}
+	}
+
+	errorCases := map[string]string{
+		"$6$salt$hash":                    "password hash does not start with a scheme like {CRYPT}",
+		"{CRYPT}":                         "password hash in the {CRYPT} scheme is empty",
+		"{MD5}X03MO1qnZdYdgyfeuILPmQ==":   "password hashes in the {MD5} scheme are not supported",
+		"{SSHA}c2FsdGVkaGFzaA==":          "password hash in the {SSHA} scheme is malformed",
+		"{PBKDF2-SHA256}1000$cGVwcGVyMTI": "password hash in the {PBKDF2-SHA256} scheme is malformed",
+		"{PBKDF2-MD5}1000$cGVw$cGVw":      "password hashes in the {PBKDF2-MD5} scheme are not supported",
+	}
+	for input, expected := range errorCases {
+		_, err := ImportPasswordHash(input)
+		if err == nil {
+			t.Errorf("expected ImportPasswordHash(%q) to fail, but it succeeded", input)
+		} else if err.Error() != expected {
+			t.Errorf("expected ImportPasswordHash(%q) to fail with %q, but got %q", input, expected, err.Error())
+		}
+	}
+}
@@ -69,12 +69,13 @@ func llCrypt(phrase, setting string) (string, error) {
 
 // Wraps the C library function crypt_gensalt_rn(). If called with an empty `prefix`,
 // this autoselects the preferred hash algorithm. Otherwise, the hash algorithm
-// specified by the `prefix` will be used.
-func llGenerateSalt(prefix string) (string, error) {
+// specified by the `prefix` will be used. If `count` is zero, the default
+// processing cost for the selected algorithm will be used.
+func llGenerateSalt(prefix string, count uint) (string, error) {
 	prefixInput := C.CString(prefix)
 	defer C.free(unsafe.Pointer(prefixInput))
 
-	output, err := C.wrap_crypt_gensalt_rn(prefixInput)
+	output, err := C.wrap_crypt_gensalt_rn(prefixInput, C.ulong(count))
 	defer C.free(unsafe.Pointer(output))
 	if err != nil {
 		return "", err
@@ -20,6 +20,6 @@ const char* feature_test();
 char *wrap_crypt_r(const char* phrase, const char* setting);
 
 // Wrapper for crypt_gensalt_rn(). Used on the Go side in llGenerateSalt().
-char *wrap_crypt_gensalt_rn(const char* prefix);
+char *wrap_crypt_gensalt_rn(const char* prefix, unsigned long count);
 
 #endif
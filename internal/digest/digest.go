@@ -0,0 +1,141 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package digest sends a weekly summary of changes to the database by email.
+// The summary is assembled from the events that audit.Log.RecordChanges()
+// puts into the audit log, so people who need to keep an eye on who got
+// access to what (e.g. management or auditors) do not need admin access to
+// the UI for that.
+package digest
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+)
+
+// Digest is the summary of all changes within a certain time frame.
+type Digest struct {
+	Since        time.Time
+	Until        time.Time
+	CreatedUsers []string //login names
+	DeletedUsers []string //login names
+	//Changes to the permissions of groups, as well as changes to the members of
+	//groups that grant permissions. One human-readable line per change.
+	PermissionChanges []string
+	//Groups where the number of members grew by more than the threshold given
+	//to Build().
+	GrownGroups []GroupGrowth
+}
+
+// GroupGrowth appears in type Digest.
+type GroupGrowth struct {
+	GroupName    string
+	AddedCount   int
+	RemovedCount int
+}
+
+// Build assembles a Digest from the given audit events. Events outside of
+// the given time frame are ignored.
+func Build(events []audit.Event, since, until time.Time, growthThreshold int) Digest {
+	d := Digest{Since: since, Until: until}
+	growthByGroup := make(map[string]*GroupGrowth)
+	var groupNames []string
+
+	for _, e := range events {
+		if !e.Time.After(since) || e.Time.After(until) {
+			continue
+		}
+		switch e.Type {
+		case audit.EventUserCreated:
+			d.CreatedUsers = append(d.CreatedUsers, e.Subject)
+		case audit.EventUserDeleted:
+			d.DeletedUsers = append(d.DeletedUsers, e.Subject)
+		case audit.EventGroupPermissionsChanged:
+			d.PermissionChanges = append(d.PermissionChanges, fmt.Sprintf(
+				"%s: group %q now grants %s (previously: %s), changed by %s",
+				formatTime(e.Time), e.Group, e.Details["new"], e.Details["old"], e.Actor.String()))
+		case audit.EventGroupMembersChanged:
+			added := strings.Fields(e.Details["added"])
+			removed := strings.Fields(e.Details["removed"])
+			if e.Details["permissions"] != "none" {
+				d.PermissionChanges = append(d.PermissionChanges, fmt.Sprintf(
+					"%s: %s in group %q (grants %s), changed by %s",
+					formatTime(e.Time), describeMemberChanges(added, removed), e.Group, e.Details["permissions"], e.Actor.String()))
+			}
+
+			growth := growthByGroup[e.Group]
+			if growth == nil {
+				growth = &GroupGrowth{GroupName: e.Group}
+				growthByGroup[e.Group] = growth
+				groupNames = append(groupNames, e.Group)
+			}
+			growth.AddedCount += len(added)
+			growth.RemovedCount += len(removed)
+		}
+	}
+
+	slices.Sort(groupNames)
+	for _, name := range groupNames {
+		growth := *growthByGroup[name]
+		if growth.AddedCount-growth.RemovedCount > growthThreshold {
+			d.GrownGroups = append(d.GrownGroups, growth)
+		}
+	}
+	return d
+}
+
+func describeMemberChanges(added, removed []string) string {
+	var parts []string
+	if len(added) > 0 {
+		parts = append(parts, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(removed, ", "))
+	}
+	return strings.Join(parts, " and ")
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// Subject returns the subject line for the email containing this Digest.
+func (d Digest) Subject() string {
+	return fmt.Sprintf("Portunus change digest for %s to %s",
+		d.Since.UTC().Format(time.DateOnly), d.Until.UTC().Format(time.DateOnly))
+}
+
+// Render returns the body of the email containing this Digest, as plain text.
+func (d Digest) Render() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is a summary of the changes in Portunus between %s and %s.\n",
+		formatTime(d.Since), formatTime(d.Until))
+
+	renderSection := func(title string, lines []string) {
+		fmt.Fprintf(&b, "\n%s:\n", title)
+		if len(lines) == 0 {
+			b.WriteString("  (none)\n")
+		}
+		for _, line := range lines {
+			fmt.Fprintf(&b, "  - %s\n", line)
+		}
+	}
+	renderSection("Accounts created", d.CreatedUsers)
+	renderSection("Accounts deleted", d.DeletedUsers)
+	renderSection("Permission changes", d.PermissionChanges)
+
+	var growthLines []string
+	for _, g := range d.GrownGroups {
+		growthLines = append(growthLines, fmt.Sprintf("%s: %d members added, %d members removed",
+			g.GroupName, g.AddedCount, g.RemovedCount))
+	}
+	renderSection("Groups with many new members", growthLines)
+	return b.String()
+}
@@ -0,0 +1,107 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package digest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestBuildAndRender(t *testing.T) {
+	t0 := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	admin := core.Actor{Type: core.ActorTypeUser, Name: "admin"}
+	events := []audit.Event{
+		//too old to be included
+		{Time: t0, Type: audit.EventUserCreated, Actor: admin, Subject: "old"},
+		{Time: t0.Add(time.Hour), Type: audit.EventUserCreated, Actor: admin, Subject: "jane"},
+		{Time: t0.Add(2 * time.Hour), Type: audit.EventUserDeleted, Actor: admin, Subject: "john"},
+		//logins are not interesting for the digest
+		{Time: t0.Add(2 * time.Hour), Type: audit.EventLogin, Actor: admin, Subject: "admin"},
+		{
+			Time: t0.Add(3 * time.Hour), Type: audit.EventGroupPermissionsChanged, Actor: admin, Group: "ops",
+			Details: map[string]string{"old": "none", "new": "LDAP read access"},
+		},
+		{
+			Time: t0.Add(4 * time.Hour), Type: audit.EventGroupMembersChanged, Actor: core.Actor{Type: core.ActorTypeSeed}, Group: "admins",
+			Details: map[string]string{"added": "jane", "removed": "", "permissions": "Portunus admin"},
+		},
+		//the growth of a group is counted across events
+		{
+			Time: t0.Add(5 * time.Hour), Type: audit.EventGroupMembersChanged, Actor: admin, Group: "staff",
+			Details: map[string]string{"added": "a b c", "removed": "", "permissions": "none"},
+		},
+		{
+			Time: t0.Add(6 * time.Hour), Type: audit.EventGroupMembersChanged, Actor: admin, Group: "staff",
+			Details: map[string]string{"added": "d", "removed": "e", "permissions": "none"},
+		},
+		//too new to be included
+		{Time: t0.Add(interval + time.Hour), Type: audit.EventUserCreated, Actor: admin, Subject: "new"},
+	}
+
+	d := Build(events, t0, t0.Add(interval), 2)
+	assert.DeepEqual(t, "subject", d.Subject(), "Portunus change digest for 2024-03-04 to 2024-03-11")
+	assert.DeepEqual(t, "body", d.Render(), `This is a summary of the changes in Portunus between 2024-03-04 08:00 UTC and 2024-03-11 08:00 UTC.
+
+Accounts created:
+  - jane
+
+Accounts deleted:
+  - john
+
+Permission changes:
+  - 2024-03-04 11:00 UTC: group "ops" now grants LDAP read access (previously: none), changed by user admin
+  - 2024-03-04 12:00 UTC: added jane in group "admins" (grants Portunus admin), changed by seed
+
+Groups with many new members:
+  - staff: 4 members added, 1 members removed
+`)
+
+	//with a higher threshold, no groups are listed
+	d = Build(events, t0, t0.Add(interval), 3)
+	assert.DeepEqual(t, "grown groups", d.GrownGroups, []GroupGrowth(nil))
+}
+
+func TestSendIfDue(t *testing.T) {
+	dir := t.TempDir()
+	log, err := audit.OpenLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := NewSender(log, SenderOptions{StatePath: filepath.Join(dir, "digest-state.json")})
+	var subjects []string
+	s.sendMail = func(subject, body string) error {
+		subjects = append(subjects, subject)
+		return nil
+	}
+
+	//on first start, nothing is sent, but the timer starts running
+	t0 := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	for _, now := range []time.Time{t0, t0.Add(time.Hour), t0.Add(interval - time.Minute)} {
+		err := s.sendIfDue(now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	assert.DeepEqual(t, "digests sent during first week", len(subjects), 0)
+
+	//the digest is sent once per week
+	for _, now := range []time.Time{t0.Add(interval), t0.Add(interval + time.Hour), t0.Add(2*interval + time.Minute)} {
+		err := s.sendIfDue(now)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	assert.DeepEqual(t, "digests sent", subjects, []string{
+		"Portunus change digest for 2024-03-04 to 2024-03-11",
+		"Portunus change digest for 2024-03-11 to 2024-03-18",
+	})
+}
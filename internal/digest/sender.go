@@ -0,0 +1,157 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package digest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// How often the digest is sent.
+const interval = 7 * 24 * time.Hour
+
+// SenderOptions contains the configuration for a Sender.
+type SenderOptions struct {
+	Recipients []string //email addresses
+	//Groups that grew by more than this many members are listed in the digest.
+	GrowthThreshold int
+	//Where the time of the last digest is stored, so that restarts do not
+	//cause digests to be skipped or sent twice.
+	StatePath string
+	Mail      MailOptions
+}
+
+// MailOptions describes how to reach the SMTP server.
+type MailOptions struct {
+	ServerAddress string //e.g. "mail.example.org:587"
+	FromAddress   string
+	//If given, the SMTP server is authenticated against with PLAIN auth. This
+	//requires TLS unless the server is on localhost.
+	Username string
+	Password string
+}
+
+// Sender sends the digest once per week.
+type Sender struct {
+	log  *audit.Log
+	opts SenderOptions
+	//can be replaced in tests
+	sendMail func(subject, body string) error
+}
+
+// NewSender instantiates a Sender.
+func NewSender(log *audit.Log, opts SenderOptions) *Sender {
+	s := &Sender{log: log, opts: opts}
+	s.sendMail = s.sendMailViaSMTP
+	return s
+}
+
+// Run sends the digest whenever it is due, until `ctx` expires.
+func (s *Sender) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		err := s.sendIfDue(time.Now())
+		if err != nil {
+			//we will try again on the next tick
+			logg.Error("could not send change digest: %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type senderState struct {
+	LastSentAt time.Time `json:"last_sent_at"`
+}
+
+func (s *Sender) sendIfDue(now time.Time) error {
+	var state senderState
+	buf, err := os.ReadFile(s.opts.StatePath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		//on first start, there is nothing to report yet
+		return s.writeState(senderState{LastSentAt: now})
+	case err != nil:
+		return err
+	}
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return fmt.Errorf("while parsing %s: %w", s.opts.StatePath, err)
+	}
+	if now.Sub(state.LastSentAt) < interval {
+		return nil
+	}
+
+	events, err := s.log.ListEventsBetween(state.LastSentAt, now)
+	if err != nil {
+		return err
+	}
+	d := Build(events, state.LastSentAt, now, s.opts.GrowthThreshold)
+	err = s.sendMail(d.Subject(), d.Render())
+	if err != nil {
+		return err
+	}
+	logg.Info("sent change digest to %s", strings.Join(s.opts.Recipients, ", "))
+	return s.writeState(senderState{LastSentAt: now})
+}
+
+func (s *Sender) writeState(state senderState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.opts.StatePath, buf, 0600)
+}
+
+func (s *Sender) sendMailViaSMTP(subject, body string) error {
+	return s.opts.Mail.Send(s.opts.Recipients, subject, body)
+}
+
+// Send submits a plain-text email to the SMTP server. This is also used for
+// emails that are not part of the digest, e.g. for notifying users about
+// security events.
+func (mo MailOptions) Send(to []string, subject, body string) error {
+	var auth smtp.Auth
+	if mo.Username != "" {
+		host, _, err := net.SplitHostPort(mo.ServerAddress)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", mo.Username, mo.Password, host)
+	}
+	msg := buildMessage(mo.FromAddress, to, subject, body, time.Now())
+	return smtp.SendMail(mo.ServerAddress, auth, mo.FromAddress, to, msg)
+}
+
+func buildMessage(from string, to []string, subject, body string, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package envconfig contains the parsers for configuration values that are
+// shared between portunus-orchestrator (which validates the configuration)
+// and portunus-server (which uses it). All errors name the environment
+// variable in question.
+package envconfig
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format descriptions for error messages.
+const (
+	durationFormat         = `a duration like "30s" or "5m"`
+	positiveDurationFormat = `a positive duration like "30s" or "5m"`
+	sizeFormat             = `a size like "512KiB" or "10MiB"`
+	uintFormat             = "a non-negative integer"
+)
+
+// ParseDuration parses a non-negative Go duration string like "30s" or "5m".
+func ParseDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("expected %s, but got %q", durationFormat, value)
+	}
+	return d, nil
+}
+
+var sizeUnits = []struct {
+	Suffix     string
+	Multiplier uint64
+}{
+	//longer suffixes first, since "B" is a suffix of all of them
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"TiB", 1 << 40},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"TB", 1e12},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes like "1048576", "512KiB" or "10MiB". Both
+// binary (KiB, MiB, GiB, TiB) and decimal units (KB, MB, GB, TB) are accepted.
+func ParseSize(value string) (uint64, error) {
+	number, multiplier := strings.TrimSpace(value), uint64(1)
+	for _, unit := range sizeUnits {
+		if prefix, ok := strings.CutSuffix(number, unit.Suffix); ok {
+			number, multiplier = strings.TrimSpace(prefix), unit.Multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("expected %s, but got %q", sizeFormat, value)
+	}
+	return n * multiplier, nil
+}
+
+// ParseUint parses a non-negative integer that fits into the given number of
+// bits, like strconv.ParseUint, but with a more readable error message.
+func ParseUint(value string, bitSize int) (uint64, error) {
+	n, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("expected %s below 2^%d, but got %q", uintFormat, bitSize, value)
+	}
+	return n, nil
+}
+
+// GetDuration reads a duration (see ParseDuration) from the given environment
+// variable, or returns the default value if the variable is empty.
+func GetDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	return get(key, defaultValue, ParseDuration)
+}
+
+// GetPositiveDuration is like GetDuration, but also rejects zero. This is
+// used for intervals that drive a ticker, since time.NewTicker panics on zero.
+func GetPositiveDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	return get(key, defaultValue, func(value string) (time.Duration, error) {
+		d, err := ParseDuration(value)
+		if err != nil || d == 0 {
+			return 0, fmt.Errorf("expected %s, but got %q", positiveDurationFormat, value)
+		}
+		return d, nil
+	})
+}
+
+// GetSize reads a size in bytes (see ParseSize) from the given environment
+// variable, or returns the default value if the variable is empty.
+func GetSize(key string, defaultValue uint64) (uint64, error) {
+	return get(key, defaultValue, ParseSize)
+}
+
+// GetUint reads a non-negative integer from the given environment variable,
+// or returns the default value if the variable is empty. The value must fit
+// into 32 bits, since this is mostly used for counts and limits.
+func GetUint(key string, defaultValue uint) (uint, error) {
+	return get(key, defaultValue, func(value string) (uint, error) {
+		n, err := ParseUint(value, 32)
+		return uint(n), err
+	})
+}
+
+// GetUint64 is like GetUint, but allows values that need all 64 bits.
+func GetUint64(key string, defaultValue uint64) (uint64, error) {
+	return get(key, defaultValue, func(value string) (uint64, error) {
+		return ParseUint(value, 64)
+	})
+}
+
+func get[T any](key string, defaultValue T, parse func(string) (T, error)) (T, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := parse(value)
+	if err != nil {
+		return defaultValue, fmt.Errorf("malformed value for %s: %w", key, err)
+	}
+	return result, nil
+}
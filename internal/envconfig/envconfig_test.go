@@ -0,0 +1,80 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package envconfig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	valid := map[string]uint64{
+		"0":       0,
+		"1048576": 1 << 20,
+		"512B":    512,
+		"512KiB":  512 << 10,
+		"10MiB":   10 << 20,
+		"10 MiB":  10 << 20,
+		"2GiB":    2 << 30,
+		"10MB":    10_000_000,
+		"1TB":     1_000_000_000_000,
+	}
+	for input, expected := range valid {
+		actual, err := ParseSize(input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", input, err.Error())
+		}
+		assert.DeepEqual(t, "ParseSize("+input+")", actual, expected)
+	}
+
+	for _, input := range []string{"", "MiB", "-1KiB", "1.5MiB", "10mib", "10 kilobytes", "20000000TiB"} {
+		_, err := ParseSize(input)
+		if err == nil {
+			t.Errorf("expected error for %q, but got none", input)
+		}
+	}
+}
+
+func TestGetters(t *testing.T) {
+	t.Setenv("PORTUNUS_TEST_DURATION", "")
+	d, err := GetDuration("PORTUNUS_TEST_DURATION", 5*time.Second)
+	assert.DeepEqual(t, "default duration", d, 5*time.Second)
+	assert.DeepEqual(t, "error for default duration", err, nil)
+
+	t.Setenv("PORTUNUS_TEST_DURATION", "2m")
+	d, err = GetDuration("PORTUNUS_TEST_DURATION", 5*time.Second)
+	assert.DeepEqual(t, "parsed duration", d, 2*time.Minute)
+	assert.DeepEqual(t, "error for parsed duration", err, nil)
+
+	t.Setenv("PORTUNUS_TEST_DURATION", "-2m")
+	_, err = GetDuration("PORTUNUS_TEST_DURATION", 5*time.Second)
+	assert.DeepEqual(t, "error for negative duration", err.Error(),
+		`malformed value for PORTUNUS_TEST_DURATION: expected a duration like "30s" or "5m", but got "-2m"`)
+
+	t.Setenv("PORTUNUS_TEST_DURATION", "0s")
+	d, err = GetDuration("PORTUNUS_TEST_DURATION", 5*time.Second)
+	assert.DeepEqual(t, "parsed zero duration", d, time.Duration(0))
+	assert.DeepEqual(t, "error for parsed zero duration", err, nil)
+	_, err = GetPositiveDuration("PORTUNUS_TEST_DURATION", 5*time.Second)
+	assert.DeepEqual(t, "error for zero positive duration", err.Error(),
+		`malformed value for PORTUNUS_TEST_DURATION: expected a positive duration like "30s" or "5m", but got "0s"`)
+
+	t.Setenv("PORTUNUS_TEST_SIZE", "1 GiB")
+	s, err := GetSize("PORTUNUS_TEST_SIZE", 1<<20)
+	assert.DeepEqual(t, "parsed size", s, uint64(1<<30))
+	assert.DeepEqual(t, "error for parsed size", err, nil)
+
+	t.Setenv("PORTUNUS_TEST_UINT", "4294967296")
+	_, err = GetUint("PORTUNUS_TEST_UINT", 10)
+	assert.DeepEqual(t, "error for overflowing integer", err.Error(),
+		`malformed value for PORTUNUS_TEST_UINT: expected a non-negative integer below 2^32, but got "4294967296"`)
+	n, err := GetUint64("PORTUNUS_TEST_UINT", 10)
+	assert.DeepEqual(t, "parsed 64-bit integer", n, uint64(1<<32))
+	assert.DeepEqual(t, "error for parsed 64-bit integer", err, nil)
+}
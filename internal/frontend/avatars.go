@@ -0,0 +1,212 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// AvatarSource looks up avatars for users without an uploaded photo from a
+// Libravatar-compatible service (such as libravatar.org or Gravatar), based
+// on the hash of their email address.
+type AvatarSource struct {
+	//e.g. "https://seccdn.libravatar.org/avatar"
+	BaseURL string
+	//If false, avatars are fetched by Portunus and served from its own
+	//domain, so that the avatar service does not learn which browsers look at
+	//which users. If true, browsers load the avatars directly from BaseURL.
+	Direct bool
+
+	client *http.Client
+	mutex  sync.Mutex
+	cache  map[string]cachedAvatar //key = email hash
+}
+
+type cachedAvatar struct {
+	ContentType string
+	Contents    []byte //nil if the avatar service did not return an image
+	FetchedAt   time.Time
+}
+
+const (
+	avatarCacheTTL      = time.Hour
+	avatarCacheCapacity = 1000
+	avatarMaxSize       = 256 << 10 // 256 KiB
+	//s = size in pixels, d = fallback for unknown email addresses
+	avatarQuery = "s=64&d=identicon"
+)
+
+// ReadAvatarSourceFromEnvironment reads an AvatarSource from the
+// PORTUNUS_SERVER_AVATAR_* environment variables that are documented in the
+// README. If avatars are not enabled, nil is returned.
+func ReadAvatarSourceFromEnvironment() (*AvatarSource, error) {
+	baseURL := os.Getenv("PORTUNUS_SERVER_AVATAR_URL")
+	if baseURL == "" {
+		return nil, nil
+	}
+	if !isWebURL(baseURL) {
+		return nil, fmt.Errorf("malformed value for PORTUNUS_SERVER_AVATAR_URL: expected an http:// or https:// URL, but got %q", baseURL)
+	}
+	return &AvatarSource{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Direct:  os.Getenv("PORTUNUS_SERVER_AVATAR_DIRECT") == "true",
+		client:  &http.Client{Timeout: 5 * time.Second},
+		cache:   make(map[string]cachedAvatar),
+	}, nil
+}
+
+// Host returns the host name of the avatar service, for display purposes.
+func (s *AvatarSource) Host() string {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return s.BaseURL
+	}
+	return u.Host
+}
+
+// Origin returns the origin of BaseURL, for the Content-Security-Policy.
+func (s *AvatarSource) Origin() string {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// As specified by Libravatar, email addresses are normalized before hashing.
+// SHA-256 is understood by both Libravatar and Gravatar.
+func hashEmailAddress(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *AvatarSource) urlFor(email string) string {
+	return fmt.Sprintf("%s/%s?%s", s.BaseURL, hashEmailAddress(email), avatarQuery)
+}
+
+// fetch returns the avatar for the given email address from the cache, or
+// from the avatar service if it is not cached.
+func (s *AvatarSource) fetch(email string) (cachedAvatar, error) {
+	hash := hashEmailAddress(email)
+	s.mutex.Lock()
+	entry, exists := s.cache[hash]
+	s.mutex.Unlock()
+	if exists && time.Since(entry.FetchedAt) < avatarCacheTTL {
+		return entry, nil
+	}
+
+	resp, err := s.client.Get(s.urlFor(email))
+	if err != nil {
+		return cachedAvatar{}, err
+	}
+	defer resp.Body.Close()
+	entry = cachedAvatar{ContentType: resp.Header.Get("Content-Type"), FetchedAt: time.Now()}
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(entry.ContentType, "image/") {
+		entry.Contents, err = io.ReadAll(io.LimitReader(resp.Body, avatarMaxSize))
+		if err != nil {
+			return cachedAvatar{}, err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.cache) >= avatarCacheCapacity {
+		//this is crude, but the cache is only there to avoid refetching the
+		//avatars for the same list over and over
+		clear(s.cache)
+	}
+	s.cache[hash] = entry
+	return entry, nil
+}
+
+// avatarURLFor returns where the picture of the given user can be loaded
+// from, or "" if there is none. If `avatarSource` is nil, only uploaded photos
+// are shown.
+func avatarURLFor(avatarSource *AvatarSource, user core.User) string {
+	switch {
+	case len(user.JPEGPhoto) > 0:
+		return "/users/" + url.PathEscape(user.LoginName) + "/avatar"
+	case avatarSource == nil || user.EMailAddress == "":
+		return ""
+	case avatarSource.Direct:
+		return avatarSource.urlFor(user.EMailAddress)
+	default:
+		return "/users/" + url.PathEscape(user.LoginName) + "/avatar"
+	}
+}
+
+var avatarSnippet = h.NewSnippet(`<img class="avatar" src="{{.}}" alt="" loading="lazy" referrerpolicy="no-referrer">`)
+
+// renderAvatar renders a small picture of the user for lists, or nothing if
+// there is neither an uploaded photo nor an avatar.
+func renderAvatar(avatarSource *AvatarSource, user core.User) template.HTML {
+	avatarURL := avatarURLFor(avatarSource, user)
+	if avatarURL == "" {
+		return ""
+	}
+	return avatarSnippet.Render(avatarURL)
+}
+
+// Serves the avatar URLs from avatarURLFor() that point to Portunus itself.
+// Like the photo on the self-service page, users can only see their own
+// picture, and admins can see the pictures of all users.
+func getUserAvatarHandler(n core.Nexus, avatarSource *AvatarSource) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		func(i *Interaction) {
+			loginName := mux.Vars(i.Req)["uid"]
+			if loginName != i.CurrentUser.LoginName && !i.CurrentUser.Perms.Includes(adminPerms) {
+				i.WriteError("Forbidden", http.StatusForbidden)
+				return
+			}
+			user, exists := n.FindUser(func(u core.User) bool { return u.LoginName == loginName })
+			if !exists {
+				i.WriteError("Not found", http.StatusNotFound)
+				return
+			}
+
+			var avatar cachedAvatar
+			switch {
+			case len(user.JPEGPhoto) > 0:
+				avatar = cachedAvatar{ContentType: "image/jpeg", Contents: user.JPEGPhoto}
+			case avatarSource != nil && !avatarSource.Direct && user.EMailAddress != "":
+				var err error
+				avatar, err = avatarSource.fetch(user.EMailAddress)
+				if err != nil {
+					i.WriteError("Could not fetch avatar: "+err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+			if avatar.Contents == nil {
+				i.WriteError("Not found", http.StatusNotFound)
+				return
+			}
+
+			hdr := i.writer.Header()
+			hdr.Set("Content-Type", avatar.ContentType)
+			hdr.Set("Cache-Control", "private, max-age=300")
+			i.writer.WriteHeader(http.StatusOK)
+			_, _ = i.writer.Write(avatar.Contents)
+			i.writer = nil
+		},
+	)
+}
@@ -0,0 +1,40 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestAvatarSourceIsUsedPerHandler(t *testing.T) {
+	_, avatarServer := setupFrontendWithOptions(t, HandlerOptions{Avatars: &AvatarSource{
+		BaseURL: "https://avatars.example.org/avatar",
+		Direct:  true,
+	}})
+	//a handler without avatars in the same process must not allow loading them
+	_, plainServer := setupFrontend(t)
+
+	for _, tc := range []struct {
+		URL         string
+		AllowsImage bool
+	}{
+		{avatarServer.URL, true},
+		{plainServer.URL, false},
+	} {
+		resp, err := http.Get(tc.URL + "/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		csp := resp.Header.Get("Content-Security-Policy")
+		assert.DeepEqual(t, "CSP allows images from avatar service", strings.Contains(csp, "https://avatars.example.org"), tc.AllowsImage)
+	}
+}
@@ -0,0 +1,126 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/logg"
+)
+
+func useBindTestForm(i *Interaction) {
+	i.FormState = &h.FormState{Fields: map[string]*h.FieldState{}}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/status/test-bind",
+		SubmitLabel: "Test credentials",
+		Fields: []h.FormField{
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "account",
+				Label:     "Login name or DN",
+			},
+			h.InputFieldSpec{
+				InputType: "password",
+				Name:      "password",
+				Label:     "Password",
+			},
+		},
+	}
+}
+
+func getBindTestHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useBindTestForm,
+		ShowForm("Test LDAP credentials"),
+	)
+}
+
+func postBindTestHandler(n core.Nexus, testBind func(loginNameOrDN, password string) ldap.BindTestResult) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useBindTestForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			i.FormState.Fields["account"].GetValueOrSetError()
+			i.FormState.Fields["password"].GetValueOrSetError()
+		},
+		ShowFormIfErrors("Test LDAP credentials"),
+		ShowView(func(i *Interaction) Page {
+			account := i.FormState.Fields["account"].Value
+			result := testBind(account, i.FormState.Fields["password"].Value)
+			logg.Info("%s tested the LDAP credentials of %s", i.CurrentUser.LoginName, result.DN)
+
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "Test LDAP credentials",
+				Contents: i.FormSpec.Render(i.Req, *i.FormState) + bindTestResultSnippet.Render(result),
+			}
+		}),
+	)
+}
+
+var bindTestResultSnippet = h.NewSnippet(`
+	<h2>Result</h2>
+	<table class="table">
+		<tbody>
+			<tr><th>Bind DN</th><td><code>{{.DN}}</code></td></tr>
+			<tr><th>Bind result</th><td>{{if .BindError}}<strong>failed:</strong> {{.BindError}}{{else}}success{{end}}</td></tr>
+		</tbody>
+	</table>
+	{{ if not .BindError }}
+		{{ with .SearchErrors }}
+			<p>The following searches failed while bound with these credentials:</p>
+			<ul>
+				{{range .}}<li>{{.}}</li>{{end}}
+			</ul>
+		{{ end }}
+		<h2>Own object</h2>
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Attribute</th>
+					<th>Values</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .OwnAttributes}}
+					<tr>
+						<td data-label="Attribute"><code>{{.Name}}</code></td>
+						<td data-label="Values">{{range .Values}}<code>{{.}}</code> {{end}}</td>
+					</tr>
+				{{else}}
+					<tr><td colspan="2" class="text-muted">No attributes are visible.</td></tr>
+				{{end}}
+			</tbody>
+		</table>
+		<h2>Visible objects</h2>
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Below</th>
+					<th>Count</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .VisibleObjects}}
+					<tr>
+						<td data-label="Below"><code>{{.BaseDN}}</code></td>
+						<td data-label="Count">{{.Count}}</td>
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{ end }}
+`)
@@ -0,0 +1,151 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Branding contains the settings for making the web UI match the corporate
+// design of the organization that runs Portunus.
+type Branding struct {
+	//Shown instead of "Portunus" in page titles, on the login page and in
+	//authenticator apps. Optional.
+	ProductName string
+	//Shown in the menu bar instead of the Portunus logo. Optional.
+	Logo *BrandingAsset
+	//CSS colors like "#3366CC". Optional.
+	AccentColor string //for buttons and the marker of the current menu item
+	LinkColor   string
+}
+
+// BrandingAsset is a file from PORTUNUS_SERVER_BRANDING_DIR. Its contents are
+// read on startup, so that the directory does not need to stay readable.
+type BrandingAsset struct {
+	FileName string
+	Contents []byte
+	ModTime  time.Time
+}
+
+// The logo files that are recognized in PORTUNUS_SERVER_BRANDING_DIR, in order
+// of preference.
+var brandingLogoFileNames = []string{"logo.svg", "logo.png"}
+
+var cssColorRx = regexp.MustCompile(`^#(?:[0-9A-Fa-f]{3}|[0-9A-Fa-f]{6})$`)
+
+// ReadBrandingFromEnvironment reads a Branding from the PORTUNUS_SERVER_*
+// environment variables that are documented in the README.
+func ReadBrandingFromEnvironment() (Branding, error) {
+	b := Branding{
+		ProductName: strings.TrimSpace(os.Getenv("PORTUNUS_SERVER_PRODUCT_NAME")),
+	}
+
+	for key, target := range map[string]*string{
+		"PORTUNUS_SERVER_ACCENT_COLOR": &b.AccentColor,
+		"PORTUNUS_SERVER_LINK_COLOR":   &b.LinkColor,
+	} {
+		value := strings.TrimSpace(os.Getenv(key))
+		if value != "" && !cssColorRx.MatchString(value) {
+			return Branding{}, fmt.Errorf(`malformed value for %s: expected a color like "#3366CC", but got %q`, key, value)
+		}
+		*target = value
+	}
+
+	dirPath := os.Getenv("PORTUNUS_SERVER_BRANDING_DIR")
+	if dirPath == "" {
+		return b, nil
+	}
+	for _, fileName := range brandingLogoFileNames {
+		asset, err := readBrandingAsset(filepath.Join(dirPath, fileName))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Branding{}, fmt.Errorf("while reading PORTUNUS_SERVER_BRANDING_DIR: %w", err)
+		}
+		b.Logo = &asset
+		break
+	}
+	if b.Logo == nil {
+		return Branding{}, fmt.Errorf("PORTUNUS_SERVER_BRANDING_DIR (%s) does not contain any of: %s",
+			dirPath, strings.Join(brandingLogoFileNames, ", "))
+	}
+	return b, nil
+}
+
+func readBrandingAsset(path string) (BrandingAsset, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return BrandingAsset{}, err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return BrandingAsset{}, err
+	}
+	return BrandingAsset{FileName: filepath.Base(path), Contents: buf, ModTime: fi.ModTime()}, nil
+}
+
+// Used by HTTPHandler() if Branding.ProductName is empty.
+const defaultProductName = "Portunus"
+
+// LogoURL returns the URL of the logo in the menu bar.
+func (b Branding) LogoURL() string {
+	if b.Logo == nil {
+		return "/static/img/logo-for-menubar.png"
+	}
+	return "/branding/" + b.Logo.FileName
+}
+
+// ThemeStylesheet returns the CSS that overrides the default colors, or an
+// empty string if the default colors are used. It is served as a separate
+// file (instead of inline in the page) because the Content-Security-Policy
+// does not allow inline styles.
+func (b Branding) ThemeStylesheet() string {
+	var buf bytes.Buffer
+	if b.AccentColor != "" {
+		fmt.Fprintf(&buf, ":root,.button-primary,.flash-primary,body>nav#nav{--highlight-color:%s}\n", b.AccentColor)
+	}
+	if b.LinkColor != "" {
+		fmt.Fprintf(&buf, ":root{--link-color:%s}\n", b.LinkColor)
+	}
+	return buf.String()
+}
+
+// Handles GET /branding/theme.css.
+func getBrandingThemeHandler(branding Branding, startupTime time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		css := branding.ThemeStylesheet()
+		if css == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		http.ServeContent(w, r, "theme.css", startupTime, strings.NewReader(css))
+	})
+}
+
+// Handles GET /branding/{file}.
+func getBrandingAssetHandler(branding Branding) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asset := branding.Logo
+		if asset == nil || r.URL.Path != "/branding/"+asset.FileName {
+			http.NotFound(w, r)
+			return
+		}
+		//the Content-Type is chosen by ServeContent() based on the file extension
+		http.ServeContent(w, r, asset.FileName, asset.ModTime, bytes.NewReader(asset.Contents))
+	})
+}
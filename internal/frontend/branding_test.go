@@ -0,0 +1,79 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestReadBrandingFromEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PORTUNUS_SERVER_PRODUCT_NAME", "Example Corp Accounts")
+	t.Setenv("PORTUNUS_SERVER_ACCENT_COLOR", "#36C")
+	t.Setenv("PORTUNUS_SERVER_BRANDING_DIR", dir)
+
+	//the branding directory must contain a logo
+	_, err := ReadBrandingFromEnvironment()
+	assert.DeepEqual(t, "error for empty branding dir", err.Error(),
+		"PORTUNUS_SERVER_BRANDING_DIR ("+dir+") does not contain any of: logo.svg, logo.png")
+
+	//SVG is preferred over PNG
+	for _, name := range []string{"logo.png", "logo.svg"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ReadBrandingFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "product name", b.ProductName, "Example Corp Accounts")
+	assert.DeepEqual(t, "logo URL", b.LogoURL(), "/branding/logo.svg")
+	assert.DeepEqual(t, "logo contents", string(b.Logo.Contents), "logo.svg")
+	assert.DeepEqual(t, "theme stylesheet", b.ThemeStylesheet(),
+		":root,.button-primary,.flash-primary,body>nav#nav{--highlight-color:#36C}\n")
+
+	//colors are validated, since they end up in a stylesheet
+	t.Setenv("PORTUNUS_SERVER_LINK_COLOR", "red;}body{display:none")
+	_, err = ReadBrandingFromEnvironment()
+	assert.DeepEqual(t, "error for malformed color", err.Error(),
+		`malformed value for PORTUNUS_SERVER_LINK_COLOR: expected a color like "#3366CC", but got "red;}body{display:none"`)
+}
+
+func TestBrandingIsShownPerHandler(t *testing.T) {
+	_, brandedServer := setupFrontendWithOptions(t, HandlerOptions{Branding: Branding{
+		ProductName: "Example Corp Accounts",
+		AccentColor: "#36C",
+	}})
+	//each handler shows its own branding, even when there are several in one process
+	_, defaultServer := setupFrontend(t)
+
+	for _, tc := range []struct {
+		Browser     *browser
+		ProductName string
+		ThemeStatus int
+	}{
+		{newBrowser(t, brandedServer), "Example Corp Accounts", http.StatusOK},
+		{newBrowser(t, defaultServer), "Portunus", http.StatusNotFound},
+	} {
+		b := tc.Browser
+		_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+		assert.DeepEqual(t, "redirect after login", location, "/self")
+		_, body := b.Get("/logout")
+		assert.DeepEqual(t, "product name on /logout", strings.Contains(body, "Do you want to log out of "+tc.ProductName+"?"), true)
+		status, _ := b.Get("/branding/theme.css")
+		assert.DeepEqual(t, "status for /branding/theme.css", status, tc.ThemeStatus)
+	}
+}
@@ -0,0 +1,56 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/clientinfo"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/sapcc/go-bits/logg"
+)
+
+var browserWarningSnippet = h.NewSnippet(`
+	<div class="flash flash-warning">
+		{{T "Your browser is too old to be used with %s safely, since it does not support the SameSite attribute of cookies." .}}
+		{{T "Please upgrade to a current version of your browser."}}
+	</div>
+`)
+
+// renderBrowserWarning renders a warning banner for browsers that are known to
+// ignore the SameSite attribute of cookies, or nothing for all other browsers.
+func renderBrowserWarning(r *http.Request, l i18n.Locale, productName string) template.HTML {
+	if !clientinfo.LacksSameSiteSupport(r.UserAgent()) {
+		return ""
+	}
+	return browserWarningSnippet.RenderIn(l, productName)
+}
+
+// isSecureRequest returns whether the browser used HTTPS, as far as we can
+// tell. Behind a reverse proxy, we rely on the proxy to report this in
+// X-Forwarded-Proto.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// refuseLoginWithoutHTTPS is a handler step for POST /login that refuses to
+// check the credentials if they may have been sent over plain HTTP. This is
+// only done if requested with HandlerOptions.RequireHTTPS. Otherwise, a missing
+// X-Forwarded-Proto is tolerated, since not all reverse proxies set it.
+func refuseLoginWithoutHTTPS(requireHTTPS bool) HandlerStep {
+	return func(i *Interaction) {
+		if !requireHTTPS || isSecureRequest(i.Req) {
+			return
+		}
+		logg.Error("refusing login from %s because the request does not have \"X-Forwarded-Proto: https\" (check the configuration of the reverse proxy)",
+			clientAddressOf(i.Req))
+		i.FormState.ErrorMessages = append(i.FormState.ErrorMessages,
+			"Logins are only accepted over HTTPS, but this request does not appear to use HTTPS. Please contact your administrators if this persists.")
+	}
+}
@@ -0,0 +1,184 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/stats"
+)
+
+func getCapacityHandler(n core.Nexus, collector *stats.Collector) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(func(_ *Interaction) Page {
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "Capacity planning",
+				Contents: capacityPageSnippet.Render(buildCapacityPageData(collector.Current(), collector.History())),
+			}
+		}),
+	)
+}
+
+type capacityPageData struct {
+	Current stats.Sample
+	HasLDAP bool
+	//formatted with formatByteSize()
+	StoreFileSize         string
+	AverageLDAPObjectSize string
+	LDAPTotalObjectSize   string
+	MDBMaxSize            string
+	MDBUsage              string //e.g. "0.4%"
+	ExhaustedAt           *time.Time
+	Charts                []capacityChart
+	ChartWidth            int
+	ChartHeight           int
+}
+
+// capacityChart is a line chart of one statistic over the recorded history.
+type capacityChart struct {
+	Title   string
+	Points  string //for the "points" attribute of an SVG <polyline>
+	Minimum string
+	Maximum string
+}
+
+const (
+	capacityChartWidth  = 600
+	capacityChartHeight = 120
+)
+
+func buildCapacityPageData(current stats.Sample, history []stats.Sample) capacityPageData {
+	data := capacityPageData{
+		Current:               current,
+		HasLDAP:               current.LDAPObjectCount > 0,
+		StoreFileSize:         formatByteSize(uint64(current.StoreFileSize)),
+		AverageLDAPObjectSize: formatByteSize(current.AverageLDAPObjectSize()),
+		LDAPTotalObjectSize:   formatByteSize(current.LDAPTotalObjectSize),
+		MDBMaxSize:            formatByteSize(ldap.MDBMaxSize),
+		MDBUsage:              fmt.Sprintf("%.1f%%", 100*float64(current.LDAPTotalObjectSize)/float64(ldap.MDBMaxSize)),
+		ChartWidth:            capacityChartWidth,
+		ChartHeight:           capacityChartHeight,
+	}
+	if t, ok := stats.ProjectLDAPExhaustion(history, ldap.MDBMaxSize); ok {
+		data.ExhaustedAt = &t
+	}
+	if len(history) < 2 {
+		return data
+	}
+
+	addChart := func(title string, value func(stats.Sample) float64, format func(float64) string) {
+		minValue, maxValue := value(history[0]), value(history[0])
+		for _, s := range history {
+			minValue = min(minValue, value(s))
+			maxValue = max(maxValue, value(s))
+		}
+		//a flat line is drawn in the middle of the chart
+		bottom, spread := minValue, maxValue-minValue
+		if spread == 0 {
+			bottom, spread = minValue-0.5, 1
+		}
+
+		points := make([]string, len(history))
+		for idx, s := range history {
+			x := float64(idx) * capacityChartWidth / float64(len(history)-1)
+			y := capacityChartHeight * (1 - (value(s)-bottom)/spread)
+			points[idx] = fmt.Sprintf("%.1f,%.1f", x, y)
+		}
+		data.Charts = append(data.Charts, capacityChart{
+			Title:   title,
+			Points:  strings.Join(points, " "),
+			Minimum: format(minValue),
+			Maximum: format(maxValue),
+		})
+	}
+	formatCount := func(v float64) string { return fmt.Sprintf("%.0f", v) }
+	formatSize := func(v float64) string { return formatByteSize(uint64(v)) }
+
+	addChart("Users", func(s stats.Sample) float64 { return float64(s.UserCount) }, formatCount)
+	addChart("Groups", func(s stats.Sample) float64 { return float64(s.GroupCount) }, formatCount)
+	addChart("Database file size", func(s stats.Sample) float64 { return float64(s.StoreFileSize) }, formatSize)
+	if data.HasLDAP {
+		addChart("Total size of LDAP objects", func(s stats.Sample) float64 { return float64(s.LDAPTotalObjectSize) }, formatSize)
+	}
+	return data
+}
+
+// Formats a size in bytes like "12.3 KiB".
+func formatByteSize(size uint64) string {
+	units := []string{"bytes", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unitIdx := 0
+	for value >= 1024 && unitIdx < len(units)-1 {
+		value /= 1024
+		unitIdx++
+	}
+	if unitIdx == 0 {
+		return fmt.Sprintf("%d bytes", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unitIdx])
+}
+
+var capacityPageSnippet = h.NewSnippet(`
+	<p>
+		These statistics help to predict when the limits of the LDAP server need to be raised. They can also be
+		scraped by Prometheus from <a href="/metrics"><code>/metrics</code></a>.
+	</p>
+	<h2>Current state</h2>
+	<table class="table">
+		<tbody>
+			<tr><th>Users</th><td>{{.Current.UserCount}}</td></tr>
+			<tr><th>Groups</th><td>{{.Current.GroupCount}}</td></tr>
+			<tr><th>Service accounts</th><td>{{.Current.ServiceAccountCount}}</td></tr>
+			<tr><th>Database file size</th><td>{{.StoreFileSize}}</td></tr>
+			{{if .HasLDAP}}
+				<tr><th>LDAP objects</th><td>{{.Current.LDAPObjectCount}}</td></tr>
+				<tr><th>Average size of LDAP objects</th><td>{{.AverageLDAPObjectSize}}</td></tr>
+				<tr><th>Total size of LDAP objects</th><td>{{.LDAPTotalObjectSize}} ({{.MDBUsage}} of the maximum database size of {{.MDBMaxSize}})</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+	{{if .HasLDAP}}
+		<p>
+			The size of LDAP objects only counts their names and values. The database of the LDAP server also holds indexes
+			and has some overhead per object, so its actual size is several times larger.
+			{{if .ExhaustedAt}}
+				If the LDAP objects keep growing like they did during the recorded history, their total size will reach the
+				maximum database size around <strong>{{.ExhaustedAt.Format "2006-01-02"}}</strong>.
+			{{end}}
+		</p>
+	{{end}}
+	<h2>History</h2>
+	{{range .Charts}}
+		<h3>{{.Title}}</h3>
+		<svg class="capacity-chart" viewBox="0 0 {{$.ChartWidth}} {{$.ChartHeight}}" width="100%" height="{{$.ChartHeight}}" preserveAspectRatio="none" role="img" aria-label="{{.Title}} between {{.Minimum}} and {{.Maximum}}">
+			<rect x="0" y="0" width="{{$.ChartWidth}}" height="{{$.ChartHeight}}" fill="white" />
+			<polyline points="{{.Points}}" fill="none" stroke="#55F" stroke-width="2" vector-effect="non-scaling-stroke" />
+		</svg>
+		<p class="small text-muted">Minimum: {{.Minimum}} &middot; Maximum: {{.Maximum}}</p>
+	{{else}}
+		<p>Statistics are recorded once per day. Charts will be shown here once there are at least two days of history.</p>
+	{{end}}
+`)
+
+// The metrics endpoint does not require a login, so that Prometheus can scrape
+// it. It only reports aggregate numbers, like the version endpoint.
+func getMetricsHandler(collector *stats.Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(stats.RenderMetrics(collector.Current(), collector.History(), collector.LDAPStatus()))
+	})
+}
@@ -0,0 +1,123 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// Edit forms carry a fingerprint of each field's value at the time when the
+// form was rendered. When the form is submitted, the fingerprints are compared
+// with the current values, to detect changes that were made by someone else
+// in the meantime:
+//
+//   - If the submitter did not touch a field that was changed by someone else,
+//     the other change is kept.
+//   - If the submitter changed the same field in a different way, the form is
+//     shown again with the submitter's input, and the field is highlighted.
+//     Submitting the form again overwrites the other change.
+const formVersionFieldName = "form_version"
+
+func fingerprintFieldState(s *h.FieldState) string {
+	hash := sha256.New()
+	//browsers submit line breaks in <textarea> as CRLF
+	value := strings.ReplaceAll(s.Value, "\r\n", "\n")
+	fmt.Fprintf(hash, "%q %t %x", value, s.IsUnfolded, s.FileContents)
+	for _, key := range slices.Sorted(maps.Keys(s.Selected)) {
+		if s.Selected[key] {
+			fmt.Fprintf(hash, " %q", key)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+func renderFormVersion(fields map[string]*h.FieldState) string {
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if name != formVersionFieldName && fields[name] != nil {
+			parts = append(parts, name+":"+fingerprintFieldState(fields[name]))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseFormVersion(version string) map[string]string {
+	result := make(map[string]string)
+	for _, part := range strings.Fields(version) {
+		name, fingerprint, ok := strings.Cut(part, ":")
+		if ok {
+			result[name] = fingerprint
+		}
+	}
+	return result
+}
+
+// addFormVersion is a handler step for edit forms that records the current
+// state of the form in a hidden field. It must come after the step that
+// selects and prefills the form.
+func addFormVersion(i *Interaction) {
+	i.FormState.Fields[formVersionFieldName] = &h.FieldState{Value: renderFormVersion(i.FormState.Fields)}
+	i.FormSpec.Fields = append(i.FormSpec.Fields, h.HiddenFieldSpec{Name: formVersionFieldName})
+}
+
+// ReadFormStateWithMerge is like ReadFormStateFromRequest, but for forms
+// using addFormVersion: Changes made by someone else since the form was
+// rendered are merged into the submitted state, or reported as errors if they
+// conflict with the submitted changes.
+func ReadFormStateWithMerge(i *Interaction) {
+	current := maps.Clone(i.FormState.Fields)
+	ReadFormStateFromRequest(i)
+
+	submitted := i.FormState.Fields[formVersionFieldName]
+	if submitted == nil || submitted.Value == "" {
+		//the form was rendered before this check existed
+		i.FormState.Fields[formVersionFieldName] = current[formVersionFieldName]
+		return
+	}
+	base := parseFormVersion(submitted.Value)
+
+	var conflicts []string
+	for name, currentState := range current {
+		if name == formVersionFieldName || currentState == nil {
+			continue
+		}
+		baseFingerprint, exists := base[name]
+		currentFingerprint := fingerprintFieldState(currentState)
+		if !exists || baseFingerprint == currentFingerprint {
+			continue //not changed by someone else
+		}
+		submittedState := i.FormState.Fields[name]
+		switch {
+		case submittedState == nil:
+			continue
+		case fingerprintFieldState(submittedState) == baseFingerprint:
+			//not changed by the submitter -> keep the other change
+			i.FormState.Fields[name] = currentState
+		case fingerprintFieldState(submittedState) != currentFingerprint:
+			submittedState.ErrorMessage = "was changed by someone else in the meantime"
+			conflicts = append(conflicts, strconv.Quote(name))
+		}
+	}
+
+	//if the form is shown again, submitting it shall overwrite the current state
+	i.FormState.Fields[formVersionFieldName] = current[formVersionFieldName]
+	if len(conflicts) > 0 {
+		slices.Sort(conflicts)
+		i.FormState.ErrorMessages = append(i.FormState.ErrorMessages, fmt.Sprintf(
+			"This %s was changed by someone else since you opened this form. Your input has been kept. Please check the highlighted fields (%s), and save again to overwrite the other changes.",
+			i.TargetRef.Type, strings.Join(conflicts, ", "),
+		))
+	}
+}
@@ -0,0 +1,128 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+var formVersionRx = regexp.MustCompile(`name="form_version" value="([^"]*)"`)
+
+// Returns the contents of the "form_version" field on the given page.
+func formVersionOf(t *testing.T, page string) string {
+	t.Helper()
+	match := formVersionRx.FindStringSubmatch(page)
+	if match == nil {
+		t.Fatal("no form_version field found on page")
+	}
+	return html.UnescapeString(match[1])
+}
+
+func TestEditFormMergesConcurrentChanges(t *testing.T) {
+	nexus, server := setupFrontend(t)
+	update := func(action func(g *core.Group)) {
+		t.Helper()
+		errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+			for idx := range db.Groups {
+				if db.Groups[idx].Name == "staff" {
+					action(&db.Groups[idx])
+				}
+			}
+			return nil
+		}, nil)
+		if !errs.IsEmpty() {
+			t.Fatal(errs.Join(", "))
+		}
+	}
+	getStaff := func() core.Group {
+		t.Helper()
+		group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+		return group
+	}
+
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Groups = []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"jane": true},
+				Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+			},
+			{
+				Name:             "staff",
+				LongName:         "Staff",
+				MemberLoginNames: core.GroupMemberNames{},
+				Notes:            "First notes.",
+			},
+		}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	b := newBrowser(t, server)
+	_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+	assert.DeepEqual(t, "redirect after login", location, "/self")
+	//the values that a browser submits for the group "staff" when only the
+	//long name is edited
+	formValues := func(page, longName, notes string) url.Values {
+		values := url.Values{
+			"long_name":       {longName},
+			"notes":           {notes},
+			"publish_to_ldap": {"yes"},
+		}
+		if page != "" {
+			values.Set("form_version", formVersionOf(t, page))
+		}
+		return values
+	}
+
+	//if someone else changes a field that we did not touch, their change is kept
+	_, page := b.Get("/groups/staff/edit")
+	update(func(g *core.Group) { g.Notes = "Other notes." })
+	_, location = b.SubmitPage(page, "/groups/staff/edit", formValues(page, "Staff members", "First notes."))
+	assert.DeepEqual(t, "redirect after edit with merge", location, "/groups")
+	assert.DeepEqual(t, "long name after edit with merge", getStaff().LongName, "Staff members")
+	assert.DeepEqual(t, "notes after edit with merge", getStaff().Notes, "Other notes.")
+
+	//if someone else changes the same field, the form is shown again with our
+	//input, and the field is highlighted
+	_, page = b.Get("/groups/staff/edit")
+	update(func(g *core.Group) { g.LongName = "Staff (theirs)" })
+	status, body := b.SubmitPage(page, "/groups/staff/edit", formValues(page, "Staff (ours)", "Other notes."))
+	assert.DeepEqual(t, "status after conflicting edit", status, http.StatusOK)
+	assert.DeepEqual(t, "conflict message after conflicting edit",
+		strings.Contains(body, `Please check the highlighted fields (&#34;long_name&#34;)`), true)
+	assert.DeepEqual(t, "field error after conflicting edit",
+		strings.Contains(body, `<span class="form-error">was changed by someone else in the meantime</span>`), true)
+	assert.DeepEqual(t, "input kept after conflicting edit", strings.Contains(body, `value="Staff (ours)"`), true)
+	assert.DeepEqual(t, "long name after conflicting edit", getStaff().LongName, "Staff (theirs)")
+
+	//submitting the form again overwrites the other change
+	_, location = b.SubmitPage(body, "/groups/staff/edit", formValues(body, "Staff (ours)", "Other notes."))
+	assert.DeepEqual(t, "redirect after resubmission", location, "/groups")
+	assert.DeepEqual(t, "long name after resubmission", getStaff().LongName, "Staff (ours)")
+
+	//forms that were rendered before form versions existed overwrite all
+	//changes made by someone else, like before
+	_, page = b.Get("/groups/staff/edit")
+	update(func(g *core.Group) { g.Notes = "Newer notes." })
+	_, location = b.SubmitPage(page, "/groups/staff/edit", formValues("", "Staff", "Other notes."))
+	assert.DeepEqual(t, "redirect after edit without form version", location, "/groups")
+	assert.DeepEqual(t, "long name after edit without form version", getStaff().LongName, "Staff")
+	assert.DeepEqual(t, "notes after edit without form version", getStaff().Notes, "Other notes.")
+}
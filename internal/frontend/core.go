@@ -7,74 +7,352 @@
 package frontend
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/clientinfo"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/risk"
+	"github.com/majewsky/portunus/internal/stats"
 	"github.com/majewsky/portunus/static"
 	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/logg"
 )
 
+// HandlerOptions contains additional configuration for HTTPHandler().
+type HandlerOptions struct {
+	AuditLog *audit.Log
+	//Optional.
+	GeoIP *clientinfo.GeoIPDatabase
+	//If not nil, users are notified by email about security events that they
+	//should be aware of, e.g. logins from a new country. Optional.
+	SendMail func(to []string, subject, body string) error
+	//Optional. If nil, all logins are allowed without additional verification.
+	LoginRiskProvider risk.Provider
+	//Reports the state of the LDAP synchronization on the status page.
+	//Optional. If nil (e.g. when Portunus serves LDAP by itself), the status
+	//page does not have an "LDAP synchronization" section.
+	LDAPStatus func() ldap.AdapterStatus
+	//Reports pending actions for the operator on the status page. Optional.
+	UpgradeNotes func() []core.UpgradeNote
+	//Shows the bind DN of service accounts. Optional.
+	ServiceAccountDN func(name string) string
+	//Show the DNs of users and groups on their detail pages. Optional.
+	UserDN           func(u core.User) string
+	GroupDNs         func(g core.Group) []string
+	IsBehindTLSProxy bool
+	//Whether login attempts are refused if the request does not indicate that
+	//the browser used HTTPS. Only takes effect if IsBehindTLSProxy is true.
+	RequireHTTPS bool
+	//Whether the login form is prefilled with the login name of the last user
+	//who logged in from the same browser.
+	RememberLoginName bool
+	//Whether users can hide some of their own attributes from the LDAP
+	//directory on the self-service form (see core.User.HiddenLDAPAttributes).
+	SelfServicePrivacy bool
+	//Provides the contents of the LDAP directory for directory snapshots.
+	//Optional. If nil, directory snapshots do not contain an LDIF file.
+	LDAPObjects func() []ldap.Object
+	//Reads the seed for the seed report in directory snapshots. Optional.
+	LoadSeed func() (*core.DatabaseSeed, errext.ErrorSet)
+	//Binds to the LDAP server with the given credentials for the "Test LDAP
+	//credentials" page. Optional. If nil, the page is not available.
+	TestLDAPBind func(loginNameOrDN, password string) ldap.BindTestResult
+	//Only set when running in maintenance mode.
+	Maintenance *MaintenanceInfo
+	//Which optional subsystems are available in the UI.
+	Features core.FeatureSet
+	//Texts and links for the login page and the page footer.
+	SiteInfo SiteInfo
+	//Product name, logo and colors of the web UI.
+	Branding Branding
+	//Where avatars for users without an uploaded photo come from. Optional. If
+	//nil, only uploaded photos are shown.
+	Avatars *AvatarSource
+	//Database statistics for the capacity planning page and the metrics
+	//endpoint. Optional. If nil, neither of these is available.
+	Stats *stats.Collector
+	//Served at POST /api/v1/provisioning. Since this endpoint is called by
+	//other systems instead of browsers, it is exempt from CSRF protection and
+	//must authenticate its requests by itself. Optional.
+	ProvisioningWebhook http.Handler
+	//The limit for the size of request bodies, not counting photo uploads.
+	//Optional. If zero, DefaultMaxRequestBodySize is used.
+	MaxRequestBodySize int64
+}
+
 // HTTPHandler returns the main http.Handler.
-func HTTPHandler(nexus core.Nexus, isBehindTLSProxy bool) http.Handler {
+func HTTPHandler(nexus core.Nexus, opts HandlerOptions) http.Handler {
+	sessionKey := initSessionStore()
+	branding := opts.Branding
+	if branding.ProductName == "" {
+		branding.ProductName = defaultProductName
+	}
+	avatarSource := opts.Avatars
+	trustedDevices := newTrustedDeviceCookie(sessionKey, opts.IsBehindTLSProxy)
+	auditLog := opts.AuditLog
+	secLog := securityEventLog{
+		AuditLog:     opts.AuditLog,
+		Nexus:        nexus,
+		GeoIP:        opts.GeoIP,
+		SendMail:     opts.SendMail,
+		FailedLogins: newFailedLoginLimiter(),
+	}
+	features := opts.Features
+	isBehindTLSProxy := opts.IsBehindTLSProxy
+	loginFormOpts := loginFormOptions{
+		Message: opts.SiteInfo.LoginMessage,
+		LastLoginName: lastLoginNameCookie{
+			Enabled: opts.RememberLoginName,
+			Secure:  opts.IsBehindTLSProxy,
+		},
+	}
+	//the handler lives as long as the process, so the listener does, too
+	nexus.AddChangeListener(context.Background(), revokeSessionsOnPasswordChange)
+
 	r := mux.NewRouter()
 	r.Methods("GET").Path(`/`).Handler(getToplevelHandler(nexus))
 	r.Methods("GET").Path(`/static/{path:.+}`).Handler(http.StripPrefix("/static/", http.FileServer(http.FS(static.FS))))
-
-	r.Methods("GET").Path(`/login`).Handler(getLoginHandler(nexus))
-	r.Methods("POST").Path(`/login`).Handler(postLoginHandler(nexus))
-	r.Methods("GET").Path(`/logout`).Handler(getLogoutHandler(nexus))
-
-	r.Methods("GET").Path(`/self`).Handler(getSelfHandler(nexus))
-	r.Methods("POST").Path(`/self`).Handler(postSelfHandler(nexus))
-
-	r.Methods("GET").Path(`/users`).Handler(getUsersHandler(nexus))
+	r.Methods("GET").Path(`/branding/theme.css`).Handler(getBrandingThemeHandler(branding, time.Now()))
+	r.Methods("GET").Path(`/branding/{file}`).Handler(getBrandingAssetHandler(branding))
+	r.Methods("POST").Path(`/theme`).Handler(postThemeHandler())
+
+	r.Methods("GET").Path(`/login`).Handler(getLoginHandler(nexus, loginFormOpts))
+	r.Methods("POST").Path(`/login`).Handler(postLoginHandler(nexus, secLog, opts.LoginRiskProvider, trustedDevices, isBehindTLSProxy && opts.RequireHTTPS, loginFormOpts))
+	r.Methods("GET").Path(`/login/verify`).Handler(getLoginVerifyHandler(nexus))
+	r.Methods("POST").Path(`/login/verify`).Handler(postLoginVerifyHandler(nexus, secLog, trustedDevices, loginFormOpts.LastLoginName))
+	r.Methods("GET").Path(`/logout`).Handler(getLogoutHandler(nexus, branding.ProductName))
+	r.Methods("POST").Path(`/logout`).Handler(postLogoutHandler())
+
+	r.Methods("GET").Path(`/self`).Handler(getSelfHandler(nexus, secLog, features, opts.SelfServicePrivacy, avatarSource))
+	r.Methods("POST").Path(`/self`).Handler(postSelfHandler(nexus, secLog, features, opts.SelfServicePrivacy, avatarSource))
+	r.Methods("GET").Path(`/self/totp`).Handler(getTOTPHandler(nexus))
+	r.Methods("POST").Path(`/self/totp`).Handler(postTOTPHandler(nexus, branding.ProductName))
+	r.Methods("GET").Path(`/self/totp/confirm`).Handler(getTOTPConfirmHandler(nexus))
+	r.Methods("POST").Path(`/self/totp/confirm`).Handler(postTOTPConfirmHandler(nexus, secLog))
+	r.Methods("GET").Path(`/self/totp/disable`).Handler(getTOTPDisableHandler(nexus))
+	r.Methods("POST").Path(`/self/totp/disable`).Handler(postTOTPDisableHandler(nexus, secLog))
+
+	r.Methods("GET").Path(`/users`).Handler(getUsersHandler(nexus, avatarSource))
+	r.Methods("GET").Path(`/users/export.csv`).Handler(getUsersExportCSVHandler(nexus))
 	r.Methods("GET").Path(`/users/new`).Handler(getUsersNewHandler(nexus))
 	r.Methods("POST").Path(`/users/new`).Handler(postUsersNewHandler(nexus))
+	r.Methods("GET").Path(`/users/deactivated`).Handler(getDeactivatedUsersHandler(nexus))
+	r.Methods("POST").Path(`/users/deactivated`).Handler(postDeactivatedUsersHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}`).Handler(getUserDetailsHandler(nexus, auditLog, avatarSource, opts.UserDN))
+	r.Methods("GET").Path(`/users/{uid}/avatar`).Handler(getUserAvatarHandler(nexus, avatarSource))
 	r.Methods("GET").Path(`/users/{uid}/edit`).Handler(getUserEditHandler(nexus))
-	r.Methods("POST").Path(`/users/{uid}/edit`).Handler(postUserEditHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/edit`).Handler(postUserEditHandler(nexus, secLog))
 	r.Methods("GET").Path(`/users/{uid}/delete`).Handler(getUserDeleteHandler(nexus))
 	r.Methods("POST").Path(`/users/{uid}/delete`).Handler(postUserDeleteHandler(nexus))
-
-	r.Methods("GET").Path(`/groups`).Handler(getGroupsHandler(nexus))
-	r.Methods("GET").Path(`/groups/new`).Handler(getGroupsNewHandler(nexus))
-	r.Methods("POST").Path(`/groups/new`).Handler(postGroupsNewHandler(nexus))
-	r.Methods("GET").Path(`/groups/{name}/edit`).Handler(getGroupEditHandler(nexus))
-	r.Methods("POST").Path(`/groups/{name}/edit`).Handler(postGroupEditHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/history`).Handler(getUserHistoryHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/history/{rev:[0-9]+}/revert`).Handler(getUserRevertHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/history/{rev:[0-9]+}/revert`).Handler(postUserRevertHandler(nexus))
+	r.Methods("GET").Path(`/users/{uid}/reset-totp`).Handler(getUserResetTOTPHandler(nexus))
+	r.Methods("POST").Path(`/users/{uid}/reset-totp`).Handler(postUserResetTOTPHandler(nexus, auditLog))
+
+	r.Methods("GET").Path(`/groups`).Handler(getGroupsHandler(nexus, features))
+	r.Methods("GET").Path(`/groups/export.csv`).Handler(getGroupsExportCSVHandler(nexus))
+	r.Methods("GET").Path(`/groups/posix-report`).Handler(getPosixReportHandler(nexus))
+	r.Methods("GET").Path(`/groups/posix-report.csv`).Handler(getPosixReportCSVHandler(nexus))
+	if features.IsEnabled(core.FeatureJoinRequests) {
+		r.Methods("GET").Path(`/groups/browse`).Handler(getGroupsBrowseHandler(nexus))
+		r.Methods("GET").Path(`/groups/requests`).Handler(getJoinRequestsHandler(nexus))
+		r.Methods("POST").Path(`/groups/requests`).Handler(postJoinRequestsHandler(nexus))
+	}
+	r.Methods("GET").Path(`/groups/new`).Handler(getGroupsNewHandler(nexus, features))
+	r.Methods("POST").Path(`/groups/new`).Handler(postGroupsNewHandler(nexus, features))
+	r.Methods("GET").Path(`/groups/{name}`).Handler(getGroupDetailsHandler(nexus, avatarSource, opts.UserDN, opts.GroupDNs))
+	r.Methods("GET").Path(`/groups/{name}/edit`).Handler(getGroupEditHandler(nexus, features))
+	r.Methods("POST").Path(`/groups/{name}/edit`).Handler(postGroupEditHandler(nexus, features))
+	r.Methods("GET").Path(`/groups/{name}/members`).Handler(getGroupMembersHandler(nexus))
+	r.Methods("POST").Path(`/groups/{name}/members`).Handler(postGroupMembersHandler(nexus))
+	if features.IsEnabled(core.FeatureJoinRequests) {
+		r.Methods("GET").Path(`/groups/{name}/join`).Handler(getGroupJoinHandler(nexus))
+		r.Methods("POST").Path(`/groups/{name}/join`).Handler(postGroupJoinHandler(nexus))
+	}
+	r.Methods("GET").Path(`/groups/{name}/history`).Handler(getGroupHistoryHandler(nexus))
+	r.Methods("GET").Path(`/groups/{name}/history/{rev:[0-9]+}/revert`).Handler(getGroupRevertHandler(nexus))
+	r.Methods("POST").Path(`/groups/{name}/history/{rev:[0-9]+}/revert`).Handler(postGroupRevertHandler(nexus))
 	r.Methods("GET").Path(`/groups/{name}/delete`).Handler(getGroupDeleteHandler(nexus))
 	r.Methods("POST").Path(`/groups/{name}/delete`).Handler(postGroupDeleteHandler(nexus))
 
+	r.Methods("GET").Path(`/service-accounts`).Handler(getServiceAccountsHandler(nexus, opts.ServiceAccountDN))
+	r.Methods("GET").Path(`/service-accounts/new`).Handler(getServiceAccountsNewHandler(nexus))
+	r.Methods("POST").Path(`/service-accounts/new`).Handler(postServiceAccountsNewHandler(nexus))
+	r.Methods("GET").Path(`/service-accounts/{name}/edit`).Handler(getServiceAccountEditHandler(nexus))
+	r.Methods("POST").Path(`/service-accounts/{name}/edit`).Handler(postServiceAccountEditHandler(nexus))
+	r.Methods("GET").Path(`/service-accounts/{name}/delete`).Handler(getServiceAccountDeleteHandler(nexus))
+	r.Methods("POST").Path(`/service-accounts/{name}/delete`).Handler(postServiceAccountDeleteHandler(nexus))
+
+	r.Methods("GET").Path(`/status`).Handler(getStatusHandler(nexus, features, opts.LDAPStatus, opts.UpgradeNotes, opts.TestLDAPBind != nil, opts.Stats != nil))
+	if opts.TestLDAPBind != nil {
+		r.Methods("GET").Path(`/status/test-bind`).Handler(getBindTestHandler(nexus))
+		r.Methods("POST").Path(`/status/test-bind`).Handler(postBindTestHandler(nexus, opts.TestLDAPBind))
+	}
+	if opts.Stats != nil {
+		r.Methods("GET").Path(`/status/capacity`).Handler(getCapacityHandler(nexus, opts.Stats))
+		r.Methods("GET").Path(`/metrics`).Handler(getMetricsHandler(opts.Stats))
+	}
+	r.Methods("GET").Path(`/api/v1/version`).Handler(getVersionHandler())
+	if opts.ProvisioningWebhook != nil {
+		r.Methods("POST").Path(provisioningWebhookPath).Handler(opts.ProvisioningWebhook)
+	}
+
+	r.Methods("GET").Path(`/export`).Handler(getExportHandler(nexus))
+	r.Methods("GET").Path(`/export.json`).Handler(getExportJSONHandler(nexus))
+	r.Methods("GET").Path(`/export/snapshot`).Handler(getSnapshotHandler(nexus))
+	r.Methods("POST").Path(`/export/snapshot`).Handler(postSnapshotHandler(nexus, snapshotSources{opts.LDAPObjects, opts.LoadSeed}, branding.ProductName))
+	r.Methods("GET").Path(`/export/snapshot.zip`).Handler(getSnapshotDownloadHandler(nexus))
+
+	if features.IsEnabled(core.FeatureAccessReviews) {
+		r.Methods("GET").Path(`/reviews`).Handler(getReviewsHandler(nexus))
+		r.Methods("GET").Path(`/reviews/new`).Handler(getReviewsNewHandler(nexus))
+		r.Methods("POST").Path(`/reviews/new`).Handler(postReviewsNewHandler(nexus))
+		r.Methods("GET").Path(`/reviews/{name}`).Handler(getReviewDetailsHandler(nexus))
+		r.Methods("GET").Path(`/reviews/{name}/tasks`).Handler(getReviewTasksHandler(nexus))
+		r.Methods("POST").Path(`/reviews/{name}/tasks`).Handler(postReviewTasksHandler(nexus))
+	}
+
+	if opts.Maintenance != nil {
+		r.Methods("GET").Path(`/maintenance`).Handler(getMaintenanceHandler(nexus, *opts.Maintenance))
+		r.Methods("POST").Path(`/maintenance`).Handler(postMaintenanceHandler(nexus, secLog, *opts.Maintenance))
+	}
+
+	if logg.ShowDebug {
+		r.Methods("GET").Path(`/debug/session`).Handler(getSessionDebugHandler(isBehindTLSProxy))
+	}
+
+	for _, p := range registeredPlugins {
+		for _, route := range p.Routes {
+			r.Methods(route.Method).Path(route.Path).Handler(route.Handler(nexus))
+		}
+	}
+
+	r.NotFoundHandler = getNotFoundHandler(nexus)
+
 	//setup CSRF with maxAge = 30 minutes
 	csrfKey := core.GenerateRandomKey(32)
-	csrfMiddleware := csrf.Protect(csrfKey, csrf.MaxAge(1800), csrf.Secure(isBehindTLSProxy))
+	csrfOpts := []csrf.Option{csrf.MaxAge(1800), csrf.Secure(isBehindTLSProxy)}
+	if logg.ShowDebug {
+		csrfOpts = append(csrfOpts, csrf.ErrorHandler(csrfDebugErrorHandler(isBehindTLSProxy)))
+	}
+	csrfMiddleware := csrf.Protect(csrfKey, csrfOpts...)
 	handler := csrfMiddleware(r)
+	if opts.ProvisioningWebhook != nil {
+		handler = skipCSRFForWebhooksMiddleware(handler)
+	}
 
 	//add various security headers via middleware
-	handler = securityHeadersMiddleware(handler)
+	handler = securityHeadersMiddleware(handler, avatarSource)
+
+	//this needs to go outside of the CSRF middleware since that one already
+	//consumes the request body of POST requests
+	maxBodySize := opts.MaxRequestBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxRequestBodySize
+	}
+	handler = requestBodyLimitMiddleware(handler, maxBodySize)
+	handler = slowRequestLogMiddleware(handler)
+
+	//this goes last to also catch panics in the other middlewares
+	handler = recoveryMiddleware(handler)
+	//...except for this one, which cannot panic, and which the error pages of
+	//recoveryMiddleware() need as well
+	handler = pageFrameMiddleware(handler, pageFrame{
+		Maintenance: opts.Maintenance,
+		SiteInfo:    opts.SiteInfo,
+		Features:    features,
+		Branding:    branding,
+	})
 
 	return handler
 }
 
-func securityHeadersMiddleware(inner http.Handler) http.Handler {
+const provisioningWebhookPath = "/api/v1/provisioning"
+
+func skipCSRFForWebhooksMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == provisioningWebhookPath {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+func securityHeadersMiddleware(inner http.Handler, avatarSource *AvatarSource) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hdr := w.Header()
 		hdr.Set("X-Frame-Options", "SAMEORIGIN")
 		hdr.Set("X-XSS-Protection", "1; mode=block")
 		hdr.Set("X-Content-Type-Options", "nosniff")
 		hdr.Set("Referrer-Policy", "no-referrer")
-		hdr.Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data:;")
+		imgSources := "'self' data:"
+		if avatarSource != nil && avatarSource.Direct {
+			imgSources += " " + avatarSource.Origin()
+		}
+		hdr.Set("Content-Security-Policy", "default-src 'self'; img-src "+imgSources+";")
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// DefaultMaxRequestBodySize is the default for
+// HandlerOptions.MaxRequestBodySize. All our forms are rather small, so this is
+// generous enough to never be hit during legitimate usage.
+const DefaultMaxRequestBodySize = 1 << 20 // 1 MiB
+
+// maxRequestBodySizeFor returns the limit for the size of the given request's
+// body. Routes that accept file uploads can be given a larger limit here.
+func maxRequestBodySizeFor(r *http.Request, defaultLimit int64) int64 {
+	if r.Method == http.MethodPost && r.URL.Path == "/self" {
+		return defaultLimit + maxPhotoUploadSize
+	}
+	return defaultLimit
+}
+
+func requestBodyLimitMiddleware(inner http.Handler, defaultLimit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxRequestBodySizeFor(r, defaultLimit)
+		if r.ContentLength > limit {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		//the Content-Length may be missing or lie, so also enforce the limit while reading
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
 		inner.ServeHTTP(w, r)
 	})
 }
 
+// Requests taking longer than this will be logged.
+const slowRequestThreshold = 5 * time.Second
+
+func slowRequestLogMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingResponseWriter{ResponseWriter: w}
+		startedAt := time.Now()
+		inner.ServeHTTP(tw, r)
+
+		duration := time.Since(startedAt)
+		if duration > slowRequestThreshold {
+			logg.Info("slow request: %s %s took %s (status %d)",
+				r.Method, r.URL.Path, duration.Round(time.Millisecond), tw.status)
+		}
+	})
+}
+
 func getToplevelHandler(n core.Nexus) http.Handler {
 	return Do(
 		LoadSession,
@@ -122,13 +400,23 @@ type Interaction struct {
 	writer http.ResponseWriter
 	//Slots for data associated with a request, which may be stored by one step
 	//and then used by later steps.
-	Session     *sessions.Session
-	CurrentUser *core.UserWithPerms
-	FormSpec    *h.FormSpec
-	FormState   *h.FormState
-	TargetUser  *core.User     //only used by CRUD views editing a single user
-	TargetGroup *core.Group    //only used by CRUD views editing a single group
-	TargetRef   core.ObjectRef //refers to TargetGroup/TargetUser (for admin forms) or CurrentUser (for selfservice forms)
+	Session              *sessions.Session
+	CurrentUser          *core.UserWithPerms
+	FormSpec             *h.FormSpec
+	FormState            *h.FormState
+	TargetUser           *core.User           //only used by CRUD views editing a single user, and by login verification
+	TargetGroup          *core.Group          //only used by CRUD views editing a single group
+	TargetServiceAccount *core.ServiceAccount //only used by CRUD views editing a single service account
+	TargetReview         *core.AccessReview   //only used by views concerning a single access review
+	TargetRef            core.ObjectRef       //refers to TargetGroup/TargetUser/TargetServiceAccount (for admin forms) or CurrentUser (for selfservice forms)
+	pendingTOTP          *totpEnrollment      //only used by views concerning TOTP enrollment
+	pendingLogin         *pendingLogin        //only used by login verification
+}
+
+// Locale returns the locale that texts on the resulting page shall be
+// translated into.
+func (i *Interaction) Locale() i18n.Locale {
+	return i18n.ForRequest(i.Req)
 }
 
 // WriteError wraps http.Error().
@@ -189,14 +477,46 @@ func RedirectTo(url string) HandlerStep {
 func RedirectWithFlashTo(url, action string) HandlerStep {
 	return func(i *Interaction) {
 		ref := i.TargetRef
-		msg := fmt.Sprintf("%s %s %q.", action, ref.Type, ref.Name)
+		l := i.Locale()
+		msg := l.Tf(action+" %s %q.", l.T(ref.Type), ref.Name)
 		i.RedirectWithFlashTo(url, Flash{"success", msg})
 	}
 }
 
+// FlashWarnings is a handler step that adds a flash for each warning from
+// core.Database.Warnings() that concerns the user or group in i.TargetRef (for
+// groups, this includes warnings concerning their members). It shall be
+// followed by a step that saves the session, like RedirectWithFlashTo.
+func FlashWarnings(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		db := core.Database{Users: n.ListUsers(), Groups: n.ListGroups()}
+		isAffected := map[core.ObjectRef]bool{i.TargetRef: true}
+		if i.TargetRef.Type == "group" {
+			for _, group := range core.ResolveNestedGroups(db.Groups) {
+				if group.Name != i.TargetRef.Name {
+					continue
+				}
+				for loginName, isMember := range group.MemberLoginNames {
+					if isMember {
+						isAffected[core.ObjectRef{Type: "user", Name: loginName}] = true
+					}
+				}
+			}
+		}
+		for _, w := range db.Warnings(n.ValidationConfig()) {
+			if isAffected[w.FieldRef.Object] {
+				i.Session.AddFlash(Flash{"warning", "Warning: " + w.Error() + "."})
+			}
+		}
+	}
+}
+
 var sessionStore *sessions.CookieStore
 
-func init() {
+// This is not done in init() because it writes into the state directory,
+// which shall not happen for commands like `portunus-server -validate-seed`.
+// The session key is returned, so that other signed cookies can use it, too.
+func initSessionStore() []byte {
 	keyPath := filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "session-key.dat")
 	keyBytes, err := os.ReadFile(keyPath)
 	if err != nil {
@@ -216,18 +536,23 @@ func init() {
 	}
 
 	sessionStore = sessions.NewCookieStore(keyBytes)
+	loadSessionRevocations(filepath.Join(os.Getenv("PORTUNUS_SERVER_STATE_DIR"), "session-revocations.json"))
+	return keyBytes
 }
 
 // LoadSession is a handler step that loads the session or starts a new one if
 // there is no valid session.
 func LoadSession(i *Interaction) {
 	var err error
-	i.Session, err = sessionStore.Get(i.Req, "portunus-login")
+	i.Session, err = sessionStore.Get(i.Req, sessionCookieName)
 	if err != nil {
 		//the session is broken - start a fresh one
-		logg.Error("could not decode user session cookie: " + err.Error())
+		logg.Error("could not decode user session cookie: %s (%s)", err.Error(), explainSessionError(err))
+		if logg.ShowDebug {
+			logg.Debug("visit /debug/session in the affected browser for more details")
+		}
 		i.Req.Header.Del("Cookie")
-		i.Session, err = sessionStore.New(i.Req, "portunus-login")
+		i.Session, err = sessionStore.New(i.Req, sessionCookieName)
 		if err != nil {
 			i.WriteError(err.Error(), http.StatusInternalServerError)
 			return
@@ -250,17 +575,42 @@ func VerifyLogin(n core.Nexus) HandlerStep {
 		if i.Session == nil {
 			panic("VerifyLogin must come after LoadSession")
 		}
+		TryLoadLogin(n)(i)
+		if i.CurrentUser == nil && i.writer != nil {
+			i.RedirectTo("/login")
+		}
+	}
+}
+
+// TryLoadLogin is like VerifyLogin, but does not redirect to /login if there
+// is no valid login. It is intended for pages that can be shown to anonymous
+// users, but shall still show the full navigation to logged-in users.
+func TryLoadLogin(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		if i.Session == nil {
+			panic("TryLoadLogin must come after LoadSession")
+		}
 		uid, ok := i.Session.Values["uid"].(string)
 		if !ok {
-			i.RedirectTo("/login")
 			return
 		}
 		user, ok := n.FindUser(func(u core.User) bool { return u.LoginName == uid })
-		if ok {
-			i.CurrentUser = &user
-		} else {
-			i.RedirectTo("/login")
+		if !ok {
+			return
+		}
+		if isSessionRevoked(i.Session, uid) {
+			clearLogin(i)
+			i.Session.AddFlash(Flash{"primary", "Your session has ended because your password was changed. Please log in again."})
+			i.SaveSession()
+			return
+		}
+		if user.Disabled {
+			clearLogin(i)
+			i.Session.AddFlash(Flash{"danger", "Your session has ended because your account was disabled."})
+			i.SaveSession()
+			return
 		}
+		i.CurrentUser = &user
 	}
 }
 
@@ -331,15 +681,34 @@ func ShowFormIfErrors(title string) HandlerStep {
 
 // TryUpdateNexus is a handler step that calls nexus.Update() if the FormState
 // does not have any errors yet, and pushes all errors into the FormState.
+//
+// The update is deliberately not bound to the request context: Once the user
+// has submitted a form, the change shall go through even if the client
+// disconnects before receiving the response.
 func TryUpdateNexus(n core.Nexus, action func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet) HandlerStep {
 	return func(i *Interaction) {
 		opts := core.UpdateOptions{
 			ConflictWithSeedIsError: true,
 			DryRun:                  !i.FormState.IsValid(),
 		}
+		if i.CurrentUser != nil {
+			opts.Actor = core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName}
+		}
 		errs := n.Update(func(db *core.Database) errext.ErrorSet {
 			return action(db, i, n.PasswordHasher())
 		}, &opts)
 		i.FormState.FillErrorsFrom(errs, i.TargetRef)
+
+		//the field-level error messages for seed conflicts need some context,
+		//esp. when the seed was changed after the form was rendered
+		for _, err := range errs {
+			if core.IsSeedConflict(err) {
+				i.FormState.ErrorMessages = append(i.FormState.ErrorMessages, seedConflictMessage)
+				break
+			}
+		}
 	}
 }
+
+const seedConflictMessage = "Some of the fields in this form are managed by the seed (the static configuration of Portunus) " +
+	"and cannot be changed here. If the seed was changed recently, these fields might not have been seed-managed when this form was loaded."
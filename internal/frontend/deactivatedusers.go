@@ -0,0 +1,144 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+var deactivatedUsersSnippet = h.NewSnippet(`
+	<p>
+		Deleted users are kept here until they are purged, either by hand or automatically after {{.RetentionDays}} day(s).
+		They do not appear in LDAP and cannot log in. Restored users are added back into those of their previous groups
+		that still exist.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Login name</th>
+				<th>Full name</th>
+				<th>Deleted</th>
+				<th>Purged on</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Users}}
+				<tr>
+					<td data-label="Login name"><code>{{.User.LoginName}}</code></td>
+					<td data-label="Full name">{{.User.FullName}}</td>
+					<td data-label="Deleted">on {{.DeactivatedAt}} by {{.DeactivatedBy}}</td>
+					<td data-label="Purged on">{{.PurgeDate $.RetentionDays}}</td>
+				</tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+var noDeactivatedUsersSnippet = h.NewSnippet(`
+	<p>There are no deactivated users.</p>
+`)
+
+func useDeactivatedUsersForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		i.FormState = &h.FormState{
+			Fields: map[string]*h.FieldState{},
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/users/deactivated",
+			SubmitLabel: "Submit",
+		}
+
+		users := n.ListDeactivatedUsers()
+		if len(users) == 0 {
+			i.FormSpec.Fields = []h.FormField{
+				h.StaticField{Value: noDeactivatedUsersSnippet.Render(nil)},
+			}
+			return
+		}
+
+		var opts []h.SelectOptionSpec
+		for _, u := range users {
+			opts = append(opts, h.SelectOptionSpec{
+				Value: u.User.LoginName,
+				Label: u.User.LoginName,
+			})
+		}
+		i.FormSpec.Fields = []h.FormField{
+			h.StaticField{Value: deactivatedUsersSnippet.Render(struct {
+				Users         []core.DeactivatedUser
+				RetentionDays uint
+			}{users, n.ValidationConfig().UserRetentionDays})},
+			h.SelectFieldSpec{
+				Name:    "restore",
+				Label:   "Restore users",
+				Options: opts,
+			},
+			h.SelectFieldSpec{
+				Name:    "purge",
+				Label:   "Purge users now (cannot be undone)",
+				Options: opts,
+			},
+		}
+	}
+}
+
+// Handles GET /users/deactivated.
+func getDeactivatedUsersHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useDeactivatedUsersForm(n),
+		ShowForm("Deactivated users"),
+	)
+}
+
+// Handles POST /users/deactivated.
+func postDeactivatedUsersHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useDeactivatedUsersForm(n),
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeDeactivatedUsersDecisions),
+		ShowFormIfErrors("Deactivated users"),
+		func(i *Interaction) {
+			i.RedirectWithFlashTo("/users/deactivated", Flash{"success", "Submitted decisions."})
+		},
+	)
+}
+
+func executeDeactivatedUsersDecisions(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	restoreState := i.FormState.Fields["restore"]
+	purgeState := i.FormState.Fields["purge"]
+	if restoreState == nil || purgeState == nil {
+		//there were no deactivated users when the form was shown
+		return nil
+	}
+	for loginName, isSelected := range restoreState.Selected {
+		if !isSelected {
+			continue
+		}
+		if purgeState.Selected[loginName] {
+			errs.Addf("cannot both restore and purge user %q", loginName)
+			continue
+		}
+		errs.Add(db.RestoreUser(loginName))
+	}
+	for loginName, isSelected := range purgeState.Selected {
+		if isSelected && !restoreState.Selected[loginName] {
+			errs.Add(db.PurgeUser(loginName))
+		}
+	}
+	return errs
+}
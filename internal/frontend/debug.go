@@ -0,0 +1,229 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// The session and CSRF cookies are both handled by gorilla libraries that
+// only give very terse error messages. When PORTUNUS_DEBUG is set, the
+// diagnostics in this file are shown on CSRF failures and on the /debug/session
+// page, to explain why a browser keeps losing its session.
+//
+// Cookie values are never included in the diagnostics, only their presence
+// and size.
+
+const (
+	sessionCookieName = "portunus-login"
+	csrfCookieName    = "_gorilla_csrf" //the default name chosen by package csrf
+)
+
+type cookieDiagnostics struct {
+	Name    string
+	Present bool
+	Size    int
+}
+
+func diagnoseCookie(r *http.Request, name string) cookieDiagnostics {
+	result := cookieDiagnostics{Name: name}
+	cookie, err := r.Cookie(name)
+	if err == nil {
+		result.Present = true
+		result.Size = len(cookie.Value)
+	}
+	return result
+}
+
+// requestDiagnostics describes the parts of a request that influence whether
+// the session and CSRF cookies are accepted.
+type requestDiagnostics struct {
+	Method         string
+	Path           string
+	Host           string
+	Scheme         string
+	ForwardedProto string
+	Origin         string
+	Referer        string
+	SecureCookies  bool //whether the CSRF cookie is issued with the Secure flag
+	SessionCookie  cookieDiagnostics
+	CSRFCookie     cookieDiagnostics
+	SessionError   string
+	CSRFError      string
+	Hints          []string
+}
+
+func diagnoseRequest(r *http.Request, isBehindTLSProxy bool, sessionErr, csrfErr error) requestDiagnostics {
+	d := requestDiagnostics{
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Host:           r.Host,
+		Scheme:         "http",
+		ForwardedProto: r.Header.Get("X-Forwarded-Proto"),
+		Origin:         r.Header.Get("Origin"),
+		Referer:        r.Referer(),
+		SecureCookies:  isBehindTLSProxy,
+		SessionCookie:  diagnoseCookie(r, sessionCookieName),
+		CSRFCookie:     diagnoseCookie(r, csrfCookieName),
+	}
+	if r.TLS != nil {
+		d.Scheme = "https"
+	}
+	if sessionErr != nil {
+		d.SessionError = sessionErr.Error()
+	}
+	if csrfErr != nil {
+		d.CSRFError = csrfErr.Error()
+	}
+
+	//the browser only sends Secure cookies over HTTPS
+	if isBehindTLSProxy && d.Scheme == "http" && d.ForwardedProto != "https" {
+		d.Hints = append(d.Hints, "PORTUNUS_SERVER_HTTP_SECURE is true, so the CSRF cookie is marked as Secure, but there is no indication that the browser is using HTTPS. If the reverse proxy does not terminate TLS, the browser will not send the CSRF cookie back.")
+	}
+	if !isBehindTLSProxy && d.ForwardedProto == "https" {
+		d.Hints = append(d.Hints, "This request was forwarded from HTTPS, but PORTUNUS_SERVER_HTTP_SECURE is not true. Cookies will work, but they are not marked as Secure.")
+	}
+
+	//our cookies do not have a Domain attribute, so they are only sent back to
+	//the exact host that issued them
+	for _, header := range []string{"Origin", "Referer"} {
+		value := r.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err == nil && u.Host != "" && !strings.EqualFold(u.Host, r.Host) {
+			d.Hints = append(d.Hints, fmt.Sprintf("The %s header points to host %q, but the request was addressed to host %q. Cookies are only sent back to the host that set them, so the browser must use the same hostname throughout. If a reverse proxy is involved, check that it forwards the original Host header.", header, u.Host, r.Host))
+		}
+	}
+
+	if !d.SessionCookie.Present && r.Method != http.MethodGet {
+		d.Hints = append(d.Hints, "The browser did not send a session cookie with this form submission. This usually means that the cookie was rejected by the browser or stripped by a proxy.")
+	}
+	if sessionErr != nil {
+		d.Hints = append(d.Hints, explainSessionError(sessionErr))
+	}
+
+	if !d.CSRFCookie.Present && r.Method != http.MethodGet {
+		d.Hints = append(d.Hints, "The browser did not send a CSRF cookie with this form submission. This usually means that the cookie was rejected by the browser or stripped by a proxy.")
+	}
+	if errors.Is(csrfErr, csrf.ErrBadToken) && d.CSRFCookie.Present {
+		d.Hints = append(d.Hints, "The CSRF token in the form does not match the CSRF cookie. The CSRF key is regenerated whenever portunus-server restarts, and each token is only valid for 30 minutes, so this is expected for forms that were opened before a restart or a long time ago.")
+	}
+	return d
+}
+
+// explainSessionError turns an error from sessionStore.Get() into something
+// that an operator can act upon.
+func explainSessionError(err error) string {
+	//the cookie store reports a securecookie.MultiError (with one error per
+	//key), which does not support errors.Is() on its elements
+	causes := []error{err}
+	var merr securecookie.MultiError
+	if errors.As(err, &merr) {
+		causes = merr
+	}
+	hasCause := func(predicate func(error) bool) bool {
+		return slices.ContainsFunc(causes, predicate)
+	}
+
+	var cerr securecookie.Error
+	switch {
+	case hasCause(func(err error) bool { return errors.Is(err, securecookie.ErrMacInvalid) }):
+		return "The session cookie was signed with a different key. This happens when session-key.dat in PORTUNUS_SERVER_STATE_DIR was regenerated (e.g. because the state directory is not persistent), or when several Portunus instances with different keys serve the same hostname."
+	case hasCause(func(err error) bool { return strings.Contains(err.Error(), "expired timestamp") }):
+		return "The session cookie has expired. The user needs to log in again."
+	case errors.As(err, &cerr) && cerr.IsDecode():
+		return "The session cookie is malformed. It may have been truncated or modified by the browser or a proxy."
+	default:
+		return "The session cookie could not be decoded for an unexpected reason."
+	}
+}
+
+func (d requestDiagnostics) logDebug(prefix string) {
+	logg.Debug("%s: %s %s (host %q, scheme %q, X-Forwarded-Proto %q, origin %q, referer %q, secure cookies = %t, session cookie present = %t, CSRF cookie present = %t)",
+		prefix, d.Method, d.Path, d.Host, d.Scheme, d.ForwardedProto, d.Origin, d.Referer,
+		d.SecureCookies, d.SessionCookie.Present, d.CSRFCookie.Present)
+	for _, hint := range d.Hints {
+		logg.Debug("%s: hint: %s", prefix, hint)
+	}
+}
+
+var requestDiagnosticsSnippet = h.NewSnippet(`
+	<p class="text-muted">
+		This page is only available because PORTUNUS_DEBUG is enabled.
+		Cookie values are not shown.
+	</p>
+	<table class="table">
+		<tbody>
+			<tr><th>Request</th><td><code>{{.Method}} {{.Path}}</code></td></tr>
+			<tr><th>Host</th><td><code>{{.Host}}</code></td></tr>
+			<tr><th>Scheme</th><td><code>{{.Scheme}}</code></td></tr>
+			<tr><th>X-Forwarded-Proto</th><td>{{if .ForwardedProto}}<code>{{.ForwardedProto}}</code>{{else}}<em>not set</em>{{end}}</td></tr>
+			<tr><th>Origin</th><td>{{if .Origin}}<code>{{.Origin}}</code>{{else}}<em>not set</em>{{end}}</td></tr>
+			<tr><th>Referer</th><td>{{if .Referer}}<code>{{.Referer}}</code>{{else}}<em>not set</em>{{end}}</td></tr>
+			<tr><th>Secure flag on CSRF cookie</th><td>{{if .SecureCookies}}yes{{else}}no{{end}}</td></tr>
+			{{range .Cookies}}
+				<tr>
+					<th>Cookie <code>{{.Name}}</code></th>
+					<td>{{if .Present}}present ({{.Size}} bytes){{else}}<strong>missing</strong>{{end}}</td>
+				</tr>
+			{{end}}
+			{{if .SessionError}}<tr><th>Session error</th><td><code>{{.SessionError}}</code></td></tr>{{end}}
+			{{if .CSRFError}}<tr><th>CSRF error</th><td><code>{{.CSRFError}}</code></td></tr>{{end}}
+		</tbody>
+	</table>
+	{{range .Hints}}<div class="flash flash-danger">{{.}}</div>{{end}}
+	<p><a href="/">Back to the start page</a></p>
+`)
+
+// Cookies is used by requestDiagnosticsSnippet.
+func (d requestDiagnostics) Cookies() []cookieDiagnostics {
+	return []cookieDiagnostics{d.SessionCookie, d.CSRFCookie}
+}
+
+func (d requestDiagnostics) Page(title string, status int) Page {
+	return Page{
+		Status:   status,
+		Title:    title,
+		Contents: requestDiagnosticsSnippet.Render(d),
+	}
+}
+
+// getSessionDebugHandler serves /debug/session. It only gets registered when
+// PORTUNUS_DEBUG is set.
+func getSessionDebugHandler(isBehindTLSProxy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//this deliberately does not use LoadSession, which would discard the
+		//broken cookie before we could look at it
+		_, err := sessionStore.New(r, sessionCookieName)
+		d := diagnoseRequest(r, isBehindTLSProxy, err, nil)
+		d.logDebug("session diagnostics")
+		d.Page("Session diagnostics", http.StatusOK).Render(w, r, nil, nil)
+	})
+}
+
+// csrfDebugErrorHandler replaces the default CSRF error handler when
+// PORTUNUS_DEBUG is set.
+func csrfDebugErrorHandler(isBehindTLSProxy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := sessionStore.New(r, sessionCookieName)
+		d := diagnoseRequest(r, isBehindTLSProxy, err, csrf.FailureReason(r))
+		d.logDebug("CSRF check failed")
+		d.Page("CSRF check failed", http.StatusForbidden).Render(w, r, nil, nil)
+	})
+}
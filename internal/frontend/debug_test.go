@@ -0,0 +1,56 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestExplainSessionError(t *testing.T) {
+	setupFrontend(t) //initializes sessionStore
+	decodeSessionCookie := func(value string) error {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/self", http.NoBody)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+		_, err := sessionStore.Get(req, sessionCookieName)
+		if err == nil {
+			t.Fatal("expected session cookie to be rejected, but it was accepted")
+		}
+		return err
+	}
+
+	//a cookie that was signed with a different key (e.g. before session-key.dat was regenerated)
+	otherStore := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+	req := httptest.NewRequest(http.MethodGet, "/self", http.NoBody)
+	rec := httptest.NewRecorder()
+	session, err := otherStore.New(req, sessionCookieName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["uid"] = "jane"
+	err = session.Save(req, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	assert.DeepEqual(t, "number of cookies", len(cookies), 1)
+	explanation := explainSessionError(decodeSessionCookie(cookies[0].Value))
+	assert.DeepEqual(t, "explanation for other key",
+		strings.HasPrefix(explanation, "The session cookie was signed with a different key."), true)
+
+	//a cookie that is not even in the right format
+	explanation = explainSessionError(decodeSessionCookie("not!a!cookie"))
+	assert.DeepEqual(t, "explanation for malformed cookie",
+		strings.HasPrefix(explanation, "The session cookie is malformed."), true)
+}
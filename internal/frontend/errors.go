@@ -0,0 +1,115 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/sapcc/go-bits/logg"
+)
+
+var internalServerErrorSnippet = h.NewSnippet(`
+	<p>{{T "Something went wrong while processing your request."}}</p>
+	<p>{{T "If this problem persists, please contact your administrator and provide the reference ID %s." (code .)}}</p>
+	<p><a href="/">{{T "Back to the start page"}}</a></p>
+`)
+
+var notFoundSnippet = h.NewSnippet(`
+	<p>{{T "The page you requested does not exist."}}</p>
+	<p><a href="/">{{T "Back to the start page"}}</a></p>
+`)
+
+// recoveryMiddleware catches panics in the inner handler and renders them as
+// a 500 error page. Every such error is assigned a reference ID that appears
+// both on the error page and in the log, so that user reports can be matched
+// to the corresponding stack trace.
+func recoveryMiddleware(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw := &trackingResponseWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			//this is used by net/http itself to abort a response, so let it through
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			refID := hex.EncodeToString(core.GenerateRandomKey(8))
+			logg.Error("panic while handling %s %s (reference ID %s): %v\n%s",
+				r.Method, r.URL.Path, refID, recovered, debug.Stack())
+
+			//if the inner handler already started writing the response, we cannot
+			//replace it with an error page anymore
+			if tw.HasStarted() {
+				return
+			}
+			Page{
+				Status:   http.StatusInternalServerError,
+				Title:    "Internal server error",
+				Contents: internalServerErrorSnippet.RenderIn(i18n.ForRequest(r), refID),
+			}.Render(tw, r, nil, nil)
+		}()
+		inner.ServeHTTP(tw, r)
+	})
+}
+
+func getNotFoundHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		TryLoadLogin(n),
+		ShowView(func(i *Interaction) Page {
+			return Page{
+				Status:   http.StatusNotFound,
+				Title:    "Not found",
+				Contents: notFoundSnippet.RenderIn(i.Locale(), nil),
+			}
+		}),
+	)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type trackingResponseWriter
+
+// trackingResponseWriter is an http.ResponseWriter that remembers whether
+// a response has already been started.
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *trackingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *trackingResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// Unwrap allows http.ResponseController to reach the original ResponseWriter.
+func (w *trackingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// HasStarted returns whether WriteHeader() or Write() has been called.
+func (w *trackingResponseWriter) HasStarted() bool {
+	return w.status != 0
+}
@@ -0,0 +1,267 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+func getExportHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(func(_ *Interaction) Page {
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "Export users and groups",
+				Contents: exportPageSnippet.Render(nil),
+			}
+		}),
+	)
+}
+
+var exportPageSnippet = h.NewSnippet(`
+	<p>Download all users and groups for reporting or migration purposes:</p>
+	<ul>
+		<li><a href="/users/export.csv">Users as CSV</a></li>
+		<li><a href="/groups/export.csv">Groups as CSV</a></li>
+		<li><a href="/export.json">Users and groups as JSON</a> (in the same format as the database file)</li>
+		<li><a href="/groups/posix-report">Report on POSIX group IDs</a> (also <a href="/groups/posix-report.csv">as CSV</a>)</li>
+		<li><a href="/export/snapshot">Directory snapshot for audits</a> (users, groups, LDAP directory and seed report in a single zip file)</li>
+	</ul>
+	<p>
+		Password hashes and keys for two-factor authentication are not included by default. For migrations to another
+		Portunus instance, the JSON export can be <a href="/export.json?password_hashes=include">downloaded including
+		password hashes and two-factor keys</a>.
+		The same option also exists for the <a href="/users/export.csv?password_hashes=include">users CSV</a>.
+		Please store these files as securely as the database itself.
+	</p>
+`)
+
+// exportIncludesPasswordHashes returns whether the exported files shall
+// contain password hashes.
+func exportIncludesPasswordHashes(r *http.Request) bool {
+	return r.URL.Query().Get("password_hashes") == "include"
+}
+
+// serveDownload is a final handler step that delivers a file for download.
+func serveDownload(fileName, contentType string, render func(i *Interaction) ([]byte, error)) HandlerStep {
+	return func(i *Interaction) {
+		buf, err := render(i)
+		if err != nil {
+			i.WriteError(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hdr := i.writer.Header()
+		hdr.Set("Content-Type", contentType)
+		hdr.Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+		hdr.Set("Cache-Control", "no-store")
+		i.writer.WriteHeader(http.StatusOK)
+		_, _ = i.writer.Write(buf)
+		i.writer = nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// JSON
+
+func getExportJSONHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		serveDownload("portunus-export.json", "application/json", renderExportJSON(n)),
+	)
+}
+
+// exportedUser is a core.User that may be serialized without its password hash.
+type exportedUser struct {
+	core.User
+	//These shadow the respective fields of core.User such that they can be omitted if empty.
+	PasswordHash string `json:"password,omitempty"`
+	TOTPKeyURL   string `json:"totp_key_url,omitempty"`
+}
+
+func renderExportJSON(n core.Nexus) func(i *Interaction) ([]byte, error) {
+	return func(i *Interaction) ([]byte, error) {
+		includeHashes := exportIncludesPasswordHashes(i.Req)
+		var data struct {
+			Users  []exportedUser `json:"users"`
+			Groups []core.Group   `json:"groups"`
+		}
+		data.Users = []exportedUser{}
+		for _, user := range sortedUsers(n) {
+			exported := exportedUser{User: user}
+			if includeHashes {
+				//the TOTP key is as sensitive as the password hash, so it follows the same rule
+				exported.PasswordHash = user.PasswordHash
+				exported.TOTPKeyURL = user.TOTPKeyURL
+			}
+			data.Users = append(data.Users, exported)
+		}
+		data.Groups = sortedGroups(n)
+		return json.MarshalIndent(data, "", "  ")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CSV
+
+func getUsersExportCSVHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		serveDownload("portunus-users.csv", "text/csv; charset=utf-8", renderUsersCSV(n)),
+	)
+}
+
+func renderUsersCSV(n core.Nexus) func(i *Interaction) ([]byte, error) {
+	return func(i *Interaction) ([]byte, error) {
+		return buildUsersCSV(n, exportIncludesPasswordHashes(i.Req))
+	}
+}
+
+func buildUsersCSV(n core.Nexus, includeHashes bool) ([]byte, error) {
+	groups := sortedGroups(n)
+
+	header := []string{
+		"login_name", "given_name", "family_name", "email", "ssh_public_keys", "groups",
+		"posix_uid", "posix_gid", "posix_home", "posix_shell", "posix_gecos", "labels",
+		"extra_attributes", "telephone_number", "mobile", "postal_address",
+		"manager", "domain",
+	}
+	if includeHashes {
+		header = append(header, "password")
+	}
+	records := [][]string{header}
+
+	for _, user := range sortedUsers(n) {
+		var groupNames []string
+		for _, group := range groups {
+			if group.ContainsUser(user) {
+				groupNames = append(groupNames, group.Name)
+			}
+		}
+		record := []string{
+			user.LoginName,
+			user.GivenName,
+			user.FamilyName,
+			user.EMailAddress,
+			strings.Join(user.SSHPublicKeys, "\n"),
+			strings.Join(groupNames, " "),
+		}
+		if user.POSIX == nil {
+			record = append(record, "", "", "", "", "")
+		} else {
+			record = append(record,
+				user.POSIX.UID.String(),
+				user.POSIX.GID.String(),
+				user.POSIX.HomeDirectory,
+				user.POSIX.LoginShell,
+				user.POSIX.GECOS,
+			)
+		}
+		record = append(record, strings.Join(user.Labels.Lines(), "\n"), strings.Join(user.ExtraAttributes.Lines(), "\n"))
+		record = append(record, user.TelephoneNumber, user.MobileNumber, user.PostalAddress, user.ManagerLoginName, user.Domain)
+		if includeHashes {
+			record = append(record, user.PasswordHash)
+		}
+		records = append(records, record)
+	}
+	return renderCSV(records)
+}
+
+func getGroupsExportCSVHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		serveDownload("portunus-groups.csv", "text/csv; charset=utf-8", renderGroupsCSV(n)),
+	)
+}
+
+func renderGroupsCSV(n core.Nexus) func(i *Interaction) ([]byte, error) {
+	return func(_ *Interaction) ([]byte, error) {
+		return buildGroupsCSV(n)
+	}
+}
+
+func buildGroupsCSV(n core.Nexus) ([]byte, error) {
+	records := [][]string{{
+		"name", "long_name", "members", "is_portunus_admin", "can_read_ldap", "posix_gid",
+		"email", "owner", "notes", "labels", "member_groups", "domain",
+	}}
+	for _, group := range sortedGroups(n) {
+		var memberNames []string
+		for loginName, isMember := range group.MemberLoginNames {
+			if isMember {
+				memberNames = append(memberNames, loginName)
+			}
+		}
+		sort.Strings(memberNames)
+		var memberGroupNames []string
+		for name, isMember := range group.MemberGroupNames {
+			if isMember {
+				memberGroupNames = append(memberGroupNames, name)
+			}
+		}
+		sort.Strings(memberGroupNames)
+
+		posixGID := ""
+		if group.PosixGID != nil {
+			posixGID = group.PosixGID.String()
+		}
+		records = append(records, []string{
+			group.Name,
+			group.LongName,
+			strings.Join(memberNames, " "),
+			strconv.FormatBool(group.Permissions.Portunus.IsAdmin),
+			strconv.FormatBool(group.Permissions.LDAP.CanRead),
+			posixGID,
+			group.EMailAddress,
+			group.OwnerLoginName,
+			group.Notes,
+			strings.Join(group.Labels.Lines(), "\n"),
+			strings.Join(memberGroupNames, " "),
+			group.Domain,
+		})
+	}
+	return renderCSV(records)
+}
+
+func renderCSV(records [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err := w.WriteAll(records) //includes Flush
+	return buf.Bytes(), err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// helper functions
+
+func sortedUsers(n core.Nexus) []core.User {
+	users := n.ListUsers()
+	sort.Slice(users, func(i, j int) bool { return users[i].LoginName < users[j].LoginName })
+	return users
+}
+
+func sortedGroups(n core.Nexus) []core.Group {
+	groups := n.ListGroups()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
@@ -0,0 +1,46 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestFeatureFlagsInUI(t *testing.T) {
+	_, enabledServer := setupFrontendWithOptions(t, HandlerOptions{
+		Features: core.NewFeatureSet(core.FeatureJoinRequests),
+	})
+	//the feature set applies per handler, even when there are several in one process
+	_, disabledServer := setupFrontendWithOptions(t, HandlerOptions{
+		Features: core.NewFeatureSet(),
+	})
+
+	for _, tc := range []struct {
+		Browser   *browser
+		IsEnabled bool
+	}{
+		{Browser: newBrowser(t, enabledServer), IsEnabled: true},
+		{Browser: newBrowser(t, disabledServer), IsEnabled: false},
+	} {
+		b := tc.Browser
+		_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+		assert.DeepEqual(t, "redirect after login", location, "/self")
+
+		_, body := b.Get("/self")
+		assert.DeepEqual(t, "navigation link to /groups/browse", strings.Contains(body, `href="/groups/browse"`), tc.IsEnabled)
+
+		//when disabled, this is routed to the details page of a group called "browse"
+		status, _ := b.Get("/groups/browse")
+		assert.DeepEqual(t, "/groups/browse is available", status == http.StatusOK, tc.IsEnabled)
+	}
+}
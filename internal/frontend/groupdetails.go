@@ -0,0 +1,202 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// Handles GET /groups/{name}.
+func getGroupDetailsHandler(n core.Nexus, avatarSource *AvatarSource, userDN func(core.User) string, groupDNs func(core.Group) []string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		ShowView(groupDetails(n, avatarSource, userDN, groupDNs)),
+	)
+}
+
+var groupDetailsSnippet = h.NewSnippet(`
+	<div class="button-row">
+		<a href="/groups/{{.Group.Name}}/edit" class="button button-primary">Edit</a>
+		<a href="/groups/{{.Group.Name}}/members" class="button button-secondary">Edit members as text</a>
+		<a href="/groups/{{.Group.Name}}/history" class="button button-secondary">History</a>
+		<a href="/groups/{{.Group.Name}}/delete" class="button button-secondary">Delete</a>
+	</div>
+	<h2>Attributes</h2>
+	<table class="table">
+		<tbody>
+			<tr><th>Name</th><td><code>{{.Group.Name}}</code> {{.SeedBadge}}</td></tr>
+			{{- with .Group.FormerNames }}
+				<tr><th>Former names</th><td>{{range $idx, $n := .}}{{if $idx}}<br>{{end}}<code>{{$n.Name}}</code> (until {{$n.RenamedAt}}){{end}}</td></tr>
+			{{- end }}
+			<tr><th>Long name</th><td>{{.Group.LongName}}</td></tr>
+			{{- if .HasDomains }}
+				<tr><th>Domain</th><td>{{if .Group.Domain}}<code>{{.Group.Domain}}</code>{{else}}<em>primary domain</em>{{end}}</td></tr>
+			{{- end }}
+			<tr><th>POSIX ID</th><td>{{with .Group.PosixGID}}{{.}}{{else}}<em>None</em>{{end}}</td></tr>
+			<tr><th>Permissions granted</th><td>{{.PermissionsText}}</td></tr>
+			<tr><th>Email address</th><td>{{if .Group.EMailAddress}}{{.Group.EMailAddress}}{{else}}<em>Not specified</em>{{end}}</td></tr>
+			<tr><th>Owner</th><td>{{if .Group.OwnerLoginName}}<a href="/users/{{.Group.OwnerLoginName}}"><code>{{.Group.OwnerLoginName}}</code></a>{{else}}<em>None</em>{{end}}</td></tr>
+			<tr><th>Notes</th><td>{{if .Group.Notes}}{{.Group.Notes}}{{else}}<em>None</em>{{end}}</td></tr>
+			<tr><th>Labels</th><td class="comma-separated-list">{{.LabelList}}</td></tr>
+			{{- if .ShowsDNs }}
+				<tr>
+					<th>LDAP DN</th>
+					<td>
+						{{- range $idx, $dn := .GroupDNs }}{{if $idx}}<br>{{end}}<code>{{$dn}}</code>{{ else }}<em>not published in the LDAP directory</em>{{ end -}}
+					</td>
+				</tr>
+			{{- end }}
+		</tbody>
+	</table>
+	{{- with .NestedGroups }}
+		<h2>Nested groups</h2>
+		<p>
+			All members of these groups are also members of this group:
+			<span class="comma-separated-list">
+				{{- range . -}}
+					<a href="/groups/{{.Name}}">{{.LongName}}</a><span class="comma">,&nbsp;</span>
+				{{- end -}}
+			</span>
+		</p>
+	{{- end }}
+	<h2>Members</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Login name</th>
+				<th>Full name</th>
+				<th>Membership</th>
+				{{- if .ShowsDNs }}<th>LDAP DN</th>{{ end }}
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Members}}
+				<tr>
+					<td data-label="Login name">{{.Avatar}}<a href="/users/{{.User.LoginName}}"><code>{{.User.LoginName}}</code></a></td>
+					<td data-label="Full name">{{.User.FullName}}</td>
+					<td data-label="Membership">
+						{{- if .IsDirect -}}
+							direct{{with .ValidUntil}} until {{.}}{{end}}
+						{{- else -}}
+							through <span class="comma-separated-list">
+								{{- range .ThroughGroups -}}
+									<a href="/groups/{{.}}"><code>{{.}}</code></a><span class="comma">,&nbsp;</span>
+								{{- end -}}
+							</span>
+						{{- end -}}
+					</td>
+					{{- if $.ShowsDNs }}<td data-label="LDAP DN"><code>{{.DN}}</code></td>{{ end }}
+				</tr>
+			{{else}}
+				<tr><td colspan="4" class="text-muted">This group does not have any members.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+type groupDetailsMember struct {
+	User          core.User
+	Avatar        template.HTML
+	IsDirect      bool
+	ValidUntil    string
+	ThroughGroups []string
+	DN            string
+}
+
+func groupDetails(n core.Nexus, avatarSource *AvatarSource, userDN func(core.User) string, groupDNs func(core.Group) []string) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		group := *i.TargetGroup
+		allGroups := n.ListGroups()
+		resolvedGroups := core.ResolveNestedGroups(allGroups)
+		findGroup := func(groups []core.Group, name string) (core.Group, bool) {
+			idx := slices.IndexFunc(groups, func(g core.Group) bool { return g.Name == name })
+			if idx == -1 {
+				return core.Group{}, false
+			}
+			return groups[idx], true
+		}
+
+		data := struct {
+			Group           core.Group
+			SeedBadge       template.HTML
+			LabelList       template.HTML
+			HasDomains      bool
+			PermissionsText string
+			ShowsDNs        bool
+			GroupDNs        []string
+			NestedGroups    []core.Group
+			Members         []groupDetailsMember
+		}{
+			Group:           group,
+			SeedBadge:       renderSeedBadge(n.SeededFieldsOf(group.Ref())),
+			LabelList:       renderLabelList(group.Labels, "/groups"),
+			HasDomains:      len(n.ValidationConfig().Domains) > 0,
+			PermissionsText: describePermissions(group.Permissions),
+			ShowsDNs:        userDN != nil && groupDNs != nil,
+		}
+		if data.ShowsDNs {
+			data.GroupDNs = groupDNs(group)
+		}
+
+		var nestedGroupNames []string
+		for name, isMember := range group.MemberGroupNames {
+			if !isMember {
+				continue
+			}
+			nestedGroupNames = append(nestedGroupNames, name)
+			if nested, exists := findGroup(allGroups, name); exists {
+				data.NestedGroups = append(data.NestedGroups, nested)
+			}
+		}
+		sort.Strings(nestedGroupNames)
+		sort.Slice(data.NestedGroups, func(i, j int) bool { return data.NestedGroups[i].Name < data.NestedGroups[j].Name })
+
+		resolved, _ := findGroup(resolvedGroups, group.Name)
+		users := n.ListUsers()
+		sort.Slice(users, func(i, j int) bool { return users[i].LoginName < users[j].LoginName })
+		for _, user := range users {
+			if !resolved.ContainsUser(user) {
+				continue
+			}
+			member := groupDetailsMember{
+				User:     user,
+				Avatar:   renderAvatar(avatarSource, user),
+				IsDirect: group.ContainsUser(user),
+			}
+			if member.IsDirect {
+				member.ValidUntil = group.MemberValidUntil[user.LoginName]
+			}
+			if !member.IsDirect {
+				for _, name := range nestedGroupNames {
+					if nested, exists := findGroup(resolvedGroups, name); exists && nested.ContainsUser(user) {
+						member.ThroughGroups = append(member.ThroughGroups, name)
+					}
+				}
+			}
+			if data.ShowsDNs {
+				member.DN = userDN(user)
+			}
+			data.Members = append(data.Members, member)
+		}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Group " + group.Name,
+			Contents: groupDetailsSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
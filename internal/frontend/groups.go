@@ -7,8 +7,14 @@
 package frontend
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"html/template"
+	"maps"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
 
@@ -19,33 +25,39 @@ import (
 	"github.com/sapcc/go-bits/errext"
 )
 
-func getGroupsHandler(n core.Nexus) http.Handler {
+func getGroupsHandler(n core.Nexus, features core.FeatureSet) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
-		ShowView(groupsList(n)),
+		ShowView(groupsList(n, features)),
 	)
 }
 
 var groupsListSnippet = h.NewSnippet(`
+	{{.FilterNotice}}
+	{{.SearchBox}}
 	<table class="table responsive">
 		<thead>
 			<tr>
-				<th>Name</th>
-				<th>Long name</th>
-				<th>POSIX ID</th>
-				<th>Members</th>
+				<th>{{.Query.RenderSortHeader "Name" "name"}}</th>
+				<th>{{.Query.RenderSortHeader "Long name" "long_name"}}</th>
+				<th>{{.Query.RenderSortHeader "POSIX ID" "posix_id"}}</th>
+				<th>{{.Query.RenderSortHeader "Members" "members"}}</th>
 				<th>Permissions granted</th>
+				<th>Contact</th>
+				<th>Labels</th>
 				<th class="actions">
 					<a href="/groups/new" class="button button-primary">New group</a>
+					{{if .HasJoinRequests}}<a href="/groups/requests" class="button button-secondary">Join requests</a>{{end}}
+					<a href="/export" class="button button-secondary">Export</a>
 				</th>
 			</tr>
 		</thead>
 		<tbody>
-			{{range .}}
+			{{range .Groups}}
 				<tr>
-					<td data-label="Name"><code>{{.Group.Name}}</code></td>
+					<td data-label="Name"><a href="/groups/{{.Group.Name}}"><code>{{.Group.Name}}</code></a> {{.SeedBadge}}{{if .Group.IsHiddenFromLDAP}} <span class="text-muted">(not in LDAP)</span>{{end}}</td>
 					<td data-label="Long name">{{.Group.LongName}}</td>
 					{{ if .Group.PosixGID -}}
 						<td data-label="POSIX ID">{{.Group.PosixGID}}</td>
@@ -54,48 +66,151 @@ var groupsListSnippet = h.NewSnippet(`
 					{{- end }}
 					<td data-label="Members">{{.MemberCount}}</td>
 					<td data-label="Permissions granted">{{.PermissionsText}}</td>
+					{{ if or .Group.OwnerLoginName .Group.EMailAddress -}}
+						<td data-label="Contact">
+							{{- if .Group.OwnerLoginName }}<code>{{.Group.OwnerLoginName}}</code>{{ end -}}
+							{{- if and .Group.OwnerLoginName .Group.EMailAddress }}<br>{{ end -}}
+							{{- if .Group.EMailAddress }}<a href="mailto:{{.Group.EMailAddress}}">{{.Group.EMailAddress}}</a>{{ end -}}
+						</td>
+					{{- else -}}
+						<td data-label="Contact" class="text-muted">None</td>
+					{{- end }}
+					<td data-label="Labels" class="comma-separated-list">{{.LabelList}}</td>
 					<td class="actions">
 						<a href="/groups/{{.Group.Name}}/edit">Edit</a>
 						·
+						<a href="/groups/{{.Group.Name}}/members">Members</a>
+						·
+						<a href="/groups/{{.Group.Name}}/history">History</a>
+						·
 						<a href="/groups/{{.Group.Name}}/delete">Delete</a>
 					</td>
 				</tr>
 			{{end}}
 		</tbody>
 	</table>
+	{{.Pagination}}
 `)
 
-func groupsList(n core.Nexus) func(*Interaction) Page {
-	return func(_ *Interaction) Page {
+// The sort keys for the group list. The first one is the default.
+var groupsListSortKeys = []string{"name", "long_name", "posix_id", "members"}
+
+var groupsListFilters = []listFilter{
+	{"posix", "Only POSIX groups"},
+	{"ldap_read", "Only groups with LDAP read access"},
+	{"empty", "Only empty groups"},
+	formerNamesListFilter,
+}
+
+func compareGroupsBy(sortKey string) func(a, b core.Group) int {
+	switch sortKey {
+	case "long_name":
+		return func(a, b core.Group) int {
+			return cmp.Or(cmp.Compare(strings.ToLower(a.LongName), strings.ToLower(b.LongName)), cmp.Compare(a.Name, b.Name))
+		}
+	case "posix_id":
+		//groups without POSIX ID come first
+		posixID := func(g core.Group) int64 {
+			if g.PosixGID == nil {
+				return -1
+			}
+			return int64(*g.PosixGID)
+		}
+		return func(a, b core.Group) int {
+			return cmp.Or(cmp.Compare(posixID(a), posixID(b)), cmp.Compare(a.Name, b.Name))
+		}
+	case "members":
+		return func(a, b core.Group) int {
+			return cmp.Or(cmp.Compare(len(a.MemberLoginNames), len(b.MemberLoginNames)), cmp.Compare(a.Name, b.Name))
+		}
+	default:
+		return func(a, b core.Group) int { return cmp.Compare(a.Name, b.Name) }
+	}
+}
+
+func matchesGroupsListFilters(g core.Group, q listQuery) bool {
+	ldap := g.Permissions.LDAP
+	switch {
+	case q.HasFilter("posix") && g.PosixGID == nil:
+		return false
+	case q.HasFilter("ldap_read") && !(ldap.CanRead || ldap.CanReadUsers || ldap.CanReadGroups || len(ldap.ReadGroupNames) > 0):
+		return false
+	case q.HasFilter("empty") && (len(g.MemberLoginNames) > 0 || len(g.MemberGroupNames) > 0):
+		return false
+	default:
+		return true
+	}
+}
+
+// describePermissions returns a short human-readable summary of the given
+// permissions, like "Portunus admin, LDAP read access".
+func describePermissions(perms core.Permissions) string {
+	var permTexts []string
+	if perms.Portunus.IsAdmin {
+		permTexts = append(permTexts, "Portunus admin")
+	}
+	if perms.LDAP.CanRead {
+		permTexts = append(permTexts, "LDAP read access")
+	} else {
+		if perms.LDAP.CanReadUsers {
+			permTexts = append(permTexts, "LDAP read access to users")
+		}
+		if perms.LDAP.CanReadGroups {
+			permTexts = append(permTexts, "LDAP read access to groups")
+		} else if count := len(perms.LDAP.ReadGroupNames); count > 0 {
+			permTexts = append(permTexts, fmt.Sprintf("LDAP read access to %d selected groups", count))
+		}
+	}
+	if perms.LDAP.WriteSubtree != "" {
+		permTexts = append(permTexts, fmt.Sprintf("LDAP write access to subtree %q", perms.LDAP.WriteSubtree))
+	}
+
+	if len(permTexts) == 0 {
+		return "None"
+	}
+	return strings.Join(permTexts, ", ")
+}
+
+func groupsList(n core.Nexus, features core.FeatureSet) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		query := listQueryFromRequest(i, "/groups", groupsListSortKeys, groupsListFilters...)
 		groups := n.ListGroups()
-		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		groups = slices.DeleteFunc(groups, func(g core.Group) bool {
+			return !g.Labels.MatchesAll(query.Labels) || !matchesGroupsListFilters(g, query) || (!query.MatchesSearch(g.Name, g.LongName) && !query.MatchesFormerNames(g.FormerNames))
+		})
+		slices.SortFunc(groups, listSortFunc(query, compareGroupsBy(query.SortKey)))
 
 		type groupItem struct {
 			Group           core.Group
 			MemberCount     int
 			PermissionsText string
+			LabelList       template.HTML
+			SeedBadge       template.HTML
+		}
+		var data struct {
+			Groups          []groupItem
+			Query           listQuery
+			FilterNotice    template.HTML
+			SearchBox       template.HTML
+			Pagination      template.HTML
+			HasJoinRequests bool
 		}
-		data := make([]groupItem, len(groups))
-		for idx, group := range groups {
+		groups, data.Pagination = paginateList(&query, groups, "groups")
+		data.Query = query
+		data.FilterNotice = renderLabelFilterNotice(query.Labels, "groups", "/groups")
+		data.SearchBox = query.RenderSearchBox("Name or long name", groupsListFilters...)
+		data.HasJoinRequests = features.IsEnabled(core.FeatureJoinRequests)
+		for _, group := range groups {
 			item := groupItem{
 				Group:       group,
 				MemberCount: len(group.MemberLoginNames),
+				LabelList:   renderLabelList(group.Labels, "/groups"),
+				SeedBadge:   renderSeedBadge(n.SeededFieldsOf(group.Ref())),
 			}
 
-			var permTexts []string
-			if group.Permissions.Portunus.IsAdmin {
-				permTexts = append(permTexts, "Portunus admin")
-			}
-			if group.Permissions.LDAP.CanRead {
-				permTexts = append(permTexts, "LDAP read access")
-			}
-
-			if len(permTexts) == 0 {
-				permTexts = []string{"None"}
-			}
-			item.PermissionsText = strings.Join(permTexts, ", ")
+			item.PermissionsText = describePermissions(group.Permissions)
 
-			data[idx] = item
+			data.Groups = append(data.Groups, item)
 		}
 
 		return Page{
@@ -107,17 +222,20 @@ func groupsList(n core.Nexus) func(*Interaction) Page {
 	}
 }
 
-func useGroupForm(n core.Nexus) HandlerStep {
+func useGroupForm(n core.Nexus, features core.FeatureSet) HandlerStep {
 	return func(i *Interaction) {
 		i.FormState = &h.FormState{
 			Fields: map[string]*h.FieldState{},
 		}
 		i.FormSpec = &h.FormSpec{
 			Fields: []h.FormField{
-				buildGroupMasterdataFieldset(i.TargetGroup, i.FormState),
-				buildGroupPermissionsFieldset(i.TargetGroup, i.FormState),
+				buildGroupMasterdataFieldset(n, i.TargetGroup, i.FormState),
+				buildGroupContactFieldset(i.TargetGroup, i.FormState),
+				buildGroupPermissionsFieldset(n, i.TargetGroup, i.FormState),
+				buildGroupDefaultMembershipFieldset(i.TargetGroup, i.FormState),
 				buildGroupPosixFieldset(i.TargetGroup, i.FormState),
-				buildGroupMemberFieldset(n, i.TargetGroup, i.FormState),
+				buildGroupMemberFieldset(n, features, i.TargetGroup, i.FormState),
+				buildGroupNestingFieldset(n, i.TargetGroup, i.FormState),
 			},
 		}
 
@@ -127,11 +245,13 @@ func useGroupForm(n core.Nexus) HandlerStep {
 		} else {
 			i.FormSpec.PostTarget = "/groups/" + i.TargetGroup.Name + "/edit"
 			i.FormSpec.SubmitLabel = "Save"
+			sf := n.SeededFieldsOf(i.TargetGroup.Ref())
+			i.FormSpec.Fields = markSeededFields(i.FormSpec.Fields, sf, i.FormState)
 		}
 	}
 }
 
-func buildGroupMasterdataFieldset(g *core.Group, state *h.FormState) h.FormField {
+func buildGroupMasterdataFieldset(n core.Nexus, g *core.Group, state *h.FormState) h.FormField {
 	var nameField h.FormField
 	if g == nil {
 		nameField = h.InputFieldSpec{
@@ -146,22 +266,90 @@ func buildGroupMasterdataFieldset(g *core.Group, state *h.FormState) h.FormField
 		}
 		state.Fields["long_name"] = &h.FieldState{Value: g.LongName}
 	}
+	var (
+		labels core.Labels
+		domain string
+	)
+	if g != nil {
+		labels = g.Labels
+		domain = g.Domain
+	}
+	state.Fields["publish_to_ldap"] = &h.FieldState{
+		Selected: map[string]bool{"yes": g == nil || !g.IsHiddenFromLDAP},
+	}
+
+	fields := []h.FormField{nameField}
+	if field, ok := buildDomainField(n, domain, state); ok {
+		fields = append(fields, field)
+	}
+	fields = append(fields,
+		h.InputFieldSpec{
+			InputType: "text",
+			Name:      "long_name",
+			Label:     "Long name",
+		},
+		buildLabelsField(labels, state),
+		h.SelectFieldSpec{
+			Name:  "publish_to_ldap",
+			Label: "Publish this group in the LDAP directory?",
+			Options: []h.SelectOptionSpec{
+				{
+					Value: "yes",
+					Label: "Yes (if not, the group still grants its permissions, but applications cannot see it)",
+				},
+			},
+		},
+	)
 
 	return h.FieldSet{
 		Label:      "Master data",
 		IsFoldable: false,
+		Fields:     fields,
+	}
+}
+
+func buildGroupContactFieldset(g *core.Group, state *h.FormState) h.FormField {
+	if g != nil {
+		state.Fields["email"] = &h.FieldState{Value: g.EMailAddress}
+		state.Fields["owner"] = &h.FieldState{Value: g.OwnerLoginName}
+		state.Fields["notes"] = &h.FieldState{Value: g.Notes}
+	}
+
+	return h.FieldSet{
+		Label:      "Contact (optional)",
+		IsFoldable: false,
 		Fields: []h.FormField{
-			nameField,
 			h.InputFieldSpec{
 				InputType: "text",
-				Name:      "long_name",
-				Label:     "Long name",
+				Name:      "email",
+				Label:     "Email address",
+			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "owner",
+				Label:     "Owner (login name of the user responsible for this group)",
+			},
+			h.MultilineInputFieldSpec{
+				Name:  "notes",
+				Label: "Notes",
 			},
 		},
 	}
 }
 
-func buildGroupPermissionsFieldset(g *core.Group, state *h.FormState) h.FormField {
+func buildGroupPermissionsFieldset(n core.Nexus, g *core.Group, state *h.FormState) h.FormField {
+	allGroups := n.ListGroups()
+	sort.Slice(allGroups, func(i, j int) bool {
+		return allGroups[i].LongName < allGroups[j].LongName
+	})
+	var groupOpts []h.SelectOptionSpec
+	for _, group := range allGroups {
+		groupOpts = append(groupOpts, h.SelectOptionSpec{
+			Value: group.Name,
+			Label: group.LongName,
+		})
+	}
+
 	if g != nil {
 		state.Fields["portunus_perms"] = &h.FieldState{
 			Selected: map[string]bool{
@@ -170,9 +358,13 @@ func buildGroupPermissionsFieldset(g *core.Group, state *h.FormState) h.FormFiel
 		}
 		state.Fields["ldap_perms"] = &h.FieldState{
 			Selected: map[string]bool{
-				"can_read": g.Permissions.LDAP.CanRead,
+				"can_read":        g.Permissions.LDAP.CanRead,
+				"can_read_users":  g.Permissions.LDAP.CanReadUsers,
+				"can_read_groups": g.Permissions.LDAP.CanReadGroups,
 			},
 		}
+		state.Fields["ldap_read_groups"] = &h.FieldState{Selected: g.Permissions.LDAP.ReadGroupNames}
+		state.Fields["ldap_write_subtree"] = &h.FieldState{Value: g.Permissions.LDAP.WriteSubtree}
 	}
 
 	return h.FieldSet{
@@ -197,13 +389,66 @@ func buildGroupPermissionsFieldset(g *core.Group, state *h.FormState) h.FormFiel
 						Value: "can_read",
 						Label: "Read access",
 					},
+					{
+						Value: "can_read_users",
+						Label: "Read access to users only",
+					},
+					{
+						Value: "can_read_groups",
+						Label: "Read access to groups only",
+					},
+				},
+			},
+			h.SelectFieldSpec{
+				Name:    "ldap_read_groups",
+				Label:   "Grants read access in LDAP to these groups only?",
+				Options: groupOpts,
+			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "ldap_write_subtree",
+				Label:     "Grants write access to the LDAP subtree \"ou=<name>,ou=subtrees\"? (optional, enter name)",
+			},
+		},
+	}
+}
+
+func buildGroupDefaultMembershipFieldset(g *core.Group, state *h.FormState) h.FormField {
+	if g != nil {
+		state.Fields["default_membership"] = &h.FieldState{
+			Selected: map[string]bool{
+				"all_users": g.DefaultMembership.ForAllUsers,
+			},
+		}
+		state.Fields["default_email_domains"] = &h.FieldState{
+			Value: strings.Join(g.DefaultMembership.ForEMailDomains, " "),
+		}
+	}
+
+	return h.FieldSet{
+		Label:      "Default membership for new users (optional)",
+		IsFoldable: false,
+		Fields: []h.FormField{
+			h.SelectFieldSpec{
+				Name:  "default_membership",
+				Label: "Add new users to this group?",
+				Options: []h.SelectOptionSpec{
+					{
+						Value: "all_users",
+						Label: "All new users",
+					},
 				},
 			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "default_email_domains",
+				Label:     "New users with an email address in these domains (space-separated)",
+			},
 		},
 	}
 }
 
-func buildGroupMemberFieldset(n core.Nexus, g *core.Group, state *h.FormState) h.FormField {
+func buildGroupMemberFieldset(n core.Nexus, features core.FeatureSet, g *core.Group, state *h.FormState) h.FormField {
 	allUsers := n.ListUsers()
 	sort.Slice(allUsers, func(i, j int) bool {
 		return allUsers[i].LoginName < allUsers[j].LoginName
@@ -219,23 +464,86 @@ func buildGroupMemberFieldset(n core.Nexus, g *core.Group, state *h.FormState) h
 			isUserSelected[user.LoginName] = g.ContainsUser(user)
 		}
 	}
+	var fields []h.FormField
+	if features.IsEnabled(core.FeatureJoinRequests) {
+		fields = append(fields, h.SelectFieldSpec{
+			Name:  "joinable",
+			Label: "Can users request to join this group?",
+			Options: []h.SelectOptionSpec{
+				{
+					Value: "yes",
+					Label: "Yes, on the \"Browse groups\" page (requests are decided on by the owner)",
+				},
+			},
+		})
+	}
+	fields = append(fields, h.SelectFieldSpec{
+		Name:    "members",
+		Label:   "Members of this Group",
+		Options: memberOpts,
+	}, h.MultilineInputFieldSpec{
+		Name:    "member_valid_until",
+		Label:   "Temporary members (optional)",
+		Tooltip: "One \"login-name=YYYY-MM-DD\" per line. These members are removed from the group automatically after the given date.",
+	})
 	if g != nil {
 		state.Fields["members"] = &h.FieldState{Selected: isUserSelected}
+		var lines []string
+		for _, loginName := range slices.Sorted(maps.Keys(g.MemberValidUntil)) {
+			lines = append(lines, loginName+"="+g.MemberValidUntil[loginName])
+		}
+		state.Fields["member_valid_until"] = &h.FieldState{Value: strings.Join(lines, "\r\n")}
+		state.Fields["joinable"] = &h.FieldState{
+			Selected: map[string]bool{"yes": g.IsJoinable},
+		}
+		fields = append(fields, h.StaticField{
+			Value: groupMembersLinkSnippet.Render(g.Name),
+		})
 	}
 
 	return h.FieldSet{
 		Label:      "Users",
 		IsFoldable: false,
+		Fields:     fields,
+	}
+}
+
+func buildGroupNestingFieldset(n core.Nexus, g *core.Group, state *h.FormState) h.FormField {
+	allGroups := n.ListGroups()
+	sort.Slice(allGroups, func(i, j int) bool {
+		return allGroups[i].LongName < allGroups[j].LongName
+	})
+	var groupOpts []h.SelectOptionSpec
+	for _, group := range allGroups {
+		if g != nil && group.Name == g.Name {
+			continue
+		}
+		groupOpts = append(groupOpts, h.SelectOptionSpec{
+			Value: group.Name,
+			Label: group.LongName,
+		})
+	}
+	if g != nil {
+		state.Fields["member_groups"] = &h.FieldState{Selected: g.MemberGroupNames}
+	}
+
+	return h.FieldSet{
+		Label:      "Nested groups",
+		IsFoldable: false,
 		Fields: []h.FormField{
 			h.SelectFieldSpec{
-				Name:    "members",
-				Label:   "Members of this Group",
-				Options: memberOpts,
+				Name:    "member_groups",
+				Label:   "Groups whose members are also members of this group",
+				Options: groupOpts,
 			},
 		},
 	}
 }
 
+var groupMembersLinkSnippet = h.NewSnippet(`
+	<p>For bulk changes, you can also <a href="/groups/{{.}}/members">edit the members as text</a>.</p>
+`)
+
 func buildGroupPosixFieldset(g *core.Group, state *h.FormState) h.FormField {
 	if g != nil && g.PosixGID != nil {
 		state.Fields["posix"] = &h.FieldState{IsUnfolded: true}
@@ -256,27 +564,30 @@ func buildGroupPosixFieldset(g *core.Group, state *h.FormState) h.FormField {
 	}
 }
 
-func getGroupEditHandler(n core.Nexus) http.Handler {
+func getGroupEditHandler(n core.Nexus, features core.FeatureSet) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetGroup(n),
-		useGroupForm(n),
+		useGroupForm(n, features),
+		addFormVersion,
 		ShowForm("Edit group"),
 	)
 }
 
-func postGroupEditHandler(n core.Nexus) http.Handler {
+func postGroupEditHandler(n core.Nexus, features core.FeatureSet) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetGroup(n),
-		useGroupForm(n),
-		ReadFormStateFromRequest,
+		useGroupForm(n, features),
+		addFormVersion,
+		ReadFormStateWithMerge,
 		TryUpdateNexus(n, executeEditGroup),
 		ShowFormIfErrors("Edit group"),
+		FlashWarnings(n),
 		RedirectWithFlashTo("/groups", "Updated"),
 	)
 }
@@ -288,6 +599,10 @@ func loadTargetGroup(n core.Nexus) HandlerStep {
 		if exists {
 			i.TargetGroup = &group
 			i.TargetRef = group.Ref()
+		} else if group, exists := n.FindGroup(func(g core.Group) bool { return core.MatchesFormerName(g.FormerNames, groupName) }); exists {
+			//keep links from before a rename working
+			msg := fmt.Sprintf("Group %q has been renamed to %q.", groupName, group.Name)
+			i.RedirectWithFlashTo("/groups/"+group.Name, Flash{"primary", msg})
 		} else {
 			msg := fmt.Sprintf("Group %q does not exist.", groupName)
 			i.RedirectWithFlashTo("/groups", Flash{"danger", msg})
@@ -299,16 +614,44 @@ func buildGroupFromFormState(fs *h.FormState, name string) (result core.Group, e
 	result = core.Group{
 		Name:             name,
 		LongName:         fs.Fields["long_name"].Value,
+		Domain:           readDomainField(fs),
 		MemberLoginNames: fs.Fields["members"].Selected,
+		MemberGroupNames: fs.Fields["member_groups"].Selected,
 		Permissions: core.Permissions{
 			Portunus: core.PortunusPermissions{
 				IsAdmin: fs.Fields["portunus_perms"].Selected["is_admin"],
 			},
 			LDAP: core.LDAPPermissions{
-				CanRead: fs.Fields["ldap_perms"].Selected["can_read"],
+				CanRead:        fs.Fields["ldap_perms"].Selected["can_read"],
+				CanReadUsers:   fs.Fields["ldap_perms"].Selected["can_read_users"],
+				CanReadGroups:  fs.Fields["ldap_perms"].Selected["can_read_groups"],
+				ReadGroupNames: fs.Fields["ldap_read_groups"].Selected,
+				WriteSubtree:   strings.TrimSpace(fs.Fields["ldap_write_subtree"].Value),
 			},
 		},
-		PosixGID: nil,
+		PosixGID:       nil,
+		EMailAddress:   fs.Fields["email"].Value,
+		OwnerLoginName: fs.Fields["owner"].Value,
+		//<textarea> contents are prone to have trailing newlines, which we do not care about
+		Notes: strings.TrimSpace(fs.Fields["notes"].Value),
+		DefaultMembership: core.DefaultMembershipRules{
+			ForAllUsers:     fs.Fields["default_membership"].Selected["all_users"],
+			ForEMailDomains: strings.Fields(fs.Fields["default_email_domains"].Value),
+		},
+	}
+	//this field is only shown if join requests are enabled (if not, the field
+	//state is still prefilled when editing a group, so the existing value is kept)
+	if fs.Fields["joinable"] != nil {
+		result.IsJoinable = fs.Fields["joinable"].Selected["yes"]
+	}
+	result.IsHiddenFromLDAP = !fs.Fields["publish_to_ldap"].Selected["yes"]
+	labels, err := core.ParseLabels(fs.Fields["labels"].Value, result.Ref().Field("labels"))
+	result.Labels = labels
+	errs.Add(err)
+	if fs.Fields["member_valid_until"] != nil {
+		validUntil, err := parseMemberValidUntil(fs.Fields["member_valid_until"].Value, result.MemberLoginNames, result.Ref().Field("member_valid_until"))
+		result.MemberValidUntil = validUntil
+		errs.Add(err)
 	}
 	if fs.Fields["posix"].IsUnfolded {
 		gid, err := core.ParsePosixID(fs.Fields["posix_gid"].Value, result.Ref().Field("posix_gid"))
@@ -318,31 +661,62 @@ func buildGroupFromFormState(fs *h.FormState, name string) (result core.Group, e
 	return
 }
 
+// Parses the "login-name=YYYY-MM-DD" lines of the "member_valid_until" field.
+// The dates are validated in core.Group.
+func parseMemberValidUntil(input string, members core.GroupMemberNames, ref core.FieldRef) (map[string]string, error) {
+	var result map[string]string
+	for idx, line := range strings.Split(input, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		loginName, date, found := strings.Cut(line, "=")
+		if !found {
+			err := fmt.Errorf("must have an entry of the form login-name=YYYY-MM-DD on each line (parse error on line %d)", idx+1)
+			return nil, ref.Wrap(err)
+		}
+		loginName = strings.TrimSpace(loginName)
+		if !members[loginName] {
+			return nil, ref.Wrap(fmt.Errorf("may only contain members of this group (found %q)", loginName))
+		}
+		if result == nil {
+			result = make(map[string]string)
+		}
+		result[loginName] = strings.TrimSpace(date)
+	}
+	return result, nil
+}
+
 func executeEditGroup(db *core.Database, i *Interaction, _ crypt.PasswordHasher) errext.ErrorSet {
 	newGroup, errs := buildGroupFromFormState(i.FormState, i.TargetGroup.Name)
+	//the former names are not part of the form, so they need to be carried over
+	if oldGroup, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == newGroup.Name }); exists {
+		newGroup.FormerNames = oldGroup.FormerNames
+	}
 	errs.Add(db.Groups.Update(newGroup))
 	return errs
 }
 
-func getGroupsNewHandler(n core.Nexus) http.Handler {
+func getGroupsNewHandler(n core.Nexus, features core.FeatureSet) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
-		useGroupForm(n),
+		useGroupForm(n, features),
 		ShowForm("Create group"),
 	)
 }
 
-func postGroupsNewHandler(n core.Nexus) http.Handler {
+func postGroupsNewHandler(n core.Nexus, features core.FeatureSet) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
-		useGroupForm(n),
+		useGroupForm(n, features),
 		ReadFormStateFromRequest,
 		TryUpdateNexus(n, executeCreateGroup),
 		ShowFormIfErrors("Create group"),
+		FlashWarnings(n),
 		RedirectWithFlashTo("/groups", "Created"),
 	)
 }
@@ -398,6 +772,185 @@ func postGroupDeleteHandler(n core.Nexus) http.Handler {
 }
 
 func executeDeleteGroup(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
-	errs.Add(db.Groups.Delete(i.TargetGroup.Name))
+	errs.Add(db.DeleteGroup(i.TargetGroup.Name))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// edit group membership as text
+
+func getGroupMembersHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		useGroupMembersForm,
+		addFormVersion,
+		ShowForm("Edit group members"),
+	)
+}
+
+func postGroupMembersHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetGroup(n),
+		useGroupMembersForm,
+		addFormVersion,
+		ReadFormStateWithMerge,
+		previewGroupMembersChange(n),
+		TryUpdateNexus(n, executeEditGroupMembers),
+		ShowFormIfErrors("Edit group members"),
+		FlashWarnings(n),
+		RedirectWithFlashTo("/groups", "Updated"),
+	)
+}
+
+var groupMembersHelpSnippet = h.NewSnippet(`
+	<p>
+		Enter one login name per line. When you submit this form, you will be shown which users will be added to and
+		removed from group <code>{{.}}</code> before the change is applied.
+	</p>
+`)
+
+func useGroupMembersForm(i *Interaction) {
+	var memberNames []string
+	for loginName, isMember := range i.TargetGroup.MemberLoginNames {
+		if isMember {
+			memberNames = append(memberNames, loginName)
+		}
+	}
+	sort.Strings(memberNames)
+
+	i.FormState = &h.FormState{
+		Fields: map[string]*h.FieldState{
+			"members": {Value: strings.Join(memberNames, "\n")},
+		},
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/groups/" + i.TargetGroup.Name + "/members",
+		SubmitLabel: "Preview changes",
+		Fields: []h.FormField{
+			h.StaticField{
+				Value: groupMembersHelpSnippet.Render(i.TargetGroup.Name),
+			},
+			h.MultilineInputFieldSpec{
+				Name:  "members",
+				Label: "Members of this group",
+			},
+		},
+	}
+}
+
+var groupMembersPreviewSnippet = h.NewSnippet(`
+	{{- if .Added }}
+		<p>These users will be added:</p>
+		<ul class="comma-separated-list">
+			{{- range .Added }}<li><code>{{.}}</code></li>{{ end -}}
+		</ul>
+	{{- end }}
+	{{- if .Removed }}
+		<p>These users will be removed:</p>
+		<ul class="comma-separated-list">
+			{{- range .Removed }}<li><code>{{.}}</code></li>{{ end -}}
+		</ul>
+	{{- end }}
+	{{- if not (or .Added .Removed) }}
+		<p>The membership of this group will not change.</p>
+	{{- end }}
+`)
+
+// previewGroupMembersChange is a handler step for the "edit members as text"
+// form. It validates the submitted login names and, unless the user already
+// confirmed the preview, renders the form again with a list of the
+// memberships that will be added or removed.
+//
+// The confirmation checkbox carries a fingerprint of the preview, so the
+// confirmation only counts if the preview would still look the same, i.e. if
+// neither the submitted list nor the group's members changed in the meantime.
+func previewGroupMembersChange(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		isExistingUser := make(map[string]bool)
+		for _, user := range n.ListUsers() {
+			isExistingUser[user.LoginName] = true
+		}
+
+		newMembers := make(core.GroupMemberNames)
+		var unknownNames []string
+		for _, loginName := range strings.Fields(i.FormState.Fields["members"].Value) {
+			if isExistingUser[loginName] {
+				newMembers[loginName] = true
+			} else {
+				unknownNames = append(unknownNames, fmt.Sprintf("%q", loginName))
+			}
+		}
+		if len(unknownNames) > 0 {
+			i.FormState.Fields["members"].ErrorMessage = "contains unknown login names: " + strings.Join(unknownNames, ", ")
+			return
+		}
+
+		var data struct {
+			Added   []string
+			Removed []string
+		}
+		for loginName := range newMembers {
+			if !i.TargetGroup.MemberLoginNames[loginName] {
+				data.Added = append(data.Added, loginName)
+			}
+		}
+		for loginName, isMember := range i.TargetGroup.MemberLoginNames {
+			if isMember && !newMembers[loginName] {
+				data.Removed = append(data.Removed, loginName)
+			}
+		}
+		sort.Strings(data.Added)
+		sort.Strings(data.Removed)
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%q %q %q", slices.Sorted(maps.Keys(newMembers)), data.Added, data.Removed)
+		previewFingerprint := hex.EncodeToString(hash.Sum(nil)[:8])
+
+		confirmField := h.SelectFieldSpec{
+			Name:  "confirm",
+			Label: "Apply these changes?",
+			Options: []h.SelectOptionSpec{{
+				Value: previewFingerprint,
+				Label: "Yes, the changes shown above are correct",
+			}},
+		}
+		confirmField.ReadState(i.Req, i.FormState)
+		if i.FormState.Fields["confirm"].Selected[previewFingerprint] {
+			return
+		}
+
+		//the confirmation checkbox is reset to make sure that the user looks at the
+		//preview again if they change the list after the first preview
+		i.FormState.Fields["confirm"] = &h.FieldState{}
+		i.FormSpec.SubmitLabel = "Save"
+		i.FormSpec.Fields = append(i.FormSpec.Fields,
+			h.StaticField{
+				Label: "Preview",
+				Value: groupMembersPreviewSnippet.Render(data),
+			},
+			confirmField,
+		)
+		ShowForm("Edit group members")(i)
+	}
+}
+
+func executeEditGroupMembers(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	//only the members are replaced, so that changes to other fields of the
+	//group that were made since the form was rendered are kept
+	newGroup, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == i.TargetGroup.Name })
+	if !exists {
+		errs.Addf("group %q was deleted in the meantime", i.TargetGroup.Name)
+		return
+	}
+	newGroup.MemberLoginNames = make(core.GroupMemberNames)
+	for _, loginName := range strings.Fields(i.FormState.Fields["members"].Value) {
+		newGroup.MemberLoginNames[loginName] = true
+	}
+	errs.Add(db.Groups.Update(newGroup))
 	return
 }
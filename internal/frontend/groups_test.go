@@ -0,0 +1,97 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+var confirmValueRx = regexp.MustCompile(`name="confirm" value="([^"]*)"`)
+
+func TestEditGroupMembersAsText(t *testing.T) {
+	nexus, server := setupFrontend(t)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = append(db.Users, core.User{LoginName: "john", GivenName: "John", FamilyName: "Doe"})
+		db.Groups = []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"jane": true},
+				Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+			},
+			{
+				Name:             "staff",
+				LongName:         "Staff",
+				MemberLoginNames: core.GroupMemberNames{},
+			},
+		}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	getStaff := func() core.Group {
+		t.Helper()
+		group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+		return group
+	}
+
+	b := newBrowser(t, server)
+	_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+	assert.DeepEqual(t, "redirect after login", location, "/self")
+	submit := func(page, members, confirm string) (int, string) {
+		t.Helper()
+		values := url.Values{"members": {members}, "form_version": {formVersionOf(t, page)}}
+		if confirm != "" {
+			values.Set("confirm", confirm)
+		}
+		return b.SubmitPage(page, "/groups/staff/members", values)
+	}
+	confirmValueOf := func(page string) string {
+		t.Helper()
+		match := confirmValueRx.FindStringSubmatch(page)
+		if match == nil {
+			t.Fatal("no confirmation checkbox found on page")
+		}
+		return match[1]
+	}
+
+	//the first submission shows a preview
+	_, page := b.Get("/groups/staff/members")
+	status, preview := submit(page, "jane", "")
+	assert.DeepEqual(t, "status after first submission", status, http.StatusOK)
+	assert.DeepEqual(t, "preview lists added user", strings.Contains(preview, "<li><code>jane</code></li>"), true)
+
+	//if the list is edited after the preview, the confirmation does not count,
+	//and the preview is shown again
+	status, preview2 := submit(preview, "jane\njohn", confirmValueOf(preview))
+	assert.DeepEqual(t, "status after edit following preview", status, http.StatusOK)
+	assert.DeepEqual(t, "preview lists both users", strings.Contains(preview2, "<li><code>jane</code></li><li><code>john</code></li>"), true)
+	assert.DeepEqual(t, "members after edit following preview", getStaff().MemberLoginNames, core.GroupMemberNames{})
+
+	//confirming the current preview applies the change, but only to the
+	//members of the group
+	errs = nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Groups[1].LongName = "Staff members"
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	_, location = submit(preview2, "jane\njohn", confirmValueOf(preview2))
+	assert.DeepEqual(t, "redirect after confirmation", location, "/groups")
+	assert.DeepEqual(t, "members after confirmation", getStaff().MemberLoginNames, core.GroupMemberNames{"jane": true, "john": true})
+	assert.DeepEqual(t, "long name after confirmation", getStaff().LongName, "Staff members")
+}
@@ -0,0 +1,284 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+var historySnippet = h.NewSnippet(`
+	{{if .Revisions}}
+		<p>
+			These are the most recent versions of {{.ObjectType}} <code>{{.Name}}</code>, newest first. Password hashes and
+			second factors are not recorded, and are left unchanged when reverting to an earlier version.
+		</p>
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Revision</th>
+					<th>Changed</th>
+					<th>Changes</th>
+					<th class="actions"></th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Revisions}}
+					<tr>
+						<td data-label="Revision">#{{.Number}}</td>
+						{{ if .ChangedAt -}}
+							<td data-label="Changed">{{.ChangedAt}} by {{.ChangedBy}}</td>
+						{{- else -}}
+							<td data-label="Changed" class="text-muted">Before history was recorded</td>
+						{{- end }}
+						<td data-label="Changes">
+							{{if .IsDeletion}}<strong>Deleted</strong>{{end}}
+							{{range .Changes}}
+								<div><code>{{.Field}}</code>: {{.OldValue}} → {{.NewValue}}</div>
+							{{end}}
+						</td>
+						<td class="actions">
+							{{if .CanRevert}}<a href="{{$.BasePath}}/history/{{.Number}}/revert">Revert to this version</a>{{end}}
+						</td>
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{else}}
+		<p>No changes have been recorded for {{.ObjectType}} <code>{{.Name}}</code> yet.</p>
+	{{end}}
+`)
+
+// The longest JSON value that is shown in full in the history view. Longer
+// values (mostly photos and SSH keys) are abbreviated.
+const maxHistoryValueLength = 80
+
+func abbreviateHistoryValue(value string) string {
+	if len(value) <= maxHistoryValueLength {
+		return value
+	}
+	return value[:maxHistoryValueLength] + "…"
+}
+
+func renderHistory[T core.Object[T]](objectType, name, basePath string, history core.ObjectHistory[T]) template.HTML {
+	type revisionItem struct {
+		Number     uint
+		ChangedAt  string
+		ChangedBy  string
+		Changes    []core.FieldChange
+		IsDeletion bool
+		CanRevert  bool
+	}
+	var items []revisionItem
+	for idx, r := range history.Revisions {
+		item := revisionItem{
+			Number:     r.Number,
+			ChangedAt:  r.ChangedAt,
+			ChangedBy:  r.ChangedBy.String(),
+			IsDeletion: r.Object == nil,
+			//reverting to the current version would not change anything
+			CanRevert: r.Object != nil && idx != len(history.Revisions)-1,
+		}
+		if !item.IsDeletion {
+			for _, c := range history.ChangesIn(r.Number) {
+				c.OldValue = abbreviateHistoryValue(c.OldValue)
+				c.NewValue = abbreviateHistoryValue(c.NewValue)
+				item.Changes = append(item.Changes, c)
+			}
+		}
+		items = append(items, item)
+	}
+	slices.Reverse(items)
+
+	return historySnippet.Render(struct {
+		ObjectType string
+		Name       string
+		BasePath   string
+		Revisions  []revisionItem
+	}{objectType, name, basePath, items})
+}
+
+func revisionNumberFromRequest(i *Interaction) uint {
+	//the route only matches digits, so this can only fail on overflow
+	number, _ := strconv.ParseUint(mux.Vars(i.Req)["rev"], 10, 32)
+	return uint(number)
+}
+
+var revertConfirmSnippet = h.NewSnippet(`
+	<p>
+		Really revert {{.ObjectType}} <code>{{.Name}}</code> to revision #{{.Number}}?
+		The revert is recorded in the history, so it can be undone in the same way.
+	</p>
+`)
+
+func useRevertForm[T core.Object[T]](objectType, name, basePath string, history core.ObjectHistory[T], ok bool) HandlerStep {
+	return func(i *Interaction) {
+		number := revisionNumberFromRequest(i)
+		r, exists := history.FindRevision(number)
+		if !ok || !exists || r.Object == nil {
+			msg := fmt.Sprintf("Revision #%d of %s %q cannot be restored.", number, objectType, name)
+			i.RedirectWithFlashTo(basePath+"/history", Flash{"danger", msg})
+			return
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  fmt.Sprintf("%s/history/%d/revert", basePath, number),
+			SubmitLabel: "Revert " + objectType,
+			Fields: []h.FormField{
+				h.StaticField{
+					Value: revertConfirmSnippet.Render(struct {
+						ObjectType string
+						Name       string
+						Number     uint
+					}{objectType, name, number}),
+				},
+			},
+		}
+	}
+}
+
+// redirectAfterRevert is like RedirectWithFlashTo, but goes back to the
+// history of i.TargetRef.
+func redirectAfterRevert(pathPrefix string) HandlerStep {
+	return func(i *Interaction) {
+		ref := i.TargetRef
+		msg := fmt.Sprintf("Reverted %s %q to revision #%d.", ref.Type, ref.Name, revisionNumberFromRequest(i))
+		i.RedirectWithFlashTo(pathPrefix+ref.Name+"/history", Flash{"success", msg})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// user history
+
+// Handles GET /users/{uid}/history.
+func getUserHistoryHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(func(i *Interaction) Page {
+			loginName := mux.Vars(i.Req)["uid"]
+			history, _ := n.FindUserHistory(loginName)
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "History of user " + loginName,
+				Contents: renderHistory("user", loginName, "/users/"+loginName, history),
+				Wide:     true,
+			}
+		}),
+	)
+}
+
+func useRevertUserForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		loginName := mux.Vars(i.Req)["uid"]
+		i.TargetRef = core.User{LoginName: loginName}.Ref()
+		history, ok := n.FindUserHistory(loginName)
+		useRevertForm("user", loginName, "/users/"+loginName, history, ok)(i)
+	}
+}
+
+// Handles GET /users/{uid}/history/{rev}/revert.
+func getUserRevertHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useRevertUserForm(n),
+		UseEmptyFormState,
+		ShowForm("Confirm revert"),
+	)
+}
+
+// Handles POST /users/{uid}/history/{rev}/revert.
+func postUserRevertHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useRevertUserForm(n),
+		UseEmptyFormState,
+		TryUpdateNexus(n, executeRevertUser),
+		ShowFormIfErrors("Confirm revert"),
+		redirectAfterRevert("/users/"),
+	)
+}
+
+func executeRevertUser(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	errs.Add(db.RevertUser(i.TargetRef.Name, revisionNumberFromRequest(i)))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// group history
+
+// Handles GET /groups/{name}/history.
+func getGroupHistoryHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(func(i *Interaction) Page {
+			name := mux.Vars(i.Req)["name"]
+			history, _ := n.FindGroupHistory(name)
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "History of group " + name,
+				Contents: renderHistory("group", name, "/groups/"+name, history),
+				Wide:     true,
+			}
+		}),
+	)
+}
+
+func useRevertGroupForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		name := mux.Vars(i.Req)["name"]
+		i.TargetRef = core.Group{Name: name}.Ref()
+		history, ok := n.FindGroupHistory(name)
+		useRevertForm("group", name, "/groups/"+name, history, ok)(i)
+	}
+}
+
+// Handles GET /groups/{name}/history/{rev}/revert.
+func getGroupRevertHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useRevertGroupForm(n),
+		UseEmptyFormState,
+		ShowForm("Confirm revert"),
+	)
+}
+
+// Handles POST /groups/{name}/history/{rev}/revert.
+func postGroupRevertHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useRevertGroupForm(n),
+		UseEmptyFormState,
+		TryUpdateNexus(n, executeRevertGroup),
+		ShowFormIfErrors("Confirm revert"),
+		redirectAfterRevert("/groups/"),
+	)
+}
+
+func executeRevertGroup(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	errs.Add(db.RevertGroup(i.TargetRef.Name, revisionNumberFromRequest(i)))
+	return
+}
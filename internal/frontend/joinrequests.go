@@ -0,0 +1,360 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// isGroupManagerFor returns whether the given user is responsible for the
+// memberships in the given group, i.e. whether they review these memberships
+// in access reviews and decide on join requests. Admins take care of groups
+// without an owner.
+func isGroupManagerFor(user core.UserWithPerms, group core.Group) bool {
+	if group.OwnerLoginName == "" {
+		return user.Perms.Portunus.IsAdmin
+	}
+	return group.OwnerLoginName == user.LoginName
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// browsing joinable groups (for all users)
+
+func getGroupsBrowseHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		ShowView(groupsBrowseList(n)),
+	)
+}
+
+var groupsBrowseSnippet = h.NewSnippet(`
+	<p>{{T "You can request to join the following groups. Your request will be decided on by the owner of the respective group."}}</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>{{T "Name"}}</th>
+				<th>{{T "Long name"}}</th>
+				<th>{{T "Owner"}}</th>
+				<th>{{T "Notes"}}</th>
+				<th>{{T "Status"}}</th>
+				<th class="actions"></th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td data-label="{{T "Name"}}"><code>{{.Group.Name}}</code></td>
+					<td data-label="{{T "Long name"}}">{{.Group.LongName}}</td>
+					{{ if .Group.OwnerLoginName -}}
+						<td data-label="{{T "Owner"}}"><code>{{.Group.OwnerLoginName}}</code></td>
+					{{- else -}}
+						<td data-label="{{T "Owner"}}" class="text-muted">{{T "Admins"}}</td>
+					{{- end }}
+					<td data-label="{{T "Notes"}}">{{.Group.Notes}}</td>
+					<td data-label="{{T "Status"}}">{{.StatusText}}</td>
+					<td class="actions">
+						{{- if .CanRequest }}
+							<a href="/groups/{{.Group.Name}}/join">{{T "Request to join"}}</a>
+						{{- end }}
+					</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="6" class="text-muted">{{T "There are no groups that accept join requests."}}</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func groupsBrowseList(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		user := i.CurrentUser
+		l := i.Locale()
+		requests := make(map[string]core.JoinRequest)
+		for _, r := range n.ListJoinRequests() {
+			if r.LoginName == user.LoginName {
+				requests[r.GroupName] = r
+			}
+		}
+
+		type groupItem struct {
+			Group      core.Group
+			StatusText string
+			CanRequest bool
+		}
+		var data []groupItem
+		for _, group := range sortedGroups(n) {
+			if !group.IsJoinable {
+				continue
+			}
+			item := groupItem{Group: group}
+			r, hasRequest := requests[group.Name]
+			switch {
+			case group.ContainsUser(user.User):
+				item.StatusText = l.T("Member")
+			case !hasRequest:
+				item.CanRequest = true
+			case r.State == core.JoinRequestPending:
+				item.StatusText = l.Tf("Requested on %s", r.RequestedAt)
+			case r.State == core.JoinRequestRejected:
+				item.StatusText = l.Tf("Request rejected on %s", r.DecidedAt)
+				item.CanRequest = true
+			default:
+				//approved, but the membership was removed again afterwards
+				item.CanRequest = true
+			}
+			data = append(data, item)
+		}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Browse groups",
+			Contents: groupsBrowseSnippet.RenderIn(l, data),
+			Wide:     true,
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// requesting to join a group
+
+func loadJoinableGroup(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		groupName := mux.Vars(i.Req)["name"]
+		group, exists := n.FindGroup(func(g core.Group) bool { return g.Name == groupName })
+		if exists && group.IsJoinable {
+			i.TargetGroup = &group
+			i.TargetRef = group.Ref()
+		} else {
+			msg := i.Locale().Tf("Group %q does not accept join requests.", groupName)
+			i.RedirectWithFlashTo("/groups/browse", Flash{"danger", msg})
+		}
+	}
+}
+
+var joinRequestGroupSnippet = h.NewSnippet(`
+	{{.LongName}} (<code>{{.Name}}</code>)
+`)
+
+func useJoinRequestForm(i *Interaction) {
+	group := *i.TargetGroup
+	i.FormState = &h.FormState{
+		Fields: map[string]*h.FieldState{},
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/groups/" + group.Name + "/join",
+		SubmitLabel: "Send request",
+		Fields: []h.FormField{
+			h.StaticField{
+				Label: "Group",
+				Value: joinRequestGroupSnippet.Render(group),
+			},
+			h.MultilineInputFieldSpec{
+				Name:  "comment",
+				Label: "Why do you need to be in this group? (optional)",
+			},
+		},
+	}
+}
+
+func getGroupJoinHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		loadJoinableGroup(n),
+		useJoinRequestForm,
+		ShowForm("Request to join group"),
+	)
+}
+
+func postGroupJoinHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		loadJoinableGroup(n),
+		useJoinRequestForm,
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeJoinRequest),
+		ShowFormIfErrors("Request to join group"),
+		RedirectWithFlashTo("/groups/browse", "Requested membership in"),
+	)
+}
+
+func executeJoinRequest(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	//<textarea> contents are prone to have trailing newlines, which we do not care about
+	comment := strings.TrimSpace(i.FormState.Fields["comment"].Value)
+	errs.Add(db.RequestGroupJoin(i.TargetGroup.Name, i.CurrentUser.LoginName, comment, time.Now()))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// deciding on join requests (for group managers)
+
+// listPendingJoinRequests returns the pending join requests for all groups
+// managed by the given user, grouped by group.
+func listPendingJoinRequests(n core.Nexus, user core.UserWithPerms) (groups []core.Group, requests map[string][]core.JoinRequest) {
+	requests = make(map[string][]core.JoinRequest)
+	for _, r := range n.ListJoinRequests() {
+		if r.State == core.JoinRequestPending {
+			requests[r.GroupName] = append(requests[r.GroupName], r)
+		}
+	}
+	for _, group := range sortedGroups(n) {
+		if len(requests[group.Name]) > 0 && isGroupManagerFor(user, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups, requests
+}
+
+var joinRequestSnippet = h.NewSnippet(`
+	<code>{{.Request.LoginName}}</code> ({{.FullName}}) on {{.Request.RequestedAt}}
+	{{- if .Request.Comment }}: <em>{{.Request.Comment}}</em>{{ end }}
+`)
+
+var noJoinRequestsSnippet = h.NewSnippet(`
+	<p>There are no pending requests to join any of the groups that you manage.</p>
+`)
+
+func useJoinRequestsDecisionForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		i.FormState = &h.FormState{
+			Fields: map[string]*h.FieldState{},
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/groups/requests",
+			SubmitLabel: "Submit decisions",
+		}
+
+		fullNames := make(map[string]string)
+		for _, user := range n.ListUsers() {
+			fullNames[user.LoginName] = user.FullName()
+		}
+
+		groups, requests := listPendingJoinRequests(n, *i.CurrentUser)
+		for _, group := range groups {
+			var (
+				fields []h.FormField
+				opts   []h.SelectOptionSpec
+			)
+			for _, r := range requests[group.Name] {
+				data := struct {
+					Request  core.JoinRequest
+					FullName string
+				}{r, fullNames[r.LoginName]}
+				fields = append(fields, h.StaticField{Value: joinRequestSnippet.Render(data)})
+				opts = append(opts, h.SelectOptionSpec{
+					Value: r.LoginName,
+					Label: r.LoginName,
+				})
+			}
+			fields = append(fields,
+				h.SelectFieldSpec{
+					Name:    "approve:" + group.Name,
+					Label:   "Approve requests from",
+					Options: opts,
+				},
+				h.SelectFieldSpec{
+					Name:    "reject:" + group.Name,
+					Label:   "Reject requests from",
+					Options: opts,
+				},
+			)
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.FieldSet{
+				Label:      fmt.Sprintf("%s (%s)", group.LongName, group.Name),
+				IsFoldable: false,
+				Fields:     fields,
+			})
+		}
+
+		if len(i.FormSpec.Fields) == 0 {
+			i.FormSpec.Fields = []h.FormField{
+				h.StaticField{Value: noJoinRequestsSnippet.Render(nil)},
+			}
+		}
+	}
+}
+
+func getJoinRequestsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useJoinRequestsDecisionForm(n),
+		ShowForm("Join requests"),
+	)
+}
+
+func postJoinRequestsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useJoinRequestsDecisionForm(n),
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeJoinRequestDecisions(n)),
+		ShowFormIfErrors("Join requests"),
+		func(i *Interaction) {
+			i.RedirectWithFlashTo("/groups/requests", Flash{"success", "Submitted decisions."})
+		},
+	)
+}
+
+func executeJoinRequestDecisions(n core.Nexus) func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet {
+	return func(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+		now := time.Now()
+		groups, requests := listPendingJoinRequests(n, *i.CurrentUser)
+		for _, group := range groups {
+			approveState := i.FormState.Fields["approve:"+group.Name]
+			rejectState := i.FormState.Fields["reject:"+group.Name]
+			if approveState == nil || rejectState == nil {
+				//group was not shown on the form that was submitted
+				continue
+			}
+			for _, r := range requests[group.Name] {
+				isApproved := approveState.Selected[r.LoginName]
+				isRejected := rejectState.Selected[r.LoginName]
+				switch {
+				case isApproved && isRejected:
+					errs.Addf("cannot both approve and reject the request of user %q to join group %q", r.LoginName, group.Name)
+				case isApproved:
+					errs.Add(db.DecideJoinRequest(group.Name, r.LoginName, core.JoinRequestApproved, i.CurrentUser.LoginName, now))
+				case isRejected:
+					errs.Add(db.DecideJoinRequest(group.Name, r.LoginName, core.JoinRequestRejected, i.CurrentUser.LoginName, now))
+				}
+			}
+		}
+		return errs
+	}
+}
+
+var joinRequestNoticeSnippet = h.NewSnippet(`
+	<div class="flash flash-warning">
+		{{T "There are %d pending request(s) to join groups that you manage:" .}}
+		<a href="/groups/requests">{{T "Go to requests"}}</a>
+	</div>
+`)
+
+func buildJoinRequestNotices(n core.Nexus, user core.UserWithPerms, l i18n.Locale) []h.FormField {
+	groups, requests := listPendingJoinRequests(n, user)
+	count := 0
+	for _, group := range groups {
+		count += len(requests[group.Name])
+	}
+	if count == 0 {
+		return nil
+	}
+	return []h.FormField{h.StaticField{Value: joinRequestNoticeSnippet.RenderIn(l, count)}}
+}
@@ -0,0 +1,71 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// The user and group lists can be filtered by labels with one or more
+// "?label=key=value" or "?label=key" query parameters (see core.Labels.Matches).
+func labelSelectorsFromRequest(i *Interaction) []string {
+	var result []string
+	for _, selector := range i.Req.URL.Query()["label"] {
+		selector = strings.TrimSpace(selector)
+		if selector != "" {
+			result = append(result, selector)
+		}
+	}
+	return result
+}
+
+var labelFilterSnippet = h.NewSnippet(`
+	<div class="flash flash-primary">
+		Showing only {{.ObjectType}} with
+		{{- range $idx, $sel := .Selectors }}{{ if $idx }} and{{ end }} label <code>{{$sel}}</code>{{ end -}}
+		. <a href="{{.ListURL}}">Show all {{.ObjectType}}</a>
+	</div>
+`)
+
+// Renders a notice about the active label filter, or nothing if the list is
+// not filtered.
+func renderLabelFilterNotice(selectors []string, objectType, listURL string) template.HTML {
+	if len(selectors) == 0 {
+		return ""
+	}
+	return labelFilterSnippet.Render(struct {
+		Selectors  []string
+		ObjectType string
+		ListURL    string
+	}{selectors, objectType, listURL})
+}
+
+// Each label in a list view links to the same list filtered by that label.
+var labelListSnippet = h.NewSnippet(`
+	{{- range .Lines -}}
+		<a href="{{$.ListURL}}?label={{.}}"><code>{{.}}</code></a><span class="comma">,&nbsp;</span>
+	{{- end -}}
+`)
+
+func renderLabelList(labels core.Labels, listURL string) template.HTML {
+	return labelListSnippet.Render(struct {
+		Lines   []string
+		ListURL string
+	}{labels.Lines(), listURL})
+}
+
+func buildLabelsField(labels core.Labels, state *h.FormState) h.FormField {
+	state.Fields["labels"] = &h.FieldState{Value: strings.Join(labels.Lines(), "\r\n")}
+	return h.MultilineInputFieldSpec{
+		Name:  "labels",
+		Label: "Labels (optional, one \"key=value\" per line)",
+	}
+}
@@ -0,0 +1,89 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// The last login name is not secret (it is shown in the login form in
+// plain text anyway), so it lives in its own cookie that outlives the session.
+const (
+	lastLoginNameCookieName   = "portunus-last-login-name"
+	lastLoginNameCookieMaxAge = 365 * 24 * time.Hour
+)
+
+// lastLoginNameCookie describes how the cookie for the last login name is
+// handled, as configured through HandlerOptions.
+type lastLoginNameCookie struct {
+	Enabled bool
+	Secure  bool
+}
+
+func (c lastLoginNameCookie) make(value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     lastLoginNameCookieName,
+		Value:    url.QueryEscape(value),
+		Path:     "/login",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Returns the empty string if there is no valid cookie, or if the feature is
+// disabled.
+func (c lastLoginNameCookie) read(r *http.Request) string {
+	if !c.Enabled {
+		return ""
+	}
+	cookie, err := r.Cookie(lastLoginNameCookieName)
+	if err != nil {
+		return ""
+	}
+	value, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// Called by completeLogin().
+func (c lastLoginNameCookie) remember(i *Interaction, loginName string) {
+	if c.Enabled {
+		http.SetCookie(i.writer, c.make(loginName, lastLoginNameCookieMaxAge))
+	}
+}
+
+// prefillLastLoginName is a handler step for GET /login that puts the
+// remembered login name into the login form. When the feature has been
+// disabled, cookies left over from before are deleted, since the point of
+// disabling it is usually that the browser is shared by multiple people.
+func prefillLastLoginName(c lastLoginNameCookie) HandlerStep {
+	return func(i *Interaction) {
+		if !c.Enabled {
+			_, err := i.Req.Cookie(lastLoginNameCookieName)
+			if err == nil {
+				http.SetCookie(i.writer, c.make("", -1))
+			}
+			return
+		}
+
+		loginName := c.read(i.Req)
+		if loginName != "" {
+			if i.FormState.Fields == nil {
+				i.FormState.Fields = make(map[string]*h.FieldState)
+			}
+			i.FormState.Fields["user_ident"] = &h.FieldState{Value: loginName}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestRememberLastLoginName(t *testing.T) {
+	_, rememberingServer := setupFrontendWithOptions(t, HandlerOptions{RememberLoginName: true})
+	//the setting applies per handler, even when there are several in one process
+	_, forgettingServer := setupFrontend(t)
+
+	loginAndLogout := func(b *browser) {
+		t.Helper()
+		_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+		assert.DeepEqual(t, "redirect after login", location, "/self")
+		_, location = b.Submit("/logout", url.Values{})
+		assert.DeepEqual(t, "redirect after logout", location, "/login")
+	}
+
+	b := newBrowser(t, rememberingServer)
+	loginAndLogout(b)
+	_, body := b.Get("/login")
+	assert.DeepEqual(t, "login name is prefilled", strings.Contains(body, `value="jane"`), true)
+
+	b = newBrowser(t, forgettingServer)
+	loginAndLogout(b)
+	_, body = b.Get("/login")
+	assert.DeepEqual(t, "login name is prefilled", strings.Contains(body, `value="jane"`), false)
+}
@@ -0,0 +1,256 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// Large list views (like the user list) are searched, sorted and paginated on
+// the server side. All of this is controlled through query parameters, so
+// that each state of the list can be bookmarked:
+//
+//   - "q" is a search term that is matched against some of the columns.
+//   - "sort" is the key of the column to sort by, and "order=desc" reverses
+//     the sort order.
+//   - "page" is the 1-based number of the page to show.
+//   - "filter" selects one of the predefined filters of the list view, and
+//     can be given multiple times.
+//   - "label" is the label filter (see labelSelectorsFromRequest).
+
+// How many items are shown on each page of a list view.
+const listPageSize = 50
+
+type listQuery struct {
+	BasePath   string
+	Search     string
+	SortKey    string
+	Descending bool
+	Page       int
+	Filters    []string
+	Labels     []string
+}
+
+// listFilter is a predefined filter for a list view, which is shown as a
+// checkbox next to the search box.
+type listFilter struct {
+	Key   string
+	Label string
+}
+
+// Reads the listQuery for the list view at the given path. Unknown sort keys
+// are replaced by the first of the given sort keys, and unknown filters are
+// ignored.
+func listQueryFromRequest(i *Interaction, basePath string, sortKeys []string, filters ...listFilter) listQuery {
+	query := i.Req.URL.Query()
+	q := listQuery{
+		BasePath:   basePath,
+		Search:     strings.TrimSpace(query.Get("q")),
+		SortKey:    query.Get("sort"),
+		Descending: query.Get("order") == "desc",
+		Labels:     labelSelectorsFromRequest(i),
+	}
+	if !slices.Contains(sortKeys, q.SortKey) {
+		q.SortKey = sortKeys[0]
+	}
+	for _, f := range filters {
+		if slices.Contains(query["filter"], f.Key) {
+			q.Filters = append(q.Filters, f.Key)
+		}
+	}
+	q.Page, _ = strconv.Atoi(query.Get("page"))
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	return q
+}
+
+// URL returns the URL for this state of the list view. Default values are
+// left out to keep the URLs short.
+func (q listQuery) URL() string {
+	values := url.Values{}
+	if q.Search != "" {
+		values.Set("q", q.Search)
+	}
+	if q.SortKey != "" {
+		values.Set("sort", q.SortKey)
+	}
+	if q.Descending {
+		values.Set("order", "desc")
+	}
+	if q.Page > 1 {
+		values.Set("page", strconv.Itoa(q.Page))
+	}
+	for _, key := range q.Filters {
+		values.Add("filter", key)
+	}
+	for _, selector := range q.Labels {
+		values.Add("label", selector)
+	}
+	if len(values) == 0 {
+		return q.BasePath
+	}
+	return q.BasePath + "?" + values.Encode()
+}
+
+// MatchesSearch returns whether any of the given strings contains the
+// search term (ignoring case). If there is no search term, everything
+// matches.
+func (q listQuery) MatchesSearch(values ...string) bool {
+	if q.Search == "" {
+		return true
+	}
+	needle := strings.ToLower(q.Search)
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// formerNamesListFilter extends the search of a list view to the names that
+// users or groups had before they were renamed (see MatchesFormerNames).
+var formerNamesListFilter = listFilter{"former_names", "Also search former names"}
+
+// MatchesFormerNames is like MatchesSearch, but for the former names of a user
+// or group. They are only searched if formerNamesListFilter is active.
+func (q listQuery) MatchesFormerNames(names []core.FormerName) bool {
+	if q.Search == "" || !q.HasFilter(formerNamesListFilter.Key) {
+		return false
+	}
+	values := make([]string, len(names))
+	for idx, n := range names {
+		values[idx] = n.Name
+	}
+	return q.MatchesSearch(values...)
+}
+
+// HasFilter returns whether the filter with the given key is active.
+func (q listQuery) HasFilter(key string) bool {
+	return slices.Contains(q.Filters, key)
+}
+
+// listSortFunc wraps a comparison function for use with slices.SortFunc,
+// reversing it if the list is sorted in descending order.
+func listSortFunc[T any](q listQuery, cmp func(a, b T) int) func(a, b T) int {
+	if q.Descending {
+		return func(a, b T) int { return cmp(b, a) }
+	}
+	return cmp
+}
+
+var listSortHeaderSnippet = h.NewSnippet(`
+	<a href="{{.URL}}">{{.Label}}</a>{{if .IsActive}}&nbsp;{{if .Descending}}▼{{else}}▲{{end}}{{end}}
+`)
+
+// Renders a column header that sorts the list by the given key when clicked.
+// Clicking the header of the active sort column reverses the sort order.
+func (q listQuery) RenderSortHeader(label, sortKey string) template.HTML {
+	target := q
+	target.SortKey = sortKey
+	target.Descending = q.SortKey == sortKey && !q.Descending
+	target.Page = 1
+	return listSortHeaderSnippet.Render(struct {
+		URL        string
+		Label      string
+		IsActive   bool
+		Descending bool
+	}{target.URL(), label, q.SortKey == sortKey, q.Descending})
+}
+
+var listSearchSnippet = h.NewSnippet(`
+	<form method="GET" action="{{.Query.BasePath}}" class="list-search">
+		<div class="button-row">
+			<input type="search" name="q" value="{{.Query.Search}}" placeholder="{{.Placeholder}}" aria-label="Search">
+			{{- range .Query.Labels }}
+				<input type="hidden" name="label" value="{{.}}">
+			{{- end }}
+			<input type="hidden" name="sort" value="{{.Query.SortKey}}">
+			{{- if .Query.Descending }}
+				<input type="hidden" name="order" value="desc">
+			{{- end }}
+			{{- range .Filters }}
+				<label><input type="checkbox" name="filter" value="{{.Key}}" {{if $.Query.HasFilter .Key}}checked{{end}}> {{.Label}}</label>
+			{{- end }}
+			<button type="submit" class="button button-secondary">Search</button>
+			{{- if or .Query.Search .Query.Filters }}
+				<a href="{{.ClearURL}}" class="button button-secondary">Clear search</a>
+			{{- end }}
+		</div>
+	</form>
+`)
+
+// Renders the search box for this list view, with checkboxes for the given
+// filters. Searching goes back to the first page, but keeps the sort order
+// and the label filter.
+func (q listQuery) RenderSearchBox(placeholder string, filters ...listFilter) template.HTML {
+	cleared := q
+	cleared.Search = ""
+	cleared.Filters = nil
+	cleared.Page = 1
+	return listSearchSnippet.Render(struct {
+		Query       listQuery
+		Placeholder string
+		Filters     []listFilter
+		ClearURL    string
+	}{q, placeholder, filters, cleared.URL()})
+}
+
+var listPaginationSnippet = h.NewSnippet(`
+	{{- if .TotalCount -}}
+		<p class="list-pagination">
+			Showing {{.ObjectType}} {{.First}}–{{.Last}} of {{.TotalCount}}.
+			{{- if gt .PageCount 1 }}
+				{{ if .PrevURL }}<a href="{{.PrevURL}}">« Previous</a>{{ else }}<span class="text-muted">« Previous</span>{{ end }}
+				· Page {{.Page}} of {{.PageCount}} ·
+				{{ if .NextURL }}<a href="{{.NextURL}}">Next »</a>{{ else }}<span class="text-muted">Next »</span>{{ end }}
+			{{- end }}
+		</p>
+	{{- else -}}
+		<p class="list-pagination text-muted">No {{.ObjectType}} found.</p>
+	{{- end -}}
+`)
+
+// paginateList returns the items on the current page of the list, and the
+// pagination controls for the list. If the requested page is past the end
+// of the list, the last page is shown instead.
+func paginateList[T any](q *listQuery, items []T, objectType string) ([]T, template.HTML) {
+	pageCount := max(1, (len(items)+listPageSize-1)/listPageSize)
+	q.Page = min(q.Page, pageCount)
+	first := (q.Page - 1) * listPageSize
+	last := min(first+listPageSize, len(items))
+
+	data := struct {
+		ObjectType string
+		First      int
+		Last       int
+		TotalCount int
+		Page       int
+		PageCount  int
+		PrevURL    string
+		NextURL    string
+	}{objectType, first + 1, last, len(items), q.Page, pageCount, "", ""}
+	if q.Page > 1 {
+		prev := *q
+		prev.Page--
+		data.PrevURL = prev.URL()
+	}
+	if q.Page < pageCount {
+		next := *q
+		next.Page++
+		data.NextURL = next.URL()
+	}
+	return items[first:last], listPaginationSnippet.Render(data)
+}
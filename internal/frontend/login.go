@@ -7,43 +7,66 @@
 package frontend
 
 import (
+	"encoding/hex"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/majewsky/portunus/internal/audit"
 	"github.com/majewsky/portunus/internal/core"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/risk"
 	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
 )
 
-func useLoginForm(i *Interaction) {
-	i.FormSpec = &h.FormSpec{
-		PostTarget:  "/login",
-		SubmitLabel: "Login",
-		Fields: []h.FormField{
-			h.InputFieldSpec{
-				InputType:        "text",
-				Name:             "user_ident",
-				Label:            "Login name or email address",
-				AutoFocus:        true,
-				AutocompleteMode: "on",
-			},
-			h.InputFieldSpec{
-				InputType:        "password",
-				Name:             "password",
-				Label:            "Password",
-				AutocompleteMode: "on",
+// loginFormOptions contains the parts of HandlerOptions that concern the
+// login form.
+type loginFormOptions struct {
+	Message       string //from SiteInfo.LoginMessage
+	LastLoginName lastLoginNameCookie
+}
+
+func useLoginForm(opts loginFormOptions) HandlerStep {
+	return func(i *Interaction) {
+		//if the login name is prefilled, the user will want to type their password next
+		hasLastLoginName := opts.LastLoginName.read(i.Req) != ""
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/login",
+			SubmitLabel: "Login",
+			Fields: []h.FormField{
+				h.InputFieldSpec{
+					InputType:        "text",
+					Name:             "user_ident",
+					Label:            "Login name or email address",
+					AutoFocus:        !hasLastLoginName,
+					AutocompleteMode: "on",
+				},
+				h.InputFieldSpec{
+					InputType:        "password",
+					Name:             "password",
+					Label:            "Password",
+					AutoFocus:        hasLastLoginName,
+					AutocompleteMode: "on",
+				},
 			},
-		},
+		}
+		if opts.Message != "" {
+			i.FormSpec.Fields = append([]h.FormField{loginMessageField{opts.Message}}, i.FormSpec.Fields...)
+		}
 	}
 }
 
 // Handles GET /login.
-func getLoginHandler(n core.Nexus) http.Handler {
+func getLoginHandler(n core.Nexus, formOpts loginFormOptions) http.Handler {
 	return Do(
 		LoadSession,
 		skipLoginIfAlreadyLoggedIn(n),
-		useLoginForm,
+		useLoginForm(formOpts),
 		UseEmptyFormState,
+		prefillLastLoginName(formOpts.LastLoginName),
 		ShowForm("Login"),
 	)
 }
@@ -51,8 +74,8 @@ func getLoginHandler(n core.Nexus) http.Handler {
 func skipLoginIfAlreadyLoggedIn(n core.Nexus) HandlerStep {
 	return func(i *Interaction) {
 		if uid, ok := i.Session.Values["uid"].(string); ok {
-			_, exists := n.FindUser(func(u core.User) bool { return u.LoginName == uid })
-			if exists {
+			user, exists := n.FindUser(func(u core.User) bool { return u.LoginName == uid })
+			if exists && !user.Disabled {
 				i.RedirectTo("/self")
 			}
 		}
@@ -60,19 +83,20 @@ func skipLoginIfAlreadyLoggedIn(n core.Nexus) HandlerStep {
 }
 
 // Handles POST /login.
-func postLoginHandler(n core.Nexus) http.Handler {
+func postLoginHandler(n core.Nexus, secLog securityEventLog, riskProvider risk.Provider, trustedDevices trustedDeviceCookie, requireHTTPS bool, formOpts loginFormOptions) http.Handler {
 	return Do(
 		LoadSession,
-		useLoginForm,
+		useLoginForm(formOpts),
 		ReadFormStateFromRequest,
-		checkLogin(n),
+		refuseLoginWithoutHTTPS(requireHTTPS),
+		checkLogin(n, secLog, riskProvider, trustedDevices, formOpts.LastLoginName),
 		ShowFormIfErrors("Login"),
 		SaveSession,
 		RedirectTo("/self"),
 	)
 }
 
-func checkLogin(n core.Nexus) HandlerStep {
+func checkLogin(n core.Nexus, secLog securityEventLog, riskProvider risk.Provider, trustedDevices trustedDeviceCookie, lastLoginName lastLoginNameCookie) HandlerStep {
 	return func(i *Interaction) {
 		fs := i.FormState
 		userIdent := fs.Fields["user_ident"].GetValueOrSetError() //either uid or email address
@@ -92,36 +116,357 @@ func checkLogin(n core.Nexus) HandlerStep {
 				passwordHash = user.PasswordHash
 			}
 
+			//this is checked before the password, so that blocked clients cannot
+			//even try to guess passwords
+			assessment := assessLoginRisk(riskProvider, i.Req, userIdent)
+			if assessment.Level == risk.LevelDeny {
+				fs.ErrorMessages = append(fs.ErrorMessages, "Logins from your network are not permitted at this time. Please contact your administrators if this persists.")
+				if exists {
+					recordLoginBlocked(secLog, i.Req, user.User, assessment)
+				}
+				return
+			}
+
 			hasher := n.PasswordHasher()
 			if !hasher.CheckPasswordHash(pwd, passwordHash) {
 				fs.Fields["password"].ErrorMessage = "is not valid (or the user account does not exist)"
+				if exists {
+					recordSecurityEvent(secLog, i.Req, audit.Event{
+						Type:    audit.EventLoginFailed,
+						Actor:   core.Actor{Type: core.ActorTypeUser, Name: user.LoginName},
+						Subject: user.LoginName,
+						Message: "failed login attempt with wrong password",
+					})
+				}
 				return
 			}
-			i.Session.Values["uid"] = user.LoginName
 
+			//this is checked after the password, so that the existence of disabled
+			//accounts is not revealed to people who do not know their password
+			if user.Disabled {
+				fs.ErrorMessages = append(fs.ErrorMessages, "Your account is disabled. Please contact your administrators.")
+				recordSecurityEvent(secLog, i.Req, audit.Event{
+					Type:    audit.EventLoginFailed,
+					Actor:   core.Actor{Type: core.ActorTypeUser, Name: user.LoginName},
+					Subject: user.LoginName,
+					Message: "failed login attempt for disabled account",
+				})
+				return
+			}
+
+			var rehashErrs errext.ErrorSet
 			if hasher.IsWeakHash(passwordHash) {
 				//since the last login of this user, the hasher started preferring a different method
 				//-> we do have the user password right now, so we can rehash it transparently
 				newPasswordHash := hasher.HashPassword(pwd)
-				errs := n.Update(func(db *core.Database) (errs errext.ErrorSet) {
+				rehashErrs = n.Update(func(db *core.Database) (errs errext.ErrorSet) {
 					for idx, dbUser := range db.Users {
 						if dbUser.LoginName == user.LoginName && dbUser.PasswordHash == passwordHash {
 							db.Users[idx].PasswordHash = newPasswordHash
 						}
 					}
 					return
-				}, nil)
-				if !errs.IsEmpty() {
-					i.RedirectWithFlashTo("/self", Flash{"danger", errs.Join(", ")})
+				}, &core.UpdateOptions{
+					Actor:    core.Actor{Type: core.ActorTypeUser, Name: user.LoginName},
+					IsRehash: true,
+				})
+			}
+
+			//users with a second factor always need to enter a code, unless they asked
+			//us to trust this browser (which is overruled by the login risk check)
+			needsTOTP := user.TOTPKeyURL != "" && !trustedDevices.isTrusted(i.Req, user.User)
+			if assessment.Level == risk.LevelChallenge {
+				if user.TOTPKeyURL == "" {
+					fs.ErrorMessages = append(fs.ErrorMessages, "Logins from your network require two-factor authentication, but your account does not have an authenticator app set up. Please contact your administrators.")
+					recordLoginBlocked(secLog, i.Req, user.User, assessment)
 					return
 				}
+				needsTOTP = true
+			}
+			if needsTOTP {
+				if !rehashErrs.IsEmpty() {
+					logg.Error("could not rehash password of user %q: %s", user.LoginName, rehashErrs.Join(", "))
+				}
+				i.Session.Values["pending_login_id"] = startPendingLogin(user.LoginName, assessment)
+				if i.SaveSession() {
+					i.RedirectTo("/login/verify")
+				}
+				return
+			}
+
+			var details map[string]string
+			if user.TOTPKeyURL != "" {
+				details = map[string]string{"verification": "trusted_device"}
+			}
+			completeLogin(i, secLog, lastLoginName, user.LoginName, details)
+			if !rehashErrs.IsEmpty() {
+				i.RedirectWithFlashTo("/self", Flash{"danger", rehashErrs.Join(", ")})
+			}
+		}
+	}
+}
+
+// completeLogin marks the session as logged in. Additional details about how
+// the login happened can be given for the audit log.
+func completeLogin(i *Interaction, secLog securityEventLog, lastLoginName lastLoginNameCookie, loginName string, details map[string]string) {
+	i.Session.Values["uid"] = loginName
+	markSessionLogin(i.Session, time.Now())
+	lastLoginName.remember(i, loginName)
+	recordSecurityEvent(secLog, i.Req, audit.Event{
+		Type:    audit.EventLogin,
+		Actor:   core.Actor{Type: core.ActorTypeUser, Name: loginName},
+		Subject: loginName,
+		Message: "successful login",
+		Details: details,
+	})
+}
+
+func assessLoginRisk(provider risk.Provider, r *http.Request, userIdent string) risk.Assessment {
+	if provider == nil {
+		return risk.Assessment{Level: risk.LevelAllow}
+	}
+	//If the client address cannot be parsed (this should not happen outside of
+	//tests), the providers see an invalid address, which only a webhook can
+	//make sense of.
+	addr, _ := netip.ParseAddr(clientAddressOf(r))
+	//Chain never returns errors
+	assessment, _ := provider.AssessLogin(r.Context(), risk.LoginAttempt{
+		ClientAddress: addr,
+		UserAgent:     r.UserAgent(),
+		UserIdent:     userIdent,
+	})
+	if assessment.Level != risk.LevelAllow {
+		logg.Info("login risk check for %q from %s: %s (%s)", userIdent, addr, assessment.Level, assessment.Reason)
+	}
+	return assessment
+}
+
+func recordLoginBlocked(secLog securityEventLog, r *http.Request, user core.User, assessment risk.Assessment) {
+	recordSecurityEvent(secLog, r, audit.Event{
+		Type:    audit.EventLoginBlocked,
+		Actor:   core.Actor{Type: core.ActorTypeUser, Name: user.LoginName},
+		Subject: user.LoginName,
+		Message: "login attempt was blocked by the login risk check",
+		Details: map[string]string{"risk_reason": assessment.Reason},
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// step-up verification
+
+// Users with two-factor authentication, as well as all users when the login
+// risk check asks for additional verification, have to enter a code from their
+// authenticator app on /login/verify after the password was accepted. In
+// between, the pending login is only held in memory and referenced by a random
+// ID in the session. Any wrong code discards the pending login, so guessing
+// codes requires entering the password every time.
+
+const pendingLoginTimeout = 5 * time.Minute
+
+type pendingLogin struct {
+	LoginName string
+	//Only set if the login risk check asked for additional verification.
+	IsRiskChallenge bool
+	RiskReason      string
+	StartedAt       time.Time
+}
+
+var (
+	//key = random ID that is stored in the session
+	pendingLogins      = make(map[string]pendingLogin)
+	pendingLoginsMutex sync.Mutex
+)
+
+func startPendingLogin(loginName string, assessment risk.Assessment) string {
+	id := hex.EncodeToString(core.GenerateRandomKey(16))
+	now := time.Now()
+
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	for otherID, other := range pendingLogins {
+		if now.Sub(other.StartedAt) > pendingLoginTimeout {
+			delete(pendingLogins, otherID)
+		}
+	}
+	isChallenge := assessment.Level == risk.LevelChallenge
+	p := pendingLogin{LoginName: loginName, IsRiskChallenge: isChallenge, StartedAt: now}
+	if isChallenge {
+		p.RiskReason = assessment.Reason
+	}
+	pendingLogins[id] = p
+	return id
+}
+
+// Removes the pending login with the given ID, and returns it if it has not
+// expired yet.
+func takePendingLogin(id string) (pendingLogin, bool) {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	p, exists := pendingLogins[id]
+	delete(pendingLogins, id)
+	if !exists || time.Since(p.StartedAt) > pendingLoginTimeout {
+		return pendingLogin{}, false
+	}
+	return p, true
+}
+
+func findPendingLogin(id string) (pendingLogin, bool) {
+	pendingLoginsMutex.Lock()
+	defer pendingLoginsMutex.Unlock()
+	p, exists := pendingLogins[id]
+	if !exists || time.Since(p.StartedAt) > pendingLoginTimeout {
+		return pendingLogin{}, false
+	}
+	return p, true
+}
+
+func loadPendingLogin(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		id, _ := i.Session.Values["pending_login_id"].(string)
+		p, exists := findPendingLogin(id)
+		if exists {
+			var user core.UserWithPerms
+			user, exists = n.FindUser(func(u core.User) bool { return u.LoginName == p.LoginName })
+			if exists && !user.Disabled {
+				i.TargetUser = &user.User
+				i.pendingLogin = &p
+				return
 			}
 		}
+		delete(i.Session.Values, "pending_login_id")
+		i.RedirectWithFlashTo("/login", Flash{"danger", "Your login attempt has expired. Please log in again."})
 	}
 }
 
+var loginVerifyIntroSnippet = h.NewSnippet(`
+	<p>
+		{{- if . -}}
+			{{T "For logins from your current network, we need to verify that it is really you."}}
+		{{- else -}}
+			{{T "Two-factor authentication is enabled for your account."}}
+		{{- end }}
+		{{T "Please enter the current code from your authenticator app."}}
+	</p>
+`)
+
+func useLoginVerifyForm(i *Interaction) {
+	fields := []h.FormField{
+		h.StaticField{
+			Value: loginVerifyIntroSnippet.RenderIn(i.Locale(), i.pendingLogin.IsRiskChallenge),
+		},
+		h.InputFieldSpec{
+			InputType:        "text",
+			Name:             "totp_code",
+			Label:            "Code from authenticator app",
+			AutoFocus:        true,
+			AutocompleteMode: "one-time-code",
+		},
+	}
+	//trusting the browser would not help when the login risk check asks again next time
+	if !i.pendingLogin.IsRiskChallenge {
+		fields = append(fields, h.SelectFieldSpec{
+			Name: "trust_device",
+			Options: []h.SelectOptionSpec{{
+				Value: "yes",
+				Label: i.Locale().Tf("Do not ask again in this browser for %d days", int(trustedDeviceDuration/(24*time.Hour))),
+			}},
+		})
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/login/verify",
+		SubmitLabel: "Verify",
+		Fields:      fields,
+	}
+}
+
+// Handles GET /login/verify.
+func getLoginVerifyHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		loadPendingLogin(n),
+		useLoginVerifyForm,
+		UseEmptyFormState,
+		ShowForm("Verify login"),
+	)
+}
+
+// Handles POST /login/verify.
+func postLoginVerifyHandler(n core.Nexus, secLog securityEventLog, trustedDevices trustedDeviceCookie, lastLoginName lastLoginNameCookie) http.Handler {
+	return Do(
+		LoadSession,
+		loadPendingLogin(n),
+		useLoginVerifyForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			id, _ := i.Session.Values["pending_login_id"].(string)
+			delete(i.Session.Values, "pending_login_id")
+			p, exists := takePendingLogin(id)
+			if !exists {
+				i.RedirectWithFlashTo("/login", Flash{"danger", "Your login attempt has expired. Please log in again."})
+				return
+			}
+
+			code := i.FormState.Fields["totp_code"].Value
+			if !isValidTOTPCode(i.TargetUser.TOTPKeyURL, code) {
+				recordSecurityEvent(secLog, i.Req, audit.Event{
+					Type:    audit.EventLoginFailed,
+					Actor:   core.Actor{Type: core.ActorTypeUser, Name: p.LoginName},
+					Subject: p.LoginName,
+					Message: "failed login attempt with wrong two-factor authentication code",
+				})
+				i.RedirectWithFlashTo("/login", Flash{"danger", "The code was not correct. Please log in again."})
+				return
+			}
+			details := map[string]string{"verification": "totp"}
+			if p.IsRiskChallenge {
+				details["risk_reason"] = p.RiskReason
+			} else if i.FormState.Fields["trust_device"].Selected["yes"] {
+				err := trustedDevices.trust(i, *i.TargetUser)
+				if err != nil {
+					logg.Error("could not set trusted device cookie for user %q: %s", p.LoginName, err.Error())
+				} else {
+					details["trusted_device"] = "added"
+				}
+			}
+			completeLogin(i, secLog, lastLoginName, p.LoginName, details)
+		},
+		SaveSession,
+		RedirectTo("/self"),
+	)
+}
+
 // Handles GET /logout.
-func getLogoutHandler(n core.Nexus) http.Handler {
+//
+// Logging out requires a POST request. Otherwise, third-party websites could
+// log users out of Portunus by embedding <img src="https://portunus.example.com/logout">.
+func getLogoutHandler(n core.Nexus, productName string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useLogoutForm(productName),
+		UseEmptyFormState,
+		ShowForm("Logout"),
+	)
+}
+
+var logoutConfirmSnippet = h.NewSnippet(`
+	<p>{{T "Do you want to log out of %s?" .}}</p>
+`)
+
+func useLogoutForm(productName string) HandlerStep {
+	return func(i *Interaction) {
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/logout",
+			SubmitLabel: "Logout",
+			Fields: []h.FormField{
+				h.StaticField{Value: logoutConfirmSnippet.RenderIn(i.Locale(), productName)},
+			},
+		}
+	}
+}
+
+// Handles POST /logout.
+func postLogoutHandler() http.Handler {
 	return Do(
 		LoadSession,
 		clearLogin,
@@ -130,6 +475,17 @@ func getLogoutHandler(n core.Nexus) http.Handler {
 	)
 }
 
+// clearLogin removes the login from the session, and discards all server-side
+// state that belongs to the session.
 func clearLogin(i *Interaction) {
+	if id, ok := i.Session.Values["pending_login_id"].(string); ok {
+		takePendingLogin(id)
+	}
+	if uid, ok := i.Session.Values["uid"].(string); ok {
+		id, _ := i.Session.Values["totp_enrollment_id"].(string)
+		discardTOTPEnrollment(uid, id)
+	}
 	delete(i.Session.Values, "uid")
+	delete(i.Session.Values, "pending_login_id")
+	delete(i.Session.Values, "totp_enrollment_id")
 }
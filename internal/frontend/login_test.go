@@ -0,0 +1,386 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/api"
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/totp"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// browser is a minimal web browser for driving the UI in tests. It keeps
+// cookies, but does not follow redirects, so that tests can check where they
+// lead.
+type browser struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+	//If set, this is sent as X-Forwarded-For with each request, so that the
+	//browser appears to come from this address.
+	ForwardedFor string
+}
+
+func newBrowser(t *testing.T, server *httptest.Server) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &browser{t: t, server: server, client: client}
+}
+
+// Returns the response body, or the redirect target if the response is a
+// redirect.
+func (b *browser) do(req *http.Request) (status int, bodyOrLocation string) {
+	b.t.Helper()
+	if b.ForwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", b.ForwardedFor)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusSeeOther {
+		return resp.StatusCode, resp.Header.Get("Location")
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (b *browser) Get(path string) (status int, bodyOrLocation string) {
+	b.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, b.server.URL+path, http.NoBody)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return b.do(req)
+}
+
+var csrfTokenRx = regexp.MustCompile(`name="gorilla.csrf.Token" value="([^"]+)"`)
+
+// Like a user would, this submits the form on the given page, with the given
+// values filled in.
+func (b *browser) Submit(path string, values url.Values) (status int, bodyOrLocation string) {
+	b.t.Helper()
+	return b.SubmitTo(path, path, values)
+}
+
+// Like Submit, but for forms whose action is different from the page that
+// they are shown on.
+func (b *browser) SubmitTo(path, action string, values url.Values) (status int, bodyOrLocation string) {
+	b.t.Helper()
+	status, body := b.Get(path)
+	if status != http.StatusOK {
+		b.t.Fatalf("expected GET %s to show a form, but got status %d: %s", path, status, body)
+	}
+	return b.SubmitPage(body, action, values)
+}
+
+// Like SubmitTo, but for a page that was obtained earlier, e.g. to simulate a
+// form that stays open for a while before it is submitted.
+func (b *browser) SubmitPage(page, action string, values url.Values) (status int, bodyOrLocation string) {
+	b.t.Helper()
+	match := csrfTokenRx.FindStringSubmatch(page)
+	if match == nil {
+		b.t.Fatalf("no CSRF token found on page for %s", action)
+	}
+	values.Set("gorilla.csrf.Token", html.UnescapeString(match[1]))
+
+	req, err := http.NewRequest(http.MethodPost, b.server.URL+action, strings.NewReader(values.Encode()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(req)
+}
+
+func setupFrontend(t *testing.T) (core.Nexus, *httptest.Server) {
+	return setupFrontendWithOptions(t, HandlerOptions{})
+}
+
+// Like setupFrontend, but with the given HandlerOptions. The AuditLog is
+// always replaced with a fresh one.
+func setupFrontendWithOptions(t *testing.T, opts HandlerOptions) (core.Nexus, *httptest.Server) {
+	t.Setenv("PORTUNUS_SERVER_STATE_DIR", t.TempDir())
+	if opts.AuditLog == nil {
+		auditLog, err := audit.OpenLog(filepath.Join(t.TempDir(), "audit.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.AuditLog = auditLog
+	}
+
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "jane",
+			GivenName:    "Jane",
+			FamilyName:   "Doe",
+			PasswordHash: "{PLAINTEXT}secret",
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	server := httptest.NewServer(HTTPHandler(nexus, opts))
+	t.Cleanup(server.Close)
+	return nexus, server
+}
+
+func TestTOTPEnrollmentAndLogin(t *testing.T) {
+	nexus, server := setupFrontend(t)
+	b := newBrowser(t, server)
+	login := url.Values{"user_ident": {"jane"}, "password": {"secret"}}
+	logout := func() {
+		t.Helper()
+		_, location := b.Submit("/logout", url.Values{})
+		assert.DeepEqual(t, "redirect after logout", location, "/login")
+	}
+
+	//without a second factor, the password is enough
+	_, location := b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login without TOTP", location, "/self")
+
+	//enroll an authenticator app
+	_, location = b.Submit("/self/totp", url.Values{"password": {"secret"}})
+	assert.DeepEqual(t, "redirect after starting enrollment", location, "/self/totp/confirm")
+	enrollment, exists := pendingTOTPEnrollments["jane"]
+	assert.DeepEqual(t, "enrollment exists", exists, true)
+	_, location = b.Submit("/self/totp/confirm", url.Values{"totp_code": {enrollment.Key.CodeAt(time.Now())}})
+	assert.DeepEqual(t, "redirect after confirming enrollment", location, "/self")
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	key, err := totp.ParseKeyURL(user.TOTPKeyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logout()
+
+	//from now on, the password alone is not enough
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after password with TOTP", location, "/login/verify")
+	_, location = b.Get("/self")
+	assert.DeepEqual(t, "redirect for /self before second step", location, "/login")
+	_, location = b.Submit("/login/verify", url.Values{"totp_code": {"000000"}})
+	assert.DeepEqual(t, "redirect after wrong code", location, "/login")
+	//the wrong code discarded the pending login
+	_, location = b.Get("/login/verify")
+	assert.DeepEqual(t, "redirect for /login/verify after wrong code", location, "/login")
+
+	//a correct code completes the login, and we can ask for this browser to be trusted
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after password with TOTP", location, "/login/verify")
+	_, location = b.Submit("/login/verify", url.Values{
+		"totp_code":    {key.CodeAt(time.Now())},
+		"trust_device": {"yes"},
+	})
+	assert.DeepEqual(t, "redirect after correct code", location, "/self")
+	status, _ := b.Get("/self")
+	assert.DeepEqual(t, "status for /self after login with TOTP", status, http.StatusOK)
+	logout()
+
+	//in the trusted browser, the password is enough again, but not in other browsers
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login in trusted browser", location, "/self")
+	_, location = newBrowser(t, server).Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login in other browser", location, "/login/verify")
+
+	//disabling the second factor requires a valid code
+	_, location = b.Submit("/self/totp/disable", url.Values{"password": {"secret"}, "current_totp_code": {key.CodeAt(time.Now())}})
+	assert.DeepEqual(t, "redirect after disabling TOTP", location, "/self")
+	user, _ = nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "TOTP key after disabling", user.TOTPKeyURL, "")
+	logout()
+
+	//after re-enrolling, the browser is not trusted anymore
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login without TOTP", location, "/self")
+	b.Submit("/self/totp", url.Values{"password": {"secret"}})
+	enrollment = pendingTOTPEnrollments["jane"]
+	b.Submit("/self/totp/confirm", url.Values{"totp_code": {enrollment.Key.CodeAt(time.Now())}})
+	logout()
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login with new TOTP key", location, "/login/verify")
+}
+
+func TestPasswordChangeEndsOtherSessions(t *testing.T) {
+	_, server := setupFrontend(t)
+	login := url.Values{"user_ident": {"jane"}, "password": {"secret"}}
+	b1 := newBrowser(t, server)
+	b2 := newBrowser(t, server)
+	for _, b := range []*browser{b1, b2} {
+		_, location := b.Submit("/login", login)
+		assert.DeepEqual(t, "redirect after login", location, "/self")
+	}
+
+	//changing the password in one browser...
+	_, location := b1.Submit("/self", url.Values{
+		"change_password": {"1"},
+		"old_password":    {"secret"},
+		"new_password":    {"swordfish"},
+		"repeat_password": {"swordfish"},
+	})
+	assert.DeepEqual(t, "redirect after password change", location, "/self")
+	status, body := b1.Get("/self")
+	assert.DeepEqual(t, "status for /self in same browser", status, http.StatusOK)
+	assert.DeepEqual(t, "flash in same browser", strings.Contains(body, "You have been logged out in all other browsers."), true)
+
+	//...ends the session in the other browser
+	_, location = b2.Get("/self")
+	assert.DeepEqual(t, "redirect for /self in other browser", location, "/login")
+	_, body = b2.Get("/login")
+	assert.DeepEqual(t, "flash in other browser", strings.Contains(body, "your password was changed"), true)
+
+	//logging in again with the new password works as usual
+	_, location = b2.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"swordfish"}})
+	assert.DeepEqual(t, "redirect after login with new password", location, "/self")
+	status, _ = b2.Get("/self")
+	assert.DeepEqual(t, "status for /self after new login", status, http.StatusOK)
+}
+
+func TestPasswordResetThroughAdminAPIEndsSessions(t *testing.T) {
+	nexus, server := setupFrontend(t)
+	b := newBrowser(t, server)
+	_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+	assert.DeepEqual(t, "redirect after login", location, "/self")
+
+	//as done by `portunusctl user reset-password`
+	adminAPI := api.NewAdminServer(nexus, func() (*core.DatabaseSeed, errext.ErrorSet) { return nil, nil }, "").Handler
+	req := httptest.NewRequest(http.MethodPost, "/v1/users/jane/password", strings.NewReader(`{"password":"swordfish"}`))
+	rec := httptest.NewRecorder()
+	adminAPI.ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status for password reset", rec.Code, http.StatusNoContent)
+
+	_, location = b.Get("/self")
+	assert.DeepEqual(t, "redirect for /self after password reset", location, "/login")
+
+	_, location = b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"swordfish"}})
+	assert.DeepEqual(t, "redirect after login with new password", location, "/self")
+
+	//a hash upgrade on login is not a password change, so it does not end other
+	//sessions (the test hasher has no stronger hashes, so any other hash stands in)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users[0].PasswordHash = "{PLAINTEXT}rehashed"
+		return nil
+	}, &core.UpdateOptions{IsRehash: true})
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	status, _ := b.Get("/self")
+	assert.DeepEqual(t, "status for /self after hash upgrade", status, http.StatusOK)
+}
+
+func TestDisabledUserCannotLogIn(t *testing.T) {
+	nexus, server := setupFrontend(t)
+	login := url.Values{"user_ident": {"jane"}, "password": {"secret"}}
+	setDisabled := func(disabled bool) {
+		t.Helper()
+		errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+			db.Users[0].Disabled = disabled
+			return nil
+		}, nil)
+		if !errs.IsEmpty() {
+			t.Fatal(errs.Join(", "))
+		}
+	}
+
+	//disabling the user ends their existing session...
+	b := newBrowser(t, server)
+	_, location := b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login", location, "/self")
+	setDisabled(true)
+	_, location = b.Get("/self")
+	assert.DeepEqual(t, "redirect for /self after disabling", location, "/login")
+	_, body := b.Get("/login")
+	assert.DeepEqual(t, "flash after disabling", strings.Contains(body, "your account was disabled"), true)
+
+	//...and prevents new logins, even with the right password
+	status, body := b.Submit("/login", login)
+	assert.DeepEqual(t, "status for login while disabled", status, http.StatusOK)
+	assert.DeepEqual(t, "error for login while disabled", strings.Contains(body, "Your account is disabled."), true)
+	status, body = b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"wrong"}})
+	assert.DeepEqual(t, "status for wrong password while disabled", status, http.StatusOK)
+	assert.DeepEqual(t, "no hint for wrong password while disabled", strings.Contains(body, "Your account is disabled."), false)
+
+	//once enabled again, the user can log in as usual
+	setDisabled(false)
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login when enabled again", location, "/self")
+}
+
+func TestLoginPageIsTranslated(t *testing.T) {
+	_, server := setupFrontend(t)
+	b := newBrowser(t, server)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/login", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9,en;q=0.8")
+	status, body := b.do(req)
+	assert.DeepEqual(t, "status", status, http.StatusOK)
+	assert.DeepEqual(t, "has lang attribute", strings.Contains(body, `<html lang="de">`), true)
+	assert.DeepEqual(t, "has translated label", strings.Contains(body, "Benutzername oder E-Mail-Adresse"), true)
+
+	//without a matching language, the page is shown in English
+	status, body = b.Get("/login")
+	assert.DeepEqual(t, "status", status, http.StatusOK)
+	assert.DeepEqual(t, "has lang attribute", strings.Contains(body, `<html lang="en">`), true)
+	assert.DeepEqual(t, "has English label", strings.Contains(body, "Login name or email address"), true)
+}
+
+func TestColorSchemeIsPersistedInSession(t *testing.T) {
+	_, server := setupFrontend(t)
+	b := newBrowser(t, server)
+
+	//by default, the browser decides
+	_, body := b.Get("/login")
+	assert.DeepEqual(t, "has lang attribute without theme", strings.Contains(body, `<html lang="en">`), true)
+
+	_, location := b.SubmitTo("/login", "/theme", url.Values{"theme": {"dark"}, "return_to": {"/login"}})
+	assert.DeepEqual(t, "redirect after choosing theme", location, "/login")
+	_, body = b.Get("/login")
+	assert.DeepEqual(t, "has dark theme", strings.Contains(body, `<html lang="en" class="theme-dark">`), true)
+
+	//redirects only go to pages within Portunus
+	_, location = b.SubmitTo("/login", "/theme", url.Values{"theme": {"light"}, "return_to": {"//example.com/"}})
+	assert.DeepEqual(t, "redirect after choosing theme", location, "/")
+	_, body = b.Get("/login")
+	assert.DeepEqual(t, "has light theme", strings.Contains(body, `<html lang="en" class="theme-light">`), true)
+
+	status, _ := b.SubmitTo("/login", "/theme", url.Values{"theme": {"purple"}})
+	assert.DeepEqual(t, "status for unknown theme", status, http.StatusBadRequest)
+
+	_, _ = b.SubmitTo("/login", "/theme", url.Values{"theme": {"auto"}})
+	_, body = b.Get("/login")
+	assert.DeepEqual(t, "has lang attribute without theme", strings.Contains(body, `<html lang="en">`), true)
+}
@@ -0,0 +1,195 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// MaintenanceInfo is given in HandlerOptions when the server runs in
+// maintenance mode because the database file cannot be loaded. In this mode,
+// the UI shows a read-only snapshot of the database from its last backup (if
+// any), and admins can restore that backup on the /maintenance page.
+type MaintenanceInfo struct {
+	//The error that prevented the database file from being loaded.
+	LoadError error
+	StorePath string
+	//When the backup that is shown as a snapshot was written. Zero if there is
+	//no usable backup.
+	SnapshotTime time.Time
+	//Replaces the database file with its backup. Nil if there is no usable
+	//backup.
+	Restore func() error
+}
+
+var errMaintenanceMode = errors.New("changes cannot be saved while Portunus is in maintenance mode")
+
+// RejectChangesInMaintenanceMode is a core.PreCommitHook that rejects all
+// changes. In maintenance mode, it is installed on the nexus holding the
+// snapshot.
+func RejectChangesInMaintenanceMode(core.Change) error {
+	return errMaintenanceMode
+}
+
+var maintenanceBannerSnippet = h.NewSnippet(`
+	<div class="flash flash-danger">
+		{{T "Portunus is in maintenance mode because its database could not be loaded."}}
+		{{if .SnapshotTime.IsZero}}
+			{{T "No backup is available, so there is nothing to show right now."}}
+		{{else}}
+			{{T "You are viewing a read-only snapshot from %s. Changes cannot be saved." (.SnapshotTime.Format "2006-01-02 15:04:05 MST")}}
+		{{end}}
+		{{if .IsAdmin}}<a href="/maintenance">{{T "Details"}}</a>{{end}}
+	</div>
+`)
+
+func renderMaintenanceBanner(info *MaintenanceInfo, currentUser *core.UserWithPerms, l i18n.Locale) template.HTML {
+	if info == nil {
+		return ""
+	}
+	return maintenanceBannerSnippet.RenderIn(l, struct {
+		SnapshotTime time.Time
+		IsAdmin      bool
+	}{
+		SnapshotTime: info.SnapshotTime,
+		IsAdmin:      currentUser != nil && currentUser.Perms.Portunus.IsAdmin,
+	})
+}
+
+var maintenanceDiagnosticsSnippet = h.NewSnippet(`
+	<p>The database file could not be loaded when Portunus started:</p>
+	<table class="table">
+		<tbody>
+			<tr><th>Database file</th><td><code>{{.StorePath}}</code></td></tr>
+			<tr><th>Error</th><td>{{.LoadError}}</td></tr>
+			<tr><th>Backup</th><td>{{if .SnapshotTime.IsZero}}<em>not available</em>{{else}}written at {{.SnapshotTime.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+		</tbody>
+	</table>
+	{{if .Restore}}
+		<p>
+			Restoring the backup replaces the database file with the snapshot that you are currently viewing. The broken
+			database file is kept next to it for later inspection. Afterwards, Portunus resumes normal operation.
+		</p>
+	{{else}}
+		<p>
+			Since there is no usable backup, the database file needs to be repaired on the server. Portunus will resume
+			normal operation once it is restarted with a readable database file.
+		</p>
+	{{end}}
+`)
+
+// Without a backup, there is nothing to restore, so only the diagnostics are shown.
+func showDiagnosticsIfNoBackup(info MaintenanceInfo) HandlerStep {
+	return func(i *Interaction) {
+		if info.Restore != nil {
+			return
+		}
+		ShowView(func(_ *Interaction) Page {
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "Maintenance mode",
+				Contents: maintenanceDiagnosticsSnippet.Render(info),
+			}
+		})(i)
+	}
+}
+
+func useMaintenanceForm(info MaintenanceInfo) HandlerStep {
+	return func(i *Interaction) {
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/maintenance",
+			SubmitLabel: "Restore backup",
+			Fields: []h.FormField{
+				h.StaticField{Value: maintenanceDiagnosticsSnippet.Render(info)},
+				h.InputFieldSpec{
+					InputType:        "password",
+					Name:             "password",
+					Label:            "Confirm with your password",
+					AutocompleteMode: "current-password",
+				},
+				h.InputFieldSpec{
+					InputType: "text",
+					Name:      "confirm",
+					Label:     `Type "restore" to confirm`,
+				},
+			},
+		}
+	}
+}
+
+// Handles GET /maintenance.
+func getMaintenanceHandler(n core.Nexus, info MaintenanceInfo) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		showDiagnosticsIfNoBackup(info),
+		useMaintenanceForm(info),
+		UseEmptyFormState,
+		ShowForm("Maintenance mode"),
+	)
+}
+
+var restoreCompletedSnippet = h.NewSnippet(`
+	<p>The database has been restored from its backup. Portunus is now resuming normal operation.</p>
+	<p><a href="/">Continue to the start page</a> (this may take a few seconds to become available)</p>
+`)
+
+// Handles POST /maintenance.
+func postMaintenanceHandler(n core.Nexus, secLog securityEventLog, info MaintenanceInfo) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		showDiagnosticsIfNoBackup(info),
+		useMaintenanceForm(info),
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			fs := i.FormState
+			pwd := fs.Fields["password"].GetValueOrSetError()
+			if pwd != "" && !n.PasswordHasher().CheckPasswordHash(pwd, i.CurrentUser.PasswordHash) {
+				fs.Fields["password"].ErrorMessage = "is not valid"
+			}
+			field := fs.Fields["confirm"]
+			if field.GetValueOrSetError() != "" && field.Value != "restore" {
+				field.ErrorMessage = `does not match "restore"`
+			}
+		},
+		ShowFormIfErrors("Maintenance mode"),
+		func(i *Interaction) {
+			err := info.Restore()
+			if err != nil {
+				logg.Error("could not restore database from backup: %s", err.Error())
+				i.FormState.ErrorMessages = append(i.FormState.ErrorMessages, "Could not restore the backup: "+err.Error())
+				ShowForm("Maintenance mode")(i)
+				return
+			}
+			recordSecurityEvent(secLog, i.Req, audit.Event{
+				Type:    audit.EventDatabaseRestored,
+				Actor:   core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName},
+				Subject: i.CurrentUser.LoginName,
+				Message: "database was restored from its backup in maintenance mode",
+			})
+			ShowView(func(_ *Interaction) Page {
+				return Page{
+					Status:   http.StatusOK,
+					Title:    "Maintenance mode",
+					Contents: restoreCompletedSnippet.Render(nil),
+				}
+			})(i)
+		},
+	)
+}
@@ -0,0 +1,72 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	restoreCount := 0
+	maintenanceNexus, maintenanceServer := setupFrontendWithOptions(t, HandlerOptions{
+		Maintenance: &MaintenanceInfo{
+			LoadError: errors.New("unexpected end of JSON input"),
+			StorePath: "/var/lib/portunus/database.json",
+			Restore: func() error {
+				restoreCount++
+				return nil
+			},
+		},
+	})
+	//a regular handler in the same process must not be affected by the other
+	//handler's maintenance mode
+	_, regularServer := setupFrontend(t)
+
+	errs := maintenanceNexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"jane": true},
+			Permissions:      core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	const bannerText = "Portunus is in maintenance mode"
+	login := url.Values{"user_ident": {"jane"}, "password": {"secret"}}
+
+	b := newBrowser(t, regularServer)
+	_, location := b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login", location, "/self")
+	_, body := b.Get("/self")
+	assert.DeepEqual(t, "banner shown by regular handler", strings.Contains(body, bannerText), false)
+	status, _ := b.Get("/maintenance")
+	assert.DeepEqual(t, "status for /maintenance on regular handler", status, http.StatusNotFound)
+
+	b = newBrowser(t, maintenanceServer)
+	_, location = b.Submit("/login", login)
+	assert.DeepEqual(t, "redirect after login", location, "/self")
+	_, body = b.Get("/self")
+	assert.DeepEqual(t, "banner shown in maintenance mode", strings.Contains(body, bannerText), true)
+	_, body = b.Get("/maintenance")
+	assert.DeepEqual(t, "diagnostics show store path", strings.Contains(body, "/var/lib/portunus/database.json"), true)
+
+	_, body = b.Submit("/maintenance", url.Values{"password": {"secret"}, "confirm": {"restore"}})
+	assert.DeepEqual(t, "restore completed", strings.Contains(body, "The database has been restored from its backup."), true)
+	assert.DeepEqual(t, "number of restores", restoreCount, 1)
+}
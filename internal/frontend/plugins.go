@@ -0,0 +1,104 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// Plugin describes additional pages that are compiled into Portunus. Plugins
+// are registered with RegisterPlugin() from an init() function, which is
+// usually reached through the public package
+// "github.com/majewsky/portunus/plugins".
+type Plugin struct {
+	//Identifies the plugin in log messages and URL paths. All routes of the
+	//plugin live below "/plugins/${Name}". May only contain lowercase ASCII
+	//letters, digits and dashes.
+	Name   string
+	Routes []PluginRoute
+	//Optional. Links that are shown in the navigation bar.
+	NavLinks []PluginNavLink
+}
+
+// PluginRoute appears in type Plugin.
+type PluginRoute struct {
+	Method string //e.g. "GET"
+	//Must be "/plugins/${Name}" or start with "/plugins/${Name}/". May contain
+	//variables like "{id}" (see gorilla/mux for syntax), which can be read
+	//with mux.Vars(i.Req).
+	Path string
+	//Builds the handler for this route, usually with Do().
+	Handler func(n core.Nexus) http.Handler
+}
+
+// PluginNavLink appears in type Plugin.
+type PluginNavLink struct {
+	Label string
+	Path  string
+	//If true, the link is only shown to users with admin access to Portunus.
+	//Note that this only hides the link: Handlers must still use
+	//VerifyPermissions() to restrict access.
+	ForAdminsOnly bool
+}
+
+var registeredPlugins []Plugin
+
+// RegisterPlugin adds a plugin to all handlers that are subsequently
+// constructed by HTTPHandler(). Mistakes in the plugin definition are
+// programming errors, so they cause a panic.
+func RegisterPlugin(p Plugin) {
+	if !isPluginName(p.Name) {
+		panic(fmt.Sprintf("invalid plugin name: %q", p.Name))
+	}
+	for _, other := range registeredPlugins {
+		if other.Name == p.Name {
+			panic(fmt.Sprintf("plugin %q is registered twice", p.Name))
+		}
+	}
+	prefix := "/plugins/" + p.Name
+	for _, route := range p.Routes {
+		if route.Path != prefix && !strings.HasPrefix(route.Path, prefix+"/") {
+			panic(fmt.Sprintf("route %s %s of plugin %q must be below %s", route.Method, route.Path, p.Name, prefix))
+		}
+		if route.Handler == nil {
+			panic(fmt.Sprintf("route %s %s of plugin %q has no handler", route.Method, route.Path, p.Name))
+		}
+	}
+	registeredPlugins = append(registeredPlugins, p)
+}
+
+func isPluginName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Collects the plugin links that shall be shown in the navigation bar.
+func pluginNavLinks(currentUser *core.UserWithPerms) (result []PluginNavLink) {
+	if currentUser == nil {
+		return nil
+	}
+	for _, p := range registeredPlugins {
+		for _, link := range p.NavLinks {
+			if link.ForAdminsOnly && !currentUser.Perms.Portunus.IsAdmin {
+				continue
+			}
+			result = append(result, link)
+		}
+	}
+	return result
+}
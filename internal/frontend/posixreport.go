@@ -0,0 +1,137 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+func getPosixReportHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(func(_ *Interaction) Page {
+			return Page{
+				Status:   http.StatusOK,
+				Title:    "POSIX group IDs",
+				Contents: posixReportSnippet.Render(core.BuildPosixGIDReport(n.ListUsers(), n.ListGroups())),
+				Wide:     true,
+			}
+		}),
+	)
+}
+
+var posixReportSnippet = h.NewSnippet(`
+	<p>
+		This report shows how GIDs are used by the POSIX groups and users in Portunus, e.g. for reconciling them with
+		file ownership on NFS exports. It can also be <a href="/groups/posix-report.csv">downloaded as CSV</a>.
+	</p>
+	{{if .Collisions}}
+		<h2>GID collisions</h2>
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>GID</th>
+					<th>Groups</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Collisions}}
+					<tr>
+						<td data-label="GID">{{.GID}}</td>
+						<td data-label="Groups">{{range .GroupNames}}<a href="/groups/{{.}}/edit"><code>{{.}}</code></a> {{end}}</td>
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{end}}
+	{{if .UsersWithUnknownGID}}
+		<h2>Users with unknown primary GID</h2>
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Login name</th>
+					<th>Full name</th>
+					<th>UID</th>
+					<th>GID</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .UsersWithUnknownGID}}
+					<tr>
+						<td data-label="Login name"><a href="/users/{{.LoginName}}/edit"><code>{{.LoginName}}</code></a></td>
+						<td data-label="Full name">{{.FullName}}</td>
+						<td data-label="UID">{{.POSIX.UID}}</td>
+						<td data-label="GID">{{.POSIX.GID}}</td>
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{end}}
+	<h2>POSIX groups</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>GID</th>
+				<th>Name</th>
+				<th>Members</th>
+				<th>Primary group of</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Groups}}
+				<tr>
+					<td data-label="GID">{{.GID}}</td>
+					<td data-label="Name"><a href="/groups/{{.Group.Name}}/edit"><code>{{.Group.Name}}</code></a></td>
+					<td data-label="Members">{{range .MemberLoginNames}}<code>{{.}}</code> {{else}}<span class="text-muted">None</span>{{end}}</td>
+					<td data-label="Primary group of">{{range .PrimaryLoginNames}}<code>{{.}}</code> {{else}}<span class="text-muted">None</span>{{end}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="4" class="text-muted">There are no POSIX groups.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func getPosixReportCSVHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		serveDownload("portunus-posix-gids.csv", "text/csv; charset=utf-8", renderPosixReportCSV(n)),
+	)
+}
+
+// The CSV contains all three sections of the report in one table. The
+// `record_type` column says which section each record belongs to.
+func renderPosixReportCSV(n core.Nexus) func(i *Interaction) ([]byte, error) {
+	return func(_ *Interaction) ([]byte, error) {
+		report := core.BuildPosixGIDReport(n.ListUsers(), n.ListGroups())
+		records := [][]string{{"record_type", "gid", "groups", "members", "primary_users"}}
+		for _, entry := range report.Groups {
+			records = append(records, []string{
+				"group",
+				entry.GID.String(),
+				entry.Group.Name,
+				strings.Join(entry.MemberLoginNames, " "),
+				strings.Join(entry.PrimaryLoginNames, " "),
+			})
+		}
+		for _, c := range report.Collisions {
+			records = append(records, []string{"collision", c.GID.String(), strings.Join(c.GroupNames, " "), "", ""})
+		}
+		for _, user := range report.UsersWithUnknownGID {
+			records = append(records, []string{"unknown_gid", user.POSIX.GID.String(), "", "", user.LoginName})
+		}
+		return renderCSV(records)
+	}
+}
@@ -0,0 +1,429 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func getReviewsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(reviewsList(n)),
+	)
+}
+
+var reviewsListSnippet = h.NewSnippet(`
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Started</th>
+				<th>Deadline</th>
+				<th>Progress</th>
+				<th class="actions">
+					<a href="/reviews/new" class="button button-primary">Start review</a>
+				</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td data-label="Name"><code>{{.Review.Name}}</code></td>
+					<td data-label="Started">{{.Review.StartedAt}} by <code>{{.Review.StartedBy}}</code></td>
+					<td data-label="Deadline">
+						{{- .Review.Deadline -}}
+						{{- if .IsOverdue }} <strong>(overdue)</strong>{{ end -}}
+					</td>
+					<td data-label="Progress">
+						{{- .ConfirmedCount }} confirmed, {{ .RemovedCount }} removed, {{ .PendingCount }} pending
+						{{- if and .IsOverdue .PendingCount }} <strong>(flagged)</strong>{{ end -}}
+					</td>
+					<td class="actions">
+						<a href="/reviews/{{.Review.Name}}">Details</a>
+					</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="5" class="text-muted">No access reviews have been started yet.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func reviewsList(n core.Nexus) func(*Interaction) Page {
+	return func(_ *Interaction) Page {
+		now := time.Now()
+		reviews := n.ListAccessReviews()
+
+		type reviewItem struct {
+			Review         core.AccessReview
+			IsOverdue      bool
+			ConfirmedCount int
+			RemovedCount   int
+			PendingCount   int
+		}
+		data := make([]reviewItem, len(reviews))
+		for idx, review := range reviews {
+			data[idx] = reviewItem{
+				Review:         review,
+				IsOverdue:      review.IsOverdue(now),
+				ConfirmedCount: review.CountItems("", core.AccessReviewConfirmed),
+				RemovedCount:   review.CountItems("", core.AccessReviewRemoved),
+				PendingCount:   review.CountItems("", core.AccessReviewPending),
+			}
+		}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Access reviews",
+			Contents: reviewsListSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
+
+func loadTargetReview(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		reviewName := mux.Vars(i.Req)["name"]
+		for _, review := range n.ListAccessReviews() {
+			if review.Name == reviewName {
+				i.TargetReview = &review
+				i.TargetRef = review.Ref()
+				return
+			}
+		}
+		msg := fmt.Sprintf("Access review %q does not exist.", reviewName)
+		if i.CurrentUser.Perms.Portunus.IsAdmin {
+			i.RedirectWithFlashTo("/reviews", Flash{"danger", msg})
+		} else {
+			i.RedirectWithFlashTo("/self", Flash{"danger", msg})
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// start a new review
+
+func useReviewForm(i *Interaction) {
+	i.FormState = &h.FormState{
+		Fields: map[string]*h.FieldState{},
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/reviews/new",
+		SubmitLabel: "Start review",
+		Fields: []h.FormField{
+			h.StaticField{
+				Value: newReviewExplanationSnippet.Render(nil),
+			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "name",
+				Label:     "Name",
+			},
+			h.InputFieldSpec{
+				InputType: "date",
+				Name:      "deadline",
+				Label:     "Deadline",
+			},
+		},
+	}
+}
+
+var newReviewExplanationSnippet = h.NewSnippet(`
+	<p>
+		All current group memberships will be included in the review.
+		The owner of each group will be asked to confirm or remove the memberships in their group.
+		Memberships in groups without an owner must be reviewed by an admin.
+	</p>
+`)
+
+func getReviewsNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useReviewForm,
+		ShowForm("Start access review"),
+	)
+}
+
+func postReviewsNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useReviewForm,
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeCreateReview),
+		ShowFormIfErrors("Start access review"),
+		RedirectWithFlashTo("/reviews", "Started"),
+	)
+}
+
+func executeCreateReview(db *core.Database, i *Interaction, _ crypt.PasswordHasher) errext.ErrorSet {
+	fs := i.FormState
+	review := core.NewAccessReview(fs.Fields["name"].Value, fs.Fields["deadline"].Value,
+		i.CurrentUser.LoginName, time.Now(), db.Groups)
+	i.TargetRef = review.Ref()
+	db.AccessReviews = append(db.AccessReviews, review)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// review progress (for admins)
+
+func getReviewDetailsHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetReview(n),
+		ShowView(reviewDetails(n)),
+	)
+}
+
+var reviewDetailsSnippet = h.NewSnippet(`
+	<p>
+		Started on {{.Review.StartedAt}} by <code>{{.Review.StartedBy}}</code>, deadline on {{.Review.Deadline}}.
+		{{- if .IsOverdue }}
+			The deadline has passed. Memberships that have not been reviewed yet are flagged below.
+		{{- end }}
+		<a href="/reviews/{{.Review.Name}}/tasks">Review memberships in groups without an owner</a>
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Group</th>
+				<th>Owner</th>
+				<th>Confirmed</th>
+				<th>Removed</th>
+				<th>Pending</th>
+				<th>Flagged</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Groups}}
+				<tr>
+					<td data-label="Group"><code>{{.GroupName}}</code></td>
+					{{ if .OwnerLoginName -}}
+						<td data-label="Owner"><code>{{.OwnerLoginName}}</code></td>
+					{{- else -}}
+						<td data-label="Owner" class="text-muted">None</td>
+					{{- end }}
+					<td data-label="Confirmed">{{.ConfirmedCount}}</td>
+					<td data-label="Removed">{{.RemovedCount}}</td>
+					<td data-label="Pending">{{.PendingCount}}</td>
+					{{ if .FlaggedLoginNames -}}
+						<td data-label="Flagged">
+							<ul class="comma-separated-list">
+								{{- range .FlaggedLoginNames }}<li><code>{{.}}</code></li>{{ end -}}
+							</ul>
+						</td>
+					{{- else -}}
+						<td data-label="Flagged" class="text-muted">None</td>
+					{{- end }}
+				</tr>
+			{{else}}
+				<tr><td colspan="6" class="text-muted">There were no group memberships when this review was started.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func reviewDetails(n core.Nexus) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		now := time.Now()
+		review := *i.TargetReview
+
+		type groupItem struct {
+			GroupName         string
+			OwnerLoginName    string
+			ConfirmedCount    int
+			RemovedCount      int
+			PendingCount      int
+			FlaggedLoginNames []string
+		}
+		var groups []groupItem
+		for _, item := range review.Items {
+			//items are sorted by group, so we only need to look at the last entry
+			if len(groups) == 0 || groups[len(groups)-1].GroupName != item.GroupName {
+				group, _ := n.FindGroup(func(g core.Group) bool { return g.Name == item.GroupName })
+				groups = append(groups, groupItem{
+					GroupName:      item.GroupName,
+					OwnerLoginName: group.OwnerLoginName,
+					ConfirmedCount: review.CountItems(item.GroupName, core.AccessReviewConfirmed),
+					RemovedCount:   review.CountItems(item.GroupName, core.AccessReviewRemoved),
+					PendingCount:   review.CountItems(item.GroupName, core.AccessReviewPending),
+				})
+			}
+			if review.IsFlagged(item, now) {
+				g := &groups[len(groups)-1]
+				g.FlaggedLoginNames = append(g.FlaggedLoginNames, item.LoginName)
+			}
+		}
+
+		data := struct {
+			Review    core.AccessReview
+			IsOverdue bool
+			Groups    []groupItem
+		}{review, review.IsOverdue(now), groups}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Access review " + review.Name,
+			Contents: reviewDetailsSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// review tasks (for group owners)
+
+// countAccessReviewTasks returns how many pending items the given user needs
+// to decide on in the given review.
+func countAccessReviewTasks(n core.Nexus, user core.UserWithPerms, review core.AccessReview) (count int) {
+	isReviewer := make(map[string]bool)
+	for _, group := range n.ListGroups() {
+		isReviewer[group.Name] = isGroupManagerFor(user, group)
+	}
+	for _, item := range review.Items {
+		if item.Decision == core.AccessReviewPending && isReviewer[item.GroupName] {
+			count++
+		}
+	}
+	return count
+}
+
+var reviewDecisionSnippet = h.NewSnippet(`
+	<code>{{.LoginName}}</code>: {{.Decision}} by <code>{{.DecidedBy}}</code>
+`)
+
+var noReviewTasksSnippet = h.NewSnippet(`
+	<p>There are no memberships for you to review in this access review.</p>
+`)
+
+func useReviewTasksForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		review := *i.TargetReview
+		i.FormState = &h.FormState{
+			Fields: map[string]*h.FieldState{},
+		}
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/reviews/" + review.Name + "/tasks",
+			SubmitLabel: "Submit decisions",
+		}
+
+		for _, group := range n.ListGroups() {
+			if !isGroupManagerFor(*i.CurrentUser, group) {
+				continue
+			}
+
+			var (
+				pendingOpts []h.SelectOptionSpec
+				decided     []h.FormField
+			)
+			fieldName := "keep:" + group.Name
+			isSelected := make(map[string]bool)
+			for _, item := range review.Items {
+				if item.GroupName != group.Name {
+					continue
+				}
+				if item.Decision == core.AccessReviewPending {
+					pendingOpts = append(pendingOpts, h.SelectOptionSpec{
+						Value: item.LoginName,
+						Label: item.LoginName,
+					})
+					isSelected[item.LoginName] = true
+				} else {
+					decided = append(decided, h.StaticField{
+						Value: reviewDecisionSnippet.Render(item),
+					})
+				}
+			}
+			if len(pendingOpts) == 0 {
+				continue
+			}
+
+			i.FormState.Fields[fieldName] = &h.FieldState{Selected: isSelected}
+			fields := []h.FormField{
+				h.SelectFieldSpec{
+					Name:    fieldName,
+					Label:   "Members to keep (unselected members will be removed from the group)",
+					Options: pendingOpts,
+				},
+			}
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.FieldSet{
+				Label:      fmt.Sprintf("%s (%s)", group.LongName, group.Name),
+				IsFoldable: false,
+				Fields:     append(fields, decided...),
+			})
+		}
+
+		if len(i.FormSpec.Fields) == 0 {
+			i.FormSpec.Fields = []h.FormField{
+				h.StaticField{Value: noReviewTasksSnippet.Render(nil)},
+			}
+		}
+	}
+}
+
+func getReviewTasksHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		loadTargetReview(n),
+		useReviewTasksForm(n),
+		ShowForm("Review memberships"),
+	)
+}
+
+func postReviewTasksHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		loadTargetReview(n),
+		useReviewTasksForm(n),
+		ReadFormStateFromRequest,
+		TryUpdateNexus(n, executeReviewTasks),
+		ShowFormIfErrors("Review memberships"),
+		RedirectWithFlashTo("/self", "Submitted decisions for"),
+	)
+}
+
+func executeReviewTasks(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	for _, item := range i.TargetReview.Items {
+		fieldState := i.FormState.Fields["keep:"+item.GroupName]
+		if fieldState == nil || item.Decision != core.AccessReviewPending {
+			//not reviewed by the current user, or already decided on
+			continue
+		}
+		group, exists := db.Groups.Find(func(g core.Group) bool { return g.Name == item.GroupName })
+		if !exists {
+			continue
+		}
+
+		//a membership that was removed in the meantime cannot be confirmed anymore
+		decision := core.AccessReviewRemoved
+		if fieldState.Selected[item.LoginName] && group.MemberLoginNames[item.LoginName] {
+			decision = core.AccessReviewConfirmed
+		}
+		errs.Add(db.DecideAccessReviewItem(i.TargetReview.Name, item.GroupName, item.LoginName,
+			decision, i.CurrentUser.LoginName))
+	}
+	return errs
+}
@@ -0,0 +1,348 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"cmp"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/clientinfo"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Security events (logins, password changes, changes to the second factor)
+// are recorded in the audit log, and each user can see their own recent
+// events on their profile page. This allows users to spot unauthorized
+// access to their account without having to ask the admins.
+
+// securityEventLog bundles everything that recordSecurityEvent() needs. It is
+// built once by HTTPHandler() and passed to all handlers that record security
+// events.
+type securityEventLog struct {
+	AuditLog *audit.Log
+	//Used to find the email address of users that need to be notified.
+	Nexus core.Nexus
+	//Used to annotate security events with the client's country. May be nil.
+	GeoIP *clientinfo.GeoIPDatabase
+	//Used to notify users about events with Notify = true. May be nil.
+	SendMail func(to []string, subject, body string) error
+	//Limits how many failed logins are recorded per client. If nil, all of
+	//them are recorded.
+	FailedLogins *failedLoginLimiter
+}
+
+// recordSecurityEvent records an event in the audit log, along with
+// information about the client that caused it. Errors are only logged: a user
+// should not be prevented from logging in just because the audit log has a
+// problem.
+func recordSecurityEvent(secLog securityEventLog, r *http.Request, e audit.Event) {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details["ip"] = clientAddressOf(r)
+	addr, _ := netip.ParseAddr(e.Details["ip"])
+	if country := secLog.GeoIP.LookupCountry(addr); country != "" {
+		e.Details["country"] = country
+	}
+	if ua := r.UserAgent(); ua != "" {
+		e.Details["user_agent"] = truncateString(ua, maxUserAgentLength)
+		if browser := clientinfo.DescribeUserAgent(ua); browser != "" {
+			e.Details["browser"] = browser
+		}
+	}
+
+	if (e.Type == audit.EventLoginFailed || e.Type == audit.EventLoginBlocked) && secLog.FailedLogins != nil {
+		allowed, suppressed := secLog.FailedLogins.allow(e.Details["ip"], time.Now())
+		if !allowed {
+			return
+		}
+		if suppressed > 0 {
+			e.Details["suppressed_attempts"] = strconv.Itoa(suppressed)
+		}
+	}
+
+	if e.Type == audit.EventLogin && isNewCountryForUser(secLog.AuditLog, e.Subject, e.Details["country"]) {
+		e.Message = fmt.Sprintf(newCountryMessageFormat, e.Message, e.Details["country"])
+		e.Notify = true
+	}
+
+	err := secLog.AuditLog.Record(e)
+	if err != nil {
+		logg.Error("could not record %s event for user %q in audit log: %s", e.Type, e.Subject, err.Error())
+	}
+	if e.Notify {
+		sendSecurityNotificationMail(secLog, e)
+	}
+}
+
+// Appended to the message of login events from a country that the user has
+// not logged in from before.
+const newCountryMessageFormat = "%s from a new country (%s)"
+
+// translateEventMessage translates the message of a security event for
+// showing it to the user. Messages are recorded in English, so that the audit
+// log does not depend on the language of whoever caused the event.
+func translateEventMessage(l i18n.Locale, e audit.Event) string {
+	if country := e.Details["country"]; country != "" {
+		suffix := fmt.Sprintf(newCountryMessageFormat, "", country)
+		if msg, ok := strings.CutSuffix(e.Message, suffix); ok {
+			return l.Tf(newCountryMessageFormat, l.T(msg), country)
+		}
+	}
+	return l.T(e.Message)
+}
+
+// Client-provided strings are truncated to this length before being recorded
+// in the audit log.
+const maxUserAgentLength = 200
+
+// isNewCountryForUser returns whether the given user has logged in before, but
+// never from the given country. If we do not know any previous logins, every
+// country would be new, so there is nothing to notify about.
+func isNewCountryForUser(auditLog *audit.Log, loginName, country string) bool {
+	if country == "" {
+		return false
+	}
+	hasPreviousLogins := false
+	for _, e := range auditLog.ListEventsForSubject(loginName) {
+		if e.Type != audit.EventLogin || e.Details["country"] == "" {
+			continue
+		}
+		if e.Details["country"] == country {
+			return false
+		}
+		hasPreviousLogins = true
+	}
+	return hasPreviousLogins
+}
+
+// sendSecurityNotificationMail notifies the user about the given event by
+// email, in addition to the notification on their profile page. The mail is
+// sent in the background, so that a slow mail server does not hold up the
+// login.
+func sendSecurityNotificationMail(secLog securityEventLog, e audit.Event) {
+	if secLog.SendMail == nil {
+		return
+	}
+	user, exists := secLog.Nexus.FindUser(func(u core.User) bool { return u.LoginName == e.Subject })
+	if !exists || user.EMailAddress == "" {
+		return
+	}
+
+	//like the audit log, this is in English since we do not know which language
+	//the user prefers outside of their browser session
+	subject := "Security notification for your account " + user.LoginName
+	body := fmt.Sprintf(securityNotificationMailFormat,
+		user.FullName(), time.Now().Format("2006-01-02 15:04 MST"), e.Message,
+		e.Details["ip"], cmp.Or(e.Details["browser"], e.Details["user_agent"], "unknown"))
+	go func() {
+		err := secLog.SendMail([]string{user.EMailAddress}, subject, body)
+		if err != nil {
+			logg.Error("could not send notification about %s event to user %q: %s", e.Type, e.Subject, err.Error())
+		}
+	}()
+}
+
+const securityNotificationMailFormat = `Hello %s,
+
+on %s, there was a %s.
+
+IP address: %s
+Browser: %s
+
+If this was not you, please contact your administrators immediately.
+`
+
+// Failed logins do not require authentication, so whoever knows a login name
+// could otherwise fill the audit log (and the disk) by guessing passwords. Per
+// client address, only the first failedLoginRecordLimit failed logins within
+// failedLoginWindow are recorded. Further attempts are only counted, and their
+// number is recorded with the next failed login from that address after the
+// window has passed.
+const (
+	failedLoginRecordLimit = 10
+	failedLoginWindow      = 10 * time.Minute
+	//Addresses are forgotten (including their counts of attempts that were not
+	//recorded) once there are this many. This is crude, but only happens when
+	//failed logins come from a lot of different addresses at once.
+	failedLoginTrackerCapacity = 10000
+)
+
+type failedLoginLimiter struct {
+	mutex    sync.Mutex
+	bySource map[string]*failedLoginWindowState //key = client address
+}
+
+type failedLoginWindowState struct {
+	StartedAt       time.Time
+	RecordedCount   int
+	SuppressedCount int
+}
+
+func newFailedLoginLimiter() *failedLoginLimiter {
+	return &failedLoginLimiter{bySource: make(map[string]*failedLoginWindowState)}
+}
+
+// allow returns whether a failed login from the given source shall be
+// recorded. If so, the second return value is how many failed logins from
+// this source were not recorded since the previous one that was.
+func (l *failedLoginLimiter) allow(source string, now time.Time) (allowed bool, suppressed int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state := l.bySource[source]
+	if state == nil || now.Sub(state.StartedAt) >= failedLoginWindow {
+		if state != nil {
+			suppressed = state.SuppressedCount
+		} else if len(l.bySource) >= failedLoginTrackerCapacity {
+			clear(l.bySource)
+		}
+		l.bySource[source] = &failedLoginWindowState{StartedAt: now, RecordedCount: 1}
+		return true, suppressed
+	}
+	if state.RecordedCount < failedLoginRecordLimit {
+		state.RecordedCount++
+		return true, 0
+	}
+	state.SuppressedCount++
+	if state.SuppressedCount == 1 {
+		logg.Info("too many failed logins from %s: not recording further attempts in the audit log until %s",
+			source, state.StartedAt.Add(failedLoginWindow).Format(time.RFC3339))
+	}
+	return false, 0
+}
+
+func truncateString(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	//avoid cutting in the middle of a multibyte character
+	cut := 0
+	for idx := range s {
+		if idx > maxLength {
+			break
+		}
+		cut = idx
+	}
+	return s[:cut] + "…"
+}
+
+// clientAddressOf returns the IP address of the client that sent this
+// request. When the request came in via a reverse proxy on the same host, the
+// address reported by the proxy in X-Forwarded-For is used instead. We only
+// trust the last entry of that header since that is the one added by the
+// proxy itself; all earlier entries could have been forged by the client.
+func clientAddressOf(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		forwardedFor := r.Header.Values("X-Forwarded-For")
+		if len(forwardedFor) > 0 {
+			entries := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				return last
+			}
+		}
+	}
+	return host
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// notifications on the profile page
+
+// How long notifications about security events are shown on the user's
+// profile page.
+const securityNotificationDuration = 30 * 24 * time.Hour
+
+var securityNotificationSnippet = h.NewSnippet(`
+	<div class="flash flash-danger">
+		{{T "On %s, %s." (.Time.Format "2006-01-02 15:04 MST") .Message}}
+		{{T "If this was not you, please contact your administrators immediately."}}
+	</div>
+`)
+
+func buildSecurityNotifications(auditLog *audit.Log, user core.UserWithPerms, l i18n.Locale) (result []h.FormField) {
+	for _, e := range auditLog.ListEventsForSubject(user.LoginName) {
+		if e.Notify && time.Since(e.Time) < securityNotificationDuration {
+			e.Message = translateEventMessage(l, e)
+			result = append(result, h.StaticField{Value: securityNotificationSnippet.RenderIn(l, e)})
+		}
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// event list on the profile page
+
+// How many security events are listed on the user's profile page.
+const securityEventListLength = 10
+
+var securityEventListSnippet = h.NewSnippet(`
+	<div class="form-row">
+		<label>{{T "Recent security events"}}</label>
+		{{- if . }}
+			<table class="table responsive">
+				<thead>
+					<tr>
+						<th>{{T "Time"}}</th>
+						<th>{{T "Event"}}</th>
+						<th>{{T "IP address"}}</th>
+						<th>{{T "Country"}}</th>
+						<th>{{T "Browser"}}</th>
+					</tr>
+				</thead>
+				<tbody>
+					{{range .}}
+						<tr>
+							<td data-label="{{T "Time"}}">{{.Time.Format "2006-01-02 15:04 MST"}}</td>
+							<td data-label="{{T "Event"}}">{{.Message}}</td>
+							<td data-label="{{T "IP address"}}">{{with .Details.ip}}<code>{{.}}</code>{{else}}<span class="text-muted">{{T "Unknown"}}</span>{{end}}</td>
+							<td data-label="{{T "Country"}}">{{with .Details.country}}{{.}}{{else}}<span class="text-muted">{{T "Unknown"}}</span>{{end}}</td>
+							<td data-label="{{T "Browser"}}">
+								{{- if .Details.browser -}}
+									<span title="{{.Details.user_agent}}">{{.Details.browser}}</span>
+								{{- else if .Details.user_agent -}}
+									{{.Details.user_agent}}
+								{{- else -}}
+									<span class="text-muted">{{T "Unknown"}}</span>
+								{{- end -}}
+							</td>
+						</tr>
+					{{end}}
+				</tbody>
+			</table>
+		{{- else }}
+			<div class="row-value"><em>{{T "None recorded yet"}}</em></div>
+		{{- end }}
+	</div>
+`)
+
+func renderSecurityEventList(auditLog *audit.Log, user core.UserWithPerms, l i18n.Locale) template.HTML {
+	events := auditLog.ListEventsForSubject(user.LoginName)
+	if len(events) > securityEventListLength {
+		events = events[:securityEventListLength]
+	}
+	for idx, e := range events {
+		events[idx].Message = translateEventMessage(l, e)
+	}
+	return securityEventListSnippet.RenderIn(l, events)
+}
@@ -0,0 +1,137 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/clientinfo"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestNewCountryLoginNotification(t *testing.T) {
+	geoIPPath := filepath.Join(t.TempDir(), "geoip.csv")
+	err := os.WriteFile(geoIPPath, []byte("192.0.2.0,192.0.2.255,DE\n198.51.100.0,198.51.100.255,FR\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geoIP, err := clientinfo.LoadGeoIPDatabase(geoIPPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type sentMail struct {
+		To      []string
+		Subject string
+		Body    string
+	}
+	mails := make(chan sentMail, 10)
+	nexus, server := setupFrontendWithOptions(t, HandlerOptions{
+		GeoIP: geoIP,
+		SendMail: func(to []string, subject, body string) error {
+			mails <- sentMail{to, subject, body}
+			return nil
+		},
+	})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users[0].EMailAddress = "jane@example.org"
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	login := func(address string) {
+		t.Helper()
+		b := newBrowser(t, server)
+		b.ForwardedFor = address
+		_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+		assert.DeepEqual(t, "redirect after login", location, "/self")
+	}
+	expectNoMail := func() {
+		t.Helper()
+		select {
+		case m := <-mails:
+			t.Errorf("unexpected mail: %#v", m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	//the first login and every further login from the same country are not notified
+	login("192.0.2.1")
+	expectNoMail()
+	login("192.0.2.2")
+	expectNoMail()
+
+	login("198.51.100.1")
+	select {
+	case m := <-mails:
+		assert.DeepEqual(t, "mail recipients", m.To, []string{"jane@example.org"})
+		assert.DeepEqual(t, "mail mentions country", strings.Contains(m.Body, "successful login from a new country (FR)"), true)
+		assert.DeepEqual(t, "mail mentions address", strings.Contains(m.Body, "IP address: 198.51.100.1"), true)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail was sent for login from new country")
+	}
+}
+
+func TestFailedLoginsAreLimitedPerSource(t *testing.T) {
+	auditLog, err := audit.OpenLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, server := setupFrontendWithOptions(t, HandlerOptions{AuditLog: auditLog})
+
+	attackerBrowser := newBrowser(t, server)
+	attackerBrowser.ForwardedFor = "192.0.2.1"
+	for range failedLoginRecordLimit + 5 {
+		attackerBrowser.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"wrong"}})
+	}
+	//attempts from other addresses are not affected
+	otherBrowser := newBrowser(t, server)
+	otherBrowser.ForwardedFor = "198.51.100.1"
+	otherBrowser.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"wrong"}})
+
+	countBySource := make(map[string]int)
+	for _, e := range auditLog.ListEventsForSubject("jane") {
+		if e.Type == audit.EventLoginFailed {
+			countBySource[e.Details["ip"]]++
+		}
+	}
+	assert.DeepEqual(t, "recorded failed logins", countBySource, map[string]int{
+		"192.0.2.1":    failedLoginRecordLimit,
+		"198.51.100.1": 1,
+	})
+}
+
+func TestFailedLoginLimiter(t *testing.T) {
+	l := newFailedLoginLimiter()
+	start := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	expect := func(now time.Time, expectedAllowed bool, expectedSuppressed int) {
+		t.Helper()
+		allowed, suppressed := l.allow("192.0.2.1", now)
+		assert.DeepEqual(t, "allowed", allowed, expectedAllowed)
+		assert.DeepEqual(t, "suppressed", suppressed, expectedSuppressed)
+	}
+
+	for range failedLoginRecordLimit {
+		expect(start, true, 0)
+	}
+	expect(start.Add(time.Minute), false, 0)
+	expect(start.Add(2*time.Minute), false, 0)
+	//once the window has passed, the next attempt is recorded along with the
+	//number of attempts that were not
+	expect(start.Add(failedLoginWindow), true, 2)
+	expect(start.Add(failedLoginWindow), true, 0)
+}
@@ -0,0 +1,123 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// Form fields whose name differs from the respective entry in core.SeededFields.
+var seededFieldAliases = map[string]string{
+	"reset_password": "password",
+}
+
+// Makes all fields of an edit form read-only that are enforced by the seed,
+// and explains this in a tooltip. This way, admins do not need to find out by
+// trial and error which changes would be rejected with seedConflictMessage.
+func markSeededFields(fields []h.FormField, sf core.SeededFields, state *h.FormState) []h.FormField {
+	if sf.IsEmpty() {
+		return fields
+	}
+	tooltip := "This field is managed by the seed (the static configuration of Portunus)."
+	if sf.Fragment != "" {
+		tooltip = fmt.Sprintf("This field is managed by the seed fragment %q.", sf.Fragment)
+	}
+
+	result := make([]h.FormField, len(fields))
+	for idx, field := range fields {
+		switch f := field.(type) {
+		case h.InputFieldSpec:
+			if sf.Contains(f.Name) {
+				f.ReadOnly = true
+				f.Tooltip = tooltip
+			}
+			field = f
+		case h.MultilineInputFieldSpec:
+			if sf.Contains(f.Name) {
+				f.ReadOnly = true
+				f.Tooltip = tooltip
+			} else if keys := seededSubfields(sf, f.Name); len(keys) > 0 {
+				//some labels are seeded, but others can still be maintained here
+				f.Tooltip = fmt.Sprintf("The entries for %s are managed by the seed and cannot be changed here.",
+					strings.Join(keys, ", "))
+			}
+			field = f
+		case h.DropdownFieldSpec:
+			if sf.Contains(f.Name) {
+				f.ReadOnly = true
+				f.Tooltip = tooltip
+			}
+			field = f
+		case h.SelectFieldSpec:
+			if sf.Contains(f.Name) {
+				f.ReadOnly = true
+				f.Tooltip = tooltip
+			} else {
+				f.Options = slices.Clone(f.Options)
+				for idx, opt := range f.Options {
+					if sf.Contains(f.Name + "." + opt.Value) {
+						f.Options[idx].ReadOnly = true
+						f.Options[idx].Tooltip = tooltip
+					}
+				}
+			}
+			field = f
+		case h.FieldSet:
+			name := f.Name
+			if alias, ok := seededFieldAliases[name]; ok {
+				name = alias
+			}
+			if f.IsFoldable && sf.Contains(name) {
+				f.ReadOnly = true
+				f.Tooltip = tooltip
+				if state.Fields[f.Name] == nil {
+					state.Fields[f.Name] = &h.FieldState{}
+				}
+			}
+			f.Fields = markSeededFields(f.Fields, sf, state)
+			field = f
+		}
+		result[idx] = field
+	}
+	return result
+}
+
+// Returns the keys of all entries in `sf` of the form "<name>.<key>".
+func seededSubfields(sf core.SeededFields, name string) []string {
+	var keys []string
+	for fieldName := range sf.Names {
+		key, ok := strings.CutPrefix(fieldName, name+".")
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Renders the badge that marks seeded users and groups in list views, so that
+// admins know beforehand which objects they cannot edit freely. Returns an
+// empty string for objects that do not appear in the seed.
+func renderSeedBadge(sf core.SeededFields) template.HTML {
+	if sf.IsEmpty() {
+		return ""
+	}
+	tooltip := "Managed by the seed (the static configuration of Portunus)."
+	if sf.Fragment != "" {
+		tooltip = fmt.Sprintf("Managed by the seed fragment %q.", sf.Fragment)
+	}
+	return seedBadgeSnippet.Render(tooltip)
+}
+
+var seedBadgeSnippet = h.NewSnippet(`<span class="badge" title="{{.}}">seed</span>`)
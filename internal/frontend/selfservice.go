@@ -7,25 +7,111 @@
 package frontend
 
 import (
+	"encoding/base64"
+	"html/template"
 	"net/http"
 	"sort"
 	"strings"
 
+	"github.com/majewsky/portunus/internal/audit"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
 	"github.com/sapcc/go-bits/errext"
 )
 
-// TODO: allow flipped order (family name first)
 var userFullNameSnippet = h.NewSnippet(`
-	<span class="given-name">{{.GivenName}}</span> <span class="family-name">{{.FamilyName}}</span>
+	{{- if .FamilyNameFirst -}}
+		<span class="family-name">{{.FamilyName}}</span> <span class="given-name">{{.GivenName}}</span>
+	{{- else -}}
+		<span class="given-name">{{.GivenName}}</span> <span class="family-name">{{.FamilyName}}</span>
+	{{- end -}}
 `)
 var userEMailAddressSnippet = h.NewSnippet(`
-	{{if .EMailAddress}}{{.EMailAddress}}{{else}}<em>Not specified</em>{{end}}
+	{{if .EMailAddress}}{{.EMailAddress}}{{else}}<em>{{T "Not specified"}}</em>{{end}}
 `)
+var notSpecifiedSnippet = h.NewSnippet(`
+	<em>{{T "Not specified"}}</em>
+`)
+var userManagerSnippet = h.NewSnippet(`
+	{{.FullName}} (<code>{{.LoginName}}</code>)
+	{{- if .EMailAddress }}, <a href="mailto:{{.EMailAddress}}">{{.EMailAddress}}</a>{{ end }}
+`)
+
+// Shows the user's manager on the profile page.
+func buildManagerField(n core.Nexus, user core.User, l i18n.Locale) h.FormField {
+	if user.ManagerLoginName == "" {
+		return h.StaticField{Label: "Manager", Value: notSpecifiedSnippet.RenderIn(l, nil)}
+	}
+	manager, exists := n.FindUser(func(u core.User) bool { return u.LoginName == user.ManagerLoginName })
+	if !exists {
+		//should not happen since Database.Validate() checks this reference
+		return h.StaticField{Label: "Manager", Value: codeTagSnippet.Render(user.ManagerLoginName)}
+	}
+	return h.StaticField{Label: "Manager", Value: userManagerSnippet.Render(manager.User)}
+}
+
+// Uploaded photos may be larger than the limit for User.JPEGPhoto since they
+// are scaled down before being stored.
+const maxPhotoUploadSize = 8 << 20 // 8 MiB
+
+var userPhotoSnippet = h.NewSnippet(`
+	<div class="form-row">
+		<label>{{T "Photo"}}</label>
+		{{if .PhotoURL}}
+			<img class="user-photo" src="{{.PhotoURL}}" alt="{{T "Your current photo"}}">
+		{{else if .AvatarURL}}
+			<div class="row-value">
+				<img class="user-photo" src="{{.AvatarURL}}" alt="{{T "Your avatar"}}" referrerpolicy="no-referrer">
+				<em>{{T "Not uploaded. Showing the avatar for your email address from %s instead." .AvatarHost}}</em>
+			</div>
+		{{else}}
+			<div class="row-value"><em>{{T "Not uploaded"}}</em></div>
+		{{end}}
+	</div>
+`)
+
+func renderUserPhoto(avatarSource *AvatarSource, user core.User, l i18n.Locale) template.HTML {
+	var data struct {
+		PhotoURL   template.URL
+		AvatarURL  string
+		AvatarHost string
+	}
+	if len(user.JPEGPhoto) > 0 {
+		//the photo has been validated as JPEG, and base64 cannot break out of the attribute
+		data.PhotoURL = template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(user.JPEGPhoto))
+	} else if avatarSource != nil {
+		data.AvatarURL = avatarURLFor(avatarSource, user)
+		data.AvatarHost = avatarSource.Host()
+	}
+	return userPhotoSnippet.RenderIn(l, data)
+}
 
-func useSelfServiceForm(n core.Nexus) HandlerStep {
+func buildPhotoFieldset(user core.User) h.FieldSet {
+	fields := []h.FormField{
+		h.FileInputFieldSpec{
+			Name:    "jpeg_photo",
+			Label:   "Upload new photo (JPEG, PNG or GIF)",
+			Accept:  "image/jpeg,image/png,image/gif",
+			MaxSize: maxPhotoUploadSize,
+		},
+	}
+	if len(user.JPEGPhoto) > 0 {
+		fields = append(fields, h.SelectFieldSpec{
+			Name:    "photo_options",
+			Options: []h.SelectOptionSpec{{Value: "remove", Label: "Remove current photo"}},
+		})
+	}
+	return h.FieldSet{
+		Name:       "change_photo",
+		Label:      "Change photo",
+		IsFoldable: true,
+		Fields:     fields,
+	}
+}
+
+func useSelfServiceForm(n core.Nexus, secLog securityEventLog, features core.FeatureSet, selfServicePrivacy bool, avatarSource *AvatarSource) HandlerStep {
 	return func(i *Interaction) {
 		user := i.CurrentUser
 		i.TargetRef = user.Ref()
@@ -61,77 +147,140 @@ func useSelfServiceForm(n core.Nexus) HandlerStep {
 			},
 		}
 
-		i.FormSpec = &h.FormSpec{
-			PostTarget:  "/self",
-			SubmitLabel: "Update profile",
-			Fields: []h.FormField{
-				h.StaticField{
-					Label: "Login name",
-					Value: codeTagSnippet.Render(user.LoginName),
-				},
-				h.StaticField{
-					Label: "Full name",
-					Value: userFullNameSnippet.Render(user),
-				},
-				h.StaticField{
-					Label: "Email address",
-					Value: userEMailAddressSnippet.Render(user),
-				},
-				h.SelectFieldSpec{
-					Name:     "memberships",
-					Label:    "Group memberships",
-					Options:  memberships,
-					ReadOnly: true,
-				},
-				h.MultilineInputFieldSpec{
-					Name:  "ssh_public_keys",
-					Label: "SSH public key(s)",
-				},
-				h.FieldSet{
-					Name:       "change_password",
-					Label:      "Change password",
-					IsFoldable: true,
-					Fields: []h.FormField{
-						h.InputFieldSpec{
-							InputType: "password",
-							Name:      "old_password",
-							Label:     "Old password",
-						},
-						h.InputFieldSpec{
-							InputType: "password",
-							Name:      "new_password",
-							Label:     "New password",
-						},
-						h.InputFieldSpec{
-							InputType: "password",
-							Name:      "repeat_password",
-							Label:     "Repeat password",
-						},
+		l := i.Locale()
+		notices := buildSecurityNotifications(secLog.AuditLog, *user, l)
+		if features.IsEnabled(core.FeatureAccessReviews) {
+			notices = append(notices, buildReviewTaskNotices(n, *user, l)...)
+		}
+		if features.IsEnabled(core.FeatureJoinRequests) {
+			notices = append(notices, buildJoinRequestNotices(n, *user, l)...)
+		}
+
+		fields := append(notices, []h.FormField{
+			h.StaticField{
+				Label: "Login name",
+				Value: codeTagSnippet.Render(user.LoginName),
+			},
+			h.StaticField{
+				Label: "Full name",
+				Value: userFullNameSnippet.Render(user),
+			},
+			h.StaticField{
+				Label: "Email address",
+				Value: userEMailAddressSnippet.RenderIn(l, user),
+			},
+			buildManagerField(n, user.User, l),
+			h.SelectFieldSpec{
+				Name:     "memberships",
+				Label:    "Group memberships",
+				Options:  memberships,
+				ReadOnly: true,
+			},
+			h.MultilineInputFieldSpec{
+				Name:  "ssh_public_keys",
+				Label: "SSH public key(s)",
+			},
+			h.StaticField{
+				Value: renderUserPhoto(avatarSource, user.User, l),
+			},
+			buildPhotoFieldset(user.User),
+		}...)
+		if selfServicePrivacy {
+			sf := n.SeededFieldsOf(user.Ref())
+			fields = append(fields, markSeededFields([]h.FormField{buildUserLDAPPrivacyField(&user.User, i.FormState)}, sf, i.FormState)...)
+		}
+		fields = append(fields, []h.FormField{
+			h.StaticField{
+				Label: "Two-factor authentication",
+				Value: renderTOTPStatus(*user, l),
+			},
+			h.StaticField{
+				Value: renderSecurityEventList(secLog.AuditLog, *user, l),
+			},
+			h.FieldSet{
+				Name:       "change_password",
+				Label:      "Change password",
+				IsFoldable: true,
+				Fields: []h.FormField{
+					h.InputFieldSpec{
+						InputType: "password",
+						Name:      "old_password",
+						Label:     "Old password",
+					},
+					h.InputFieldSpec{
+						InputType: "password",
+						Name:      "new_password",
+						Label:     "New password",
+					},
+					h.InputFieldSpec{
+						InputType: "password",
+						Name:      "repeat_password",
+						Label:     "Repeat password",
 					},
 				},
 			},
+		}...)
+
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/self",
+			SubmitLabel: "Update profile",
+			IsMultipart: true,
+			Fields:      fields,
 		}
 	}
 }
 
-func getSelfHandler(n core.Nexus) http.Handler {
+var reviewTaskNoticeSnippet = h.NewSnippet(`
+	<div class="flash flash-warning">
+		{{T "Please review %d group membership(s) for the access review %s until %s:" .Count (code .Review.Name) .Review.Deadline}}
+		<a href="/reviews/{{.Review.Name}}/tasks">{{T "Go to review"}}</a>
+	</div>
+`)
+
+func buildReviewTaskNotices(n core.Nexus, user core.UserWithPerms, l i18n.Locale) (result []h.FormField) {
+	for _, review := range n.ListAccessReviews() {
+		count := countAccessReviewTasks(n, user, review)
+		if count > 0 {
+			data := struct {
+				Count  int
+				Review core.AccessReview
+			}{count, review}
+			result = append(result, h.StaticField{Value: reviewTaskNoticeSnippet.RenderIn(l, data)})
+		}
+	}
+	return result
+}
+
+func getSelfHandler(n core.Nexus, secLog securityEventLog, features core.FeatureSet, selfServicePrivacy bool, avatarSource *AvatarSource) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
-		useSelfServiceForm(n),
+		useSelfServiceForm(n, secLog, features, selfServicePrivacy, avatarSource),
 		ShowForm("My profile"),
 	)
 }
 
-func postSelfHandler(n core.Nexus) http.Handler {
+func postSelfHandler(n core.Nexus, secLog securityEventLog, features core.FeatureSet, selfServicePrivacy bool, avatarSource *AvatarSource) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
-		useSelfServiceForm(n),
+		useSelfServiceForm(n, secLog, features, selfServicePrivacy, avatarSource),
 		ReadFormStateFromRequest,
 		validateSelfServiceForm(n),
-		TryUpdateNexus(n, executeSelfService),
+		TryUpdateNexus(n, executeSelfService(selfServicePrivacy)),
 		ShowFormIfErrors("My profile"),
+		func(i *Interaction) {
+			if i.FormState.Fields["change_password"].IsUnfolded {
+				recordSecurityEvent(secLog, i.Req, audit.Event{
+					Type:    audit.EventPasswordChange,
+					Actor:   core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName},
+					Subject: i.CurrentUser.LoginName,
+					Message: "password was changed",
+				})
+				keepCurrentSession(i, i.CurrentUser.LoginName)
+				i.Session.AddFlash(Flash{"primary", "You have been logged out in all other browsers."})
+			}
+		},
 		RedirectWithFlashTo("/self", "Updated"),
 	)
 }
@@ -152,20 +301,48 @@ func validateSelfServiceForm(n core.Nexus) HandlerStep {
 				fs.Fields["repeat_password"].ErrorMessage = "did not match"
 			}
 		}
+
+		//scaling and reencoding the photo can take a while, so this needs to
+		//happen before n.Update() instead of in executeSelfService(), where it would
+		//block all other writes; only the prepared photo is kept in the form state
+		photoField := fs.Fields["jpeg_photo"]
+		removePhoto := fs.Fields["photo_options"] != nil && fs.Fields["photo_options"].Selected["remove"]
+		if fs.Fields["change_photo"].IsUnfolded && !removePhoto && photoField != nil && len(photoField.FileContents) > 0 {
+			photo, err := core.PrepareUserPhoto(photoField.FileContents)
+			if err == nil {
+				photoField.FileContents = photo
+			} else {
+				photoField.FileContents = nil
+				photoField.ErrorMessage = err.Error()
+			}
+		}
 	}
 }
 
-func executeSelfService(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
-	fs := i.FormState
-	for idx, user := range db.Users {
-		if user.LoginName != i.CurrentUser.LoginName {
-			continue
-		}
-		if fs.Fields["change_password"].IsUnfolded {
-			user.PasswordHash = hasher.HashPassword(fs.Fields["new_password"].Value)
+func executeSelfService(selfServicePrivacy bool) func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet {
+	return func(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
+		fs := i.FormState
+		for idx, user := range db.Users {
+			if user.LoginName != i.CurrentUser.LoginName {
+				continue
+			}
+			if fs.Fields["change_password"].IsUnfolded {
+				user.PasswordHash = hasher.HashPassword(fs.Fields["new_password"].Value)
+			}
+			if fs.Fields["change_photo"].IsUnfolded {
+				switch {
+				case fs.Fields["photo_options"] != nil && fs.Fields["photo_options"].Selected["remove"]:
+					user.JPEGPhoto = nil
+				case len(fs.Fields["jpeg_photo"].FileContents) > 0:
+					user.JPEGPhoto = fs.Fields["jpeg_photo"].FileContents //already prepared by validateSelfServiceForm()
+				}
+			}
+			user.SSHPublicKeys = core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value)
+			if selfServicePrivacy {
+				user.HiddenLDAPAttributes = readUserLDAPPrivacyField(fs)
+			}
+			db.Users[idx] = user //`user` copies by value, so we need to write the changes back explicitly
 		}
-		user.SSHPublicKeys = core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value)
-		db.Users[idx] = user //`user` copies by value, so we need to write the changes back explicitly
+		return
 	}
-	return
 }
@@ -0,0 +1,35 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSelfServicePrivacyField(t *testing.T) {
+	_, privacyServer := setupFrontendWithOptions(t, HandlerOptions{SelfServicePrivacy: true})
+	//the setting applies per handler, even when there are several in one process
+	_, regularServer := setupFrontend(t)
+
+	for _, tc := range []struct {
+		Browser      *browser
+		IsFieldShown bool
+	}{
+		{Browser: newBrowser(t, privacyServer), IsFieldShown: true},
+		{Browser: newBrowser(t, regularServer), IsFieldShown: false},
+	} {
+		b := tc.Browser
+		_, location := b.Submit("/login", url.Values{"user_ident": {"jane"}, "password": {"secret"}})
+		assert.DeepEqual(t, "redirect after login", location, "/self")
+		_, body := b.Get("/self")
+		assert.DeepEqual(t, "privacy field is shown", strings.Contains(body, `name="hidden_ldap_attributes"`), tc.IsFieldShown)
+	}
+}
@@ -0,0 +1,352 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func getServiceAccountsHandler(n core.Nexus, bindDN func(string) string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(serviceAccountsList(n, bindDN)),
+	)
+}
+
+var serviceAccountsListSnippet = h.NewSnippet(`
+	<p>
+		Service accounts are used by applications to bind to the LDAP server.
+		They cannot log into Portunus, and can only read what their read scopes allow.
+	</p>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Name</th>
+				<th>Bind DN</th>
+				<th>Description</th>
+				<th>Can read</th>
+				<th class="actions">
+					<a href="/service-accounts/new" class="button button-primary">New service account</a>
+				</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td data-label="Name"><code>{{.Account.Name}}</code></td>
+					{{ if .BindDN -}}
+						<td data-label="Bind DN"><code>{{.BindDN}}</code></td>
+					{{- else -}}
+						<td data-label="Bind DN" class="text-muted">Unknown</td>
+					{{- end }}
+					{{ if .Account.Description -}}
+						<td data-label="Description">{{.Account.Description}}</td>
+					{{- else -}}
+						<td data-label="Description" class="text-muted">None</td>
+					{{- end }}
+					<td data-label="Can read">{{.Account.ReadScopes}}</td>
+					<td class="actions">
+						<a href="/service-accounts/{{.Account.Name}}/edit">Edit</a>
+						·
+						<a href="/service-accounts/{{.Account.Name}}/delete">Delete</a>
+					</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="5" class="text-muted">No service accounts have been created yet.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+`)
+
+func serviceAccountsList(n core.Nexus, bindDN func(string) string) func(*Interaction) Page {
+	return func(_ *Interaction) Page {
+		type accountItem struct {
+			Account core.ServiceAccount
+			BindDN  string
+		}
+		var data []accountItem
+		for _, s := range n.ListServiceAccounts() {
+			item := accountItem{Account: s}
+			if bindDN != nil {
+				item.BindDN = bindDN(s.Name)
+			}
+			data = append(data, item)
+		}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "Service accounts",
+			Contents: serviceAccountsListSnippet.Render(data),
+			Wide:     true,
+		}
+	}
+}
+
+func loadTargetServiceAccount(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		name := mux.Vars(i.Req)["name"]
+		for _, s := range n.ListServiceAccounts() {
+			if s.Name == name {
+				i.TargetServiceAccount = &s
+				i.TargetRef = s.Ref()
+				return
+			}
+		}
+		msg := fmt.Sprintf("Service account %q does not exist.", name)
+		i.RedirectWithFlashTo("/service-accounts", Flash{"danger", msg})
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// create and edit service accounts
+
+func useServiceAccountForm(i *Interaction) {
+	s := i.TargetServiceAccount
+	i.FormState = &h.FormState{
+		Fields: map[string]*h.FieldState{},
+	}
+
+	var nameField h.FormField
+	if s == nil {
+		nameField = h.InputFieldSpec{
+			InputType: "text",
+			Name:      "name",
+			Label:     "Name",
+		}
+	} else {
+		nameField = h.StaticField{
+			Label: "Name",
+			Value: codeTagSnippet.Render(s.Name),
+		}
+		i.FormState.Fields["description"] = &h.FieldState{Value: s.Description}
+		i.FormState.Fields["read_scopes"] = &h.FieldState{
+			Selected: map[string]bool{
+				"users":  s.ReadScopes.Users,
+				"groups": s.ReadScopes.Groups,
+			},
+		}
+	}
+
+	passwordFields := []h.FormField{
+		h.InputFieldSpec{
+			InputType: "password",
+			Name:      "password",
+			Label:     "Password",
+		},
+		h.InputFieldSpec{
+			InputType: "password",
+			Name:      "repeat_password",
+			Label:     "Repeat password",
+		},
+	}
+	passwordFieldset := h.FieldSet{
+		Label:      "Initial password",
+		IsFoldable: false,
+		Fields:     passwordFields,
+	}
+	if s != nil {
+		passwordFieldset = h.FieldSet{
+			Name:       "reset_password",
+			Label:      "Reset password",
+			IsFoldable: true,
+			Fields:     passwordFields,
+		}
+	}
+
+	i.FormSpec = &h.FormSpec{
+		Fields: []h.FormField{
+			h.FieldSet{
+				Label:      "Master data",
+				IsFoldable: false,
+				Fields: []h.FormField{
+					nameField,
+					h.InputFieldSpec{
+						InputType: "text",
+						Name:      "description",
+						Label:     "Description (optional)",
+					},
+				},
+			},
+			h.SelectFieldSpec{
+				Name:  "read_scopes",
+				Label: "Can read in LDAP",
+				Options: []h.SelectOptionSpec{
+					{
+						Value: "users",
+						Label: "All users",
+					},
+					{
+						Value: "groups",
+						Label: "All groups",
+					},
+				},
+			},
+			passwordFieldset,
+		},
+	}
+
+	if s == nil {
+		i.FormSpec.PostTarget = "/service-accounts/new"
+		i.FormSpec.SubmitLabel = "Create service account"
+	} else {
+		i.FormSpec.PostTarget = "/service-accounts/" + s.Name + "/edit"
+		i.FormSpec.SubmitLabel = "Save"
+	}
+}
+
+func validateServiceAccountForm(i *Interaction) {
+	fs := i.FormState
+	if i.TargetServiceAccount == nil || fs.Fields["reset_password"].IsUnfolded {
+		password1 := fs.Fields["password"].GetValueOrSetError()
+		password2 := fs.Fields["repeat_password"].GetValueOrSetError()
+		if password2 != "" && password1 != password2 {
+			fs.Fields["repeat_password"].ErrorMessage = "did not match"
+		}
+	}
+}
+
+func buildServiceAccountFromFormState(fs *h.FormState, name, passwordHash string) core.ServiceAccount {
+	return core.ServiceAccount{
+		Name:         name,
+		Description:  fs.Fields["description"].Value,
+		PasswordHash: passwordHash,
+		ReadScopes: core.ServiceAccountScopes{
+			Users:  fs.Fields["read_scopes"].Selected["users"],
+			Groups: fs.Fields["read_scopes"].Selected["groups"],
+		},
+	}
+}
+
+func getServiceAccountsNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useServiceAccountForm,
+		ShowForm("Create service account"),
+	)
+}
+
+func postServiceAccountsNewHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useServiceAccountForm,
+		ReadFormStateFromRequest,
+		validateServiceAccountForm,
+		TryUpdateNexus(n, executeCreateServiceAccount),
+		ShowFormIfErrors("Create service account"),
+		RedirectWithFlashTo("/service-accounts", "Created"),
+	)
+}
+
+func executeCreateServiceAccount(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
+	name := i.FormState.Fields["name"].Value
+	passwordHash := hasher.HashPassword(i.FormState.Fields["password"].Value)
+	newAccount := buildServiceAccountFromFormState(i.FormState, name, passwordHash)
+	i.TargetRef = newAccount.Ref()
+	db.ServiceAccounts = append(db.ServiceAccounts, newAccount)
+	return nil
+}
+
+func getServiceAccountEditHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceAccount(n),
+		useServiceAccountForm,
+		ShowForm("Edit service account"),
+	)
+}
+
+func postServiceAccountEditHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceAccount(n),
+		useServiceAccountForm,
+		ReadFormStateFromRequest,
+		validateServiceAccountForm,
+		TryUpdateNexus(n, executeEditServiceAccount),
+		ShowFormIfErrors("Edit service account"),
+		RedirectWithFlashTo("/service-accounts", "Updated"),
+	)
+}
+
+func executeEditServiceAccount(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) (errs errext.ErrorSet) {
+	passwordHash := i.TargetServiceAccount.PasswordHash
+	if i.FormState.Fields["reset_password"].IsUnfolded {
+		if pw := i.FormState.Fields["password"].Value; pw != "" {
+			passwordHash = hasher.HashPassword(pw)
+		}
+	}
+	newAccount := buildServiceAccountFromFormState(i.FormState, i.TargetServiceAccount.Name, passwordHash)
+	errs.Add(db.ServiceAccounts.Update(newAccount))
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// delete service accounts
+
+func getServiceAccountDeleteHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceAccount(n),
+		useDeleteServiceAccountForm,
+		UseEmptyFormState,
+		ShowForm("Confirm service account deletion"),
+	)
+}
+
+var deleteServiceAccountConfirmSnippet = h.NewSnippet(`
+	<p>Really delete service account <code>{{.}}</code>? Applications using it will not be able to bind to LDAP anymore. This cannot be undone.</p>
+`)
+
+func useDeleteServiceAccountForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/service-accounts/" + i.TargetServiceAccount.Name + "/delete",
+		SubmitLabel: "Delete service account",
+		Fields: []h.FormField{
+			h.StaticField{
+				Value: deleteServiceAccountConfirmSnippet.Render(i.TargetServiceAccount.Name),
+			},
+		},
+	}
+}
+
+func postServiceAccountDeleteHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetServiceAccount(n),
+		useDeleteServiceAccountForm,
+		UseEmptyFormState,
+		TryUpdateNexus(n, executeDeleteServiceAccount),
+		ShowFormIfErrors("Confirm service account deletion"),
+		RedirectWithFlashTo("/service-accounts", "Deleted"),
+	)
+}
+
+func executeDeleteServiceAccount(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	errs.Add(db.ServiceAccounts.Delete(i.TargetServiceAccount.Name))
+	return
+}
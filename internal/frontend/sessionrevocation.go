@@ -0,0 +1,135 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// When a user's password is changed, all other sessions of that user are
+// ended, so that a stolen session does not survive a password rotation. This
+// applies to all password changes, no matter if they come from the web UI, the
+// admin API or a password change through LDAP (see
+// revokeSessionsOnPasswordChange). Since
+// the sessions themselves live in cookies, the server keeps a record of when
+// each user's sessions were last ended, and only accepts sessions that were
+// logged in after that point. The records are persisted in the state
+// directory, so that a restart of Portunus does not revive ended sessions.
+//
+// Records are never pruned: Active sessions are refreshed on each request, so
+// there is no upper bound on how old a session can be. Since there is at most
+// one record per user, this does not grow without bounds either.
+var sessionRevocations = struct {
+	sync.Mutex
+	Path   string
+	ByUser map[string]time.Time
+}{ByUser: make(map[string]time.Time)}
+
+// Called by initSessionStore().
+func loadSessionRevocations(path string) {
+	sessionRevocations.Lock()
+	defer sessionRevocations.Unlock()
+	sessionRevocations.Path = path
+	sessionRevocations.ByUser = make(map[string]time.Time)
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logg.Error("cannot read session revocations: %s", err.Error())
+		}
+		return
+	}
+	err = json.Unmarshal(buf, &sessionRevocations.ByUser)
+	if err != nil {
+		logg.Error("cannot parse session revocations in %s: %s", path, err.Error())
+	}
+	if sessionRevocations.ByUser == nil {
+		//the file contained "null"
+		sessionRevocations.ByUser = make(map[string]time.Time)
+	}
+}
+
+// markSessionLogin is called by completeLogin() to record when the session was
+// logged in.
+func markSessionLogin(s *sessions.Session, now time.Time) {
+	s.Values["login_at"] = now.UnixNano()
+}
+
+// isSessionRevoked returns whether the given session belongs to the given user
+// and was logged in before that user's sessions were last ended.
+func isSessionRevoked(s *sessions.Session, loginName string) bool {
+	sessionRevocations.Lock()
+	revokedAt, exists := sessionRevocations.ByUser[loginName]
+	sessionRevocations.Unlock()
+	if !exists {
+		return false
+	}
+	//sessions from before this check was introduced do not have a login time,
+	//and count as being older than any revocation
+	loginAt, _ := s.Values["login_at"].(int64)
+	return loginAt < revokedAt.UnixNano()
+}
+
+// revokeSessionsOnPasswordChange is registered as a change listener by
+// HTTPHandler(). It ends all sessions of users whose password was changed.
+func revokeSessionsOnPasswordChange(change core.Change) {
+	if change.IsInitialLoad || change.IsRehash {
+		return
+	}
+	now := time.Now()
+	for _, update := range change.Diff.Users.Updated {
+		if update.Old.PasswordHash != update.New.PasswordHash {
+			endSessionsOfUser(update.New.LoginName, now)
+		}
+	}
+}
+
+// keepCurrentSession is called by handlers that change the password of the
+// given user, after the change has been made. If the session of the current
+// interaction belongs to that user, it is exempted from being ended by
+// revokeSessionsOnPasswordChange.
+func keepCurrentSession(i *Interaction, loginName string) {
+	if uid, _ := i.Session.Values["uid"].(string); uid == loginName {
+		markSessionLogin(i.Session, time.Now())
+	}
+}
+
+// Ends all sessions of the given user that were logged in before `now`.
+func endSessionsOfUser(loginName string, now time.Time) {
+	sessionRevocations.Lock()
+	defer sessionRevocations.Unlock()
+	sessionRevocations.ByUser[loginName] = now
+	err := saveSessionRevocations(sessionRevocations.Path, sessionRevocations.ByUser)
+	if err != nil {
+		logg.Error("cannot persist session revocations: %s (ended sessions of user %q will be valid again after a restart)", err.Error(), loginName)
+	}
+}
+
+func saveSessionRevocations(path string, byUser map[string]time.Time) error {
+	buf, err := json.Marshal(byUser)
+	if err != nil {
+		return err
+	}
+
+	//write atomically, so that a crash during the write does not lose the
+	//records of all users (which would revive their ended sessions)
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), os.Getpid()))
+	err = os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
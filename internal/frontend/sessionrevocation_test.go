@@ -0,0 +1,43 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSessionRevocationsArePersisted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session-revocations.json")
+	loadSessionRevocations(path)
+
+	revokedAt := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	endSessionsOfUser("jane", revokedAt)
+	endSessionsOfUser("john", revokedAt.Add(time.Hour))
+
+	//the file is replaced atomically, so no temporary file may be left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "number of files in state dir", len(entries), 1)
+
+	//after a restart, the records are still there
+	loadSessionRevocations(path)
+	sessionRevocations.Lock()
+	byUser := sessionRevocations.ByUser
+	sessionRevocations.Unlock()
+	assert.DeepEqual(t, "records after reload", byUser, map[string]time.Time{
+		"jane": revokedAt,
+		"john": revokedAt.Add(time.Hour),
+	})
+}
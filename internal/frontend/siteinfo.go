@@ -0,0 +1,111 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+)
+
+// SiteInfo contains texts and links that the operator of a Portunus
+// deployment wants to show to its users, e.g. because public-facing websites
+// are legally required to link to an imprint and a privacy policy. All fields
+// are optional.
+type SiteInfo struct {
+	//Shown above the login form.
+	LoginMessage string
+	//Shown in the page footer.
+	ImprintURL       string
+	PrivacyPolicyURL string
+	SupportContact   string //either an email address, a URL or free-form text
+}
+
+// ReadSiteInfoFromEnvironment reads a SiteInfo from the PORTUNUS_SERVER_*
+// environment variables that are documented in the README.
+func ReadSiteInfoFromEnvironment() (SiteInfo, error) {
+	info := SiteInfo{
+		LoginMessage:     strings.TrimSpace(os.Getenv("PORTUNUS_SERVER_LOGIN_MESSAGE")),
+		ImprintURL:       os.Getenv("PORTUNUS_SERVER_IMPRINT_URL"),
+		PrivacyPolicyURL: os.Getenv("PORTUNUS_SERVER_PRIVACY_POLICY_URL"),
+		SupportContact:   strings.TrimSpace(os.Getenv("PORTUNUS_SERVER_SUPPORT_CONTACT")),
+	}
+	for key, value := range map[string]string{
+		"PORTUNUS_SERVER_IMPRINT_URL":        info.ImprintURL,
+		"PORTUNUS_SERVER_PRIVACY_POLICY_URL": info.PrivacyPolicyURL,
+	} {
+		if value != "" && !isWebURL(value) {
+			return SiteInfo{}, fmt.Errorf("malformed value for %s: expected an http:// or https:// URL, but got %q", key, value)
+		}
+	}
+	return info, nil
+}
+
+func isWebURL(input string) bool {
+	u, err := url.Parse(input)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+var footerSnippet = h.NewSnippet(`
+	<footer>
+		{{- if .SupportContact -}}
+			<span>{{T "Support:"}} {{if .SupportContactURL}}<a href="{{.SupportContactURL}}">{{.SupportContact}}</a>{{else}}{{.SupportContact}}{{end}}</span>
+		{{- end -}}
+		{{- if .ImprintURL -}}
+			<a href="{{.ImprintURL}}">{{T "Imprint"}}</a>
+		{{- end -}}
+		{{- if .PrivacyPolicyURL -}}
+			<a href="{{.PrivacyPolicyURL}}">{{T "Privacy policy"}}</a>
+		{{- end -}}
+		{{- .ThemeSwitcher -}}
+	</footer>
+`)
+
+func renderFooter(siteInfo SiteInfo, l i18n.Locale, themeSwitcher template.HTML) template.HTML {
+	data := struct {
+		SiteInfo
+		SupportContactURL string
+		ThemeSwitcher     template.HTML
+	}{SiteInfo: siteInfo, ThemeSwitcher: themeSwitcher}
+	switch {
+	case isWebURL(siteInfo.SupportContact):
+		data.SupportContactURL = siteInfo.SupportContact
+	case strings.Contains(siteInfo.SupportContact, "@") && !strings.ContainsAny(siteInfo.SupportContact, " :"):
+		data.SupportContactURL = "mailto:" + siteInfo.SupportContact
+	}
+	return footerSnippet.RenderIn(l, data)
+}
+
+// loginMessageField is a FormField that shows SiteInfo.LoginMessage as
+// paragraphs at the top of the login form. Paragraphs are separated by empty
+// lines.
+type loginMessageField struct {
+	Message string
+}
+
+var loginMessageSnippet = h.NewSnippet(`{{range .}}<p>{{.}}</p>{{end}}`)
+
+// ReadState implements the h.FormField interface.
+func (f loginMessageField) ReadState(*http.Request, *h.FormState) {}
+
+// RenderField implements the h.FormField interface.
+func (f loginMessageField) RenderField(h.FormState) template.HTML {
+	var paragraphs []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(f.Message, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+		}
+	}
+	return loginMessageSnippet.Render(paragraphs)
+}
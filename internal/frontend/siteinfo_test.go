@@ -0,0 +1,34 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestSiteInfoIsShownOnLoginPageAndFooter(t *testing.T) {
+	_, serverA := setupFrontendWithOptions(t, HandlerOptions{SiteInfo: SiteInfo{
+		LoginMessage:   "Welcome to site A.",
+		SupportContact: "help@a.example.org",
+	}})
+	//each handler shows its own texts, even when there are several in one process
+	_, serverB := setupFrontendWithOptions(t, HandlerOptions{SiteInfo: SiteInfo{
+		ImprintURL: "https://b.example.org/imprint",
+	}})
+
+	_, body := newBrowser(t, serverA).Get("/login")
+	assert.DeepEqual(t, "login message on A", strings.Contains(body, "<p>Welcome to site A.</p>"), true)
+	assert.DeepEqual(t, "support contact on A", strings.Contains(body, `<a href="mailto:help@a.example.org">help@a.example.org</a>`), true)
+	assert.DeepEqual(t, "imprint on A", strings.Contains(body, "b.example.org"), false)
+
+	_, body = newBrowser(t, serverB).Get("/login")
+	assert.DeepEqual(t, "login message on B", strings.Contains(body, "Welcome to site A."), false)
+	assert.DeepEqual(t, "imprint on B", strings.Contains(body, `<a href="https://b.example.org/imprint">`), true)
+}
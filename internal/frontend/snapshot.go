@@ -0,0 +1,358 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/buildinfo"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/majewsky/portunus/internal/ldif"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// A directory snapshot bundles the exports that are usually required as audit
+// evidence into a single zip file:
+//
+//  1. On /export/snapshot, an admin requests a new snapshot.
+//  2. The snapshot is built in the background, while /export/snapshot shows
+//     the progress and reloads itself until the snapshot is complete.
+//  3. The finished snapshot can be downloaded from /export/snapshot.zip.
+//
+// Snapshots are only held in memory, and only for the admin who requested
+// them. They are discarded after snapshotTimeout.
+
+const snapshotTimeout = 1 * time.Hour
+
+// snapshotSources contains the optional inputs for a directory snapshot.
+type snapshotSources struct {
+	LDAPObjects func() []ldap.Object                         //if nil, there is no LDIF file
+	LoadSeed    func() (*core.DatabaseSeed, errext.ErrorSet) //if nil, there is no seed report
+}
+
+// snapshotFile is a file within a directory snapshot.
+type snapshotFile struct {
+	Name        string
+	Description string
+	//Returns nil if the file shall not be included in the snapshot, and a
+	//reason for why that is.
+	Render func() ([]byte, string, error)
+}
+
+type snapshotJob struct {
+	Files       []snapshotFile
+	ProductName string //for the manifest
+	RequestedBy string
+	StartedAt   time.Time
+
+	mutex     sync.Mutex
+	filesDone int
+	result    []byte
+	err       error
+}
+
+var (
+	//key = login name of the admin who requested the snapshot
+	snapshotJobs      = make(map[string]*snapshotJob)
+	snapshotJobsMutex sync.Mutex
+)
+
+func startSnapshotJob(n core.Nexus, src snapshotSources, productName, loginName string) {
+	now := time.Now()
+	job := &snapshotJob{
+		Files:       listSnapshotFiles(n, src),
+		ProductName: productName,
+		RequestedBy: loginName,
+		StartedAt:   now,
+	}
+
+	snapshotJobsMutex.Lock()
+	for otherLoginName, other := range snapshotJobs {
+		if now.Sub(other.StartedAt) > snapshotTimeout {
+			delete(snapshotJobs, otherLoginName)
+		}
+	}
+	snapshotJobs[loginName] = job
+	snapshotJobsMutex.Unlock()
+
+	go job.run()
+}
+
+func findSnapshotJob(loginName string) *snapshotJob {
+	snapshotJobsMutex.Lock()
+	defer snapshotJobsMutex.Unlock()
+	job := snapshotJobs[loginName]
+	if job != nil && time.Since(job.StartedAt) > snapshotTimeout {
+		delete(snapshotJobs, loginName)
+		return nil
+	}
+	return job
+}
+
+func listSnapshotFiles(n core.Nexus, src snapshotSources) []snapshotFile {
+	return []snapshotFile{
+		{
+			Name:        "users.csv",
+			Description: "Users (without password hashes)",
+			Render: func() ([]byte, string, error) {
+				buf, err := buildUsersCSV(n, false)
+				return buf, "", err
+			},
+		},
+		{
+			Name:        "groups.csv",
+			Description: "Groups",
+			Render: func() ([]byte, string, error) {
+				buf, err := buildGroupsCSV(n)
+				return buf, "", err
+			},
+		},
+		{
+			Name:        "directory.ldif",
+			Description: "LDAP directory (without password hashes)",
+			Render: func() ([]byte, string, error) {
+				if src.LDAPObjects == nil {
+					return nil, "the LDAP directory is not available", nil
+				}
+				var entries []ldif.Entry
+				for _, obj := range src.LDAPObjects() {
+					entries = append(entries, ldif.Entry{DN: obj.DN, Attributes: obj.Attributes})
+				}
+				var buf bytes.Buffer
+				err := ldif.Write(&buf, entries)
+				return buf.Bytes(), "", err
+			},
+		},
+		{
+			Name:        "seed-report.json",
+			Description: "Problems and conflicts in the seed (same as `portunusctl seed check`)",
+			Render: func() ([]byte, string, error) {
+				if src.LoadSeed == nil {
+					return nil, "no seed is configured", nil
+				}
+				seed, errs := src.LoadSeed()
+				if seed == nil && errs.IsEmpty() {
+					return nil, "no seed is configured", nil
+				}
+				buf, err := json.MarshalIndent(core.BuildSeedReport(seed, errs, n.ValidationConfig()), "", "  ")
+				return buf, "", err
+			},
+		},
+	}
+}
+
+func (job *snapshotJob) run() {
+	buf, err := job.build()
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.result = buf
+	job.err = err
+}
+
+func (job *snapshotJob) build() ([]byte, error) {
+	var (
+		buf bytes.Buffer
+		//the manifest lists all files with checksums, so that auditors can
+		//check that the files in the snapshot were not altered
+		manifest strings.Builder
+	)
+	fmt.Fprintf(&manifest, "Directory snapshot of %s\n", job.ProductName)
+	fmt.Fprintf(&manifest, "Requested by: %s\n", job.RequestedBy)
+	fmt.Fprintf(&manifest, "Generated at: %s\n", job.StartedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&manifest, "Portunus version: %s\n\n", buildinfo.Get().Version)
+
+	zw := zip.NewWriter(&buf)
+	for _, file := range job.Files {
+		contents, reason, err := file.Render()
+		if err != nil {
+			return nil, fmt.Errorf("cannot render %s: %w", file.Name, err)
+		}
+		if contents == nil {
+			fmt.Fprintf(&manifest, "%s: not included (%s)\n", file.Name, reason)
+		} else {
+			checksum := sha256.Sum256(contents)
+			fmt.Fprintf(&manifest, "%s: %s\n  SHA-256: %s\n", file.Name, file.Description, hex.EncodeToString(checksum[:]))
+			err = writeZipFile(zw, file.Name, job.StartedAt, contents)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		job.mutex.Lock()
+		job.filesDone++
+		job.mutex.Unlock()
+	}
+
+	err := writeZipFile(zw, "MANIFEST.txt", job.StartedAt, []byte(manifest.String()))
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	return buf.Bytes(), err
+}
+
+func writeZipFile(zw *zip.Writer, name string, modified time.Time, contents []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(contents)
+	return err
+}
+
+// snapshotJobStatus is a point-in-time view of a snapshotJob, for rendering.
+type snapshotJobStatus struct {
+	StartedAt   string
+	FilesDone   int
+	FilesTotal  int
+	CurrentFile string //only set while the job is running
+	IsDone      bool
+	Error       string
+}
+
+func (job *snapshotJob) status() snapshotJobStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	s := snapshotJobStatus{
+		StartedAt:  job.StartedAt.UTC().Format(time.RFC3339),
+		FilesDone:  job.filesDone,
+		FilesTotal: len(job.Files),
+		IsDone:     job.result != nil || job.err != nil,
+	}
+	if job.err != nil {
+		s.Error = job.err.Error()
+	}
+	if !s.IsDone && job.filesDone < len(job.Files) {
+		s.CurrentFile = job.Files[job.filesDone].Name
+	}
+	return s
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// handlers
+
+func getSnapshotHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			job := findSnapshotJob(i.CurrentUser.LoginName)
+			if job == nil {
+				return
+			}
+			status := job.status()
+			if status.IsDone {
+				return
+			}
+			//reload until the snapshot is complete (this works without JavaScript)
+			i.writer.Header().Set("Refresh", "1")
+			ShowView(func(_ *Interaction) Page {
+				return Page{
+					Status:   http.StatusOK,
+					Title:    "Directory snapshot",
+					Contents: snapshotProgressSnippet.Render(status),
+				}
+			})(i)
+		},
+		useSnapshotForm,
+		UseEmptyFormState,
+		ShowForm("Directory snapshot"),
+	)
+}
+
+var snapshotProgressSnippet = h.NewSnippet(`
+	<p>Preparing the snapshot that was requested at {{.StartedAt}}. This page reloads automatically.</p>
+	<p>
+		<progress value="{{.FilesDone}}" max="{{.FilesTotal}}">{{.FilesDone}} of {{.FilesTotal}} files</progress><br>
+		{{.FilesDone}} of {{.FilesTotal}} files done{{if .CurrentFile}}, currently rendering <code>{{.CurrentFile}}</code>{{end}}
+	</p>
+`)
+
+func useSnapshotForm(i *Interaction) {
+	var status *snapshotJobStatus
+	if job := findSnapshotJob(i.CurrentUser.LoginName); job != nil {
+		s := job.status()
+		status = &s
+	}
+
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/export/snapshot",
+		SubmitLabel: "Prepare new snapshot",
+		Fields: []h.FormField{
+			h.StaticField{
+				Value: snapshotFormSnippet.Render(status),
+			},
+		},
+	}
+}
+
+var snapshotFormSnippet = h.NewSnippet(`
+	<p>
+		A directory snapshot is a zip file for audit evidence that contains all users and groups as CSV, the LDAP
+		directory as LDIF and the report on problems in the seed. Password hashes are not included. The file
+		<code>MANIFEST.txt</code> in the snapshot records when the snapshot was taken and the SHA-256 checksums of
+		all other files.
+	</p>
+	{{if .}}
+		{{if .Error}}
+			<p>The snapshot that was requested at {{.StartedAt}} could not be prepared: {{.Error}}</p>
+		{{else}}
+			<p>The snapshot that was requested at {{.StartedAt}} is <a href="/export/snapshot.zip">ready for download</a>.</p>
+		{{end}}
+	{{end}}
+`)
+
+func postSnapshotHandler(n core.Nexus, src snapshotSources, productName string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		useSnapshotForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			startSnapshotJob(n, src, productName, i.CurrentUser.LoginName)
+			i.RedirectTo("/export/snapshot")
+		},
+	)
+}
+
+func getSnapshotDownloadHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		func(i *Interaction) {
+			job := findSnapshotJob(i.CurrentUser.LoginName)
+			if job == nil || !job.status().IsDone {
+				i.RedirectTo("/export/snapshot")
+				return
+			}
+			fileName := "portunus-snapshot-" + job.StartedAt.UTC().Format("2006-01-02") + ".zip"
+			serveDownload(fileName, "application/zip", func(_ *Interaction) ([]byte, error) {
+				job.mutex.Lock()
+				defer job.mutex.Unlock()
+				return job.result, job.err
+			})(i)
+		},
+	)
+}
@@ -0,0 +1,155 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/majewsky/portunus/internal/buildinfo"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/ldap"
+)
+
+func getStatusHandler(n core.Nexus, features core.FeatureSet, ldapStatus func() ldap.AdapterStatus, upgradeNotes func() []core.UpgradeNote, canTestBind, hasCapacityReport bool) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		ShowView(func(_ *Interaction) Page {
+			var ldapStatusReport *ldap.AdapterStatus
+			if ldapStatus != nil {
+				report := ldapStatus()
+				ldapStatusReport = &report
+			}
+			var notes []core.UpgradeNote
+			if upgradeNotes != nil {
+				notes = upgradeNotes()
+			}
+			return Page{
+				Status: http.StatusOK,
+				Title:  "System status",
+				Contents: statusPageSnippet.Render(statusPageData{
+					Build:        buildinfo.Get(),
+					Features:     features,
+					UpgradeNotes: notes,
+					Warnings:     core.Database{Users: n.ListUsers(), Groups: n.ListGroups()}.Warnings(n.ValidationConfig()),
+					LDAP:         ldapStatusReport,
+					CanTestBind:  canTestBind,
+
+					HasCapacityReport: hasCapacityReport,
+				}),
+			}
+		}),
+	)
+}
+
+type statusPageData struct {
+	Build        buildinfo.Info
+	Features     core.FeatureSet
+	UpgradeNotes []core.UpgradeNote
+	Warnings     []core.ValidationError
+	LDAP         *ldap.AdapterStatus //nil if there is no LDAP synchronization
+	CanTestBind  bool
+
+	HasCapacityReport bool
+}
+
+var statusPageSnippet = h.NewSnippet(`
+	<h2>Portunus</h2>
+	<table class="table">
+		<tbody>
+			<tr><th>Version</th><td>{{.Build.Version}}</td></tr>
+			<tr><th>Commit</th><td><code>{{.Build.Commit}}</code></td></tr>
+			<tr><th>Go version</th><td>{{.Build.GoVersion}}</td></tr>
+			<tr><th>Enabled features</th><td>{{range $idx, $f := .Features.List}}{{if $idx}}, {{end}}<code>{{$f}}</code>{{else}}<em>none</em>{{end}}</td></tr>
+		</tbody>
+	</table>
+	{{ with .UpgradeNotes }}
+		<h2>Upgrade notes</h2>
+		<p>Please take care of the following points. Each of them disappears from this list once it has been resolved.</p>
+		<ul>
+			{{range .}}<li><strong>{{.Topic}}:</strong> {{.Message}}</li>{{end}}
+		</ul>
+	{{ end }}
+	{{ with .Warnings }}
+		<h2>Warnings</h2>
+		<p>These problems do not prevent any changes, but are likely to cause trouble in systems using the LDAP directory.</p>
+		<ul>
+			{{range .}}<li>{{.Error}}</li>{{end}}
+		</ul>
+	{{ end }}
+	{{ with .LDAP }}
+	<h2>LDAP synchronization</h2>
+	<table class="table">
+		<tbody>
+			<tr><th>Last synchronization</th><td>{{if .LastSyncAt.IsZero}}<em>not yet</em>{{else}}{{.LastSyncAt.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+			<tr><th>Successful writes</th><td>{{.SuccessfulOperations}}</td></tr>
+			<tr><th>Failed writes</th><td>{{.FailedOperations}}</td></tr>
+			<tr><th>Retried writes</th><td>{{.RetriedOperations}}</td></tr>
+			<tr><th>Next retry</th><td>{{if .NextRetryAt.IsZero}}<em>none scheduled</em>{{else}}{{.NextRetryAt.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+		</tbody>
+	</table>
+	{{ if .Failures }}
+		<p>
+			The following objects could not be written into the LDAP directory, so the directory does not reflect their
+			current state. Please check the server log for details.
+		</p>
+		<table class="table responsive">
+			<thead>
+				<tr>
+					<th>Object</th>
+					<th>Operation</th>
+					<th>Error</th>
+					<th>Attempts</th>
+					<th>Failing since</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{range .Failures}}
+					<tr>
+						<td data-label="Object"><code>{{.DN}}</code></td>
+						<td data-label="Operation">{{.ChangeType}}</td>
+						<td data-label="Error">{{.Error}}</td>
+						<td data-label="Attempts">{{.Attempts}}</td>
+						<td data-label="Failing since">{{.FirstFailureAt.Format "2006-01-02 15:04:05 MST"}}</td>
+					</tr>
+				{{end}}
+			</tbody>
+		</table>
+	{{ else }}
+		<p>All objects are in sync with the LDAP directory.</p>
+	{{ end }}
+	{{ end }}
+	{{ if .HasCapacityReport }}
+		<p>
+			To find out how the database has grown over time, and when the limits of the LDAP server might be reached,
+			see the <a href="/status/capacity">capacity planning</a> page.
+		</p>
+	{{ end }}
+	{{ if .CanTestBind }}
+		<p>
+			When an application cannot log in with credentials that work in Portunus, you can
+			<a href="/status/test-bind">test these credentials against the LDAP server</a>.
+		</p>
+	{{ end }}
+`)
+
+// The version endpoint does not require a login, so that deployment tooling
+// and monitoring can check which version is running.
+func getVersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		buf, err := json.Marshal(buildinfo.Get())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(buf)
+	})
+}
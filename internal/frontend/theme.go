@@ -0,0 +1,113 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+)
+
+// The color schemes that users can choose between. With "auto", the
+// prefers-color-scheme setting of the browser decides.
+var themeNames = []string{"auto", "light", "dark"}
+
+// themeFromSession returns the color scheme that the user chose, or "auto" if
+// they did not choose one.
+func themeFromSession(s *sessions.Session) string {
+	if s != nil {
+		if theme, ok := s.Values["theme"].(string); ok && isThemeName(theme) {
+			return theme
+		}
+	}
+	return "auto"
+}
+
+func isThemeName(input string) bool {
+	for _, name := range themeNames {
+		if name == input {
+			return true
+		}
+	}
+	return false
+}
+
+// The switcher is a form with one submit button per theme, so that it works
+// without JavaScript.
+var themeSwitcherSnippet = h.NewSnippet(`
+	<form class="theme-switcher" method="POST" action="/theme">
+		{{.CSRFField}}
+		<input type="hidden" name="return_to" value="{{.ReturnTo}}">
+		<span>{{T "Color scheme:"}}</span>
+		{{- range .Options -}}
+			{{- if .IsCurrent -}}
+				<span class="theme-current">{{T .Label}}</span>
+			{{- else -}}
+				<button type="submit" name="theme" value="{{.Name}}">{{T .Label}}</button>
+			{{- end -}}
+		{{- end -}}
+	</form>
+`)
+
+var themeLabels = map[string]string{
+	"auto":  "Automatic",
+	"light": "Light",
+	"dark":  "Dark",
+}
+
+func renderThemeSwitcher(r *http.Request, currentTheme string, l i18n.Locale) template.HTML {
+	type option struct {
+		Name      string
+		Label     string
+		IsCurrent bool
+	}
+	data := struct {
+		CSRFField template.HTML
+		ReturnTo  string
+		Options   []option
+	}{
+		CSRFField: csrf.TemplateField(r),
+		ReturnTo:  r.URL.RequestURI(),
+	}
+	for _, name := range themeNames {
+		data.Options = append(data.Options, option{name, themeLabels[name], name == currentTheme})
+	}
+	return themeSwitcherSnippet.RenderIn(l, data)
+}
+
+// Handles POST /theme.
+func postThemeHandler() http.Handler {
+	return Do(
+		LoadSession,
+		func(i *Interaction) {
+			theme := i.Req.PostForm.Get("theme")
+			if !isThemeName(theme) {
+				i.WriteError("unknown theme", http.StatusBadRequest)
+				return
+			}
+			if theme == "auto" {
+				delete(i.Session.Values, "theme")
+			} else {
+				i.Session.Values["theme"] = theme
+			}
+		},
+		SaveSession,
+		func(i *Interaction) {
+			//only allow redirects within Portunus
+			returnTo := i.Req.PostForm.Get("return_to")
+			if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+				returnTo = "/"
+			}
+			i.RedirectTo(returnTo)
+		},
+	)
+}
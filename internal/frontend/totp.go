@@ -0,0 +1,512 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
+	"github.com/majewsky/portunus/internal/totp"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Enrolling a second factor works like this:
+//
+//  1. On /self/totp, the user confirms their identity with their password
+//     (and with their current second factor, if they are replacing it).
+//  2. A new key is generated and shown on /self/totp/confirm.
+//  3. The user adds the key to their authenticator app, and proves this by
+//     entering a valid code. Only then is the key stored in the database.
+//
+// Between steps 2 and 3, the key is only held in memory, and only for the
+// session that passed step 1. If the enrollment is not completed within
+// totpEnrollmentTimeout, the key is discarded, and a new key will be generated
+// for the next attempt.
+
+const totpEnrollmentTimeout = 10 * time.Minute
+
+type totpEnrollment struct {
+	ID        string //stored in the session that started the enrollment
+	Key       totp.Key
+	StartedAt time.Time
+}
+
+var (
+	//key = login name (so there can only be one pending enrollment per user)
+	pendingTOTPEnrollments      = make(map[string]totpEnrollment)
+	pendingTOTPEnrollmentsMutex sync.Mutex
+)
+
+func startTOTPEnrollment(issuer, loginName string) (totpEnrollment, error) {
+	key, err := totp.GenerateKey(issuer, loginName)
+	if err != nil {
+		return totpEnrollment{}, err
+	}
+	now := time.Now()
+	enrollment := totpEnrollment{
+		ID:        hex.EncodeToString(core.GenerateRandomKey(16)),
+		Key:       key,
+		StartedAt: now,
+	}
+
+	pendingTOTPEnrollmentsMutex.Lock()
+	defer pendingTOTPEnrollmentsMutex.Unlock()
+	for otherLoginName, other := range pendingTOTPEnrollments {
+		if now.Sub(other.StartedAt) > totpEnrollmentTimeout {
+			delete(pendingTOTPEnrollments, otherLoginName)
+		}
+	}
+	pendingTOTPEnrollments[loginName] = enrollment
+	return enrollment, nil
+}
+
+func findTOTPEnrollment(loginName, id string) (totpEnrollment, bool) {
+	pendingTOTPEnrollmentsMutex.Lock()
+	defer pendingTOTPEnrollmentsMutex.Unlock()
+	enrollment, exists := pendingTOTPEnrollments[loginName]
+	if !exists || enrollment.ID != id {
+		return totpEnrollment{}, false
+	}
+	if time.Since(enrollment.StartedAt) > totpEnrollmentTimeout {
+		delete(pendingTOTPEnrollments, loginName)
+		return totpEnrollment{}, false
+	}
+	return enrollment, true
+}
+
+func finishTOTPEnrollment(loginName string) {
+	pendingTOTPEnrollmentsMutex.Lock()
+	defer pendingTOTPEnrollmentsMutex.Unlock()
+	delete(pendingTOTPEnrollments, loginName)
+}
+
+// Like finishTOTPEnrollment, but only if the pending enrollment belongs to the
+// session with the given enrollment ID.
+func discardTOTPEnrollment(loginName, id string) {
+	pendingTOTPEnrollmentsMutex.Lock()
+	defer pendingTOTPEnrollmentsMutex.Unlock()
+	if pendingTOTPEnrollments[loginName].ID == id {
+		delete(pendingTOTPEnrollments, loginName)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// shared handler steps
+
+// Adds the fields for confirming the current user's identity.
+func buildReauthFields(user core.UserWithPerms) []h.FormField {
+	fields := []h.FormField{
+		h.InputFieldSpec{
+			InputType: "password",
+			Name:      "password",
+			Label:     "Current password",
+			AutoFocus: true,
+		},
+	}
+	if user.TOTPKeyURL != "" {
+		fields = append(fields, h.InputFieldSpec{
+			InputType: "text",
+			Name:      "current_totp_code",
+			Label:     "Code from your current authenticator app",
+		})
+	}
+	return fields
+}
+
+// Checks the fields from buildReauthFields().
+func checkReauth(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		fs := i.FormState
+		user := i.CurrentUser
+		password := fs.Fields["password"].GetValueOrSetError()
+		if password != "" && !n.PasswordHasher().CheckPasswordHash(password, user.PasswordHash) {
+			fs.Fields["password"].ErrorMessage = "is not correct"
+		}
+		if user.TOTPKeyURL != "" {
+			code := fs.Fields["current_totp_code"].GetValueOrSetError()
+			if code != "" && !isValidTOTPCode(user.TOTPKeyURL, code) {
+				fs.Fields["current_totp_code"].ErrorMessage = "is not correct"
+			}
+		}
+	}
+}
+
+func isValidTOTPCode(keyURL, code string) bool {
+	key, err := totp.ParseKeyURL(keyURL)
+	return err == nil && key.Verify(code, time.Now())
+}
+
+var totpStatusSnippet = h.NewSnippet(`
+	{{- if . -}}
+		{{T "Enabled"}}
+	{{- else -}}
+		<em>{{T "Not enabled"}}</em>
+	{{- end }}
+	(<a href="/self/totp">{{T "Manage"}}</a>)
+`)
+
+func renderTOTPStatus(user core.UserWithPerms, l i18n.Locale) template.HTML {
+	return totpStatusSnippet.RenderIn(l, user.TOTPKeyURL != "")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// step 1: /self/totp
+
+var totpIntroSnippet = h.NewSnippet(`
+	<p>
+		{{- if . -}}
+			{{T "Two-factor authentication is enabled for your account."}}
+			{{T "You can move it to a new authenticator app, or %s." (link "/self/totp/disable" (T "disable it"))}}
+		{{- else -}}
+			{{T "Two-factor authentication is not enabled for your account."}}
+			{{T "To enable it, you need an authenticator app that supports time-based one-time passwords (TOTP)."}}
+		{{- end -}}
+	</p>
+	<p>{{T "Please confirm your identity to continue."}}</p>
+`)
+
+func useTOTPStartForm(i *Interaction) {
+	isEnrolled := i.CurrentUser.TOTPKeyURL != ""
+	submitLabel := "Set up authenticator app"
+	if isEnrolled {
+		submitLabel = "Set up new authenticator app"
+	}
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/self/totp",
+		SubmitLabel: submitLabel,
+		Fields: append([]h.FormField{
+			h.StaticField{Value: totpIntroSnippet.RenderIn(i.Locale(), isEnrolled)},
+		}, buildReauthFields(*i.CurrentUser)...),
+	}
+}
+
+// Handles GET /self/totp.
+func getTOTPHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useTOTPStartForm,
+		UseEmptyFormState,
+		ShowForm("Two-factor authentication"),
+	)
+}
+
+// Handles POST /self/totp.
+func postTOTPHandler(n core.Nexus, productName string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		useTOTPStartForm,
+		ReadFormStateFromRequest,
+		checkReauth(n),
+		ShowFormIfErrors("Two-factor authentication"),
+		func(i *Interaction) {
+			enrollment, err := startTOTPEnrollment(productName, i.CurrentUser.LoginName)
+			if err != nil {
+				i.WriteError(err.Error(), http.StatusInternalServerError)
+				return
+			}
+			i.Session.Values["totp_enrollment_id"] = enrollment.ID
+		},
+		SaveSession,
+		RedirectTo("/self/totp/confirm"),
+	)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// steps 2 and 3: /self/totp/confirm
+
+func loadTOTPEnrollment(i *Interaction) {
+	id, _ := i.Session.Values["totp_enrollment_id"].(string)
+	enrollment, exists := findTOTPEnrollment(i.CurrentUser.LoginName, id)
+	if !exists {
+		delete(i.Session.Values, "totp_enrollment_id")
+		msg := "The setup of your authenticator app has expired. Please start again."
+		i.RedirectWithFlashTo("/self/totp", Flash{"danger", msg})
+		return
+	}
+	i.pendingTOTP = &enrollment
+}
+
+var totpKeySnippet = h.NewSnippet(`
+	<p>
+		{{T "Please add the following key to your authenticator app. Most apps allow you to either enter the secret manually, or to paste the full URL."}}
+	</p>
+	<div class="form-row">
+		<label>{{T "Secret"}}</label>
+		<div class="row-value"><code>{{.EncodedSecret}}</code></div>
+	</div>
+	<div class="form-row">
+		<label>URL</label>
+		<div class="row-value"><code>{{.URL}}</code></div>
+	</div>
+	<p>{{T "Then enter the code that your authenticator app shows to complete the setup."}}</p>
+`)
+
+func useTOTPConfirmForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/self/totp/confirm",
+		SubmitLabel: "Enable two-factor authentication",
+		Fields: []h.FormField{
+			h.StaticField{Value: totpKeySnippet.RenderIn(i.Locale(), i.pendingTOTP.Key)},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "totp_code",
+				Label:     "Code from your authenticator app",
+				AutoFocus: true,
+			},
+		},
+	}
+}
+
+// Handles GET /self/totp/confirm.
+func getTOTPConfirmHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		loadTOTPEnrollment,
+		useTOTPConfirmForm,
+		UseEmptyFormState,
+		ShowForm("Set up authenticator app"),
+	)
+}
+
+// Handles POST /self/totp/confirm.
+func postTOTPConfirmHandler(n core.Nexus, secLog securityEventLog) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		loadTOTPEnrollment,
+		useTOTPConfirmForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			i.TargetRef = i.CurrentUser.Ref()
+			field := i.FormState.Fields["totp_code"]
+			code := field.GetValueOrSetError()
+			if code != "" && !i.pendingTOTP.Key.Verify(code, time.Now()) {
+				field.ErrorMessage = "is not correct"
+			}
+		},
+		TryUpdateNexus(n, executeEnableTOTP),
+		ShowFormIfErrors("Set up authenticator app"),
+		func(i *Interaction) {
+			finishTOTPEnrollment(i.CurrentUser.LoginName)
+			delete(i.Session.Values, "totp_enrollment_id")
+			recordSecurityEvent(secLog, i.Req, audit.Event{
+				Type:    audit.EventTOTPEnabled,
+				Actor:   core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName},
+				Subject: i.CurrentUser.LoginName,
+				Message: "two-factor authentication was enabled",
+			})
+			i.RedirectWithFlashTo("/self", Flash{"success", "Two-factor authentication has been enabled."})
+		},
+	)
+}
+
+func executeEnableTOTP(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	for idx, user := range db.Users {
+		if user.LoginName == i.CurrentUser.LoginName {
+			db.Users[idx].TOTPKeyURL = i.pendingTOTP.Key.URL()
+		}
+	}
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// /self/totp/disable
+
+var totpDisableSnippet = h.NewSnippet(`
+	<p>{{T "Please confirm your identity to disable two-factor authentication."}}</p>
+`)
+
+func useTOTPDisableForm(i *Interaction) {
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/self/totp/disable",
+		SubmitLabel: "Disable two-factor authentication",
+		Fields: append([]h.FormField{
+			h.StaticField{Value: totpDisableSnippet.RenderIn(i.Locale(), nil)},
+		}, buildReauthFields(*i.CurrentUser)...),
+	}
+}
+
+func verifyTOTPEnrolled(i *Interaction) {
+	if i.CurrentUser.TOTPKeyURL == "" {
+		i.RedirectTo("/self/totp")
+	}
+}
+
+// Handles GET /self/totp/disable.
+func getTOTPDisableHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		verifyTOTPEnrolled,
+		useTOTPDisableForm,
+		UseEmptyFormState,
+		ShowForm("Disable two-factor authentication"),
+	)
+}
+
+// Handles POST /self/totp/disable.
+func postTOTPDisableHandler(n core.Nexus, secLog securityEventLog) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		verifyTOTPEnrolled,
+		useTOTPDisableForm,
+		ReadFormStateFromRequest,
+		checkReauth(n),
+		func(i *Interaction) { i.TargetRef = i.CurrentUser.Ref() },
+		TryUpdateNexus(n, executeDisableTOTP),
+		ShowFormIfErrors("Disable two-factor authentication"),
+		func(i *Interaction) {
+			recordSecurityEvent(secLog, i.Req, audit.Event{
+				Type:    audit.EventTOTPDisabled,
+				Actor:   core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName},
+				Subject: i.CurrentUser.LoginName,
+				Message: "two-factor authentication was disabled",
+			})
+			i.RedirectWithFlashTo("/self", Flash{"success", "Two-factor authentication has been disabled."})
+		},
+	)
+}
+
+func executeDisableTOTP(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	for idx, user := range db.Users {
+		if user.LoginName == i.CurrentUser.LoginName {
+			db.Users[idx].TOTPKeyURL = ""
+		}
+	}
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// /users/{uid}/reset-totp
+
+// Admins can remove the second factor of users who have lost their
+// authenticator device. Since this weakens the protection of the account,
+// the admin has to record how they verified the user's identity, and the user
+// is notified of the reset on their profile page.
+
+var resetTOTPConfirmSnippet = h.NewSnippet(`
+	<p>
+		Really reset two-factor authentication for user <code>{{.}}</code>? Afterwards, the user can log in with just
+		their password, and set up a new authenticator app on their profile page.
+	</p>
+	<p>
+		Please only do this after verifying that the person requesting the reset is the owner of this account.
+		This action will be recorded in the audit log, and the user will be notified.
+	</p>
+`)
+
+func useResetTOTPForm(i *Interaction) {
+	if i.TargetUser.LoginName == i.CurrentUser.LoginName {
+		msg := "You cannot reset your own two-factor authentication. Please use your profile page instead."
+		i.RedirectWithFlashTo("/users", Flash{"danger", msg})
+		return
+	}
+	if i.TargetUser.TOTPKeyURL == "" {
+		msg := fmt.Sprintf("User %q does not have two-factor authentication enabled.", i.TargetUser.LoginName)
+		i.RedirectWithFlashTo("/users/"+i.TargetUser.LoginName+"/edit", Flash{"danger", msg})
+		return
+	}
+
+	i.FormSpec = &h.FormSpec{
+		PostTarget:  "/users/" + i.TargetUser.LoginName + "/reset-totp",
+		SubmitLabel: "Reset two-factor authentication",
+		Fields: []h.FormField{
+			h.StaticField{
+				Value: resetTOTPConfirmSnippet.Render(i.TargetUser.LoginName),
+			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "verification",
+				Label:     "How did you verify the user's identity?",
+				AutoFocus: true,
+			},
+			h.InputFieldSpec{
+				InputType: "text",
+				Name:      "confirm_login_name",
+				Label:     "Type the login name of the user to confirm",
+			},
+		},
+	}
+}
+
+// Handles GET /users/{uid}/reset-totp.
+func getUserResetTOTPHandler(n core.Nexus) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useResetTOTPForm,
+		UseEmptyFormState,
+		ShowForm("Reset two-factor authentication"),
+	)
+}
+
+// Handles POST /users/{uid}/reset-totp.
+func postUserResetTOTPHandler(n core.Nexus, auditLog *audit.Log) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		useResetTOTPForm,
+		ReadFormStateFromRequest,
+		func(i *Interaction) {
+			i.TargetRef = i.TargetUser.Ref()
+			fs := i.FormState
+			fs.Fields["verification"].GetValueOrSetError()
+			field := fs.Fields["confirm_login_name"]
+			if field.GetValueOrSetError() != "" && field.Value != i.TargetUser.LoginName {
+				field.ErrorMessage = "does not match the login name of this user"
+			}
+		},
+		TryUpdateNexus(n, executeResetTOTP),
+		ShowFormIfErrors("Reset two-factor authentication"),
+		func(i *Interaction) {
+			err := auditLog.Record(audit.Event{
+				Type:    audit.EventTOTPReset,
+				Actor:   core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName},
+				Subject: i.TargetUser.LoginName,
+				Message: "two-factor authentication was reset by an admin",
+				Details: map[string]string{"verification": i.FormState.Fields["verification"].Value},
+				Notify:  true,
+			})
+			if err != nil {
+				//the reset itself cannot be undone at this point, so the admin needs to know
+				logg.Error("could not record TOTP reset for user %q in audit log: %s", i.TargetUser.LoginName, err.Error())
+				msg := "Two-factor authentication has been reset, but the reset could not be recorded in the audit log. Please check the server logs."
+				i.RedirectWithFlashTo("/users", Flash{"danger", msg})
+				return
+			}
+			msg := fmt.Sprintf("Reset two-factor authentication for user %q.", i.TargetUser.LoginName)
+			i.RedirectWithFlashTo("/users", Flash{"success", msg})
+		},
+	)
+}
+
+func executeResetTOTP(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+	for idx, user := range db.Users {
+		if user.LoginName == i.TargetUser.LoginName {
+			db.Users[idx].TOTPKeyURL = ""
+		}
+	}
+	return
+}
@@ -0,0 +1,92 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// When entering the code from their authenticator app during login, users can
+// ask for the browser to be trusted for a while. This is remembered in a
+// signed cookie that outlives the session. The cookie is bound to the user's
+// current TOTP key, so it becomes invalid when two-factor authentication is
+// disabled, reset by an admin, or moved to a new authenticator app.
+const (
+	trustedDeviceCookieName = "portunus-trusted-device"
+	trustedDeviceDuration   = 30 * 24 * time.Hour
+)
+
+// trustedDeviceCookie is built once by HTTPHandler() and passed to the login
+// handlers.
+type trustedDeviceCookie struct {
+	Codec  *securecookie.SecureCookie
+	Secure bool
+}
+
+func newTrustedDeviceCookie(sessionKey []byte, secure bool) trustedDeviceCookie {
+	codec := securecookie.New(sessionKey, nil).
+		MaxAge(int(trustedDeviceDuration.Seconds())).
+		SetSerializer(securecookie.JSONEncoder{})
+	return trustedDeviceCookie{codec, secure}
+}
+
+type trustedDevice struct {
+	LoginName      string `json:"uid"`
+	KeyFingerprint string `json:"key"`
+}
+
+func fingerprintTOTPKey(keyURL string) string {
+	sum := sha256.Sum256([]byte(keyURL))
+	return hex.EncodeToString(sum[:16])
+}
+
+// isTrusted checks whether the request comes from a browser that the given
+// user has asked us to trust.
+func (c trustedDeviceCookie) isTrusted(r *http.Request, user core.User) bool {
+	if user.TOTPKeyURL == "" || c.Codec == nil {
+		return false
+	}
+	cookie, err := r.Cookie(trustedDeviceCookieName)
+	if err != nil {
+		return false
+	}
+	var d trustedDevice
+	err = c.Codec.Decode(trustedDeviceCookieName, cookie.Value, &d)
+	if err != nil {
+		return false
+	}
+	expected := fingerprintTOTPKey(user.TOTPKeyURL)
+	return d.LoginName == user.LoginName && subtle.ConstantTimeCompare([]byte(d.KeyFingerprint), []byte(expected)) == 1
+}
+
+// trust sets the cookie that isTrusted() looks for.
+func (c trustedDeviceCookie) trust(i *Interaction, user core.User) error {
+	value, err := c.Codec.Encode(trustedDeviceCookieName, trustedDevice{
+		LoginName:      user.LoginName,
+		KeyFingerprint: fingerprintTOTPKey(user.TOTPKeyURL),
+	})
+	if err != nil {
+		return err
+	}
+	http.SetCookie(i.writer, &http.Cookie{
+		Name:     trustedDeviceCookieName,
+		Value:    value,
+		Path:     "/login",
+		MaxAge:   int(trustedDeviceDuration.Seconds()),
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
@@ -0,0 +1,270 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package frontend
+
+import (
+	"html/template"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	h "github.com/majewsky/portunus/internal/html"
+	"golang.org/x/crypto/ssh"
+)
+
+// Handles GET /users/{uid}.
+func getUserDetailsHandler(n core.Nexus, auditLog *audit.Log, avatarSource *AvatarSource, userDN func(core.User) string) http.Handler {
+	return Do(
+		LoadSession,
+		VerifyLogin(n),
+		VerifyPermissions(adminPerms),
+		loadTargetUser(n),
+		ShowView(userDetails(n, auditLog, avatarSource, userDN)),
+	)
+}
+
+var userDetailsSnippet = h.NewSnippet(`
+	<div class="button-row">
+		<a href="/users/{{.User.LoginName}}/edit" class="button button-primary">Edit</a>
+		<a href="/users/{{.User.LoginName}}/history" class="button button-secondary">History</a>
+		<a href="/users/{{.User.LoginName}}/delete" class="button button-secondary">Delete</a>
+	</div>
+	<h2>Attributes</h2>
+	<table class="table">
+		<tbody>
+			<tr><th>Login name</th><td>{{.Avatar}}<code>{{.User.LoginName}}</code> {{.SeedBadge}}</td></tr>
+			{{- with .User.FormerLoginNames }}
+				<tr><th>Former login names</th><td>{{range $idx, $n := .}}{{if $idx}}<br>{{end}}<code>{{$n.Name}}</code> (until {{$n.RenamedAt}}){{end}}</td></tr>
+			{{- end }}
+			{{- if .User.Disabled }}
+				<tr><th>Account status</th><td>Disabled (cannot log in)</td></tr>
+			{{- end }}
+			{{- with .User.ValidUntil }}
+				<tr><th>Valid until</th><td>{{.}}</td></tr>
+			{{- end }}
+			<tr><th>Given name</th><td>{{.User.GivenName}}</td></tr>
+			<tr><th>Family name</th><td>{{.User.FamilyName}}</td></tr>
+			{{- if .User.FamilyNameFirst }}
+				<tr><th>Name order</th><td>Family name first</td></tr>
+			{{- end }}
+			{{- if .HasDomains }}
+				<tr><th>Domain</th><td>{{if .User.Domain}}<code>{{.User.Domain}}</code>{{else}}<em>primary domain</em>{{end}}</td></tr>
+			{{- end }}
+			<tr><th>Email address</th><td>{{if .User.EMailAddress}}{{.User.EMailAddress}}{{else}}<em>Not specified</em>{{end}}</td></tr>
+			<tr><th>Telephone number</th><td>{{if .User.TelephoneNumber}}{{.User.TelephoneNumber}}{{else}}<em>Not specified</em>{{end}}</td></tr>
+			<tr><th>Mobile number</th><td>{{if .User.MobileNumber}}{{.User.MobileNumber}}{{else}}<em>Not specified</em>{{end}}</td></tr>
+			<tr><th>Postal address</th><td>{{range $idx, $line := .PostalAddressLines}}{{if $idx}}<br>{{end}}{{$line}}{{else}}<em>Not specified</em>{{end}}</td></tr>
+			<tr><th>Manager</th><td>{{if .User.ManagerLoginName}}<a href="/users/{{.User.ManagerLoginName}}"><code>{{.User.ManagerLoginName}}</code></a>{{else}}<em>None</em>{{end}}</td></tr>
+			<tr><th>Labels</th><td class="comma-separated-list">{{.LabelList}}</td></tr>
+			<tr><th>Photo</th><td>{{if .User.JPEGPhoto}}uploaded{{else}}<em>Not uploaded</em>{{end}}</td></tr>
+			{{- with .DN }}
+				<tr><th>LDAP DN</th><td><code>{{.}}</code></td></tr>
+			{{- end }}
+			{{- with .User.HiddenLDAPAttributes }}
+				<tr>
+					<th>Hidden from LDAP</th>
+					<td class="comma-separated-list">
+						{{- range . -}}
+							<code>{{.}}</code><span class="comma">,&nbsp;</span>
+						{{- end -}}
+					</td>
+				</tr>
+			{{- end }}
+		</tbody>
+	</table>
+	<h2>POSIX attributes</h2>
+	{{- with .User.POSIX }}
+		<table class="table">
+			<tbody>
+				<tr><th>User ID</th><td>{{.UID}}</td></tr>
+				<tr><th>Group ID</th><td>{{.GID}}</td></tr>
+				<tr><th>Home directory</th><td><code>{{.HomeDirectory}}</code></td></tr>
+				<tr><th>Login shell</th><td>{{if .LoginShell}}<code>{{.LoginShell}}</code>{{else}}<em>Not specified</em>{{end}}</td></tr>
+				<tr><th>GECOS</th><td>{{if .GECOS}}{{.GECOS}}{{else}}<em>Not specified</em>{{end}}</td></tr>
+			</tbody>
+		</table>
+	{{- else }}
+		<p>This user is not a POSIX user account.</p>
+	{{- end }}
+	{{- with .ExtraAttributes }}
+		<h2>Extra LDAP attributes</h2>
+		<table class="table">
+			<tbody>
+				{{- range . }}
+					<tr><th><code>{{.Name}}</code></th><td><code>{{.Value}}</code></td></tr>
+				{{- end }}
+			</tbody>
+		</table>
+	{{- end }}
+	<h2>Group memberships</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Group</th>
+				<th>Membership</th>
+				<th>Permissions granted</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Groups}}
+				<tr>
+					<td data-label="Group"><a href="/groups/{{.Group.Name}}">{{.Group.LongName}}</a> (<code>{{.Group.Name}}</code>)</td>
+					<td data-label="Membership">{{if .IsDirect}}direct{{with .ValidUntil}} until {{.}}{{end}}{{else}}through nested group{{end}}</td>
+					<td data-label="Permissions granted">{{.PermissionsText}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="3" class="text-muted">This user is not a member of any groups.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+	<p>Effective permissions: {{.PermissionsText}}</p>
+	<h2>SSH public keys</h2>
+	<table class="table responsive">
+		<thead>
+			<tr>
+				<th>Type</th>
+				<th>Fingerprint</th>
+				<th>Comment</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .SSHKeys}}
+				<tr>
+					<td data-label="Type"><code>{{.Type}}</code></td>
+					<td data-label="Fingerprint"><code>{{.Fingerprint}}</code></td>
+					<td data-label="Comment">{{if .Comment}}{{.Comment}}{{else}}<span class="text-muted">None</span>{{end}}</td>
+				</tr>
+			{{else}}
+				<tr><td colspan="3" class="text-muted">This user has not uploaded any SSH public keys.</td></tr>
+			{{end}}
+		</tbody>
+	</table>
+	<h2>Security</h2>
+	<table class="table">
+		<tbody>
+			<tr>
+				<th>Two-factor authentication</th>
+				<td>
+					{{- if .User.TOTPKeyURL -}}
+						enabled (<a href="/users/{{.User.LoginName}}/reset-totp">reset</a>)
+					{{- else -}}
+						<em>not enabled</em>
+					{{- end -}}
+				</td>
+			</tr>
+			<tr>
+				<th>Last password change</th>
+				<td>
+					{{- with .LastPasswordChange -}}
+						{{.Time.Format "2006-01-02 15:04 MST"}}: {{.Message}}{{with .Actor.Name}} (by <code>{{.}}</code>){{end}}
+					{{- else -}}
+						<em>not recorded in the recent audit log</em>
+					{{- end -}}
+				</td>
+			</tr>
+		</tbody>
+	</table>
+`)
+
+type userDetailsGroupItem struct {
+	Group           core.Group
+	IsDirect        bool
+	ValidUntil      string
+	PermissionsText string
+}
+
+type userDetailsSSHKey struct {
+	Type        string
+	Fingerprint string
+	Comment     string
+}
+
+func userDetails(n core.Nexus, auditLog *audit.Log, avatarSource *AvatarSource, userDN func(core.User) string) func(*Interaction) Page {
+	return func(i *Interaction) Page {
+		user, _ := n.FindUser(func(u core.User) bool { return u.LoginName == i.TargetUser.LoginName })
+
+		data := struct {
+			User               core.User
+			Avatar             template.HTML
+			SeedBadge          template.HTML
+			LabelList          template.HTML
+			DN                 string
+			HasDomains         bool
+			PostalAddressLines []string
+			ExtraAttributes    []struct{ Name, Value string }
+			Groups             []userDetailsGroupItem
+			PermissionsText    string
+			SSHKeys            []userDetailsSSHKey
+			LastPasswordChange *audit.Event
+		}{
+			User:            user.User,
+			Avatar:          renderAvatar(avatarSource, user.User),
+			SeedBadge:       renderSeedBadge(n.SeededFieldsOf(user.Ref())),
+			LabelList:       renderLabelList(user.Labels, "/users"),
+			HasDomains:      len(n.ValidationConfig().Domains) > 0,
+			PermissionsText: describePermissions(user.Perms),
+		}
+		if userDN != nil {
+			data.DN = userDN(user.User)
+		}
+		if user.PostalAddress != "" {
+			data.PostalAddressLines = strings.Split(user.PostalAddress, "\n")
+		}
+
+		attrNames := make([]string, 0, len(user.ExtraAttributes))
+		for name := range user.ExtraAttributes {
+			attrNames = append(attrNames, name)
+		}
+		sort.Strings(attrNames)
+		for _, name := range attrNames {
+			data.ExtraAttributes = append(data.ExtraAttributes, struct{ Name, Value string }{name, user.ExtraAttributes[name]})
+		}
+
+		//GroupMemberships includes memberships through nested groups, so we need
+		//to look at the unresolved groups to see which memberships are direct
+		memberships := slices.Clone(user.GroupMemberships)
+		sort.Slice(memberships, func(i, j int) bool { return memberships[i].Name < memberships[j].Name })
+		for _, group := range memberships {
+			unresolved, _ := n.FindGroup(func(g core.Group) bool { return g.Name == group.Name })
+			data.Groups = append(data.Groups, userDetailsGroupItem{
+				Group:           group,
+				IsDirect:        unresolved.MemberLoginNames[user.LoginName],
+				ValidUntil:      unresolved.MemberValidUntil[user.LoginName],
+				PermissionsText: describePermissions(group.Permissions),
+			})
+		}
+
+		for _, key := range user.SSHPublicKeys {
+			//the keys have been validated when they were stored
+			pubkey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+			if err != nil {
+				continue
+			}
+			data.SSHKeys = append(data.SSHKeys, userDetailsSSHKey{
+				Type:        pubkey.Type(),
+				Fingerprint: ssh.FingerprintSHA256(pubkey),
+				Comment:     comment,
+			})
+		}
+
+		for _, e := range auditLog.ListEventsForSubject(user.LoginName) {
+			if e.Type == audit.EventPasswordChange {
+				data.LastPasswordChange = &e
+				break
+			}
+		}
+
+		return Page{
+			Status:   http.StatusOK,
+			Title:    "User " + user.LoginName,
+			Contents: userDetailsSnippet.Render(data),
+		}
+	}
+}
@@ -7,12 +7,18 @@
 package frontend
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
+	"slices"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/majewsky/portunus/internal/audit"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/crypt"
 	h "github.com/majewsky/portunus/internal/html"
@@ -25,32 +31,37 @@ var adminPerms = core.Permissions{
 	},
 }
 
-func getUsersHandler(n core.Nexus) http.Handler {
+func getUsersHandler(n core.Nexus, avatarSource *AvatarSource) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
-		ShowView(usersList(n)),
+		ShowView(usersList(n, avatarSource)),
 	)
 }
 
 var usersListSnippet = h.NewSnippet(`
+	{{.FilterNotice}}
+	{{.SearchBox}}
 	<table class="table responsive">
 		<thead>
 			<tr>
-				<th>Login name</th>
-				<th>Full name</th>
-				<th>POSIX ID</th>
+				<th>{{.Query.RenderSortHeader "Login name" "login_name"}}</th>
+				<th>{{.Query.RenderSortHeader "Full name" "full_name"}}</th>
+				<th>{{.Query.RenderSortHeader "POSIX ID" "posix_id"}}</th>
 				<th>Groups</th>
+				<th>Labels</th>
 				<th class="actions">
 					<a href="/users/new" class="button button-primary">New user</a>
+					<a href="/export" class="button button-secondary">Export</a>
+					{{if .HasDeactivatedUsers}}<a href="/users/deactivated" class="button button-secondary">Deactivated users</a>{{end}}
 				</th>
 			</tr>
 		</thead>
 		<tbody>
-			{{range .}}
+			{{range .Users}}
 				<tr>
-					<td data-label="Login name"><code>{{.User.LoginName}}</code></td>
+					<td data-label="Login name">{{.Avatar}}<a href="/users/{{.User.LoginName}}"><code>{{.User.LoginName}}</code></a> {{.SeedBadge}}{{if .User.Disabled}} <span class="badge badge-danger" title="This user cannot log in.">disabled</span>{{end}}</td>
 					<td data-label="Full name">{{.UserFullName}}</td>
 					{{ if .User.POSIX -}}
 						<td data-label="POSIX ID">{{.User.POSIX.UID}}</td>
@@ -59,44 +70,95 @@ var usersListSnippet = h.NewSnippet(`
 					{{- end }}
 					<td data-label="Groups" class="comma-separated-list">
 						{{- range .Groups -}}
-						<a href="/groups/{{.Name}}/edit">{{.LongName}}</a><span class="comma">,&nbsp;</span>
+						<a href="/groups/{{.Name}}">{{.LongName}}</a><span class="comma">,&nbsp;</span>
 						{{- end -}}
 					</td>
+					<td data-label="Labels" class="comma-separated-list">{{.LabelList}}</td>
 					<td class="actions">
 						<a href="/users/{{.User.LoginName}}/edit">Edit</a>
 						·
+						<a href="/users/{{.User.LoginName}}/history">History</a>
+						·
 						<a href="/users/{{.User.LoginName}}/delete">Delete</a>
 					</td>
 				</tr>
 			{{end}}
 		</tbody>
 	</table>
+	{{.Pagination}}
 `)
 
-func usersList(n core.Nexus) func(*Interaction) Page {
-	return func(_ *Interaction) Page {
+// The sort keys for the user list. The first one is the default.
+var usersListSortKeys = []string{"login_name", "full_name", "posix_id"}
+
+func compareUsersBy(sortKey string) func(a, b core.User) int {
+	switch sortKey {
+	case "full_name":
+		return func(a, b core.User) int {
+			return cmp.Or(cmp.Compare(strings.ToLower(a.FullName()), strings.ToLower(b.FullName())), cmp.Compare(a.LoginName, b.LoginName))
+		}
+	case "posix_id":
+		//users without POSIX attributes come first
+		posixID := func(u core.User) int64 {
+			if u.POSIX == nil {
+				return -1
+			}
+			return int64(u.POSIX.UID)
+		}
+		return func(a, b core.User) int {
+			return cmp.Or(cmp.Compare(posixID(a), posixID(b)), cmp.Compare(a.LoginName, b.LoginName))
+		}
+	default:
+		return func(a, b core.User) int { return cmp.Compare(a.LoginName, b.LoginName) }
+	}
+}
+
+func usersList(n core.Nexus, avatarSource *AvatarSource) func(*Interaction) Page {
+	return func(i *Interaction) Page {
 		groups := n.ListGroups()
 		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		query := listQueryFromRequest(i, "/users", usersListSortKeys, formerNamesListFilter)
 		users := n.ListUsers()
-		sort.Slice(users, func(i, j int) bool { return users[i].LoginName < users[j].LoginName })
+		users = slices.DeleteFunc(users, func(u core.User) bool {
+			return !u.Labels.MatchesAll(query.Labels) || (!query.MatchesSearch(u.LoginName, u.FullName(), u.EMailAddress) && !query.MatchesFormerNames(u.FormerLoginNames))
+		})
+		slices.SortFunc(users, listSortFunc(query, compareUsersBy(query.SortKey)))
 
 		type userItem struct {
 			User         core.User
 			UserFullName string
 			Groups       []core.Group
+			LabelList    template.HTML
+			SeedBadge    template.HTML
+			Avatar       template.HTML
+		}
+		var data struct {
+			Users               []userItem
+			Query               listQuery
+			FilterNotice        template.HTML
+			SearchBox           template.HTML
+			Pagination          template.HTML
+			HasDeactivatedUsers bool
 		}
-		data := make([]userItem, len(users))
-		for idx, user := range users {
+		users, data.Pagination = paginateList(&query, users, "users")
+		data.Query = query
+		data.FilterNotice = renderLabelFilterNotice(query.Labels, "users", "/users")
+		data.SearchBox = query.RenderSearchBox("Login name, full name or email address", formerNamesListFilter)
+		data.HasDeactivatedUsers = len(n.ListDeactivatedUsers()) > 0
+		for _, user := range users {
 			item := userItem{
 				User:         user,
 				UserFullName: user.FullName(),
+				LabelList:    renderLabelList(user.Labels, "/users"),
+				SeedBadge:    renderSeedBadge(n.SeededFieldsOf(user.Ref())),
+				Avatar:       renderAvatar(avatarSource, user),
 			}
 			for _, group := range groups {
 				if group.ContainsUser(user) {
 					item.Groups = append(item.Groups, group)
 				}
 			}
-			data[idx] = item
+			data.Users = append(data.Users, item)
 		}
 
 		return Page{
@@ -127,12 +189,30 @@ func useUserForm(n core.Nexus) HandlerStep {
 
 		i.FormSpec.Fields = append(i.FormSpec.Fields,
 			buildUserMasterdataFieldset(n, i.TargetUser, i.FormState),
-			buildUserPosixFieldset(i.TargetUser, i.FormState),
+			buildUserPosixFieldset(n.ValidationConfig(), i.TargetUser, i.FormState),
 			buildUserPasswordFieldset(i.TargetUser),
 		)
+		if names := n.ValidationConfig().ExtraUserAttributes; len(names) > 0 {
+			i.FormSpec.Fields = append(i.FormSpec.Fields,
+				buildUserExtraAttributesFieldset(names, i.TargetUser, i.FormState))
+		}
+		if i.TargetUser != nil && i.TargetUser.TOTPKeyURL != "" {
+			i.FormSpec.Fields = append(i.FormSpec.Fields, h.StaticField{
+				Label: "Two-factor authentication",
+				Value: userTOTPResetSnippet.Render(i.TargetUser.LoginName),
+			})
+		}
+		if i.TargetUser != nil {
+			sf := n.SeededFieldsOf(i.TargetUser.Ref())
+			i.FormSpec.Fields = markSeededFields(i.FormSpec.Fields, sf, i.FormState)
+		}
 	}
 }
 
+var userTOTPResetSnippet = h.NewSnippet(`
+	Enabled (<a href="/users/{{.}}/reset-totp">Reset</a>)
+`)
+
 func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState) h.FormField {
 	var fields []h.FormField
 	if u == nil {
@@ -148,6 +228,14 @@ func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState)
 		})
 	}
 
+	var domain string
+	if u != nil {
+		domain = u.Domain
+	}
+	if field, ok := buildDomainField(n, domain, state); ok {
+		fields = append(fields, field)
+	}
+
 	fields = append(fields,
 		h.InputFieldSpec{
 			InputType: "text",
@@ -159,24 +247,81 @@ func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState)
 			Name:      "family_name",
 			Label:     "Family name",
 		},
+		h.SelectFieldSpec{
+			Name:  "family_name_first",
+			Label: "Name order",
+			Options: []h.SelectOptionSpec{{
+				Value: "yes",
+				Label: "Family name first (e.g. for East Asian or Hungarian names)",
+			}},
+		},
 		h.InputFieldSpec{
 			InputType: "text",
 			Name:      "email",
 			Label:     "Email address (optional in Portunus, but required by some services)",
 		},
+		h.InputFieldSpec{
+			InputType: "tel",
+			Name:      "telephone_number",
+			Label:     "Telephone number (optional)",
+		},
+		h.InputFieldSpec{
+			InputType: "tel",
+			Name:      "mobile",
+			Label:     "Mobile number (optional)",
+		},
+		h.MultilineInputFieldSpec{
+			Name:  "postal_address",
+			Label: "Postal address (optional)",
+		},
+		h.InputFieldSpec{
+			InputType: "text",
+			Name:      "manager",
+			Label:     "Manager (login name, optional)",
+		},
 		h.MultilineInputFieldSpec{
 			Name:  "ssh_public_keys",
 			Label: "SSH public key(s)",
 		},
+		buildUserLDAPPrivacyField(u, state),
+		h.SelectFieldSpec{
+			Name:  "disabled",
+			Label: "Account status",
+			Options: []h.SelectOptionSpec{{
+				Value: "yes",
+				Label: "Disabled (cannot log in)",
+			}},
+		},
+		h.InputFieldSpec{
+			InputType: "date",
+			Name:      "valid_until",
+			Label:     "Valid until (optional)",
+		},
 	)
+	var labels core.Labels
 	if u != nil {
+		labels = u.Labels
+		state.Fields["disabled"] = &h.FieldState{
+			Selected: map[string]bool{"yes": u.Disabled},
+		}
+		state.Fields["valid_until"] = &h.FieldState{Value: u.ValidUntil}
 		state.Fields["given_name"] = &h.FieldState{Value: u.GivenName}
 		state.Fields["family_name"] = &h.FieldState{Value: u.FamilyName}
+		state.Fields["family_name_first"] = &h.FieldState{
+			Selected: map[string]bool{"yes": u.FamilyNameFirst},
+		}
 		state.Fields["email"] = &h.FieldState{Value: u.EMailAddress}
+		state.Fields["telephone_number"] = &h.FieldState{Value: u.TelephoneNumber}
+		state.Fields["mobile"] = &h.FieldState{Value: u.MobileNumber}
+		state.Fields["postal_address"] = &h.FieldState{
+			Value: strings.ReplaceAll(u.PostalAddress, "\n", "\r\n"),
+		}
+		state.Fields["manager"] = &h.FieldState{Value: u.ManagerLoginName}
 		state.Fields["ssh_public_keys"] = &h.FieldState{
 			Value: strings.Join(u.SSHPublicKeys, "\r\n"),
 		}
 	}
+	fields = append(fields, buildLabelsField(labels, state))
 
 	allGroups := n.ListGroups()
 	sort.Slice(allGroups, func(i, j int) bool {
@@ -193,9 +338,13 @@ func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState)
 			isGroupSelected[group.Name] = group.ContainsUser(*u)
 		}
 	}
+	membershipsLabel := "Group memberships"
+	if u == nil {
+		membershipsLabel = "Group memberships (in addition to the default memberships for new users)"
+	}
 	fields = append(fields, h.SelectFieldSpec{
 		Name:    "memberships",
-		Label:   "Group memberships",
+		Label:   membershipsLabel,
 		Options: groupOpts,
 	})
 	state.Fields["memberships"] = &h.FieldState{Selected: isGroupSelected}
@@ -207,6 +356,65 @@ func buildUserMasterdataFieldset(n core.Nexus, u *core.User, state *h.FormState)
 	}
 }
 
+// Builds the field for User.HiddenLDAPAttributes. This field appears on the
+// user form and, if allowed, on the self-service form.
+func buildUserLDAPPrivacyField(u *core.User, state *h.FormState) h.FormField {
+	labels := map[string]string{
+		"mail":         "Email address",
+		"sshPublicKey": "SSH public key(s)",
+		"jpegPhoto":    "Photo",
+	}
+	var opts []h.SelectOptionSpec
+	isHidden := make(map[string]bool)
+	for _, name := range core.HideableUserLDAPAttributes {
+		opts = append(opts, h.SelectOptionSpec{Value: name, Label: labels[name]})
+		isHidden[name] = u != nil && u.HidesLDAPAttribute(name)
+	}
+	state.Fields["hidden_ldap_attributes"] = &h.FieldState{Selected: isHidden}
+	return h.SelectFieldSpec{
+		Name:    "hidden_ldap_attributes",
+		Label:   "Hide from the LDAP directory (the values are still kept in Portunus)",
+		Options: opts,
+	}
+}
+
+// Reads the field built by buildUserLDAPPrivacyField.
+func readUserLDAPPrivacyField(fs *h.FormState) (result []string) {
+	for _, name := range core.HideableUserLDAPAttributes {
+		if fs.Fields["hidden_ldap_attributes"].Selected[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Builds the field for selecting the domain of a user or group. If there are
+// no additional domains, no field is shown and false is returned.
+func buildDomainField(n core.Nexus, current string, state *h.FormState) (h.FormField, bool) {
+	domainNames := n.ValidationConfig().Domains
+	if len(domainNames) == 0 {
+		return nil, false
+	}
+	opts := []h.SelectOptionSpec{{Value: "", Label: "Primary domain"}}
+	for _, name := range domainNames {
+		opts = append(opts, h.SelectOptionSpec{Value: name, Label: name})
+	}
+	state.Fields["domain"] = &h.FieldState{Value: current}
+	return h.DropdownFieldSpec{
+		Name:    "domain",
+		Label:   "Domain",
+		Options: opts,
+	}, true
+}
+
+// Reads the field from buildDomainField(), if it was shown.
+func readDomainField(fs *h.FormState) string {
+	if field := fs.Fields["domain"]; field != nil {
+		return field.Value
+	}
+	return ""
+}
+
 func buildUserPasswordFieldset(u *core.User) h.FormField {
 	fields := []h.FormField{
 		h.InputFieldSpec{
@@ -236,7 +444,29 @@ func buildUserPasswordFieldset(u *core.User) h.FormField {
 	}
 }
 
-func buildUserPosixFieldset(u *core.User, state *h.FormState) h.FormField {
+const extraAttributeFieldPrefix = "extra_attributes."
+
+func buildUserExtraAttributesFieldset(names []string, u *core.User, state *h.FormState) h.FormField {
+	var fields []h.FormField
+	for _, name := range names {
+		fieldName := extraAttributeFieldPrefix + name
+		fields = append(fields, h.InputFieldSpec{
+			InputType: "text",
+			Name:      fieldName,
+			Label:     name,
+		})
+		if u != nil {
+			state.Fields[fieldName] = &h.FieldState{Value: u.ExtraAttributes[name]}
+		}
+	}
+	return h.FieldSet{
+		Label:      "Additional LDAP attributes (optional)",
+		IsFoldable: false,
+		Fields:     fields,
+	}
+}
+
+func buildUserPosixFieldset(cfg *core.ValidationConfig, u *core.User, state *h.FormState) h.FormField {
 	if u != nil && u.POSIX != nil {
 		state.Fields["posix"] = &h.FieldState{IsUnfolded: true}
 		state.Fields["posix_uid"] = &h.FieldState{Value: u.POSIX.UID.String()}
@@ -246,6 +476,16 @@ func buildUserPosixFieldset(u *core.User, state *h.FormState) h.FormField {
 		state.Fields["posix_gecos"] = &h.FieldState{Value: u.POSIX.GECOS}
 	}
 
+	//when creating a user, the home directory is filled in by executeCreateUser()
+	//if left empty, since it depends on the login name
+	homeLabel := "Home directory"
+	if u == nil {
+		state.Fields["posix_shell"] = &h.FieldState{Value: cfg.DefaultLoginShell}
+		if cfg.DefaultHomePrefix != "" {
+			homeLabel = fmt.Sprintf("Home directory (default: %s)", cfg.DefaultHomeDirectory("<login name>"))
+		}
+	}
+
 	return h.FieldSet{
 		Name:       "posix",
 		Label:      "Is a POSIX user account",
@@ -263,7 +503,7 @@ func buildUserPosixFieldset(u *core.User, state *h.FormState) h.FormField {
 			},
 			h.InputFieldSpec{
 				Name:      "posix_home",
-				Label:     "Home directory",
+				Label:     homeLabel,
 				InputType: "text",
 			},
 			h.InputFieldSpec{
@@ -287,21 +527,36 @@ func getUserEditHandler(n core.Nexus) http.Handler {
 		VerifyPermissions(adminPerms),
 		loadTargetUser(n),
 		useUserForm(n),
+		addFormVersion,
 		ShowForm("Edit user"),
 	)
 }
 
-func postUserEditHandler(n core.Nexus) http.Handler {
+func postUserEditHandler(n core.Nexus, secLog securityEventLog) http.Handler {
 	return Do(
 		LoadSession,
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetUser(n),
 		useUserForm(n),
-		ReadFormStateFromRequest,
+		addFormVersion,
+		ReadFormStateWithMerge,
 		validateUserForm,
 		TryUpdateNexus(n, executeEditUser),
 		ShowFormIfErrors("Edit user"),
+		func(i *Interaction) {
+			if i.FormState.Fields["reset_password"].IsUnfolded {
+				recordSecurityEvent(secLog, i.Req, audit.Event{
+					Type:    audit.EventPasswordChange,
+					Actor:   core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName},
+					Subject: i.TargetUser.LoginName,
+					Message: "password was changed by an admin",
+				})
+				keepCurrentSession(i, i.TargetUser.LoginName)
+				i.Session.AddFlash(Flash{"primary", fmt.Sprintf("All other sessions of user %q have been ended.", i.TargetUser.LoginName)})
+			}
+		},
+		FlashWarnings(n),
 		RedirectWithFlashTo("/users", "Updated"),
 	)
 }
@@ -313,6 +568,10 @@ func loadTargetUser(n core.Nexus) HandlerStep {
 		if exists {
 			i.TargetUser = &user.User
 			i.TargetRef = user.User.Ref()
+		} else if user, exists := n.FindUser(func(u core.User) bool { return core.MatchesFormerName(u.FormerLoginNames, userLoginName) }); exists {
+			//keep links from before a rename working
+			msg := fmt.Sprintf("User %q has been renamed to %q.", userLoginName, user.LoginName)
+			i.RedirectWithFlashTo("/users/"+user.LoginName, Flash{"primary", msg})
 		} else {
 			msg := fmt.Sprintf("User %q does not exist.", userLoginName)
 			i.RedirectWithFlashTo("/users", Flash{"danger", msg})
@@ -325,10 +584,39 @@ func buildUserFromFormState(fs *h.FormState, loginName, passwordHash string) (re
 		LoginName:     loginName,
 		GivenName:     fs.Fields["given_name"].Value,
 		FamilyName:    fs.Fields["family_name"].Value,
+		Domain:        readDomainField(fs),
 		EMailAddress:  fs.Fields["email"].Value,
 		SSHPublicKeys: core.SplitSSHPublicKeys(fs.Fields["ssh_public_keys"].Value),
 		PasswordHash:  passwordHash,
 		POSIX:         nil,
+
+		TelephoneNumber: fs.Fields["telephone_number"].Value,
+		MobileNumber:    fs.Fields["mobile"].Value,
+		PostalAddress:   core.SplitPostalAddress(fs.Fields["postal_address"].Value),
+
+		ManagerLoginName:     strings.TrimSpace(fs.Fields["manager"].Value),
+		HiddenLDAPAttributes: readUserLDAPPrivacyField(fs),
+	}
+	if fs.Fields["family_name_first"] != nil {
+		result.FamilyNameFirst = fs.Fields["family_name_first"].Selected["yes"]
+	}
+	if fs.Fields["disabled"] != nil {
+		result.Disabled = fs.Fields["disabled"].Selected["yes"]
+	}
+	if fs.Fields["valid_until"] != nil {
+		result.ValidUntil = strings.TrimSpace(fs.Fields["valid_until"].Value)
+	}
+	labels, err := core.ParseLabels(fs.Fields["labels"].Value, result.Ref().Field("labels"))
+	result.Labels = labels
+	errs.Add(err)
+	for fieldName, field := range fs.Fields {
+		name, ok := strings.CutPrefix(fieldName, extraAttributeFieldPrefix)
+		if ok && strings.TrimSpace(field.Value) != "" {
+			if result.ExtraAttributes == nil {
+				result.ExtraAttributes = make(core.ExtraAttributes)
+			}
+			result.ExtraAttributes[name] = field.Value
+		}
 	}
 	if fs.Fields["posix"].IsUnfolded {
 		uid, err := core.ParsePosixID(fs.Fields["posix_uid"].Value, result.Ref().Field("posix_uid"))
@@ -367,6 +655,17 @@ func executeEditUser(db *core.Database, i *Interaction, hasher crypt.PasswordHas
 	}
 
 	newUser, errs := buildUserFromFormState(i.FormState, i.TargetUser.LoginName, passwordHash)
+	//the second factor, the photo and the former login names are not part of
+	//the form, so they need to be carried over
+	oldUser, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == newUser.LoginName })
+	if exists {
+		newUser.TOTPKeyURL = oldUser.TOTPKeyURL
+		newUser.JPEGPhoto = oldUser.JPEGPhoto
+		newUser.FormerLoginNames = oldUser.FormerLoginNames
+	}
+	if newUser.Disabled && newUser.LoginName == i.CurrentUser.LoginName {
+		errs.Add(newUser.Ref().Field("disabled").Wrap(errors.New("cannot be set on your own account")))
+	}
 	errs.Add(db.Users.Update(newUser))
 
 	isMemberOf := i.FormState.Fields["memberships"].Selected
@@ -398,29 +697,36 @@ func postUsersNewHandler(n core.Nexus) http.Handler {
 		useUserForm(n),
 		ReadFormStateFromRequest,
 		validateUserForm,
-		TryUpdateNexus(n, executeCreateUser),
+		TryUpdateNexus(n, executeCreateUser(n.ValidationConfig())),
 		ShowFormIfErrors("Create user"),
+		FlashWarnings(n),
 		RedirectWithFlashTo("/users", "Created"),
 	)
 }
 
-func executeCreateUser(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
-	loginName := i.FormState.Fields["login_name"].Value
-	passwordHash := hasher.HashPassword(i.FormState.Fields["password"].Value)
-
-	newUser, errs := buildUserFromFormState(i.FormState, loginName, passwordHash)
-	i.TargetRef = newUser.Ref()
-	db.Users = append(db.Users, newUser)
+func executeCreateUser(cfg *core.ValidationConfig) func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet {
+	return func(db *core.Database, i *Interaction, hasher crypt.PasswordHasher) errext.ErrorSet {
+		loginName := i.FormState.Fields["login_name"].Value
+		passwordHash := hasher.HashPassword(i.FormState.Fields["password"].Value)
 
-	isMemberOf := i.FormState.Fields["memberships"].Selected
-	for idx := range db.Groups {
-		group := &db.Groups[idx]
-		if group.MemberLoginNames == nil {
-			group.MemberLoginNames = make(map[string]bool)
+		newUser, errs := buildUserFromFormState(i.FormState, loginName, passwordHash)
+		if newUser.POSIX != nil && strings.TrimSpace(newUser.POSIX.HomeDirectory) == "" {
+			newUser.POSIX.HomeDirectory = cfg.DefaultHomeDirectory(loginName)
+		}
+		i.TargetRef = newUser.Ref()
+		db.Users = append(db.Users, newUser)
+
+		isMemberOf := i.FormState.Fields["memberships"].Selected
+		for idx := range db.Groups {
+			group := &db.Groups[idx]
+			if group.MemberLoginNames == nil {
+				group.MemberLoginNames = make(map[string]bool)
+			}
+			group.MemberLoginNames[loginName] = isMemberOf[group.Name]
 		}
-		group.MemberLoginNames[loginName] = isMemberOf[group.Name]
+		db.AddDefaultMemberships(newUser)
+		return errs
 	}
-	return errs
 }
 
 func getUserDeleteHandler(n core.Nexus) http.Handler {
@@ -429,30 +735,42 @@ func getUserDeleteHandler(n core.Nexus) http.Handler {
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetUser(n),
-		useDeleteUserForm,
+		useDeleteUserForm(n),
 		UseEmptyFormState,
 		ShowForm("Confirm user deletion"),
 	)
 }
 
 var deleteUserConfirmSnippet = h.NewSnippet(`
-	<p>Really delete user <code>{{.}}</code>? This cannot be undone.</p>
+	{{if .RetentionDays}}
+		<p>
+			Really delete user <code>{{.LoginName}}</code>? The user will be removed from LDAP right away, but can be
+			restored from the <a href="/users/deactivated">deactivated users</a> for the next {{.RetentionDays}} day(s).
+		</p>
+	{{else}}
+		<p>Really delete user <code>{{.LoginName}}</code>? This cannot be undone.</p>
+	{{end}}
 `)
 
-func useDeleteUserForm(i *Interaction) {
-	if i.TargetUser.LoginName == i.CurrentUser.LoginName {
-		i.RedirectWithFlashTo("/users", Flash{"danger", "You cannot delete yourself."})
-		return
-	}
+func useDeleteUserForm(n core.Nexus) HandlerStep {
+	return func(i *Interaction) {
+		if i.TargetUser.LoginName == i.CurrentUser.LoginName {
+			i.RedirectWithFlashTo("/users", Flash{"danger", "You cannot delete yourself."})
+			return
+		}
 
-	i.FormSpec = &h.FormSpec{
-		PostTarget:  "/users/" + i.TargetUser.LoginName + "/delete",
-		SubmitLabel: "Delete user",
-		Fields: []h.FormField{
-			h.StaticField{
-				Value: deleteUserConfirmSnippet.Render(i.TargetUser.LoginName),
+		i.FormSpec = &h.FormSpec{
+			PostTarget:  "/users/" + i.TargetUser.LoginName + "/delete",
+			SubmitLabel: "Delete user",
+			Fields: []h.FormField{
+				h.StaticField{
+					Value: deleteUserConfirmSnippet.Render(struct {
+						LoginName     string
+						RetentionDays uint
+					}{i.TargetUser.LoginName, n.ValidationConfig().UserRetentionDays}),
+				},
 			},
-		},
+		}
 	}
 }
 
@@ -462,22 +780,17 @@ func postUserDeleteHandler(n core.Nexus) http.Handler {
 		VerifyLogin(n),
 		VerifyPermissions(adminPerms),
 		loadTargetUser(n),
-		useDeleteUserForm,
+		useDeleteUserForm(n),
 		UseEmptyFormState,
-		TryUpdateNexus(n, executeDeleteUser),
+		TryUpdateNexus(n, executeDeleteUser(n.ValidationConfig())),
 		ShowFormIfErrors("Confirm user deletion"),
 		RedirectWithFlashTo("/users", "Deleted"),
 	)
 }
 
-func executeDeleteUser(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
-	userLoginName := i.TargetUser.LoginName
-	errs.Add(db.Users.Delete(userLoginName))
-
-	for _, group := range db.Groups {
-		if group.MemberLoginNames != nil {
-			group.MemberLoginNames[userLoginName] = false
-		}
+func executeDeleteUser(cfg *core.ValidationConfig) func(*core.Database, *Interaction, crypt.PasswordHasher) errext.ErrorSet {
+	return func(db *core.Database, i *Interaction, _ crypt.PasswordHasher) (errs errext.ErrorSet) {
+		errs.Add(db.DeactivateUser(i.TargetUser.LoginName, core.Actor{Type: core.ActorTypeUser, Name: i.CurrentUser.LoginName}, time.Now(), cfg))
+		return
 	}
-	return
 }
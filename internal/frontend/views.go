@@ -7,6 +7,7 @@
 package frontend
 
 import (
+	"context"
 	"encoding/gob"
 	"html/template"
 	"net/http"
@@ -15,75 +16,120 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/majewsky/portunus/internal/core"
 	h "github.com/majewsky/portunus/internal/html"
+	"github.com/majewsky/portunus/internal/i18n"
 )
 
 var mainSnippet = h.NewSnippet(`
 	<!DOCTYPE html>
-	<html>
+	<html lang="{{.Lang}}"{{if ne .Theme "auto"}} class="theme-{{.Theme}}"{{end}}>
 		<head>
 			<meta charset="utf-8">
 			<meta http-equiv="X-UA-Compatible" content="IE=edge" />
 			<meta name="viewport" content="width=device-width, initial-scale=1">
 			<title>
 				{{- if .Page.Title -}}
-					{{ .Page.Title }} - Portunus
+					{{ T .Page.Title }} - {{ .Branding.ProductName }}
 				{{- else -}}
-					Portunus
+					{{ .Branding.ProductName }}
 				{{- end -}}
 			</title>
 			<link rel="stylesheet" type="text/css" href="/static/css/portunus.css" />
+			{{- if .Branding.ThemeStylesheet }}
+				<link rel="stylesheet" type="text/css" href="/branding/theme.css" />
+			{{- end }}
 		</head>
 		<body {{if .Page.Wide}}class="wide"{{end}}>
 			<nav id="nav">
 				<div id="nav-bar">
 					<div id="nav-title">
-						<img src="/static/img/logo-for-menubar.png" alt="Site logo">
+						<img src="{{.Branding.LogoURL}}" alt="{{T "Site logo"}}">
 					</div>
 					<a id="nav-fold" href="#">
-						<img src="/static/img/logo-for-menubar.png" alt="Site logo">
-						<span>Close menu</span>
+						<img src="{{.Branding.LogoURL}}" alt="{{T "Site logo"}}">
+						<span>{{T "Close menu"}}</span>
 					</a>
 					<a id="nav-unfold" href="#nav">
-						<img src="/static/img/logo-for-menubar.png" alt="Site logo">
-						<span>{{.Page.Title}} - Portunus</span>
+						<img src="{{.Branding.LogoURL}}" alt="{{T "Site logo"}}">
+						<span>{{T .Page.Title}} - {{.Branding.ProductName}}</span>
 					</a>
 					<div class="nav-area" id="nav-left">
 						{{ if .CurrentUser }}
-							<a href="/self" class="nav-item {{if eq .CurrentSection "self"}}nav-item-current{{end}}">My profile</a>
+							<a href="/self" class="nav-item {{if eq .CurrentSection "self"}}nav-item-current{{end}}">{{T "My profile"}}</a>
+							{{if and (not .CurrentUser.Perms.Portunus.IsAdmin) (.Features.IsEnabled "join-requests")}}
+								<a href="/groups/browse" class="nav-item {{if eq .CurrentSection "groups"}}nav-item-current{{end}}">{{T "Browse groups"}}</a>
+							{{end}}
 							{{if .CurrentUser.Perms.Portunus.IsAdmin}}
-								<a href="/users" class="nav-item {{if eq .CurrentSection "users"}}nav-item-current{{end}}">Users</a>
-								<a href="/groups" class="nav-item {{if eq .CurrentSection "groups"}}nav-item-current{{end}}">Groups</a>
+								<a href="/users" class="nav-item {{if eq .CurrentSection "users"}}nav-item-current{{end}}">{{T "Users"}}</a>
+								<a href="/groups" class="nav-item {{if eq .CurrentSection "groups"}}nav-item-current{{end}}">{{T "Groups"}}</a>
+								<a href="/service-accounts" class="nav-item {{if eq .CurrentSection "service-accounts"}}nav-item-current{{end}}">{{T "Service accounts"}}</a>
+								{{if .Features.IsEnabled "access-reviews"}}
+									<a href="/reviews" class="nav-item {{if eq .CurrentSection "reviews"}}nav-item-current{{end}}">{{T "Access reviews"}}</a>
+								{{end}}
+								<a href="/status" class="nav-item {{if eq .CurrentSection "status"}}nav-item-current{{end}}">{{T "Status"}}</a>
+							{{end}}
+							{{range .PluginNavLinks}}
+								<a href="{{.Path}}" class="nav-item {{if eq $.CurrentPath .Path}}nav-item-current{{end}}">{{.Label}}</a>
 							{{end}}
 						{{ else }}
-							<a class="nav-item nav-item-current" href="/login">Login to Portunus</a>
+							<a class="nav-item nav-item-current" href="/login">{{T "Login to %s" .Branding.ProductName}}</a>
 						{{ end }}
 					</div>
 					<div class="nav-area" id="nav-right">
 						{{ if .CurrentUserFullName }}
 							<div class="nav-item nav-item-current">{{.CurrentUserFullName}}</div>
-							<a class="nav-item" href="/logout">Logout</a>
+							<a class="nav-item" href="/logout">{{T "Logout"}}</a>
 						{{ end }}
 					</div>
 				</div>
 			</nav>
 			<main>
-				{{range .Flashes}}<div class="flash flash-{{.Type}}">{{.Message}}</div>{{end}}
+				{{.MaintenanceBanner}}
+				{{.BrowserWarning}}
+				{{range .Flashes}}<div class="flash flash-{{.Type}}">{{T .Message}}</div>{{end}}
 				{{.Page.Contents}}
 			</main>
+			{{.Footer}}
 		</body>
 	</html>
 `)
 
 // Flash is a flash message.
 type Flash struct {
-	Type    string //either "danger" or "success"
-	Message string
+	Type    string //either "danger", "warning" or "success"
+	Message string //fixed texts are translated when the flash is shown
 }
 
 func init() {
 	gob.Register(Flash{})
 }
 
+// pageFrame contains the parts of HandlerOptions that Page.Render() needs for
+// everything around the page contents (banners, navigation and footer). It is
+// attached to each request by pageFrameMiddleware(), so that it does not need
+// to be passed through every single handler.
+type pageFrame struct {
+	Maintenance *MaintenanceInfo
+	SiteInfo    SiteInfo
+	Features    core.FeatureSet
+	Branding    Branding
+}
+
+type pageFrameContextKey struct{}
+
+func pageFrameMiddleware(inner http.Handler, frame pageFrame) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), pageFrameContextKey{}, frame)
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the zero value for requests that did not pass through
+// pageFrameMiddleware(), e.g. in tests of individual handlers.
+func pageFrameOf(r *http.Request) pageFrame {
+	frame, _ := r.Context().Value(pageFrameContextKey{}).(pageFrame)
+	return frame
+}
+
 // Page describes a HTML page produced by Portunus.
 type Page struct {
 	Status   int
@@ -94,33 +140,60 @@ type Page struct {
 
 // Render renders the given page.
 func (p Page) Render(w http.ResponseWriter, r *http.Request, currentUser *core.UserWithPerms, s *sessions.Session) {
+	l := i18n.ForRequest(r)
+	theme := themeFromSession(s)
+	frame := pageFrameOf(r)
 	data := struct {
 		Page                Page
+		Lang                string
+		Theme               string
+		Branding            Branding
 		CurrentUser         *core.UserWithPerms
 		CurrentUserFullName string
 		CurrentSection      string
+		CurrentPath         string
+		PluginNavLinks      []PluginNavLink
+		Features            core.FeatureSet
 		Navigation          template.HTML
+		MaintenanceBanner   template.HTML
+		BrowserWarning      template.HTML
+		Footer              template.HTML
 		Flashes             []Flash
 	}{
-		Page:           p,
-		CurrentUser:    currentUser,
-		CurrentSection: strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0],
+		Page:              p,
+		Lang:              l.Tag,
+		Theme:             theme,
+		Branding:          frame.Branding,
+		CurrentUser:       currentUser,
+		CurrentSection:    strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0],
+		CurrentPath:       r.URL.Path,
+		PluginNavLinks:    pluginNavLinks(currentUser),
+		Features:          frame.Features,
+		MaintenanceBanner: renderMaintenanceBanner(frame.Maintenance, currentUser, l),
+		BrowserWarning:    renderBrowserWarning(r, l, frame.Branding.ProductName),
+		Footer:            renderFooter(frame.SiteInfo, l, renderThemeSwitcher(r, theme, l)),
 	}
 	if currentUser != nil {
 		data.CurrentUserFullName = currentUser.FullName()
 	}
 
-	for _, value := range s.Flashes() {
-		if f, ok := value.(Flash); ok {
-			data.Flashes = append(data.Flashes, f)
+	//`s` may be nil when rendering an error page for a request that failed
+	//before the session could be loaded
+	if s != nil {
+		for _, value := range s.Flashes() {
+			if f, ok := value.(Flash); ok {
+				data.Flashes = append(data.Flashes, f)
+			}
+		}
+		err := s.Save(r, w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-	}
-	err := s.Save(r, w)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", l.Tag)
+	w.Header().Add("Vary", "Accept-Language")
 	w.WriteHeader(p.Status)
-	_, _ = w.Write([]byte(mainSnippet.Render(data)))
+	_, _ = w.Write([]byte(mainSnippet.RenderIn(l, data)))
 }
@@ -0,0 +1,214 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package ha coordinates leadership between two Portunus instances that share
+// their state directory, so that one of them can take over when the other
+// fails. Only the instance holding the lease may run the adapters and serve
+// requests.
+//
+// The lease is a small JSON file in the shared directory. We cannot rely on
+// file locks since those are not reliable on network filesystems, so the
+// lease is instead written by atomic rename and read back after a short delay
+// to detect concurrent takeovers. This requires the clocks of both hosts to be
+// reasonably synchronized (e.g. by NTP).
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// LeaseOptions contains the configuration for a Lease.
+type LeaseOptions struct {
+	Path     string //path of the lease file in the shared directory
+	NodeName string //unique name of this instance
+	//How long the lease stays valid without being renewed. The lease is
+	//renewed at a third of this interval. Must be at least MinTTL.
+	TTL time.Duration
+}
+
+// MinTTL is the lower bound for LeaseOptions.TTL. Each renewal interval
+// (a third of the TTL) must be well above the delay that tryAcquire() waits
+// for concurrent takeovers to settle.
+const MinTTL = 5 * time.Second
+
+// Lease is the leadership lease for one instance.
+type Lease struct {
+	opts LeaseOptions
+	//The time until which our own lease is valid, if we hold it.
+	expiresAt time.Time
+	//can be replaced in tests
+	now         func() time.Time
+	settleDelay time.Duration
+}
+
+type leaseState struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NewLease instantiates a Lease. This does not touch the lease file yet.
+func NewLease(opts LeaseOptions) (*Lease, error) {
+	if opts.TTL < MinTTL {
+		return nil, fmt.Errorf("lease TTL must be at least %s, but got %s", MinTTL, opts.TTL)
+	}
+	return &Lease{
+		opts:        opts,
+		now:         time.Now,
+		settleDelay: time.Second,
+	}, nil
+}
+
+// Acquire blocks until we hold the lease, or until `ctx` expires. Returns
+// whether the lease was acquired.
+func (l *Lease) Acquire(ctx context.Context) bool {
+	for {
+		ok, err := l.tryAcquire()
+		if err != nil {
+			//we will try again on the next tick
+			logg.Error("could not acquire leadership lease: %s", err.Error())
+		}
+		if ok {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(l.opts.TTL / 3):
+		}
+	}
+}
+
+func (l *Lease) tryAcquire() (bool, error) {
+	state, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	now := l.now()
+	if state.Holder != l.opts.NodeName && now.Before(state.ExpiresAt) {
+		return false, nil
+	}
+
+	expiresAt := now.Add(l.opts.TTL)
+	err = l.write(leaseState{Holder: l.opts.NodeName, ExpiresAt: expiresAt})
+	if err != nil {
+		return false, err
+	}
+	//if the other instance tried to take over at the same time, only one of
+	//the renames survives, and both of us will see the same winner here
+	time.Sleep(l.settleDelay)
+	state, err = l.read()
+	if err != nil || state.Holder != l.opts.NodeName {
+		return false, err
+	}
+	l.expiresAt = expiresAt
+	return true, nil
+}
+
+// Hold renews the lease periodically until `ctx` expires. An error is returned
+// if the lease was lost, in which case the caller must stop serving at once.
+// The lease is not released when `ctx` expires; use Release() for that.
+func (l *Lease) Hold(ctx context.Context) error {
+	ticker := time.NewTicker(l.opts.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := l.renew()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (l *Lease) renew() error {
+	state, err := l.read()
+	if err == nil {
+		if state.Holder != l.opts.NodeName {
+			return fmt.Errorf("lost leadership lease to %q", state.Holder)
+		}
+		now := l.now()
+		expiresAt := now.Add(l.opts.TTL)
+		err = l.write(leaseState{Holder: l.opts.NodeName, ExpiresAt: expiresAt})
+		if err == nil {
+			l.expiresAt = expiresAt
+			return nil
+		}
+	}
+
+	//the shared storage may be unavailable for a moment; this is only fatal if
+	//the other instance may already have taken over
+	if !l.now().Before(l.expiresAt) {
+		return fmt.Errorf("could not renew leadership lease before it expired: %w", err)
+	}
+	logg.Error("could not renew leadership lease (will retry): %s", err.Error())
+	return nil
+}
+
+// Release gives up the lease if we still hold it, so that the other instance
+// can take over without waiting for the lease to expire.
+func (l *Lease) Release() error {
+	state, err := l.read()
+	if err != nil || state.Holder != l.opts.NodeName {
+		return err
+	}
+	l.expiresAt = time.Time{}
+	return os.Remove(l.opts.Path)
+}
+
+// CurrentHolder returns the name of the instance holding the lease, or the
+// empty string if the lease is vacant.
+func (l *Lease) CurrentHolder() (string, error) {
+	state, err := l.read()
+	if err != nil || !l.now().Before(state.ExpiresAt) {
+		return "", err
+	}
+	return state.Holder, nil
+}
+
+func (l *Lease) read() (leaseState, error) {
+	var state leaseState
+	buf, err := os.ReadFile(l.opts.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		//vacant lease
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return state, fmt.Errorf("while parsing %s: %w", l.opts.Path, err)
+	}
+	return state, nil
+}
+
+func (l *Lease) write(state leaseState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(
+		filepath.Dir(l.opts.Path),
+		fmt.Sprintf(".%s.%s", filepath.Base(l.opts.Path), l.opts.NodeName),
+	)
+	err = os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.opts.Path)
+}
@@ -0,0 +1,107 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ha
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestLeaseTakeover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.json")
+	clock := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	makeLease := func(nodeName string) *Lease {
+		l, err := NewLease(LeaseOptions{Path: path, NodeName: nodeName, TTL: 30 * time.Second})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		l.now = func() time.Time { return clock }
+		l.settleDelay = 0
+		return l
+	}
+	leaseA := makeLease("a")
+	leaseB := makeLease("b")
+
+	expectAcquire := func(l *Lease, expected bool) {
+		t.Helper()
+		ok, err := l.tryAcquire()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "acquired by "+l.opts.NodeName, ok, expected)
+	}
+	expectHolder := func(expected string) {
+		t.Helper()
+		holder, err := leaseA.CurrentHolder()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "current holder", holder, expected)
+	}
+
+	//a vacant lease can be acquired by whoever comes first
+	expectHolder("")
+	expectAcquire(leaseA, true)
+	expectAcquire(leaseB, false)
+	expectHolder("a")
+
+	//as long as A keeps renewing, B cannot take over
+	for range 5 {
+		clock = clock.Add(10 * time.Second)
+		err := leaseA.renew()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expectAcquire(leaseB, false)
+	}
+
+	//when A stops renewing, B takes over after the TTL
+	clock = clock.Add(29 * time.Second)
+	expectAcquire(leaseB, false)
+	clock = clock.Add(time.Second)
+	expectAcquire(leaseB, true)
+	expectHolder("b")
+
+	//A notices that it lost the lease
+	err := leaseA.renew()
+	assert.DeepEqual(t, "renewal error", err.Error(), `lost leadership lease to "b"`)
+
+	//A restarting does not let it steal the lease back
+	expectAcquire(leaseA, false)
+
+	//when B shuts down gracefully, A can take over immediately
+	err = leaseB.Release()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectHolder("")
+	expectAcquire(leaseA, true)
+
+	//releasing a lease that we do not hold does nothing
+	err = leaseB.Release()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectHolder("a")
+}
+
+func TestLeaseTTLIsValidated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.json")
+	for _, ttl := range []time.Duration{0, -time.Second, time.Second} {
+		_, err := NewLease(LeaseOptions{Path: path, NodeName: "a", TTL: ttl})
+		if err == nil {
+			t.Errorf("expected error for TTL = %s, but got none", ttl)
+		}
+	}
+	_, err := NewLease(LeaseOptions{Path: path, NodeName: "a", TTL: MinTTL})
+	if err != nil {
+		t.Errorf("unexpected error for TTL = %s: %s", MinTTL, err.Error())
+	}
+}
@@ -8,10 +8,12 @@ package h
 
 import (
 	"html/template"
+	"io"
 	"net/http"
 
 	"github.com/gorilla/csrf"
 	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/i18n"
 	"github.com/sapcc/go-bits/errext"
 )
 
@@ -22,6 +24,17 @@ import (
 type FormState struct {
 	Fields        map[string]*FieldState
 	ErrorMessages []string //errors that do not apply to specific fields
+	//Set by FormSpec.Render() for the fields that it renders.
+	locale i18n.Locale
+}
+
+// Locale returns the locale that the form is rendered in. This can be used
+// when implementing the RenderField() method of the FormField interface.
+func (s FormState) Locale() i18n.Locale {
+	if s.locale.Tag == "" {
+		return i18n.English
+	}
+	return s.locale
 }
 
 // IsValid returns false if any field has a validation error.
@@ -61,6 +74,7 @@ type FieldState struct {
 	Value        string          //only used by InputFieldSpec
 	Selected     map[string]bool //only used by SelectFieldSpec
 	IsUnfolded   bool            //only used by FieldSet
+	FileContents []byte          //only used by FileInputFieldSpec
 	ErrorMessage string
 }
 
@@ -87,6 +101,8 @@ type FormSpec struct {
 	PostTarget  string
 	SubmitLabel string
 	Fields      []FormField
+	//Must be set if Fields contains a FileInputFieldSpec.
+	IsMultipart bool
 }
 
 // ReadState reads and validates the field value from r.PostForm, and stores it
@@ -102,18 +118,20 @@ func (f FormSpec) ReadState(r *http.Request, s *FormState) {
 
 var formSpecSnippet = NewSnippet(`
 	{{- range .ErrorMessages }}
-		<div class="flash flash-danger">{{ . }}</div>
+		<div class="flash flash-danger">{{ T . }}</div>
 	{{- end }}
-	<form method="POST" action={{.Spec.PostTarget}}>
+	<form method="POST" action="{{.Spec.PostTarget}}"{{if .Spec.IsMultipart}} enctype="multipart/form-data"{{end}}>
 		{{.Fields}}
 		<div class="button-row">
-			<button type="submit" class="button button-primary">{{.Spec.SubmitLabel}}</button>
+			<button type="submit" class="button button-primary">{{T .Spec.SubmitLabel}}</button>
 		</div>
 	</form>
 `)
 
-// Render produces the HTML for this form.
+// Render produces the HTML for this form. Labels and error messages are
+// translated into the locale requested by the client.
 func (f FormSpec) Render(r *http.Request, s FormState) template.HTML {
+	s.locale = i18n.ForRequest(r)
 	data := struct {
 		Spec          FormSpec
 		Fields        template.HTML
@@ -126,7 +144,7 @@ func (f FormSpec) Render(r *http.Request, s FormState) template.HTML {
 	for _, field := range f.Fields {
 		data.Fields = data.Fields + field.RenderField(s)
 	}
-	return formSpecSnippet.Render(data)
+	return formSpecSnippet.RenderIn(s.Locale(), data)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -139,26 +157,35 @@ type InputFieldSpec struct {
 	InputType        string
 	AutoFocus        bool
 	AutocompleteMode string
+	//If ReadOnly is set, the field cannot be edited, and ReadState() leaves
+	//the prefilled FieldState alone. Tooltip is shown when hovering over the
+	//field, e.g. to explain why it cannot be edited.
+	ReadOnly bool
+	Tooltip  string
 }
 
 // ReadState reads and validates the field value from r.PostForm, and stores it
 // in the given FormState.
 func (f InputFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	if f.ReadOnly {
+		return
+	}
 	formState.Fields[f.Name] = &FieldState{Value: r.PostForm.Get(f.Name)}
 }
 
 var inputFieldSnippet = NewSnippet(`
-	<div class="form-row">
+	<div class="form-row" {{if .Spec.Tooltip}}title="{{T .Spec.Tooltip}}"{{end}}>
 		<label for="{{.Spec.Name}}">
-			{{.Spec.Label}}
+			{{T .Spec.Label}}
 			{{if .State.ErrorMessage}}
-				<span class="form-error">{{.State.ErrorMessage}}</span>
+				<span class="form-error">{{T .State.ErrorMessage}}</span>
 			{{end}}
 		</label>
 		<input
 			name="{{.Spec.Name}}" type="{{.Spec.InputType}}"
 			{{ if and (ne .State.Value "") (ne .Spec.InputType "password") }}value="{{.State.Value}}"{{ end }}
 			{{ if .Spec.AutoFocus }}autofocus{{ end }}
+			{{ if .Spec.ReadOnly }}readonly{{ end }}
 			class="row-input {{if .State.ErrorMessage}}form-error{{end}}"
 			autocomplete="{{if .Spec.AutocompleteMode}}{{.Spec.AutocompleteMode}}{{else}}off{{end}}"
 		/>
@@ -177,7 +204,7 @@ func (f InputFieldSpec) RenderField(state FormState) template.HTML {
 	if data.State == nil {
 		data.State = &FieldState{}
 	}
-	return inputFieldSnippet.Render(data)
+	return inputFieldSnippet.RenderIn(state.Locale(), data)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -185,27 +212,33 @@ func (f InputFieldSpec) RenderField(state FormState) template.HTML {
 
 // MultilineInputFieldSpec describes a single <input> field within type FormSpec.
 type MultilineInputFieldSpec struct {
-	Name  string
-	Label string
+	Name     string
+	Label    string
+	ReadOnly bool   //like in InputFieldSpec
+	Tooltip  string //like in InputFieldSpec
 }
 
 // ReadState reads and validates the field value from r.PostForm, and stores it
 // in the given FormState.
 func (f MultilineInputFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	if f.ReadOnly {
+		return
+	}
 	formState.Fields[f.Name] = &FieldState{Value: r.PostForm.Get(f.Name)}
 }
 
 var multilineInputFieldSnippet = NewSnippet(`
-	<div class="form-row">
+	<div class="form-row" {{if .Spec.Tooltip}}title="{{T .Spec.Tooltip}}"{{end}}>
 		<label for="{{.Spec.Name}}">
-			{{.Spec.Label}}
+			{{T .Spec.Label}}
 			{{if .State.ErrorMessage}}
-				<span class="form-error">{{.State.ErrorMessage}}</span>
+				<span class="form-error">{{T .State.ErrorMessage}}</span>
 			{{end}}
 		</label>
 		<textarea
 			name="{{.Spec.Name}}"
 			class="row-input {{if .State.ErrorMessage}}form-error{{end}}"
+			{{ if .Spec.ReadOnly }}readonly{{ end }}
 			autocomplete="off">
 				{{- .State.Value -}}
 		</textarea>
@@ -224,7 +257,105 @@ func (f MultilineInputFieldSpec) RenderField(state FormState) template.HTML {
 	if data.State == nil {
 		data.State = &FieldState{}
 	}
-	return multilineInputFieldSnippet.Render(data)
+	return multilineInputFieldSnippet.RenderIn(state.Locale(), data)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type FileInputFieldSpec
+
+// FileInputFieldSpec describes an <input type="file"> field within type
+// FormSpec. The containing FormSpec must have IsMultipart set. When no file was
+// uploaded, the FieldState has no FileContents and no ErrorMessage.
+type FileInputFieldSpec struct {
+	Name    string
+	Label   string
+	Accept  string //e.g. "image/*"
+	MaxSize int64  //in bytes
+}
+
+// ReadState reads the uploaded file from r.MultipartForm, and stores it in the
+// given FormState.
+func (f FileInputFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	state := &FieldState{}
+	formState.Fields[f.Name] = state
+	if r.MultipartForm == nil || len(r.MultipartForm.File[f.Name]) == 0 {
+		return
+	}
+
+	header := r.MultipartForm.File[f.Name][0]
+	if header.Size == 0 {
+		return //the browser sends an empty part if no file was selected
+	}
+	if header.Size > f.MaxSize {
+		state.ErrorMessage = i18n.ForRequest(r).Tf("must not be larger than %d KiB", f.MaxSize>>10)
+		return
+	}
+	file, err := header.Open()
+	if err == nil {
+		state.FileContents, err = io.ReadAll(io.LimitReader(file, f.MaxSize))
+		file.Close()
+	}
+	if err != nil {
+		state.ErrorMessage = i18n.ForRequest(r).Tf("could not be read: %s", err.Error())
+	}
+}
+
+var fileInputFieldSnippet = NewSnippet(`
+	<div class="form-row">
+		<label for="{{.Spec.Name}}">
+			{{T .Spec.Label}}
+			{{if .State.ErrorMessage}}
+				<span class="form-error">{{T .State.ErrorMessage}}</span>
+			{{end}}
+		</label>
+		<input
+			name="{{.Spec.Name}}" type="file"
+			{{ if .Spec.Accept }}accept="{{.Spec.Accept}}"{{ end }}
+			class="row-input {{if .State.ErrorMessage}}form-error{{end}}"
+		/>
+	</div>
+`)
+
+// RenderField produces the HTML for this field.
+func (f FileInputFieldSpec) RenderField(state FormState) template.HTML {
+	data := struct {
+		Spec  FileInputFieldSpec
+		State *FieldState
+	}{
+		Spec:  f,
+		State: state.Fields[f.Name],
+	}
+	if data.State == nil {
+		data.State = &FieldState{}
+	}
+	return fileInputFieldSnippet.RenderIn(state.Locale(), data)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type HiddenFieldSpec
+
+// HiddenFieldSpec describes an <input type="hidden"> within type FormSpec. It
+// carries the value from the FormState through to the next submission.
+type HiddenFieldSpec struct {
+	Name string
+}
+
+// ReadState implements the FormField interface.
+func (f HiddenFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	formState.Fields[f.Name] = &FieldState{Value: r.PostForm.Get(f.Name)}
+}
+
+var hiddenFieldSnippet = NewSnippet(`
+	<input type="hidden" name="{{.Name}}" value="{{.Value}}" />
+`)
+
+// RenderField implements the FormField interface.
+func (f HiddenFieldSpec) RenderField(state FormState) template.HTML {
+	var value string
+	if s := state.Fields[f.Name]; s != nil {
+		value = s.Value
+	}
+	return hiddenFieldSnippet.Render(struct{ Name, Value string }{f.Name, value})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -242,17 +373,17 @@ func (f StaticField) ReadState(*http.Request, *FormState) {
 
 var staticFieldSnippet = NewSnippet(`
 	<div class="form-row">
-		<label>{{.Label}}</label>
+		<label>{{T .Label}}</label>
 		<div class="row-value">{{.Value}}</div>
 	</div>
 `)
 
 // RenderField implements the FormField interface.
-func (f StaticField) RenderField(FormState) template.HTML {
+func (f StaticField) RenderField(state FormState) template.HTML {
 	if f.Label == "" {
 		return f.Value
 	}
-	return staticFieldSnippet.Render(f)
+	return staticFieldSnippet.RenderIn(state.Locale(), f)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -264,14 +395,22 @@ type FieldSet struct {
 	Label      string
 	Fields     []FormField
 	IsFoldable bool
+	//If IsFoldable and ReadOnly are both set, the fieldset cannot be folded or
+	//unfolded, and ReadState() keeps the prefilled state. ReadOnly does not
+	//apply to the contained fields. Tooltip is shown when hovering over the
+	//fieldset's label.
+	ReadOnly bool
+	Tooltip  string
 }
 
 // ReadState implements the FormField interface.
 func (fs FieldSet) ReadState(r *http.Request, s *FormState) {
 	if fs.IsFoldable {
-		isUnfolded := r.PostForm.Get(fs.Name) == "1"
-		s.Fields[fs.Name] = &FieldState{IsUnfolded: isUnfolded}
-		if !isUnfolded {
+		if !fs.ReadOnly {
+			isUnfolded := r.PostForm.Get(fs.Name) == "1"
+			s.Fields[fs.Name] = &FieldState{IsUnfolded: isUnfolded}
+		}
+		if s.Fields[fs.Name] == nil || !s.Fields[fs.Name].IsUnfolded {
 			return
 		}
 	}
@@ -285,10 +424,12 @@ func (fs FieldSet) ReadState(r *http.Request, s *FormState) {
 // special layouting rules that make styling them with CSS unnecessarily hard.
 var fieldSetSnippet = NewSnippet(`
 	{{if .Spec.IsFoldable}}
-		<input type="checkbox" class="for-fieldset" id="{{.Spec.Name}}" name="{{.Spec.Name}}" value="1" {{if .State.IsUnfolded}}checked{{end}}>
+		<input type="checkbox" class="for-fieldset" id="{{.Spec.Name}}"
+			{{if not .Spec.ReadOnly}}name="{{.Spec.Name}}" value="1"{{end}}
+			{{if .State.IsUnfolded}}checked{{end}}>
 	{{end}}
 	<fieldset>
-		<label for="{{.Spec.Name}}">{{.Spec.Label}}</label>
+		<label {{if not .Spec.ReadOnly}}for="{{.Spec.Name}}"{{end}} {{if .Spec.Tooltip}}title="{{T .Spec.Tooltip}}"{{end}}>{{T .Spec.Label}}</label>
 		{{.Fields}}
 	</fieldset>
 `)
@@ -311,5 +452,5 @@ func (fs FieldSet) RenderField(state FormState) template.HTML {
 		data.Fields = data.Fields + f.RenderField(state)
 	}
 
-	return fieldSetSnippet.Render(data)
+	return fieldSetSnippet.RenderIn(state.Locale(), data)
 }
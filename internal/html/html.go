@@ -9,27 +9,80 @@ package h
 
 import (
 	"bytes"
+	"fmt"
 	"html"
 	"html/template"
 	"strings"
+
+	"github.com/majewsky/portunus/internal/i18n"
 )
 
 // Snippet provides a convenience API around html/template.Template.
+//
+// Inside the template, texts can be translated with the function T, e.g.
+// `{{T "Login name"}}`. Additional arguments are formatted into the
+// translated text like with fmt.Sprintf. Translations and arguments are
+// HTML-escaped, except for arguments of type template.HTML. To show an
+// argument in monospace, wrap it with the function code, e.g.
+// `{{T "Group %s" (code .Name)}}`. To show it as a link, use the function
+// link, e.g. `{{T "Go to %s" (link "/self" (T "your profile"))}}`.
 type Snippet struct {
-	T *template.Template
+	//key = i18n.Locale.Tag
+	templates map[string]*template.Template
 }
 
 // NewSnippet parses html/template code into a Snippet.
 func NewSnippet(input string) Snippet {
-	return Snippet{template.Must(template.New("").Parse(strings.TrimSpace(input)))}
+	//each locale gets its own copy of the template with a different T function
+	s := Snippet{make(map[string]*template.Template, len(i18n.Locales))}
+	for _, l := range i18n.Locales {
+		funcs := template.FuncMap{"T": translateFunc(l), "code": renderCode, "link": renderLink}
+		s.templates[l.Tag] = template.Must(template.New("").Funcs(funcs).Parse(strings.TrimSpace(input)))
+	}
+	return s
 }
 
-// Render renders the snippet with the given data.
+// Render renders the snippet with the given data, with texts in English.
 func (s Snippet) Render(data interface{}) template.HTML {
+	return s.RenderIn(i18n.English, data)
+}
+
+// RenderIn renders the snippet with the given data, with texts translated
+// into the given locale.
+func (s Snippet) RenderIn(l i18n.Locale, data interface{}) template.HTML {
 	var buf bytes.Buffer
-	err := s.T.Execute(&buf, data)
+	err := s.templates[l.Tag].Execute(&buf, data)
 	if err != nil {
 		return template.HTML(`<div class="flash flash-danger">` + html.EscapeString(err.Error()) + `</div>`)
 	}
 	return template.HTML(buf.String())
 }
+
+func renderCode(value string) template.HTML {
+	return template.HTML("<code>" + html.EscapeString(value) + "</code>")
+}
+
+func renderLink(href string, text template.HTML) template.HTML {
+	return template.HTML(`<a href="` + html.EscapeString(href) + `">` + string(text) + "</a>")
+}
+
+func translateFunc(l i18n.Locale) func(string, ...any) template.HTML {
+	return func(msg string, args ...any) template.HTML {
+		format := html.EscapeString(l.T(msg))
+		if len(args) == 0 {
+			return template.HTML(format)
+		}
+		escapedArgs := make([]any, len(args))
+		for idx, arg := range args {
+			switch arg := arg.(type) {
+			case template.HTML:
+				escapedArgs[idx] = string(arg)
+			case int, int64, uint, uint64:
+				escapedArgs[idx] = arg
+			default:
+				escapedArgs[idx] = html.EscapeString(fmt.Sprint(arg))
+			}
+		}
+		return template.HTML(fmt.Sprintf(format, escapedArgs...))
+	}
+}
@@ -7,9 +7,10 @@
 package h
 
 import (
-	"fmt"
 	"html/template"
 	"net/http"
+
+	"github.com/majewsky/portunus/internal/i18n"
 )
 
 // SelectFieldSpec is a FormField where values can be selected from a given set.
@@ -18,7 +19,8 @@ type SelectFieldSpec struct {
 	Name     string
 	Label    string
 	Options  []SelectOptionSpec
-	ReadOnly bool
+	ReadOnly bool   //like in InputFieldSpec
+	Tooltip  string //like in InputFieldSpec
 }
 
 // ReadState implements the FormField interface.
@@ -27,40 +29,53 @@ func (f SelectFieldSpec) ReadState(r *http.Request, formState *FormState) {
 		return
 	}
 
+	//read-only options keep their prefilled state
+	var prefilled map[string]bool
+	if formState.Fields[f.Name] != nil {
+		prefilled = formState.Fields[f.Name].Selected
+	}
+
 	isValidValue := make(map[string]bool)
+	s := FieldState{Selected: make(map[string]bool)}
 	for _, o := range f.Options {
-		isValidValue[o.Value] = true
+		if o.ReadOnly {
+			if prefilled[o.Value] {
+				s.Selected[o.Value] = true
+			}
+		} else {
+			isValidValue[o.Value] = true
+		}
 	}
 
-	s := FieldState{Selected: make(map[string]bool)}
 	for _, value := range r.PostForm[f.Name] {
 		s.Selected[value] = true
 		if !isValidValue[value] {
-			s.ErrorMessage = fmt.Sprintf("does not have the option %q", value)
+			s.ErrorMessage = i18n.ForRequest(r).Tf("does not have the option %q", value)
 		}
 	}
 	formState.Fields[f.Name] = &s
 }
 
 var selectFieldSnippet = NewSnippet(`
-	<div class="form-row item-list">
+	<div class="form-row item-list" {{if .Spec.Tooltip}}title="{{T .Spec.Tooltip}}"{{end}}>
 		<label>
-			{{.Spec.Label}}
+			{{T .Spec.Label}}
 			{{if .State.ErrorMessage}}
-				<span class="form-error">{{.State.ErrorMessage}}</span>
+				<span class="form-error">{{T .State.ErrorMessage}}</span>
 			{{end}}
 		</label>
 		{{- range $idx, $opt := .Spec.Options -}}
 			{{- $id := printf "%s-%d" $.Spec.Name $idx -}}
+			{{- $readOnly := or $.Spec.ReadOnly $opt.ReadOnly -}}
 			<input
 				type="checkbox" id="{{$id}}"
-				{{if $.Spec.ReadOnly}}
+				{{if $readOnly}}
 					readonly
 				{{else}}
 					name="{{$.Spec.Name}}" value="{{$opt.Value}}"
 				{{end}}
 				{{if index $.State.Selected $opt.Value}} checked {{end}}
-			/><label {{if not $.Spec.ReadOnly}} for="{{$id}}" {{end}}>{{$opt.Label}}</label>
+			/><label {{if not $readOnly}} for="{{$id}}" {{end}} {{if $opt.Tooltip}} title="{{T $opt.Tooltip}}" {{end}}>{{T $opt.Label}}</label>
 		{{- end -}}
 	</div>
 `)
@@ -78,11 +93,77 @@ func (f SelectFieldSpec) RenderField(state FormState) template.HTML {
 		data.State = &FieldState{}
 	}
 
-	return selectFieldSnippet.Render(data)
+	return selectFieldSnippet.RenderIn(state.Locale(), data)
 }
 
 // SelectOptionSpec describes an option that can be selected in a SelectFieldSpec.
 type SelectOptionSpec struct {
 	Value string
 	Label string
+	//Only used by SelectFieldSpec. Like SelectFieldSpec.ReadOnly and
+	//SelectFieldSpec.Tooltip, but for this option only.
+	ReadOnly bool
+	Tooltip  string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// type DropdownFieldSpec
+
+// DropdownFieldSpec is a FormField where exactly one value can be selected
+// from a given set. It's rendered as a <select> element.
+type DropdownFieldSpec struct {
+	Name     string
+	Label    string
+	Options  []SelectOptionSpec
+	ReadOnly bool   //like in InputFieldSpec
+	Tooltip  string //like in InputFieldSpec
+}
+
+// ReadState implements the FormField interface.
+func (f DropdownFieldSpec) ReadState(r *http.Request, formState *FormState) {
+	if f.ReadOnly {
+		return
+	}
+	s := FieldState{Value: r.PostForm.Get(f.Name)}
+	isValidValue := false
+	for _, o := range f.Options {
+		if o.Value == s.Value {
+			isValidValue = true
+		}
+	}
+	if !isValidValue {
+		s.ErrorMessage = i18n.ForRequest(r).Tf("does not have the option %q", s.Value)
+	}
+	formState.Fields[f.Name] = &s
+}
+
+var dropdownFieldSnippet = NewSnippet(`
+	<div class="form-row" {{if .Spec.Tooltip}}title="{{T .Spec.Tooltip}}"{{end}}>
+		<label for="{{.Spec.Name}}">
+			{{T .Spec.Label}}
+			{{if .State.ErrorMessage}}
+				<span class="form-error">{{T .State.ErrorMessage}}</span>
+			{{end}}
+		</label>
+		<select name="{{.Spec.Name}}" class="row-input {{if .State.ErrorMessage}}form-error{{end}}" {{if .Spec.ReadOnly}}disabled readonly{{end}}>
+			{{- range .Spec.Options -}}
+				<option value="{{.Value}}" {{if eq .Value $.State.Value}}selected{{end}}>{{T .Label}}</option>
+			{{- end -}}
+		</select>
+	</div>
+`)
+
+// RenderField implements the FormField interface.
+func (f DropdownFieldSpec) RenderField(state FormState) template.HTML {
+	data := struct {
+		Spec  DropdownFieldSpec
+		State *FieldState
+	}{
+		Spec:  f,
+		State: state.Fields[f.Name],
+	}
+	if data.State == nil {
+		data.State = &FieldState{}
+	}
+	return dropdownFieldSnippet.RenderIn(state.Locale(), data)
 }
@@ -0,0 +1,291 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package i18n
+
+// Texts are grouped by the part of the UI where they appear. Users are
+// addressed formally ("Sie").
+var germanMessages = map[string]string{
+	//page layout
+	"Access reviews":   "Zugriffsprüfungen",
+	"Browse groups":    "Gruppen durchsuchen",
+	"Close menu":       "Menü schließen",
+	"Groups":           "Gruppen",
+	"Imprint":          "Impressum",
+	"Login to %s":      "Bei %s anmelden",
+	"Logout":           "Abmelden",
+	"My profile":       "Mein Profil",
+	"Privacy policy":   "Datenschutzerklärung",
+	"Service accounts": "Dienstkonten",
+	"Site logo":        "Logo der Website",
+	"Status":           "Status",
+	"Support:":         "Support:",
+	"Users":            "Benutzer",
+	"Your browser is too old to be used with %s safely, since it does not support the SameSite attribute of cookies.": "Ihr Browser ist zu alt, um %s sicher zu verwenden, da er das SameSite-Attribut von Cookies nicht unterstützt.",
+	"Please upgrade to a current version of your browser.":                                                            "Bitte aktualisieren Sie Ihren Browser auf eine aktuelle Version.",
+
+	//color scheme switcher in the footer
+	"Automatic":     "Automatisch",
+	"Color scheme:": "Farbschema:",
+	"Dark":          "Dunkel",
+	"Light":         "Hell",
+
+	//maintenance mode
+	"Details": "Details",
+	"Portunus is in maintenance mode because its database could not be loaded.":                    "Portunus befindet sich im Wartungsmodus, da die Datenbank nicht geladen werden konnte.",
+	"No backup is available, so there is nothing to show right now.":                               "Es ist keine Sicherung verfügbar, daher kann im Moment nichts angezeigt werden.",
+	"You are viewing a read-only snapshot from %s. Changes cannot be saved.":                       "Sie sehen einen schreibgeschützten Stand vom %s. Änderungen können nicht gespeichert werden.",
+	"changes cannot be saved while Portunus is in maintenance mode":                                "Änderungen können nicht gespeichert werden, solange sich Portunus im Wartungsmodus befindet",
+	"Something went wrong while processing your request.":                                          "Bei der Verarbeitung Ihrer Anfrage ist ein Fehler aufgetreten.",
+	"If this problem persists, please contact your administrator and provide the reference ID %s.": "Wenn das Problem weiterhin besteht, wenden Sie sich bitte an Ihre Administratoren und geben Sie die Referenz-ID %s an.",
+
+	//error pages
+	"Back to the start page":                 "Zurück zur Startseite",
+	"Internal server error":                  "Interner Serverfehler",
+	"Not found":                              "Nicht gefunden",
+	"The page you requested does not exist.": "Die angeforderte Seite existiert nicht.",
+
+	//forms
+	"could not be read: %s":             "konnte nicht gelesen werden: %s",
+	"did not match":                     "stimmt nicht überein",
+	"does not have the option %q":       "hat keine Option %q",
+	"is not correct":                    "ist nicht korrekt",
+	"must be a JPEG, PNG or GIF image":  "muss ein Bild im Format JPEG, PNG oder GIF sein",
+	"must be equal to the seeded value": "muss dem Wert aus dem Seed entsprechen",
+	"must not be empty":                 "darf nicht leer sein",
+	"must not be larger than %d KiB":    "darf nicht größer als %d KiB sein",
+	"Some of the fields in this form are managed by the seed (the static configuration of Portunus) and cannot be changed here. If the seed was changed recently, these fields might not have been seed-managed when this form was loaded.": "Einige Felder dieses Formulars werden durch den Seed (die statische Konfiguration von Portunus) verwaltet und können hier nicht geändert werden. Falls der Seed kürzlich geändert wurde, wurden diese Felder beim Laden des Formulars möglicherweise noch nicht durch den Seed verwaltet.",
+
+	//messages after changes (the verb goes last in German)
+	"Updated %s %q.":                 "%s %q wurde aktualisiert.",
+	"Requested membership in %s %q.": "Mitgliedschaft in %s %q wurde beantragt.",
+	"group":                          "Gruppe",
+	"user":                           "Benutzer",
+
+	//login
+	"Code from authenticator app":                                                    "Code aus der Authenticator-App",
+	"Do not ask again in this browser for %d days":                                   "In diesem Browser %d Tage lang nicht mehr fragen",
+	"Do you want to log out of %s?":                                                  "Möchten Sie sich von %s abmelden?",
+	"For logins from your current network, we need to verify that it is really you.": "Bei Anmeldungen aus Ihrem aktuellen Netzwerk müssen wir überprüfen, dass Sie es wirklich sind.",
+	"is not valid (or the user account does not exist)":                              "ist nicht gültig (oder das Benutzerkonto existiert nicht)",
+	"Login":                       "Anmelden",
+	"Login name or email address": "Benutzername oder E-Mail-Adresse",
+	"Logins are only accepted over HTTPS, but this request does not appear to use HTTPS. Please contact your administrators if this persists.":                    "Anmeldungen werden nur über HTTPS angenommen, aber diese Anfrage scheint kein HTTPS zu verwenden. Bitte wenden Sie sich an Ihre Administratoren, wenn das Problem weiterhin besteht.",
+	"Logins from your network are not permitted at this time. Please contact your administrators if this persists.":                                               "Anmeldungen aus Ihrem Netzwerk sind derzeit nicht erlaubt. Bitte wenden Sie sich an Ihre Administratoren, wenn das Problem weiterhin besteht.",
+	"Logins from your network require two-factor authentication, but your account does not have an authenticator app set up. Please contact your administrators.": "Anmeldungen aus Ihrem Netzwerk erfordern eine Zwei-Faktor-Authentifizierung, aber für Ihr Konto ist keine Authenticator-App eingerichtet. Bitte wenden Sie sich an Ihre Administratoren.",
+	"Password": "Passwort",
+	"Please enter the current code from your authenticator app.": "Bitte geben Sie den aktuellen Code aus Ihrer Authenticator-App ein.",
+	"The code was not correct. Please log in again.":             "Der Code war nicht korrekt. Bitte melden Sie sich erneut an.",
+	"Verify":       "Bestätigen",
+	"Verify login": "Anmeldung bestätigen",
+	"Your account is disabled. Please contact your administrators.":                  "Ihr Konto ist gesperrt. Bitte wenden Sie sich an Ihre Administratoren.",
+	"Your login attempt has expired. Please log in again.":                           "Ihr Anmeldeversuch ist abgelaufen. Bitte melden Sie sich erneut an.",
+	"Your session has ended because your account was disabled.":                      "Ihre Sitzung wurde beendet, da Ihr Konto gesperrt wurde.",
+	"Your session has ended because your password was changed. Please log in again.": "Ihre Sitzung wurde beendet, da Ihr Passwort geändert wurde. Bitte melden Sie sich erneut an.",
+
+	//profile page
+	"Change password":   "Passwort ändern",
+	"Change photo":      "Foto ändern",
+	"Email address":     "E-Mail-Adresse",
+	"Full name":         "Vollständiger Name",
+	"Group memberships": "Gruppenmitgliedschaften",
+	"Go to requests":    "Zu den Anträgen",
+	"Go to review":      "Zur Prüfung",
+	"Hide from the LDAP directory (the values are still kept in Portunus)": "Im LDAP-Verzeichnis verbergen (die Werte bleiben in Portunus gespeichert)",
+	"Login name":    "Benutzername",
+	"Manager":       "Vorgesetzte(r)",
+	"New password":  "Neues Passwort",
+	"Not specified": "Nicht angegeben",
+	"Not uploaded":  "Nicht hochgeladen",
+	"Not uploaded. Showing the avatar for your email address from %s instead.": "Nicht hochgeladen. Stattdessen wird der Avatar für Ihre E-Mail-Adresse von %s angezeigt.",
+	"Old password": "Altes Passwort",
+	"Photo":        "Foto",
+	"Please review %d group membership(s) for the access review %s until %s:": "Bitte prüfen Sie %d Gruppenmitgliedschaft(en) für die Zugriffsprüfung %s bis zum %s:",
+	"Remove current photo": "Aktuelles Foto entfernen",
+	"Repeat password":      "Passwort wiederholen",
+	"SSH public key(s)":    "Öffentliche(r) SSH-Schlüssel",
+	"There are %d pending request(s) to join groups that you manage:": "Es gibt %d offene(n) Antrag/Anträge auf Beitritt zu Gruppen, die Sie verwalten:",
+	"Two-factor authentication":                                       "Zwei-Faktor-Authentifizierung",
+	"Update profile":                                                  "Profil aktualisieren",
+	"Upload new photo (JPEG, PNG or GIF)":                             "Neues Foto hochladen (JPEG, PNG oder GIF)",
+	"You have been logged out in all other browsers.":                 "Sie wurden in allen anderen Browsern abgemeldet.",
+	"Your avatar":        "Ihr Avatar",
+	"Your current photo": "Ihr aktuelles Foto",
+
+	//security events
+	"Browser":    "Browser",
+	"Country":    "Land",
+	"Event":      "Ereignis",
+	"IP address": "IP-Adresse",
+	"If this was not you, please contact your administrators immediately.": "Falls Sie das nicht waren, wenden Sie sich bitte umgehend an Ihre Administratoren.",
+	"None recorded yet":          "Bisher keine aufgezeichnet",
+	"On %s, %s.":                 "Am %s: %s.",
+	"Recent security events":     "Letzte Sicherheitsereignisse",
+	"Time":                       "Zeit",
+	"Unknown":                    "Unbekannt",
+	"%s from a new country (%s)": "%s aus einem neuen Land (%s)",
+	"failed login attempt with wrong password":                       "fehlgeschlagener Anmeldeversuch mit falschem Passwort",
+	"failed login attempt with wrong two-factor authentication code": "fehlgeschlagener Anmeldeversuch mit falschem Code für die Zwei-Faktor-Authentifizierung",
+	"login attempt was blocked by the login risk check":              "Anmeldeversuch wurde durch die Risikoprüfung blockiert",
+	"password was changed":                                           "Passwort wurde geändert",
+	"successful login":                                               "erfolgreiche Anmeldung",
+	"two-factor authentication was disabled":                         "Zwei-Faktor-Authentifizierung wurde deaktiviert",
+	"two-factor authentication was enabled":                          "Zwei-Faktor-Authentifizierung wurde aktiviert",
+	"two-factor authentication was reset by an admin":                "Zwei-Faktor-Authentifizierung wurde von einem Administrator zurückgesetzt",
+
+	//two-factor authentication
+	"Code from your authenticator app":         "Code aus Ihrer Authenticator-App",
+	"Code from your current authenticator app": "Code aus Ihrer aktuellen Authenticator-App",
+	"Current password":                         "Aktuelles Passwort",
+	"disable it":                               "sie deaktivieren",
+	"Disable two-factor authentication":        "Zwei-Faktor-Authentifizierung deaktivieren",
+	"Enable two-factor authentication":         "Zwei-Faktor-Authentifizierung aktivieren",
+	"Enabled":                                  "Aktiviert",
+	"Manage":                                   "Verwalten",
+	"Not enabled":                              "Nicht aktiviert",
+	"Please add the following key to your authenticator app. Most apps allow you to either enter the secret manually, or to paste the full URL.": "Bitte fügen Sie den folgenden Schlüssel zu Ihrer Authenticator-App hinzu. Bei den meisten Apps können Sie entweder das Geheimnis manuell eingeben oder die vollständige URL einfügen.",
+	"Please confirm your identity to continue.":                          "Bitte bestätigen Sie Ihre Identität, um fortzufahren.",
+	"Please confirm your identity to disable two-factor authentication.": "Bitte bestätigen Sie Ihre Identität, um die Zwei-Faktor-Authentifizierung zu deaktivieren.",
+	"Secret":                       "Geheimnis",
+	"Set up authenticator app":     "Authenticator-App einrichten",
+	"Set up new authenticator app": "Neue Authenticator-App einrichten",
+	"The setup of your authenticator app has expired. Please start again.":                            "Die Einrichtung Ihrer Authenticator-App ist abgelaufen. Bitte beginnen Sie erneut.",
+	"Then enter the code that your authenticator app shows to complete the setup.":                    "Geben Sie dann den Code ein, den Ihre Authenticator-App anzeigt, um die Einrichtung abzuschließen.",
+	"To enable it, you need an authenticator app that supports time-based one-time passwords (TOTP).": "Um sie zu aktivieren, benötigen Sie eine Authenticator-App, die zeitbasierte Einmalpasswörter (TOTP) unterstützt.",
+	"Two-factor authentication has been disabled.":                                                    "Die Zwei-Faktor-Authentifizierung wurde deaktiviert.",
+	"Two-factor authentication has been enabled.":                                                     "Die Zwei-Faktor-Authentifizierung wurde aktiviert.",
+	"Two-factor authentication is enabled for your account.":                                          "Für Ihr Konto ist die Zwei-Faktor-Authentifizierung aktiviert.",
+	"Two-factor authentication is not enabled for your account.":                                      "Für Ihr Konto ist die Zwei-Faktor-Authentifizierung nicht aktiviert.",
+	"You can move it to a new authenticator app, or %s.":                                              "Sie können sie auf eine neue Authenticator-App umziehen oder %s.",
+
+	//browsing groups
+	"Admins": "Administratoren",
+	"Group":  "Gruppe",
+	"Group %q does not accept join requests.": "Die Gruppe %q nimmt keine Beitrittsanträge an.",
+	"Long name":              "Langer Name",
+	"Member":                 "Mitglied",
+	"Name":                   "Name",
+	"Notes":                  "Notizen",
+	"Owner":                  "Verantwortlich",
+	"Request rejected on %s": "Antrag abgelehnt am %s",
+	"Request to join":        "Beitritt beantragen",
+	"Request to join group":  "Beitritt zu einer Gruppe beantragen",
+	"Requested on %s":        "Beantragt am %s",
+	"Send request":           "Antrag senden",
+	"There are no groups that accept join requests.":                                                                      "Es gibt keine Gruppen, die Beitrittsanträge annehmen.",
+	"Why do you need to be in this group? (optional)":                                                                     "Warum benötigen Sie die Mitgliedschaft in dieser Gruppe? (optional)",
+	"You can request to join the following groups. Your request will be decided on by the owner of the respective group.": "Sie können den Beitritt zu den folgenden Gruppen beantragen. Über Ihren Antrag entscheidet die verantwortliche Person der jeweiligen Gruppe.",
+
+	//admin forms (only the labels of form fields are translated so far; the
+	//other contents of admin pages are still shown in English)
+	"Account status":                              "Kontostatus",
+	"Add new users to this group?":                "Neue Benutzer zu dieser Gruppe hinzufügen?",
+	"Additional LDAP attributes (optional)":       "Zusätzliche LDAP-Attribute (optional)",
+	"Admin access":                                "Administratorzugriff",
+	"All groups":                                  "Alle Gruppen",
+	"All new users":                               "Alle neuen Benutzer",
+	"All users":                                   "Alle Benutzer",
+	"Apply these changes?":                        "Diese Änderungen übernehmen?",
+	"Approve requests from":                       "Anträge genehmigen von",
+	"Can read in LDAP":                            "Darf im LDAP lesen",
+	"Can users request to join this group?":       "Können Benutzer den Beitritt zu dieser Gruppe beantragen?",
+	"Capacity planning":                           "Kapazitätsplanung",
+	"Confirm group deletion":                      "Löschen der Gruppe bestätigen",
+	"Confirm revert":                              "Zurücksetzen bestätigen",
+	"Confirm service account deletion":            "Löschen des Dienstkontos bestätigen",
+	"Confirm user deletion":                       "Löschen des Benutzers bestätigen",
+	"Confirm with your password":                  "Mit Ihrem Passwort bestätigen",
+	"Contact (optional)":                          "Kontakt (optional)",
+	"Create group":                                "Gruppe anlegen",
+	"Create service account":                      "Dienstkonto anlegen",
+	"Create user":                                 "Benutzer anlegen",
+	"Created %s %q.":                              "%s %q wurde angelegt.",
+	"Deactivated users":                           "Deaktivierte Benutzer",
+	"Deadline":                                    "Frist",
+	"Default membership for new users (optional)": "Standardmitgliedschaft für neue Benutzer (optional)",
+	"Delete group":                                "Gruppe löschen",
+	"Delete service account":                      "Dienstkonto löschen",
+	"Delete user":                                 "Benutzer löschen",
+	"Deleted %s %q.":                              "%s %q wurde gelöscht.",
+	"Description (optional)":                      "Beschreibung (optional)",
+	"Disabled (cannot log in)":                    "Gesperrt (kann sich nicht anmelden)",
+	"Domain":                                      "Domain",
+	"Edit group":                                  "Gruppe bearbeiten",
+	"Edit group members":                          "Gruppenmitglieder bearbeiten",
+	"Edit service account":                        "Dienstkonto bearbeiten",
+	"Edit user":                                   "Benutzer bearbeiten",
+	"Email address (optional in Portunus, but required by some services)": "E-Mail-Adresse (in Portunus optional, aber von manchen Diensten benötigt)",
+	"Export users and groups": "Benutzer und Gruppen exportieren",
+	"Family name":             "Nachname",
+	"Family name first (e.g. for East Asian or Hungarian names)": "Nachname zuerst (z. B. für ostasiatische oder ungarische Namen)",
+	"Given name":                                       "Vorname",
+	"Grants permissions in LDAP?":                      "Gewährt Berechtigungen im LDAP?",
+	"Grants permissions in Portunus?":                  "Gewährt Berechtigungen in Portunus?",
+	"Grants read access in LDAP to these groups only?": "Gewährt Lesezugriff im LDAP nur auf diese Gruppen?",
+	"Grants write access to the LDAP subtree \"ou=<name>,ou=subtrees\"? (optional, enter name)": "Gewährt Schreibzugriff auf den LDAP-Teilbaum \"ou=<name>,ou=subtrees\"? (optional, Namen eingeben)",
+	"Group ID": "Gruppen-ID",
+	"Groups whose members are also members of this group": "Gruppen, deren Mitglieder auch Mitglieder dieser Gruppe sind",
+	"How did you verify the user's identity?":             "Wie haben Sie die Identität des Benutzers überprüft?",
+	"Initial password":        "Anfangspasswort",
+	"Is a POSIX group":        "Ist eine POSIX-Gruppe",
+	"Is a POSIX user account": "Ist ein POSIX-Benutzerkonto",
+	"Join requests":           "Beitrittsanträge",
+	"Labels (optional, one \"key=value\" per line)": "Labels (optional, ein \"key=value\" pro Zeile)",
+	"Login name or DN":               "Benutzername oder DN",
+	"Login shell (optional)":         "Login-Shell (optional)",
+	"Maintenance mode":               "Wartungsmodus",
+	"Manager (login name, optional)": "Vorgesetzte(r) (Benutzername, optional)",
+	"Master data":                    "Stammdaten",
+	"Members of this group":          "Mitglieder dieser Gruppe",
+	"Members to keep (unselected members will be removed from the group)": "Zu behaltende Mitglieder (nicht ausgewählte Mitglieder werden aus der Gruppe entfernt)",
+	"Mobile number (optional)": "Mobilnummer (optional)",
+	"Name order":               "Namensreihenfolge",
+	"Nested groups":            "Verschachtelte Gruppen",
+	"New users with an email address in these domains (space-separated)": "Neue Benutzer mit einer E-Mail-Adresse in diesen Domains (durch Leerzeichen getrennt)",
+	"Owner (login name of the user responsible for this group)":          "Verantwortlich (Benutzername der für diese Gruppe verantwortlichen Person)",
+	"Permissions":               "Berechtigungen",
+	"POSIX group IDs":           "POSIX-Gruppen-IDs",
+	"Postal address (optional)": "Postanschrift (optional)",
+	"Preview":                   "Vorschau",
+	"Preview changes":           "Änderungen anzeigen",
+	"Primary domain":            "Primäre Domain",
+	"Primary group ID":          "Primäre Gruppen-ID",
+	"Publish this group in the LDAP directory?":  "Diese Gruppe im LDAP-Verzeichnis veröffentlichen?",
+	"Purge users now (cannot be undone)":         "Benutzer jetzt endgültig löschen (kann nicht rückgängig gemacht werden)",
+	"Read access":                                "Lesezugriff",
+	"Read access to groups only":                 "Lesezugriff nur auf Gruppen",
+	"Read access to users only":                  "Lesezugriff nur auf Benutzer",
+	"Reject requests from":                       "Anträge ablehnen von",
+	"Reset password":                             "Passwort zurücksetzen",
+	"Reset two-factor authentication":            "Zwei-Faktor-Authentifizierung zurücksetzen",
+	"Restore backup":                             "Sicherung wiederherstellen",
+	"Restore users":                              "Benutzer wiederherstellen",
+	"Review memberships":                         "Mitgliedschaften prüfen",
+	"Start access review":                        "Zugriffsprüfung starten",
+	"Start review":                               "Prüfung starten",
+	"Started %s %q.":                             "%s %q wurde gestartet.",
+	"Submit":                                     "Absenden",
+	"Submit decisions":                           "Entscheidungen absenden",
+	"Submitted decisions.":                       "Entscheidungen wurden abgesendet.",
+	"Submitted decisions for %s %q.":             "Entscheidungen für %s %q wurden abgesendet.",
+	"System status":                              "Systemstatus",
+	"Telephone number (optional)":                "Telefonnummer (optional)",
+	"Temporary members (optional)":               "Befristete Mitglieder (optional)",
+	"Test credentials":                           "Zugangsdaten testen",
+	"Test LDAP credentials":                      "LDAP-Zugangsdaten testen",
+	"Type the login name of the user to confirm": "Geben Sie zur Bestätigung den Benutzernamen ein",
+	"User ID":                                    "Benutzer-ID",
+	"Valid until (optional)":                     "Gültig bis (optional)",
+	"Yes (if not, the group still grants its permissions, but applications cannot see it)": "Ja (andernfalls gewährt die Gruppe weiterhin ihre Berechtigungen, ist aber für Anwendungen nicht sichtbar)",
+	"Yes, on the \"Browse groups\" page (requests are decided on by the owner)":            "Ja, auf der Seite \"Gruppen durchsuchen\" (über Anträge entscheidet die verantwortliche Person)",
+	"Yes, the changes shown above are correct":                                             "Ja, die oben gezeigten Änderungen sind korrekt",
+	"You cannot delete yourself.":                                                          "Sie können sich nicht selbst löschen.",
+	"access review":                                                                        "Zugriffsprüfung",
+	"does not match the login name of this user":                                           "stimmt nicht mit dem Benutzernamen dieses Benutzers überein",
+	"is not valid":    "ist nicht gültig",
+	"service account": "Dienstkonto",
+	"was changed by someone else in the meantime": "wurde zwischenzeitlich von jemand anderem geändert",
+}
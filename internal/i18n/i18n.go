@@ -0,0 +1,117 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package i18n translates the texts of the web UI.
+//
+// Texts are written in English in the code, and the English text doubles as
+// the key for looking up the translation (like msgid in gettext). Texts that
+// do not have a translation are shown in English, so UI parts that have not
+// been translated yet stay usable.
+package i18n
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Locale translates texts into one language.
+type Locale struct {
+	//The primary language subtag from BCP 47, e.g. "en" or "de".
+	Tag string
+	//key = English text, value = translated text
+	messages map[string]string
+}
+
+var (
+	// English is the language that all texts are written in, and the default
+	// when the user's browser does not ask for any supported language.
+	English = Locale{Tag: "en"}
+	// German is a translation of the UI into German.
+	German = Locale{Tag: "de", messages: germanMessages}
+)
+
+// Locales contains all supported locales.
+var Locales = []Locale{English, German}
+
+// T returns the translation of the given text, or the text itself if it has
+// no translation.
+func (l Locale) T(msg string) string {
+	if translated, exists := l.messages[msg]; exists {
+		return translated
+	}
+	return msg
+}
+
+// Tf is like fmt.Sprintf, but translates the format string first.
+func (l Locale) Tf(format string, args ...any) string {
+	return fmt.Sprintf(l.T(format), args...)
+}
+
+// ForRequest returns the locale that best matches the Accept-Language header
+// of the given request.
+func ForRequest(r *http.Request) Locale {
+	return Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// Negotiate returns the locale that best matches the given value of an
+// Accept-Language header (see RFC 9110, section 12.5.4). Region subtags are
+// ignored, so "de-AT" selects German. If none of the requested languages is
+// supported, English is returned.
+func Negotiate(acceptLanguage string) Locale {
+	type candidate struct {
+		Tag     string
+		Quality float64
+	}
+	var candidates []candidate
+	for _, entry := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(entry, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		tag, _, _ = strings.Cut(tag, "-")
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			value, isQuality := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if isQuality {
+				var err error
+				quality, err = strconv.ParseFloat(value, 64)
+				if err != nil {
+					quality = 0
+				}
+			}
+		}
+		if quality > 0 {
+			candidates = append(candidates, candidate{tag, quality})
+		}
+	}
+
+	//entries with the same quality keep the order from the header
+	slices.SortStableFunc(candidates, func(lhs, rhs candidate) int {
+		switch {
+		case lhs.Quality > rhs.Quality:
+			return -1
+		case lhs.Quality < rhs.Quality:
+			return +1
+		default:
+			return 0
+		}
+	})
+	for _, c := range candidates {
+		if c.Tag == "*" {
+			return English
+		}
+		for _, l := range Locales {
+			if l.Tag == c.Tag {
+				return l
+			}
+		}
+	}
+	return English
+}
@@ -0,0 +1,51 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package i18n
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	testCases := map[string]string{
+		"":                            "en",
+		"de":                          "de",
+		"de-DE,de;q=0.9,en;q=0.8":     "de",
+		"DE-at":                       "de",
+		"fr":                          "en",
+		"fr,de;q=0.5":                 "de",
+		"en;q=0.5,de":                 "de",
+		"en,de":                       "en",
+		"de;q=0,en":                   "en",
+		"de;q=invalid":                "en",
+		"*":                           "en",
+		"*;q=0.9,de;q=0.8":            "en",
+		"  de-CH ; q=0.7 , fr;q=0.9 ": "de",
+	}
+	for header, expected := range testCases {
+		assert.DeepEqual(t, "locale for "+header, Negotiate(header).Tag, expected)
+	}
+}
+
+var formatVerbRx = regexp.MustCompile(`%[a-z%]`)
+
+func TestTranslationsHaveSameFormatVerbs(t *testing.T) {
+	for _, l := range Locales {
+		for msg, translated := range l.messages {
+			//the order of arguments cannot change, but the position in the sentence can
+			expected := formatVerbRx.FindAllString(msg, -1)
+			actual := formatVerbRx.FindAllString(translated, -1)
+			if !slices.Equal(expected, actual) {
+				t.Errorf("%s translation of %q has format verbs %v, but expected %v", l.Tag, msg, actual, expected)
+			}
+		}
+	}
+}
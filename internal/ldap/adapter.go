@@ -7,13 +7,19 @@
 package ldap
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/audit"
 	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
 )
 
 // Adapter translates changes to the Portunus database into updates in the LDAP
@@ -24,15 +30,98 @@ type Adapter struct {
 	init         sync.Once
 	objects      []Object //persisted objects, key = object DN
 	objectsMutex sync.Mutex
+	changelog    *changelog //nil if disabled
+	renderLabels bool
+	layout       Layout
+	timeNow      func() time.Time //can be replaced in unit tests
+
+	disabledUsers DisabledUserHandling
+
+	status         statusTracker
+	retryInterval  time.Duration
+	retryDelay     time.Duration //current backoff, 0 if no retry is scheduled
+	retryQueuePath string        //empty if disabled
+	resyncChan     chan struct{} //signaled by Reconnect()
+
+	acceptPasswordChanges bool
+	driftHandling         DriftHandling
+	auditLog              *audit.Log //may be nil
+}
+
+// AdapterOptions contains optional settings for an Adapter.
+type AdapterOptions struct {
+	//If non-zero, the Adapter records its changes below cn=changelog,
+	//retaining up to this many of the most recent changes.
+	ChangelogSize uint64
+	//If true, the labels of users and groups are rendered into the
+	//portunusLabel attribute.
+	RenderLabels bool
+	//The names of the OUs containing the objects managed by Portunus.
+	Layout Layout
+	//If non-zero, failed write operations are retried after this interval.
+	//The interval doubles after each unsuccessful retry, up to one hour.
+	//Regardless of this setting, failed write operations are always retried
+	//on the next change to the Portunus database.
+	RetryInterval time.Duration
+	//If non-empty, failed write operations are recorded in this file, so that
+	//they are also retried after Portunus is restarted.
+	RetryQueuePath string
+	//If true, password changes that users make in the LDAP directory (e.g.
+	//through `passwd` with pam_ldap) are copied into the Portunus database.
+	//This requires the LDAP server's ACL to allow users to write their own
+	//password.
+	AcceptPasswordChanges bool
+	//Whether the LDAP directory is checked for objects that were modified,
+	//added or deleted by someone other than Portunus, and what happens to them.
+	//The zero value is equivalent to DriftHandlingIgnore.
+	DriftHandling DriftHandling
+	//If not nil, password changes and other imported changes that were made in
+	//the LDAP directory are recorded here.
+	AuditLog *audit.Log
+	//How disabled users appear in the LDAP directory. The zero value is
+	//equivalent to DisabledUserHandlingRemove.
+	DisabledUserHandling DisabledUserHandling
 }
 
+// The upper limit for the backoff of AdapterOptions.RetryInterval.
+const maxRetryDelay = time.Hour
+
 // NewAdapter initializes an Adapter instance.
-func NewAdapter(nexus core.Nexus, conn Connection) *Adapter {
-	return &Adapter{nexus: nexus, conn: conn}
+func NewAdapter(nexus core.Nexus, conn Connection, opts AdapterOptions) *Adapter {
+	a := &Adapter{
+		nexus:          nexus,
+		conn:           conn,
+		renderLabels:   opts.RenderLabels,
+		layout:         opts.Layout.withDefaults(),
+		timeNow:        time.Now,
+		retryInterval:  opts.RetryInterval,
+		retryQueuePath: opts.RetryQueuePath,
+		resyncChan:     make(chan struct{}, 1),
+
+		acceptPasswordChanges: opts.AcceptPasswordChanges,
+		driftHandling:         opts.DriftHandling,
+		auditLog:              opts.AuditLog,
+	}
+	if a.driftHandling == "" {
+		a.driftHandling = DriftHandlingIgnore
+	}
+	a.disabledUsers = opts.DisabledUserHandling
+	if a.disabledUsers == "" {
+		a.disabledUsers = DisabledUserHandlingRemove
+	}
+	if opts.ChangelogSize > 0 {
+		a.changelog = newChangelog(opts.ChangelogSize)
+	}
+	return a
 }
 
 // Run listens for changes to the Portunus database until `ctx` expires.
-// An error is returned if any write into the LDAP database fails.
+// Pending writes are flushed before Run() returns.
+//
+// When a write into the LDAP database fails (e.g. because an object violates
+// the server's schema), the error is logged and reported in Status(), and the
+// remaining writes proceed as usual. An error is only returned if the basic
+// directory structure cannot be created.
 func (a *Adapter) Run(ctx context.Context) error {
 	//create main directory structure, but only when Run() is called for the first time
 	//(this precaution is not relevant for regular execution because main() calls
@@ -41,80 +130,276 @@ func (a *Adapter) Run(ctx context.Context) error {
 	isFirstRun := false
 	a.init.Do(func() { isFirstRun = true })
 	if isFirstRun {
-		for _, addReq := range makeStaticObjects(a.conn.DNSuffix()) {
+		staticObjects := makeStaticObjects(a.conn.DNSuffix(), a.nexus.ValidationConfig().Domains, a.layout)
+		if a.changelog != nil {
+			staticObjects = append(staticObjects, a.changelog.containerObject(a.conn.DNSuffix()))
+		}
+		for _, addReq := range staticObjects {
 			err := a.conn.Add(addReq)
+			//with 389-ds, portunus-orchestrator might have created the suffix
+			//objects before us to put its ACIs on them
+			if err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultEntryAlreadyExists) {
+				return err
+			}
+		}
+		if a.retryQueuePath != "" {
+			failures, err := loadRetryQueue(a.retryQueuePath)
 			if err != nil {
 				return err
 			}
+			a.restoreFailures(failures)
 		}
 	}
 
 	//we need to be able to explicitly cancel the nexus listener to avoid it
-	//deadlocking on `operationsChan` not being listened to anymore
+	//deadlocking on `writeChan` not being listened to anymore
 	ctxListen, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	//writes get sent to us from whatever goroutine the nexus update is running on
 	writeChan := make(chan core.Database, 1)
 	a.nexus.AddListener(ctxListen, func(db core.Database) {
-		writeChan <- db
+		//if we stop listening between the nexus checking `ctxListen` and us
+		//getting here, the send could block forever (and with it, the nexus
+		//update that is calling us), so we need to watch `ctxListen` here as well
+		select {
+		case writeChan <- db:
+		case <-ctxListen.Done():
+		}
 	})
 
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if a.acceptPasswordChanges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poll(ctxListen, passwordChangePollInterval, a.checkPasswordChanges)
+		}()
+	}
+	if a.driftHandling != DriftHandlingIgnore {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poll(ctxListen, driftCheckInterval, a.checkDrift)
+		}()
+	}
+
+	var (
+		lastDB    core.Database
+		hasLastDB bool
+		retryChan <-chan time.Time //nil while no retry is scheduled
+	)
 	for {
 		select {
 		case <-ctx.Done():
+			//if an update came in right before we were stopped, make sure that it
+			//does not get lost
+			select {
+			case db := <-writeChan:
+				a.writeDatabase(db)
+			default:
+			}
 			return nil
 		case db := <-writeChan:
-			for _, op := range a.computeUpdates(db) {
-				err := op.ExecuteOn(a.conn)
-				if err != nil {
-					return err
-				}
+			lastDB = db
+			hasLastDB = true
+		case <-retryChan:
+		case <-a.resyncChan:
+			if !hasLastDB {
+				continue
 			}
 		}
+
+		retryChan = nil
+		retryDelay := a.writeDatabase(lastDB)
+		if retryDelay > 0 {
+			retryChan = time.After(retryDelay)
+		}
 	}
 }
 
-func (a *Adapter) computeUpdates(db core.Database) []operation {
-	newObjects := renderDBToLDAP(db, a.conn.DNSuffix())
-
+// Takes over the failed operations from a previous run. Adds and modifies
+// will be retried anyway because the first sync renders all objects, but
+// deletes need to be retried explicitly since their objects are not in the
+// Portunus database anymore.
+func (a *Adapter) restoreFailures(failures []OperationFailure) {
 	a.objectsMutex.Lock()
 	defer a.objectsMutex.Unlock()
+	a.status.restore(failures)
+	for _, f := range failures {
+		if f.ChangeType == "delete" {
+			a.objects = append(a.objects, Object{DN: f.DN})
+		}
+	}
+}
 
-	result := computeUpdates(a.objects, newObjects)
-	a.objects = newObjects
+// Reconnect replaces the connection to the LDAP server with a fresh one. This
+// is used when slapd was restarted, e.g. to load a renewed TLS certificate.
+// Afterwards, Run() writes the current state of the Portunus database again,
+// so that writes that failed while slapd was down are not left pending until
+// the next change.
+func (a *Adapter) Reconnect() error {
+	a.objectsMutex.Lock()
+	err := a.conn.Reconnect()
+	a.objectsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case a.resyncChan <- struct{}{}:
+	default:
+		//a resync is already pending
+	}
+	return nil
+}
+
+// Status returns a report on recent write operations into the LDAP database.
+func (a *Adapter) Status() AdapterStatus {
+	return a.status.get()
+}
+
+// ServiceAccountDN returns the DN that the service account with the given name
+// uses to bind to the LDAP server.
+func (a *Adapter) ServiceAccountDN(name string) string {
+	r := dnResolver{layout: a.layout, primarySuffix: a.conn.DNSuffix()}
+	return r.serviceAccountDN(name)
+}
+
+// UserDN returns the DN of the given user in the LDAP directory.
+func (a *Adapter) UserDN(u core.User) string {
+	r := dnResolver{layout: a.layout, primarySuffix: a.conn.DNSuffix()}
+	return r.userObjectDN(u)
+}
+
+// GroupDNs returns the DNs of the objects that the given group is rendered
+// into in the LDAP directory (two for POSIX groups, otherwise one), or nil if
+// the group is hidden from LDAP.
+func (a *Adapter) GroupDNs(g core.Group) []string {
+	r := dnResolver{layout: a.layout, primarySuffix: a.conn.DNSuffix()}
+	return r.groupObjectDNs(g)
+}
+
+// Objects returns the objects that Portunus has written into the LDAP
+// directory, without their password hashes. Parents come before their
+// children, so the result can be exported as an LDIF file.
+func (a *Adapter) Objects() []Object {
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+	result := make([]Object, 0, len(a.objects))
+	for _, obj := range a.objects {
+		if obj.Attributes != nil { //skip placeholders for failed deletions
+			result = append(result, obj.withoutPassword())
+		}
+	}
+	slices.SortFunc(result, func(lhs, rhs Object) int {
+		return cmp.Or(
+			cmp.Compare(strings.Count(lhs.DN, ","), strings.Count(rhs.DN, ",")),
+			strings.Compare(lhs.DN, rhs.DN),
+		)
+	})
 	return result
 }
 
+// Returns the primary suffix and the suffixes of all additional domains.
+func (a *Adapter) allSuffixes() []string {
+	suffixes := []string{a.conn.DNSuffix()}
+	for _, domainName := range a.nexus.ValidationConfig().Domains {
+		suffixes = append(suffixes, core.SuffixOfDomainName(domainName))
+	}
+	return suffixes
+}
+
+// Writes all changes between the last known state of the LDAP database and
+// the given Portunus database. Returns after which delay a retry is needed,
+// or 0 if no retry shall be scheduled.
+func (a *Adapter) writeDatabase(db core.Database) time.Duration {
+	newObjects := renderDBToLDAP(db, a.conn.DNSuffix(), a.layout, a.renderLabels, a.disabledUsers)
+
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+
+	a.status.beginSync()
+	isFailedDN := make(map[string]bool)
+	for _, op := range computeUpdates(a.objects, newObjects) {
+		err := op.ExecuteOn(a.conn)
+		if op.DeleteRequest != nil && goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+			//the object is already gone (e.g. when a delete from the retry queue
+			//arrives at a fresh slapd), so the directory is in the desired state
+			err = nil
+		}
+		a.status.recordResult(op, err, true, a.timeNow())
+		if err != nil {
+			isFailedDN[op.DN()] = true
+			continue
+		}
+		if a.changelog == nil {
+			continue
+		}
+		//failures to write changelog entries are reported, but not retried
+		for _, logOp := range a.changelog.record(op, a.conn.DNSuffix(), a.timeNow()) {
+			a.status.recordResult(logOp, logOp.ExecuteOn(a.conn), false, a.timeNow())
+		}
+	}
+	a.objects = mergeObjects(a.objects, newObjects, isFailedDN)
+	a.status.recordObjects(a.objects)
+
+	var nextRetryAt time.Time
+	now := a.timeNow()
+	switch {
+	case len(isFailedDN) == 0 || a.retryInterval == 0:
+		a.retryDelay = 0
+	case a.retryDelay == 0:
+		a.retryDelay = a.retryInterval
+	default:
+		a.retryDelay = min(2*a.retryDelay, max(a.retryInterval, maxRetryDelay))
+	}
+	if a.retryDelay > 0 {
+		nextRetryAt = now.Add(a.retryDelay)
+	}
+	a.status.endSync(now, nextRetryAt)
+	if a.retryQueuePath != "" {
+		err := saveRetryQueue(a.retryQueuePath, a.status.get().Failures)
+		if err != nil {
+			logg.Error("cannot persist failed LDAP operations: %s", err.Error())
+		}
+	}
+	return a.retryDelay
+}
+
 // Renders the static objects that we need to establish our basic LDAP
 // directory structure.
-func makeStaticObjects(dnSuffix string) (result []goldap.AddRequest) {
+func makeStaticObjects(dnSuffix string, domainNames []string, layout Layout) (result []goldap.AddRequest) {
 	//shorthand for obtaining a goldap.Attribute object
 	attr := func(typeName string, values ...string) goldap.Attribute {
 		return goldap.Attribute{Type: typeName, Vals: values}
 	}
 
-	//domain-component object
-	suffixRDNs := strings.Split(dnSuffix, ",")
-	dcName := strings.TrimPrefix(suffixRDNs[0], "dc=")
-	result = append(result, goldap.AddRequest{
-		DN: dnSuffix,
-		Attributes: []goldap.Attribute{
-			attr("dc", dcName),
-			attr("o", dcName),
-			attr("objectClass", "dcObject", "organization", "top"),
-		},
-	})
-
-	//organizational units
-	for _, ouName := range []string{"users", "groups", "posix-groups"} {
+	//domain-component object and organizational units below each suffix
+	addSuffix := func(suffix string, ouNames []string) {
+		suffixRDNs := strings.Split(suffix, ",")
+		dcName := strings.TrimPrefix(suffixRDNs[0], "dc=")
 		result = append(result, goldap.AddRequest{
-			DN: fmt.Sprintf("ou=%s,%s", ouName, dnSuffix),
+			DN: suffix,
 			Attributes: []goldap.Attribute{
-				attr("ou", ouName),
-				attr("objectClass", "organizationalUnit", "top"),
+				attr("dc", dcName),
+				attr("o", dcName),
+				attr("objectClass", "dcObject", "organization", "top"),
 			},
 		})
+		for _, ouName := range ouNames {
+			result = append(result, goldap.AddRequest{
+				DN: fmt.Sprintf("ou=%s,%s", ouName, suffix),
+				Attributes: []goldap.Attribute{
+					attr("ou", ouName),
+					attr("objectClass", "organizationalUnit", "top"),
+				},
+			})
+		}
+	}
+	addSuffix(dnSuffix, layout.allOUs())
+	for _, domainName := range domainNames {
+		addSuffix(core.SuffixOfDomainName(domainName), layout.domainOUs())
 	}
 
 	//service user account
@@ -141,12 +426,38 @@ func makeStaticObjects(dnSuffix string) (result []goldap.AddRequest) {
 }
 
 // Converts a core.Database instance into a list of LDAP objects.
-func renderDBToLDAP(db core.Database, dnSuffix string) (result []Object) {
+func renderDBToLDAP(db core.Database, dnSuffix string, layout Layout, withLabels bool, disabledUsers DisabledUserHandling) (result []Object) {
+	//LDAP clients generally do not resolve nested groups, so all attributes
+	//that describe group memberships contain the transitive closure instead
+	db.Groups = core.ResolveNestedGroups(db.Groups)
+	r := newDNResolver(db, dnSuffix, layout)
+
+	//disabled users are left out entirely, including from the members of all
+	//groups (ResolveNestedGroups() returned clones, so we can edit them here)
+	if disabledUsers != DisabledUserHandlingMark {
+		db.Users = slices.DeleteFunc(slices.Clone(db.Users), func(u core.User) bool {
+			if u.Disabled {
+				for _, g := range db.Groups {
+					delete(g.MemberLoginNames, u.LoginName)
+				}
+			}
+			return u.Disabled
+		})
+	}
+
+	//groups that are hidden from LDAP are not rendered, and do not appear in
+	//the memberships of their users, but they still grant their permissions
+	//through the virtual groups below
+	publishedGroups := slices.DeleteFunc(slices.Clone(db.Groups), func(g core.Group) bool { return g.IsHiddenFromLDAP })
+
 	for _, u := range db.Users {
-		result = append(result, renderUser(u, dnSuffix, db.Groups))
+		result = append(result, renderUser(u, r, publishedGroups, withLabels))
+	}
+	for _, g := range publishedGroups {
+		result = append(result, renderGroup(g, r, withLabels)...)
 	}
-	for _, g := range db.Groups {
-		result = append(result, renderGroup(g, dnSuffix)...)
+	for _, s := range db.ServiceAccounts {
+		result = append(result, renderServiceAccount(s, r))
 	}
 
 	//render the virtual group that controls read access to the LDAP server (this
@@ -156,7 +467,7 @@ func renderDBToLDAP(db core.Database, dnSuffix string) (result []Object) {
 		if group.Permissions.LDAP.CanRead {
 			for loginName, isMember := range group.MemberLoginNames {
 				if isMember {
-					dn := fmt.Sprintf("uid=%s,ou=users,%s", loginName, dnSuffix)
+					dn := r.userDN(loginName)
 					ldapViewerDNames = append(ldapViewerDNames, dn)
 				}
 			}
@@ -175,5 +486,117 @@ func renderDBToLDAP(db core.Database, dnSuffix string) (result []Object) {
 		},
 	})
 
+	//render the virtual groups that control write access to the subtrees below
+	//layout.SubtreesOU (the LDAP server's ACL derives the group name from the subtree
+	//name); since a user may be in several groups that grant access to the same
+	//subtree, we need to deduplicate the members
+	isSubtreeWriter := make(map[string]map[string]bool)
+	for _, group := range db.Groups {
+		subtree := group.Permissions.LDAP.WriteSubtree
+		if subtree == "" {
+			continue
+		}
+		if isSubtreeWriter[subtree] == nil {
+			isSubtreeWriter[subtree] = make(map[string]bool)
+		}
+		for loginName, isMember := range group.MemberLoginNames {
+			if isMember {
+				dn := r.userDN(loginName)
+				isSubtreeWriter[subtree][dn] = true
+			}
+		}
+	}
+	for _, subtree := range slices.Sorted(maps.Keys(isSubtreeWriter)) {
+		dnames := slices.Sorted(maps.Keys(isSubtreeWriter[subtree]))
+		if len(dnames) == 0 {
+			//groups need to have at least one member
+			dnames = []string{"cn=nobody," + dnSuffix}
+		}
+		result = append(result, Object{
+			DN: fmt.Sprintf("cn=portunus-writers-%s,%s", subtree, dnSuffix),
+			Attributes: map[string][]string{
+				"cn":          {"portunus-writers-" + subtree},
+				"member":      dnames,
+				"objectClass": {"groupOfNames", "top"},
+			},
+		})
+	}
+
+	//render the virtual groups that control partial read access to the LDAP
+	//server (the LDAP server's ACL derives the group name from the scope or, for
+	//read access to individual groups, from the group name); unlike above, the
+	//scope groups are only rendered when they have members
+	isScopeReader := map[string]map[string]bool{
+		"users":  make(map[string]bool),
+		"groups": make(map[string]bool),
+	}
+	isGroupReader := make(map[string]map[string]bool)
+	for _, group := range db.Groups {
+		perms := group.Permissions.LDAP
+		for loginName, isMember := range group.MemberLoginNames {
+			if !isMember {
+				continue
+			}
+			dn := r.userDN(loginName)
+			if perms.CanReadUsers {
+				isScopeReader["users"][dn] = true
+			}
+			if perms.CanReadGroups {
+				isScopeReader["groups"][dn] = true
+			}
+		}
+
+		for name, isReadable := range perms.ReadGroupNames {
+			if !isReadable {
+				continue
+			}
+			if isGroupReader[name] == nil {
+				isGroupReader[name] = make(map[string]bool)
+			}
+			for loginName, isMember := range group.MemberLoginNames {
+				if isMember {
+					isGroupReader[name][r.userDN(loginName)] = true
+				}
+			}
+		}
+	}
+	for _, s := range db.ServiceAccounts {
+		dn := r.serviceAccountDN(s.Name)
+		if s.ReadScopes.Users {
+			isScopeReader["users"][dn] = true
+		}
+		if s.ReadScopes.Groups {
+			isScopeReader["groups"][dn] = true
+		}
+	}
+	for _, scope := range []string{"users", "groups"} {
+		if len(isScopeReader[scope]) == 0 {
+			continue
+		}
+		result = append(result, Object{
+			DN: fmt.Sprintf("cn=portunus-readers-%s,%s", scope, dnSuffix),
+			Attributes: map[string][]string{
+				"cn":          {"portunus-readers-" + scope},
+				"member":      slices.Sorted(maps.Keys(isScopeReader[scope])),
+				"objectClass": {"groupOfNames", "top"},
+			},
+		})
+	}
+	for _, name := range slices.Sorted(maps.Keys(isGroupReader)) {
+		dnames := slices.Sorted(maps.Keys(isGroupReader[name]))
+		if len(dnames) == 0 {
+			//groups need to have at least one member
+			dnames = []string{"cn=nobody," + dnSuffix}
+		}
+		result = append(result, Object{
+			DN: fmt.Sprintf("cn=portunus-readers-group-%s,%s", name, dnSuffix),
+			Attributes: map[string][]string{
+				"cn":          {"portunus-readers-group-" + name},
+				"member":      dnames,
+				"objectClass": {"groupOfNames", "top"},
+			},
+		})
+	}
+
 	return
 }
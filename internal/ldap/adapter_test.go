@@ -8,6 +8,9 @@ package ldap
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,14 +18,21 @@ import (
 	goldap "github.com/go-ldap/ldap/v3"
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/errext"
 )
 
 func setupAdapterTest(t *testing.T) (conn *test.LDAPConnectionDouble, updateDBWithRunningAdapter func(core.UpdateAction) errext.ErrorSet) {
+	_, conn, updateDBWithRunningAdapter = setupAdapterTestWithOptions(t, AdapterOptions{})
+	return conn, updateDBWithRunningAdapter
+}
+
+func setupAdapterTestWithOptions(t *testing.T, opts AdapterOptions) (adapter *Adapter, conn *test.LDAPConnectionDouble, updateDBWithRunningAdapter func(core.UpdateAction) errext.ErrorSet) {
 	vcfg := core.GetValidationConfigForTests()
 	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
 	conn = test.NewLDAPConnectionDouble("dc=example,dc=org")
-	adapter := NewAdapter(nexus, conn)
+	adapter = NewAdapter(nexus, conn, opts)
+	adapter.timeNow = func() time.Time { return time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC) }
 
 	//This can be used by the test to update the database while adapter.Run() is
 	//running in a separate goroutine. This function takes care to shutdown
@@ -62,27 +72,33 @@ func setupAdapterTest(t *testing.T) (conn *test.LDAPConnectionDouble, updateDBWi
 			{Type: "objectClass", Vals: []string{"dcObject", "organization", "top"}},
 		},
 	})
+	for _, ouName := range adapter.layout.allOUs() {
+		conn.ExpectAdd(goldap.AddRequest{
+			DN: "ou=" + ouName + ",dc=example,dc=org",
+			Attributes: []goldap.Attribute{
+				{Type: "ou", Vals: []string{ouName}},
+				{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
+			},
+		})
+	}
+	//GetValidationConfigForTests() has one extra domain, "example.net"
 	conn.ExpectAdd(goldap.AddRequest{
-		DN: "ou=users,dc=example,dc=org",
-		Attributes: []goldap.Attribute{
-			{Type: "ou", Vals: []string{"users"}},
-			{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
-		},
-	})
-	conn.ExpectAdd(goldap.AddRequest{
-		DN: "ou=groups,dc=example,dc=org",
-		Attributes: []goldap.Attribute{
-			{Type: "ou", Vals: []string{"groups"}},
-			{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
-		},
-	})
-	conn.ExpectAdd(goldap.AddRequest{
-		DN: "ou=posix-groups,dc=example,dc=org",
+		DN: "dc=example,dc=net",
 		Attributes: []goldap.Attribute{
-			{Type: "ou", Vals: []string{"posix-groups"}},
-			{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
+			{Type: "dc", Vals: []string{"example"}},
+			{Type: "o", Vals: []string{"example"}},
+			{Type: "objectClass", Vals: []string{"dcObject", "organization", "top"}},
 		},
 	})
+	for _, ouName := range adapter.layout.domainOUs() {
+		conn.ExpectAdd(goldap.AddRequest{
+			DN: "ou=" + ouName + ",dc=example,dc=net",
+			Attributes: []goldap.Attribute{
+				{Type: "ou", Vals: []string{ouName}},
+				{Type: "objectClass", Vals: []string{"organizationalUnit", "top"}},
+			},
+		})
+	}
 	conn.ExpectAdd(goldap.AddRequest{
 		DN: "cn=portunus,dc=example,dc=org",
 		Attributes: []goldap.Attribute{
@@ -99,6 +115,16 @@ func setupAdapterTest(t *testing.T) (conn *test.LDAPConnectionDouble, updateDBWi
 			{Type: "objectClass", Vals: []string{"organizationalRole", "top"}},
 		},
 	})
+	if opts.ChangelogSize > 0 {
+		conn.ExpectAdd(goldap.AddRequest{
+			DN: "cn=changelog,dc=example,dc=org",
+			Attributes: []goldap.Attribute{
+				{Type: "cn", Vals: []string{"changelog"}},
+				{Type: "description", Vals: []string{"Recent changes to the objects managed by Portunus"}},
+				{Type: "objectClass", Vals: []string{"organizationalRole", "top"}},
+			},
+		})
+	}
 
 	return
 }
@@ -224,6 +250,9 @@ func TestBasicOperations(t *testing.T) {
 
 const dummySSHPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGNvYUluYODNXoQKDGG+pTEigpsvJP2SHfMz0a+Hl2xO alice@example.org"
 
+// Only the JPEG header, but that is enough to pass validation.
+const dummyJPEGPhoto = "\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"
+
 // The password belonging to this hash is "foo".
 const dummyPasswordHash = "$6$sxI7hpdrkEHuquNj$6zcRp52hrMXSFeF1EOrdETuVYmAmOsYCiG7sCCP54CoX8vHwCEUURWxY5Si0LyvRoC/oZPDaNjUh4DDFBO/Wi/"
 
@@ -235,12 +264,15 @@ func TestAllFieldsFilled(t *testing.T) {
 	//put one user and one group in the database
 	action := func(db *core.Database) errext.ErrorSet {
 		db.Users = []core.User{{
-			LoginName:     "alice",
-			GivenName:     "Alice",
-			FamilyName:    "Administrator",
-			EMailAddress:  "alice@example.org",
-			SSHPublicKeys: []string{dummySSHPublicKey},
-			PasswordHash:  dummyPasswordHash,
+			LoginName:       "alice",
+			GivenName:       "Alice",
+			FamilyName:      "Administrator",
+			EMailAddress:    "alice@example.org",
+			SSHPublicKeys:   []string{dummySSHPublicKey},
+			PasswordHash:    dummyPasswordHash,
+			TelephoneNumber: "+49 30 1234-0",
+			MobileNumber:    "+49 151 2345678",
+			PostalAddress:   "Example Corp.\nc/o Cost Center $42\nExample Street 1\n12345 Example City",
 			POSIX: &core.UserPosixAttributes{
 				UID:           1234,
 				GID:           123,
@@ -248,6 +280,8 @@ func TestAllFieldsFilled(t *testing.T) {
 				LoginShell:    "/bin/zsh",
 				GECOS:         "Alice Allison",
 			},
+			ExtraAttributes: core.ExtraAttributes{"employeeNumber": "42"},
+			JPEGPhoto:       []byte(dummyJPEGPhoto),
 		}}
 		gid := core.PosixID(123)
 		db.Groups = []core.Group{{
@@ -258,7 +292,10 @@ func TestAllFieldsFilled(t *testing.T) {
 				Portunus: core.PortunusPermissions{IsAdmin: true},
 				LDAP:     core.LDAPPermissions{CanRead: true},
 			},
-			PosixGID: &gid,
+			PosixGID:       &gid,
+			EMailAddress:   "admins@example.org",
+			OwnerLoginName: "alice",
+			Notes:          "Please ask Alice before joining.",
 		}}
 		return nil
 	}
@@ -275,12 +312,17 @@ func TestAllFieldsFilled(t *testing.T) {
 			{Type: "givenName", Vals: []string{"Alice"}},
 			{Type: "userPassword", Vals: []string{dummyPasswordHash}},
 			{Type: "mail", Vals: []string{"alice@example.org"}},
+			{Type: "telephoneNumber", Vals: []string{"+49 30 1234-0"}},
+			{Type: "mobile", Vals: []string{"+49 151 2345678"}},
+			{Type: "postalAddress", Vals: []string{`Example Corp.$c/o Cost Center \2442$Example Street 1$12345 Example City`}},
 			{Type: "sshPublicKey", Vals: []string{dummySSHPublicKey}},
 			{Type: "uidNumber", Vals: []string{"1234"}},
 			{Type: "gidNumber", Vals: []string{"123"}},
 			{Type: "homeDirectory", Vals: []string{"/home/alice"}},
 			{Type: "loginShell", Vals: []string{"/bin/zsh"}},
 			{Type: "gecos", Vals: []string{"Alice Allison"}},
+			{Type: "employeeNumber", Vals: []string{"42"}},
+			{Type: "jpegPhoto", Vals: []string{dummyJPEGPhoto}},
 			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
 			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top", "posixAccount"}},
 		},
@@ -290,7 +332,10 @@ func TestAllFieldsFilled(t *testing.T) {
 		Attributes: []goldap.Attribute{
 			{Type: "cn", Vals: []string{"admins"}},
 			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
-			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+			{Type: "mail", Vals: []string{"admins@example.org"}},
+			{Type: "owner", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "description", Vals: []string{"Please ask Alice before joining."}},
+			{Type: "objectClass", Vals: []string{"portunusGroup", "groupOfNames", "top"}},
 		},
 	})
 	conn.ExpectAdd(goldap.AddRequest{
@@ -543,3 +588,1637 @@ func TestLDAPViewerPermission(t *testing.T) {
 	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
 	conn.CheckAllExecuted(t)
 }
+
+func TestLDAPPartialReadPermissions(t *testing.T) {
+	//This test checks that partial read permissions populate the respective
+	//virtual groups (but not "portunus-viewers").
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Auditor",
+			PasswordHash: "x",
+		}}
+		db.Groups = []core.Group{
+			{
+				Name:     "admins",
+				LongName: "Administrators",
+			},
+			{
+				Name:             "auditors",
+				LongName:         "Auditors",
+				MemberLoginNames: core.GroupMemberNames{"alice": true},
+				Permissions: core.Permissions{LDAP: core.LDAPPermissions{
+					CanReadUsers:   true,
+					ReadGroupNames: core.GroupMemberNames{"admins": true},
+				}},
+			},
+		}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Auditor"}},
+			{Type: "sn", Vals: []string{"Auditor"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=auditors,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=auditors,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"auditors"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-readers-users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-readers-users"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-readers-group-admins,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-readers-group-admins"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//when nobody has read access to the group anymore, its virtual group disappears
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[1].Permissions.LDAP.ReadGroupNames = nil
+		return nil
+	}
+	conn.ExpectDelete(goldap.DelRequest{DN: "cn=portunus-readers-group-admins,dc=example,dc=org"})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPServiceAccounts(t *testing.T) {
+	//This test checks that service accounts are rendered below their own OU,
+	//and that their read scopes populate the respective virtual groups.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.ServiceAccounts = []core.ServiceAccount{
+			{
+				Name:         "grafana",
+				PasswordHash: "x",
+				ReadScopes:   core.ServiceAccountScopes{Users: true},
+			},
+			{
+				Name:         "nextcloud",
+				Description:  "Nextcloud user backend",
+				PasswordHash: "y",
+				ReadScopes:   core.ServiceAccountScopes{Users: true, Groups: true},
+			},
+		}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=grafana,ou=service-accounts,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"grafana"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"organizationalRole", "simpleSecurityObject", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=nextcloud,ou=service-accounts,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"nextcloud"}},
+			{Type: "description", Vals: []string{"Nextcloud user backend"}},
+			{Type: "userPassword", Vals: []string{"y"}},
+			{Type: "objectClass", Vals: []string{"organizationalRole", "simpleSecurityObject", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-readers-users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-readers-users"}},
+			{Type: "member", Vals: []string{
+				"cn=grafana,ou=service-accounts,dc=example,dc=org",
+				"cn=nextcloud,ou=service-accounts,dc=example,dc=org",
+			}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-readers-groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-readers-groups"}},
+			{Type: "member", Vals: []string{"cn=nextcloud,ou=service-accounts,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//when the last service account with a particular scope loses it, the
+	//respective virtual group disappears
+	action = func(db *core.Database) errext.ErrorSet {
+		db.ServiceAccounts[1].ReadScopes.Groups = false
+		return nil
+	}
+	conn.ExpectDelete(goldap.DelRequest{DN: "cn=portunus-readers-groups,dc=example,dc=org"})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPSubtreeWritePermission(t *testing.T) {
+	//This test checks that Permissions.LDAP.WriteSubtree populates one virtual
+	//group per subtree, even if several groups grant access to the same subtree.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "printsrv",
+			GivenName:    "Print",
+			FamilyName:   "Server",
+			PasswordHash: "x",
+		}}
+		db.Groups = []core.Group{
+			{
+				Name:             "print-admins",
+				LongName:         "Printer administrators",
+				MemberLoginNames: core.GroupMemberNames{"printsrv": true},
+				Permissions:      core.Permissions{LDAP: core.LDAPPermissions{WriteSubtree: "printers"}},
+			},
+			{
+				Name:             "print-services",
+				LongName:         "Printer services",
+				MemberLoginNames: core.GroupMemberNames{"printsrv": true},
+				Permissions:      core.Permissions{LDAP: core.LDAPPermissions{WriteSubtree: "printers"}},
+			},
+		}
+		return nil
+	}
+
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=printsrv,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"printsrv"}},
+			{Type: "cn", Vals: []string{"Print Server"}},
+			{Type: "sn", Vals: []string{"Server"}},
+			{Type: "givenName", Vals: []string{"Print"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=print-admins,ou=groups,dc=example,dc=org", "cn=print-services,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	for _, name := range []string{"print-admins", "print-services"} {
+		conn.ExpectAdd(goldap.AddRequest{
+			DN: "cn=" + name + ",ou=groups,dc=example,dc=org",
+			Attributes: []goldap.Attribute{
+				{Type: "cn", Vals: []string{name}},
+				{Type: "member", Vals: []string{"uid=printsrv,ou=users,dc=example,dc=org"}},
+				{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+			},
+		})
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-writers-printers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-writers-printers"}},
+			{Type: "member", Vals: []string{"uid=printsrv,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//when no group grants access to the subtree anymore, the virtual group is removed
+	action = func(db *core.Database) errext.ErrorSet {
+		for idx := range db.Groups {
+			db.Groups[idx].Permissions.LDAP.WriteSubtree = ""
+		}
+		return nil
+	}
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "cn=portunus-writers-printers,dc=example,dc=org",
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPChangelog(t *testing.T) {
+	//This test checks that changes are recorded below cn=changelog, and that
+	//the oldest changelog entries are removed once the size limit is exceeded.
+	_, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{ChangelogSize: 3})
+
+	expectChangelogEntry := func(number, targetDN, changeType string) {
+		conn.ExpectAdd(goldap.AddRequest{
+			DN: "changeNumber=" + number + ",cn=changelog,dc=example,dc=org",
+			Attributes: []goldap.Attribute{
+				{Type: "changeNumber", Vals: []string{number}},
+				{Type: "targetDN", Vals: []string{targetDN}},
+				{Type: "changeType", Vals: []string{changeType}},
+				{Type: "changeTime", Vals: []string{"20240401120000Z"}},
+				{Type: "objectClass", Vals: []string{"changeLogEntry", "top"}},
+			},
+		})
+	}
+
+	//the first update creates a group and the portunus-viewers group
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Groups = []core.Group{{
+			Name:     "grafana-users",
+			LongName: "We monitor the monitoring.",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=grafana-users,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"grafana-users"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	expectChangelogEntry("1", "cn=grafana-users,ou=groups,dc=example,dc=org", "add")
+	expectChangelogEntry("2", "cn=portunus-viewers,dc=example,dc=org", "add")
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//modifying the group is recorded as well
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].LongName = "Grafana users"
+		db.Groups[0].Notes = "We monitor the monitoring."
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "cn=grafana-users,ou=groups,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "description", Vals: []string{"We monitor the monitoring."}},
+		}},
+	})
+	expectChangelogEntry("3", "cn=grafana-users,ou=groups,dc=example,dc=org", "modify")
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//replacing the group with a different one records two changes, which
+	//pushes the two oldest entries out of the changelog
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups = []core.Group{{
+			Name:     "grafana-admins",
+			LongName: "We administer the monitoring.",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=grafana-admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"grafana-admins"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "cn=grafana-users,ou=groups,dc=example,dc=org",
+	})
+	expectChangelogEntry("4", "cn=grafana-admins,ou=groups,dc=example,dc=org", "add")
+	expectChangelogEntry("5", "cn=grafana-users,ou=groups,dc=example,dc=org", "delete")
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "changeNumber=1,cn=changelog,dc=example,dc=org",
+	})
+	conn.ExpectDelete(goldap.DelRequest{
+		DN: "changeNumber=2,cn=changelog,dc=example,dc=org",
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPRenderLabels(t *testing.T) {
+	//This test checks that labels are rendered into portunusLabel when enabled.
+	//(When disabled, they are ignored, as can be seen in the other tests.)
+	_, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{RenderLabels: true})
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:  "alice",
+			GivenName:  "Alice",
+			FamilyName: "Administrator",
+			Labels:     core.Labels{"cost-center": "1234", "team": "ops"},
+		}}
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"alice": true},
+			Labels:           core.Labels{"managed-by": "terraform"},
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{""}},
+			{Type: "portunusLabel", Vals: []string{"cost-center=1234", "team=ops"}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "portunusLabel", Vals: []string{"managed-by=terraform"}},
+			{Type: "objectClass", Vals: []string{"portunusGroup", "groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPNestedGroups(t *testing.T) {
+	//This test checks that members of nested groups are rendered as members of
+	//the containing groups, including for the purpose of LDAP permissions.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		db.Groups = []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"alice": true},
+			},
+			{
+				Name:             "staff",
+				LongName:         "Staff",
+				MemberLoginNames: core.GroupMemberNames{},
+				MemberGroupNames: core.GroupMemberNames{"admins": true},
+				Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+			},
+		}
+		return nil
+	}
+
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org", "cn=staff,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"staff"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPHiddenGroups(t *testing.T) {
+	//This test checks that groups hidden from LDAP are not rendered, but still
+	//grant their permissions.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		db.Groups = []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"alice": true},
+			},
+			{
+				Name:             "ldap-viewers",
+				LongName:         "LDAP viewers",
+				MemberLoginNames: core.GroupMemberNames{"alice": true},
+				Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+				IsHiddenFromLDAP: true,
+			},
+		}
+		return nil
+	}
+
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//publishing the group renders it, and adds it to the memberships of its users
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[1].IsHiddenFromLDAP = false
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org", "cn=ldap-viewers,ou=groups,dc=example,dc=org"}},
+		}},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=ldap-viewers,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"ldap-viewers"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPHiddenUserAttributes(t *testing.T) {
+	//This test checks that attributes hidden from LDAP are left out of the
+	//user's LDAP object, and are rendered again when they are published.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:            "alice",
+			GivenName:            "Alice",
+			FamilyName:           "Allison",
+			EMailAddress:         "alice@example.org",
+			SSHPublicKeys:        []string{dummySSHPublicKey},
+			PasswordHash:         "x",
+			JPEGPhoto:            []byte(dummyJPEGPhoto),
+			HiddenLDAPAttributes: []string{"mail", "jpegPhoto"},
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Allison"}},
+			{Type: "sn", Vals: []string{"Allison"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "sshPublicKey", Vals: []string{dummySSHPublicKey}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//publishing the email address renders it, while the photo stays hidden
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users[0].HiddenLDAPAttributes = []string{"jpegPhoto"}
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "mail", Vals: []string{"alice@example.org"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPFamilyNameFirst(t *testing.T) {
+	//This test checks that the name order of a user is reflected in the "cn"
+	//attribute.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:       "alice",
+			GivenName:       "Alice",
+			FamilyName:      "Allison",
+			FamilyNameFirst: true,
+			PasswordHash:    "x",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Allison Alice"}},
+			{Type: "sn", Vals: []string{"Allison"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users[0].FamilyNameFirst = false
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "cn", Vals: []string{"Alice Allison"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPDisabledUsers(t *testing.T) {
+	//This test checks that disabled users are left out of the LDAP directory by
+	//default, including from the members of their groups.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Allison", PasswordHash: "x"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Bobson", PasswordHash: "y", Disabled: true},
+		}
+		db.Groups = []core.Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: core.GroupMemberNames{"alice": true, "bob": true},
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Allison"}},
+			{Type: "sn", Vals: []string{"Allison"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "isMemberOf", Vals: []string{"cn=staff,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"staff"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//when the user is enabled again, they reappear with their group memberships
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users[1].Disabled = false
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=bob,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"bob"}},
+			{Type: "cn", Vals: []string{"Bob Bobson"}},
+			{Type: "sn", Vals: []string{"Bobson"}},
+			{Type: "givenName", Vals: []string{"Bob"}},
+			{Type: "userPassword", Vals: []string{"y"}},
+			{Type: "isMemberOf", Vals: []string{"cn=staff,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=org", "uid=bob,ou=users,dc=example,dc=org"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPDisabledUsersMarked(t *testing.T) {
+	//This test checks that, with DisabledUserHandlingMark, disabled users stay
+	//in the LDAP directory, but without their password.
+	_, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{DisabledUserHandling: DisabledUserHandlingMark})
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "bob",
+			GivenName:    "Bob",
+			FamilyName:   "Bobson",
+			PasswordHash: "y",
+			Disabled:     true,
+		}}
+		db.Groups = []core.Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			MemberLoginNames: core.GroupMemberNames{"bob": true},
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=bob,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"bob"}},
+			{Type: "cn", Vals: []string{"Bob Bobson"}},
+			{Type: "sn", Vals: []string{"Bobson"}},
+			{Type: "givenName", Vals: []string{"Bob"}},
+			{Type: "portunusDisabled", Vals: []string{"TRUE"}},
+			{Type: "isMemberOf", Vals: []string{"cn=staff,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"staff"}},
+			{Type: "member", Vals: []string{"uid=bob,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestFailedOperations(t *testing.T) {
+	//This test checks that a write that is rejected by the LDAP server does not
+	//prevent other objects from being written, and that the failed write is
+	//attempted again on the next database update.
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{})
+
+	makeUser := func(loginName, givenName string) core.User {
+		return core.User{LoginName: loginName, GivenName: givenName, FamilyName: "Doe", PasswordHash: "x"}
+	}
+	makeAddRequest := func(loginName, givenName string) goldap.AddRequest {
+		return goldap.AddRequest{
+			DN: "uid=" + loginName + ",ou=users,dc=example,dc=org",
+			Attributes: []goldap.Attribute{
+				{Type: "uid", Vals: []string{loginName}},
+				{Type: "cn", Vals: []string{givenName + " Doe"}},
+				{Type: "sn", Vals: []string{"Doe"}},
+				{Type: "givenName", Vals: []string{givenName}},
+				{Type: "userPassword", Vals: []string{"x"}},
+				{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+			},
+		}
+	}
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{makeUser("jane", "Jane"), makeUser("john", "John")}
+		return nil
+	}
+	conn.ExpectAddAndReject(makeAddRequest("jane", "Jane"))
+	conn.ExpectAdd(makeAddRequest("john", "John"))
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	assert.DeepEqual(t, "adapter status", adapter.Status(), AdapterStatus{
+		SuccessfulOperations: 2,
+		FailedOperations:     1,
+		LastSyncAt:           now,
+		Failures: []OperationFailure{{
+			DN:             "uid=jane,ou=users,dc=example,dc=org",
+			ChangeType:     "add",
+			Error:          `LDAP Result Code 65 "Object Class Violation": rejected by test double`,
+			Attempts:       1,
+			FirstFailureAt: now,
+			LastFailureAt:  now,
+		}},
+		//john and cn=portunus-viewers, but not jane
+		ObjectCount:     2,
+		TotalObjectSize: 319,
+	})
+
+	//on the next update, the failed write is attempted again
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users[1].GivenName = "Johnny"
+		return nil
+	}
+	conn.ExpectAdd(makeAddRequest("jane", "Jane"))
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=john,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{
+			{Operation: goldap.ReplaceAttribute, Modification: goldap.PartialAttribute{Type: "cn", Vals: []string{"Johnny Doe"}}},
+			{Operation: goldap.ReplaceAttribute, Modification: goldap.PartialAttribute{Type: "givenName", Vals: []string{"Johnny"}}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+	assert.DeepEqual(t, "failures", adapter.Status().Failures, []OperationFailure(nil))
+}
+
+func TestFailedOperationsWithRetry(t *testing.T) {
+	//Like TestFailedOperations, but with retries on a timer. The timer itself
+	//is too slow to fire during the test, but we can check the backoff.
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{RetryInterval: 10 * time.Minute})
+
+	makeAddRequest := func(longName string) goldap.AddRequest {
+		return goldap.AddRequest{
+			DN: "cn=staff,ou=groups,dc=example,dc=org",
+			Attributes: []goldap.Attribute{
+				{Type: "cn", Vals: []string{"staff"}},
+				{Type: "description", Vals: []string{longName}},
+				{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+				{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+			},
+		}
+	}
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Groups = []core.Group{{Name: "staff", LongName: "Staff", Notes: "first"}}
+		return nil
+	}
+	conn.ExpectAddAndReject(makeAddRequest("first"))
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	assert.DeepEqual(t, "next retry", adapter.Status().NextRetryAt, now.Add(10*time.Minute))
+
+	//each unsuccessful attempt doubles the retry interval...
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].Notes = "second"
+		return nil
+	}
+	conn.ExpectAddAndReject(makeAddRequest("second"))
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+	status := adapter.Status()
+	assert.DeepEqual(t, "next retry", status.NextRetryAt, now.Add(20*time.Minute))
+	assert.DeepEqual(t, "attempts", status.Failures[0].Attempts, uint64(2))
+	assert.DeepEqual(t, "retried operations", status.RetriedOperations, uint64(1))
+
+	//...until the write succeeds
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].Notes = "third"
+		return nil
+	}
+	conn.ExpectAdd(makeAddRequest("third"))
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+	status = adapter.Status()
+	assert.DeepEqual(t, "next retry", status.NextRetryAt, time.Time{})
+	assert.DeepEqual(t, "failures", status.Failures, []OperationFailure(nil))
+	assert.DeepEqual(t, "retried operations", status.RetriedOperations, uint64(2))
+}
+
+func TestFailedOperationsPersistence(t *testing.T) {
+	//This test checks that failed operations are carried over into the next run
+	//of the Adapter through the retry queue file.
+	queuePath := filepath.Join(t.TempDir(), "ldap-retry-queue.json")
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{RetryQueuePath: queuePath})
+
+	groupAddRequest := goldap.AddRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"staff"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	}
+	viewersAddRequest := goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	}
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Groups = []core.Group{{Name: "staff", LongName: "Staff"}}
+		return nil
+	}
+	conn.ExpectAddAndReject(groupAddRequest)
+	conn.ExpectAdd(viewersAddRequest)
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	queue, err := loadRetryQueue(queuePath)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "retry queue", queue, adapter.Status().Failures)
+
+	//simulate a restart while a delete was also pending
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	queue = append(queue, OperationFailure{
+		DN:             "cn=former-staff,ou=groups,dc=example,dc=org",
+		ChangeType:     "delete",
+		Error:          "connection refused",
+		Attempts:       3,
+		FirstFailureAt: now.Add(-time.Hour),
+		LastFailureAt:  now.Add(-time.Minute),
+	})
+	test.ExpectNoError(t, saveRetryQueue(queuePath, queue))
+
+	adapter, conn, updateDBWithRunningAdapter = setupAdapterTestWithOptions(t, AdapterOptions{RetryQueuePath: queuePath})
+	conn.ExpectAddAndReject(groupAddRequest)
+	conn.ExpectAdd(viewersAddRequest)
+	conn.ExpectDelete(goldap.DelRequest{DN: "cn=former-staff,ou=groups,dc=example,dc=org"})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//the attempt counter for the add continues where the previous run left off
+	assert.DeepEqual(t, "failures", adapter.Status().Failures, []OperationFailure{{
+		DN:             "cn=staff,ou=groups,dc=example,dc=org",
+		ChangeType:     "add",
+		Error:          `LDAP Result Code 65 "Object Class Violation": rejected by test double`,
+		Attempts:       2,
+		FirstFailureAt: now,
+		LastFailureAt:  now,
+	}})
+
+	//once everything is written, the queue file is removed
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].Notes = "fixed"
+		return nil
+	}
+	groupAddRequest.Attributes = append(groupAddRequest.Attributes, goldap.Attribute{Type: "description", Vals: []string{"fixed"}})
+	conn.ExpectAdd(groupAddRequest)
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+	_, err = os.Stat(queuePath)
+	assert.DeepEqual(t, "queue file exists", os.IsNotExist(err), true)
+}
+
+func TestLDAPCustomLayout(t *testing.T) {
+	//This test checks that users and groups are placed in the configured OUs,
+	//and that extra OUs are created (see setupAdapterTestWithOptions).
+	layout := Layout{
+		UsersOU:       "people",
+		PosixGroupsOU: "unix-groups",
+		ExtraOUs:      []string{"services"},
+	}
+	_, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{Layout: layout})
+
+	gid := core.PosixID(42)
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:  "alice",
+			GivenName:  "Alice",
+			FamilyName: "Administrator",
+		}}
+		db.Groups = []core.Group{{
+			Name:             "admins",
+			LongName:         "Administrators",
+			MemberLoginNames: core.GroupMemberNames{"alice": true},
+			Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+			PosixGID:         &gid,
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=people,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{""}},
+			{Type: "isMemberOf", Vals: []string{"cn=admins,ou=groups,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=people,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=admins,ou=unix-groups,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"admins"}},
+			{Type: "gidNumber", Vals: []string{"42"}},
+			{Type: "memberUid", Vals: []string{"alice"}},
+			{Type: "objectClass", Vals: []string{"posixGroup", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=people,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLayoutFromEnvironment(t *testing.T) {
+	t.Setenv("PORTUNUS_LDAP_USERS_OU", "people")
+	t.Setenv("PORTUNUS_LDAP_EXTRA_OUS", "services hosts")
+	layout, err := LayoutFromEnvironment()
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "layout", layout, Layout{
+		UsersOU:           "people",
+		GroupsOU:          "groups",
+		PosixGroupsOU:     "posix-groups",
+		ServiceAccountsOU: "service-accounts",
+		SubtreesOU:        "subtrees",
+		ExtraOUs:          []string{"services", "hosts"},
+	})
+
+	t.Setenv("PORTUNUS_LDAP_EXTRA_OUS", "services,hosts")
+	_, err = LayoutFromEnvironment()
+	assert.DeepEqual(t, "error", err.Error(), `malformed OU name in PORTUNUS_LDAP_EXTRA_OUS: "services,hosts"`)
+
+	t.Setenv("PORTUNUS_LDAP_EXTRA_OUS", "")
+	t.Setenv("PORTUNUS_LDAP_GROUPS_OU", "People")
+	_, err = LayoutFromEnvironment()
+	assert.DeepEqual(t, "error", err.Error(), `OU name "People" is used in both PORTUNUS_LDAP_USERS_OU and PORTUNUS_LDAP_GROUPS_OU`)
+}
+
+func TestLDAPMultipleDomains(t *testing.T) {
+	//This test checks that users and groups are placed below the suffix of their
+	//respective domain, and that references between domains use the right DNs.
+	conn, updateDBWithRunningAdapter := setupAdapterTest(t)
+
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", Domain: "example.net"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Builder", ManagerLoginName: "alice"},
+		}
+		db.Groups = []core.Group{{
+			Name:             "staff",
+			LongName:         "Staff",
+			Domain:           "example.net",
+			MemberLoginNames: core.GroupMemberNames{"alice": true, "bob": true},
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=net",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{""}},
+			{Type: "isMemberOf", Vals: []string{"cn=staff,ou=groups,dc=example,dc=net"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=bob,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"bob"}},
+			{Type: "cn", Vals: []string{"Bob Builder"}},
+			{Type: "sn", Vals: []string{"Builder"}},
+			{Type: "givenName", Vals: []string{"Bob"}},
+			{Type: "userPassword", Vals: []string{""}},
+			{Type: "manager", Vals: []string{"uid=alice,ou=users,dc=example,dc=net"}},
+			{Type: "isMemberOf", Vals: []string{"cn=staff,ou=groups,dc=example,dc=net"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=net",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"staff"}},
+			{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=net", "uid=bob,ou=users,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//moving a user into a different domain moves the LDAP object
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users[1].Domain = "example.net"
+		return nil
+	}
+	conn.ExpectDelete(goldap.DelRequest{DN: "uid=bob,ou=users,dc=example,dc=org"})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=bob,ou=users,dc=example,dc=net",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"bob"}},
+			{Type: "cn", Vals: []string{"Bob Builder"}},
+			{Type: "sn", Vals: []string{"Builder"}},
+			{Type: "givenName", Vals: []string{"Bob"}},
+			{Type: "userPassword", Vals: []string{""}},
+			{Type: "manager", Vals: []string{"uid=alice,ou=users,dc=example,dc=net"}},
+			{Type: "isMemberOf", Vals: []string{"cn=staff,ou=groups,dc=example,dc=net"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "cn=staff,ou=groups,dc=example,dc=net",
+		Changes: []goldap.Change{
+			{Operation: goldap.ReplaceAttribute, Modification: goldap.PartialAttribute{Type: "member", Vals: []string{"uid=alice,ou=users,dc=example,dc=net", "uid=bob,ou=users,dc=example,dc=net"}}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPPasswordChanges(t *testing.T) {
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{AcceptPasswordChanges: true})
+
+	//setup a user
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	expectSearches := func(entries ...*goldap.Entry) {
+		for _, suffix := range []string{"dc=example,dc=org", "dc=example,dc=net"} {
+			req := goldap.NewSearchRequest("ou=users,"+suffix,
+				goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+				"(uid=*)", []string{"userPassword"}, nil,
+			)
+			if suffix == "dc=example,dc=org" {
+				conn.ExpectSearch(*req, entries...)
+			} else {
+				conn.ExpectSearch(*req)
+			}
+		}
+	}
+	expectPasswordHash := func(expected string) {
+		t.Helper()
+		user, exists := adapter.nexus.FindUser(func(u core.User) bool { return u.LoginName == "alice" })
+		if !exists {
+			t.Fatal("user alice has disappeared")
+		}
+		assert.DeepEqual(t, "password hash of alice", user.PasswordHash, expected)
+	}
+
+	//when the password is changed in LDAP (e.g. through the Password Modify
+	//extended operation), the new hash is copied into the Portunus database...
+	newHash := "{CRYPT}" + dummyPasswordHash
+	expectSearches(goldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", map[string][]string{
+		"userPassword": {newHash},
+	}))
+	adapter.checkPasswordChanges()
+	conn.CheckAllExecuted(t)
+	expectPasswordHash(newHash)
+
+	//...without the new hash being written back into LDAP on the next sync
+	action = func(db *core.Database) errext.ErrorSet {
+		db.Users[0].EMailAddress = "alice@example.org"
+		return nil
+	}
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "mail", Vals: []string{"alice@example.org"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//unchanged passwords do not cause any further activity
+	expectSearches(goldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", map[string][]string{
+		"userPassword": {newHash},
+	}))
+	adapter.checkPasswordChanges()
+	conn.CheckAllExecuted(t)
+
+	//plaintext passwords are not accepted and get reverted immediately
+	expectSearches(goldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", map[string][]string{
+		"userPassword": {"hunter2"},
+	}))
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "userPassword", Vals: []string{newHash}},
+		}},
+	})
+	adapter.checkPasswordChanges()
+	conn.CheckAllExecuted(t)
+	expectPasswordHash(newHash)
+
+	//the same goes for deleted passwords
+	expectSearches(goldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", nil))
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "userPassword", Vals: []string{newHash}},
+		}},
+	})
+	adapter.checkPasswordChanges()
+	conn.CheckAllExecuted(t)
+	expectPasswordHash(newHash)
+}
+
+func TestLDAPDriftHandling(t *testing.T) {
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{DriftHandling: DriftHandlingImport})
+
+	//setup a user
+	action := func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+		}}
+		return nil
+	}
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	viewersGroup := goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	}
+	conn.ExpectAdd(viewersGroup)
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(action))
+	conn.CheckAllExecuted(t)
+
+	//each check searches all OUs containing managed objects; the given entries
+	//are reported by the search for their parent object
+	expectSearches := func(entries ...*goldap.Entry) {
+		searches := []struct {
+			BaseDN string
+			Filter string
+		}{
+			{"dc=example,dc=org", "(&(objectClass=groupOfNames)(cn=portunus-*))"},
+			{"ou=service-accounts,dc=example,dc=org", "(objectClass=*)"},
+		}
+		for _, suffix := range []string{"dc=example,dc=org", "dc=example,dc=net"} {
+			for _, ouName := range []string{"users", "groups", "posix-groups"} {
+				searches = append(searches, struct {
+					BaseDN string
+					Filter string
+				}{"ou=" + ouName + "," + suffix, "(objectClass=*)"})
+			}
+		}
+		for _, s := range searches {
+			var matchingEntries []*goldap.Entry
+			for _, entry := range entries {
+				_, parentDN, _ := strings.Cut(entry.DN, ",")
+				if parentDN == s.BaseDN {
+					matchingEntries = append(matchingEntries, entry)
+				}
+			}
+			req := goldap.NewSearchRequest(s.BaseDN,
+				goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+				s.Filter, []string{"*"}, nil,
+			)
+			conn.ExpectSearch(*req, matchingEntries...)
+		}
+	}
+	aliceEntry := func(override map[string][]string) *goldap.Entry {
+		attrs := map[string][]string{
+			"uid":          {"alice"},
+			"cn":           {"Alice Administrator"},
+			"sn":           {"Administrator"},
+			"givenName":    {"Alice"},
+			"userPassword": {"x"},
+			"objectClass":  {"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"},
+		}
+		for name, values := range override {
+			if values == nil {
+				delete(attrs, name)
+			} else {
+				attrs[name] = values
+			}
+		}
+		return goldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", attrs)
+	}
+	viewersEntry := goldap.NewEntry("cn=portunus-viewers,dc=example,dc=org", map[string][]string{
+		"cn":          {"portunus-viewers"},
+		"member":      {"cn=nobody,dc=example,dc=org"},
+		"objectClass": {"groupOfNames", "top"},
+	})
+	expectUser := func(expected core.User) {
+		t.Helper()
+		user, exists := adapter.nexus.FindUser(func(u core.User) bool { return u.LoginName == "alice" })
+		if !exists {
+			t.Fatal("user alice has disappeared")
+		}
+		assert.DeepEqual(t, "user alice", user.User, expected)
+	}
+
+	//without drift, there is no further activity (attribute names, like DNs,
+	//are compared case-insensitively)
+	expectSearches(aliceEntry(map[string][]string{"givenName": nil, "GIVENNAME": {"Alice"}}), viewersEntry)
+	adapter.checkDrift()
+	conn.CheckAllExecuted(t)
+
+	//changes to importable attributes are copied into the Portunus database,
+	//but changes to other attributes are reverted
+	expectSearches(aliceEntry(map[string][]string{
+		"givenName":   {"Alicia"},
+		"description": {"I was here"},
+	}), viewersEntry)
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.DeleteAttribute,
+			Modification: goldap.PartialAttribute{Type: "description", Vals: nil},
+		}},
+	})
+	adapter.checkDrift()
+	conn.CheckAllExecuted(t)
+	expectUser(core.User{
+		LoginName:    "alice",
+		GivenName:    "Alicia",
+		FamilyName:   "Administrator",
+		PasswordHash: "x",
+	})
+
+	//derived attributes follow on the next sync, but the imported attribute is
+	//not written back
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "cn", Vals: []string{"Alicia Administrator"}},
+		}},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(func(db *core.Database) errext.ErrorSet { return nil }))
+	conn.CheckAllExecuted(t)
+
+	//changes that the Portunus database does not accept are reverted
+	expectSearches(aliceEntry(map[string][]string{
+		"givenName": {"Alicia"},
+		"cn":        {"Alicia Administrator"},
+		"sn":        nil,
+	}), viewersEntry)
+	conn.ExpectModify(goldap.ModifyRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{
+			Operation:    goldap.ReplaceAttribute,
+			Modification: goldap.PartialAttribute{Type: "sn", Vals: []string{"Administrator"}},
+		}},
+	})
+	adapter.checkDrift()
+	conn.CheckAllExecuted(t)
+	expectUser(core.User{
+		LoginName:    "alice",
+		GivenName:    "Alicia",
+		FamilyName:   "Administrator",
+		PasswordHash: "x",
+	})
+
+	//added objects are deleted, and deleted objects are restored
+	expectSearches(
+		aliceEntry(map[string][]string{"givenName": {"Alicia"}, "cn": {"Alicia Administrator"}}),
+		goldap.NewEntry("uid=mallory,ou=users,dc=example,dc=org", map[string][]string{
+			"uid":         {"mallory"},
+			"objectClass": {"inetOrgPerson", "organizationalPerson", "person", "top"},
+		}),
+	)
+	conn.ExpectDelete(goldap.DelRequest{DN: "uid=mallory,ou=users,dc=example,dc=org"})
+	conn.ExpectAdd(viewersGroup)
+	adapter.checkDrift()
+	conn.CheckAllExecuted(t)
+}
+
+func TestLDAPTestBind(t *testing.T) {
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{})
+
+	//setup a user in a secondary domain
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=alice,ou=users,dc=example,dc=net",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"alice"}},
+			{Type: "cn", Vals: []string{"Alice Administrator"}},
+			{Type: "sn", Vals: []string{"Administrator"}},
+			{Type: "givenName", Vals: []string{"Alice"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "alice",
+			GivenName:    "Alice",
+			FamilyName:   "Administrator",
+			PasswordHash: "x",
+			Domain:       "example.net",
+		}}
+		return nil
+	}))
+	conn.CheckAllExecuted(t)
+
+	//a failed bind is reported without any searches
+	result := adapter.TestBind("alice", "wrong")
+	assert.DeepEqual(t, "DN", result.DN, "uid=alice,ou=users,dc=example,dc=net")
+	assert.DeepEqual(t, "bind error", result.BindError != "", true)
+	assert.DeepEqual(t, "own attributes", result.OwnAttributes, []BindTestAttribute(nil))
+	conn.CheckAllExecuted(t)
+
+	//a successful bind reports the account's own object (with the password hash
+	//redacted) and how many objects it can see in each OU
+	aliceDN := "uid=alice,ou=users,dc=example,dc=net"
+	conn.ExpectBindAs(aliceDN, "correct")
+	conn.ExpectSearch(
+		*goldap.NewSearchRequest(aliceDN,
+			goldap.ScopeBaseObject, goldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{"*"}, nil,
+		),
+		goldap.NewEntry(aliceDN, map[string][]string{
+			"uid":          {"alice"},
+			"userPassword": {"x"},
+		}),
+	)
+	var expectedVisibility []BindTestVisibility
+	for _, baseDN := range []string{
+		"ou=users,dc=example,dc=org",
+		"ou=groups,dc=example,dc=org",
+		"ou=posix-groups,dc=example,dc=org",
+		"ou=users,dc=example,dc=net",
+		"ou=groups,dc=example,dc=net",
+		"ou=posix-groups,dc=example,dc=net",
+		"ou=service-accounts,dc=example,dc=org",
+	} {
+		var entries []*goldap.Entry
+		if baseDN == "ou=users,dc=example,dc=net" {
+			entries = append(entries, goldap.NewEntry(aliceDN, nil))
+		}
+		conn.ExpectSearch(*goldap.NewSearchRequest(baseDN,
+			goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{"1.1"}, nil,
+		), entries...)
+		expectedVisibility = append(expectedVisibility, BindTestVisibility{baseDN, len(entries)})
+	}
+
+	result = adapter.TestBind("alice", "correct")
+	conn.CheckAllExecuted(t)
+	assert.DeepEqual(t, "result", result, BindTestResult{
+		DN: aliceDN,
+		OwnAttributes: []BindTestAttribute{
+			{"uid", []string{"alice"}},
+			{"userPassword", []string{"(redacted)"}},
+		},
+		VisibleObjects: expectedVisibility,
+	})
+
+	//DNs are used as given
+	result = adapter.TestBind("cn=portunus,dc=example,dc=org", "")
+	assert.DeepEqual(t, "DN", result.DN, "cn=portunus,dc=example,dc=org")
+}
+
+func TestLDAPReconnect(t *testing.T) {
+	//This test checks that after a reconnect, writes that failed in the
+	//meantime are attempted again without waiting for the next database update.
+	adapter, conn, updateDBWithRunningAdapter := setupAdapterTestWithOptions(t, AdapterOptions{})
+
+	viewersGroup := goldap.AddRequest{
+		DN: "cn=portunus-viewers,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"portunus-viewers"}},
+			{Type: "member", Vals: []string{"cn=nobody,dc=example,dc=org"}},
+			{Type: "objectClass", Vals: []string{"groupOfNames", "top"}},
+		},
+	}
+	conn.ExpectAddAndReject(viewersGroup)
+	conn.ExpectAdd(goldap.AddRequest{
+		DN: "uid=jane,ou=users,dc=example,dc=org",
+		Attributes: []goldap.Attribute{
+			{Type: "uid", Vals: []string{"jane"}},
+			{Type: "cn", Vals: []string{"Jane Doe"}},
+			{Type: "sn", Vals: []string{"Doe"}},
+			{Type: "givenName", Vals: []string{"Jane"}},
+			{Type: "userPassword", Vals: []string{"x"}},
+			{Type: "objectClass", Vals: []string{"portunusPerson", "inetOrgPerson", "organizationalPerson", "person", "top"}},
+		},
+	})
+	test.ExpectNoErrors(t, updateDBWithRunningAdapter(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "jane", GivenName: "Jane", FamilyName: "Doe", PasswordHash: "x"}}
+		return nil
+	}))
+	conn.CheckAllExecuted(t)
+
+	//when Run() starts, it rewrites the current state anyway (with the same
+	//result as before), so wait for that to settle before reconnecting
+	conn.ExpectAddAndReject(viewersGroup)
+	conn.ExpectAdd(viewersGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, adapter.Run(ctx))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	test.ExpectNoError(t, adapter.Reconnect())
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	wg.Wait()
+	conn.CheckAllExecuted(t)
+	assert.DeepEqual(t, "reconnect count", conn.ReconnectCount(), 1)
+	assert.DeepEqual(t, "failures", adapter.Status().Failures, []OperationFailure(nil))
+}
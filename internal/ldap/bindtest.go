@@ -0,0 +1,126 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// BindTestResult describes the outcome of Adapter.TestBind().
+type BindTestResult struct {
+	DN string
+	//Empty if the bind succeeded. If the bind failed, the other fields are empty.
+	BindError string
+	//The attributes of the account's own object, as far as the account itself
+	//can see them. Password hashes are redacted.
+	OwnAttributes []BindTestAttribute
+	//How many objects the account can see in each of the OUs managed by Portunus.
+	VisibleObjects []BindTestVisibility
+	//Errors from searches that failed after the bind succeeded.
+	SearchErrors []string
+}
+
+// BindTestAttribute appears in type BindTestResult.
+type BindTestAttribute struct {
+	Name   string
+	Values []string
+}
+
+// BindTestVisibility appears in type BindTestResult.
+type BindTestVisibility struct {
+	BaseDN string
+	Count  int
+}
+
+// TestBind binds to the LDAP server with the given credentials, and reports
+// what the bound account can see. This is used to debug reports like "I can
+// log into Portunus, but not into app X". The argument can be a DN, or the
+// login name of a user, or the name of a service account.
+//
+// The password is only forwarded to the LDAP server. It is never logged.
+func (a *Adapter) TestBind(loginNameOrDN, password string) BindTestResult {
+	result := BindTestResult{DN: a.resolveBindDN(loginNameOrDN)}
+
+	err := a.conn.BindAs(result.DN, password, func(search func(goldap.SearchRequest) (*goldap.SearchResult, error)) {
+		req := goldap.NewSearchRequest(result.DN,
+			goldap.ScopeBaseObject, goldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{"*"}, nil,
+		)
+		sr, err := search(*req)
+		switch {
+		case err != nil:
+			result.SearchErrors = append(result.SearchErrors, err.Error())
+		case len(sr.Entries) == 0:
+			result.SearchErrors = append(result.SearchErrors, "cannot see own object "+result.DN)
+		default:
+			for _, attr := range sr.Entries[0].Attributes {
+				values := attr.Values
+				if strings.EqualFold(attr.Name, "userPassword") {
+					values = slices.Repeat([]string{"(redacted)"}, len(values))
+				}
+				result.OwnAttributes = append(result.OwnAttributes, BindTestAttribute{attr.Name, values})
+			}
+			slices.SortFunc(result.OwnAttributes, func(lhs, rhs BindTestAttribute) int {
+				return strings.Compare(lhs.Name, rhs.Name)
+			})
+		}
+
+		for _, baseDN := range a.bindTestBaseDNs() {
+			//attribute "1.1" requests no attributes at all, since we only count entries
+			req := goldap.NewSearchRequest(baseDN,
+				goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+				"(objectClass=*)", []string{"1.1"}, nil,
+			)
+			sr, err := search(*req)
+			if err != nil {
+				result.SearchErrors = append(result.SearchErrors, err.Error())
+				continue
+			}
+			result.VisibleObjects = append(result.VisibleObjects, BindTestVisibility{baseDN, len(sr.Entries)})
+		}
+	})
+	if err != nil {
+		result.BindError = err.Error()
+	}
+	return result
+}
+
+// Users are preferred over service accounts with the same name. Unknown names
+// are assumed to refer to a user in the primary suffix, so that the result at
+// least shows which DN was tried.
+func (a *Adapter) resolveBindDN(loginNameOrDN string) string {
+	if strings.Contains(loginNameOrDN, "=") {
+		return loginNameOrDN
+	}
+
+	r := dnResolver{layout: a.layout, primarySuffix: a.conn.DNSuffix()}
+	user, exists := a.nexus.FindUser(func(u core.User) bool { return u.LoginName == loginNameOrDN })
+	if exists {
+		r.userDomains = map[string]string{user.LoginName: user.Domain}
+		return r.userDN(user.LoginName)
+	}
+	for _, s := range a.nexus.ListServiceAccounts() {
+		if s.Name == loginNameOrDN {
+			return r.serviceAccountDN(s.Name)
+		}
+	}
+	return r.userDN(loginNameOrDN)
+}
+
+func (a *Adapter) bindTestBaseDNs() (result []string) {
+	for _, suffix := range a.allSuffixes() {
+		for _, ouName := range a.layout.domainOUs() {
+			result = append(result, fmt.Sprintf("ou=%s,%s", ouName, suffix))
+		}
+	}
+	return append(result, fmt.Sprintf("ou=%s,%s", a.layout.ServiceAccountsOU, a.conn.DNSuffix()))
+}
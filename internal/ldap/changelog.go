@@ -0,0 +1,69 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// changelog maintains a bounded list of recent changes below
+// cn=changelog,$SUFFIX, using the entry format from draft-good-ldap-changelog.
+// This is for the benefit of legacy consumers that poll for changes instead of
+// using a proper synchronization protocol.
+//
+// Since the LDAP directory is rebuilt from scratch whenever Portunus starts,
+// the change numbers start over at 1 on each start.
+type changelog struct {
+	maxSize     uint64
+	firstNumber uint64 //change number of the oldest entry that still exists
+	nextNumber  uint64 //change number of the next entry to be created
+}
+
+func newChangelog(maxSize uint64) *changelog {
+	return &changelog{maxSize: maxSize, firstNumber: 1, nextNumber: 1}
+}
+
+// Renders the container object below which the changelog entries are placed.
+func (c *changelog) containerObject(dnSuffix string) goldap.AddRequest {
+	return goldap.AddRequest{
+		DN: "cn=changelog," + dnSuffix,
+		Attributes: []goldap.Attribute{
+			{Type: "cn", Vals: []string{"changelog"}},
+			{Type: "description", Vals: []string{"Recent changes to the objects managed by Portunus"}},
+			{Type: "objectClass", Vals: []string{"organizationalRole", "top"}},
+		},
+	}
+}
+
+// Returns the operations that record the given operation in the changelog,
+// including the removal of entries that exceed the size limit.
+func (c *changelog) record(op operation, dnSuffix string, now time.Time) (result []operation) {
+	number := c.nextNumber
+	c.nextNumber++
+	result = append(result, operation{AddRequest: &goldap.AddRequest{
+		DN: fmt.Sprintf("changeNumber=%d,cn=changelog,%s", number, dnSuffix),
+		Attributes: []goldap.Attribute{
+			{Type: "changeNumber", Vals: []string{strconv.FormatUint(number, 10)}},
+			{Type: "targetDN", Vals: []string{op.DN()}},
+			{Type: "changeType", Vals: []string{op.ChangeType()}},
+			{Type: "changeTime", Vals: []string{now.UTC().Format("20060102150405Z")}},
+			{Type: "objectClass", Vals: []string{"changeLogEntry", "top"}},
+		},
+	}})
+
+	for c.nextNumber-c.firstNumber > c.maxSize {
+		result = append(result, operation{DeleteRequest: &goldap.DelRequest{
+			DN: fmt.Sprintf("changeNumber=%d,cn=changelog,%s", c.firstNumber, dnSuffix),
+		}})
+		c.firstNumber++
+	}
+	return result
+}
@@ -30,6 +30,34 @@ func (op operation) ExecuteOn(conn Connection) error {
 	}
 }
 
+// DN returns the DN of the object targeted by this operation.
+func (op operation) DN() string {
+	switch {
+	case op.AddRequest != nil:
+		return op.AddRequest.DN
+	case op.ModifyRequest != nil:
+		return op.ModifyRequest.DN
+	case op.DeleteRequest != nil:
+		return op.DeleteRequest.DN
+	default:
+		panic("operation had no non-nil member field!")
+	}
+}
+
+// ChangeType returns "add", "modify" or "delete".
+func (op operation) ChangeType() string {
+	switch {
+	case op.AddRequest != nil:
+		return "add"
+	case op.ModifyRequest != nil:
+		return "modify"
+	case op.DeleteRequest != nil:
+		return "delete"
+	default:
+		panic("operation had no non-nil member field!")
+	}
+}
+
 // Computes a minimal changeset (i.e. a set of LDAP write operations) by
 // diffing two sets of LDAP objects.
 func computeUpdates(oldObjects, newObjects []Object) (result []operation) {
@@ -59,6 +87,38 @@ func computeUpdates(oldObjects, newObjects []Object) (result []operation) {
 	return result
 }
 
+// Computes which objects exist in the LDAP database after the changeset from
+// computeUpdates(oldObjects, newObjects) was executed, if the operations on
+// the objects in `isFailedDN` failed. (Each object has at most one operation
+// in the changeset, and failed operations do not change the object.)
+func mergeObjects(oldObjects, newObjects []Object, isFailedDN map[string]bool) []Object {
+	if len(isFailedDN) == 0 {
+		return newObjects
+	}
+	oldObjectsByDN := make(map[string]Object, len(oldObjects))
+	for _, oldObj := range oldObjects {
+		oldObjectsByDN[oldObj.DN] = oldObj
+	}
+
+	result := make([]Object, 0, len(newObjects))
+	isNewDN := make(map[string]bool, len(newObjects))
+	for _, newObj := range newObjects {
+		isNewDN[newObj.DN] = true
+		if !isFailedDN[newObj.DN] {
+			result = append(result, newObj)
+		} else if oldObj, exists := oldObjectsByDN[newObj.DN]; exists {
+			result = append(result, oldObj) //failed modify
+		}
+		//else: failed add, so the object does not exist
+	}
+	for _, oldObj := range oldObjects {
+		if !isNewDN[oldObj.DN] && isFailedDN[oldObj.DN] {
+			result = append(result, oldObj) //failed delete
+		}
+	}
+	return result
+}
+
 func buildAddRequest(obj Object) operation {
 	req := goldap.AddRequest{
 		DN:         obj.DN,
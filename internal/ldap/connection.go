@@ -9,6 +9,7 @@ package ldap
 import (
 	"errors"
 	"fmt"
+	"net"
 	"time"
 
 	goldap "github.com/go-ldap/ldap/v3"
@@ -23,6 +24,15 @@ type Connection interface {
 	Add(goldap.AddRequest) error
 	Modify(goldap.ModifyRequest) error
 	Delete(goldap.DelRequest) error
+	Search(goldap.SearchRequest) (*goldap.SearchResult, error)
+	//Opens a separate connection that is bound as `dn` instead of as Portunus'
+	//service user, and calls `action` with a function that searches on that
+	//connection. The connection is closed when `action` returns. An error is
+	//only returned if the connection cannot be established or the bind fails.
+	BindAs(dn, password string, action func(search func(goldap.SearchRequest) (*goldap.SearchResult, error))) error
+	//Replaces the connection with a fresh one, e.g. after the LDAP server was
+	//restarted. Retries for a few seconds if the LDAP server is not available.
+	Reconnect() error
 }
 
 // ConnectionOptions contains all configuration values that we need to connect
@@ -31,6 +41,7 @@ type ConnectionOptions struct {
 	DNSuffix      string //e.g. "dc=example,dc=org"
 	Password      string //for Portunus' service user
 	TLSDomainName string //if empty, LDAP without TLS is used
+	SocketPath    string //if not empty, LDAP over this Unix socket is used instead of TCP
 }
 
 type connectionImpl struct {
@@ -63,21 +74,95 @@ func (c *connectionImpl) getConn(retryCounter int, sleepInterval time.Duration)
 	}
 	time.Sleep(sleepInterval)
 
+	err = c.dial()
+	if err != nil {
+		logg.Info("cannot connect to LDAP server (attempt %d/10): %s", retryCounter+1, err.Error())
+		return c.getConn(retryCounter+1, sleepInterval*2)
+	}
+
+	logg.Info("connected to LDAP server")
+	return nil
+}
+
+func (c *connectionImpl) openConn() (*goldap.Conn, error) {
+	if c.opts.SocketPath != "" {
+		//the socket is only reachable on this host, so TLS is not needed
+		return DialSocket(c.opts.SocketPath)
+	}
 	if c.opts.TLSDomainName != "" {
-		c.conn, err = goldap.DialTLS("tcp", c.opts.TLSDomainName+":ldaps", nil)
-	} else {
-		c.conn, err = goldap.Dial("tcp", ":ldap")
+		return goldap.DialTLS("tcp", c.opts.TLSDomainName+":ldaps", nil)
 	}
+	return goldap.Dial("tcp", ":ldap")
+}
+
+// MinimumSSF is the security strength factor that portunus-orchestrator
+// configures slapd to require for all connections except those on the LDAPI
+// socket. For TLS connections, this is the key size of the negotiated cipher.
+// It must not exceed what goldap.DialTLS() in openConn() negotiates with the
+// default tls.Config: Go does not allow restricting TLS 1.3 cipher suites, and
+// those include AES-128-GCM.
+const MinimumSSF = 128
+
+// DialSocket connects to an LDAP server on the Unix socket at the given path,
+// like an ldapi:// URL would. We do not go through goldap.DialURL() since the
+// socket path would have to survive being parsed as the path of a URL.
+func DialSocket(path string) (*goldap.Conn, error) {
+	netConn, err := net.DialTimeout("unix", path, goldap.DefaultTimeout)
+	if err != nil {
+		return nil, goldap.NewError(goldap.ErrorNetwork, err)
+	}
+	conn := goldap.NewConn(netConn, false)
+	conn.Start()
+	return conn, nil
+}
+
+func (c *connectionImpl) dial() (err error) {
+	c.conn, err = c.openConn()
 	if err == nil {
 		err = c.conn.Bind(c.userDN, c.opts.Password)
+		if err != nil {
+			c.conn.Close()
+		}
 	}
 	if err != nil {
-		logg.Info("cannot connect to LDAP server (attempt %d/10): %s", retryCounter+1, err.Error())
-		return c.getConn(retryCounter+1, sleepInterval*2)
+		c.conn = nil
 	}
+	return err
+}
 
-	logg.Info("connected to LDAP server")
-	return nil
+// Executes a request. If the connection to the LDAP server was lost (e.g.
+// because slapd was restarted), we reconnect once and repeat the request. If
+// the LDAP server is still unavailable, the error is returned and the Adapter
+// will retry the request later.
+func (c *connectionImpl) execute(action func(*goldap.Conn) error) error {
+	var err error
+	if c.conn != nil {
+		err = action(c.conn)
+		if err == nil || !(goldap.IsErrorWithCode(err, goldap.ErrorNetwork) || c.conn.IsClosing()) {
+			return err
+		}
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	dialErr := c.dial()
+	if dialErr != nil {
+		if err == nil {
+			return fmt.Errorf("no connection to LDAP server: %w", dialErr)
+		}
+		return fmt.Errorf("%w (could not reconnect: %s)", err, dialErr.Error())
+	}
+	logg.Info("reconnected to LDAP server")
+	return action(c.conn)
+}
+
+// Reconnect implements the Connection interface.
+func (c *connectionImpl) Reconnect() error {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return c.getConn(0, 5*time.Millisecond)
 }
 
 // DNSuffix implements the Connection interface.
@@ -87,7 +172,7 @@ func (c *connectionImpl) DNSuffix() string {
 
 // Add implements the Connection interface.
 func (c *connectionImpl) Add(req goldap.AddRequest) error {
-	err := c.conn.Add(&req)
+	err := c.execute(func(conn *goldap.Conn) error { return conn.Add(&req) })
 	if err == nil {
 		logg.Info("LDAP object %s created", req.DN)
 	} else {
@@ -98,7 +183,7 @@ func (c *connectionImpl) Add(req goldap.AddRequest) error {
 
 // Modify implements the Connection interface.
 func (c *connectionImpl) Modify(req goldap.ModifyRequest) error {
-	err := c.conn.Modify(&req)
+	err := c.execute(func(conn *goldap.Conn) error { return conn.Modify(&req) })
 	if err == nil {
 		logg.Info("LDAP object %s updated", req.DN)
 	} else {
@@ -109,7 +194,7 @@ func (c *connectionImpl) Modify(req goldap.ModifyRequest) error {
 
 // Delete implements the Connection interface.
 func (c *connectionImpl) Delete(req goldap.DelRequest) error {
-	err := c.conn.Del(&req)
+	err := c.execute(func(conn *goldap.Conn) error { return conn.Del(&req) })
 	if err == nil {
 		logg.Info("LDAP object %s deleted", req.DN)
 	} else {
@@ -117,3 +202,38 @@ func (c *connectionImpl) Delete(req goldap.DelRequest) error {
 	}
 	return nil
 }
+
+// Search implements the Connection interface.
+func (c *connectionImpl) Search(req goldap.SearchRequest) (result *goldap.SearchResult, err error) {
+	err = c.execute(func(conn *goldap.Conn) (err error) {
+		result, err = conn.Search(&req)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot search below LDAP object %s: %w", req.BaseDN, err)
+	}
+	return result, nil
+}
+
+// BindAs implements the Connection interface.
+func (c *connectionImpl) BindAs(dn, password string, action func(search func(goldap.SearchRequest) (*goldap.SearchResult, error))) error {
+	conn, err := c.openConn()
+	if err != nil {
+		return fmt.Errorf("cannot connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	//NOTE: The password must not end up in the log or in the error message.
+	err = conn.Bind(dn, password)
+	if err != nil {
+		return err
+	}
+	action(func(req goldap.SearchRequest) (*goldap.SearchResult, error) {
+		result, err := conn.Search(&req)
+		if err != nil {
+			return nil, fmt.Errorf("cannot search below LDAP object %s: %w", req.BaseDN, err)
+		}
+		return result, nil
+	})
+	return nil
+}
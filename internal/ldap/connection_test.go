@@ -0,0 +1,160 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestDialSocket(t *testing.T) {
+	//the path contains characters that would need escaping in an ldapi:// URL
+	socketPath := filepath.Join(t.TempDir(), "run dir", "ldapi%sock")
+	test.ExpectNoError(t, os.MkdirAll(filepath.Dir(socketPath), 0700))
+	listener, err := net.Listen("unix", socketPath)
+	test.ExpectNoError(t, err)
+	runServerForTest(t, listener)
+
+	conn, err := DialSocket(socketPath)
+	test.ExpectNoError(t, err)
+	defer conn.Close()
+	err = conn.Bind("uid=alice,ou=users,dc=example,dc=org", "alice-pw")
+	test.ExpectNoError(t, err)
+	result, err := conn.Search(goldap.NewSearchRequest(
+		"ou=users,dc=example,dc=org", goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+		"(uid=bob)", []string{"uid"}, nil,
+	))
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of search results", len(result.Entries), 1)
+
+	_, err = DialSocket(filepath.Join(t.TempDir(), "nonexistent"))
+	if !goldap.IsErrorWithCode(err, goldap.ErrorNetwork) {
+		t.Errorf("expected network error for nonexistent socket, but got: %v", err)
+	}
+}
+
+func TestDialTLSMeetsMinimumSSF(t *testing.T) {
+	//portunus-server connects to slapd with goldap.DialTLS() and the default
+	//tls.Config, so whichever cipher suite slapd picks from what we offer must
+	//satisfy the `security ssf=` directive that the orchestrator renders from
+	//MinimumSSF; we cannot know slapd's preferences, so we try every suite
+	for _, keyType := range []string{"ecdsa", "rsa"} {
+		cert, roots := generateCertificateForTest(t, keyType)
+
+		serverConfigs := []*tls.Config{{MinVersion: tls.VersionTLS13}}
+		for _, suite := range tls.CipherSuites() {
+			serverConfigs = append(serverConfigs, &tls.Config{
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{suite.ID},
+			})
+		}
+
+		negotiatedVersions := make(map[uint16]bool)
+		for _, serverConfig := range serverConfigs {
+			serverConfig.Certificates = []tls.Certificate{cert}
+			state, ok := negotiateWithDialTLS(t, serverConfig, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+			if !ok {
+				continue //suite not offered by the client, or not compatible with this key type
+			}
+			negotiatedVersions[state.Version] = true
+			suiteName := tls.CipherSuiteName(state.CipherSuite)
+			if ssf := cipherSuiteSSF(suiteName); ssf < MinimumSSF {
+				t.Errorf("%s suite %s has SSF %d, which is below MinimumSSF = %d", keyType, suiteName, ssf, MinimumSSF)
+			}
+		}
+		if !negotiatedVersions[tls.VersionTLS12] || !negotiatedVersions[tls.VersionTLS13] {
+			t.Errorf("%s: expected to negotiate both TLS 1.2 and 1.3, but got %v", keyType, negotiatedVersions)
+		}
+	}
+}
+
+// Returns the SSF that slapd assigns to a TLS connection with this cipher
+// suite, i.e. the key size of its bulk cipher.
+func cipherSuiteSSF(suiteName string) int {
+	switch {
+	case strings.Contains(suiteName, "AES_256"), strings.Contains(suiteName, "CHACHA20"):
+		return 256
+	case strings.Contains(suiteName, "AES_128"):
+		return 128
+	default:
+		return 0
+	}
+}
+
+func negotiateWithDialTLS(t *testing.T, serverConfig, clientConfig *tls.Config) (tls.ConnectionState, bool) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	test.ExpectNoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*tls.Conn).Handshake() //errors will be reported by the client side
+	}()
+
+	conn, err := goldap.DialTLS("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		return tls.ConnectionState{}, false
+	}
+	defer conn.Close()
+	return conn.TLSConnectionState()
+}
+
+func generateCertificateForTest(t *testing.T, keyType string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	var (
+		privateKey crypto.Signer
+		err        error
+	)
+	switch keyType {
+	case "ecdsa":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	test.ExpectNoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	test.ExpectNoError(t, err)
+	parsedCert, err := x509.ParseCertificate(certDER)
+	test.ExpectNoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(parsedCert)
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: privateKey}, roots
+}
@@ -0,0 +1,345 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// DriftHandling is an enum that appears in type AdapterOptions. It controls
+// what happens with objects that were modified, added or deleted in the LDAP
+// directory by someone other than Portunus.
+type DriftHandling string
+
+const (
+	// DriftHandlingIgnore is the default. The LDAP directory is not checked for
+	// drift, so external changes persist until Portunus overwrites them with its
+	// next write to the respective object.
+	DriftHandlingIgnore DriftHandling = "ignore"
+	// DriftHandlingRepair reverts all external changes.
+	DriftHandlingRepair DriftHandling = "repair"
+	// DriftHandlingImport copies changes to certain user attributes (see
+	// importableUserAttributes) into the Portunus database, and reverts all
+	// other external changes.
+	DriftHandlingImport DriftHandling = "import"
+)
+
+// ParseDriftHandling parses the value of the PORTUNUS_LDAP_DRIFT_HANDLING
+// variable. The empty string is accepted as DriftHandlingIgnore.
+func ParseDriftHandling(input string) (DriftHandling, error) {
+	switch h := DriftHandling(input); h {
+	case "":
+		return DriftHandlingIgnore, nil
+	case DriftHandlingIgnore, DriftHandlingRepair, DriftHandlingImport:
+		return h, nil
+	default:
+		return "", fmt.Errorf(`invalid value for PORTUNUS_LDAP_DRIFT_HANDLING: %q (expected "ignore", "repair" or "import")`, input)
+	}
+}
+
+// How often the LDAP directory is checked for drift if
+// AdapterOptions.DriftHandling is not DriftHandlingIgnore. This is much less
+// frequent than the check for password changes since every check reads all
+// managed objects.
+const driftCheckInterval = 5 * time.Minute
+
+// The user attributes that can be imported with DriftHandlingImport. Derived
+// attributes (like cn and gecos) are not in this list because they follow
+// from the imported ones on the next sync.
+var importableUserAttributes = []string{"givenName", "sn", "mail", "telephoneNumber", "mobile", "sshPublicKey", "loginShell"}
+
+// An object in the LDAP directory that differs from what we last wrote.
+type drift struct {
+	Expected *Object //nil if the object was added outside of Portunus
+	Observed *Object //nil if the object was deleted outside of Portunus
+}
+
+func (d drift) DN() string {
+	if d.Expected != nil {
+		return d.Expected.DN
+	}
+	return d.Observed.DN
+}
+
+// Compares the managed objects in the LDAP directory with what we last wrote,
+// and repairs or imports all changes that were made by someone else.
+func (a *Adapter) checkDrift() {
+	for _, d := range a.findDrift() {
+		switch {
+		case d.Expected == nil:
+			logg.Info("LDAP object %s was added outside of Portunus", d.DN())
+		case d.Observed == nil:
+			logg.Info("LDAP object %s was deleted outside of Portunus", d.DN())
+		default:
+			logg.Info("LDAP object %s was modified outside of Portunus", d.DN())
+			if a.driftHandling == DriftHandlingImport {
+				a.importDrift(d)
+			}
+		}
+		a.repairDrift(d)
+	}
+}
+
+// Only the direct children of the OUs that we manage are considered, so that
+// e.g. the subtrees below layout.SubtreesOU can be changed freely.
+func (a *Adapter) driftSearchRequests() (result []goldap.SearchRequest) {
+	search := func(baseDN, filter string) {
+		req := goldap.NewSearchRequest(baseDN,
+			goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+			filter, []string{"*"}, nil,
+		)
+		result = append(result, *req)
+	}
+
+	primarySuffix := a.conn.DNSuffix()
+	search(primarySuffix, "(&(objectClass=groupOfNames)(cn=portunus-*))") //virtual groups for the ACL
+	search(fmt.Sprintf("ou=%s,%s", a.layout.ServiceAccountsOU, primarySuffix), "(objectClass=*)")
+	for _, suffix := range a.allSuffixes() {
+		for _, ouName := range a.layout.domainOUs() {
+			search(fmt.Sprintf("ou=%s,%s", ouName, suffix), "(objectClass=*)")
+		}
+	}
+	return result
+}
+
+func (a *Adapter) findDrift() (result []drift) {
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+	if len(a.objects) == 0 {
+		return nil //no sync has happened yet
+	}
+
+	//DNs are case-insensitive, so the LDAP server might not report them in the
+	//same spelling that we used
+	observedByDN := make(map[string]Object)
+	for _, req := range a.driftSearchRequests() {
+		sr, err := a.conn.Search(req)
+		if err != nil {
+			//without a complete picture, we cannot tell deleted objects apart from
+			//objects that we did not see
+			logg.Error("while checking for drift in LDAP: %s", err.Error())
+			return nil
+		}
+		for _, entry := range sr.Entries {
+			obj := Object{DN: entry.DN, Attributes: make(map[string][]string, len(entry.Attributes))}
+			for _, attr := range entry.Attributes {
+				obj.Attributes[attr.Name] = attr.Values
+			}
+			observedByDN[strings.ToLower(entry.DN)] = obj
+		}
+	}
+
+	isExpectedDN := make(map[string]bool, len(a.objects))
+	for _, obj := range a.objects {
+		if len(obj.Attributes) == 0 {
+			continue //placeholder for a failed delete, see restoreFailures()
+		}
+		key := strings.ToLower(obj.DN)
+		isExpectedDN[key] = true
+		observed, exists := observedByDN[key]
+		if !exists {
+			result = append(result, drift{Expected: &obj})
+			continue
+		}
+		if len(a.buildRepairOperations(observed, obj)) > 0 {
+			result = append(result, drift{Expected: &obj, Observed: &observed})
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(observedByDN)) {
+		if !isExpectedDN[key] {
+			observed := observedByDN[key]
+			result = append(result, drift{Observed: &observed})
+		}
+	}
+	return result
+}
+
+// Returns the writes that revert the `observed` object to the `expected` state.
+func (a *Adapter) buildRepairOperations(observed, expected Object) []operation {
+	//attribute names are case-insensitive as well, and they need to be spelled
+	//consistently for buildModifyRequest()
+	observedAttrs := make(map[string][]string, len(observed.Attributes))
+	for name, values := range observed.Attributes {
+		for expectedName := range expected.Attributes {
+			if strings.EqualFold(name, expectedName) {
+				name = expectedName
+				break
+			}
+		}
+		observedAttrs[name] = values
+	}
+	if a.acceptPasswordChanges {
+		//this is handled by checkPasswordChanges() instead
+		observedAttrs["userPassword"] = expected.Attributes["userPassword"]
+	}
+	return buildModifyRequest(expected.DN, observedAttrs, expected.Attributes)
+}
+
+func (a *Adapter) repairDrift(d drift) {
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+
+	//compare against the current state, since a sync might have happened since
+	//findDrift() (in particular, one triggered by importDrift())
+	idx := slices.IndexFunc(a.objects, func(obj Object) bool { return strings.EqualFold(obj.DN, d.DN()) })
+	var ops []operation
+	switch {
+	case idx == -1 && d.Expected == nil:
+		ops = []operation{{DeleteRequest: &goldap.DelRequest{DN: d.Observed.DN}}}
+	case idx == -1:
+		return //the object was deleted by a sync in the meantime
+	case d.Observed == nil:
+		ops = []operation{buildAddRequest(a.objects[idx])}
+	default:
+		ops = a.buildRepairOperations(*d.Observed, a.objects[idx])
+	}
+
+	for _, op := range ops {
+		//failures are only logged; they will be retried on the next check
+		a.status.recordResult(op, op.ExecuteOn(a.conn), false, a.timeNow())
+	}
+}
+
+// Copies the values of importableUserAttributes from the LDAP directory into
+// the Portunus database. If this succeeds, the imported attributes do not
+// count as drift anymore in the subsequent repairDrift().
+func (a *Adapter) importDrift(d drift) {
+	loginName := firstValueOf(d.Expected.Attributes["uid"])
+	if loginName == "" || !strings.HasPrefix(strings.ToLower(d.Expected.DN), "uid=") {
+		return //not a user object
+	}
+	observedAttrs := a.buildRepairOperations(*d.Observed, *d.Expected)
+	var changedAttrs []string
+	for _, op := range observedAttrs {
+		for _, change := range op.ModifyRequest.Changes {
+			if slices.Contains(importableUserAttributes, change.Modification.Type) {
+				changedAttrs = append(changedAttrs, change.Modification.Type)
+			}
+		}
+	}
+	if len(changedAttrs) == 0 {
+		return
+	}
+	slices.Sort(changedAttrs)
+
+	//update our record of the LDAP directory before updating the nexus, so that
+	//the sync triggered by the nexus update does not revert the imported values
+	observedValues := make(map[string][]string, len(changedAttrs))
+	for _, name := range changedAttrs {
+		observedValues[name] = nil //in case the attribute was deleted
+	}
+	for name, values := range d.Observed.Attributes {
+		for _, changedName := range changedAttrs {
+			if strings.EqualFold(name, changedName) {
+				observedValues[changedName] = values
+			}
+		}
+	}
+	a.setObjectAttributes(d.Expected.DN, observedValues)
+
+	err := a.applyDriftImport(loginName, observedValues)
+	if err != nil {
+		logg.Error("not importing changes to user %q from LDAP: %s", loginName, err.Error())
+		expectedValues := make(map[string][]string, len(changedAttrs))
+		for _, name := range changedAttrs {
+			expectedValues[name] = d.Expected.Attributes[name]
+		}
+		a.setObjectAttributes(d.Expected.DN, expectedValues)
+		return
+	}
+
+	logg.Info("imported changes to user %q from LDAP: %s", loginName, strings.Join(changedAttrs, ", "))
+	if a.auditLog == nil {
+		return
+	}
+	err = a.auditLog.Record(audit.Event{
+		Type:    audit.EventLDAPImport,
+		Actor:   directoryActor,
+		Subject: loginName,
+		Message: "changes made in LDAP were imported: " + strings.Join(changedAttrs, ", "),
+		Details: map[string]string{"dn": d.Expected.DN},
+	})
+	if err != nil {
+		logg.Error("could not record import of changes to user %q in audit log: %s", loginName, err.Error())
+	}
+}
+
+func (a *Adapter) setObjectAttributes(dn string, values map[string][]string) {
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+	idx := slices.IndexFunc(a.objects, func(obj Object) bool { return obj.DN == dn })
+	if idx == -1 {
+		return
+	}
+	obj := a.objects[idx]
+	obj.Attributes = maps.Clone(obj.Attributes)
+	for name, v := range values {
+		if len(v) == 0 {
+			delete(obj.Attributes, name)
+		} else {
+			obj.Attributes[name] = v
+		}
+	}
+	a.objects[idx] = obj
+}
+
+func (a *Adapter) applyDriftImport(loginName string, values map[string][]string) error {
+	errs := a.nexus.Update(func(db *core.Database) (errs errext.ErrorSet) {
+		idx := slices.IndexFunc(db.Users, func(u core.User) bool { return u.LoginName == loginName })
+		if idx == -1 {
+			errs.Addf("user %q does not exist", loginName)
+			return
+		}
+		u := &db.Users[idx]
+		for name, v := range values {
+			if u.HidesLDAPAttribute(name) {
+				//the value in Portunus was never published, so the observed value is not a change to it
+				errs.Addf("cannot import %s for user %q who has this attribute hidden from LDAP", name, loginName)
+				continue
+			}
+			switch name {
+			case "givenName":
+				u.GivenName = firstValueOf(v)
+			case "sn":
+				u.FamilyName = firstValueOf(v)
+			case "mail":
+				u.EMailAddress = firstValueOf(v)
+			case "telephoneNumber":
+				u.TelephoneNumber = firstValueOf(v)
+			case "mobile":
+				u.MobileNumber = firstValueOf(v)
+			case "sshPublicKey":
+				u.SSHPublicKeys = slices.Clone(v)
+			case "loginShell":
+				if u.POSIX == nil {
+					errs.Addf("cannot set loginShell for user %q who is not a POSIX user", loginName)
+					continue
+				}
+				u.POSIX.LoginShell = firstValueOf(v)
+			}
+		}
+		return
+	}, &core.UpdateOptions{
+		ConflictWithSeedIsError: true,
+		Actor:                   directoryActor,
+	})
+	if !errs.IsEmpty() {
+		return errors.New(errs.Join(", "))
+	}
+	return nil
+}
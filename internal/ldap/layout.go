@@ -0,0 +1,197 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// Layout contains the names of the organizational units below the LDAP
+// suffix that Portunus creates and maintains. Empty fields are treated as
+// having their default values (see DefaultLayout).
+type Layout struct {
+	UsersOU           string
+	GroupsOU          string
+	PosixGroupsOU     string
+	ServiceAccountsOU string
+	SubtreesOU        string
+	//Additional OUs that are created empty, e.g. because applications expect
+	//them to exist. Only Portunus' own service user can write into them.
+	ExtraOUs []string
+}
+
+// DefaultLayout returns the Layout that Portunus uses unless configured
+// otherwise.
+func DefaultLayout() Layout {
+	return Layout{
+		UsersOU:           "users",
+		GroupsOU:          "groups",
+		PosixGroupsOU:     "posix-groups",
+		ServiceAccountsOU: "service-accounts",
+		SubtreesOU:        "subtrees",
+	}
+}
+
+// OU names are restricted such that they can be put into DNs and into the
+// regexes in the slapd ACL without any escaping.
+var ouNameRx = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// LayoutFromEnvironment reads a Layout from the PORTUNUS_LDAP_*_OU
+// environment variables, and checks it for validity.
+func LayoutFromEnvironment() (Layout, error) {
+	l := Layout{
+		UsersOU:           os.Getenv("PORTUNUS_LDAP_USERS_OU"),
+		GroupsOU:          os.Getenv("PORTUNUS_LDAP_GROUPS_OU"),
+		PosixGroupsOU:     os.Getenv("PORTUNUS_LDAP_POSIX_GROUPS_OU"),
+		ServiceAccountsOU: os.Getenv("PORTUNUS_LDAP_SERVICE_ACCOUNTS_OU"),
+		SubtreesOU:        os.Getenv("PORTUNUS_LDAP_SUBTREES_OU"),
+		ExtraOUs:          strings.Fields(os.Getenv("PORTUNUS_LDAP_EXTRA_OUS")),
+	}.withDefaults()
+
+	isUsed := make(map[string]string)
+	check := func(key, name string) error {
+		if !ouNameRx.MatchString(name) {
+			return fmt.Errorf("malformed OU name in %s: %q", key, name)
+		}
+		//OU names are case-insensitive, just like all attribute values in DNs
+		if otherKey, exists := isUsed[strings.ToLower(name)]; exists {
+			return fmt.Errorf("OU name %q is used in both %s and %s", name, otherKey, key)
+		}
+		isUsed[strings.ToLower(name)] = key
+		return nil
+	}
+	for _, pair := range [][2]string{
+		{"PORTUNUS_LDAP_USERS_OU", l.UsersOU},
+		{"PORTUNUS_LDAP_GROUPS_OU", l.GroupsOU},
+		{"PORTUNUS_LDAP_POSIX_GROUPS_OU", l.PosixGroupsOU},
+		{"PORTUNUS_LDAP_SERVICE_ACCOUNTS_OU", l.ServiceAccountsOU},
+		{"PORTUNUS_LDAP_SUBTREES_OU", l.SubtreesOU},
+	} {
+		err := check(pair[0], pair[1])
+		if err != nil {
+			return Layout{}, err
+		}
+	}
+	for _, name := range l.ExtraOUs {
+		err := check("PORTUNUS_LDAP_EXTRA_OUS", name)
+		if err != nil {
+			return Layout{}, err
+		}
+	}
+	return l, nil
+}
+
+func (l Layout) withDefaults() Layout {
+	d := DefaultLayout()
+	if l.UsersOU == "" {
+		l.UsersOU = d.UsersOU
+	}
+	if l.GroupsOU == "" {
+		l.GroupsOU = d.GroupsOU
+	}
+	if l.PosixGroupsOU == "" {
+		l.PosixGroupsOU = d.PosixGroupsOU
+	}
+	if l.ServiceAccountsOU == "" {
+		l.ServiceAccountsOU = d.ServiceAccountsOU
+	}
+	if l.SubtreesOU == "" {
+		l.SubtreesOU = d.SubtreesOU
+	}
+	return l
+}
+
+// The OUs that are created below the primary suffix when the Adapter starts,
+// in order.
+func (l Layout) allOUs() []string {
+	return append([]string{l.UsersOU, l.GroupsOU, l.PosixGroupsOU, l.ServiceAccountsOU, l.SubtreesOU}, l.ExtraOUs...)
+}
+
+// The OUs that are created below each additional suffix. Subtrees and extra
+// OUs (as well as service accounts) only exist below the primary suffix.
+func (l Layout) domainOUs() []string {
+	return []string{l.UsersOU, l.GroupsOU, l.PosixGroupsOU}
+}
+
+// Computes the DNs of users and groups. Since users and groups can be placed
+// in different domains, this needs to know where each of them lives.
+type dnResolver struct {
+	layout        Layout
+	primarySuffix string
+	userDomains   map[string]string //key = login name, value = domain name
+	groupDomains  map[string]string //key = group name, value = domain name
+}
+
+func newDNResolver(db core.Database, primarySuffix string, layout Layout) dnResolver {
+	r := dnResolver{
+		layout:        layout,
+		primarySuffix: primarySuffix,
+		userDomains:   make(map[string]string),
+		groupDomains:  make(map[string]string),
+	}
+	for _, u := range db.Users {
+		if u.Domain != "" {
+			r.userDomains[u.LoginName] = u.Domain
+		}
+	}
+	for _, g := range db.Groups {
+		if g.Domain != "" {
+			r.groupDomains[g.Name] = g.Domain
+		}
+	}
+	return r
+}
+
+func (r dnResolver) suffixOf(domainName string) string {
+	if domainName == "" {
+		return r.primarySuffix
+	}
+	return core.SuffixOfDomainName(domainName)
+}
+
+func (r dnResolver) userDN(loginName string) string {
+	return fmt.Sprintf("uid=%s,ou=%s,%s", loginName, r.layout.UsersOU, r.suffixOf(r.userDomains[loginName]))
+}
+
+func (r dnResolver) groupDN(name string) string {
+	return fmt.Sprintf("cn=%s,ou=%s,%s", name, r.layout.GroupsOU, r.suffixOf(r.groupDomains[name]))
+}
+
+func (r dnResolver) posixGroupDN(name string) string {
+	return fmt.Sprintf("cn=%s,ou=%s,%s", name, r.layout.PosixGroupsOU, r.suffixOf(r.groupDomains[name]))
+}
+
+// Like userDN, but the domain is taken from the given user instead of from
+// the database that the resolver was built from.
+func (r dnResolver) userObjectDN(u core.User) string {
+	r.userDomains = map[string]string{u.LoginName: u.Domain}
+	return r.userDN(u.LoginName)
+}
+
+// Returns the DNs of all objects that renderGroup() creates for the given
+// group, or nil if the group is hidden from LDAP.
+func (r dnResolver) groupObjectDNs(g core.Group) []string {
+	if g.IsHiddenFromLDAP {
+		return nil
+	}
+	r.groupDomains = map[string]string{g.Name: g.Domain}
+	result := []string{r.groupDN(g.Name)}
+	if g.PosixGID != nil {
+		result = append(result, r.posixGroupDN(g.Name))
+	}
+	return result
+}
+
+// Service accounts only exist below the primary suffix.
+func (r dnResolver) serviceAccountDN(name string) string {
+	return fmt.Sprintf("cn=%s,ou=%s,%s", name, r.layout.ServiceAccountsOU, r.primarySuffix)
+}
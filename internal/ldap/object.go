@@ -8,6 +8,9 @@ package ldap
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/majewsky/portunus/internal/core"
 )
@@ -18,34 +21,75 @@ type Object struct {
 	Attributes map[string][]string
 }
 
+// Returns the approximate size of this object in the LDAP database, i.e. the
+// combined length of its DN and of all its attribute types and values.
+func (o Object) size() uint64 {
+	result := uint64(len(o.DN))
+	for attrType, values := range o.Attributes {
+		for _, value := range values {
+			result += uint64(len(attrType) + len(value))
+		}
+	}
+	return result
+}
+
+// Returns a copy of this object without the userPassword attribute.
+func (o Object) withoutPassword() Object {
+	attrs := make(map[string][]string, len(o.Attributes))
+	for attrType, values := range o.Attributes {
+		if attrType != "userPassword" {
+			attrs[attrType] = slices.Clone(values)
+		}
+	}
+	return Object{DN: o.DN, Attributes: attrs}
+}
+
 // Produces the LDAP objects representing the given group.
-func renderGroup(g core.Group, dnSuffix string) []Object {
+func renderGroup(g core.Group, r dnResolver, withLabels bool) []Object {
 	memberDNames := make([]string, 0, len(g.MemberLoginNames))
 	memberLoginNames := make([]string, 0, len(g.MemberLoginNames))
-	for name, isMember := range g.MemberLoginNames {
-		if isMember {
-			memberDNames = append(memberDNames, fmt.Sprintf("uid=%s,ou=users,%s", name, dnSuffix))
+	for _, name := range slices.Sorted(maps.Keys(g.MemberLoginNames)) {
+		if g.MemberLoginNames[name] {
+			memberDNames = append(memberDNames, r.userDN(name))
 			memberLoginNames = append(memberLoginNames, name)
 		}
 	}
+	//since members can be in different domains, sorting by login name does not
+	//sort the DNs (and a stable order avoids pointless writes)
+	slices.Sort(memberDNames)
 	if len(memberDNames) == 0 {
 		//The OpenLDAP core.schema requires that `groupOfNames` contain at least
 		//one `member` attribute. If the group does not have any proper members,
 		//add the dummy user account "nobody" to it.
-		memberDNames = append(memberDNames, "cn=nobody,"+dnSuffix)
+		memberDNames = append(memberDNames, "cn=nobody,"+r.primarySuffix)
 	}
 
 	objs := []Object{{
-		DN: fmt.Sprintf("cn=%s,ou=groups,%s", g.Name, dnSuffix),
+		DN: r.groupDN(g.Name),
 		Attributes: map[string][]string{
 			"cn":          {g.Name},
 			"member":      memberDNames,
 			"objectClass": {"groupOfNames", "top"},
 		},
 	}}
+	if g.EMailAddress != "" {
+		objs[0].Attributes["mail"] = []string{g.EMailAddress}
+	}
+	if withLabels && len(g.Labels) > 0 {
+		objs[0].Attributes["portunusLabel"] = g.Labels.Lines()
+	}
+	if g.EMailAddress != "" || objs[0].Attributes["portunusLabel"] != nil {
+		objs[0].Attributes["objectClass"] = []string{"portunusGroup", "groupOfNames", "top"}
+	}
+	if g.OwnerLoginName != "" {
+		objs[0].Attributes["owner"] = []string{r.userDN(g.OwnerLoginName)}
+	}
+	if g.Notes != "" {
+		objs[0].Attributes["description"] = []string{g.Notes}
+	}
 	if g.PosixGID != nil {
 		objs = append(objs, Object{
-			DN: fmt.Sprintf("cn=%s,ou=posix-groups,%s", g.Name, dnSuffix),
+			DN: r.posixGroupDN(g.Name),
 			Attributes: map[string][]string{
 				"cn":          {g.Name},
 				"gidNumber":   {g.PosixGID.String()},
@@ -57,18 +101,48 @@ func renderGroup(g core.Group, dnSuffix string) []Object {
 	return objs
 }
 
+// DisabledUserHandling is an enum that appears in type AdapterOptions and
+// ServerOptions. It controls how users with core.User.Disabled appear in the
+// LDAP directory.
+type DisabledUserHandling string
+
+const (
+	// DisabledUserHandlingRemove is the default. Disabled users are left out of
+	// the LDAP directory, and do not appear as members of any groups.
+	DisabledUserHandlingRemove DisabledUserHandling = "remove"
+	// DisabledUserHandlingMark keeps disabled users in the LDAP directory
+	// (including their group memberships), but without their password, so they
+	// cannot bind. Their objects carry the attribute "portunusDisabled: TRUE",
+	// so that applications can recognize them.
+	DisabledUserHandlingMark DisabledUserHandling = "mark"
+)
+
+// ParseDisabledUserHandling parses the value of the
+// PORTUNUS_LDAP_DISABLED_USER_HANDLING variable. The empty string is accepted
+// as DisabledUserHandlingRemove.
+func ParseDisabledUserHandling(input string) (DisabledUserHandling, error) {
+	switch h := DisabledUserHandling(input); h {
+	case "":
+		return DisabledUserHandlingRemove, nil
+	case DisabledUserHandlingRemove, DisabledUserHandlingMark:
+		return h, nil
+	default:
+		return "", fmt.Errorf(`invalid value for PORTUNUS_LDAP_DISABLED_USER_HANDLING: %q (expected "remove" or "mark")`, input)
+	}
+}
+
 // Produces the LDAP object representing the given user.
-func renderUser(u core.User, dnSuffix string, allGroups []core.Group) Object {
+func renderUser(u core.User, r dnResolver, allGroups []core.Group, withLabels bool) Object {
 	var memberOfGroupDNames []string
 	for _, group := range allGroups {
 		if group.ContainsUser(u) {
-			dn := fmt.Sprintf("cn=%s,ou=groups,%s", group.Name, dnSuffix)
+			dn := r.groupDN(group.Name)
 			memberOfGroupDNames = append(memberOfGroupDNames, dn)
 		}
 	}
 
 	obj := Object{
-		DN: fmt.Sprintf("uid=%s,ou=users,%s", u.LoginName, dnSuffix),
+		DN: r.userDN(u.LoginName),
 		Attributes: map[string][]string{
 			"uid":          {u.LoginName},
 			"cn":           {u.FullName()},
@@ -80,12 +154,34 @@ func renderUser(u core.User, dnSuffix string, allGroups []core.Group) Object {
 		},
 	}
 
-	if u.EMailAddress != "" {
+	if u.EMailAddress != "" && !u.HidesLDAPAttribute("mail") {
 		obj.Attributes["mail"] = []string{u.EMailAddress}
 	}
-	if len(u.SSHPublicKeys) > 0 {
+	if u.TelephoneNumber != "" {
+		obj.Attributes["telephoneNumber"] = []string{u.TelephoneNumber}
+	}
+	if u.MobileNumber != "" {
+		obj.Attributes["mobile"] = []string{u.MobileNumber}
+	}
+	if u.PostalAddress != "" {
+		obj.Attributes["postalAddress"] = []string{renderPostalAddress(u.PostalAddress)}
+	}
+	if u.ManagerLoginName != "" {
+		obj.Attributes["manager"] = []string{r.userDN(u.ManagerLoginName)}
+	}
+	if len(u.SSHPublicKeys) > 0 && !u.HidesLDAPAttribute("sshPublicKey") {
 		obj.Attributes["sshPublicKey"] = u.SSHPublicKeys
 	}
+	if withLabels && len(u.Labels) > 0 {
+		obj.Attributes["portunusLabel"] = u.Labels.Lines()
+	}
+	if len(u.JPEGPhoto) > 0 && !u.HidesLDAPAttribute("jpegPhoto") {
+		obj.Attributes["jpegPhoto"] = []string{string(u.JPEGPhoto)}
+	}
+	//validation ensures that these do not collide with any of the attributes above
+	for name, value := range u.ExtraAttributes {
+		obj.Attributes[name] = []string{value}
+	}
 
 	if u.POSIX != nil {
 		obj.Attributes["uidNumber"] = []string{u.POSIX.UID.String()}
@@ -102,5 +198,39 @@ func renderUser(u core.User, dnSuffix string, allGroups []core.Group) Object {
 		obj.Attributes["objectClass"] = append(obj.Attributes["objectClass"], "posixAccount")
 	}
 
+	//with DisabledUserHandlingRemove, disabled users do not get here at all
+	if u.Disabled {
+		obj.Attributes["portunusDisabled"] = []string{"TRUE"}
+		delete(obj.Attributes, "userPassword")
+	}
+
+	return obj
+}
+
+// Renders a multi-line postal address in the Postal Address syntax from
+// RFC 4517, section 3.3.28: Lines are separated by "$", and occurrences of
+// "\" and "$" within a line are escaped as "\5C" and "\24", respectively.
+func renderPostalAddress(address string) string {
+	lines := strings.Split(address, "\n")
+	for idx, line := range lines {
+		line = strings.ReplaceAll(line, `\`, `\5C`)
+		lines[idx] = strings.ReplaceAll(line, "$", `\24`)
+	}
+	return strings.Join(lines, "$")
+}
+
+// Produces the LDAP object representing the given service account.
+func renderServiceAccount(s core.ServiceAccount, r dnResolver) Object {
+	obj := Object{
+		DN: r.serviceAccountDN(s.Name),
+		Attributes: map[string][]string{
+			"cn":           {s.Name},
+			"userPassword": {s.PasswordHash},
+			"objectClass":  {"organizationalRole", "simpleSecurityObject", "top"},
+		},
+	}
+	if s.Description != "" {
+		obj.Attributes["description"] = []string{s.Description}
+	}
 	return obj
 }
@@ -0,0 +1,218 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// How often the LDAP directory is checked for password changes if
+// AdapterOptions.AcceptPasswordChanges is set.
+const passwordChangePollInterval = 10 * time.Second
+
+// The actor that is reported for changes that were made in the LDAP directory
+// and copied into the Portunus database.
+var directoryActor = core.Actor{Type: core.ActorTypeSystem, Name: "ldap"}
+
+// A password change that was observed in the LDAP directory.
+type passwordChange struct {
+	DN        string
+	LoginName string
+	OldHash   string //as last written by us
+	NewHash   string //as found in the LDAP directory
+}
+
+// Runs `check` periodically until `ctx` expires. This is used for
+// checkPasswordChanges() and checkDrift().
+func poll(ctx context.Context, interval time.Duration, check func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// Users can change their own password in the LDAP directory, usually through
+// the Password Modify extended operation (this is what `passwd` does with
+// pam_ldap or SSSD). Since the Portunus database is the source of truth, such
+// changes would be overwritten on the next sync, so we copy them into the
+// Portunus database instead. Changes that the Portunus database does not
+// accept are reverted in the LDAP directory.
+func (a *Adapter) checkPasswordChanges() {
+	for _, c := range a.findPasswordChanges() {
+		err := a.applyPasswordChange(c)
+		if err == nil {
+			logg.Info("password of user %q was changed through LDAP", c.LoginName)
+			a.recordPasswordChange(c)
+			continue
+		}
+		logg.Error("rejecting password change of user %q through LDAP: %s", c.LoginName, err.Error())
+		a.revertPasswordChange(c)
+	}
+}
+
+// Compares the password hashes in the LDAP directory against those that we
+// last wrote. To avoid a roundtrip write, a.objects is updated to the observed
+// state right away.
+func (a *Adapter) findPasswordChanges() (result []passwordChange) {
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+
+	//user objects are recognized by their uid attribute
+	objectIndexByDN := make(map[string]int)
+	for idx, obj := range a.objects {
+		if len(obj.Attributes["uid"]) == 1 {
+			objectIndexByDN[obj.DN] = idx
+		}
+	}
+	if len(objectIndexByDN) == 0 {
+		return nil
+	}
+
+	for _, suffix := range a.allSuffixes() {
+		req := goldap.NewSearchRequest(
+			fmt.Sprintf("ou=%s,%s", a.layout.UsersOU, suffix),
+			goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+			"(uid=*)", []string{"userPassword"}, nil,
+		)
+		sr, err := a.conn.Search(*req)
+		if err != nil {
+			logg.Error("while checking for password changes in LDAP: %s", err.Error())
+			continue
+		}
+
+		for _, entry := range sr.Entries {
+			idx, exists := objectIndexByDN[entry.DN]
+			if !exists {
+				continue
+			}
+			obj := a.objects[idx]
+			oldHash := firstValueOf(obj.Attributes["userPassword"])
+			newHash := entry.GetAttributeValue("userPassword")
+			if oldHash == newHash {
+				continue
+			}
+			result = append(result, passwordChange{
+				DN:        obj.DN,
+				LoginName: obj.Attributes["uid"][0],
+				OldHash:   oldHash,
+				NewHash:   newHash,
+			})
+			obj.Attributes = withUserPassword(obj.Attributes, newHash)
+			a.objects[idx] = obj
+		}
+	}
+	return result
+}
+
+func (a *Adapter) applyPasswordChange(c passwordChange) error {
+	//this rejects deleted passwords as well as plaintext passwords (the latter
+	//can only be set with a regular modify request, not with the extended
+	//operation, since slapd hashes the new password for the latter)
+	passwordHash, err := crypt.ImportPasswordHash(c.NewHash)
+	if err != nil {
+		return err
+	}
+
+	errs := a.nexus.Update(func(db *core.Database) (errs errext.ErrorSet) {
+		for idx, user := range db.Users {
+			if user.LoginName == c.LoginName {
+				db.Users[idx].PasswordHash = passwordHash
+				return
+			}
+		}
+		errs.Addf("user %q does not exist", c.LoginName)
+		return
+	}, &core.UpdateOptions{
+		//a password change that conflicts with the seed shall be reverted
+		//instead of being silently corrected by the next seed application
+		ConflictWithSeedIsError: true,
+		Actor:                   directoryActor,
+	})
+	if !errs.IsEmpty() {
+		return errors.New(errs.Join(", "))
+	}
+	return nil
+}
+
+func (a *Adapter) recordPasswordChange(c passwordChange) {
+	if a.auditLog == nil {
+		return
+	}
+	err := a.auditLog.Record(audit.Event{
+		Type:    audit.EventPasswordChange,
+		Actor:   directoryActor,
+		Subject: c.LoginName,
+		Message: "password was changed through LDAP",
+		Details: map[string]string{"dn": c.DN},
+		Notify:  true,
+	})
+	if err != nil {
+		logg.Error("could not record password change for user %q in audit log: %s", c.LoginName, err.Error())
+	}
+}
+
+func (a *Adapter) revertPasswordChange(c passwordChange) {
+	a.objectsMutex.Lock()
+	defer a.objectsMutex.Unlock()
+
+	idx := slices.IndexFunc(a.objects, func(obj Object) bool { return obj.DN == c.DN })
+	if idx == -1 || firstValueOf(a.objects[idx].Attributes["userPassword"]) != c.NewHash {
+		//the object was deleted or rewritten by a sync in the meantime
+		return
+	}
+	obj := a.objects[idx]
+	obj.Attributes = withUserPassword(obj.Attributes, c.OldHash)
+	a.objects[idx] = obj
+
+	req := goldap.ModifyRequest{DN: c.DN}
+	if c.OldHash == "" {
+		req.Delete("userPassword", nil)
+	} else {
+		req.Replace("userPassword", []string{c.OldHash})
+	}
+	err := a.conn.Modify(req)
+	if err != nil {
+		logg.Error("could not revert password change of user %q in LDAP: %s", c.LoginName, err.Error())
+	}
+}
+
+func firstValueOf(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Returns a copy of `attrs` with the given userPassword, leaving the original
+// map untouched.
+func withUserPassword(attrs map[string][]string, passwordHash string) map[string][]string {
+	attrs = maps.Clone(attrs)
+	if passwordHash == "" {
+		delete(attrs, "userPassword")
+	} else {
+		attrs["userPassword"] = []string{passwordHash}
+	}
+	return attrs
+}
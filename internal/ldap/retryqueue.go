@@ -0,0 +1,71 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The contents of the file at AdapterOptions.RetryQueuePath.
+type persistedRetryQueue struct {
+	Failures      []OperationFailure `json:"failures"`
+	SchemaVersion uint               `json:"schema_version"`
+}
+
+// Reads the failed operations that were recorded by a previous run of the
+// Adapter. A missing file is not an error: it just means that there was
+// nothing left to retry.
+func loadRetryQueue(path string) ([]OperationFailure, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var q persistedRetryQueue
+	err = json.Unmarshal(buf, &q)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	if q.SchemaVersion != 1 {
+		return nil, fmt.Errorf("found %s with schema version %d, but this Portunus only understands schema version 1", path, q.SchemaVersion)
+	}
+	return q.Failures, nil
+}
+
+// Records the given failed operations, such that they can be retried by the
+// next run of the Adapter if the server is restarted before they succeed. If
+// there are no failures, the file is removed instead.
+func saveRetryQueue(path string, failures []OperationFailure) error {
+	if len(failures) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	buf, err := json.MarshalIndent(persistedRetryQueue{failures, 1}, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	//write atomically, so that a crash during the write does not lose the queue
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d", filepath.Base(path), os.Getpid()))
+	err = os.WriteFile(tmpPath, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,805 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	oidStartTLS       = "1.3.6.1.4.1.1466.20037"
+	oidPasswordModify = "1.3.6.1.4.1.4203.1.11.1"
+	oidWhoAmI         = goldap.ControlTypeWhoAmI
+)
+
+// The largest request that Server accepts. Requests from legitimate clients
+// are much smaller than this (the largest ones are searches with long filters).
+const maxRequestSize = 1 << 20
+
+// How deeply BER elements may be nested in a request. Again, legitimate
+// requests stay far below this.
+const maxRequestDepth = 64
+
+// Server is an LDAP server that serves the Portunus database directly from
+// memory. It can be used instead of running slapd with an Adapter, which is
+// useful for small deployments that do not want to depend on OpenLDAP.
+//
+// The directory is read-only: All write operations are refused, since all
+// changes need to go through Portunus. Access control works like in the slapd
+// configuration rendered by portunus-orchestrator, except that password hashes
+// are never disclosed to anyone.
+type Server struct {
+	nexus        core.Nexus
+	dnSuffix     string
+	renderLabels bool
+	layout       Layout
+	tlsConfig    *tls.Config //nil if disabled
+
+	disabledUsers DisabledUserHandling
+	directory     atomic.Pointer[directory]
+}
+
+// ServerOptions contains settings for a Server.
+type ServerOptions struct {
+	//The suffix of the primary domain, e.g. "dc=example,dc=org".
+	DNSuffix string
+	//Same meaning as in AdapterOptions.
+	RenderLabels         bool
+	Layout               Layout
+	DisabledUserHandling DisabledUserHandling
+	//If not nil, clients on plain connections can upgrade to TLS with StartTLS.
+	//Other operations are refused on plain connections until they do so. (This
+	//is the same behavior as slapd when configured by portunus-orchestrator.)
+	TLSConfig *tls.Config
+}
+
+// NewServer initializes a Server instance.
+func NewServer(nexus core.Nexus, opts ServerOptions) (*Server, error) {
+	s := &Server{
+		nexus:        nexus,
+		dnSuffix:     opts.DNSuffix,
+		renderLabels: opts.RenderLabels,
+		layout:       opts.Layout.withDefaults(),
+		tlsConfig:    opts.TLSConfig,
+	}
+	s.disabledUsers = opts.DisabledUserHandling
+	if s.disabledUsers == "" {
+		s.disabledUsers = DisabledUserHandlingRemove
+	}
+	//until the nexus reports the database for the first time, we serve just the
+	//static objects (this also checks that the configured suffixes are valid)
+	err := s.updateDirectory(core.Database{})
+	return s, err
+}
+
+// ServiceAccountDN returns the DN that the service account with the given name
+// uses to bind to the LDAP server.
+func (s *Server) ServiceAccountDN(name string) string {
+	r := dnResolver{layout: s.layout, primarySuffix: s.dnSuffix}
+	return r.serviceAccountDN(name)
+}
+
+// UserDN returns the DN of the given user in the LDAP directory.
+func (s *Server) UserDN(u core.User) string {
+	r := dnResolver{layout: s.layout, primarySuffix: s.dnSuffix}
+	return r.userObjectDN(u)
+}
+
+// GroupDNs returns the DNs of the objects that the given group is rendered
+// into in the LDAP directory (two for POSIX groups, otherwise one), or nil if
+// the group is hidden from LDAP.
+func (s *Server) GroupDNs(g core.Group) []string {
+	r := dnResolver{layout: s.layout, primarySuffix: s.dnSuffix}
+	return r.groupObjectDNs(g)
+}
+
+// Objects returns all objects in the directory, without their password
+// hashes. Parents come before their children, so the result can be exported
+// as an LDIF file.
+func (s *Server) Objects() []Object {
+	d := s.directory.Load()
+	result := make([]Object, len(d.entries))
+	for idx, entry := range d.entries {
+		result[idx] = entry.withoutPassword()
+	}
+	return result
+}
+
+// Returns the primary suffix and the suffixes of all additional domains.
+func (s *Server) allSuffixes() []string {
+	suffixes := []string{s.dnSuffix}
+	for _, domainName := range s.nexus.ValidationConfig().Domains {
+		suffixes = append(suffixes, core.SuffixOfDomainName(domainName))
+	}
+	return suffixes
+}
+
+func (s *Server) updateDirectory(db core.Database) error {
+	objects := renderDBToLDAP(db, s.dnSuffix, s.layout, s.renderLabels, s.disabledUsers)
+	for _, req := range makeStaticObjects(s.dnSuffix, s.nexus.ValidationConfig().Domains, s.layout) {
+		attrs := make(map[string][]string, len(req.Attributes))
+		for _, attr := range req.Attributes {
+			attrs[attr.Type] = attr.Vals
+		}
+		objects = append(objects, Object{DN: req.DN, Attributes: attrs})
+	}
+
+	d, err := buildDirectory(objects, s.dnSuffix, s.allSuffixes(), s.layout)
+	if err != nil {
+		return err
+	}
+	s.directory.Store(d)
+	return nil
+}
+
+// Run serves LDAP on the given listeners until `ctx` expires. Connections from
+// listeners created with tls.NewListener() count as encrypted; all other
+// connections count as plain.
+func (s *Server) Run(ctx context.Context, listeners ...net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.nexus.AddListener(ctx, func(db core.Database) {
+		err := s.updateDirectory(db)
+		if err != nil {
+			//the previous state of the directory continues to be served
+			logg.Error("cannot update LDAP directory: %s", err.Error())
+		}
+	})
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errChan <- s.serve(ctx, listener)
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errChan:
+		cancel()
+	}
+	wg.Wait()
+	return err
+}
+
+func (s *Server) serve(ctx context.Context, listener net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		_, isTLS := conn.(*tls.Conn)
+		c := &serverConn{
+			server: s,
+			conn:   conn,
+			reader: bufio.NewReader(conn),
+			isTLS:  isTLS,
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stop()
+			c.run()
+		}()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// connection handling
+
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	isTLS  bool
+	//empty for anonymous connections
+	boundDN           string //normalized
+	boundDNForDisplay string //as in the directory
+}
+
+func (c *serverConn) run() {
+	defer c.conn.Close()
+	for {
+		msg, err := readRequest(c.reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logg.Debug("closing LDAP connection from %s: %s", c.conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		err = c.handleMessage(msg)
+		if err != nil {
+			if !errors.Is(err, errUnbind) {
+				logg.Debug("closing LDAP connection from %s: %s", c.conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+	}
+}
+
+// Returned by handleMessage() when the client asked to close the connection.
+var errUnbind = errors.New("unbind")
+
+// For each request that has a response, the tag of the response.
+var responseTags = map[ber.Tag]ber.Tag{
+	goldap.ApplicationBindRequest:     goldap.ApplicationBindResponse,
+	goldap.ApplicationSearchRequest:   goldap.ApplicationSearchResultDone,
+	goldap.ApplicationModifyRequest:   goldap.ApplicationModifyResponse,
+	goldap.ApplicationAddRequest:      goldap.ApplicationAddResponse,
+	goldap.ApplicationDelRequest:      goldap.ApplicationDelResponse,
+	goldap.ApplicationModifyDNRequest: goldap.ApplicationModifyDNResponse,
+	goldap.ApplicationCompareRequest:  goldap.ApplicationCompareResponse,
+	goldap.ApplicationExtendedRequest: goldap.ApplicationExtendedResponse,
+}
+
+// A control that was attached to a request.
+type requestControl struct {
+	Type        string
+	Criticality bool
+	Value       []byte
+}
+
+// Handles a single LDAPMessage (see RFC 4511, section 4.2). An error is
+// returned if the connection shall be closed.
+func (c *serverConn) handleMessage(msg *ber.Packet) error {
+	if len(msg.Children) < 2 {
+		return errors.New("malformed LDAPMessage")
+	}
+	messageID, ok := msg.Children[0].Value.(int64)
+	if !ok {
+		return errors.New("malformed message ID")
+	}
+	op := msg.Children[1]
+	if op.ClassType != ber.ClassApplication {
+		return errors.New("malformed protocol operation")
+	}
+	var controls []requestControl
+	if len(msg.Children) > 2 {
+		var err error
+		controls, err = parseControls(msg.Children[2])
+		if err != nil {
+			return err
+		}
+	}
+
+	switch op.Tag {
+	case goldap.ApplicationUnbindRequest:
+		return errUnbind
+	case goldap.ApplicationAbandonRequest:
+		//all requests are answered before the next one is read, so there is
+		//never anything to abandon
+		return nil
+	}
+	responseTag, exists := responseTags[op.Tag]
+	if !exists {
+		return fmt.Errorf("unknown protocol operation %d", op.Tag)
+	}
+
+	//paging is the only control that we support, and only on searches
+	for _, control := range controls {
+		if control.Criticality && (control.Type != goldap.ControlTypePaging || op.Tag != goldap.ApplicationSearchRequest) {
+			return c.respond(messageID, newResult(responseTag, goldap.LDAPResultUnavailableCriticalExtension,
+				"critical control is not supported: "+control.Type))
+		}
+	}
+
+	isStartTLS := op.Tag == goldap.ApplicationExtendedRequest && len(op.Children) > 0 && op.Children[0].Data.String() == oidStartTLS
+	if c.server.tlsConfig != nil && !c.isTLS && !isStartTLS {
+		return c.respond(messageID, newResult(responseTag, goldap.LDAPResultConfidentialityRequired,
+			"TLS confidentiality required"))
+	}
+
+	switch op.Tag {
+	case goldap.ApplicationBindRequest:
+		return c.handleBind(messageID, op)
+	case goldap.ApplicationSearchRequest:
+		return c.handleSearch(messageID, op, controls)
+	case goldap.ApplicationCompareRequest:
+		return c.handleCompare(messageID, op)
+	case goldap.ApplicationExtendedRequest:
+		return c.handleExtended(messageID, op)
+	default:
+		return c.respond(messageID, newResult(responseTag, goldap.LDAPResultUnwillingToPerform,
+			"this directory is read-only; changes need to be made in Portunus"))
+	}
+}
+
+func parseControls(packet *ber.Packet) ([]requestControl, error) {
+	if packet.ClassType != ber.ClassContext || packet.Tag != 0 {
+		return nil, errors.New("malformed controls")
+	}
+	result := make([]requestControl, len(packet.Children))
+	for idx, child := range packet.Children {
+		if len(child.Children) == 0 || len(child.Children) > 3 {
+			return nil, errors.New("malformed control")
+		}
+		result[idx].Type = child.Children[0].Data.String()
+		for _, field := range child.Children[1:] {
+			switch value := field.Value.(type) {
+			case bool:
+				result[idx].Criticality = value
+			default:
+				result[idx].Value = field.Data.Bytes()
+			}
+		}
+	}
+	return result, nil
+}
+
+// Handles a BindRequest (see RFC 4511, section 4.2). Only simple binds are
+// supported.
+func (c *serverConn) handleBind(messageID int64, op *ber.Packet) error {
+	//a failed bind resets the connection to anonymous
+	c.boundDN = ""
+	c.boundDNForDisplay = ""
+
+	respond := func(code uint16, message string) error {
+		return c.respond(messageID, newResult(goldap.ApplicationBindResponse, code, message))
+	}
+	if len(op.Children) != 3 {
+		return respond(goldap.LDAPResultProtocolError, "malformed bind request")
+	}
+	if version, _ := op.Children[0].Value.(int64); version != 3 {
+		return respond(goldap.LDAPResultProtocolError, "only LDAPv3 is supported")
+	}
+	name := op.Children[1].Data.String()
+	auth := op.Children[2]
+	if auth.ClassType != ber.ClassContext || auth.Tag != 0 {
+		return respond(goldap.LDAPResultAuthMethodNotSupported, "only simple binds are supported")
+	}
+	password := auth.Data.String()
+
+	switch {
+	case name == "" && password == "":
+		return respond(goldap.LDAPResultSuccess, "")
+	case password == "":
+		return respond(goldap.LDAPResultUnwillingToPerform, "unauthenticated bind (DN with no password) disallowed")
+	}
+
+	dn, err := normalizeDN(name)
+	if err != nil {
+		return respond(goldap.LDAPResultInvalidDNSyntax, "invalid DN")
+	}
+	entry, exists := c.server.directory.Load().find(dn)
+	if !exists || entry.passwordHash == "" || !c.server.nexus.PasswordHasher().CheckPasswordHash(password, entry.passwordHash) {
+		return respond(goldap.LDAPResultInvalidCredentials, "")
+	}
+	c.boundDN = dn
+	c.boundDNForDisplay = entry.DN
+	return respond(goldap.LDAPResultSuccess, "")
+}
+
+// Handles a SearchRequest (see RFC 4511, section 4.5.1). The only supported
+// control is the paged results control from RFC 2696.
+func (c *serverConn) handleSearch(messageID int64, op *ber.Packet, controls []requestControl) error {
+	respond := func(code uint16, message string, controls ...*ber.Packet) error {
+		return c.respond(messageID, newResult(goldap.ApplicationSearchResultDone, code, message), controls...)
+	}
+	if len(op.Children) != 8 {
+		return respond(goldap.LDAPResultProtocolError, "malformed search request")
+	}
+	baseDN, err := normalizeDN(op.Children[0].Data.String())
+	if err != nil {
+		return respond(goldap.LDAPResultInvalidDNSyntax, "invalid DN")
+	}
+	scope, _ := op.Children[1].Value.(int64)
+	if _, exists := goldap.ScopeMap[int(scope)]; !exists {
+		return respond(goldap.LDAPResultProtocolError, "invalid scope")
+	}
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	typesOnly, _ := op.Children[5].Value.(bool)
+	filter := op.Children[6]
+	requestedAttrs := make([]string, len(op.Children[7].Children))
+	for idx, child := range op.Children[7].Children {
+		requestedAttrs[idx] = child.Data.String()
+	}
+	_, err = evaluateFilter(filter, nil)
+	if err != nil {
+		return respond(goldap.LDAPResultProtocolError, err.Error())
+	}
+
+	var paging *goldap.ControlPaging
+	for _, control := range controls {
+		if control.Type == goldap.ControlTypePaging {
+			paging, err = parsePagingControl(control.Value)
+			if err != nil {
+				return respond(goldap.LDAPResultProtocolError, err.Error())
+			}
+		}
+	}
+
+	//collect the matching entries
+	var entries []directoryEntry
+	if baseDN == "" {
+		//the root DSE is only visible with a base object search (like in slapd)
+		if scope != goldap.ScopeBaseObject {
+			return respond(goldap.LDAPResultNoSuchObject, "")
+		}
+		entries = []directoryEntry{c.rootDSE()}
+	} else {
+		var exists bool
+		entries, exists = c.server.directory.Load().entriesInScope(baseDN, int(scope), c.boundDN)
+		if !exists {
+			return respond(goldap.LDAPResultNoSuchObject, "")
+		}
+	}
+	entries = slices.DeleteFunc(entries, func(entry directoryEntry) bool {
+		result, _ := evaluateFilter(filter, entry.Attributes)
+		return result != filterTrue
+	})
+
+	//paging is stateless: the cookie is just the offset of the next page (if
+	//the directory changes between pages, entries may be skipped or repeated,
+	//but clients tolerate that just like with any other server)
+	var responseControls []*ber.Packet
+	if paging != nil {
+		offset := 0
+		if len(paging.Cookie) > 0 {
+			offset, err = strconv.Atoi(string(paging.Cookie))
+			if err != nil || offset < 0 || offset > len(entries) {
+				return respond(goldap.LDAPResultUnwillingToPerform, "invalid paged results cookie")
+			}
+		}
+		entries = entries[offset:]
+		nextPage := goldap.NewControlPaging(0)
+		if paging.PagingSize > 0 && len(entries) > int(paging.PagingSize) {
+			entries = entries[:paging.PagingSize]
+			nextPage.SetCookie([]byte(strconv.Itoa(offset + int(paging.PagingSize))))
+		}
+		if paging.PagingSize == 0 {
+			//a page size of 0 means that the client abandons the search
+			entries = nil
+		}
+		responseControls = append(responseControls, nextPage.Encode())
+	}
+
+	resultCode := uint16(goldap.LDAPResultSuccess)
+	if sizeLimit > 0 && len(entries) > int(sizeLimit) {
+		entries = entries[:sizeLimit]
+		resultCode = goldap.LDAPResultSizeLimitExceeded
+	}
+	for _, entry := range entries {
+		err := c.respond(messageID, encodeSearchResultEntry(entry, requestedAttrs, typesOnly))
+		if err != nil {
+			return err
+		}
+	}
+	return respond(resultCode, "", responseControls...)
+}
+
+func parsePagingControl(value []byte) (*goldap.ControlPaging, error) {
+	err := validateBER(value, 0)
+	if err != nil {
+		return nil, err
+	}
+	packet, err := ber.DecodePacketErr(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(packet.Children) != 2 {
+		return nil, errors.New("malformed paged results control")
+	}
+	size, ok := packet.Children[0].Value.(int64)
+	if !ok || size < 0 {
+		return nil, errors.New("malformed paged results control")
+	}
+	return &goldap.ControlPaging{
+		PagingSize: uint32(min(size, int64(maxRequestSize))),
+		Cookie:     packet.Children[1].Data.Bytes(),
+	}, nil
+}
+
+// The root DSE describes the server itself (see RFC 4512, section 5.1).
+func (c *serverConn) rootDSE() directoryEntry {
+	extensions := []string{oidWhoAmI}
+	if c.server.tlsConfig != nil {
+		extensions = append(extensions, oidStartTLS)
+	}
+	return directoryEntry{Object: Object{
+		DN: "",
+		Attributes: map[string][]string{
+			"objectClass":          {"top"},
+			"namingContexts":       c.server.allSuffixes(),
+			"supportedControl":     {goldap.ControlTypePaging},
+			"supportedExtension":   extensions,
+			"supportedLDAPVersion": {"3"},
+		},
+	}}
+}
+
+// Attributes that are only returned when requested explicitly, or with "+".
+var operationalAttributes = map[string]bool{
+	"namingcontexts":       true,
+	"supportedcontrol":     true,
+	"supportedextension":   true,
+	"supportedldapversion": true,
+}
+
+func encodeSearchResultEntry(entry directoryEntry, requestedAttrs []string, typesOnly bool) *ber.Packet {
+	//see RFC 4511, section 4.5.1.8 for what the special attribute names mean
+	withUserAttrs := len(requestedAttrs) == 0
+	withOperationalAttrs := false
+	isRequested := make(map[string]bool)
+	for _, name := range requestedAttrs {
+		switch name {
+		case "*":
+			withUserAttrs = true
+		case "+":
+			withOperationalAttrs = true
+		default:
+			name, _, _ = strings.Cut(name, ";")
+			isRequested[strings.ToLower(name)] = true
+		}
+	}
+
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "Object Name"))
+	attrsPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range slices.Sorted(maps.Keys(entry.Attributes)) {
+		key := strings.ToLower(name)
+		isIncluded := isRequested[key]
+		if operationalAttributes[key] {
+			isIncluded = isIncluded || withOperationalAttrs
+		} else {
+			isIncluded = isIncluded || withUserAttrs
+		}
+		if !isIncluded {
+			continue
+		}
+
+		attrPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attrPacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		valuesPacket := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		if !typesOnly {
+			for _, value := range entry.Attributes[name] {
+				valuesPacket.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+			}
+		}
+		attrPacket.AppendChild(valuesPacket)
+		attrsPacket.AppendChild(attrPacket)
+	}
+	packet.AppendChild(attrsPacket)
+	return packet
+}
+
+// Handles a CompareRequest (see RFC 4511, section 4.10).
+func (c *serverConn) handleCompare(messageID int64, op *ber.Packet) error {
+	respond := func(code uint16, message string) error {
+		return c.respond(messageID, newResult(goldap.ApplicationCompareResponse, code, message))
+	}
+	if len(op.Children) != 2 || len(op.Children[1].Children) != 2 {
+		return respond(goldap.LDAPResultProtocolError, "malformed compare request")
+	}
+	dn, err := normalizeDN(op.Children[0].Data.String())
+	if err != nil {
+		return respond(goldap.LDAPResultInvalidDNSyntax, "invalid DN")
+	}
+	attrName := op.Children[1].Children[0].Data.String()
+	assertion := op.Children[1].Children[1].Data.String()
+
+	d := c.server.directory.Load()
+	entry, exists := d.find(dn)
+	if !exists || !d.canRead(c.boundDN, entry) {
+		return respond(goldap.LDAPResultNoSuchObject, "")
+	}
+	values := lookupAttribute(entry.Attributes, attrName)
+	if len(values) == 0 {
+		return respond(goldap.LDAPResultNoSuchAttribute, "")
+	}
+	for _, value := range values {
+		if compareAttributeValues(attrName, value, assertion) == 0 {
+			return respond(goldap.LDAPResultCompareTrue, "")
+		}
+	}
+	return respond(goldap.LDAPResultCompareFalse, "")
+}
+
+// Handles an ExtendedRequest (see RFC 4511, section 4.12).
+func (c *serverConn) handleExtended(messageID int64, op *ber.Packet) error {
+	respond := func(code uint16, message string, extraFields ...*ber.Packet) error {
+		result := newResult(goldap.ApplicationExtendedResponse, code, message)
+		for _, field := range extraFields {
+			result.AppendChild(field)
+		}
+		return c.respond(messageID, result)
+	}
+	if len(op.Children) == 0 {
+		return respond(goldap.LDAPResultProtocolError, "malformed extended request")
+	}
+	responseName := func(oid string) *ber.Packet {
+		return ber.NewString(ber.ClassContext, ber.TypePrimitive, 10, oid, "Response Name")
+	}
+
+	switch oid := op.Children[0].Data.String(); oid {
+	case oidWhoAmI:
+		authzID := ""
+		if c.boundDN != "" {
+			authzID = "dn:" + c.boundDNForDisplay
+		}
+		return respond(goldap.LDAPResultSuccess, "", ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, authzID, "Response Value"))
+
+	case oidStartTLS:
+		switch {
+		case c.server.tlsConfig == nil:
+			return respond(goldap.LDAPResultProtocolError, "TLS is not configured", responseName(oid))
+		case c.isTLS:
+			return respond(goldap.LDAPResultOperationsError, "TLS already started", responseName(oid))
+		case c.reader.Buffered() > 0:
+			//the client must wait for our response before starting the handshake
+			return respond(goldap.LDAPResultProtocolError, "unexpected data after StartTLS", responseName(oid))
+		}
+		err := respond(goldap.LDAPResultSuccess, "", responseName(oid))
+		if err != nil {
+			return err
+		}
+		tlsConn := tls.Server(c.conn, c.server.tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		c.conn = tlsConn
+		c.reader = bufio.NewReader(tlsConn)
+		c.isTLS = true
+		return nil
+
+	case oidPasswordModify:
+		return respond(goldap.LDAPResultUnwillingToPerform, "this directory is read-only; passwords need to be changed in Portunus")
+
+	default:
+		return respond(goldap.LDAPResultProtocolError, "unsupported extended operation: "+oid)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// encoding and decoding
+
+func newResult(tag ber.Tag, code uint16, message string) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, goldap.ApplicationMap[uint8(tag)])
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	return packet
+}
+
+func (c *serverConn) respond(messageID int64, op *ber.Packet, controls ...*ber.Packet) error {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	msg.AppendChild(op)
+	if len(controls) > 0 {
+		controlsPacket := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			controlsPacket.AppendChild(control)
+		}
+		msg.AppendChild(controlsPacket)
+	}
+	_, err := c.conn.Write(msg.Bytes())
+	return err
+}
+
+// Reads one LDAPMessage from the client. Unlike ber.ReadPacket(), this
+// checks all length fields against the actual message size before decoding,
+// so that clients cannot make us allocate huge buffers by sending bogus
+// lengths.
+func readRequest(r *bufio.Reader) (*ber.Packet, error) {
+	header, err := r.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := 2
+	if header[1]&0x80 != 0 {
+		headerSize += int(header[1] & 0x7F)
+	}
+	header, err = r.Peek(headerSize)
+	if err != nil {
+		return nil, err
+	}
+	_, headerSize, contentSize, err := parseBERHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if headerSize+contentSize > maxRequestSize {
+		return nil, fmt.Errorf("request is larger than %d bytes", maxRequestSize)
+	}
+
+	buf := make([]byte, headerSize+contentSize)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	err = validateBER(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return ber.DecodePacketErr(buf)
+}
+
+// Checks that the given buffer contains a sequence of BER elements whose
+// length fields are consistent with the buffer size.
+func validateBER(buf []byte, depth int) error {
+	if depth > maxRequestDepth {
+		return errors.New("request is nested too deeply")
+	}
+	for len(buf) > 0 {
+		isConstructed, headerSize, contentSize, err := parseBERHeader(buf)
+		if err != nil {
+			return err
+		}
+		if contentSize > len(buf)-headerSize {
+			return errors.New("length of BER element exceeds its container")
+		}
+		if isConstructed {
+			err := validateBER(buf[headerSize:headerSize+contentSize], depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		buf = buf[headerSize+contentSize:]
+	}
+	return nil
+}
+
+// Parses the identifier and length octets of a BER element. LDAP only uses a
+// subset of BER (see RFC 4511, section 5.1): Tag numbers are small, and
+// lengths are always definite.
+func parseBERHeader(buf []byte) (isConstructed bool, headerSize, contentSize int, err error) {
+	if len(buf) < 2 {
+		return false, 0, 0, io.ErrUnexpectedEOF
+	}
+	if buf[0]&0x1F == 0x1F {
+		return false, 0, 0, errors.New("unsupported BER tag number")
+	}
+	isConstructed = buf[0]&0x20 != 0
+	if buf[1]&0x80 == 0 {
+		return isConstructed, 2, int(buf[1]), nil
+	}
+	lengthSize := int(buf[1] & 0x7F)
+	if lengthSize == 0 || lengthSize > 4 {
+		return false, 0, 0, errors.New("unsupported BER length encoding")
+	}
+	if len(buf) < 2+lengthSize {
+		return false, 0, 0, io.ErrUnexpectedEOF
+	}
+	for _, b := range buf[2 : 2+lengthSize] {
+		contentSize = contentSize<<8 | int(b)
+	}
+	return isConstructed, 2 + lengthSize, contentSize, nil
+}
@@ -0,0 +1,235 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func setupServerTest(t *testing.T) (connect func() *goldap.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	test.ExpectNoError(t, err)
+	runServerForTest(t, listener)
+
+	return func() *goldap.Conn {
+		t.Helper()
+		conn, err := goldap.DialURL("ldap://" + listener.Addr().String())
+		test.ExpectNoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+}
+
+// Runs an LDAP server with a few test users on the given listener until the
+// test ends.
+func runServerForTest(t *testing.T, listener net.Listener) {
+	vcfg := core.GetValidationConfigForTests()
+	nexus := core.NewNexus(nil, vcfg, &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{
+			{LoginName: "alice", GivenName: "Alice", FamilyName: "Administrator", PasswordHash: "{PLAINTEXT}alice-pw"},
+			{LoginName: "bob", GivenName: "Bob", FamilyName: "Builder", PasswordHash: "{PLAINTEXT}bob-pw"},
+			{LoginName: "carol", GivenName: "Carol", FamilyName: "Auditor", PasswordHash: "{PLAINTEXT}carol-pw"},
+		}
+		db.Groups = []core.Group{
+			{
+				Name:             "admins",
+				LongName:         "Administrators",
+				MemberLoginNames: core.GroupMemberNames{"alice": true},
+				Permissions:      core.Permissions{LDAP: core.LDAPPermissions{CanRead: true}},
+			},
+			{
+				Name:             "auditors",
+				LongName:         "Auditors",
+				MemberLoginNames: core.GroupMemberNames{"carol": true},
+				Permissions: core.Permissions{LDAP: core.LDAPPermissions{
+					CanReadUsers:   true,
+					ReadGroupNames: core.GroupMemberNames{"builders": true},
+				}},
+			},
+			{
+				Name:             "builders",
+				LongName:         "Builders",
+				MemberLoginNames: core.GroupMemberNames{"bob": true},
+				PosixGID:         p2gid(1001),
+			},
+		}
+		db.ServiceAccounts = []core.ServiceAccount{{
+			Name:         "nextcloud",
+			PasswordHash: "{PLAINTEXT}nextcloud-pw",
+			ReadScopes:   core.ServiceAccountScopes{Users: true},
+		}}
+		return nil
+	}, nil)
+	test.ExpectNoErrors(t, errs)
+
+	server, err := NewServer(nexus, ServerOptions{DNSuffix: "dc=example,dc=org"})
+	test.ExpectNoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, server.Run(ctx, listener))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+func p2gid(val core.PosixID) *core.PosixID {
+	return &val
+}
+
+// Returns the DNs of all objects below the suffix that match the filter.
+func searchDNs(t *testing.T, conn *goldap.Conn, filter string) []string {
+	t.Helper()
+	result, err := conn.Search(goldap.NewSearchRequest(
+		"dc=example,dc=org", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{"1.1"}, nil,
+	))
+	test.ExpectNoError(t, err)
+	dnames := make([]string, len(result.Entries))
+	for idx, entry := range result.Entries {
+		dnames[idx] = entry.DN
+	}
+	return dnames
+}
+
+func TestServerAccessControl(t *testing.T) {
+	connect := setupServerTest(t)
+
+	//anonymous clients can read the root DSE, but nothing else
+	conn := connect()
+	result, err := conn.Search(goldap.NewSearchRequest(
+		"", goldap.ScopeBaseObject, goldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"namingContexts", "supportedLDAPVersion"}, nil,
+	))
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "naming contexts", result.Entries[0].GetAttributeValues("namingContexts"), []string{"dc=example,dc=org", "dc=example,dc=net"})
+	assert.DeepEqual(t, "LDAP versions", result.Entries[0].GetAttributeValues("supportedLDAPVersion"), []string{"3"})
+	assert.DeepEqual(t, "anonymous search", searchDNs(t, conn, "(objectClass=*)"), []string{})
+
+	//binds check the password
+	err = conn.Bind("uid=bob,ou=users,dc=example,dc=org", "wrong")
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		t.Errorf("expected bind with wrong password to fail with invalidCredentials, but got: %v", err)
+	}
+	err = conn.UnauthenticatedBind("uid=bob,ou=users,dc=example,dc=org")
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultUnwillingToPerform) {
+		t.Errorf("expected unauthenticated bind to be refused, but got: %v", err)
+	}
+
+	//users without any LDAP permissions can only see themselves
+	test.ExpectNoError(t, conn.Bind("uid=bob,ou=users,dc=example,dc=org", "bob-pw"))
+	assert.DeepEqual(t, "search as bob", searchDNs(t, conn, "(objectClass=*)"),
+		[]string{"uid=bob,ou=users,dc=example,dc=org"})
+
+	//viewers can see everything except for service accounts
+	test.ExpectNoError(t, conn.Bind("uid=alice,ou=users,dc=example,dc=org", "alice-pw"))
+	assert.DeepEqual(t, "search for groups as alice", searchDNs(t, conn, "(objectClass=groupOfNames)"), []string{
+		"cn=portunus-readers-group-builders,dc=example,dc=org",
+		"cn=portunus-readers-users,dc=example,dc=org",
+		"cn=portunus-viewers,dc=example,dc=org",
+		"cn=admins,ou=groups,dc=example,dc=org",
+		"cn=auditors,ou=groups,dc=example,dc=org",
+		"cn=builders,ou=groups,dc=example,dc=org",
+	})
+	assert.DeepEqual(t, "search for service accounts as alice", searchDNs(t, conn, "(cn=nextcloud)"), []string{})
+
+	//partial read permissions work on the respective OUs and groups
+	test.ExpectNoError(t, conn.Bind("uid=carol,ou=users,dc=example,dc=org", "carol-pw"))
+	assert.DeepEqual(t, "search as carol", searchDNs(t, conn, "(objectClass=*)"), []string{
+		"ou=users,dc=example,dc=org",
+		"cn=builders,ou=groups,dc=example,dc=org",
+		"cn=builders,ou=posix-groups,dc=example,dc=org",
+		"uid=alice,ou=users,dc=example,dc=org",
+		"uid=bob,ou=users,dc=example,dc=org",
+		"uid=carol,ou=users,dc=example,dc=org",
+	})
+
+	//service accounts can see themselves and their read scopes
+	test.ExpectNoError(t, conn.Bind("cn=nextcloud,ou=service-accounts,dc=example,dc=org", "nextcloud-pw"))
+	assert.DeepEqual(t, "search as nextcloud", searchDNs(t, conn, "(|(objectClass=person)(objectClass=organizationalRole))"), []string{
+		"cn=nextcloud,ou=service-accounts,dc=example,dc=org",
+		"uid=alice,ou=users,dc=example,dc=org",
+		"uid=bob,ou=users,dc=example,dc=org",
+		"uid=carol,ou=users,dc=example,dc=org",
+	})
+	whoami, err := conn.WhoAmI(nil)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "WhoAmI", whoami.AuthzID, "dn:cn=nextcloud,ou=service-accounts,dc=example,dc=org")
+}
+
+func TestServerSearch(t *testing.T) {
+	connect := setupServerTest(t)
+	conn := connect()
+	test.ExpectNoError(t, conn.Bind("uid=alice,ou=users,dc=example,dc=org", "alice-pw"))
+
+	//filters work like in slapd
+	assert.DeepEqual(t, "search with AND and DN-valued attribute",
+		searchDNs(t, conn, "(&(objectClass=inetOrgPerson)(isMemberOf=CN=Builders,OU=Groups,DC=example,DC=org))"),
+		[]string{"uid=bob,ou=users,dc=example,dc=org"})
+	assert.DeepEqual(t, "search with substrings and NOT",
+		searchDNs(t, conn, "(&(uid=*o*)(!(sn=build*)))"),
+		[]string{"uid=carol,ou=users,dc=example,dc=org"})
+	assert.DeepEqual(t, "search with numeric comparison",
+		searchDNs(t, conn, "(&(objectClass=posixGroup)(gidNumber>=1000)(memberUid=bob))"),
+		[]string{"cn=builders,ou=posix-groups,dc=example,dc=org"})
+
+	//password hashes are never returned, not even to viewers or to the user itself
+	result, err := conn.Search(goldap.NewSearchRequest(
+		"uid=alice,ou=users,dc=example,dc=org", goldap.ScopeBaseObject, goldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"uid", "userPassword"}, nil,
+	))
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "attributes of alice", len(result.Entries[0].Attributes), 1)
+	assert.DeepEqual(t, "uid of alice", result.Entries[0].GetAttributeValue("uid"), "alice")
+	assert.DeepEqual(t, "search on userPassword", searchDNs(t, conn, "(userPassword=*)"), []string{})
+
+	//searches below nonexistent objects fail
+	_, err = conn.Search(goldap.NewSearchRequest(
+		"ou=unknown,dc=example,dc=org", goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", nil, nil,
+	))
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultNoSuchObject) {
+		t.Errorf("expected search below nonexistent object to fail with noSuchObject, but got: %v", err)
+	}
+
+	//paged searches return the same result as unpaged searches
+	pagedResult, err := conn.SearchWithPaging(goldap.NewSearchRequest(
+		"ou=users,dc=example,dc=org", goldap.ScopeSingleLevel, goldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"1.1"}, nil,
+	), 2)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of entries in paged search", len(pagedResult.Entries), 3)
+
+	//so do compare operations
+	isMember, err := conn.Compare("cn=builders,ou=groups,dc=example,dc=org", "member", "uid=bob,ou=users,dc=example,dc=org")
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "compare result", isMember, true)
+
+	//writes are refused
+	err = conn.Modify(&goldap.ModifyRequest{
+		DN:      "uid=bob,ou=users,dc=example,dc=org",
+		Changes: []goldap.Change{{Operation: goldap.ReplaceAttribute, Modification: goldap.PartialAttribute{Type: "sn", Vals: []string{"Ross"}}}},
+	})
+	if !goldap.IsErrorWithCode(err, goldap.LDAPResultUnwillingToPerform) {
+		t.Errorf("expected modify to fail with unwillingToPerform, but got: %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// The in-memory LDAP directory that a Server serves from. It is rebuilt from
+// scratch whenever the Portunus database changes, and never modified
+// afterwards, so it can be read without locking.
+type directory struct {
+	//sorted such that parents come before their children
+	entries []directoryEntry
+	//key = normalized DN, value = index into `entries`
+	byDN map[string]int
+	//key = normalized DN of a group, value = set of normalized member DNs
+	members map[string]map[string]bool
+	//normalized suffix of the primary domain
+	primarySuffix string
+}
+
+type directoryEntry struct {
+	//does not contain userPassword (see below)
+	Object
+	normalizedDN string
+	depth        int //number of RDNs
+	scope        readScope
+	//the userPassword attribute is split off since it is only used for
+	//checking binds; it is never returned in search results
+	passwordHash string
+}
+
+// Which rule of the access control applies to an entry, besides the rules
+// that apply everywhere. This mirrors the slapd ACL that is rendered by
+// portunus-orchestrator.
+type readScope struct {
+	Kind readScopeKind
+	//only for readScopeGroup
+	GroupName string
+}
+
+type readScopeKind int
+
+const (
+	//readable by cn=portunus-viewers and by the object itself
+	readScopeDefault readScopeKind = iota
+	//only readable by the object itself
+	readScopeServiceAccounts
+	//additionally readable by cn=portunus-readers-users
+	readScopeUsers
+	//additionally readable by cn=portunus-readers-groups
+	readScopeGroupsOU
+	//additionally readable by cn=portunus-readers-groups and by
+	//cn=portunus-readers-group-$NAME
+	readScopeGroup
+)
+
+func buildDirectory(objects []Object, primarySuffix string, suffixes []string, layout Layout) (*directory, error) {
+	d := &directory{
+		entries: make([]directoryEntry, 0, len(objects)),
+		byDN:    make(map[string]int, len(objects)),
+		members: make(map[string]map[string]bool),
+	}
+	var err error
+	d.primarySuffix, err = normalizeDN(primarySuffix)
+	if err != nil {
+		return nil, err
+	}
+	normalizedSuffixes := make([]string, len(suffixes))
+	for idx, suffix := range suffixes {
+		normalizedSuffixes[idx], err = normalizeDN(suffix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, obj := range objects {
+		rdns, err := normalizeRDNs(obj.DN)
+		if err != nil {
+			return nil, err
+		}
+		entry := directoryEntry{
+			Object:       Object{DN: obj.DN, Attributes: make(map[string][]string, len(obj.Attributes))},
+			normalizedDN: strings.Join(rdns, ","),
+			depth:        len(rdns),
+		}
+		for key, values := range obj.Attributes {
+			if key == "userPassword" {
+				entry.passwordHash = firstValueOf(values)
+			} else {
+				entry.Attributes[key] = values
+			}
+		}
+		entry.scope = d.scopeOf(entry, normalizedSuffixes, layout)
+
+		if memberDNs := entry.Attributes["member"]; len(memberDNs) > 0 {
+			isMember := make(map[string]bool, len(memberDNs))
+			for _, memberDN := range memberDNs {
+				normalized, err := normalizeDN(memberDN)
+				if err != nil {
+					return nil, err
+				}
+				isMember[normalized] = true
+			}
+			d.members[entry.normalizedDN] = isMember
+		}
+		d.entries = append(d.entries, entry)
+	}
+
+	slices.SortFunc(d.entries, func(lhs, rhs directoryEntry) int {
+		return cmp.Or(cmp.Compare(lhs.depth, rhs.depth), strings.Compare(lhs.normalizedDN, rhs.normalizedDN))
+	})
+	for idx, entry := range d.entries {
+		if _, exists := d.byDN[entry.normalizedDN]; exists {
+			return nil, fmt.Errorf("duplicate DN: %q", entry.DN)
+		}
+		d.byDN[entry.normalizedDN] = idx
+	}
+	return d, nil
+}
+
+func (d *directory) scopeOf(entry directoryEntry, normalizedSuffixes []string, layout Layout) readScope {
+	isBelow := func(dn string) bool {
+		return entry.normalizedDN == dn || strings.HasSuffix(entry.normalizedDN, ","+dn)
+	}
+
+	//service accounts only exist below the primary suffix
+	if isBelow("ou=" + strings.ToLower(layout.ServiceAccountsOU) + "," + d.primarySuffix) {
+		return readScope{Kind: readScopeServiceAccounts}
+	}
+	for _, suffix := range normalizedSuffixes {
+		if isBelow("ou=" + strings.ToLower(layout.UsersOU) + "," + suffix) {
+			return readScope{Kind: readScopeUsers}
+		}
+		for _, ouName := range []string{layout.GroupsOU, layout.PosixGroupsOU} {
+			ouDN := "ou=" + strings.ToLower(ouName) + "," + suffix
+			if entry.normalizedDN == ouDN {
+				return readScope{Kind: readScopeGroupsOU}
+			}
+			//like the dn.regex in the slapd ACL, this only matches direct children
+			rdn, parentDN, _ := strings.Cut(entry.normalizedDN, ",")
+			if parentDN == ouDN && strings.HasPrefix(rdn, "cn=") {
+				return readScope{Kind: readScopeGroup, GroupName: firstValueOf(entry.Attributes["cn"])}
+			}
+		}
+	}
+	return readScope{Kind: readScopeDefault}
+}
+
+// Whether the given group has the given member. Both DNs must be normalized.
+func (d *directory) isMember(groupDN, memberDN string) bool {
+	return d.members[groupDN][memberDN]
+}
+
+// Whether the object with the given normalized DN (or an anonymous client, if
+// empty) may see the given entry.
+func (d *directory) canRead(boundDN string, entry directoryEntry) bool {
+	switch {
+	case boundDN == "":
+		return false
+	case boundDN == entry.normalizedDN:
+		return true
+	case entry.scope.Kind == readScopeServiceAccounts:
+		return false
+	case d.isMember("cn=portunus-viewers,"+d.primarySuffix, boundDN):
+		return true
+	}
+
+	switch entry.scope.Kind {
+	case readScopeUsers:
+		return d.isMember("cn=portunus-readers-users,"+d.primarySuffix, boundDN)
+	case readScopeGroupsOU:
+		return d.isMember("cn=portunus-readers-groups,"+d.primarySuffix, boundDN)
+	case readScopeGroup:
+		groupReadersDN := fmt.Sprintf("cn=portunus-readers-group-%s,%s", strings.ToLower(entry.scope.GroupName), d.primarySuffix)
+		return d.isMember("cn=portunus-readers-groups,"+d.primarySuffix, boundDN) ||
+			d.isMember(groupReadersDN, boundDN)
+	default:
+		return false
+	}
+}
+
+// Finds the entry with the given normalized DN.
+func (d *directory) find(dn string) (directoryEntry, bool) {
+	idx, exists := d.byDN[dn]
+	if !exists {
+		return directoryEntry{}, false
+	}
+	return d.entries[idx], true
+}
+
+// Returns all entries in the given scope that the bound client may see. The
+// base DN must be normalized. The second return value is false if the base
+// object does not exist.
+func (d *directory) entriesInScope(baseDN string, scope int, boundDN string) ([]directoryEntry, bool) {
+	base, exists := d.find(baseDN)
+	if !exists {
+		return nil, false
+	}
+
+	var result []directoryEntry
+	for _, entry := range d.entries {
+		isChild := strings.HasSuffix(entry.normalizedDN, ","+baseDN)
+		var inScope bool
+		switch scope {
+		case goldap.ScopeBaseObject:
+			inScope = entry.normalizedDN == baseDN
+		case goldap.ScopeSingleLevel:
+			inScope = isChild && entry.depth == base.depth+1
+		case goldap.ScopeWholeSubtree:
+			inScope = isChild || entry.normalizedDN == baseDN
+		case goldap.ScopeChildren:
+			inScope = isChild
+		}
+		if inScope && d.canRead(boundDN, entry) {
+			result = append(result, entry)
+		}
+	}
+	return result, true
+}
+
+// Brings a DN into a canonical form for comparison. Attribute names and
+// values are compared case-insensitively, which matches the matching rules
+// for all attributes that appear in the RDNs of our objects.
+func normalizeDN(dn string) (string, error) {
+	rdns, err := normalizeRDNs(dn)
+	return strings.Join(rdns, ","), err
+}
+
+func normalizeRDNs(dn string) ([]string, error) {
+	parsed, err := goldap.ParseDN(dn)
+	if err != nil {
+		return nil, err
+	}
+	rdns := make([]string, len(parsed.RDNs))
+	for idx, rdn := range parsed.RDNs {
+		parts := make([]string, len(rdn.Attributes))
+		for idx2, attr := range rdn.Attributes {
+			parts[idx2] = strings.ToLower(attr.Type) + "=" + dnValueEscaper.Replace(strings.ToLower(attr.Value))
+		}
+		//the order of attributes in a multi-valued RDN is not significant
+		slices.Sort(parts)
+		rdns[idx] = strings.Join(parts, "+")
+	}
+	return rdns, nil
+}
+
+var dnValueEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `+`, `\+`, `=`, `\=`)
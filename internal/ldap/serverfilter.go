@@ -0,0 +1,240 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// The result of evaluating a search filter. LDAP uses three-valued logic
+// (see RFC 4511, section 4.5.1.7).
+type filterResult int
+
+const (
+	filterFalse filterResult = iota
+	filterTrue
+	filterUndefined
+)
+
+// Attributes that contain DNs, and thus need to be compared with
+// normalizeDN() instead of as plain strings.
+var dnValuedAttributes = map[string]bool{
+	"ismemberof": true,
+	"member":     true,
+	"owner":      true,
+}
+
+// Attributes with case-sensitive matching rules (compare the custom schema in
+// portunus-orchestrator). All other attributes are compared
+// case-insensitively.
+var caseExactAttributes = map[string]bool{
+	"portunuslabel": true,
+}
+
+// Evaluates a search filter in its BER encoding against the given attributes.
+// All parts of the filter are evaluated (even if the result is already known),
+// so evaluating the filter against an empty attribute set can be used to
+// check whether the filter is well-formed.
+func evaluateFilter(f *ber.Packet, attrs map[string][]string) (filterResult, error) {
+	if f.ClassType != ber.ClassContext {
+		return filterUndefined, errors.New("malformed filter")
+	}
+
+	switch f.Tag {
+	case goldap.FilterAnd:
+		result := filterTrue
+		for _, child := range f.Children {
+			childResult, err := evaluateFilter(child, attrs)
+			if err != nil {
+				return filterUndefined, err
+			}
+			if childResult == filterFalse || (childResult == filterUndefined && result == filterTrue) {
+				result = childResult
+			}
+		}
+		return result, nil
+
+	case goldap.FilterOr:
+		result := filterFalse
+		for _, child := range f.Children {
+			childResult, err := evaluateFilter(child, attrs)
+			if err != nil {
+				return filterUndefined, err
+			}
+			if childResult == filterTrue || (childResult == filterUndefined && result == filterFalse) {
+				result = childResult
+			}
+		}
+		return result, nil
+
+	case goldap.FilterNot:
+		if len(f.Children) != 1 {
+			return filterUndefined, errors.New("malformed NOT filter")
+		}
+		childResult, err := evaluateFilter(f.Children[0], attrs)
+		switch childResult {
+		case filterTrue:
+			return filterFalse, err
+		case filterFalse:
+			return filterTrue, err
+		default:
+			return filterUndefined, err
+		}
+
+	case goldap.FilterPresent:
+		attrName := f.Data.String()
+		if strings.EqualFold(attrName, "objectClass") {
+			//shortcut for the most common filter "(objectClass=*)"
+			return filterTrue, nil
+		}
+		return boolToFilterResult(len(lookupAttribute(attrs, attrName)) > 0), nil
+
+	case goldap.FilterEqualityMatch, goldap.FilterApproxMatch, goldap.FilterGreaterOrEqual, goldap.FilterLessOrEqual:
+		if len(f.Children) != 2 {
+			return filterUndefined, fmt.Errorf("malformed %s filter", goldap.FilterMap[uint64(f.Tag)])
+		}
+		attrName := f.Children[0].Data.String()
+		assertion := f.Children[1].Data.String()
+		for _, value := range lookupAttribute(attrs, attrName) {
+			var matches bool
+			switch f.Tag {
+			case goldap.FilterGreaterOrEqual:
+				matches = compareAttributeValues(attrName, value, assertion) >= 0
+			case goldap.FilterLessOrEqual:
+				matches = compareAttributeValues(attrName, value, assertion) <= 0
+			default:
+				//we do not implement any sort of approximate matching
+				matches = compareAttributeValues(attrName, value, assertion) == 0
+			}
+			if matches {
+				return filterTrue, nil
+			}
+		}
+		return filterFalse, nil
+
+	case goldap.FilterSubstrings:
+		if len(f.Children) != 2 {
+			return filterUndefined, errors.New("malformed Substrings filter")
+		}
+		attrName := f.Children[0].Data.String()
+		for _, value := range lookupAttribute(attrs, attrName) {
+			matches, err := matchSubstrings(attrName, value, f.Children[1].Children)
+			if err != nil {
+				return filterUndefined, err
+			}
+			if matches {
+				return filterTrue, nil
+			}
+		}
+		//when there is no value to match against, check the substrings anyway
+		//to report malformed filters
+		_, err := matchSubstrings(attrName, "", f.Children[1].Children)
+		return filterFalse, err
+
+	case goldap.FilterExtensibleMatch:
+		//we do not know any matching rules
+		return filterUndefined, nil
+
+	default:
+		return filterUndefined, fmt.Errorf("unknown filter type %d", f.Tag)
+	}
+}
+
+func boolToFilterResult(value bool) filterResult {
+	if value {
+		return filterTrue
+	}
+	return filterFalse
+}
+
+// Finds the values of the given attribute. Attribute names are
+// case-insensitive, and attribute options (e.g. "cn;lang-de") are ignored.
+func lookupAttribute(attrs map[string][]string, attrName string) []string {
+	attrName, _, _ = strings.Cut(attrName, ";")
+	for key, values := range attrs {
+		if strings.EqualFold(key, attrName) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Compares two values of the given attribute in the way that a matching rule
+// for this attribute would. Numbers are compared numerically.
+func compareAttributeValues(attrName, lhs, rhs string) int {
+	attrName = strings.ToLower(attrName)
+	if dnValuedAttributes[attrName] {
+		lhsNormalized, err1 := normalizeDN(lhs)
+		rhsNormalized, err2 := normalizeDN(rhs)
+		if err1 == nil && err2 == nil {
+			return strings.Compare(lhsNormalized, rhsNormalized)
+		}
+	}
+
+	lhsNumber, err1 := strconv.ParseInt(lhs, 10, 64)
+	rhsNumber, err2 := strconv.ParseInt(rhs, 10, 64)
+	if err1 == nil && err2 == nil {
+		return cmp.Compare(lhsNumber, rhsNumber)
+	}
+
+	if !caseExactAttributes[attrName] {
+		lhs = strings.ToLower(lhs)
+		rhs = strings.ToLower(rhs)
+	}
+	return strings.Compare(lhs, rhs)
+}
+
+func matchSubstrings(attrName, value string, substrings []*ber.Packet) (bool, error) {
+	if !caseExactAttributes[strings.ToLower(attrName)] {
+		value = strings.ToLower(value)
+	}
+
+	matches := true
+	for idx, substring := range substrings {
+		if substring.ClassType != ber.ClassContext {
+			return false, errors.New("malformed Substrings filter")
+		}
+		part := substring.Data.String()
+		if !caseExactAttributes[strings.ToLower(attrName)] {
+			part = strings.ToLower(part)
+		}
+
+		switch substring.Tag {
+		case goldap.FilterSubstringsInitial:
+			if idx != 0 {
+				return false, errors.New("malformed Substrings filter: initial substring must come first")
+			}
+			if strings.HasPrefix(value, part) {
+				value = value[len(part):]
+			} else {
+				matches = false
+			}
+		case goldap.FilterSubstringsAny:
+			pos := strings.Index(value, part)
+			if pos >= 0 {
+				value = value[pos+len(part):]
+			} else {
+				matches = false
+			}
+		case goldap.FilterSubstringsFinal:
+			if idx != len(substrings)-1 {
+				return false, errors.New("malformed Substrings filter: final substring must come last")
+			}
+			matches = matches && strings.HasSuffix(value, part)
+		default:
+			return false, errors.New("malformed Substrings filter")
+		}
+	}
+	return matches, nil
+}
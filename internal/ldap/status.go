@@ -0,0 +1,150 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldap
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// MDBMaxSize is the maximum size of the mdb database that portunus-orchestrator
+// configures for slapd, in bytes.
+const MDBMaxSize = 1 << 30
+
+// AdapterStatus describes how well an Adapter is keeping the LDAP directory in
+// sync with the Portunus database. It is returned by Adapter.Status().
+type AdapterStatus struct {
+	//Counters for all write operations since the Adapter was started, including
+	//those for the changelog.
+	SuccessfulOperations uint64
+	FailedOperations     uint64
+	//How many of those write operations were attempted again for objects whose
+	//previous write had failed (regardless of whether they succeeded this time).
+	RetriedOperations uint64
+	//When the Adapter last processed a database update (or a retry).
+	LastSyncAt time.Time
+	//The objects whose most recent write failed, sorted by DN. The directory
+	//does not reflect the current state of the Portunus database for these.
+	Failures []OperationFailure
+	//When the failed operations will be retried next, or zero if no retry is
+	//scheduled (either because there are no failures or because retries are
+	//disabled). Failed operations are always retried on the next database update.
+	NextRetryAt time.Time
+	//How many of the objects rendered from the Portunus database exist in the
+	//directory, and their total size in bytes (see Object.size()). The static
+	//structure of the directory and the changelog are not included.
+	ObjectCount     int
+	TotalObjectSize uint64
+}
+
+// OperationFailure appears in type AdapterStatus. It is also persisted in
+// the file at AdapterOptions.RetryQueuePath.
+type OperationFailure struct {
+	DN         string `json:"dn"`
+	ChangeType string `json:"change_type"` //"add", "modify" or "delete"
+	Error      string `json:"error"`
+	//How often this object has failed to be written in a row.
+	Attempts       uint64    `json:"attempts"`
+	FirstFailureAt time.Time `json:"first_failure_at"`
+	LastFailureAt  time.Time `json:"last_failure_at"`
+}
+
+// Tracks the AdapterStatus while the Adapter is running.
+type statusTracker struct {
+	mutex       sync.Mutex
+	status      AdapterStatus
+	failures    map[string]OperationFailure //key = DN
+	newFailures map[string]OperationFailure //while a sync is in progress
+}
+
+// Called before the first sync with the failures persisted by a previous run
+// of the Adapter, so that their attempt counters carry over.
+func (t *statusTracker) restore(failures []OperationFailure) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.failures = make(map[string]OperationFailure, len(failures))
+	for _, f := range failures {
+		t.failures[f.DN] = f
+	}
+}
+
+// Called when a sync starts.
+func (t *statusTracker) beginSync() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.newFailures = make(map[string]OperationFailure)
+}
+
+// Called for each write operation during a sync. If `countAsFailure` is false,
+// the error is only logged and counted, but the object is not listed in
+// AdapterStatus.Failures (this is used for changelog entries).
+func (t *statusTracker) recordResult(op operation, err error, countAsFailure bool, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, isRetry := t.failures[op.DN()]; isRetry && countAsFailure {
+		t.status.RetriedOperations++
+	}
+	if err == nil {
+		t.status.SuccessfulOperations++
+		return
+	}
+
+	t.status.FailedOperations++
+	logg.Error("could not %s LDAP object %s: %s", op.ChangeType(), op.DN(), err.Error())
+	if !countAsFailure {
+		return
+	}
+	f, exists := t.failures[op.DN()]
+	if !exists {
+		f = OperationFailure{DN: op.DN(), FirstFailureAt: now}
+	}
+	f.ChangeType = op.ChangeType()
+	f.Error = err.Error()
+	f.Attempts++
+	f.LastFailureAt = now
+	t.newFailures[op.DN()] = f
+}
+
+// Called when a sync is complete. Objects that did not fail during this sync
+// are no longer considered failing. Returns how many objects are failing.
+func (t *statusTracker) endSync(now, nextRetryAt time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.failures = t.newFailures
+	t.newFailures = nil
+	t.status.LastSyncAt = now
+	t.status.NextRetryAt = nextRetryAt
+	return len(t.failures)
+}
+
+// Called after each sync with the objects that now exist in the directory.
+func (t *statusTracker) recordObjects(objects []Object) {
+	var totalSize uint64
+	for _, obj := range objects {
+		totalSize += obj.size()
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.status.ObjectCount = len(objects)
+	t.status.TotalObjectSize = totalSize
+}
+
+// Returns a copy of the current status.
+func (t *statusTracker) get() AdapterStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := t.status
+	result.Failures = nil
+	for _, dn := range slices.Sorted(maps.Keys(t.failures)) {
+		result.Failures = append(result.Failures, t.failures[dn])
+	}
+	return result
+}
@@ -0,0 +1,207 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldif
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+)
+
+// Import converts LDAP entries into Portunus users and groups. Users are
+// recognized by the object classes inetOrgPerson, person or user (for Active
+// Directory), groups by the object classes groupOfNames, groupOfUniqueNames,
+// group (for Active Directory) or posixGroup. All other entries are ignored.
+//
+// Information that cannot be carried over is reported in the returned list of
+// warnings. The result is not validated; the caller should call
+// Database.Validate() to find out which objects need to be fixed manually.
+func Import(entries []Entry) (db core.Database, warnings []string) {
+	warnf := func(msg string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(msg, args...))
+	}
+
+	//users must be converted first, so that group members can be resolved
+	loginNameForDN := make(map[string]string)
+	isLoginName := make(map[string]bool)
+	for _, e := range entries {
+		if !e.HasObjectClass("inetorgperson", "person", "user") || e.HasObjectClass("computer") {
+			continue
+		}
+		user, ok := importUser(e, warnf)
+		if !ok {
+			continue
+		}
+		if isLoginName[user.LoginName] {
+			warnf("line %d: skipping %q: a user with login name %q was already imported", e.LineNumber, e.DN, user.LoginName)
+			continue
+		}
+		db.Users = append(db.Users, user)
+		loginNameForDN[normalizeDN(e.DN)] = user.LoginName
+		isLoginName[user.LoginName] = true
+	}
+
+	//the same group may appear multiple times (e.g. once as groupOfNames and
+	//once as posixGroup), so all entries with the same name are merged
+	groupIndex := make(map[string]int)
+	for _, e := range entries {
+		if !e.HasObjectClass("groupofnames", "groupofuniquenames", "group", "posixgroup") {
+			continue
+		}
+		name := e.Get("cn")
+		if name == "" {
+			warnf("line %d: skipping %q: missing attribute \"cn\"", e.LineNumber, e.DN)
+			continue
+		}
+		idx, exists := groupIndex[name]
+		if !exists {
+			idx = len(db.Groups)
+			groupIndex[name] = idx
+			db.Groups = append(db.Groups, core.Group{
+				Name:             name,
+				LongName:         name,
+				MemberLoginNames: make(core.GroupMemberNames),
+			})
+		}
+		importGroupInto(&db.Groups[idx], e, loginNameForDN, isLoginName, warnf)
+	}
+
+	db.Normalize()
+	return db, warnings
+}
+
+func importUser(e Entry, warnf func(string, ...any)) (core.User, bool) {
+	user := core.User{
+		LoginName:     e.Get("uid"),
+		GivenName:     e.Get("givenname"),
+		FamilyName:    e.Get("sn"),
+		EMailAddress:  e.Get("mail"),
+		SSHPublicKeys: e.Attributes["sshpublickey"],
+	}
+	if user.LoginName == "" {
+		user.LoginName = e.Get("samaccountname")
+	}
+	if user.LoginName == "" {
+		warnf("line %d: skipping %q: missing attribute \"uid\" or \"sAMAccountName\"", e.LineNumber, e.DN)
+		return core.User{}, false
+	}
+
+	//Portunus requires both given name and family name, so try to derive them
+	//from the common name if necessary
+	if user.GivenName == "" || user.FamilyName == "" {
+		names := strings.Fields(e.Get("cn"))
+		if len(names) >= 2 {
+			if user.GivenName == "" {
+				user.GivenName = strings.Join(names[:len(names)-1], " ")
+			}
+			if user.FamilyName == "" {
+				user.FamilyName = names[len(names)-1]
+			}
+		}
+	}
+
+	//if there are multiple hashes, take the first one that Portunus understands
+	var hashErrs []string
+	for _, value := range e.Attributes["userpassword"] {
+		passwordHash, err := crypt.ImportPasswordHash(value)
+		if err == nil {
+			user.PasswordHash = passwordHash
+			break
+		}
+		hashErrs = append(hashErrs, err.Error())
+	}
+	if user.PasswordHash == "" {
+		if len(hashErrs) > 0 {
+			warnf("user %q: password hash not imported: %s", user.LoginName, strings.Join(hashErrs, "; "))
+		} else {
+			warnf("user %q: no password hash found", user.LoginName)
+		}
+	}
+
+	if e.HasObjectClass("posixaccount") {
+		ref := user.Ref()
+		uid, err1 := core.ParsePosixID(e.Get("uidnumber"), ref.Field("posix_uid"))
+		gid, err2 := core.ParsePosixID(e.Get("gidnumber"), ref.Field("posix_gid"))
+		if err1 == nil && err2 == nil {
+			user.POSIX = &core.UserPosixAttributes{
+				UID:           uid,
+				GID:           gid,
+				HomeDirectory: e.Get("homedirectory"),
+				LoginShell:    e.Get("loginshell"),
+				GECOS:         e.Get("gecos"),
+			}
+		} else {
+			warnf("user %q: POSIX attributes not imported because of malformed uidNumber or gidNumber", user.LoginName)
+		}
+	}
+
+	return user, true
+}
+
+func importGroupInto(group *core.Group, e Entry, loginNameForDN map[string]string, isLoginName map[string]bool, warnf func(string, ...any)) {
+	if description := e.Get("description"); description != "" && group.Notes == "" {
+		group.Notes = strings.TrimSpace(description)
+	}
+	if mail := e.Get("mail"); mail != "" && group.EMailAddress == "" {
+		group.EMailAddress = mail
+	}
+	if owner := e.Get("owner"); owner != "" && group.OwnerLoginName == "" {
+		loginName, exists := loginNameForDN[normalizeDN(owner)]
+		if exists {
+			group.OwnerLoginName = loginName
+		} else {
+			warnf("group %q: owner %q not imported because it does not refer to an imported user", group.Name, owner)
+		}
+	}
+
+	var memberDNames []string
+	memberDNames = append(memberDNames, e.Attributes["member"]...)
+	for _, value := range e.Attributes["uniquemember"] {
+		//uniqueMember values may have an optional UID suffix like "#'0101'B"
+		dn, _, _ := strings.Cut(value, "#")
+		memberDNames = append(memberDNames, dn)
+	}
+	for _, dn := range memberDNames {
+		loginName, exists := loginNameForDN[normalizeDN(dn)]
+		if exists {
+			group.MemberLoginNames[loginName] = true
+		} else {
+			warnf("group %q: member %q not imported because it does not refer to an imported user", group.Name, dn)
+		}
+	}
+	for _, loginName := range e.Attributes["memberuid"] {
+		if isLoginName[loginName] {
+			group.MemberLoginNames[loginName] = true
+		} else {
+			warnf("group %q: memberUid %q not imported because it does not refer to an imported user", group.Name, loginName)
+		}
+	}
+
+	if e.HasObjectClass("posixgroup") {
+		gid, err := core.ParsePosixID(e.Get("gidnumber"), group.Ref().Field("posix_gid"))
+		if err == nil {
+			group.PosixGID = &gid
+		} else {
+			warnf("group %q: POSIX group ID not imported because of malformed gidNumber", group.Name)
+		}
+	}
+}
+
+// normalizeDN brings a DN into a canonical form, so that references to the
+// same object can be matched even when they are formatted differently.
+// This is not a full implementation of the rules from RFC 4514, but it covers
+// the differences found in practice (case and whitespace).
+func normalizeDN(dn string) string {
+	rdns := strings.Split(dn, ",")
+	for idx, rdn := range rdns {
+		attrType, value, _ := strings.Cut(rdn, "=")
+		rdns[idx] = strings.ToLower(strings.TrimSpace(attrType)) + "=" + strings.ToLower(strings.TrimSpace(value))
+	}
+	return strings.Join(rdns, ",")
+}
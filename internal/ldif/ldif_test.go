@@ -0,0 +1,177 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldif
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+const testInput = `version: 1
+
+# an OpenLDAP user with a folded attribute value
+dn: uid=jane,ou=people,dc=example,dc=org
+objectClass: inetOrgPerson
+objectClass: posixAccount
+uid: jane
+cn: Jane Doe
+givenName: Jane
+sn: Doe
+mail: jane@example.org
+userPassword: {CRYPT}$6$salt$hash
+uidNumber: 1000
+gidNumber: 1000
+homeDirectory: /home/ja
+ ne
+
+dn: uid=john,ou=people,dc=example,dc=org
+objectClass: inetOrgPerson
+uid: john
+cn:: Sm9obiBRdWluY3k=
+userPassword: {MD5}X03MO1qnZdYdgyfeuILPmQ==
+userPassword: {ssha}88m3dY86bbB/46jjYMWWejSEkOxwZXBwZXIxMg==
+
+dn: uid=jim,ou=people,dc=example,dc=org
+objectClass: inetOrgPerson
+uid: jim
+givenName: Jim
+sn: Doe
+userPassword: {MD5}X03MO1qnZdYdgyfeuILPmQ==
+
+dn: cn=staff,ou=groups,dc=example,dc=org
+objectClass: groupOfNames
+cn: staff
+description: All staff
+member: UID=jane, OU=people, DC=example, DC=org
+member: uid=john,ou=people,dc=example,dc=org
+member: cn=nobody,dc=example,dc=org
+
+dn: cn=staff,ou=posix-groups,dc=example,dc=org
+objectClass: posixGroup
+cn: staff
+gidNumber: 1000
+memberUid: jane
+
+dn: ou=people,dc=example,dc=org
+objectClass: organizationalUnit
+ou: people
+`
+
+func TestImport(t *testing.T) {
+	entries, err := Parse(strings.NewReader(testInput))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "entry count", len(entries), 6)
+	assert.DeepEqual(t, "line number", entries[1].LineNumber, 18)
+
+	db, warnings := Import(entries)
+	gid := core.PosixID(1000)
+	assert.DeepEqual(t, "users", []core.User(db.Users), []core.User{
+		{
+			LoginName:    "jane",
+			GivenName:    "Jane",
+			FamilyName:   "Doe",
+			EMailAddress: "jane@example.org",
+			PasswordHash: "{CRYPT}$6$salt$hash",
+			POSIX: &core.UserPosixAttributes{
+				UID:           1000,
+				GID:           1000,
+				HomeDirectory: "/home/jane",
+			},
+		},
+		{
+			LoginName:  "jim",
+			GivenName:  "Jim",
+			FamilyName: "Doe",
+		},
+		{
+			LoginName:    "john",
+			GivenName:    "John",
+			FamilyName:   "Quincy",
+			PasswordHash: "{SSHA}88m3dY86bbB/46jjYMWWejSEkOxwZXBwZXIxMg==",
+		},
+	})
+	assert.DeepEqual(t, "groups", []core.Group(db.Groups), []core.Group{{
+		Name:             "staff",
+		LongName:         "staff",
+		Notes:            "All staff",
+		MemberLoginNames: core.GroupMemberNames{"jane": true, "john": true},
+		PosixGID:         &gid,
+	}})
+	assert.DeepEqual(t, "warnings", warnings, []string{
+		`user "jim": password hash not imported: password hashes in the {MD5} scheme are not supported`,
+		`group "staff": member "cn=nobody,dc=example,dc=org" not imported because it does not refer to an imported user`,
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]string{
+		"dn: cn=foo\nchangetype: modify\n":    `line 2: change records with "changetype: modify" are not supported`,
+		"cn: foo\n":                           `line 1: expected "dn:", but found "cn:"`,
+		"dn: cn=foo\njpegPhoto:< file:///x\n": `line 2: values referring to URLs are not supported (found for "jpegphoto")`,
+		" continued\n":                        `line 1: unexpected continuation line`,
+	}
+	for input, expected := range testCases {
+		_, err := Parse(strings.NewReader(input))
+		if err == nil {
+			t.Errorf("expected error %q for input %q, but got no error", expected, input)
+		} else {
+			assert.DeepEqual(t, "error for "+input, err.Error(), expected)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	entries := []Entry{
+		{
+			DN: "uid=jane,ou=users,dc=example,dc=org",
+			Attributes: map[string][]string{
+				"objectClass": {"inetOrgPerson", "top"},
+				"cn":          {"Jane Doe"},
+				"jpegPhoto":   {"\xff\xd8\xff\xe0"},
+				"description": {strings.Repeat("long text ", 10)},
+			},
+		},
+		{
+			DN:         "cn=Jürgen,ou=groups,dc=example,dc=org",
+			Attributes: map[string][]string{"cn": {"Jürgen"}},
+		},
+	}
+
+	var sb strings.Builder
+	err := Write(&sb, entries)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "LDIF output", sb.String(), `version: 1
+
+dn: uid=jane,ou=users,dc=example,dc=org
+cn: Jane Doe
+description:: bG9uZyB0ZXh0IGxvbmcgdGV4dCBsb25nIHRleHQgbG9uZyB0ZXh0IGxvbmcgdG
+ V4dCBsb25nIHRleHQgbG9uZyB0ZXh0IGxvbmcgdGV4dCBsb25nIHRleHQgbG9uZyB0ZXh0IA==
+jpegPhoto:: /9j/4A==
+objectClass: inetOrgPerson
+objectClass: top
+
+dn:: Y249SsO8cmdlbixvdT1ncm91cHMsZGM9ZXhhbXBsZSxkYz1vcmc=
+cn:: SsO8cmdlbg==
+`)
+
+	//the output can be read back
+	parsed, err := Parse(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "entry count", len(parsed), 2)
+	assert.DeepEqual(t, "photo after round trip", parsed[0].Get("jpegphoto"), "\xff\xd8\xff\xe0")
+	assert.DeepEqual(t, "description after round trip", parsed[0].Get("description"), strings.Repeat("long text ", 10))
+	assert.DeepEqual(t, "DN after round trip", parsed[1].DN, "cn=Jürgen,ou=groups,dc=example,dc=org")
+}
@@ -0,0 +1,186 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package ldif reads LDIF exports from other LDAP directories and converts them
+// into Portunus users and groups. It can also write LDIF files, e.g. to export
+// the directory that Portunus renders.
+package ldif
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Entry is a single record from an LDIF file.
+type Entry struct {
+	DN string
+	//Attribute types are lowercased and stripped of options (e.g. ";binary"),
+	//since LDAP attribute types are case-insensitive.
+	Attributes map[string][]string
+	//The line number where this entry starts (for error messages).
+	LineNumber int
+}
+
+// Get returns the first value of the given attribute, or the empty string if
+// the attribute does not exist.
+func (e Entry) Get(attrType string) string {
+	values := e.Attributes[attrType]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// HasObjectClass returns whether this entry has any of the given object
+// classes. The arguments must be in lowercase.
+func (e Entry) HasObjectClass(classes ...string) bool {
+	for _, value := range e.Attributes["objectclass"] {
+		for _, class := range classes {
+			if strings.ToLower(value) == class {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parse reads all entries from an LDIF file as described in RFC 2849. Change
+// records are not supported, except for "changetype: add".
+func Parse(r io.Reader) ([]Entry, error) {
+	var (
+		result  []Entry
+		current *Entry
+		//the logical line that is currently being assembled from folded lines
+		logicalLine     string
+		logicalLineNum  int
+		inCommentLine   bool
+		physicalLineNum int
+	)
+
+	flushLine := func() error {
+		if logicalLine == "" {
+			return nil
+		}
+		line, lineNum := logicalLine, logicalLineNum
+		logicalLine = ""
+		if current == nil {
+			current = &Entry{Attributes: make(map[string][]string), LineNumber: lineNum}
+		}
+		return current.addLine(line, lineNum, len(result) == 0)
+	}
+	flushEntry := func() error {
+		err := flushLine()
+		if err != nil {
+			return err
+		}
+		if current != nil && current.DN != "" {
+			result = append(result, *current)
+		}
+		current = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		physicalLineNum++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		switch {
+		case strings.HasPrefix(line, " "):
+			//continuation of the previous line (comments can be folded, too)
+			if !inCommentLine {
+				if logicalLine == "" {
+					return nil, fmt.Errorf("line %d: unexpected continuation line", physicalLineNum)
+				}
+				logicalLine += line[1:]
+			}
+		case strings.HasPrefix(line, "#"):
+			err := flushLine()
+			if err != nil {
+				return nil, err
+			}
+			inCommentLine = true
+		case line == "":
+			inCommentLine = false
+			err := flushEntry()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			inCommentLine = false
+			err := flushLine()
+			if err != nil {
+				return nil, err
+			}
+			logicalLine = line
+			logicalLineNum = physicalLineNum
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	err := flushEntry()
+	return result, err
+}
+
+func (e *Entry) addLine(line string, lineNum int, isFirstEntry bool) error {
+	attrType, value, err := parseAttrValue(line)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", lineNum, err)
+	}
+
+	if e.DN == "" {
+		switch {
+		case attrType == "dn":
+			e.DN = value
+			return nil
+		case attrType == "version" && isFirstEntry && len(e.Attributes) == 0:
+			//the version line appears before the first entry
+			return nil
+		default:
+			return fmt.Errorf("line %d: expected \"dn:\", but found %q", lineNum, attrType+":")
+		}
+	}
+
+	switch attrType {
+	case "changetype":
+		if strings.ToLower(value) != "add" {
+			return fmt.Errorf("line %d: change records with \"changetype: %s\" are not supported", lineNum, value)
+		}
+		return nil
+	case "control":
+		return fmt.Errorf("line %d: change records with controls are not supported", lineNum)
+	}
+	e.Attributes[attrType] = append(e.Attributes[attrType], value)
+	return nil
+}
+
+func parseAttrValue(line string) (attrType, value string, err error) {
+	attrType, rest, found := strings.Cut(line, ":")
+	if !found {
+		return "", "", fmt.Errorf("missing colon in %q", line)
+	}
+	//strip options like in "userCertificate;binary"
+	attrType, _, _ = strings.Cut(attrType, ";")
+	attrType = strings.ToLower(strings.TrimSpace(attrType))
+
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid base64 value for %q: %w", attrType, err)
+		}
+		return attrType, string(buf), nil
+	case strings.HasPrefix(rest, "<"):
+		return "", "", fmt.Errorf("values referring to URLs are not supported (found for %q)", attrType)
+	default:
+		return attrType, strings.TrimLeft(rest, " "), nil
+	}
+}
@@ -0,0 +1,99 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package ldif
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Lines longer than this are folded, as recommended by RFC 2849.
+const maxLineLength = 76
+
+// Write writes the given entries as an LDIF file (as described in RFC 2849)
+// in the order in which they are given. Attributes are written in
+// alphabetical order to make the output reproducible. Values that are not
+// plain ASCII text (e.g. photos) are base64-encoded.
+//
+// The LineNumber field of each entry is ignored.
+func Write(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	_, err := bw.WriteString("version: 1\n")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var lines []string
+		lines = append(lines, formatAttrValue("dn", entry.DN))
+		for _, attrType := range slices.Sorted(maps.Keys(entry.Attributes)) {
+			for _, value := range entry.Attributes[attrType] {
+				lines = append(lines, formatAttrValue(attrType, value))
+			}
+		}
+
+		_, err := bw.WriteString("\n")
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			_, err := bw.WriteString(foldLine(line))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func formatAttrValue(attrType, value string) string {
+	if isSafeString(value) {
+		return attrType + ": " + value
+	}
+	return attrType + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+// Returns whether the value can be written as-is, i.e. whether it matches the
+// SAFE-STRING production from RFC 2849. Values with trailing spaces are also
+// encoded since the spaces would be hard to notice otherwise.
+func isSafeString(value string) bool {
+	if value == "" {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for _, b := range []byte(value) {
+		if b == 0 || b == '\n' || b == '\r' || b >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits a line into physical lines of at most maxLineLength characters.
+// Continuation lines start with a single space.
+func foldLine(line string) string {
+	var sb strings.Builder
+	limit := maxLineLength
+	for len(line) > limit {
+		sb.WriteString(line[:limit])
+		sb.WriteString("\n ")
+		line = line[limit:]
+		limit = maxLineLength - 1 //to account for the leading space
+	}
+	sb.WriteString(line)
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,204 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package policy contains implementations of core.PreCommitHook that consult
+// external systems before changes to the database are committed.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// MaxTimeout is the upper limit for WebhookOptions.Timeout. The webhook is
+// consulted while the nexus holds its write lock, so every other change (and
+// every login that needs to rehash a password) waits for the webhook, too.
+const MaxTimeout = 10 * time.Second
+
+// WebhookOptions contains the configuration for a Webhook.
+type WebhookOptions struct {
+	URL string
+	//Must be positive. Values above MaxTimeout are reduced to MaxTimeout.
+	Timeout time.Duration
+	//If true, changes are allowed when the webhook cannot be reached or
+	//returns an invalid response. If false (default), they are rejected.
+	FailOpen bool
+}
+
+// Webhook asks an external HTTP endpoint to approve or deny each change to
+// the database. The endpoint receives a POST request with the proposed
+// changes as JSON, and is expected to respond with 200 and a JSON body like
+// `{"allowed":false,"message":"reason for denial"}`.
+type Webhook struct {
+	opts   WebhookOptions
+	client *http.Client
+}
+
+// NewWebhook instantiates a Webhook.
+func NewWebhook(opts WebhookOptions) *Webhook {
+	return &Webhook{
+		opts:   opts,
+		client: &http.Client{Timeout: min(opts.Timeout, MaxTimeout)},
+	}
+}
+
+// Check is a core.PreCommitHook that forwards the change to the webhook.
+// Since it runs under the nexus' write lock, it blocks all other writes for up
+// to the configured timeout.
+func (w *Webhook) Check(change core.Change) error {
+	resp, err := w.send(buildRequest(change))
+	if err != nil {
+		//the full error may contain internal details like the webhook URL, so
+		//it only goes into the log
+		if w.opts.FailOpen {
+			logg.Error("policy webhook failed, allowing the change anyway: %s", err.Error())
+			return nil
+		}
+		logg.Error("policy webhook failed, rejecting the change: %s", err.Error())
+		return errors.New("this change could not be checked against the policy, please try again later")
+	}
+
+	if resp.Allowed {
+		return nil
+	}
+	if resp.Message == "" {
+		return errors.New("this change was rejected by the policy")
+	}
+	return fmt.Errorf("this change was rejected by the policy: %s", resp.Message)
+}
+
+func (w *Webhook) send(req webhookRequest) (webhookResponse, error) {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return webhookResponse{}, err
+	}
+	httpResp, err := w.client.Post(w.opts.URL, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return webhookResponse{}, err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<16))
+	if err != nil {
+		return webhookResponse{}, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return webhookResponse{}, fmt.Errorf("expected 200 OK, but got %s: %q", httpResp.Status, string(respBody))
+	}
+
+	var resp webhookResponse
+	dec := json.NewDecoder(bytes.NewReader(respBody))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&resp)
+	if err != nil {
+		return webhookResponse{}, fmt.Errorf("cannot decode response body %q: %w", string(respBody), err)
+	}
+	return resp, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// wire format
+
+type webhookRequest struct {
+	Actor  core.Actor   `json:"actor"`
+	Users  userChanges  `json:"users"`
+	Groups groupChanges `json:"groups"`
+}
+
+type userChanges struct {
+	Created []core.User  `json:"created"`
+	Updated []userUpdate `json:"updated"`
+	Deleted []core.User  `json:"deleted"`
+}
+
+type userUpdate struct {
+	Old core.User `json:"old"`
+	New core.User `json:"new"`
+	//Since password hashes are redacted, this is the only way for the policy
+	//to learn about password changes.
+	PasswordChanged bool `json:"password_changed"`
+}
+
+type groupChanges struct {
+	Created []core.Group  `json:"created"`
+	Updated []groupUpdate `json:"updated"`
+	Deleted []core.Group  `json:"deleted"`
+}
+
+type groupUpdate struct {
+	Old core.Group `json:"old"`
+	New core.Group `json:"new"`
+}
+
+type webhookResponse struct {
+	Allowed bool   `json:"allowed"`
+	Message string `json:"message"`
+}
+
+// Password hashes and TOTP keys are not given to the policy endpoint: They are
+// useless to any legitimate policy, and should not be spread around any
+// further than necessary.
+const redactedSecret = "<redacted>"
+
+func redactUser(u core.User) core.User {
+	if u.PasswordHash != "" {
+		u.PasswordHash = redactedSecret
+	}
+	if u.TOTPKeyURL != "" {
+		u.TOTPKeyURL = redactedSecret
+	}
+	return u
+}
+
+func buildRequest(change core.Change) webhookRequest {
+	diff := change.Diff
+	//NOTE: All lists are initialized to be non-nil, so that they get serialized
+	//as `[]` instead of `null`.
+	req := webhookRequest{
+		Actor: change.Actor,
+		Users: userChanges{
+			Created: make([]core.User, 0, len(diff.Users.Created)),
+			Updated: make([]userUpdate, 0, len(diff.Users.Updated)),
+			Deleted: make([]core.User, 0, len(diff.Users.Deleted)),
+		},
+		Groups: groupChanges{
+			Created: diff.Groups.Created,
+			Updated: make([]groupUpdate, 0, len(diff.Groups.Updated)),
+			Deleted: diff.Groups.Deleted,
+		},
+	}
+	for _, u := range diff.Users.Created {
+		req.Users.Created = append(req.Users.Created, redactUser(u))
+	}
+	for _, upd := range diff.Users.Updated {
+		req.Users.Updated = append(req.Users.Updated, userUpdate{
+			Old:             redactUser(upd.Old),
+			New:             redactUser(upd.New),
+			PasswordChanged: upd.Old.PasswordHash != upd.New.PasswordHash,
+		})
+	}
+	for _, u := range diff.Users.Deleted {
+		req.Users.Deleted = append(req.Users.Deleted, redactUser(u))
+	}
+	for _, upd := range diff.Groups.Updated {
+		req.Groups.Updated = append(req.Groups.Updated, groupUpdate(upd))
+	}
+	if req.Groups.Created == nil {
+		req.Groups.Created = []core.Group{}
+	}
+	if req.Groups.Deleted == nil {
+		req.Groups.Deleted = []core.Group{}
+	}
+	return req
+}
@@ -0,0 +1,83 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package policy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	var lastRequest webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&lastRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		//the policy under test: nobody may be deleted
+		if len(lastRequest.Users.Deleted) > 0 {
+			w.Write([]byte(`{"allowed":false,"message":"users may not be deleted"}`))
+		} else {
+			w.Write([]byte(`{"allowed":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	alice := core.User{LoginName: "alice", GivenName: "Alice", FamilyName: "Doe", PasswordHash: "{CRYPT}$5$alice"}
+	aliceChanged := alice
+	aliceChanged.PasswordHash = "{CRYPT}$5$changed"
+
+	//allowed change: check that password hashes do not reach the webhook
+	hook := NewWebhook(WebhookOptions{URL: srv.URL, Timeout: time.Second})
+	actor := core.Actor{Type: core.ActorTypeUser, Name: "admin"}
+	err := hook.Check(core.Change{
+		Actor: actor,
+		Diff: core.DatabaseDiff{
+			Users: core.ObjectDiff[core.User]{
+				Updated: []core.ObjectUpdate[core.User]{{Old: alice, New: aliceChanged}},
+			},
+		},
+	})
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "actor", lastRequest.Actor, actor)
+	assert.DeepEqual(t, "old password hash", lastRequest.Users.Updated[0].Old.PasswordHash, redactedSecret)
+	assert.DeepEqual(t, "new password hash", lastRequest.Users.Updated[0].New.PasswordHash, redactedSecret)
+	assert.DeepEqual(t, "password changed", lastRequest.Users.Updated[0].PasswordChanged, true)
+
+	//denied change
+	deleteAlice := core.Change{
+		Actor: actor,
+		Diff: core.DatabaseDiff{
+			Users: core.ObjectDiff[core.User]{Deleted: []core.User{alice}},
+		},
+	}
+	err = hook.Check(deleteAlice)
+	expectError(t, err, "this change was rejected by the policy: users may not be deleted")
+
+	//unreachable webhook is handled according to FailOpen
+	srv.Close()
+	err = NewWebhook(WebhookOptions{URL: srv.URL, Timeout: time.Second}).Check(deleteAlice)
+	expectError(t, err, "this change could not be checked against the policy, please try again later")
+	err = NewWebhook(WebhookOptions{URL: srv.URL, Timeout: time.Second, FailOpen: true}).Check(deleteAlice)
+	assert.DeepEqual(t, "error", err, nil)
+}
+
+func expectError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if err == nil {
+		t.Errorf("expected error %q, but got no error", expected)
+	} else {
+		assert.DeepEqual(t, "error message", err.Error(), expected)
+	}
+}
@@ -0,0 +1,344 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package provisioning implements the inbound webhook through which an
+// external system (usually the HR system) creates and deactivates users
+// when people join or leave the organization.
+package provisioning
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/api"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// SignatureHeader is the request header that contains the HMAC-SHA256 of the
+// timestamp and the request body (see signedMessage), in the form
+// "sha256=<hex digest>".
+const SignatureHeader = "X-Portunus-Signature"
+
+// TimestampHeader is the request header that contains the time when the
+// request was sent, in seconds since the Unix epoch. Since the timestamp is
+// covered by the signature, captured requests cannot be replayed later on.
+const TimestampHeader = "X-Portunus-Timestamp"
+
+// How far the timestamp of a request may deviate from the current time. This
+// allows for some clock skew between the systems, and for network delays.
+const maxTimestampSkew = 5 * time.Minute
+
+// The fields that a FieldMapping can refer to. "action" and "login_name" are
+// always required, the names are only required for creating users.
+var mappableFields = []string{"action", "login_name", "given_name", "family_name", "email"}
+
+// FieldMapping describes where the values for Portunus are found in the
+// payloads that the external system sends.
+type FieldMapping struct {
+	//For each of the mappableFields, the dot-separated path of the respective
+	//value in the payload, e.g. "employee.first_name". Fields not mentioned here
+	//are expected at the top level of the payload under their own name.
+	Fields map[string]string `json:"fields"`
+	//Translates the values of the "action" field into the actions that
+	//Portunus understands ("create" or "disable"), e.g. {"leaver": "disable"}.
+	//Values not mentioned here are taken as-is.
+	Actions map[string]string `json:"actions"`
+}
+
+// ReadFieldMapping reads a FieldMapping from the JSON file at the given path.
+// If the path is empty, the default mapping (with all fields at the top level
+// of the payload) is returned.
+func ReadFieldMapping(path string) (FieldMapping, error) {
+	if path == "" {
+		return FieldMapping{}, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return FieldMapping{}, err
+	}
+	var m FieldMapping
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&m)
+	if err != nil {
+		return FieldMapping{}, fmt.Errorf("while parsing %s: %w", path, err)
+	}
+	for name, valuePath := range m.Fields {
+		if !slices.Contains(mappableFields, name) {
+			return FieldMapping{}, fmt.Errorf("while parsing %s: unknown field %q (expected one of: %s)",
+				path, name, strings.Join(mappableFields, ", "))
+		}
+		if valuePath == "" {
+			return FieldMapping{}, fmt.Errorf("while parsing %s: empty path for field %q", path, name)
+		}
+	}
+	for value, action := range m.Actions {
+		if action != actionCreate && action != actionDisable {
+			return FieldMapping{}, fmt.Errorf("while parsing %s: action %q maps to %q, but only %q and %q are supported",
+				path, value, action, actionCreate, actionDisable)
+		}
+	}
+	return m, nil
+}
+
+const (
+	actionCreate  = "create"
+	actionDisable = "disable"
+)
+
+// Returns the value of the given field from the payload, or "" if the payload
+// does not contain it.
+func (m FieldMapping) lookup(payload map[string]any, field string) (string, error) {
+	path := m.Fields[field]
+	if path == "" {
+		path = field
+	}
+	var current any = payload
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]any)
+		if !ok {
+			return "", nil
+		}
+		current = obj[key]
+	}
+	switch value := current.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(value), nil
+	case json.Number:
+		return value.String(), nil
+	default:
+		return "", fmt.Errorf("expected a string at %q in the payload, but found %T", path, current)
+	}
+}
+
+// ReceiverOptions contains the configuration for a Receiver.
+type ReceiverOptions struct {
+	//The shared secret for the HMAC in SignatureHeader.
+	Secret  string
+	Mapping FieldMapping
+}
+
+// Receiver is the http.Handler for the provisioning webhook. Each request
+// contains one event like "create this user" or "disable this user". The
+// resulting changes go through Nexus.Update() like those made in the UI, so
+// they are subject to the same validation, seed enforcement and policy
+// checks, and appear in the audit log with the actor "api-token
+// provisioning-webhook".
+type Receiver struct {
+	nexus core.Nexus
+	opts  ReceiverOptions
+}
+
+// NewReceiver instantiates a Receiver.
+func NewReceiver(nexus core.Nexus, opts ReceiverOptions) *Receiver {
+	return &Receiver{nexus, opts}
+}
+
+// The actor for all changes made through the webhook.
+var receiverActor = core.Actor{Type: core.ActorTypeAPIToken, Name: "provisioning-webhook"}
+
+// Response is the response body for successful requests.
+type Response struct {
+	LoginName string `json:"login_name"`
+	//One of "created", "disabled" or "unchanged". Events are accepted with
+	//"unchanged" if they were already processed before (e.g. when the external
+	//system retries a delivery), so that they can be retried safely.
+	Result string `json:"result"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (rcv *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "cannot read request body: %s", err.Error())
+		return
+	}
+	timestamp := r.Header.Get(TimestampHeader)
+	if !isRecentTimestamp(timestamp, time.Now()) {
+		respondWithError(w, http.StatusUnauthorized, "missing or stale timestamp in %s header (must be within %s of the current time)",
+			TimestampHeader, maxTimestampSkew)
+		return
+	}
+	if !rcv.hasValidSignature(signedMessage(timestamp, body), r.Header.Get(SignatureHeader)) {
+		respondWithError(w, http.StatusUnauthorized, "missing or invalid signature in %s header", SignatureHeader)
+		return
+	}
+
+	var payload map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	err = dec.Decode(&payload)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "malformed request body: %s", err.Error())
+		return
+	}
+	values := make(map[string]string, len(mappableFields))
+	for _, field := range mappableFields {
+		values[field], err = rcv.opts.Mapping.lookup(payload, field)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "malformed request body: %s", err.Error())
+			return
+		}
+	}
+	action := values["action"]
+	if mapped, ok := rcv.opts.Mapping.Actions[action]; ok {
+		action = mapped
+	}
+	loginName := values["login_name"]
+	if loginName == "" {
+		respondWithError(w, http.StatusBadRequest, "payload does not contain a login name")
+		return
+	}
+
+	var (
+		result string
+		status int
+		errs   errext.ErrorSet
+	)
+	switch action {
+	case actionCreate:
+		user := core.User{
+			LoginName:    loginName,
+			GivenName:    values["given_name"],
+			FamilyName:   values["family_name"],
+			EMailAddress: values["email"],
+		}
+		result, status, errs = rcv.createUser(user)
+	case actionDisable:
+		result, status, errs = rcv.disableUser(loginName)
+	default:
+		respondWithError(w, http.StatusBadRequest, "unknown action %q (expected %q or %q)", action, actionCreate, actionDisable)
+		return
+	}
+	if !errs.IsEmpty() {
+		api.RespondWithErrors(w, status, errs)
+		return
+	}
+
+	buf, err := json.Marshal(Response{LoginName: loginName, Result: result})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "%s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf)
+}
+
+// Returns whether the given value of TimestampHeader is within
+// maxTimestampSkew of `now`.
+func isRecentTimestamp(header string, now time.Time) bool {
+	seconds, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	return skew <= maxTimestampSkew && skew >= -maxTimestampSkew
+}
+
+// signedMessage returns the message that the signature in SignatureHeader is
+// computed over: the value of TimestampHeader, a dot, and the request body.
+func signedMessage(timestamp string, body []byte) []byte {
+	return append([]byte(timestamp+"."), body...)
+}
+
+func (rcv *Receiver) hasValidSignature(message []byte, header string) bool {
+	digest, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	actual, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(rcv.opts.Secret))
+	mac.Write(message)
+	return hmac.Equal(actual, mac.Sum(nil))
+}
+
+func (rcv *Receiver) update(action core.UpdateAction) errext.ErrorSet {
+	return rcv.nexus.Update(action, &core.UpdateOptions{
+		ConflictWithSeedIsError: true,
+		Actor:                   receiverActor,
+	})
+}
+
+// Users are created without a password. They can log in once an admin has
+// set an initial password for them.
+func (rcv *Receiver) createUser(user core.User) (result string, status int, errs errext.ErrorSet) {
+	result = "created"
+	errs = rcv.update(func(db *core.Database) (errs errext.ErrorSet) {
+		if _, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == user.LoginName }); exists {
+			result = "unchanged"
+			return nil
+		}
+		//a person who returns after having left should not silently get back
+		//their previous group memberships, so such users must be restored by
+		//an admin
+		if slices.ContainsFunc(db.DeactivatedUsers, func(u core.DeactivatedUser) bool { return u.User.LoginName == user.LoginName }) {
+			status = http.StatusConflict
+			errs.Addf("user %q was deactivated and can only be restored by an admin", user.LoginName)
+			return errs
+		}
+		db.Users = append(db.Users, user)
+		db.AddDefaultMemberships(user)
+		return nil
+	})
+	if !errs.IsEmpty() {
+		if status == 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		return "", status, errs
+	}
+	return result, http.StatusOK, nil
+}
+
+// Like deleting a user in the UI, this deactivates the user (or deletes it
+// immediately if PORTUNUS_USER_RETENTION_DAYS is 0).
+func (rcv *Receiver) disableUser(loginName string) (result string, status int, errs errext.ErrorSet) {
+	result = "disabled"
+	cfg := rcv.nexus.ValidationConfig()
+	errs = rcv.update(func(db *core.Database) (errs errext.ErrorSet) {
+		if _, exists := db.Users.Find(func(u core.User) bool { return u.LoginName == loginName }); !exists {
+			if slices.ContainsFunc(db.DeactivatedUsers, func(u core.DeactivatedUser) bool { return u.User.LoginName == loginName }) {
+				result = "unchanged"
+				return nil
+			}
+			status = http.StatusNotFound
+			errs.Addf("user %q does not exist", loginName)
+			return errs
+		}
+		errs.Add(db.DeactivateUser(loginName, receiverActor, time.Now(), cfg))
+		return errs
+	})
+	if !errs.IsEmpty() {
+		if status == 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		return "", status, errs
+	}
+	return result, http.StatusOK, nil
+}
+
+func respondWithError(w http.ResponseWriter, status int, format string, args ...any) {
+	var errs errext.ErrorSet
+	errs.Addf(format, args...)
+	api.RespondWithErrors(w, status, errs)
+}
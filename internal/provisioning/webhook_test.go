@@ -0,0 +1,199 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package provisioning
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+const testSecret = "swordfish"
+
+func setupReceiver(t *testing.T, mapping FieldMapping) (core.Nexus, *Receiver) {
+	t.Helper()
+	cfg := core.GetValidationConfigForTests()
+	cfg.UserRetentionDays = 30
+	nexus := core.NewNexus(nil, cfg, &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{
+			LoginName:    "jane",
+			GivenName:    "Jane",
+			FamilyName:   "Doe",
+			PasswordHash: "{PLAINTEXT}secret",
+		}}
+		db.Groups = []core.Group{{
+			Name:              "staff",
+			LongName:          "Staff",
+			MemberLoginNames:  core.GroupMemberNames{"jane": true},
+			DefaultMembership: core.DefaultMembershipRules{ForAllUsers: true},
+		}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	return nexus, NewReceiver(nexus, ReceiverOptions{Secret: testSecret, Mapping: mapping})
+}
+
+func deliver(t *testing.T, rcv *Receiver, secret, body string) (int, string) {
+	t.Helper()
+	return deliverAt(t, rcv, secret, body, time.Now())
+}
+
+// Like deliver, but with the given time in the timestamp header.
+func deliverAt(t *testing.T, rcv *Receiver, secret, body string, sentAt time.Time) (int, string) {
+	t.Helper()
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signedMessage(timestamp, []byte(body)))
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/provisioning", strings.NewReader(body))
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+	rcv.ServeHTTP(rec, req)
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func TestCreateAndDisableUser(t *testing.T) {
+	nexus, rcv := setupReceiver(t, FieldMapping{})
+
+	//create a user (twice, to check that retries are accepted)
+	payload := `{"action":"create","login_name":"john","given_name":"John","family_name":"Doe","email":"john@example.org"}`
+	status, body := deliver(t, rcv, testSecret, payload)
+	assert.DeepEqual(t, "status for create", status, http.StatusOK)
+	assert.DeepEqual(t, "body for create", body, `{"login_name":"john","result":"created"}`)
+	status, body = deliver(t, rcv, testSecret, payload)
+	assert.DeepEqual(t, "status for repeated create", status, http.StatusOK)
+	assert.DeepEqual(t, "body for repeated create", body, `{"login_name":"john","result":"unchanged"}`)
+
+	user, exists := nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "user exists", exists, true)
+	assert.DeepEqual(t, "email of new user", user.EMailAddress, "john@example.org")
+	group, _ := nexus.FindGroup(func(g core.Group) bool { return g.Name == "staff" })
+	assert.DeepEqual(t, "default membership of new user", group.MemberLoginNames["john"], true)
+
+	//the names are validated like in the UI
+	status, body = deliver(t, rcv, testSecret, `{"action":"create","login_name":"jim"}`)
+	assert.DeepEqual(t, "status for invalid create", status, http.StatusUnprocessableEntity)
+	assert.DeepEqual(t, "body for invalid create", body, `{"code":"validation_error","errors":["field \"given_name\" in user \"jim\" is missing","field \"family_name\" in user \"jim\" is missing"],"fields":{"users/jim/family_name":["is missing"],"users/jim/given_name":["is missing"]}}`)
+
+	//disable the user (twice, again)
+	payload = `{"action":"disable","login_name":"john"}`
+	status, body = deliver(t, rcv, testSecret, payload)
+	assert.DeepEqual(t, "status for disable", status, http.StatusOK)
+	assert.DeepEqual(t, "body for disable", body, `{"login_name":"john","result":"disabled"}`)
+	status, body = deliver(t, rcv, testSecret, payload)
+	assert.DeepEqual(t, "status for repeated disable", status, http.StatusOK)
+	assert.DeepEqual(t, "body for repeated disable", body, `{"login_name":"john","result":"unchanged"}`)
+	deactivated := nexus.ListDeactivatedUsers()
+	assert.DeepEqual(t, "deactivated user count", len(deactivated), 1)
+	assert.DeepEqual(t, "deactivated by", deactivated[0].DeactivatedBy, receiverActor)
+
+	//returning users are not restored automatically
+	status, _ = deliver(t, rcv, testSecret, `{"action":"create","login_name":"john","given_name":"John","family_name":"Doe"}`)
+	assert.DeepEqual(t, "status for create of deactivated user", status, http.StatusConflict)
+
+	status, _ = deliver(t, rcv, testSecret, `{"action":"disable","login_name":"unknown"}`)
+	assert.DeepEqual(t, "status for disable of unknown user", status, http.StatusNotFound)
+}
+
+func TestSignatureIsRequired(t *testing.T) {
+	nexus, rcv := setupReceiver(t, FieldMapping{})
+	payload := `{"action":"disable","login_name":"jane"}`
+
+	status, body := deliver(t, rcv, "wrong", payload)
+	assert.DeepEqual(t, "status with wrong secret", status, http.StatusUnauthorized)
+	assert.DeepEqual(t, "body with wrong secret", body, `{"code":"unauthorized","errors":["missing or invalid signature in X-Portunus-Signature header"]}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/provisioning", strings.NewReader(payload))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	rec := httptest.NewRecorder()
+	rcv.ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status without signature", rec.Code, http.StatusUnauthorized)
+
+	//a signature over the body alone (without the timestamp) is not accepted
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(payload))
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/provisioning", strings.NewReader(payload))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec = httptest.NewRecorder()
+	rcv.ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status with signature over body only", rec.Code, http.StatusUnauthorized)
+
+	_, exists := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "user still exists", exists, true)
+}
+
+func TestStaleTimestampIsRejected(t *testing.T) {
+	nexus, rcv := setupReceiver(t, FieldMapping{})
+	payload := `{"action":"disable","login_name":"jane"}`
+
+	//a correctly signed delivery that was captured a while ago cannot be replayed
+	status, body := deliverAt(t, rcv, testSecret, payload, time.Now().Add(-10*time.Minute))
+	assert.DeepEqual(t, "status for stale timestamp", status, http.StatusUnauthorized)
+	assert.DeepEqual(t, "body for stale timestamp", body, `{"code":"unauthorized","errors":["missing or stale timestamp in X-Portunus-Timestamp header (must be within 5m0s of the current time)"]}`)
+	status, _ = deliverAt(t, rcv, testSecret, payload, time.Now().Add(10*time.Minute))
+	assert.DeepEqual(t, "status for timestamp in the future", status, http.StatusUnauthorized)
+	_, exists := nexus.FindUser(func(u core.User) bool { return u.LoginName == "jane" })
+	assert.DeepEqual(t, "user still exists", exists, true)
+
+	//some clock skew is tolerated
+	status, _ = deliverAt(t, rcv, testSecret, payload, time.Now().Add(-1*time.Minute))
+	assert.DeepEqual(t, "status for slightly old timestamp", status, http.StatusOK)
+}
+
+func TestFieldMapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	err := os.WriteFile(path, []byte(`{
+		"fields": {
+			"action": "event",
+			"login_name": "employee.username",
+			"given_name": "employee.first_name",
+			"family_name": "employee.last_name"
+		},
+		"actions": { "joiner": "create", "leaver": "disable" }
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	mapping, err := ReadFieldMapping(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	nexus, rcv := setupReceiver(t, mapping)
+	status, body := deliver(t, rcv, testSecret, `{"event":"joiner","employee":{"username":"john","first_name":"John","last_name":"Doe","id":42}}`)
+	assert.DeepEqual(t, "status for joiner", status, http.StatusOK)
+	assert.DeepEqual(t, "body for joiner", body, `{"login_name":"john","result":"created"}`)
+	user, _ := nexus.FindUser(func(u core.User) bool { return u.LoginName == "john" })
+	assert.DeepEqual(t, "full name of new user", user.FullName(), "John Doe")
+
+	status, _ = deliver(t, rcv, testSecret, `{"event":"transfer","employee":{"username":"john"}}`)
+	assert.DeepEqual(t, "status for unknown action", status, http.StatusBadRequest)
+
+	//mistakes in the mapping are reported on startup
+	err = os.WriteFile(path, []byte(`{"fields":{"surname":"last_name"}}`), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = ReadFieldMapping(path)
+	assert.DeepEqual(t, "error for unknown field", err != nil && strings.Contains(err.Error(), `unknown field "surname"`), true)
+}
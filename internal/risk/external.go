@@ -0,0 +1,175 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package risk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CrowdSec
+
+// CrowdSecOptions contains the configuration for a CrowdSec provider.
+type CrowdSecOptions struct {
+	//The base URL of the CrowdSec Local API, e.g. "http://127.0.0.1:8080".
+	URL string
+	//The API key of a bouncer registered with `cscli bouncers add`.
+	APIKey  string
+	Timeout time.Duration
+}
+
+// CrowdSec is a Provider that acts as a CrowdSec bouncer: It asks the CrowdSec
+// Local API for active decisions about the client address. Decisions of type
+// "ban" deny the login, all other decisions (e.g. "captcha") require
+// additional verification.
+type CrowdSec struct {
+	opts   CrowdSecOptions
+	client *http.Client
+}
+
+// NewCrowdSec instantiates a CrowdSec provider.
+func NewCrowdSec(opts CrowdSecOptions) *CrowdSec {
+	return &CrowdSec{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+type crowdSecDecision struct {
+	Type     string `json:"type"`
+	Scenario string `json:"scenario"`
+}
+
+// AssessLogin implements the Provider interface.
+func (c *CrowdSec) AssessLogin(ctx context.Context, attempt LoginAttempt) (Assessment, error) {
+	reqURL := strings.TrimSuffix(c.opts.URL, "/") + "/v1/decisions?ip=" + url.QueryEscape(attempt.ClientAddress.Unmap().String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, http.NoBody)
+	if err != nil {
+		return Assessment{}, err
+	}
+	req.Header.Set("X-Api-Key", c.opts.APIKey)
+
+	//the response is `null` if there are no decisions
+	var decisions []crowdSecDecision
+	err = doJSONRequest(c.client, req, &decisions)
+	if err != nil {
+		return Assessment{}, fmt.Errorf("while querying CrowdSec: %w", err)
+	}
+
+	result := Assessment{Level: LevelAllow}
+	for _, d := range decisions {
+		level := LevelChallenge
+		if d.Type == "ban" {
+			level = LevelDeny
+		}
+		if level > result.Level {
+			result = Assessment{
+				Level:  level,
+				Reason: fmt.Sprintf("CrowdSec has a %q decision for this client (scenario %q)", d.Type, d.Scenario),
+			}
+		}
+	}
+	return result, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// generic webhook
+
+// WebhookOptions contains the configuration for a Webhook provider.
+type WebhookOptions struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// Webhook is a Provider that asks an external HTTP endpoint to assess each
+// login attempt. The endpoint receives a POST request with a JSON body like
+// `{"client_address":"198.51.100.42","user_agent":"...","user_ident":"john"}`,
+// and is expected to respond with 200 and a JSON body like
+// `{"level":"challenge","reason":"..."}`.
+type Webhook struct {
+	opts   WebhookOptions
+	client *http.Client
+}
+
+// NewWebhook instantiates a Webhook provider.
+func NewWebhook(opts WebhookOptions) *Webhook {
+	return &Webhook{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+type webhookRequest struct {
+	ClientAddress string `json:"client_address"`
+	UserAgent     string `json:"user_agent"`
+	UserIdent     string `json:"user_ident"`
+}
+
+type webhookResponse struct {
+	Level  string `json:"level"`
+	Reason string `json:"reason"`
+}
+
+// AssessLogin implements the Provider interface.
+func (w *Webhook) AssessLogin(ctx context.Context, attempt LoginAttempt) (Assessment, error) {
+	reqBody, err := json.Marshal(webhookRequest{
+		ClientAddress: attempt.ClientAddress.Unmap().String(),
+		UserAgent:     attempt.UserAgent,
+		UserIdent:     attempt.UserIdent,
+	})
+	if err != nil {
+		return Assessment{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.opts.URL, bytes.NewReader(reqBody))
+	if err != nil {
+		return Assessment{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp webhookResponse
+	err = doJSONRequest(w.client, req, &resp)
+	if err != nil {
+		return Assessment{}, fmt.Errorf("while querying login risk webhook: %w", err)
+	}
+	level, err := ParseLevel(resp.Level)
+	if err != nil {
+		return Assessment{}, fmt.Errorf("while querying login risk webhook: %w", err)
+	}
+	return Assessment{Level: level, Reason: resp.Reason}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// helpers
+
+func doJSONRequest(client *http.Client, req *http.Request, target any) error {
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("expected 200 OK, but got %s: %q", httpResp.Status, string(respBody))
+	}
+	err = json.Unmarshal(respBody, target)
+	if err != nil {
+		return fmt.Errorf("cannot decode response body %q: %w", string(respBody), err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package risk contains login risk providers. Before a login is accepted,
+// the login handler asks the configured providers how risky the login
+// attempt is, and can then either accept it, ask for additional verification,
+// or reject it outright. This allows deployments to integrate their existing
+// abuse-prevention infrastructure (e.g. IP reputation lists).
+package risk
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// Level is an enum that appears in type Assessment. Higher levels are more
+// restrictive.
+type Level int
+
+const (
+	// LevelAllow means that the login can proceed as usual.
+	LevelAllow Level = iota
+	// LevelChallenge means that the user must complete an additional
+	// verification step before the login is accepted.
+	LevelChallenge
+	// LevelDeny means that the login must be rejected.
+	LevelDeny
+)
+
+// String returns the representation of this Level in configuration files and
+// in the wire format of external providers.
+func (l Level) String() string {
+	switch l {
+	case LevelAllow:
+		return "allow"
+	case LevelChallenge:
+		return "challenge"
+	case LevelDeny:
+		return "deny"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+// ParseLevel is the inverse of Level.String().
+func ParseLevel(input string) (Level, error) {
+	for _, l := range []Level{LevelAllow, LevelChallenge, LevelDeny} {
+		if input == l.String() {
+			return l, nil
+		}
+	}
+	return LevelAllow, fmt.Errorf("unknown risk level: %q", input)
+}
+
+// LoginAttempt describes a login attempt that shall be assessed by a Provider.
+type LoginAttempt struct {
+	ClientAddress netip.Addr
+	UserAgent     string
+	//As entered into the login form, so this may be a login name or an email
+	//address, and the user may not exist.
+	UserIdent string
+}
+
+// Assessment is the result of Provider.AssessLogin().
+type Assessment struct {
+	Level Level
+	//A human-readable explanation, for use in logs and the audit log.
+	//This is never shown to the client.
+	Reason string
+}
+
+// Provider is the interface for login risk providers.
+type Provider interface {
+	// AssessLogin returns how risky the given login attempt is. An error is
+	// returned if the provider could not reach a verdict (e.g. because an
+	// external service is unavailable).
+	AssessLogin(ctx context.Context, attempt LoginAttempt) (Assessment, error)
+}
+
+// Chain is a Provider that consults several providers in order, and returns
+// the most restrictive assessment. Providers that fail are treated as if they
+// returned FailureLevel.
+type Chain struct {
+	Providers    []Provider
+	FailureLevel Level
+}
+
+// AssessLogin implements the Provider interface.
+func (c Chain) AssessLogin(ctx context.Context, attempt LoginAttempt) (Assessment, error) {
+	result := Assessment{Level: LevelAllow}
+	for _, p := range c.Providers {
+		a, err := p.AssessLogin(ctx, attempt)
+		if err != nil {
+			//the full error may contain internal details like API URLs, so it only goes into the log
+			logg.Error("login risk provider failed, assuming risk level %q: %s", c.FailureLevel, err.Error())
+			a = Assessment{Level: c.FailureLevel, Reason: "login risk provider failed"}
+		}
+		if a.Level > result.Level {
+			result = a
+		}
+		if result.Level == LevelDeny {
+			break //cannot get any worse
+		}
+	}
+	return result, nil
+}
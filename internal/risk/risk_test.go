@@ -0,0 +1,153 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package risk
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func attemptFrom(addr string) LoginAttempt {
+	return LoginAttempt{ClientAddress: netip.MustParseAddr(addr), UserIdent: "john"}
+}
+
+func TestStaticList(t *testing.T) {
+	list, err := parseStaticList(strings.NewReader(`
+		# comments and empty lines are ignored
+		allow     198.51.100.0/24
+		challenge 0.0.0.0/0
+		deny      203.0.113.7 # trailing comments too
+		deny      2001:db8::/32
+	`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for addr, expected := range map[string]Level{
+		"198.51.100.42":        LevelAllow,
+		"::ffff:198.51.100.42": LevelAllow,
+		"192.0.2.1":            LevelChallenge,
+		"203.0.113.7":          LevelDeny,
+		"203.0.113.8":          LevelChallenge,
+		"2001:db8::1":          LevelDeny,
+		"2001:db9::1":          LevelAllow,
+	} {
+		a, err := list.AssessLogin(context.Background(), attemptFrom(addr))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if a.Level != expected {
+			t.Errorf("expected %s -> %s, but got %s (%s)", addr, expected, a.Level, a.Reason)
+		}
+	}
+
+	_, err = parseStaticList(strings.NewReader("allow 10.0.0.0/8\nblock 10.1.0.0/16\n"))
+	expectError(t, err, `in line 2: unknown risk level: "block"`)
+	_, err = parseStaticList(strings.NewReader("allow\n"))
+	expectError(t, err, `in line 1: expected a risk level and an address range, but got "allow"`)
+}
+
+func TestCrowdSec(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/decisions" || r.Header.Get("X-Api-Key") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Query().Get("ip") {
+		case "192.0.2.1":
+			w.Write([]byte(`[{"type":"captcha","scenario":"crowdsecurity/http-probing"}]`))
+		case "192.0.2.2":
+			w.Write([]byte(`[{"type":"captcha","scenario":"a"},{"type":"ban","scenario":"crowdsecurity/ssh-bf"}]`))
+		default:
+			w.Write([]byte(`null`))
+		}
+	}))
+	defer srv.Close()
+
+	provider := NewCrowdSec(CrowdSecOptions{URL: srv.URL + "/", APIKey: "secret", Timeout: time.Second})
+	for addr, expected := range map[string]Level{
+		"192.0.2.1":   LevelChallenge,
+		"192.0.2.2":   LevelDeny,
+		"192.0.2.3":   LevelAllow,
+		"2001:db8::1": LevelAllow,
+	} {
+		a, err := provider.AssessLogin(context.Background(), attemptFrom(addr))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if a.Level != expected {
+			t.Errorf("expected %s -> %s, but got %s (%s)", addr, expected, a.Level, a.Reason)
+		}
+	}
+
+	_, err := NewCrowdSec(CrowdSecOptions{URL: srv.URL, APIKey: "wrong", Timeout: time.Second}).
+		AssessLogin(context.Background(), attemptFrom("192.0.2.1"))
+	expectError(t, err, `while querying CrowdSec: expected 200 OK, but got 403 Forbidden: "forbidden\n"`)
+}
+
+func TestWebhookAndChain(t *testing.T) {
+	var lastRequest webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&lastRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		//the policy under test: "root" is never allowed to log in
+		if lastRequest.UserIdent == "root" {
+			w.Write([]byte(`{"level":"deny","reason":"nice try"}`))
+		} else {
+			w.Write([]byte(`{"level":"allow"}`))
+		}
+	}))
+	defer srv.Close()
+
+	hook := NewWebhook(WebhookOptions{URL: srv.URL, Timeout: time.Second})
+	attempt := LoginAttempt{ClientAddress: netip.MustParseAddr("192.0.2.1"), UserAgent: "curl/8.7.1", UserIdent: "root"}
+	a, err := hook.AssessLogin(context.Background(), attempt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "assessment", a, Assessment{Level: LevelDeny, Reason: "nice try"})
+	assert.DeepEqual(t, "request", lastRequest, webhookRequest{ClientAddress: "192.0.2.1", UserAgent: "curl/8.7.1", UserIdent: "root"})
+
+	//the chain returns the most restrictive assessment
+	list, err := parseStaticList(strings.NewReader("challenge 192.0.2.0/24\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chain := Chain{Providers: []Provider{list, hook}, FailureLevel: LevelChallenge}
+	a, _ = chain.AssessLogin(context.Background(), attempt)
+	assert.DeepEqual(t, "level for root", a.Level, LevelDeny)
+	attempt.UserIdent = "john"
+	a, _ = chain.AssessLogin(context.Background(), attempt)
+	assert.DeepEqual(t, "level for john", a.Level, LevelChallenge)
+
+	//failing providers are treated according to FailureLevel
+	srv.Close()
+	a, _ = Chain{Providers: []Provider{hook}, FailureLevel: LevelChallenge}.AssessLogin(context.Background(), attempt)
+	assert.DeepEqual(t, "level when failing closed", a.Level, LevelChallenge)
+	a, _ = Chain{Providers: []Provider{hook}, FailureLevel: LevelAllow}.AssessLogin(context.Background(), attempt)
+	assert.DeepEqual(t, "level when failing open", a.Level, LevelAllow)
+}
+
+func expectError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if err == nil {
+		t.Errorf("expected error %q, but got no error", expected)
+	} else if err.Error() != expected {
+		t.Errorf("expected error %q, but got %q", expected, err.Error())
+	}
+}
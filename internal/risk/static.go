@@ -0,0 +1,106 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package risk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// StaticList is a Provider that assigns risk levels to fixed IP ranges. It is
+// read from a file where each line contains a risk level and an IP address
+// or CIDR range, e.g.
+//
+//	# our office network is trusted
+//	allow     198.51.100.0/24
+//	challenge 0.0.0.0/0
+//	deny      203.0.113.7
+//
+// When multiple ranges contain the client address, the most specific (i.e.
+// longest) prefix wins. Addresses that do not match any range are allowed.
+type StaticList struct {
+	rules []staticRule
+}
+
+type staticRule struct {
+	Prefix netip.Prefix
+	Level  Level
+}
+
+// LoadStaticList reads a StaticList from the given file.
+func LoadStaticList(path string) (*StaticList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list, err := parseStaticList(file)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return list, nil
+}
+
+func parseStaticList(r io.Reader) (*StaticList, error) {
+	var list StaticList
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("in line %d: expected a risk level and an address range, but got %q", lineNo, strings.TrimSpace(line))
+		}
+
+		level, err := ParseLevel(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("in line %d: %w", lineNo, err)
+		}
+		var prefix netip.Prefix
+		if strings.Contains(fields[1], "/") {
+			prefix, err = netip.ParsePrefix(fields[1])
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(fields[1])
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("in line %d: %w", lineNo, err)
+		}
+		list.rules = append(list.rules, staticRule{prefix.Masked(), level})
+	}
+	return &list, scanner.Err()
+}
+
+// AssessLogin implements the Provider interface.
+func (l *StaticList) AssessLogin(_ context.Context, attempt LoginAttempt) (Assessment, error) {
+	addr := attempt.ClientAddress.Unmap()
+	var (
+		best      staticRule
+		bestFound = false
+	)
+	for _, rule := range l.rules {
+		if rule.Prefix.Contains(addr) && (!bestFound || rule.Prefix.Bits() > best.Prefix.Bits()) {
+			best, bestFound = rule, true
+		}
+	}
+	if !bestFound {
+		return Assessment{Level: LevelAllow}, nil
+	}
+	return Assessment{
+		Level:  best.Level,
+		Reason: fmt.Sprintf("client address %s matches %s in static list", addr, best.Prefix),
+	}, nil
+}
@@ -0,0 +1,71 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package sdnotify implements the client side of the sd_notify(3) protocol,
+// which is used by systemd units with Type=notify to report readiness and
+// liveness to the service manager.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notifier sends status updates to the service manager.
+type Notifier struct {
+	socketPath       string
+	watchdogInterval time.Duration
+}
+
+// FromEnvironment builds a Notifier from the environment variables set by
+// the service manager. If we were not started by a service manager that
+// expects notifications, false is returned in the second return value.
+//
+// The respective environment variables are removed from the environment, so
+// that child processes do not try to send notifications on our behalf.
+func FromEnvironment() (Notifier, bool) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	watchdogUsec := os.Getenv("WATCHDOG_USEC")
+	watchdogPID := os.Getenv("WATCHDOG_PID")
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	if socketPath == "" {
+		return Notifier{}, false
+	}
+	//sockets in the abstract namespace are announced with a leading "@"
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	n := Notifier{socketPath: socketPath}
+	usec, err := strconv.ParseUint(watchdogUsec, 10, 64)
+	if err == nil && usec > 0 && (watchdogPID == "" || watchdogPID == strconv.Itoa(os.Getpid())) {
+		n.watchdogInterval = time.Duration(usec) * time.Microsecond
+	}
+	return n, true
+}
+
+// WatchdogInterval returns how often the service manager expects to receive
+// "WATCHDOG=1" before considering the service to be hung, or 0 if the
+// watchdog is not enabled. It is customary to send pings at half this interval.
+func (n Notifier) WatchdogInterval() time.Duration {
+	return n.watchdogInterval
+}
+
+// Notify sends a message like "READY=1" or "STATUS=..." to the service manager.
+func (n Notifier) Notify(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,57 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestNotify(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	n, ok := FromEnvironment()
+	assert.DeepEqual(t, "ok", ok, true)
+	assert.DeepEqual(t, "watchdog interval", n.WatchdogInterval(), 30*time.Second)
+	assert.DeepEqual(t, "NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"), "")
+
+	err = n.Notify("READY=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	count, err := listener.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, "message", string(buf[:count]), "READY=1")
+
+	//without NOTIFY_SOCKET, nothing is expected from us
+	_, ok = FromEnvironment()
+	assert.DeepEqual(t, "ok", ok, false)
+
+	//the watchdog is only for us if WATCHDOG_PID says so
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "1")
+	n, _ = FromEnvironment()
+	assert.DeepEqual(t, "watchdog interval", n.WatchdogInterval(), time.Duration(0))
+}
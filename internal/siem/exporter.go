@@ -0,0 +1,160 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package siem ships the events from the audit log to an external SIEM
+// (security information and event management) system.
+//
+// The audit log file doubles as the queue for the export: The exporter
+// remembers how far into the file it has delivered events, and only advances
+// this position once a batch has been accepted by the target. When the target
+// is unreachable or overloaded, events therefore pile up in the audit log
+// instead of in memory, and recording new events is never slowed down by the
+// export. Delivery is at-least-once: If Portunus stops between sending a batch
+// and persisting the new position, that batch is sent again on restart.
+package siem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	// How many events are sent at once.
+	batchSize = 500
+	// How often the audit log is checked for new events while the export is
+	// caught up.
+	pollInterval = 10 * time.Second
+	// How long to wait at most before retrying after a failed delivery. The
+	// delay starts at pollInterval and doubles with each consecutive failure.
+	maxRetryDelay = 10 * time.Minute
+)
+
+// ExporterOptions contains the configuration for an Exporter.
+type ExporterOptions struct {
+	//Where the events are sent. See README for the supported URL schemes.
+	URL    string
+	Format Format
+	//If given, this is sent as the Authorization header to HTTP(S) targets.
+	Authorization string
+	//Where the export position is stored, so that restarts do not cause events
+	//to be skipped.
+	StatePath string
+}
+
+// Exporter ships events from the audit log to a SIEM.
+type Exporter struct {
+	log       *audit.Log
+	target    target
+	statePath string
+}
+
+// NewExporter instantiates an Exporter. An error is returned if the options
+// are invalid.
+func NewExporter(log *audit.Log, opts ExporterOptions) (*Exporter, error) {
+	t, err := parseTarget(opts.URL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{log: log, target: t, statePath: opts.StatePath}, nil
+}
+
+// Run exports new events as they are recorded, until `ctx` expires.
+func (e *Exporter) Run(ctx context.Context) {
+	delay := pollInterval
+	isFailing := false
+	for {
+		hasMore, err := e.exportBatch(time.Now())
+		if err == nil {
+			if isFailing {
+				logg.Info("export of audit events to SIEM has recovered")
+			}
+			isFailing = false
+			delay = pollInterval
+		} else {
+			var rae errRetryAfter
+			if errors.As(err, &rae) {
+				delay = max(delay, min(rae.Delay, maxRetryDelay))
+			}
+			logg.Error("could not export audit events to SIEM (will retry in %s): %s", delay.String(), err.Error())
+			isFailing = true
+		}
+
+		//do not wait when there is a backlog to work through
+		if hasMore && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if isFailing {
+			delay = min(2*delay, maxRetryDelay)
+		}
+	}
+}
+
+type exporterState struct {
+	//The byte offset in the audit log file up to which events have been
+	//delivered.
+	Offset int64 `json:"offset"`
+}
+
+// Sends the next batch of events. Returns whether there are more events
+// waiting to be sent.
+func (e *Exporter) exportBatch(now time.Time) (hasMore bool, err error) {
+	var state exporterState
+	buf, err := os.ReadFile(e.statePath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		//on first start, the export begins at the start of the audit log
+	case err != nil:
+		return false, err
+	default:
+		err = json.Unmarshal(buf, &state)
+		if err != nil {
+			return false, fmt.Errorf("while parsing %s: %w", e.statePath, err)
+		}
+	}
+
+	events, offset, err := e.log.ReadEventsAt(state.Offset, batchSize)
+	if errors.Is(err, audit.ErrOffsetOutOfRange) {
+		logg.Info("audit log is shorter than the export position in %s, so it was probably replaced; restarting the SIEM export from the start of the audit log", e.statePath)
+		events, offset, err = e.log.ReadEventsAt(0, batchSize)
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(events) == 0 {
+		return false, nil
+	}
+
+	err = e.target.Send(events, now)
+	if err != nil {
+		return false, err
+	}
+	err = e.writeState(exporterState{Offset: offset})
+	if err != nil {
+		return false, err
+	}
+	return len(events) == batchSize, nil
+}
+
+func (e *Exporter) writeState(state exporterState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(e.statePath, buf, 0600)
+}
@@ -0,0 +1,256 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package siem
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/buildinfo"
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/assert"
+)
+
+var (
+	t0      = time.Unix(1700000000, 0).UTC()
+	admin   = core.Actor{Type: core.ActorTypeUser, Name: "admin"}
+	events0 = []audit.Event{
+		{
+			Time:    t0,
+			Type:    audit.EventLoginFailed,
+			Actor:   core.Actor{Type: core.ActorTypeUser, Name: "jane"},
+			Subject: "jane",
+			Message: "failed login attempt with wrong password",
+			Details: map[string]string{"ip": "192.0.2.1", "user_agent": "curl/8.0", "country": "DE"},
+		},
+		{
+			Time:    t0.Add(time.Minute),
+			Type:    audit.EventGroupMembersChanged,
+			Actor:   admin,
+			Group:   "admins",
+			Message: "members were changed (1 added, 0 removed)",
+			Details: map[string]string{"added": "jane", "removed": "", "permissions": "Portunus admin"},
+		},
+	}
+)
+
+func setupExportTest(t *testing.T, format Format, targetURL string) (*audit.Log, *Exporter) {
+	t.Helper()
+	dir := t.TempDir()
+	log, err := audit.OpenLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, e := range events0 {
+		err := log.Record(e)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	exporter, err := NewExporter(log, ExporterOptions{
+		URL:           targetURL,
+		Format:        format,
+		Authorization: "Bearer secret",
+		StatePath:     filepath.Join(dir, "siem-export-state.json"),
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return log, exporter
+}
+
+func TestCEFFormat(t *testing.T) {
+	line, err := FormatCEF.Serialize(events0[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := fmt.Sprintf(`CEF:0|Portunus|Portunus|%s|login-failed|failed login attempt with wrong password|7|`, buildinfo.Get().Version) +
+		`rt=1700000000000 cs1Label=actorType cs1=user suser=jane duser=jane src=192.0.2.1 requestClientApplication=curl/8.0 ` +
+		`cs3Label=details cs3={"country":"DE"} msg=failed login attempt with wrong password`
+	assert.DeepEqual(t, "CEF line", string(line), expected)
+
+	//special characters are escaped
+	line, err = FormatCEF.Serialize(audit.Event{
+		Time:    t0,
+		Type:    audit.EventTOTPReset,
+		Actor:   admin,
+		Subject: "jane",
+		Message: "reset | verified=yes\nby phone",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "escaped CEF line", strings.SplitN(string(line), "|", 6)[5],
+		`reset \| verified=yes by phone|5|rt=1700000000000 cs1Label=actorType cs1=user suser=admin duser=jane msg=reset | verified\=yes\nby phone`)
+}
+
+func TestExportToSpoolDirectory(t *testing.T) {
+	spoolDir := t.TempDir()
+	log, exporter := setupExportTest(t, FormatJSON, "file://"+spoolDir)
+	readSpool := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(spoolDir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var contents []string
+		for _, entry := range entries {
+			buf, err := os.ReadFile(filepath.Join(spoolDir, entry.Name()))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			contents = append(contents, string(buf))
+			os.Remove(filepath.Join(spoolDir, entry.Name()))
+		}
+		return contents
+	}
+
+	//the first batch contains the entire audit log so far
+	hasMore, err := exporter.exportBatch(t0.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "hasMore", hasMore, false)
+	contents := readSpool()
+	assert.DeepEqual(t, "number of spool files", len(contents), 1)
+	lines := strings.Split(strings.TrimSuffix(contents[0], "\n"), "\n")
+	assert.DeepEqual(t, "number of events in spool file", len(lines), 2)
+	assert.DeepEqual(t, "first event", strings.HasPrefix(lines[0], `{"time":"2023-11-14T22:13:20Z","type":"login-failed"`), true)
+
+	//without new events, nothing is written
+	_, err = exporter.exportBatch(t0.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "spool files without new events", readSpool(), []string(nil))
+
+	//when the consumer does not keep up, the export pauses...
+	for idx := range maxSpoolFiles {
+		err := os.WriteFile(filepath.Join(spoolDir, fmt.Sprintf("unconsumed-%d", idx)), nil, 0600)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err = log.Record(audit.Event{Time: t0.Add(3 * time.Hour), Type: audit.EventLogin, Actor: admin, Subject: "admin", Message: "successful login"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = exporter.exportBatch(t0.Add(3 * time.Hour))
+	assert.DeepEqual(t, "error for full spool", err.Error(), fmt.Sprintf("spool directory %s contains 1000 files that have not been picked up yet", spoolDir))
+
+	//...and continues where it left off once the spool has been consumed
+	readSpool()
+	_, err = exporter.exportBatch(t0.Add(4 * time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	contents = readSpool()
+	assert.DeepEqual(t, "number of spool files after catching up", len(contents), 1)
+	assert.DeepEqual(t, "events after catching up", strings.Count(contents[0], "\n"), 1)
+	assert.DeepEqual(t, "event after catching up", strings.Contains(contents[0], `"successful login"`), true)
+}
+
+func TestExportToHTTP(t *testing.T) {
+	var (
+		receivedBodies []string
+		statusCode     = http.StatusServiceUnavailable
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if statusCode != http.StatusOK {
+			w.Header().Set("Retry-After", "120")
+			http.Error(w, "overloaded", statusCode)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		receivedBodies = append(receivedBodies, r.Header.Get("Content-Type")+"\n"+string(body))
+	}))
+	t.Cleanup(server.Close)
+	_, exporter := setupExportTest(t, FormatCEF, server.URL+"/ingest")
+
+	//an overloaded receiver can ask us to back off
+	_, err := exporter.exportBatch(t0.Add(time.Hour))
+	var rae errRetryAfter
+	assert.DeepEqual(t, "error is errRetryAfter", errors.As(err, &rae), true)
+	assert.DeepEqual(t, "retry delay", rae.Delay, 2*time.Minute)
+
+	//the batch is sent again on the next attempt
+	statusCode = http.StatusOK
+	_, err = exporter.exportBatch(t0.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of requests", len(receivedBodies), 1)
+	lines := strings.Split(strings.TrimSuffix(receivedBodies[0], "\n"), "\n")
+	assert.DeepEqual(t, "content type", lines[0], "text/plain; charset=utf-8")
+	assert.DeepEqual(t, "number of events", len(lines)-1, 2)
+	assert.DeepEqual(t, "second event", strings.Contains(lines[2], "|group-members-changed|"), true)
+}
+
+func TestExportToSyslog(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		//read messages with octet-counting framing
+		var messages []string
+		reader := bufio.NewReader(conn)
+		for {
+			lengthStr, err := reader.ReadString(' ')
+			if err != nil {
+				break
+			}
+			length, _ := strconv.Atoi(strings.TrimSuffix(lengthStr, " "))
+			buf := make([]byte, length)
+			_, err = io.ReadFull(reader, buf)
+			if err != nil {
+				break
+			}
+			messages = append(messages, string(buf))
+		}
+		received <- messages
+	}()
+
+	_, exporter := setupExportTest(t, FormatJSON, "syslog+tcp://"+listener.Addr().String())
+	exporter.target = syslogTarget{Network: "tcp", Address: listener.Addr().String(), Hostname: "portunus.example.org", Format: FormatJSON}
+	_, err = exporter.exportBatch(time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	messages := <-received
+	assert.DeepEqual(t, "number of messages", len(messages), 2)
+	prefixes := []string{
+		fmt.Sprintf(`<84>1 2023-11-14T22:13:20.000000Z portunus.example.org portunus %d login-failed - {"time":`, os.Getpid()),
+		fmt.Sprintf(`<86>1 2023-11-14T22:14:20.000000Z portunus.example.org portunus %d group-members-changed - {"time":`, os.Getpid()),
+	}
+	for idx, prefix := range prefixes {
+		assert.DeepEqual(t, fmt.Sprintf("message %d has expected header", idx), strings.HasPrefix(messages[idx], prefix), true)
+	}
+}
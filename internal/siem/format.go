@@ -0,0 +1,140 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package siem
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/majewsky/portunus/internal/audit"
+	"github.com/majewsky/portunus/internal/buildinfo"
+)
+
+// Format is an enum that appears in type ExporterOptions. It controls how
+// each event is serialized.
+type Format string
+
+const (
+	// FormatJSON is the default. Each event is serialized as a JSON object, in
+	// the same way as in the audit log file.
+	FormatJSON Format = "json"
+	// FormatCEF serializes each event in the Common Event Format that is
+	// understood by most SIEM systems.
+	FormatCEF Format = "cef"
+)
+
+// ParseFormat parses the value of the PORTUNUS_SIEM_EXPORT_FORMAT variable.
+// The empty string is accepted as FormatJSON.
+func ParseFormat(input string) (Format, error) {
+	switch f := Format(input); f {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatCEF:
+		return f, nil
+	default:
+		return "", fmt.Errorf(`invalid value for PORTUNUS_SIEM_EXPORT_FORMAT: %q (expected "json" or "cef")`, input)
+	}
+}
+
+// Serialize renders the given event in this format, as a single line without
+// the trailing newline.
+func (f Format) Serialize(e audit.Event) ([]byte, error) {
+	switch f {
+	case FormatCEF:
+		return []byte(renderCEF(e)), nil
+	default:
+		return json.Marshal(e)
+	}
+}
+
+// severity is the importance of an event, as far as a SIEM is concerned.
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityNotice
+	severityWarning
+)
+
+func severityOf(e audit.Event) severity {
+	switch e.Type {
+	case audit.EventLoginFailed, audit.EventLoginBlocked:
+		return severityWarning
+	case audit.EventTOTPReset, audit.EventDatabaseRestored, audit.EventGroupPermissionsChanged:
+		return severityNotice
+	default:
+		return severityInfo
+	}
+}
+
+// Details that have a standard field in CEF. All other details are put into
+// a custom field as JSON.
+var cefDetailFields = map[string]string{
+	"ip":         "src",
+	"user_agent": "requestClientApplication",
+}
+
+// Renders an event in the Common Event Format, version 0.
+func renderCEF(e audit.Event) string {
+	cefSeverity := map[severity]int{severityInfo: 3, severityNotice: 5, severityWarning: 7}[severityOf(e)]
+	header := []string{
+		"CEF:0",
+		"Portunus",
+		"Portunus",
+		escapeCEFHeader(buildinfo.Get().Version),
+		escapeCEFHeader(string(e.Type)),
+		escapeCEFHeader(e.Message),
+		strconv.Itoa(cefSeverity),
+	}
+
+	fields := []string{
+		"rt=" + strconv.FormatInt(e.Time.UnixMilli(), 10),
+		"cs1Label=actorType",
+		"cs1=" + escapeCEFValue(string(e.Actor.Type)),
+	}
+	if e.Actor.Name != "" {
+		fields = append(fields, "suser="+escapeCEFValue(e.Actor.Name))
+	}
+	if e.Subject != "" {
+		fields = append(fields, "duser="+escapeCEFValue(e.Subject))
+	}
+	if e.Group != "" {
+		fields = append(fields, "cs2Label=group", "cs2="+escapeCEFValue(e.Group))
+	}
+	otherDetails := make(map[string]string)
+	for _, key := range slices.Sorted(maps.Keys(e.Details)) {
+		if name, exists := cefDetailFields[key]; exists {
+			fields = append(fields, name+"="+escapeCEFValue(e.Details[key]))
+		} else {
+			otherDetails[key] = e.Details[key]
+		}
+	}
+	if len(otherDetails) > 0 {
+		buf, _ := json.Marshal(otherDetails) //cannot fail for map[string]string
+		fields = append(fields, "cs3Label=details", "cs3="+escapeCEFValue(string(buf)))
+	}
+	fields = append(fields, "msg="+escapeCEFValue(e.Message))
+
+	return strings.Join(header, "|") + "|" + strings.Join(fields, " ")
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func escapeCEFHeader(value string) string {
+	return cefHeaderEscaper.Replace(value)
+}
+
+func escapeCEFValue(value string) string {
+	return cefValueEscaper.Replace(value)
+}
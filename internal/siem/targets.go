@@ -0,0 +1,279 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package siem
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majewsky/portunus/internal/audit"
+)
+
+// target is where the exported events go. Send() must either deliver the
+// entire batch or return an error, in which case the batch is sent again
+// later.
+type target interface {
+	Send(events []audit.Event, now time.Time) error
+}
+
+// Serializes the given events with one line per event.
+func serializeLines(events []audit.Event, format Format) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, e := range events {
+		line, err := format.Serialize(e)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// errRetryAfter is returned by a target that was told by the receiving end
+// how long to wait before the next attempt.
+type errRetryAfter struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e errRetryAfter) Error() string {
+	return e.Err.Error()
+}
+
+// How long each delivery to a remote target may take.
+const sendTimeout = 30 * time.Second
+
+// Parses the value of PORTUNUS_SIEM_EXPORT_URL.
+func parseTarget(rawURL string, opts ExporterOptions) (target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for PORTUNUS_SIEM_EXPORT_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return httpTarget{
+			URL:           rawURL,
+			Authorization: opts.Authorization,
+			Format:        opts.Format,
+			Client:        &http.Client{Timeout: sendTimeout},
+		}, nil
+	case "syslog+udp", "syslog+tcp", "syslog+tls":
+		if u.Host == "" || u.Port() == "" {
+			return nil, fmt.Errorf("invalid value for PORTUNUS_SIEM_EXPORT_URL: %q does not have a host and port", rawURL)
+		}
+		hostname, _ := os.Hostname()
+		return syslogTarget{
+			Network:  strings.TrimPrefix(u.Scheme, "syslog+"),
+			Address:  u.Host,
+			Hostname: hostname,
+			Format:   opts.Format,
+		}, nil
+	case "file":
+		if u.Host != "" || !filepath.IsAbs(u.Path) {
+			return nil, fmt.Errorf("invalid value for PORTUNUS_SIEM_EXPORT_URL: %q does not refer to an absolute path", rawURL)
+		}
+		return spoolTarget{Dir: u.Path, Format: opts.Format}, nil
+	default:
+		return nil, fmt.Errorf(`invalid value for PORTUNUS_SIEM_EXPORT_URL: unsupported scheme %q (expected "https", "syslog+udp", "syslog+tcp", "syslog+tls" or "file")`, u.Scheme)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// HTTPS bulk export
+
+// httpTarget sends each batch as one POST request, with one event per line.
+type httpTarget struct {
+	URL           string
+	Authorization string //optional
+	Format        Format
+	Client        *http.Client
+}
+
+// Send implements the target interface.
+func (t httpTarget) Send(events []audit.Event, _ time.Time) error {
+	body, err := serializeLines(events, t.Format)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if t.Format == FormatCEF {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if t.Authorization != "" {
+		req.Header.Set("Authorization", t.Authorization)
+	}
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("POST %s returned %s: %q", t.URL, resp.Status, string(respBody))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		//the receiving end is overloaded and may tell us how long to back off
+		seconds, parseErr := strconv.ParseUint(resp.Header.Get("Retry-After"), 10, 32)
+		if parseErr == nil {
+			return errRetryAfter{err, time.Duration(seconds) * time.Second}
+		}
+	}
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// syslog
+
+// syslogTarget sends each event as a syslog message in the format from
+// RFC 5424. Over TCP and TLS, messages are framed with octet counting
+// (RFC 6587, section 3.4.1, and RFC 5425).
+type syslogTarget struct {
+	Network  string //"udp", "tcp" or "tls"
+	Address  string
+	Hostname string
+	Format   Format
+}
+
+// Events are logged in the "authpriv" facility.
+const syslogFacility = 10
+
+var syslogSeverity = map[severity]int{
+	severityInfo:    6,
+	severityNotice:  5,
+	severityWarning: 4,
+}
+
+// Send implements the target interface.
+func (t syslogTarget) Send(events []audit.Event, now time.Time) error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: sendTimeout}
+	if t.Network == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.Address, nil)
+	} else {
+		conn, err = dialer.Dial(t.Network, t.Address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(now.Add(sendTimeout))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		buf, err := t.renderMessage(e)
+		if err != nil {
+			return err
+		}
+		if t.Network != "udp" {
+			buf = append([]byte(strconv.Itoa(len(buf))+" "), buf...)
+		}
+		_, err = conn.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Close()
+}
+
+// Renders the message for an event in the format from RFC 5424, section 6.
+// The event type is used as the message ID.
+func (t syslogTarget) renderMessage(e audit.Event) ([]byte, error) {
+	body, err := t.Format.Serialize(e)
+	if err != nil {
+		return nil, err
+	}
+	hostname := t.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	header := fmt.Sprintf("<%d>1 %s %s portunus %d %s - ",
+		syslogFacility*8+syslogSeverity[severityOf(e)],
+		e.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, os.Getpid(), e.Type)
+	return append([]byte(header), body...), nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// spool directory
+
+// How many unconsumed files may be in the spool directory. When this many
+// files have not been picked up yet, the export pauses until the consumer has
+// caught up.
+const maxSpoolFiles = 1000
+
+// spoolTarget writes each batch into a new file in a spool directory, from
+// where a log shipper (or the SIEM itself) picks them up and deletes them.
+type spoolTarget struct {
+	Dir    string
+	Format Format
+}
+
+// Send implements the target interface.
+func (t spoolTarget) Send(events []audit.Event, now time.Time) error {
+	entries, err := os.ReadDir(t.Dir)
+	if err != nil {
+		return err
+	}
+	fileCount := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			fileCount++
+		}
+	}
+	if fileCount >= maxSpoolFiles {
+		return fmt.Errorf("spool directory %s contains %d files that have not been picked up yet", t.Dir, fileCount)
+	}
+
+	buf, err := serializeLines(events, t.Format)
+	if err != nil {
+		return err
+	}
+
+	//files are written under a hidden name and then renamed into place, so that
+	//the consumer never sees incomplete files
+	extension := ".jsonl"
+	if t.Format == FormatCEF {
+		extension = ".cef"
+	}
+	name := fmt.Sprintf("portunus-%s%s", now.UTC().Format("20060102T150405.000000000Z"), extension)
+	tmpPath := filepath.Join(t.Dir, ".tmp-"+name)
+	err = os.WriteFile(tmpPath, buf, 0640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, filepath.Join(t.Dir, name))
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package stats collects statistics about the size of the Portunus database
+// and the LDAP directory, and keeps a daily history of them for capacity
+// planning. The most pressing limit is the maxsize of slapd's mdb database
+// (see ldap.MDBMaxSize), which cannot be raised while slapd is running.
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// How many daily samples are retained in the history.
+const historySize = 730
+
+// Sample contains the statistics at one point in time.
+type Sample struct {
+	Time                time.Time `json:"time"`
+	UserCount           int       `json:"users"`
+	GroupCount          int       `json:"groups"`
+	ServiceAccountCount int       `json:"service_accounts"`
+	StoreFileSize       int64     `json:"store_file_size"` //in bytes
+	//Only filled if there is LDAP synchronization (see ldap.AdapterStatus).
+	LDAPObjectCount     int    `json:"ldap_objects,omitempty"`
+	LDAPTotalObjectSize uint64 `json:"ldap_total_object_size,omitempty"` //in bytes
+}
+
+// AverageLDAPObjectSize returns the average size of an LDAP object in bytes,
+// or 0 if there are no LDAP objects.
+func (s Sample) AverageLDAPObjectSize() uint64 {
+	if s.LDAPObjectCount == 0 {
+		return 0
+	}
+	return s.LDAPTotalObjectSize / uint64(s.LDAPObjectCount)
+}
+
+// CollectorOptions contains the configuration for a Collector.
+type CollectorOptions struct {
+	StorePath   string //path to the database file (empty if there is none, e.g. with PostgreSQL)
+	HistoryPath string //where the history of daily samples is persisted
+	//Optional. If nil (e.g. when Portunus serves LDAP by itself), the LDAP
+	//fields of each Sample are left empty.
+	LDAPStatus func() ldap.AdapterStatus
+}
+
+// Collector takes samples of the current statistics, and records one sample
+// per day into its history.
+type Collector struct {
+	nexus   core.Nexus
+	opts    CollectorOptions
+	mutex   sync.Mutex
+	history []Sample
+	//can be replaced in tests
+	now func() time.Time
+}
+
+// NewCollector instantiates a Collector, and loads its history from
+// CollectorOptions.HistoryPath if it exists.
+func NewCollector(nexus core.Nexus, opts CollectorOptions) (*Collector, error) {
+	c := &Collector{nexus: nexus, opts: opts, now: time.Now}
+	buf, err := os.ReadFile(opts.HistoryPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return c, nil
+	case err != nil:
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &c.history)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing %s: %w", opts.HistoryPath, err)
+	}
+	return c, nil
+}
+
+// Run records a sample into the history once per day, until `ctx` expires.
+// The first sample is only taken after an hour, so that the LDAP adapter has
+// long finished its initial synchronization.
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.recordIfDue()
+		if err != nil {
+			//we will try again on the next tick
+			logg.Error("could not record database statistics: %s", err.Error())
+		}
+	}
+}
+
+// Current takes a sample of the current statistics.
+func (c *Collector) Current() Sample {
+	s := Sample{
+		Time:                c.now(),
+		UserCount:           len(c.nexus.ListUsers()),
+		GroupCount:          len(c.nexus.ListGroups()),
+		ServiceAccountCount: len(c.nexus.ListServiceAccounts()),
+	}
+	fi, err := os.Stat(c.opts.StorePath)
+	if err == nil {
+		s.StoreFileSize = fi.Size()
+	}
+	if c.opts.LDAPStatus != nil {
+		status := c.opts.LDAPStatus()
+		s.LDAPObjectCount = status.ObjectCount
+		s.LDAPTotalObjectSize = status.TotalObjectSize
+	}
+	return s
+}
+
+// LDAPStatus returns the current status of the LDAP synchronization, or nil
+// if there is none (see CollectorOptions.LDAPStatus).
+func (c *Collector) LDAPStatus() *ldap.AdapterStatus {
+	if c.opts.LDAPStatus == nil {
+		return nil
+	}
+	status := c.opts.LDAPStatus()
+	return &status
+}
+
+// History returns the recorded daily samples, oldest first.
+func (c *Collector) History() []Sample {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.history)
+}
+
+func (c *Collector) recordIfDue() error {
+	s := c.Current()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.history) > 0 {
+		last := c.history[len(c.history)-1]
+		if last.Time.UTC().Format(time.DateOnly) == s.Time.UTC().Format(time.DateOnly) {
+			return nil
+		}
+	}
+	c.history = append(c.history, s)
+	if len(c.history) > historySize {
+		c.history = slices.Clone(c.history[len(c.history)-historySize:])
+	}
+
+	buf, err := json.Marshal(c.history)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.opts.HistoryPath, buf, 0600)
+}
+
+// ProjectLDAPExhaustion estimates when the total size of all LDAP objects
+// will reach the given limit, by extrapolating linearly from the history. The
+// second return value is false if there is not enough history, or if the size
+// is not growing.
+func ProjectLDAPExhaustion(history []Sample, limit uint64) (time.Time, bool) {
+	if len(history) < 2 {
+		return time.Time{}, false
+	}
+	first := history[0]
+	last := history[len(history)-1]
+	elapsed := last.Time.Sub(first.Time)
+	if elapsed < 24*time.Hour || last.LDAPTotalObjectSize <= first.LDAPTotalObjectSize {
+		return time.Time{}, false
+	}
+	if last.LDAPTotalObjectSize >= limit {
+		return last.Time, true
+	}
+
+	growth := float64(last.LDAPTotalObjectSize - first.LDAPTotalObjectSize)
+	remaining := float64(limit - last.LDAPTotalObjectSize)
+	return last.Time.Add(time.Duration(float64(elapsed) * remaining / growth)), true
+}
+
+// RenderMetrics renders the given sample in the Prometheus text exposition
+// format. If the history allows for a projection, the result of
+// ProjectLDAPExhaustion() for ldap.MDBMaxSize is included as well. If
+// `ldapStatus` is not nil, the counters for LDAP write operations are
+// included, too.
+func RenderMetrics(current Sample, history []Sample, ldapStatus *ldap.AdapterStatus) []byte {
+	var buf bytes.Buffer
+	metric := func(metricType, name, help string, value any) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, value)
+	}
+	gauge := func(name, help string, value any) { metric("gauge", name, help, value) }
+	counter := func(name, help string, value any) { metric("counter", name, help, value) }
+	gauge("portunus_users", "Number of users.", current.UserCount)
+	gauge("portunus_groups", "Number of groups.", current.GroupCount)
+	gauge("portunus_service_accounts", "Number of service accounts.", current.ServiceAccountCount)
+	gauge("portunus_database_file_size_bytes", "Size of the database file.", current.StoreFileSize)
+	if ldapStatus != nil {
+		counter("portunus_ldap_successful_writes_total", "Number of successful write operations on the LDAP server since startup.", ldapStatus.SuccessfulOperations)
+		counter("portunus_ldap_failed_writes_total", "Number of failed write operations on the LDAP server since startup.", ldapStatus.FailedOperations)
+		counter("portunus_ldap_retried_writes_total", "Number of write operations on the LDAP server since startup that were attempted again after an earlier failure.", ldapStatus.RetriedOperations)
+		gauge("portunus_ldap_failing_objects", "Number of LDAP objects whose most recent write failed.", len(ldapStatus.Failures))
+	}
+	if current.LDAPObjectCount == 0 {
+		return buf.Bytes()
+	}
+
+	gauge("portunus_ldap_objects", "Number of LDAP objects rendered from the database.", current.LDAPObjectCount)
+	gauge("portunus_ldap_objects_size_bytes", "Combined length of the DNs, attribute types and values of all LDAP objects.", current.LDAPTotalObjectSize)
+	gauge("portunus_ldap_object_average_size_bytes", "Average size of an LDAP object.", current.AverageLDAPObjectSize())
+	gauge("portunus_ldap_mdb_maxsize_bytes", "Maximum size of the LDAP server's database.", ldap.MDBMaxSize)
+	if t, ok := ProjectLDAPExhaustion(history, ldap.MDBMaxSize); ok {
+		gauge("portunus_ldap_mdb_maxsize_projected_timestamp_seconds", "When the size of all LDAP objects will reach the maximum database size, if the growth of the recorded history continues.", t.Unix())
+	}
+	return buf.Bytes()
+}
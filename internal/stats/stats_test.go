@@ -0,0 +1,173 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/ldap"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+func TestRecordHistory(t *testing.T) {
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Users = []core.User{{LoginName: "alice", GivenName: "Alice", FamilyName: "Admin"}}
+		db.Groups = []core.Group{{Name: "admins", LongName: "Administrators"}}
+		return nil
+	}, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+
+	opts := CollectorOptions{
+		StorePath:   filepath.Join(t.TempDir(), "database.json"),
+		HistoryPath: filepath.Join(t.TempDir(), "stats-history.json"),
+		LDAPStatus: func() ldap.AdapterStatus {
+			return ldap.AdapterStatus{ObjectCount: 4, TotalObjectSize: 1000}
+		},
+	}
+	clock := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	makeCollector := func() *Collector {
+		c, err := NewCollector(nexus, opts)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		c.now = func() time.Time { return clock }
+		return c
+	}
+	record := func(c *Collector) {
+		t.Helper()
+		err := c.recordIfDue()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//only one sample is recorded per day
+	c := makeCollector()
+	record(c)
+	clock = clock.Add(10 * time.Hour)
+	record(c)
+	assert.DeepEqual(t, "number of samples", len(c.History()), 1)
+	assert.DeepEqual(t, "first sample", c.History()[0], Sample{
+		Time:                time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC),
+		UserCount:           1,
+		GroupCount:          1,
+		LDAPObjectCount:     4,
+		LDAPTotalObjectSize: 1000,
+	})
+	clock = clock.Add(10 * time.Hour)
+	record(c)
+	assert.DeepEqual(t, "number of samples", len(c.History()), 2)
+
+	//the history survives a restart
+	c = makeCollector()
+	assert.DeepEqual(t, "number of samples after reload", len(c.History()), 2)
+	assert.DeepEqual(t, "reloaded sample", c.History()[1].Time.Equal(clock), true)
+}
+
+func TestProjectLDAPExhaustion(t *testing.T) {
+	start := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	sample := func(days int, size uint64) Sample {
+		return Sample{Time: start.AddDate(0, 0, days), LDAPTotalObjectSize: size}
+	}
+
+	//not enough history
+	_, ok := ProjectLDAPExhaustion(nil, 1000)
+	assert.DeepEqual(t, "projection without history", ok, false)
+	_, ok = ProjectLDAPExhaustion([]Sample{sample(0, 100)}, 1000)
+	assert.DeepEqual(t, "projection with one sample", ok, false)
+
+	//no growth
+	_, ok = ProjectLDAPExhaustion([]Sample{sample(0, 200), sample(10, 100)}, 1000)
+	assert.DeepEqual(t, "projection while shrinking", ok, false)
+
+	//linear growth of 10 per day, 500 remaining
+	exhaustedAt, ok := ProjectLDAPExhaustion([]Sample{sample(0, 400), sample(5, 450), sample(10, 500)}, 1000)
+	assert.DeepEqual(t, "projection while growing", ok, true)
+	assert.DeepEqual(t, "projected time", exhaustedAt, start.AddDate(0, 0, 60))
+
+	//limit already reached
+	exhaustedAt, ok = ProjectLDAPExhaustion([]Sample{sample(0, 400), sample(10, 1200)}, 1000)
+	assert.DeepEqual(t, "projection beyond limit", ok, true)
+	assert.DeepEqual(t, "projected time", exhaustedAt, start.AddDate(0, 0, 10))
+}
+
+func TestRenderMetrics(t *testing.T) {
+	current := Sample{UserCount: 3, GroupCount: 2, StoreFileSize: 4096}
+	assert.DeepEqual(t, "metrics without LDAP", string(RenderMetrics(current, nil, nil)), `# HELP portunus_users Number of users.
+# TYPE portunus_users gauge
+portunus_users 3
+# HELP portunus_groups Number of groups.
+# TYPE portunus_groups gauge
+portunus_groups 2
+# HELP portunus_service_accounts Number of service accounts.
+# TYPE portunus_service_accounts gauge
+portunus_service_accounts 0
+# HELP portunus_database_file_size_bytes Size of the database file.
+# TYPE portunus_database_file_size_bytes gauge
+portunus_database_file_size_bytes 4096
+`)
+
+	start := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	current.LDAPObjectCount = 8
+	current.LDAPTotalObjectSize = 2000
+	history := []Sample{
+		{Time: start, LDAPTotalObjectSize: ldap.MDBMaxSize / 4},
+		{Time: start.AddDate(0, 0, 1), LDAPTotalObjectSize: ldap.MDBMaxSize / 2},
+	}
+	assert.DeepEqual(t, "metrics with LDAP", string(RenderMetrics(current, history, &ldap.AdapterStatus{
+		SuccessfulOperations: 42,
+		FailedOperations:     3,
+		RetriedOperations:    2,
+		Failures:             []ldap.OperationFailure{{DN: "uid=jane,ou=users,dc=example,dc=org"}},
+	})), `# HELP portunus_users Number of users.
+# TYPE portunus_users gauge
+portunus_users 3
+# HELP portunus_groups Number of groups.
+# TYPE portunus_groups gauge
+portunus_groups 2
+# HELP portunus_service_accounts Number of service accounts.
+# TYPE portunus_service_accounts gauge
+portunus_service_accounts 0
+# HELP portunus_database_file_size_bytes Size of the database file.
+# TYPE portunus_database_file_size_bytes gauge
+portunus_database_file_size_bytes 4096
+# HELP portunus_ldap_successful_writes_total Number of successful write operations on the LDAP server since startup.
+# TYPE portunus_ldap_successful_writes_total counter
+portunus_ldap_successful_writes_total 42
+# HELP portunus_ldap_failed_writes_total Number of failed write operations on the LDAP server since startup.
+# TYPE portunus_ldap_failed_writes_total counter
+portunus_ldap_failed_writes_total 3
+# HELP portunus_ldap_retried_writes_total Number of write operations on the LDAP server since startup that were attempted again after an earlier failure.
+# TYPE portunus_ldap_retried_writes_total counter
+portunus_ldap_retried_writes_total 2
+# HELP portunus_ldap_failing_objects Number of LDAP objects whose most recent write failed.
+# TYPE portunus_ldap_failing_objects gauge
+portunus_ldap_failing_objects 1
+# HELP portunus_ldap_objects Number of LDAP objects rendered from the database.
+# TYPE portunus_ldap_objects gauge
+portunus_ldap_objects 8
+# HELP portunus_ldap_objects_size_bytes Combined length of the DNs, attribute types and values of all LDAP objects.
+# TYPE portunus_ldap_objects_size_bytes gauge
+portunus_ldap_objects_size_bytes 2000
+# HELP portunus_ldap_object_average_size_bytes Average size of an LDAP object.
+# TYPE portunus_ldap_object_average_size_bytes gauge
+portunus_ldap_object_average_size_bytes 250
+# HELP portunus_ldap_mdb_maxsize_bytes Maximum size of the LDAP server's database.
+# TYPE portunus_ldap_mdb_maxsize_bytes gauge
+portunus_ldap_mdb_maxsize_bytes 1073741824
+# HELP portunus_ldap_mdb_maxsize_projected_timestamp_seconds When the size of all LDAP objects will reach the maximum database size, if the growth of the recorded history continues.
+# TYPE portunus_ldap_mdb_maxsize_projected_timestamp_seconds gauge
+portunus_ldap_mdb_maxsize_projected_timestamp_seconds 1709769600
+`)
+}
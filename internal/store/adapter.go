@@ -13,10 +13,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/majewsky/portunus/internal/core"
 	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
 )
 
 // Adapter translates between the Portunus database and the disk store.
@@ -25,22 +27,26 @@ type Adapter struct {
 	//Run(), so we don't have any concurrency to deal with.
 	nexus     core.Nexus
 	storePath string
+	backups   BackupOptions
 	//This contains the known contents of the store file. We maintain this to
 	//avoid useless roundtrip writes from disk -> nexus -> disk.
 	diskState []byte
 	//This is set when we signal ErrDatabaseNeedsInitialization to the nexus, to
 	//instruct Run() to wait for the response before continuing.
 	initPending bool
+	//The schema version of the store file, or 0 if unknown. This is the only
+	//field that is also read outside of Run(), by UpgradeNotes().
+	storedSchemaVersion atomic.Uint32
 }
 
 // NewAdapter initializes an Adapter instance.
-func NewAdapter(nexus core.Nexus, storePath string) *Adapter {
-	return &Adapter{nexus: nexus, storePath: storePath}
+func NewAdapter(nexus core.Nexus, storePath string, backups BackupOptions) *Adapter {
+	return &Adapter{nexus: nexus, storePath: storePath, backups: backups}
 }
 
 // Run listens for and propagates changes to the Portunus database and the disk
-// store until `ctx` expires. An error is returned if any write into the LDAP
-// database fails.
+// store until `ctx` expires. An error is returned if any write into the disk
+// store fails. Pending writes are flushed before Run() returns.
 func (a *Adapter) Run(ctx context.Context) error {
 	//first read initializes the internal database from the pre-existing store
 	//file (or marks that initialization is required)
@@ -57,7 +63,13 @@ func (a *Adapter) Run(ctx context.Context) error {
 	//writes get sent to us from whatever goroutine the nexus update is running on
 	writeChan := make(chan core.Database, 1)
 	a.nexus.AddListener(ctxListen, func(db core.Database) {
-		writeChan <- db
+		//if we stop listening between the nexus checking `ctxListen` and us
+		//getting here, the send could block forever (and with it, the nexus
+		//update that is calling us), so we need to watch `ctxListen` here as well
+		select {
+		case writeChan <- db:
+		case <-ctxListen.Done():
+		}
 	})
 
 	//if we instructed the nexus to perform first-time initialization, we need to
@@ -85,6 +97,18 @@ LOOP:
 	for {
 		select {
 		case <-ctx.Done():
+			//if an update came in right before we were stopped, make sure that it
+			//does not get lost
+			select {
+			case db := <-writeChan:
+				err = watcher.WhileSuspended(func() error {
+					return a.writeDatabase(db)
+				})
+				if err != nil {
+					return err
+				}
+			default:
+			}
 			break LOOP
 		case err := <-watcher.Backend.Errors:
 			return fmt.Errorf("error while watching %s for changes: %w", a.storePath, err)
@@ -121,9 +145,15 @@ LOOP:
 // persistedDatabase is a variant of type Database. This is what gets
 // persisted into the database file.
 type persistedDatabase struct {
-	Users         []core.User  `json:"users"`
-	Groups        []core.Group `json:"groups"`
-	SchemaVersion uint         `json:"schema_version"`
+	Users            []core.User                      `json:"users"`
+	Groups           []core.Group                     `json:"groups"`
+	ServiceAccounts  []core.ServiceAccount            `json:"service_accounts,omitempty"`
+	AccessReviews    []core.AccessReview              `json:"access_reviews,omitempty"`
+	JoinRequests     []core.JoinRequest               `json:"join_requests,omitempty"`
+	DeactivatedUsers []core.DeactivatedUser           `json:"deactivated_users,omitempty"`
+	UserHistory      []core.ObjectHistory[core.User]  `json:"user_history,omitempty"`
+	GroupHistory     []core.ObjectHistory[core.Group] `json:"group_history,omitempty"`
+	SchemaVersion    uint                             `json:"schema_version"`
 }
 
 func (a *Adapter) updateNexusByLoadingFromDisk(db *core.Database) (errs errext.ErrorSet) {
@@ -142,33 +172,101 @@ func (a *Adapter) updateNexusByLoadingFromDiskImpl(db *core.Database) error {
 		return err
 	}
 
-	var pdb persistedDatabase
-	err = json.Unmarshal(buf, &pdb)
+	loadedDB, schemaVersion, err := unmarshalDatabase(buf)
 	if err != nil {
-		return fmt.Errorf("cannot parse DB: %w", err)
+		return err
 	}
+	*db = loadedDB
+	a.storedSchemaVersion.Store(uint32(schemaVersion))
+	return nil
+}
 
-	if pdb.SchemaVersion != 1 {
-		return fmt.Errorf("found DB with schema version %d, but this Portunus only understands schema version 1", pdb.SchemaVersion)
+func (a *Adapter) writeDatabase(db core.Database) error {
+	buf, err := MarshalDatabase(db)
+	if err != nil {
+		return err
 	}
-
-	db.Users = pdb.Users
-	db.Groups = pdb.Groups
+	err = a.writeStoreFile(buf)
+	if err != nil {
+		return err
+	}
+	a.storedSchemaVersion.Store(uint32(CurrentSchemaVersion()))
 	return nil
 }
 
-func (a *Adapter) writeDatabase(db core.Database) error {
+// UpgradeNotes implements the Backend interface.
+func (a *Adapter) UpgradeNotes() []core.UpgradeNote {
+	return schemaUpgradeNotes(uint(a.storedSchemaVersion.Load()), "database file")
+}
+
+// MarshalDatabase renders the given database in the format of the database
+// file. This is also used by tools that generate database files.
+func MarshalDatabase(db core.Database) ([]byte, error) {
 	pdb := persistedDatabase{
-		Users:         db.Users,
-		Groups:        db.Groups,
-		SchemaVersion: 1,
+		Users:            db.Users,
+		Groups:           db.Groups,
+		ServiceAccounts:  db.ServiceAccounts,
+		AccessReviews:    db.AccessReviews,
+		JoinRequests:     db.JoinRequests,
+		DeactivatedUsers: db.DeactivatedUsers,
+		UserHistory:      db.UserHistory,
+		GroupHistory:     db.GroupHistory,
+		SchemaVersion:    CurrentSchemaVersion(),
 	}
 	buf, err := json.MarshalIndent(pdb, "", "  ")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	buf = append(buf, '\n') //follow the Unix convention of having a NL at the end of the file
-	return a.writeStoreFile(buf)
+	return buf, nil
+}
+
+// UnmarshalDatabase is the reverse of MarshalDatabase. This is also used by
+// tools that inspect database files without running the full server.
+// Database files with an older schema version are migrated to the current
+// one (see MigrateDatabase).
+func UnmarshalDatabase(buf []byte) (core.Database, error) {
+	db, _, err := unmarshalDatabase(buf)
+	return db, err
+}
+
+// Like UnmarshalDatabase, but also returns the schema version that the
+// database file had before migrating it.
+func unmarshalDatabase(buf []byte) (core.Database, uint, error) {
+	var header struct {
+		SchemaVersion uint `json:"schema_version"`
+	}
+	err := json.Unmarshal(buf, &header)
+	if err != nil {
+		return core.Database{}, 0, fmt.Errorf("cannot parse DB: %w", err)
+	}
+	err = checkSchemaVersion(header.SchemaVersion)
+	if err != nil {
+		return core.Database{}, 0, err
+	}
+	if header.SchemaVersion != CurrentSchemaVersion() {
+		buf, err = MigrateDatabase(buf, CurrentSchemaVersion())
+		if err != nil {
+			return core.Database{}, 0, err
+		}
+	}
+
+	var pdb persistedDatabase
+	err = json.Unmarshal(buf, &pdb)
+	if err != nil {
+		return core.Database{}, 0, fmt.Errorf("cannot parse DB: %w", err)
+	}
+
+	return core.Database{
+		Users:            pdb.Users,
+		Groups:           pdb.Groups,
+		ServiceAccounts:  pdb.ServiceAccounts,
+		AccessReviews:    pdb.AccessReviews,
+		JoinRequests:     pdb.JoinRequests,
+		DeactivatedUsers: pdb.DeactivatedUsers,
+		UserHistory:      pdb.UserHistory,
+		GroupHistory:     pdb.GroupHistory,
+	}, header.SchemaVersion, nil
 }
 
 func (a *Adapter) readStoreFile() ([]byte, error) {
@@ -195,11 +293,20 @@ func (a *Adapter) writeStoreFile(buf []byte) error {
 	if err != nil {
 		return err
 	}
+	err = keepBackupOf(a.storePath)
+	if err != nil {
+		return fmt.Errorf("cannot keep backup of %s: %w", a.storePath, err)
+	}
 	err = os.Rename(tmpPath, a.storePath)
 	if err != nil {
 		return err
 	}
-
 	a.diskState = buf
+
+	//the write itself was successful, so a failed backup is not fatal
+	err = takeTimestampedBackup(a.storePath, a.backups, time.Now())
+	if err != nil {
+		logg.Error("cannot take backup of %s in %s: %s", a.storePath, a.backups.Dir, err.Error())
+	}
 	return nil
 }
@@ -9,6 +9,7 @@ package store
 import (
 	"context"
 	_ "embed"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -87,7 +88,7 @@ func TestReadExistingStore(t *testing.T) {
 	})
 
 	//let the adapter load those contents
-	adapter := NewAdapter(nexus, storePath)
+	adapter := NewAdapter(nexus, storePath, BackupOptions{})
 	test.ExpectNoError(t, adapter.Run(ctx))
 }
 
@@ -128,7 +129,7 @@ func TestReadSideloadedStore(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		adapter := NewAdapter(nexus, storePath)
+		adapter := NewAdapter(nexus, storePath, BackupOptions{})
 		test.ExpectNoError(t, adapter.Run(ctx))
 	}()
 
@@ -167,7 +168,7 @@ func TestWriteStore(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		adapter := NewAdapter(nexus, storePath)
+		adapter := NewAdapter(nexus, storePath, BackupOptions{})
 		test.ExpectNoError(t, adapter.Run(ctx))
 	}()
 
@@ -191,6 +192,42 @@ func TestWriteStore(t *testing.T) {
 	buf, err := os.ReadFile(storePath)
 	test.ExpectNoError(t, err)
 	assert.DeepEqual(t, "database contents after write", string(buf), db2Representation)
+
+	//the previous contents shall have been kept as a backup
+	buf, err = os.ReadFile(BackupPathFor(storePath))
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "backup contents after write", string(buf), db1Representation)
+}
+
+func TestRestoreBackup(t *testing.T) {
+	dirPath, storePath := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+
+	//without a usable backup, restoring fails and leaves the database file alone
+	test.ExpectNoError(t, os.WriteFile(storePath, []byte("{ broken"), 0666))
+	err := RestoreBackup(storePath, time.Unix(0, 0))
+	if err == nil {
+		t.Error("expected RestoreBackup to fail without a backup, but it succeeded")
+	}
+	test.ExpectNoError(t, os.WriteFile(BackupPathFor(storePath), []byte("{ also broken"), 0666))
+	err = RestoreBackup(storePath, time.Unix(0, 0))
+	if err == nil {
+		t.Error("expected RestoreBackup to fail with a broken backup, but it succeeded")
+	}
+	_, err = ReadDatabaseFile(storePath)
+	if err == nil {
+		t.Error("expected ReadDatabaseFile to fail on the broken database file, but it succeeded")
+	}
+
+	//with a usable backup, the database file is replaced and the broken file is kept around
+	test.ExpectNoError(t, os.WriteFile(BackupPathFor(storePath), []byte(db1Representation), 0666))
+	test.ExpectNoError(t, RestoreBackup(storePath, time.Unix(0, 0)))
+	db, err := ReadDatabaseFile(storePath)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "database contents after restore", db, db1Contents)
+	buf, err := os.ReadFile(storePath + ".corrupt-19700101-000000")
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "broken database file after restore", string(buf), "{ broken")
 }
 
 func TestInitializeMissingStore(t *testing.T) {
@@ -217,7 +254,7 @@ func TestInitializeMissingStore(t *testing.T) {
 	})
 
 	//let the adapter fulfil this promise
-	adapter := NewAdapter(nexus, storePath)
+	adapter := NewAdapter(nexus, storePath, BackupOptions{})
 	var wg2 sync.WaitGroup
 	wg2.Add(1)
 	go func() {
@@ -244,3 +281,73 @@ func setupTempDir(t *testing.T) (dirPath, storePath string) {
 	test.ExpectNoError(t, err)
 	return dirPath, filepath.Join(dirPath, "database.json")
 }
+
+func TestTimestampedBackups(t *testing.T) {
+	dirPath, storePath := setupTempDir(t)
+	defer os.RemoveAll(dirPath)
+	opts := BackupOptions{
+		Dir:         filepath.Join(dirPath, "backups"),
+		Retention:   3,
+		MinInterval: 10 * time.Minute,
+	}
+
+	clock := time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC)
+	write := func(contents string) {
+		t.Helper()
+		//like in Adapter.writeStoreFile(), the file is replaced instead of rewritten
+		tmpPath := storePath + ".tmp"
+		test.ExpectNoError(t, os.WriteFile(tmpPath, []byte(contents), 0666))
+		test.ExpectNoError(t, os.Rename(tmpPath, storePath))
+		test.ExpectNoError(t, takeTimestampedBackup(storePath, opts, clock))
+	}
+	expectBackups := func(expected ...string) {
+		t.Helper()
+		backups, err := ListBackups(opts.Dir)
+		test.ExpectNoError(t, err)
+		var actual []string
+		for _, b := range backups {
+			buf, err := os.ReadFile(filepath.Join(opts.Dir, b.Name))
+			test.ExpectNoError(t, err)
+			actual = append(actual, fmt.Sprintf("%s=%s", b.Name, string(buf)))
+		}
+		assert.DeepEqual(t, "backups", actual, expected)
+	}
+
+	//first write is always backed up
+	write(`{"v":1}`)
+	expectBackups(`database-20240304-080000.json={"v":1}`)
+
+	//writes within the MinInterval are not backed up, and the existing backup is
+	//not affected by the database file being replaced
+	clock = clock.Add(5 * time.Minute)
+	write(`{"v":2}`)
+	expectBackups(`database-20240304-080000.json={"v":1}`)
+
+	//once the MinInterval has passed, further backups are taken, but never more
+	//than the Retention
+	for _, v := range []int{3, 4, 5} {
+		clock = clock.Add(10 * time.Minute)
+		write(fmt.Sprintf(`{"v":%d}`, v))
+	}
+	expectBackups(
+		`database-20240304-083500.json={"v":5}`,
+		`database-20240304-082500.json={"v":4}`,
+		`database-20240304-081500.json={"v":3}`,
+	)
+
+	//backups can be read back by name, but only by names that ListBackups() would report
+	_, err := ReadBackup(opts.Dir, "database-20240304-081500.json")
+	assert.DeepEqual(t, "error from ReadBackup", err.Error(), "while reading "+opts.Dir+"/database-20240304-081500.json: found DB with schema version 0, but this Portunus only understands schema version 1")
+	_, err = ReadBackup(opts.Dir, "../database.json")
+	assert.DeepEqual(t, "error from ReadBackup", err.Error(), `"../database.json" is not the name of a backup`)
+
+	//Retention = 0 disables backups entirely
+	opts.Retention = 0
+	clock = clock.Add(time.Hour)
+	write(`{"v":6}`)
+	expectBackups(
+		`database-20240304-083500.json={"v":5}`,
+		`database-20240304-082500.json={"v":4}`,
+		`database-20240304-081500.json={"v":3}`,
+	)
+}
@@ -0,0 +1,210 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+)
+
+// BackupPathFor returns the path where the Adapter keeps the previous version
+// of the database file at `storePath`.
+func BackupPathFor(storePath string) string {
+	return storePath + ".bak"
+}
+
+// ReadDatabaseFile reads and parses the database file at the given path. This
+// is used to check the database file at startup before any Adapter is
+// started, and to inspect its backup.
+func ReadDatabaseFile(path string) (core.Database, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return core.Database{}, err
+	}
+	db, err := UnmarshalDatabase(buf)
+	if err != nil {
+		return core.Database{}, fmt.Errorf("while reading %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Before the database file is replaced, its previous version is kept in the
+// backup location. Since a hardlink is used, the database file itself is never
+// missing, not even briefly.
+func keepBackupOf(storePath string) error {
+	backupPath := BackupPathFor(storePath)
+	err := os.Remove(backupPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Link(storePath, backupPath)
+	if errors.Is(err, os.ErrNotExist) {
+		//there is no previous version during first-time initialization
+		return nil
+	}
+	return err
+}
+
+// RestoreBackup replaces the database file at `storePath` with its backup.
+// The replaced file is not deleted: It is kept next to the database file with
+// a ".corrupt-<timestamp>" suffix, so that it can be inspected later.
+//
+// This must only be called while no Adapter is running.
+func RestoreBackup(storePath string, now time.Time) error {
+	backupPath := BackupPathFor(storePath)
+	buf, err := os.ReadFile(backupPath)
+	if err != nil {
+		return err
+	}
+	_, err = UnmarshalDatabase(buf)
+	if err != nil {
+		return fmt.Errorf("while reading %s: %w", backupPath, err)
+	}
+
+	corruptPath := fmt.Sprintf("%s.corrupt-%s", storePath, now.UTC().Format("20060102-150405"))
+	err = os.Link(storePath, corruptPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmpPath := filepath.Join(
+		filepath.Dir(storePath),
+		fmt.Sprintf(".%s.%d", filepath.Base(storePath), os.Getpid()),
+	)
+	err = os.WriteFile(tmpPath, buf, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, storePath)
+}
+
+// BackupOptions configures the timestamped backups that the Adapter keeps in
+// addition to the backup from BackupPathFor().
+type BackupOptions struct {
+	Dir string //where backups are kept
+	//How many backups are kept. The oldest backups are deleted when there are
+	//more than this. If 0, no timestamped backups are taken.
+	Retention uint
+	//If not 0, a new backup is only taken when the previous one is at least
+	//this old. Otherwise, a backup is taken on every change.
+	MinInterval time.Duration
+}
+
+// BackupInfo describes a timestamped backup of the database file.
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"` //in bytes
+}
+
+const backupTimeFormat = "20060102-150405"
+
+var backupNameRx = regexp.MustCompile(`^database-(\d{8}-\d{6})\.json$`)
+
+// ListBackups returns all timestamped backups in the given directory,
+// newest first.
+func ListBackups(dir string) ([]BackupInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []BackupInfo
+	for _, entry := range entries {
+		match := backupNameRx.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		createdAt, err := time.ParseInLocation(backupTimeFormat, match[1], time.UTC)
+		if err != nil {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, BackupInfo{Name: entry.Name(), CreatedAt: createdAt, Size: fi.Size()})
+	}
+	slices.Reverse(result) //os.ReadDir() sorts by name, i.e. oldest first
+	return result, nil
+}
+
+// ReadBackup reads and parses the timestamped backup with the given name
+// (as reported by ListBackups) from the given directory.
+func ReadBackup(dir, name string) (core.Database, error) {
+	if !backupNameRx.MatchString(name) {
+		return core.Database{}, fmt.Errorf("%q is not the name of a backup", name)
+	}
+	return ReadDatabaseFile(filepath.Join(dir, name))
+}
+
+// After the database file was written, a timestamped backup of it is taken if
+// due, and the oldest backups beyond the retention count are deleted. Like in
+// keepBackupOf(), the backup is a hardlink to the database file, which is safe
+// since the database file is always replaced by rename instead of written to.
+func takeTimestampedBackup(storePath string, opts BackupOptions, now time.Time) error {
+	if opts.Retention == 0 {
+		return nil
+	}
+	backups, err := ListBackups(opts.Dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) > 0 && opts.MinInterval > 0 && now.Sub(backups[0].CreatedAt) < opts.MinInterval {
+		return nil
+	}
+
+	err = os.MkdirAll(opts.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("database-%s.json", now.UTC().Format(backupTimeFormat))
+	backupPath := filepath.Join(opts.Dir, name)
+	err = os.Remove(backupPath) //if a backup was already taken within this second
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Link(storePath, backupPath)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 || backups[0].Name != name {
+		backups = append([]BackupInfo{{Name: name}}, backups...)
+	}
+
+	for _, backup := range backups[min(uint(len(backups)), opts.Retention):] {
+		err := os.Remove(filepath.Join(opts.Dir, backup.Name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreTimestampedBackup replaces the contents of the given database with
+// the contents of the given backup, as returned by ReadBackup(). Unlike
+// RestoreBackup(), this is done through the nexus while the Adapter is
+// running, so the restored contents are validated and written like any other
+// change. The change history is not restored, so that the restore itself shows
+// up in it.
+func RestoreTimestampedBackup(db *core.Database, backup core.Database) {
+	db.Users = backup.Users
+	db.Groups = backup.Groups
+	db.ServiceAccounts = backup.ServiceAccounts
+	db.AccessReviews = backup.AccessReviews
+	db.JoinRequests = backup.JoinRequests
+	db.DeactivatedUsers = backup.DeactivatedUsers
+}
@@ -0,0 +1,156 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// schemaMigration converts the database between two consecutive schema
+// versions. Migrations work on the generic JSON representation of the
+// database file instead of on persistedDatabase, since the types in
+// internal/core only ever describe the current schema version.
+type schemaMigration struct {
+	Description string
+	Up          func(doc map[string]any) error
+	//Optional. If nil, databases cannot be downgraded past this migration.
+	Down func(doc map[string]any) error
+}
+
+// schemaMigrations[N] converts between schema versions N+1 and N+2. To change
+// the format of the database file, append a migration here and adjust
+// persistedDatabase and the types in internal/core to match its result.
+var schemaMigrations []schemaMigration
+
+// CurrentSchemaVersion returns the schema version of the database files
+// written by this version of Portunus.
+func CurrentSchemaVersion() uint {
+	return uint(len(schemaMigrations)) + 1
+}
+
+func describeSupportedSchemaVersions() string {
+	if CurrentSchemaVersion() == 1 {
+		return "schema version 1"
+	}
+	return fmt.Sprintf("schema versions 1 through %d", CurrentSchemaVersion())
+}
+
+func checkSchemaVersion(version uint) error {
+	switch {
+	case version > CurrentSchemaVersion():
+		return fmt.Errorf("found DB with schema version %d, but this Portunus only understands %s (use `portunus-server -migrate-database` from a newer Portunus to downgrade it)",
+			version, describeSupportedSchemaVersions())
+	case version == 0:
+		return fmt.Errorf("found DB with schema version 0, but this Portunus only understands %s", describeSupportedSchemaVersions())
+	default:
+		return nil
+	}
+}
+
+// Builds the upgrade note for a store that still contains a database with an
+// older schema version. Loading such a database migrates it in memory only;
+// the store is converted when the next change is written.
+func schemaUpgradeNotes(storedVersion uint, storeDesc string) []core.UpgradeNote {
+	if storedVersion == 0 || storedVersion >= CurrentSchemaVersion() {
+		return nil
+	}
+	return []core.UpgradeNote{{
+		Topic: "Database schema upgrade pending",
+		Message: fmt.Sprintf("The %s still uses schema version %d. It will be converted to schema version %d when the next change is saved. "+
+			"After that, older versions of Portunus cannot read it unless it is downgraded with `portunus-server -migrate-database`. "+
+			"If you might need to go back to an older version of Portunus, take a backup now.",
+			storeDesc, storedVersion, CurrentSchemaVersion()),
+	}}
+}
+
+// migrateDocument converts the given generic representation of the database
+// file into the target schema version, one migration at a time.
+func migrateDocument(doc map[string]any, targetVersion uint) error {
+	number, ok := doc["schema_version"].(json.Number)
+	if !ok {
+		return errors.New("missing or malformed schema_version")
+	}
+	parsed, err := strconv.ParseUint(number.String(), 10, 32)
+	if err != nil {
+		return fmt.Errorf("malformed schema_version: %w", err)
+	}
+	version := uint(parsed)
+	err = checkSchemaVersion(version)
+	if err != nil {
+		return err
+	}
+	if targetVersion == 0 || targetVersion > CurrentSchemaVersion() {
+		return fmt.Errorf("cannot migrate to schema version %d, since this Portunus only understands %s", targetVersion, describeSupportedSchemaVersions())
+	}
+
+	for version < targetVersion {
+		m := schemaMigrations[version-1]
+		err := m.Up(doc)
+		if err != nil {
+			return fmt.Errorf("while migrating from schema version %d to %d (%s): %w", version, version+1, m.Description, err)
+		}
+		logg.Info("migrated database from schema version %d to %d: %s", version, version+1, m.Description)
+		version++
+	}
+	for version > targetVersion {
+		m := schemaMigrations[version-2]
+		if m.Down == nil {
+			return fmt.Errorf("cannot downgrade from schema version %d to %d (%s): not supported", version, version-1, m.Description)
+		}
+		err := m.Down(doc)
+		if err != nil {
+			return fmt.Errorf("while downgrading from schema version %d to %d (%s): %w", version, version-1, m.Description, err)
+		}
+		logg.Info("downgraded database from schema version %d to %d: %s", version, version-1, m.Description)
+		version--
+	}
+	doc["schema_version"] = version
+	return nil
+}
+
+// MigrateDatabase converts the contents of a database file into the given
+// schema version. Since the result can be an older schema version than
+// CurrentSchemaVersion(), it is returned in the format of the database file
+// instead of as core.Database.
+func MigrateDatabase(buf []byte, targetVersion uint) ([]byte, error) {
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber() //avoid rounding of large numbers through float64
+	err := dec.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse DB: %w", err)
+	}
+	err = migrateDocument(doc, targetVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetVersion == CurrentSchemaVersion() {
+		//round-trip through the regular types to get the regular formatting
+		buf, err = json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		db, err := UnmarshalDatabase(buf)
+		if err != nil {
+			return nil, err
+		}
+		return MarshalDatabase(db)
+	}
+	buf, err = json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
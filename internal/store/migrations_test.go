@@ -0,0 +1,176 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+)
+
+// For these tests, we pretend that an earlier version of Portunus stored email
+// addresses as "mail" instead of "email".
+var testMigrations = []schemaMigration{
+	{
+		Description: `rename "mail" to "email" in users`,
+		Up: func(doc map[string]any) error {
+			return renameUserField(doc, "mail", "email")
+		},
+		Down: func(doc map[string]any) error {
+			return renameUserField(doc, "email", "mail")
+		},
+	},
+	{
+		Description: "irreversible no-op",
+		Up:          func(doc map[string]any) error { return nil },
+	},
+}
+
+func renameUserField(doc map[string]any, oldKey, newKey string) error {
+	users, _ := doc["users"].([]any)
+	for _, user := range users {
+		fields, ok := user.(map[string]any)
+		if !ok {
+			return errors.New("user is not an object")
+		}
+		if value, exists := fields[oldKey]; exists {
+			fields[newKey] = value
+			delete(fields, oldKey)
+		}
+	}
+	return nil
+}
+
+func withSchemaMigrations(t *testing.T, migrations []schemaMigration) {
+	saved := schemaMigrations
+	schemaMigrations = migrations
+	t.Cleanup(func() { schemaMigrations = saved })
+}
+
+const (
+	v1Representation = `{"users":[{"login_name":"jane","given_name":"Jane","family_name":"Doe","mail":"jane@example.com","password":""}],"groups":[],"schema_version":1}`
+	v2Representation = `{
+  "groups": [],
+  "schema_version": 2,
+  "users": [
+    {
+      "email": "jane@example.com",
+      "family_name": "Doe",
+      "given_name": "Jane",
+      "login_name": "jane",
+      "password": ""
+    }
+  ]
+}
+`
+)
+
+func TestMigrateOnLoad(t *testing.T) {
+	withSchemaMigrations(t, testMigrations)
+	assert.DeepEqual(t, "current schema version", CurrentSchemaVersion(), uint(3))
+
+	db, err := UnmarshalDatabase([]byte(v1Representation))
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "migrated database", db, core.Database{
+		Users: []core.User{{
+			LoginName:    "jane",
+			GivenName:    "Jane",
+			FamilyName:   "Doe",
+			EMailAddress: "jane@example.com",
+		}},
+		Groups: []core.Group{},
+	})
+
+	//when written again, the database file has the current schema version
+	buf, err := MarshalDatabase(db)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "migrated database file", string(buf), `{
+  "users": [
+    {
+      "login_name": "jane",
+      "given_name": "Jane",
+      "family_name": "Doe",
+      "email": "jane@example.com",
+      "password": ""
+    }
+  ],
+  "groups": [],
+  "schema_version": 3
+}
+`)
+
+	//newer schema versions are rejected with a hint about how to downgrade
+	_, err = UnmarshalDatabase([]byte(`{"users":[],"groups":[],"schema_version":4}`))
+	assert.DeepEqual(t, "error for newer schema version", err.Error(),
+		"found DB with schema version 4, but this Portunus only understands schema versions 1 through 3 (use `portunus-server -migrate-database` from a newer Portunus to downgrade it)")
+}
+
+func TestUpgradeNoteForOldSchemaVersion(t *testing.T) {
+	withSchemaMigrations(t, testMigrations)
+	storePath := filepath.Join(t.TempDir(), "database.json")
+	test.ExpectNoError(t, os.WriteFile(storePath, []byte(v1Representation), 0666))
+
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter := NewAdapter(nexus, storePath, BackupOptions{})
+	assert.DeepEqual(t, "upgrade notes before load", adapter.UpgradeNotes(), []core.UpgradeNote(nil))
+
+	//loading the database only migrates it in memory...
+	errs := nexus.Update(adapter.updateNexusByLoadingFromDisk, nil)
+	if !errs.IsEmpty() {
+		t.Fatal(errs.Join(", "))
+	}
+	notes := adapter.UpgradeNotes()
+	assert.DeepEqual(t, "number of upgrade notes after load", len(notes), 1)
+	assert.DeepEqual(t, "upgrade note after load", notes[0].String(),
+		"Database schema upgrade pending: The database file still uses schema version 1. It will be converted to schema version 3 when the next change is saved. "+
+			"After that, older versions of Portunus cannot read it unless it is downgraded with `portunus-server -migrate-database`. "+
+			"If you might need to go back to an older version of Portunus, take a backup now.")
+
+	//...so the note goes away once the database file is written
+	test.ExpectNoError(t, adapter.writeDatabase(core.Database{}))
+	assert.DeepEqual(t, "upgrade notes after write", adapter.UpgradeNotes(), []core.UpgradeNote(nil))
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	withSchemaMigrations(t, testMigrations)
+
+	//upgrade to an intermediate version
+	buf, err := MigrateDatabase([]byte(v1Representation), 2)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "upgraded database file", string(buf), v2Representation)
+
+	//downgrade again
+	buf, err = MigrateDatabase(buf, 1)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "downgraded database file", string(buf), `{
+  "groups": [],
+  "schema_version": 1,
+  "users": [
+    {
+      "family_name": "Doe",
+      "given_name": "Jane",
+      "login_name": "jane",
+      "mail": "jane@example.com",
+      "password": ""
+    }
+  ]
+}
+`)
+
+	//migrations without Down cannot be reverted
+	_, err = MigrateDatabase([]byte(`{"users":[],"groups":[],"schema_version":3}`), 2)
+	assert.DeepEqual(t, "error for irreversible downgrade", err.Error(),
+		"cannot downgrade from schema version 3 to 2 (irreversible no-op): not supported")
+	_, err = MigrateDatabase([]byte(v1Representation), 5)
+	assert.DeepEqual(t, "error for unknown target version", err.Error(),
+		"cannot migrate to schema version 5, since this Portunus only understands schema versions 1 through 3")
+}
@@ -0,0 +1,469 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
+
+	//SQL drivers for SQLAdapter
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Backend is the interface shared by Adapter (which uses the database file)
+// and SQLAdapter.
+type Backend interface {
+	//Run propagates changes between the Portunus database and the store until
+	//`ctx` expires, like Adapter.Run().
+	Run(ctx context.Context) error
+	//UpgradeNotes reports whether the store still contains a database with an
+	//older schema version. This is safe to call while Run() is running.
+	UpgradeNotes() []core.UpgradeNote
+}
+
+// SQLOptions contains the configuration for an SQLAdapter.
+type SQLOptions struct {
+	//Either "sqlite" or "postgres".
+	Driver string
+	//For "sqlite", the path to the database file. For "postgres", a connection
+	//string as understood by libpq.
+	DSN string
+	//How often the SQL database is checked for changes made by someone else.
+	PollInterval time.Duration
+}
+
+// SQLAdapter is an alternative to Adapter that keeps the Portunus database in
+// an SQL database instead of the database file. Each object is stored in its
+// own row as a JSON document in the same format as in the database file.
+// Writes are done in a single transaction that also increments the revision
+// number in the metadata table, which is how changes made by someone else
+// are detected. A write only goes through if the revision is still the one
+// that we last saw; otherwise the change made by someone else wins.
+type SQLAdapter struct {
+	//NOTE: Like for Adapter, all DB access is done by the goroutine that calls
+	//Run(), so there is no mutex here.
+	nexus core.Nexus
+	db    *sql.DB
+	opts  SQLOptions
+	//The revision and contents that were last read from or written into the
+	//SQL database. We maintain this to avoid useless roundtrip writes and to
+	//only write rows that actually changed.
+	revision int64
+	rows     map[sqlRowKey]string
+	//Like Adapter.storedSchemaVersion.
+	storedSchemaVersion atomic.Uint32
+}
+
+type sqlRowKey struct {
+	Kind string
+	Name string
+}
+
+const sqlSchema = `
+	CREATE TABLE IF NOT EXISTS portunus_metadata (
+		schema_version INTEGER NOT NULL,
+		revision       BIGINT  NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS portunus_objects (
+		kind    TEXT NOT NULL,
+		name    TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		PRIMARY KEY (kind, name)
+	);
+`
+
+// NewSQLAdapter connects to the SQL database and creates its tables if they
+// do not exist yet.
+func NewSQLAdapter(nexus core.Nexus, opts SQLOptions) (*SQLAdapter, error) {
+	var (
+		db  *sql.DB
+		err error
+	)
+	switch opts.Driver {
+	case "sqlite":
+		//WAL mode allows other processes to read while we are writing
+		db, err = sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate", opts.DSN))
+		if err == nil {
+			db.SetMaxOpenConns(1)
+		}
+	case "postgres":
+		db, err = sql.Open("postgres", opts.DSN)
+	default:
+		return nil, fmt.Errorf("unknown SQL driver: %q", opts.Driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s database: %w", opts.Driver, err)
+	}
+	_, err = db.Exec(sqlSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create tables in %s database: %w", opts.Driver, err)
+	}
+	return &SQLAdapter{nexus: nexus, db: db, opts: opts}, nil
+}
+
+// Run implements the Backend interface.
+func (a *SQLAdapter) Run(ctx context.Context) error {
+	defer a.db.Close()
+
+	//first read initializes the internal database from the SQL database (or
+	//instructs the nexus to perform first-time initialization)
+	errs := a.nexus.Update(a.updateNexusByLoadingFromSQL, nil)
+	if !errs.IsEmpty() {
+		return fmt.Errorf("while loading database from %s: %s", a.opts.Driver, errs.Join(", "))
+	}
+
+	//see Adapter.Run() for why this needs to be cancelled explicitly
+	ctxListen, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writeChan := make(chan core.Database, 1)
+	a.nexus.AddListener(ctxListen, func(db core.Database) {
+		select {
+		case writeChan <- db:
+		case <-ctxListen.Done():
+		}
+	})
+
+	ticker := time.NewTicker(a.opts.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			//if an update came in right before we were stopped, make sure that it
+			//does not get lost
+			select {
+			case db := <-writeChan:
+				return a.writeDatabase(db)
+			default:
+				return nil
+			}
+		case <-ticker.C:
+			var revision int64
+			err := a.db.QueryRow(`SELECT revision FROM portunus_metadata`).Scan(&revision)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("while checking %s database for changes: %w", a.opts.Driver, err)
+			}
+			if revision == a.revision {
+				continue
+			}
+			errs := a.nexus.Update(a.updateNexusByLoadingFromSQL, nil)
+			if !errs.IsEmpty() {
+				return fmt.Errorf("while loading database from %s: %s", a.opts.Driver, errs.Join(", "))
+			}
+		case db := <-writeChan:
+			err := a.writeDatabase(db)
+			if errors.Is(err, errSQLWriteConflict) {
+				logg.Error("discarding a change to the Portunus database because the %s database was changed by someone else in the meantime", a.opts.Driver)
+				errs := a.nexus.Update(a.updateNexusByLoadingFromSQL, nil)
+				if !errs.IsEmpty() {
+					return fmt.Errorf("while loading database from %s: %s", a.opts.Driver, errs.Join(", "))
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *SQLAdapter) updateNexusByLoadingFromSQL(db *core.Database) (errs errext.ErrorSet) {
+	errs.Add(a.updateNexusByLoadingFromSQLImpl(db))
+	return
+}
+
+func (a *SQLAdapter) updateNexusByLoadingFromSQLImpl(db *core.Database) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //only reading, so there is nothing to commit
+
+	var (
+		schemaVersion uint
+		revision      int64
+	)
+	err = tx.QueryRow(`SELECT schema_version, revision FROM portunus_metadata`).Scan(&schemaVersion, &revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		a.revision = 0
+		a.rows = nil
+		return core.ErrDatabaseNeedsInitialization
+	}
+	if err != nil {
+		return err
+	}
+	err = checkSchemaVersion(schemaVersion)
+	if err != nil {
+		return err
+	}
+
+	rows := make(map[sqlRowKey]string)
+	sqlRows, err := tx.Query(`SELECT kind, name, payload FROM portunus_objects`)
+	if err != nil {
+		return err
+	}
+	defer sqlRows.Close()
+	for sqlRows.Next() {
+		var (
+			key     sqlRowKey
+			payload string
+		)
+		err := sqlRows.Scan(&key.Kind, &key.Name, &payload)
+		if err != nil {
+			return err
+		}
+		rows[key] = payload
+	}
+	err = sqlRows.Err()
+	if err != nil {
+		return err
+	}
+
+	var loadedDB core.Database
+	if schemaVersion == CurrentSchemaVersion() {
+		loadedDB, err = unmarshalSQLRows(rows)
+	} else {
+		//migrations are defined on the format of the database file, so we need
+		//to take a detour through that format
+		var buf []byte
+		buf, err = renderSQLRowsAsDatabaseFile(rows, schemaVersion)
+		if err == nil {
+			loadedDB, err = UnmarshalDatabase(buf)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	*db = loadedDB
+	a.revision = revision
+	//if the rows were migrated, this makes the next write replace all of them
+	a.rows = rows
+	a.storedSchemaVersion.Store(uint32(schemaVersion))
+	return nil
+}
+
+// errSQLWriteConflict is returned by writeDatabase when the revision in the
+// SQL database is not the one that we last read or wrote.
+var errSQLWriteConflict = errors.New("conflicting write by someone else")
+
+func (a *SQLAdapter) writeDatabase(db core.Database) error {
+	rows, err := marshalSQLRows(db)
+	if err != nil {
+		return err
+	}
+	if a.rows != nil && maps.Equal(rows, a.rows) {
+		//avoid pointless writes
+		return nil
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //no-op if committed
+
+	//claim the next revision first, so that concurrent writers are
+	//serialized on the metadata row
+	var result sql.Result
+	if a.revision == 0 {
+		//first-time initialization
+		result, err = tx.Exec(`INSERT INTO portunus_metadata (schema_version, revision)
+			SELECT CAST($1 AS INTEGER), 1 WHERE NOT EXISTS (SELECT 1 FROM portunus_metadata)`, CurrentSchemaVersion())
+	} else {
+		result, err = tx.Exec(`UPDATE portunus_metadata SET revision = revision + 1, schema_version = $1 WHERE revision = $2`,
+			CurrentSchemaVersion(), a.revision)
+	}
+	if err != nil {
+		return err
+	}
+	updatedCount, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updatedCount == 0 {
+		return errSQLWriteConflict
+	}
+
+	for key := range a.rows {
+		if _, exists := rows[key]; !exists {
+			_, err := tx.Exec(`DELETE FROM portunus_objects WHERE kind = $1 AND name = $2`, key.Kind, key.Name)
+			if err != nil {
+				return fmt.Errorf("cannot delete %s %q from %s database: %w", key.Kind, key.Name, a.opts.Driver, err)
+			}
+		}
+	}
+	for key, payload := range rows {
+		if oldPayload, exists := a.rows[key]; exists && oldPayload == payload {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO portunus_objects (kind, name, payload) VALUES ($1, $2, $3)
+			ON CONFLICT (kind, name) DO UPDATE SET payload = excluded.payload`, key.Kind, key.Name, payload)
+		if err != nil {
+			return fmt.Errorf("cannot write %s %q into %s database: %w", key.Kind, key.Name, a.opts.Driver, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("cannot commit write into %s database: %w", a.opts.Driver, err)
+	}
+
+	a.revision++
+	a.rows = rows
+	a.storedSchemaVersion.Store(uint32(CurrentSchemaVersion()))
+	return nil
+}
+
+// UpgradeNotes implements the Backend interface.
+func (a *SQLAdapter) UpgradeNotes() []core.UpgradeNote {
+	return schemaUpgradeNotes(uint(a.storedSchemaVersion.Load()), a.opts.Driver+" database")
+}
+
+// Join requests do not have a unique identity, so they are stored by their
+// position in the list, with zero padding to retain the order when sorting by
+// name.
+const sqlJoinRequestNameFormat = "%08d"
+
+func marshalSQLRows(db core.Database) (map[sqlRowKey]string, error) {
+	rows := make(map[sqlRowKey]string)
+	add := func(kind, name string, obj any) error {
+		buf, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		rows[sqlRowKey{kind, name}] = string(buf)
+		return nil
+	}
+
+	var err error
+	for _, u := range db.Users {
+		err = errors.Join(err, add("user", u.LoginName, u))
+	}
+	for _, g := range db.Groups {
+		err = errors.Join(err, add("group", g.Name, g))
+	}
+	for _, s := range db.ServiceAccounts {
+		err = errors.Join(err, add("service_account", s.Name, s))
+	}
+	for _, r := range db.AccessReviews {
+		err = errors.Join(err, add("access_review", r.Name, r))
+	}
+	for idx, r := range db.JoinRequests {
+		err = errors.Join(err, add("join_request", fmt.Sprintf(sqlJoinRequestNameFormat, idx), r))
+	}
+	for _, u := range db.DeactivatedUsers {
+		err = errors.Join(err, add("deactivated_user", u.User.LoginName, u))
+	}
+	for _, h := range db.UserHistory {
+		err = errors.Join(err, add("user_history", h.Name, h))
+	}
+	for _, h := range db.GroupHistory {
+		err = errors.Join(err, add("group_history", h.Name, h))
+	}
+	return rows, err
+}
+
+func unmarshalSQLRows(rows map[sqlRowKey]string) (db core.Database, err error) {
+	keys := slices.Collect(maps.Keys(rows))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Name < keys[j].Name
+	})
+
+	for _, key := range keys {
+		buf := []byte(rows[key])
+		switch key.Kind {
+		case "user":
+			var u core.User
+			err = json.Unmarshal(buf, &u)
+			db.Users = append(db.Users, u)
+		case "group":
+			var g core.Group
+			err = json.Unmarshal(buf, &g)
+			db.Groups = append(db.Groups, g)
+		case "service_account":
+			var s core.ServiceAccount
+			err = json.Unmarshal(buf, &s)
+			db.ServiceAccounts = append(db.ServiceAccounts, s)
+		case "access_review":
+			var r core.AccessReview
+			err = json.Unmarshal(buf, &r)
+			db.AccessReviews = append(db.AccessReviews, r)
+		case "join_request":
+			var r core.JoinRequest
+			err = json.Unmarshal(buf, &r)
+			db.JoinRequests = append(db.JoinRequests, r)
+		case "deactivated_user":
+			var u core.DeactivatedUser
+			err = json.Unmarshal(buf, &u)
+			db.DeactivatedUsers = append(db.DeactivatedUsers, u)
+		case "user_history":
+			var h core.ObjectHistory[core.User]
+			err = json.Unmarshal(buf, &h)
+			db.UserHistory = append(db.UserHistory, h)
+		case "group_history":
+			var h core.ObjectHistory[core.Group]
+			err = json.Unmarshal(buf, &h)
+			db.GroupHistory = append(db.GroupHistory, h)
+		default:
+			err = errors.New("unknown kind of object")
+		}
+		if err != nil {
+			return core.Database{}, fmt.Errorf("cannot parse %s %q: %w", key.Kind, key.Name, err)
+		}
+	}
+	return db, nil
+}
+
+// The keys in the database file that correspond to each kind of row.
+var sqlKindToFileKey = map[string]string{
+	"user":             "users",
+	"group":            "groups",
+	"service_account":  "service_accounts",
+	"access_review":    "access_reviews",
+	"join_request":     "join_requests",
+	"deactivated_user": "deactivated_users",
+	"user_history":     "user_history",
+	"group_history":    "group_history",
+}
+
+func renderSQLRowsAsDatabaseFile(rows map[sqlRowKey]string, schemaVersion uint) ([]byte, error) {
+	keys := slices.Collect(maps.Keys(rows))
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Name < keys[j].Name
+	})
+
+	doc := map[string]any{"schema_version": schemaVersion}
+	for _, key := range keys {
+		fileKey, exists := sqlKindToFileKey[key.Kind]
+		if !exists {
+			return nil, fmt.Errorf("cannot parse %s %q: unknown kind of object", key.Kind, key.Name)
+		}
+		objects, _ := doc[fileKey].([]json.RawMessage)
+		doc[fileKey] = append(objects, json.RawMessage(rows[key]))
+	}
+	return json.Marshal(doc)
+}
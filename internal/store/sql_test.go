@@ -0,0 +1,161 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/test"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/errext"
+)
+
+// NOTE: Only SQLite is tested here since it does not need a database server.
+// The queries are the same for PostgreSQL.
+
+func TestSQLStore(t *testing.T) {
+	opts := SQLOptions{
+		Driver:       "sqlite",
+		DSN:          filepath.Join(t.TempDir(), "database.sqlite"),
+		PollInterval: 10 * time.Millisecond,
+	}
+	runAdapter := func(ctx context.Context, nexus core.Nexus, wg *sync.WaitGroup) {
+		adapter, err := NewSQLAdapter(nexus, opts)
+		test.ExpectNoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			test.ExpectNoError(t, adapter.Run(ctx))
+		}()
+	}
+
+	//on first start, the nexus initializes the database, and then we put our own contents in there
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	runAdapter(ctx, nexus, &wg)
+	time.Sleep(25 * time.Millisecond)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		*db = db1Contents.Cloned()
+		return nil
+	}, nil)
+	for _, err := range errs {
+		test.ExpectNoError(t, err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	cancel()
+	wg.Wait()
+
+	//the rows can be inspected with plain SQL
+	sqlDB, err := sql.Open("sqlite3", opts.DSN)
+	test.ExpectNoError(t, err)
+	defer sqlDB.Close()
+	var payload string
+	err = sqlDB.QueryRow(`SELECT payload FROM portunus_objects WHERE kind = 'group' AND name = 'nobody'`).Scan(&payload)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "group payload", payload, `{"name":"nobody","long_name":"Nobody in here.","members":[],"permissions":{"portunus":{"is_admin":false},"ldap":{"can_read":false}}}`)
+	var count int
+	err = sqlDB.QueryRow(`SELECT COUNT(*) FROM portunus_objects WHERE kind = 'user'`).Scan(&count)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "number of users", count, 0)
+
+	//on the next start, those contents are loaded again, and changes made by
+	//someone else are picked up while running
+	nexus = core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	updateCount := 0
+	nexus.AddListener(ctx, func(actualDB core.Database) {
+		updateCount++
+		switch updateCount {
+		case 1:
+			assert.DeepEqual(t, "group after reload", actualDB.Groups, db1Contents.Groups)
+		case 2:
+			assert.DeepEqual(t, "group after sideload", actualDB.Groups, db2Contents.Groups)
+			cancel()
+		default:
+			t.Error("too many updates")
+		}
+	})
+	runAdapter(ctx, nexus, &wg)
+	time.Sleep(25 * time.Millisecond)
+	_, err = sqlDB.Exec(`UPDATE portunus_objects SET payload = $1 WHERE kind = 'group' AND name = 'nobody'`,
+		`{"name":"nobody","long_name":"Still empty.","members":[],"permissions":{"portunus":{"is_admin":false},"ldap":{"can_read":false}}}`)
+	test.ExpectNoError(t, err)
+	_, err = sqlDB.Exec(`UPDATE portunus_metadata SET revision = revision + 1`)
+	test.ExpectNoError(t, err)
+	wg.Wait()
+}
+
+func TestSQLStoreWriteConflict(t *testing.T) {
+	opts := SQLOptions{
+		Driver: "sqlite",
+		DSN:    filepath.Join(t.TempDir(), "database.sqlite"),
+		//the conflict shall be found by the write, not by polling
+		PollInterval: time.Hour,
+	}
+	nexus := core.NewNexus(nil, core.GetValidationConfigForTests(), &core.NoopHasher{})
+	adapter, err := NewSQLAdapter(nexus, opts)
+	test.ExpectNoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		test.ExpectNoError(t, adapter.Run(ctx))
+	}()
+	time.Sleep(25 * time.Millisecond)
+	errs := nexus.Update(func(db *core.Database) errext.ErrorSet {
+		*db = db1Contents.Cloned()
+		return nil
+	}, nil)
+	for _, err := range errs {
+		test.ExpectNoError(t, err)
+	}
+	time.Sleep(25 * time.Millisecond)
+
+	//someone else writes into the database...
+	sqlDB, err := sql.Open("sqlite3", opts.DSN)
+	test.ExpectNoError(t, err)
+	defer sqlDB.Close()
+	_, err = sqlDB.Exec(`UPDATE portunus_objects SET payload = $1 WHERE kind = 'group' AND name = 'nobody'`,
+		`{"name":"nobody","long_name":"Still empty.","members":[],"permissions":{"portunus":{"is_admin":false},"ldap":{"can_read":false}}}`)
+	test.ExpectNoError(t, err)
+	_, err = sqlDB.Exec(`UPDATE portunus_metadata SET revision = revision + 1`)
+	test.ExpectNoError(t, err)
+
+	//...before we write our own change, so our change is discarded and their
+	//change is loaded instead
+	errs = nexus.Update(func(db *core.Database) errext.ErrorSet {
+		db.Groups[0].LongName = "Overwritten."
+		return nil
+	}, nil)
+	for _, err := range errs {
+		test.ExpectNoError(t, err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	assert.DeepEqual(t, "groups after conflict", nexus.ListGroups(), []core.Group(db2Contents.Groups))
+
+	var payload string
+	err = sqlDB.QueryRow(`SELECT payload FROM portunus_objects WHERE kind = 'group' AND name = 'nobody'`).Scan(&payload)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "group payload after conflict", payload,
+		`{"name":"nobody","long_name":"Still empty.","members":[],"permissions":{"portunus":{"is_admin":false},"ldap":{"can_read":false}}}`)
+	var revision int64
+	err = sqlDB.QueryRow(`SELECT revision FROM portunus_metadata`).Scan(&revision)
+	test.ExpectNoError(t, err)
+	assert.DeepEqual(t, "revision after conflict", revision, int64(3))
+
+	cancel()
+	wg.Wait()
+}
@@ -7,6 +7,7 @@
 package test
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"sort"
@@ -23,6 +24,23 @@ type LDAPConnectionDouble struct {
 	expectedAddRequests    []goldap.AddRequest
 	expectedModifyRequests []goldap.ModifyRequest
 	expectedDeleteRequests []goldap.DelRequest
+	rejectedAddRequests    []goldap.AddRequest
+	expectedSearches       []expectedSearch
+	expectedBinds          []expectedBind
+	reconnectCount         int
+	//The Adapter continues after failed requests, so unexpected requests are
+	//also collected here to be reported by CheckAllExecuted().
+	unexpectedRequests []string
+}
+
+type expectedBind struct {
+	DN       string
+	Password string
+}
+
+type expectedSearch struct {
+	Request goldap.SearchRequest
+	Entries []*goldap.Entry
 }
 
 // NewLDAPConnectionDouble builds an LDAPConnectionDouble.
@@ -37,17 +55,55 @@ func (d *LDAPConnectionDouble) DNSuffix() string {
 
 // Add implements the ldap.Connection interface.
 func (d *LDAPConnectionDouble) Add(req goldap.AddRequest) error {
-	return removeIfExpected[goldap.AddRequest](&d.expectedAddRequests, normalizeAddRequest(req))
+	req = normalizeAddRequest(req)
+	if removeIfExpected[goldap.AddRequest](&d.rejectedAddRequests, req) == nil {
+		return goldap.NewError(goldap.LDAPResultObjectClassViolation, errors.New("rejected by test double"))
+	}
+	return d.recordIfUnexpected(removeIfExpected[goldap.AddRequest](&d.expectedAddRequests, req))
 }
 
 // Modify implements the ldap.Connection interface.
 func (d *LDAPConnectionDouble) Modify(req goldap.ModifyRequest) error {
-	return removeIfExpected[goldap.ModifyRequest](&d.expectedModifyRequests, normalizeModifyRequest(req))
+	return d.recordIfUnexpected(removeIfExpected[goldap.ModifyRequest](&d.expectedModifyRequests, normalizeModifyRequest(req)))
 }
 
 // Delete implements the ldap.Connection interface.
 func (d *LDAPConnectionDouble) Delete(req goldap.DelRequest) error {
-	return removeIfExpected[goldap.DelRequest](&d.expectedDeleteRequests, req)
+	return d.recordIfUnexpected(removeIfExpected[goldap.DelRequest](&d.expectedDeleteRequests, req))
+}
+
+// Search implements the ldap.Connection interface.
+func (d *LDAPConnectionDouble) Search(req goldap.SearchRequest) (*goldap.SearchResult, error) {
+	for idx, s := range d.expectedSearches {
+		if reflect.DeepEqual(s.Request, req) {
+			d.expectedSearches = append(append([]expectedSearch(nil), d.expectedSearches[0:idx]...), d.expectedSearches[idx+1:]...)
+			return &goldap.SearchResult{Entries: s.Entries}, nil
+		}
+	}
+	return nil, d.recordIfUnexpected(fmt.Errorf("unexpected LDAP request:\n\t%#v", req))
+}
+
+// BindAs implements the ldap.Connection interface. Searches on the bound
+// connection are served from the same pool as those sent through Search().
+// Binds that were not announced with ExpectBindAs() fail like a bind with the
+// wrong password would.
+func (d *LDAPConnectionDouble) BindAs(dn, password string, action func(search func(goldap.SearchRequest) (*goldap.SearchResult, error))) error {
+	if removeIfExpected[expectedBind](&d.expectedBinds, expectedBind{dn, password}) != nil {
+		return goldap.NewError(goldap.LDAPResultInvalidCredentials, errors.New("rejected by test double"))
+	}
+	action(d.Search)
+	return nil
+}
+
+// Reconnect implements the ldap.Connection interface.
+func (d *LDAPConnectionDouble) Reconnect() error {
+	d.reconnectCount++
+	return nil
+}
+
+// ReconnectCount returns how often Reconnect() was called.
+func (d *LDAPConnectionDouble) ReconnectCount() int {
+	return d.reconnectCount
 }
 
 func removeIfExpected[R any](pool *[]R, req R) error {
@@ -61,6 +117,13 @@ func removeIfExpected[R any](pool *[]R, req R) error {
 	return fmt.Errorf("unexpected LDAP request:\n\t%#v", req)
 }
 
+func (d *LDAPConnectionDouble) recordIfUnexpected(err error) error {
+	if err != nil {
+		d.unexpectedRequests = append(d.unexpectedRequests, err.Error())
+	}
+	return err
+}
+
 // ExpectAdd records that we expect an AddRequest to be executed via this
 // double after this call returns.
 func (d *LDAPConnectionDouble) ExpectAdd(req goldap.AddRequest) {
@@ -73,6 +136,25 @@ func (d *LDAPConnectionDouble) ExpectModify(req goldap.ModifyRequest) {
 	d.expectedModifyRequests = append(d.expectedModifyRequests, normalizeModifyRequest(req))
 }
 
+// ExpectSearch records that we expect a SearchRequest to be executed via this
+// double after this call returns, and that it shall yield the given entries.
+func (d *LDAPConnectionDouble) ExpectSearch(req goldap.SearchRequest, entries ...*goldap.Entry) {
+	d.expectedSearches = append(d.expectedSearches, expectedSearch{req, entries})
+}
+
+// ExpectBindAs records that we expect a bind with the given credentials via
+// BindAs() after this call returns, and that this bind shall succeed.
+func (d *LDAPConnectionDouble) ExpectBindAs(dn, password string) {
+	d.expectedBinds = append(d.expectedBinds, expectedBind{dn, password})
+}
+
+// ExpectAddAndReject records that we expect an AddRequest to be executed via
+// this double after this call returns, and that this request shall fail like
+// it would if the LDAP server's schema rejected it.
+func (d *LDAPConnectionDouble) ExpectAddAndReject(req goldap.AddRequest) {
+	d.rejectedAddRequests = append(d.rejectedAddRequests, normalizeAddRequest(req))
+}
+
 // ExpectDelete records that we expect an DeleteRequest to be executed via this
 // double after this call returns.
 func (d *LDAPConnectionDouble) ExpectDelete(req goldap.DelRequest) {
@@ -80,10 +162,15 @@ func (d *LDAPConnectionDouble) ExpectDelete(req goldap.DelRequest) {
 }
 
 // CheckAllExecuted fails the test if any of the expected requests that were
-// enqueued with ExpectAdd, ExpectModify or ExpectDelete were not sent before
-// this call.
+// enqueued with ExpectAdd, ExpectModify, ExpectDelete, ExpectSearch or ExpectBindAs were not sent before
+// this call. It also fails the test for each unexpected request that was
+// received since the last call.
 func (d *LDAPConnectionDouble) CheckAllExecuted(t *testing.T) {
 	t.Helper()
+	for _, msg := range d.unexpectedRequests {
+		t.Error(msg)
+	}
+	d.unexpectedRequests = nil
 	for _, req := range d.expectedAddRequests {
 		t.Errorf("did not observe as expected:\n\t%#v", req)
 	}
@@ -96,6 +183,18 @@ func (d *LDAPConnectionDouble) CheckAllExecuted(t *testing.T) {
 		t.Errorf("did not observe as expected:\n\t%#v", req)
 	}
 	d.expectedDeleteRequests = nil
+	for _, req := range d.rejectedAddRequests {
+		t.Errorf("did not observe as expected:\n\t%#v", req)
+	}
+	d.rejectedAddRequests = nil
+	for _, s := range d.expectedSearches {
+		t.Errorf("did not observe as expected:\n\t%#v", s.Request)
+	}
+	d.expectedSearches = nil
+	for _, b := range d.expectedBinds {
+		t.Errorf("did not observe bind as expected: %s", b.DN)
+	}
+	d.expectedBinds = nil
 }
 
 func normalizeAddRequest(req goldap.AddRequest) goldap.AddRequest {
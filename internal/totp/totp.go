@@ -0,0 +1,151 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package totp implements time-based one-time passwords as per RFC 6238, in
+// the variant that is understood by all common authenticator apps: HMAC-SHA1,
+// six digits, and a time step of 30 seconds.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	period     = 30 //seconds
+	digits     = 6
+	secretSize = 20 //bytes, as recommended by RFC 4226 for HMAC-SHA1
+	//When verifying, codes from this many time steps before or after the
+	//current one are also accepted, to account for clock drift and for the
+	//time that the user needs to type the code.
+	allowedSkew = 1
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Key is the shared secret between Portunus and the user's authenticator app.
+type Key struct {
+	Issuer      string
+	AccountName string
+	Secret      []byte
+}
+
+// GenerateKey generates a new Key with a random secret.
+func GenerateKey(issuer, accountName string) (Key, error) {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{issuer, accountName, secret}, nil
+}
+
+// EncodedSecret returns the secret in the base32 encoding that authenticator
+// apps expect when the key is entered manually.
+func (k Key) EncodedSecret() string {
+	return secretEncoding.EncodeToString(k.Secret)
+}
+
+// URL returns this key as an "otpauth://" URL, as understood by
+// authenticator apps.
+func (k Key) URL() string {
+	query := url.Values{
+		"secret":    {k.EncodedSecret()},
+		"issuer":    {k.Issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(digits)},
+		"period":    {strconv.Itoa(period)},
+	}
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + k.Issuer + ":" + k.AccountName,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// ParseKeyURL is the inverse of Key.URL. Keys with parameters that differ
+// from what this package implements are rejected.
+func ParseKeyURL(input string) (Key, error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return Key{}, err
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		return Key{}, errors.New(`expected an URL starting with "otpauth://totp/"`)
+	}
+
+	query := u.Query()
+	for key, expected := range map[string]string{"algorithm": "SHA1", "digits": strconv.Itoa(digits), "period": strconv.Itoa(period)} {
+		value := query.Get(key)
+		if value != "" && value != expected {
+			return Key{}, fmt.Errorf("expected %s=%s, but got %s=%s", key, expected, key, value)
+		}
+	}
+	secret, err := secretEncoding.DecodeString(strings.ToUpper(strings.TrimRight(query.Get("secret"), "=")))
+	if err != nil || len(secret) == 0 {
+		return Key{}, errors.New("missing or malformed secret")
+	}
+
+	var k Key
+	k.Secret = secret
+	label := strings.TrimPrefix(u.Path, "/")
+	k.Issuer, k.AccountName, _ = strings.Cut(label, ":")
+	if k.AccountName == "" {
+		k.Issuer, k.AccountName = "", label
+	}
+	if issuer := query.Get("issuer"); issuer != "" {
+		k.Issuer = issuer
+	}
+	return k, nil
+}
+
+// CodeAt returns the one-time password for the given time.
+func (k Key) CodeAt(t time.Time) string {
+	return k.codeForStep(uint64(t.Unix() / period))
+}
+
+func (k Key) codeForStep(step uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, k.Secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	//dynamic truncation as per RFC 4226, section 5.3
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+// Verify checks whether the given code is valid at the given time.
+func (k Key) Verify(code string, now time.Time) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != digits {
+		return false
+	}
+	step := now.Unix() / period
+	ok := false
+	for offset := int64(-allowedSkew); offset <= allowedSkew; offset++ {
+		expected := k.codeForStep(uint64(step + offset))
+		//not returning early, to not leak the offset through timing
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
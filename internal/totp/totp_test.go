@@ -0,0 +1,85 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestCodeGeneration(t *testing.T) {
+	//test vectors from RFC 6238, appendix B (truncated to 6 digits)
+	key := Key{Secret: []byte("12345678901234567890")}
+	testCases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unixTime, expected := range testCases {
+		actual := key.CodeAt(time.Unix(unixTime, 0))
+		assert.DeepEqual(t, "code", actual, expected)
+	}
+
+	//codes are accepted within one time step of the current time
+	now := time.Unix(1234567890, 0)
+	for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		if !key.Verify(key.CodeAt(now.Add(offset)), now) {
+			t.Errorf("expected code with offset %s to be accepted", offset)
+		}
+	}
+	for _, offset := range []time.Duration{-60 * time.Second, 60 * time.Second} {
+		if key.Verify(key.CodeAt(now.Add(offset)), now) {
+			t.Errorf("expected code with offset %s to be rejected", offset)
+		}
+	}
+	if !key.Verify(" 005 924 ", now) {
+		t.Error("expected code with extra spaces to be accepted")
+	}
+	if key.Verify("", now) {
+		t.Error("expected empty code to be rejected")
+	}
+}
+
+func TestKeyURL(t *testing.T) {
+	key, err := GenerateKey("Portunus", "jane")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	parsed, err := ParseKeyURL(key.URL())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "parsed key", parsed, key)
+
+	//keys from other generators may omit the defaults and the issuer
+	parsed, err = ParseKeyURL("otpauth://totp/jane?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "parsed key", parsed, Key{AccountName: "jane", Secret: []byte("12345678901234567890")})
+
+	errorCases := map[string]string{
+		"otpauth://hotp/jane?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ":                  "expected an URL starting with \"otpauth://totp/\"",
+		"otpauth://totp/jane?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&digits=8":         "expected digits=6, but got digits=8",
+		"otpauth://totp/jane?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&algorithm=SHA256": "expected algorithm=SHA1, but got algorithm=SHA256",
+		"otpauth://totp/jane?secret=not-base32":                                        "missing or malformed secret",
+		"otpauth://totp/jane":                                                          "missing or malformed secret",
+	}
+	for input, expected := range errorCases {
+		_, err := ParseKeyURL(input)
+		if err == nil {
+			t.Errorf("expected ParseKeyURL(%q) to fail, but it succeeded", input)
+		} else if err.Error() != expected {
+			t.Errorf("expected ParseKeyURL(%q) to fail with %q, but got %q", input, expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+* Copyright 2024 Stefan Majewsky <majewsky@gmx.net>
+* SPDX-License-Identifier: GPL-3.0-only
+* Refer to the file "LICENSE" for details.
+*******************************************************************************/
+
+// Package plugins is the extension point for adding custom pages to the
+// Portunus UI without forking the frontend. Portunus' own packages are
+// internal, so this package re-exports the parts of them that plugins need.
+//
+// A plugin is a Go package that calls Register() from its init() function:
+//
+//	package equipment
+//
+//	import (
+//		"net/http"
+//
+//		"github.com/majewsky/portunus/plugins"
+//	)
+//
+//	func init() {
+//		plugins.Register(plugins.Plugin{
+//			Name: "equipment",
+//			Routes: []plugins.Route{{
+//				Method:  "GET",
+//				Path:    "/plugins/equipment",
+//				Handler: getEquipmentHandler,
+//			}},
+//			NavLinks: []plugins.NavLink{{Label: "Equipment", Path: "/plugins/equipment"}},
+//		})
+//	}
+//
+//	func getEquipmentHandler(n plugins.Nexus) http.Handler {
+//		return plugins.Do(
+//			plugins.LoadSession,
+//			plugins.VerifyLogin(n),
+//			plugins.ShowView(func(i *plugins.Interaction) plugins.Page {
+//				return plugins.Page{
+//					Status:   http.StatusOK,
+//					Title:    "Equipment",
+//					Contents: equipmentSnippet.Render(i.CurrentUser),
+//				}
+//			}),
+//		)
+//	}
+//
+// The plugin is compiled into portunus-server by adding a blank import of its
+// package to a new file in cmd/portunus-server/ (see README.md for details).
+//
+// This API is not covered by semantic versioning yet. Breaking changes are
+// announced in the changelog.
+package plugins
+
+import (
+	"github.com/majewsky/portunus/internal/core"
+	"github.com/majewsky/portunus/internal/crypt"
+	"github.com/majewsky/portunus/internal/frontend"
+	h "github.com/majewsky/portunus/internal/html"
+)
+
+// Registration of plugins.
+type (
+	Plugin  = frontend.Plugin
+	Route   = frontend.PluginRoute
+	NavLink = frontend.PluginNavLink
+)
+
+// Register adds a plugin to the Portunus UI. This must be called from an
+// init() function.
+func Register(p Plugin) {
+	frontend.RegisterPlugin(p)
+}
+
+// Building handlers. See the respective functions in the frontend package for
+// documentation.
+type (
+	Handler     = frontend.Handler
+	HandlerStep = frontend.HandlerStep
+	Interaction = frontend.Interaction
+	Page        = frontend.Page
+	Flash       = frontend.Flash
+)
+
+// Building handlers (continued).
+var (
+	Do                       = frontend.Do
+	LoadSession              = frontend.LoadSession
+	SaveSession              = frontend.SaveSession
+	VerifyLogin              = frontend.VerifyLogin
+	TryLoadLogin             = frontend.TryLoadLogin
+	VerifyPermissions        = frontend.VerifyPermissions
+	UseEmptyFormState        = frontend.UseEmptyFormState
+	ReadFormStateFromRequest = frontend.ReadFormStateFromRequest
+	ShowView                 = frontend.ShowView
+	ShowForm                 = frontend.ShowForm
+	ShowFormIfErrors         = frontend.ShowFormIfErrors
+	TryUpdateNexus           = frontend.TryUpdateNexus
+	RedirectTo               = frontend.RedirectTo
+	RedirectWithFlashTo      = frontend.RedirectWithFlashTo
+)
+
+// AdminPermissions can be given to VerifyPermissions() to restrict a handler
+// to users with admin access to Portunus.
+var AdminPermissions = core.Permissions{Portunus: core.PortunusPermissions{IsAdmin: true}}
+
+// Access to the Portunus database.
+type (
+	Nexus          = core.Nexus
+	Database       = core.Database
+	User           = core.User
+	UserWithPerms  = core.UserWithPerms
+	Group          = core.Group
+	Permissions    = core.Permissions
+	ObjectRef      = core.ObjectRef
+	PasswordHasher = crypt.PasswordHasher
+)
+
+// Rendering HTML.
+type (
+	Snippet          = h.Snippet
+	FormSpec         = h.FormSpec
+	FormState        = h.FormState
+	FormField        = h.FormField
+	FieldState       = h.FieldState
+	FieldSet         = h.FieldSet
+	InputFieldSpec   = h.InputFieldSpec
+	StaticField      = h.StaticField
+	SelectFieldSpec  = h.SelectFieldSpec
+	SelectOptionSpec = h.SelectOptionSpec
+)
+
+// NewSnippet parses a HTML template. See the html package for details.
+var NewSnippet = h.NewSnippet